@@ -0,0 +1,332 @@
+package mawt
+
+// This module implements the ambient light sensor that scales the brightness of
+// the frames, so that the portal stays visible in daylight without being
+// blinding at night.  TSL2561 and BH1750 sensors are read directly over I2C,
+// other sensors can be used through a file, such as the illuminance reported
+// by a Linux IIO driver, or a command printing the light level in lux.  The
+// level is smoothed so that a passing shadow does not make the LEDs flicker
+
+import (
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	i2cSlave = 0x0703 // The ioctl selecting the address of the device on an I2C bus
+)
+
+// AmbientConfig defines the light sensor and how the light level maps onto the brightness
+//
+type AmbientConfig struct {
+	Sensor    string        `yaml:"sensor" json:"sensor"`       // bh1750, tsl2561, file or command
+	Bus       string        `yaml:"bus" json:"bus"`             // The I2C bus device, defaults to /dev/i2c-1
+	Address   int           `yaml:"address" json:"address"`     // The I2C address, defaults to 0x23 for the bh1750 and 0x39 for the tsl2561
+	Path      string        `yaml:"path" json:"path"`           // The file the light level in lux is read from
+	Command   string        `yaml:"command" json:"command"`     // The shell command printing the light level in lux
+	Interval  time.Duration `yaml:"interval" json:"interval"`   // The time between readings, defaults to 1s
+	Smoothing time.Duration `yaml:"smoothing" json:"smoothing"` // The time taken to follow a change in the light, defaults to 10s
+	Dark      float64       `yaml:"dark" json:"dark"`           // The light level in lux at or below which the minimum brightness is used, defaults to 10
+	Bright    float64       `yaml:"bright" json:"bright"`       // The light level in lux at or above which the maximum brightness is used, defaults to 10000
+	Min       float64       `yaml:"min" json:"min"`             // The brightness in the dark, defaults to 0.2
+	Max       float64       `yaml:"max" json:"max"`             // The brightness in daylight, defaults to 1
+}
+
+// Ambient reads a light sensor and computes the brightness for the light level
+//
+type Ambient struct {
+	config   AmbientConfig
+	reader   func() (lux float64, err errors.Error)
+	lux      float64   // The smoothed light level
+	raw      float64   // The last reading
+	read     time.Time // When the last reading was taken, zero before the first
+	failures *ErrorSummary
+	lastErr  string
+	sync.Mutex
+}
+
+// AmbientReport describes the light level and the brightness used for it
+//
+type AmbientReport struct {
+	Sensor    string    `json:"sensor"`
+	Lux       float64   `json:"lux"`    // The smoothed light level
+	RawLux    float64   `json:"rawLux"` // The last reading
+	Level     float64   `json:"level"`  // The brightness applied to the frames
+	Read      time.Time `json:"read"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// NewAmbient validates the configuration of the light sensor, supplying the defaults
+//
+func NewAmbient(config AmbientConfig) (ambient *Ambient, err errors.Error) {
+	ambient = &Ambient{failures: NewErrorSummary(errorSummaryInterval)}
+
+	if len(config.Bus) == 0 {
+		config.Bus = "/dev/i2c-1"
+	}
+	switch config.Sensor {
+	case "bh1750":
+		if config.Address == 0 {
+			config.Address = 0x23
+		}
+		ambient.reader = ambient.readBH1750
+	case "tsl2561":
+		if config.Address == 0 {
+			config.Address = 0x39
+		}
+		ambient.reader = ambient.readTSL2561
+	case "file":
+		if len(config.Path) == 0 {
+			return nil, errors.New("the ambient file sensor needs a path").With("stack", stack.Trace().TrimRuntime())
+		}
+		ambient.reader = ambient.readFile
+	case "command":
+		if len(config.Command) == 0 {
+			return nil, errors.New("the ambient command sensor needs a command").With("stack", stack.Trace().TrimRuntime())
+		}
+		ambient.reader = ambient.readCommand
+	default:
+		return nil, errors.New("unknown ambient light sensor, bh1750, tsl2561, file and command are supported").With("sensor", config.Sensor).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Address < 0 || config.Address > 0x7F {
+		return nil, errors.New("I2C addresses must be from 0 to 0x7f").With("address", config.Address).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if config.Interval < 0 || config.Smoothing < 0 {
+		return nil, errors.New("the ambient interval and smoothing cannot be negative").With("interval", config.Interval).With("smoothing", config.Smoothing).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second
+	}
+	if config.Smoothing == 0 {
+		config.Smoothing = 10 * time.Second
+	}
+
+	if config.Dark < 0 || config.Bright < 0 {
+		return nil, errors.New("the ambient light levels cannot be negative").With("dark", config.Dark).With("bright", config.Bright).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Dark == 0 {
+		config.Dark = 10
+	}
+	if config.Bright == 0 {
+		config.Bright = 10000
+	}
+	if config.Bright <= config.Dark {
+		return nil, errors.New("the bright light level must be above the dark light level").With("dark", config.Dark).With("bright", config.Bright).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if config.Min == 0 {
+		config.Min = 0.2
+	}
+	if config.Max == 0 {
+		config.Max = 1
+	}
+	if config.Min < 0 || config.Max > 1 || config.Min > config.Max {
+		return nil, errors.New("the ambient brightness must be from 0 to 1 with the min no more than the max").With("min", config.Min).With("max", config.Max).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	ambient.config = config
+	return ambient, nil
+}
+
+// Start reads the sensor at the configured interval until the quit channel is closed
+//
+func (ambient *Ambient) Start(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	poll := &sensorPoll{
+		name:     "ambient",
+		sensor:   ambient.config.Sensor,
+		interval: ambient.config.Interval,
+		failures: ambient.failures,
+		read:     ambient.reader,
+		apply:    ambient.apply,
+		failed:   ambient.failed,
+	}
+	poll.start(errorC, quitC)
+}
+
+// failed records the error of a reading, the last light level continuing to be used
+//
+func (ambient *Ambient) failed(err errors.Error) {
+	ambient.Lock()
+	defer ambient.Unlock()
+
+	ambient.lastErr = err.Error()
+}
+
+// apply folds a reading into the smoothed light level, the first reading is used
+// as it is
+//
+func (ambient *Ambient) apply(lux float64, now time.Time) {
+	ambient.Lock()
+	defer ambient.Unlock()
+
+	if ambient.read.IsZero() {
+		ambient.lux = lux
+	} else {
+		weight := 1 - math.Exp(-float64(now.Sub(ambient.read))/float64(ambient.config.Smoothing))
+		ambient.lux += (lux - ambient.lux) * weight
+	}
+	ambient.raw = lux
+	ambient.read = now
+	ambient.lastErr = ""
+}
+
+// level maps a light level onto the brightness, the perceived brightness of the
+// surroundings following the logarithm of the light level
+//
+func (ambient *Ambient) level(lux float64) (level float64) {
+	config := ambient.config
+	share := (math.Log(math.Max(lux, config.Dark)) - math.Log(config.Dark)) / (math.Log(config.Bright) - math.Log(config.Dark))
+	return config.Min + (config.Max-config.Min)*math.Min(share, 1)
+}
+
+// Level returns the brightness for the current light level, the maximum being used
+// until the sensor has been read
+//
+func (ambient *Ambient) Level() (level float64) {
+	ambient.Lock()
+	defer ambient.Unlock()
+
+	if ambient.read.IsZero() {
+		return ambient.config.Max
+	}
+	return ambient.level(ambient.lux)
+}
+
+// Report returns the light level and the brightness used for it
+//
+func (ambient *Ambient) Report() (report AmbientReport) {
+	level := ambient.Level()
+
+	ambient.Lock()
+	defer ambient.Unlock()
+
+	return AmbientReport{
+		Sensor:    ambient.config.Sensor,
+		Lux:       ambient.lux,
+		RawLux:    ambient.raw,
+		Level:     level,
+		Read:      ambient.read,
+		LastError: ambient.lastErr,
+	}
+}
+
+// i2c opens the bus and selects the address of the sensor
+//
+func (ambient *Ambient) i2c() (bus *os.File, err errors.Error) {
+	bus, errGo := os.OpenFile(ambient.config.Bus, os.O_RDWR, 0)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("bus", ambient.config.Bus).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = unix.IoctlSetInt(int(bus.Fd()), i2cSlave, ambient.config.Address); errGo != nil {
+		bus.Close()
+		return nil, errors.Wrap(errGo).With("bus", ambient.config.Bus).With("address", ambient.config.Address).With("stack", stack.Trace().TrimRuntime())
+	}
+	return bus, nil
+}
+
+// i2cTransfer writes a command to the sensor and reads the reply
+//
+func (ambient *Ambient) i2cTransfer(command []byte, reply []byte, wait time.Duration) (err errors.Error) {
+	bus, err := ambient.i2c()
+	if err != nil {
+		return err
+	}
+	defer bus.Close()
+
+	if _, errGo := bus.Write(command); errGo != nil {
+		return errors.Wrap(errGo).With("bus", ambient.config.Bus).With("address", ambient.config.Address).With("stack", stack.Trace().TrimRuntime())
+	}
+	time.Sleep(wait)
+	if len(reply) == 0 {
+		return nil
+	}
+	if _, errGo := bus.Read(reply); errGo != nil {
+		return errors.Wrap(errGo).With("bus", ambient.config.Bus).With("address", ambient.config.Address).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// readBH1750 takes a one time high resolution measurement
+//
+func (ambient *Ambient) readBH1750() (lux float64, err errors.Error) {
+	reply := make([]byte, 2)
+	if err = ambient.i2cTransfer([]byte{0x20}, reply, 180*time.Millisecond); err != nil {
+		return 0, err
+	}
+	return float64(uint16(reply[0])<<8|uint16(reply[1])) / 1.2, nil
+}
+
+// readTSL2561 powers the sensor up and reads both channels, converting them to lux
+// using the approximation from the datasheet.  The default integration time of
+// 402ms and the low gain are used so that daylight does not saturate the sensor
+//
+func (ambient *Ambient) readTSL2561() (lux float64, err errors.Error) {
+	if err = ambient.i2cTransfer([]byte{0x80, 0x03}, nil, 410*time.Millisecond); err != nil {
+		return 0, err
+	}
+	channels := [2]float64{}
+	for i, register := range []byte{0xAC, 0xAE} {
+		reply := make([]byte, 2)
+		if err = ambient.i2cTransfer([]byte{register}, reply, 0); err != nil {
+			return 0, err
+		}
+		raw := uint16(reply[1])<<8 | uint16(reply[0])
+		if raw == 0xFFFF {
+			// Saturated, which only happens in direct sunlight
+			return ambient.config.Bright, nil
+		}
+		// The datasheet approximation assumes the high gain of 16x
+		channels[i] = float64(raw) * 16
+	}
+
+	ch0, ch1 := channels[0], channels[1]
+	if ch0 == 0 {
+		return 0, nil
+	}
+	switch ratio := ch1 / ch0; {
+	case ratio <= 0.5:
+		lux = 0.0304*ch0 - 0.062*ch0*math.Pow(ratio, 1.4)
+	case ratio <= 0.61:
+		lux = 0.0224*ch0 - 0.031*ch1
+	case ratio <= 0.8:
+		lux = 0.0128*ch0 - 0.0153*ch1
+	case ratio <= 1.3:
+		lux = 0.00146*ch0 - 0.00112*ch1
+	default:
+		lux = 0
+	}
+	return math.Max(lux, 0), nil
+}
+
+// checkLux rejects the negative light levels a misbehaving sensor can report
+//
+func checkLux(reading float64, readErr errors.Error) (lux float64, err errors.Error) {
+	if readErr != nil {
+		return 0, readErr
+	}
+	if reading < 0 {
+		return 0, errors.New("light level out of range").With("lux", reading).With("stack", stack.Trace().TrimRuntime())
+	}
+	return reading, nil
+}
+
+// readFile reads the light level from a file, for example
+// /sys/bus/iio/devices/iio:device0/in_illuminance_input
+//
+func (ambient *Ambient) readFile() (lux float64, err errors.Error) {
+	return checkLux(readSensorFile(ambient.config.Path))
+}
+
+// readCommand runs a shell command that prints the light level, the command must
+// finish within the interval between readings
+//
+func (ambient *Ambient) readCommand() (lux float64, err errors.Error) {
+	return checkLux(readSensorCommand(ambient.config.Command, ambient.config.Interval))
+}
@@ -7,8 +7,11 @@ package mawt
 // to the fadecandy server interface
 
 import (
+	"image/color"
+	"sync"
 	"time"
 
+	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 
 	"github.com/TeamNorCal/animation"
@@ -16,9 +19,39 @@ import (
 	"github.com/TeamNorCal/mawt/model"
 )
 
+var (
+	waitingColor = color.RGBA{0x40, 0x40, 0x40, 0xFF}
+)
+
+const (
+	waitingSweep = 2 * time.Second // The time the waiting pattern takes to travel along a strand
+
+	// animatedFields are the fields of a status the portal animations are drawn from,
+	// the shaft windows from the faction and level and the resonator strands from
+	// the resonators
+	animatedFields = ChangeFaction | ChangeLevel | ChangeResonators
+)
+
+// statusSink applies the portal statuses to the animations.  Statuses are applied by
+// the goroutine polling the status while frames are drawn by the render loop, the
+// mutex guarding the state shared between the two
+//
 type statusSink struct {
-	statusC chan *model.PortalStatus
-	portal  animationModel.Portal
+	statusC  chan *model.PortalStatus
+	portal   animationModel.Portal
+	received bool                         // Set once a usable portal status has been applied
+	faction  string                       // The faction of the last portal status applied
+	waiting  []animationModel.ChannelData // The buffers for the waiting pattern, used only by the render loop
+	started  time.Time                    // The time of the first frame, the waiting pattern sweeps from it
+	static   []animationModel.ChannelData // The buffers for the static faction color drawn in safe mode
+	sync.Mutex
+}
+
+// staticSource draws the static color of the faction of the portal in place of the
+// portal animations, used in safe mode
+//
+type staticSource struct {
+	sink *statusSink
 }
 
 func NewSink() (sink *statusSink) {
@@ -28,11 +61,115 @@ func NewSink() (sink *statusSink) {
 	}
 }
 
+// UpdateStatus applies a portal status to the animations.  Statuses that are missing,
+// or that have no faction because they could not be parsed, are ignored
+//
 func (sink *statusSink) UpdateStatus(status *model.Status) (err errors.Error) {
+	return sink.UpdateFields(status, ChangeAll)
+}
+
+// UpdateFields applies a portal status of which only the fields in the mask changed.
+// Changes to fields the animations are not drawn from leave them untouched, other
+// statuses are given to the portal animations whole, the animation package
+// comparing them with the status it last drew to decide which layers to start again
+//
+func (sink *statusSink) UpdateFields(status *model.Status, mask ChangeMask) (err errors.Error) {
+	if status == nil || len(status.Faction) == 0 {
+		return errors.New("portal status not available").With("stack", stack.Trace().TrimRuntime())
+	}
+	sink.Lock()
+	sink.faction = status.Faction
+	received := sink.received
+	sink.Unlock()
+	if received && mask&animatedFields == 0 {
+		return nil
+	}
 	sink.portal.UpdateFromCanonicalStatus(status)
+
+	sink.Lock()
+	sink.received = true
+	sink.Unlock()
 	return nil
 }
 
+// state returns whether a usable portal status has been applied, along with the
+// faction of the last status applied
+//
+func (sink *statusSink) state() (received bool, faction string) {
+	sink.Lock()
+	defer sink.Unlock()
+
+	return sink.received, sink.faction
+}
+
+// GetFrame renders the animations at the supplied time, or the waiting pattern
+// when no portal status has yet been received
+//
 func (sink *statusSink) GetFrame(tm time.Time) []animationModel.ChannelData {
-	return sink.portal.GetFrame(tm)
+	frame := sink.portal.GetFrame(tm)
+	if received, _ := sink.state(); received {
+		return frame
+	}
+	return sink.waitingFrame(frame, tm)
+}
+
+// waitingFrame draws the waiting pattern, a dim grey dot with a fading tail that
+// sweeps along every strand, using the strands and lengths of the animation frame
+//
+func (sink *statusSink) waitingFrame(frame []animationModel.ChannelData, tm time.Time) (waiting []animationModel.ChannelData) {
+	if sink.started.IsZero() {
+		sink.started = tm
+	}
+	sweep := int64(tm.Sub(sink.started) % waitingSweep)
+	if len(sink.waiting) != len(frame) {
+		sink.waiting = make([]animationModel.ChannelData, len(frame))
+	}
+	for i, channelData := range frame {
+		data := sink.waiting[i].Data
+		if len(data) != len(channelData.Data) {
+			data = make([]color.RGBA, len(channelData.Data))
+		}
+		for j := range data {
+			data[j] = color.RGBA{}
+		}
+		if len(data) != 0 {
+			head := int(int64(len(data)) * sweep / int64(waitingSweep))
+			for tail := 0; tail != 4 && tail <= head; tail++ {
+				scale := func(value uint8) uint8 { return value >> uint(tail) }
+				data[head-tail] = color.RGBA{scale(waitingColor.R), scale(waitingColor.G), scale(waitingColor.B), 0xFF}
+			}
+		}
+		sink.waiting[i] = animationModel.ChannelData{ChannelNum: channelData.ChannelNum, Data: data}
+	}
+	return sink.waiting
+}
+
+// GetFrame draws every pixel in the color of the faction of the portal, or the
+// waiting pattern when no portal status has yet been received.  The strands and
+// their lengths are taken from the first frame of the portal animations, which are
+// not run again
+//
+func (source staticSource) GetFrame(tm time.Time) []animationModel.ChannelData {
+	sink := source.sink
+	if len(sink.static) == 0 {
+		frame := sink.portal.GetFrame(tm)
+		sink.static = make([]animationModel.ChannelData, len(frame))
+		for i, channelData := range frame {
+			sink.static[i] = animationModel.ChannelData{ChannelNum: channelData.ChannelNum, Data: make([]color.RGBA, len(channelData.Data))}
+		}
+	}
+	received, faction := sink.state()
+	if !received {
+		return sink.waitingFrame(sink.static, tm)
+	}
+	c, isKnown := timelineColors[faction]
+	if !isKnown {
+		c = timelineColors["N"]
+	}
+	for _, channelData := range sink.static {
+		for i := range channelData.Data {
+			channelData.Data[i] = c
+		}
+	}
+	return sink.static
 }
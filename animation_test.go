@@ -0,0 +1,89 @@
+package mawt
+
+import (
+	"encoding/json"
+	"image/color"
+	"testing"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt/model"
+)
+
+// checkWaiting checks a frame shows the waiting pattern with its head at the pixel
+// given as a fraction of the length of each strand
+//
+func checkWaiting(t *testing.T, frame []animationModel.ChannelData, head float64) {
+	t.Helper()
+
+	if len(frame) == 0 {
+		t.Fatal("the waiting pattern has no strands")
+	}
+	for _, strand := range frame {
+		if len(strand.Data) == 0 {
+			continue
+		}
+		at := int(float64(len(strand.Data)) * head)
+		for i, pixel := range strand.Data {
+			want := color.RGBA{}
+			if i <= at && at-i < 4 {
+				shift := uint(at - i)
+				want = color.RGBA{waitingColor.R >> shift, waitingColor.G >> shift, waitingColor.B >> shift, 0xFF}
+			}
+			if pixel != want {
+				t.Fatalf("strand %d pixel %d is %v, the waiting pattern wants %v", strand.ChannelNum, i, pixel, want)
+			}
+		}
+	}
+}
+
+func TestSinkWaitingWithoutStatus(t *testing.T) {
+	unparsed := &model.Status{}
+	if errGo := json.Unmarshal([]byte(`{"Title": "Shaft", "controllingFaction": 7}`), unparsed); errGo == nil {
+		t.Fatal("the malformed status was parsed")
+	}
+
+	tests := []struct {
+		name   string
+		status *model.Status
+	}{
+		{name: "never polled", status: nil},
+		{name: "empty faction", status: &model.Status{Title: "Shaft", Level: 5, Health: 100}},
+		{name: "parse failure", status: unparsed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := NewSink()
+			if err := sink.UpdateStatus(test.status); err == nil {
+				t.Fatal("an unusable status was accepted")
+			}
+
+			start := time.Now()
+			checkWaiting(t, sink.GetFrame(start), 0)
+			checkWaiting(t, sink.GetFrame(start.Add(waitingSweep/2)), 0.5)
+
+			if sink.received {
+				t.Fatal("the sink was marked as having received a status")
+			}
+		})
+	}
+}
+
+func TestSinkStopsWaiting(t *testing.T) {
+	sink := NewSink()
+	start := time.Now()
+	sink.GetFrame(start)
+
+	status := &model.Status{Title: "Shaft", Faction: "E", Level: 5, Health: 100}
+	if err := sink.UpdateStatus(status); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !sink.received {
+		t.Fatal("a usable status was not applied")
+	}
+	frame := sink.GetFrame(start.Add(time.Second))
+	if len(frame) != 0 && len(sink.waiting) != 0 && &frame[0] == &sink.waiting[0] {
+		t.Fatal("the waiting pattern is drawn after a usable status was applied")
+	}
+}
@@ -0,0 +1,282 @@
+package mawt
+
+// This module implements the arbitration between the portals of a pipeline
+// that share its display.  By default only the home portal is shown, the
+// other policies show the first available portal of a priority list, the
+// portal that changed most recently, or cycle through the portals showing
+// each for a dwell time
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ArbitrationConfig selects the policy deciding which portal is displayed
+//
+type ArbitrationConfig struct {
+	Policy   string        `yaml:"policy" json:"policy"`     // home, priority, recent or cycle, home when empty
+	Priority []string      `yaml:"priority" json:"priority"` // The tecthulhu URLs in order of preference, for the priority policy
+	Dwell    time.Duration `yaml:"dwell" json:"dwell"`       // The time each portal is shown, for the cycle policy, defaults to 10s
+	Stale    time.Duration `yaml:"stale" json:"stale"`       // Portals with no status for this long are not displayed, defaults to a minute
+	Debounce int           `yaml:"debounce" json:"debounce"` // Polls a change of faction must persist for before it is displayed, 0 or 1 displays changes at once
+}
+
+type arbitrated struct {
+	url      string
+	home     bool
+	status   *model.Status
+	revision uint64    // The revision of the status given by its poller, 0 when the source does not count changes
+	seen     time.Time // When the last status was received
+	changed  time.Time // When the status last showed the portal changing
+
+	pending string // A changed faction not yet seen for enough polls to be displayed
+	polls   int    // The consecutive polls the pending faction has been seen for
+}
+
+// Arbiter decides which of the portals of a pipeline is displayed
+//
+type Arbiter struct {
+	config    ArbitrationConfig
+	pipeline  string
+	portals   map[string]*arbitrated
+	order     []string // Portals in the order they were first seen, used for cycling
+	displayed string   // The URL of the portal being displayed
+	since     time.Time
+	sync.Mutex
+}
+
+// DisplayState reports the portal being displayed by a pipeline
+//
+type DisplayState struct {
+	Policy    string    `json:"policy"`
+	Displayed string    `json:"displayed"`
+	Since     time.Time `json:"since"`
+	Portals   []string  `json:"portals"`
+}
+
+// NewArbiter validates an arbitration policy and creates an arbiter for it
+//
+func NewArbiter(config ArbitrationConfig) (arbiter *Arbiter, err errors.Error) {
+	switch config.Policy {
+	case "":
+		config.Policy = "home"
+	case "home", "recent", "cycle":
+	case "priority":
+		if len(config.Priority) == 0 {
+			return nil, errors.New("the priority arbitration policy needs a list of tecthulhu URLs").With("stack", stack.Trace().TrimRuntime())
+		}
+	default:
+		return nil, errors.New("unknown arbitration policy, home, priority, recent and cycle are supported").With("policy", config.Policy).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Dwell <= 0 {
+		config.Dwell = 10 * time.Second
+	}
+	if config.Stale <= 0 {
+		config.Stale = time.Minute
+	}
+	if config.Debounce < 0 {
+		return nil, errors.New("the debounce poll count cannot be negative").With("debounce", config.Debounce).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &Arbiter{
+		config:  config,
+		portals: map[string]*arbitrated{},
+		order:   []string{},
+	}, nil
+}
+
+// Offer records a status received from a portal, returning the status to display
+// when the display needs to be updated
+//
+func (arbiter *Arbiter) Offer(msg *model.PortalMsg, now time.Time) (show *model.Status) {
+	arbiter.Lock()
+	defer arbiter.Unlock()
+
+	url := msg.URL
+	// Statuses published without a URL can only be told apart by whether they
+	// come from the home portal
+	if len(url) == 0 {
+		url = "other"
+		if msg.Home {
+			url = "home"
+		}
+	}
+
+	portal, isPresent := arbiter.portals[url]
+	if !isPresent {
+		portal = &arbitrated{url: url}
+		arbiter.portals[url] = portal
+		arbiter.order = append(arbiter.order, url)
+	}
+	portal.home = msg.Home
+	portal.seen = now
+	shown := arbiter.debounce(portal, &msg.Status, now)
+	if portal.status == nil || len(deriveEvents(portal.status, shown, msg.Home, now)) != 0 {
+		portal.changed = now
+	}
+	portal.status = shown.DeepCopy()
+	portal.revision = msg.Revision
+
+	if arbiter.choose(now) || arbiter.displayed == url {
+		return arbiter.portals[arbiter.displayed].status.DeepCopy()
+	}
+	return nil
+}
+
+// debounce returns the status of a portal to be displayed.  A change of faction, such
+// as a momentary neutral, is held back by displaying the status with the faction it
+// replaces until the change has been seen for the debounce count of consecutive polls,
+// changes that revert sooner being reported as glitches.  The rest of the status, such
+// as the health, is displayed at once
+//
+func (arbiter *Arbiter) debounce(portal *arbitrated, status *model.Status, now time.Time) (shown *model.Status) {
+	if arbiter.config.Debounce <= 1 || portal.status == nil {
+		return status
+	}
+	if status.Faction == portal.status.Faction {
+		if len(portal.pending) != 0 {
+			bus.Publish(TopicEvents, Event{Time: now, Pipeline: arbiter.pipeline, Portal: portal.url, Home: portal.home, Kind: "glitch",
+				Detail: fmt.Sprintf("faction %s ignored after %d of %d polls", portal.pending, portal.polls, arbiter.config.Debounce)})
+			portal.pending, portal.polls = "", 0
+		}
+		return status
+	}
+
+	if portal.pending != status.Faction {
+		portal.pending, portal.polls = status.Faction, 0
+	}
+	portal.polls++
+	if portal.polls < arbiter.config.Debounce {
+		shown = status.DeepCopy()
+		shown.Faction = portal.status.Faction
+		return shown
+	}
+	portal.pending, portal.polls = "", 0
+	return status
+}
+
+// Tick re-evaluates the policy, returning the status to display when the portal
+// displayed changes without a status being received
+//
+func (arbiter *Arbiter) Tick(now time.Time) (show *model.Status) {
+	arbiter.Lock()
+	defer arbiter.Unlock()
+
+	if arbiter.choose(now) {
+		return arbiter.portals[arbiter.displayed].status.DeepCopy()
+	}
+	return nil
+}
+
+// choose applies the policy, returning true when a different portal is to be displayed
+//
+func (arbiter *Arbiter) choose(now time.Time) (switched bool) {
+	live := func(url string) bool {
+		portal, isPresent := arbiter.portals[url]
+		return isPresent && now.Sub(portal.seen) < arbiter.config.Stale
+	}
+
+	home := ""
+	for _, url := range arbiter.order {
+		if arbiter.portals[url].home {
+			home = url
+		}
+	}
+
+	choice := ""
+	switch arbiter.config.Policy {
+	case "priority":
+		for _, url := range arbiter.config.Priority {
+			if live(url) {
+				choice = url
+				break
+			}
+		}
+	case "recent":
+		for _, url := range arbiter.order {
+			if live(url) && (len(choice) == 0 || arbiter.portals[url].changed.After(arbiter.portals[choice].changed)) {
+				choice = url
+			}
+		}
+	case "cycle":
+		choice = arbiter.displayed
+		if !live(choice) || now.Sub(arbiter.since) >= arbiter.config.Dwell {
+			// Move on to the next live portal after the one displayed
+			start := 0
+			for i, url := range arbiter.order {
+				if url == arbiter.displayed {
+					start = i + 1
+				}
+			}
+			choice = ""
+			for i := range arbiter.order {
+				if url := arbiter.order[(start+i)%len(arbiter.order)]; live(url) {
+					choice = url
+					break
+				}
+			}
+			if len(choice) != 0 && choice == arbiter.displayed {
+				// The only live portal continues to be displayed for another dwell
+				arbiter.since = now
+			}
+		}
+	}
+	// The home portal is displayed when the policy has no live portal to offer
+	if len(choice) == 0 {
+		choice = home
+	}
+
+	if len(choice) == 0 || choice == arbiter.displayed {
+		return false
+	}
+	arbiter.displayed = choice
+	arbiter.since = now
+	componentLog(LogDecoder).Info("portal displayed", "pipeline", arbiter.pipeline, "portal", choice, "policy", arbiter.config.Policy)
+	if arbiter.config.Policy != "home" {
+		bus.Publish(TopicEvents, Event{Time: now, Pipeline: arbiter.pipeline, Portal: choice, Home: arbiter.portals[choice].home, Kind: "display", Detail: arbiter.config.Policy})
+	}
+	return true
+}
+
+// SetHome makes a portal the home portal, displayed when the policy has no other portal
+// to offer, without waiting for the next status from the portals
+//
+func (arbiter *Arbiter) SetHome(url string) {
+	arbiter.Lock()
+	defer arbiter.Unlock()
+
+	for key, portal := range arbiter.portals {
+		portal.home = key == url
+	}
+}
+
+// Revision returns the portal being displayed along with the revision of its status,
+// 0 when the source of the status does not count its changes
+//
+func (arbiter *Arbiter) Revision() (url string, revision uint64) {
+	arbiter.Lock()
+	defer arbiter.Unlock()
+
+	if portal, isPresent := arbiter.portals[arbiter.displayed]; isPresent {
+		return arbiter.displayed, portal.revision
+	}
+	return arbiter.displayed, 0
+}
+
+// State returns the portal being displayed
+//
+func (arbiter *Arbiter) State() (state DisplayState) {
+	arbiter.Lock()
+	defer arbiter.Unlock()
+
+	return DisplayState{
+		Policy:    arbiter.config.Policy,
+		Displayed: arbiter.displayed,
+		Since:     arbiter.since,
+		Portals:   append([]string{}, arbiter.order...),
+	}
+}
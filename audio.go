@@ -34,8 +34,41 @@ import (
 
 var (
 	audioDir = flag.String("audioDir", "assets/sounds", "The directory in which the audio aiff formatted event files can be found")
+
+	// audioLatency is the time between a sound being queued and it being heard
+	audioLatency = struct {
+		latency time.Duration
+		sync.Mutex
+	}{latency: DefaultAudioLatency}
+)
+
+const (
+	DefaultAudioLatency = 100 * time.Millisecond
+
+	// cueBuffers is the number of blocks of sound queued ahead of the audio device on
+	// the stream of the cues, kept short so that a cue is not heard late
+	cueBuffers = 2
 )
 
+// SetAudioLatency sets the time between a sound being queued and it being heard,
+// audio cues are queued early to compensate
+//
+func SetAudioLatency(latency time.Duration) {
+	audioLatency.Lock()
+	defer audioLatency.Unlock()
+
+	audioLatency.latency = latency
+}
+
+// AudioLatency returns the time between a sound being queued and it being heard
+//
+func AudioLatency() (latency time.Duration) {
+	audioLatency.Lock()
+	defer audioLatency.Unlock()
+
+	return audioLatency.latency
+}
+
 func InitAudio(ambientC <-chan string, sfxC <-chan []string, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
 
 	go runAudio(ambientC, sfxC, errorC, quitC)
@@ -44,9 +77,10 @@ func InitAudio(ambientC <-chan string, sfxC <-chan []string, errorC chan<- error
 }
 
 type effects struct {
-	wakeup chan struct{}
-	sfxs   []string
-	stream alsa.AudioStream
+	wakeup  chan struct{}
+	sfxs    []string
+	stream  alsa.AudioStream
+	running bool // Set while the sound effects are being played
 	sync.Mutex
 }
 
@@ -57,6 +91,21 @@ var (
 	}
 )
 
+// cueStream plays the audio cues of shows on a stream of their own, so that they are
+// not held up by the sound effects of the portal.  A cue stops any cue still playing
+//
+type cueStream struct {
+	playC   chan string // The file of the cue to be played next
+	running bool        // Set while cues can be played
+	sync.Mutex
+}
+
+var (
+	cuePlayer = cueStream{
+		playC: make(chan string, 1),
+	}
+)
+
 func reportError(err errors.Error, errorC chan<- errors.Error) {
 	select {
 	case errorC <- err:
@@ -112,6 +161,7 @@ func (sfxs *effects) playback(quitC <-chan struct{}) (err errors.Error) {
 }
 
 func playSFX(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	defer track("audio sfx")()
 	//Open ALSA pipe
 	controlC := make(chan bool)
 	//Create stream
@@ -125,8 +175,13 @@ func playSFX(errorC chan<- errors.Error, quitC <-chan struct{}) {
 
 	streamC <- sfxs.stream
 
+	sfxs.Lock()
+	sfxs.running = true
+	sfxs.Unlock()
+
 	defer func() {
 		sfxs.Lock()
+		sfxs.running = false
 		close(sfxs.wakeup)
 		sfxs.Unlock()
 	}()
@@ -153,6 +208,110 @@ func playSFX(errorC chan<- errors.Error, quitC <-chan struct{}) {
 	}
 }
 
+// PlayCue plays a sound effect at once on the stream of the audio cues, used by the
+// audio cues of shows which need the sound to be heard promptly.  Sound effects of the
+// portal being played do not delay it, while a cue still playing is cut short
+//
+func PlayCue(sound string) (err errors.Error) {
+	fp := filepath.Join(*audioDir, sound+".aiff")
+	if _, errGo := os.Stat(fp); errGo != nil {
+		return errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	cuePlayer.Lock()
+	defer cuePlayer.Unlock()
+
+	if !cuePlayer.running {
+		return errors.New("audio is not running").With("sound", sound).With("stack", stack.Trace().TrimRuntime())
+	}
+	select {
+	case cuePlayer.playC <- fp:
+	default:
+		return errors.New("another audio cue is waiting to be played").With("sound", sound).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func playCues(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	defer track("audio cues")()
+	//Open ALSA pipe
+	controlC := make(chan bool)
+	//Create stream
+	streamC := alsa.Init(controlC)
+
+	stream := alsa.AudioStream{Channels: 2,
+		Rate:         int(44100),
+		SampleFormat: alsa.INT16_TYPE,
+		DataStream:   make(chan alsa.AudioData, cueBuffers),
+	}
+
+	streamC <- stream
+
+	cuePlayer.Lock()
+	cuePlayer.running = true
+	cuePlayer.Unlock()
+
+	defer func() {
+		cuePlayer.Lock()
+		cuePlayer.running = false
+		cuePlayer.Unlock()
+	}()
+
+	fp := ""
+	for {
+		if len(fp) == 0 {
+			select {
+			case fp = <-cuePlayer.playC:
+			case <-quitC:
+				return
+			}
+		}
+		next, err := playCue(fp, stream, quitC)
+		if err != nil {
+			reportError(err, errorC)
+		}
+		fp = next
+
+		select {
+		case <-quitC:
+			return
+		default:
+		}
+	}
+}
+
+// playCue writes the sound of a cue to the stream of the cues, returning the file of
+// a cue played before it finished so that the new cue is played at once
+//
+func playCue(fp string, stream alsa.AudioStream, quitC <-chan struct{}) (next string, err errors.Error) {
+	file, errGo := os.Open(fp)
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer file.Close()
+
+	data := make([]byte, 8192)
+
+	for {
+		data = data[:cap(data)]
+		n, errGo := file.Read(data)
+		if errGo != nil {
+			if errGo == io.EOF {
+				return "", nil
+			}
+			return "", errors.Wrap(errGo).With("file", fp).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		select {
+		case stream.DataStream <- append([]byte(nil), data[:n]...):
+		case next = <-cuePlayer.playC:
+			return next, nil
+		case <-quitC:
+			return "", nil
+		}
+	}
+}
+
 // Sounds possible at this point
 //
 // e-ambient, r-ambient, n-ambient
@@ -163,11 +322,14 @@ func playSFX(errorC chan<- errors.Error, quitC <-chan struct{}) {
 // e-resonator-destroyed, r-resonator-destroyed
 
 func runAudio(ambientC <-chan string, sfxC <-chan []string, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	defer track("audio")()
 
 	go playAmbient(ambientC, errorC, quitC)
 
 	go playSFX(errorC, quitC)
 
+	go playCues(errorC, quitC)
+
 	for {
 		select {
 
@@ -198,6 +360,7 @@ type ambientFP struct {
 }
 
 func playAmbient(ambientC <-chan string, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	defer track("audio ambient")()
 
 	ambient := ambientFP{}
 
@@ -247,6 +410,7 @@ func playAmbient(ambientC <-chan string, errorC chan<- errors.Error, quitC <-cha
 						reportError(err, errorC)
 
 						ambient.fp = ""
+						ambient.Unlock()
 						continue
 					}
 					fp = ambient.fp
@@ -257,6 +421,8 @@ func playAmbient(ambientC <-chan string, errorC chan<- errors.Error, quitC <-cha
 			if ambient.file == nil {
 				select {
 				case <-time.After(250 * time.Millisecond):
+				case <-quitC:
+					return
 				}
 				continue
 			}
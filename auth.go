@@ -0,0 +1,225 @@
+package mawt
+
+// This module implements the authentication of the HTTP surfaces of the gateway,
+// the REST API, the preview WebSockets, the configuration editor and the metrics,
+// which are otherwise open to anyone on the shared networks used at events.
+// Clients present a bearer token, or a client certificate when the API is served
+// using TLS with a client CA, and each user is limited to the endpoints on their
+// allow list.  Browsers that cannot set headers, such as for WebSockets, can give
+// the token as the token query parameter, after which it is kept in a cookie
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	authCookie = "mawt-token"
+)
+
+// AuthUser is a client of the HTTP surfaces, identified by a token or by the common
+// name of its client certificate
+//
+type AuthUser struct {
+	Name       string `yaml:"name"`
+	Token      string `yaml:"token"`      // A bearer token sent in the Authorization header
+	CommonName string `yaml:"commonName"` // The common name of a client certificate signed by the client CA
+
+	// Allow lists the endpoints the user may use, each a path pattern optionally
+	// preceded by a method, or * for any method, and a space, for example
+	// "GET /api/v1/*".  A * in the path matches any run of characters including
+	// slashes
+	Allow []string `yaml:"allow"`
+}
+
+// AuthTLS defines the certificates used to serve the HTTP surfaces using TLS
+//
+type AuthTLS struct {
+	Cert     string `yaml:"cert"`     // The PEM certificate of the server
+	Key      string `yaml:"key"`      // The PEM private key of the server
+	ClientCA string `yaml:"clientCA"` // Optional PEM CA that client certificates are verified against
+}
+
+// AuthConfig defines the users of the HTTP surfaces and the endpoints open to all
+//
+type AuthConfig struct {
+	Users  []AuthUser `yaml:"users"`
+	Public []string   `yaml:"public"` // Endpoint patterns served without credentials
+	TLS    *AuthTLS   `yaml:"tls"`    // Optional TLS, needed for client certificates
+}
+
+// Auth checks the credentials of requests made to the HTTP surfaces
+//
+type Auth struct {
+	config AuthConfig
+}
+
+// NewAuth validates the users and certificates
+//
+func NewAuth(config AuthConfig) (auth *Auth, err errors.Error) {
+	if len(config.Users) == 0 {
+		return nil, errors.New("authentication needs at least one user").With("stack", stack.Trace().TrimRuntime())
+	}
+	names := map[string]bool{}
+	for _, user := range config.Users {
+		if len(user.Name) == 0 || names[user.Name] {
+			return nil, errors.New("users must have a unique name").With("user", user.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		names[user.Name] = true
+		if (len(user.Token) == 0) == (len(user.CommonName) == 0) {
+			return nil, errors.New("users need either a token or a client certificate common name").With("user", user.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(user.CommonName) != 0 && (config.TLS == nil || len(config.TLS.ClientCA) == 0) {
+			return nil, errors.New("client certificates need a TLS client CA").With("user", user.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(user.Allow) == 0 {
+			return nil, errors.New("users need at least one allowed endpoint").With("user", user.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	auth = &Auth{config: config}
+	if config.TLS != nil {
+		if _, err = auth.TLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// TLSConfig returns the TLS settings of the server, nil when TLS is not used.  Client
+// certificates are requested but only required by the endpoints of users identified
+// by them
+//
+func (auth *Auth) TLSConfig() (config *tls.Config, err errors.Error) {
+	if auth.config.TLS == nil {
+		return nil, nil
+	}
+	settings := auth.config.TLS
+	if len(settings.Cert) == 0 || len(settings.Key) == 0 {
+		return nil, errors.New("TLS needs a certificate and key").With("stack", stack.Trace().TrimRuntime())
+	}
+	cert, errGo := tls.LoadX509KeyPair(settings.Cert, settings.Key)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("cert", settings.Cert).With("key", settings.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	config = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if len(settings.ClientCA) != 0 {
+		pem, errGo := ioutil.ReadFile(settings.ClientCA)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("clientCA", settings.ClientCA).With("stack", stack.Trace().TrimRuntime())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("the client CA contains no certificates").With("clientCA", settings.ClientCA).With("stack", stack.Trace().TrimRuntime())
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Handler wraps a handler so that only requests from users allowed to use the
+// endpoint reach it
+//
+func (auth *Auth) Handler(next http.Handler) (handler http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed(auth.config.Public, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, fromQuery := auth.identify(r)
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mawt"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !allowed(user.Allow, r) {
+			http.Error(w, "user "+user.Name+" is not allowed to use "+r.URL.Path, http.StatusForbidden)
+			return
+		}
+		// Browsers keep the token so the pages they load can use the API
+		if fromQuery {
+			http.SetCookie(w, &http.Cookie{Name: authCookie, Value: r.URL.Query().Get("token"), Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode, Secure: SecureRequest(r)})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identify returns the user making a request, nil when the credentials are missing
+// or unknown
+//
+func (auth *Auth) identify(r *http.Request) (user *AuthUser, fromQuery bool) {
+	token := ""
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	} else if query := r.URL.Query().Get("token"); len(query) != 0 {
+		token, fromQuery = query, true
+	} else if cookie, errGo := r.Cookie(authCookie); errGo == nil {
+		token = cookie.Value
+	}
+
+	// Only verified chains are trusted, unverified certificates are refused during
+	// the handshake
+	commonName := ""
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		commonName = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	for i, candidate := range auth.config.Users {
+		if len(candidate.Token) != 0 && len(token) != 0 && subtle.ConstantTimeCompare([]byte(candidate.Token), []byte(token)) == 1 {
+			return &auth.config.Users[i], fromQuery
+		}
+		if len(candidate.CommonName) != 0 && candidate.CommonName == commonName {
+			return &auth.config.Users[i], false
+		}
+	}
+	return nil, false
+}
+
+// allowed tests a request against endpoint patterns
+//
+func allowed(patterns []string, r *http.Request) (isAllowed bool) {
+	for _, pattern := range patterns {
+		if fields := strings.Fields(pattern); len(fields) == 2 {
+			if fields[0] != "*" && !strings.EqualFold(fields[0], r.Method) {
+				continue
+			}
+			pattern = fields[1]
+		}
+		if wildcardMatch(pattern, r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches a path against a pattern in which * matches any run of
+// characters
+//
+func wildcardMatch(pattern string, path string) (matched bool) {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == path
+	}
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(path, part)
+		if i < 0 {
+			return false
+		}
+		path = path[i+len(part):]
+	}
+	return strings.HasSuffix(path, parts[len(parts)-1])
+}
@@ -0,0 +1,121 @@
+package mawt
+
+// This module advertises the state of the home portal as a Bluetooth LE beacon
+// so that companion mobile apps near the sculpture can display it without any
+// network connectivity.  The advertisement is non-connectable and carries a
+// manufacturer specific payload along with a shortened portal title
+//
+// Manufacturer specific payload, following the 0xFFFF test company identifier
+//
+//   byte 0  payload version, currently 1
+//   byte 1  faction, 'E', 'R' or 'N'
+//   byte 2  portal level 0-8
+//   byte 3  number of deployed resonators 0-8
+//   byte 4  portal health 0-100
+
+import (
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	beaconVersion = 1
+	beaconCompany = 0xFFFF
+
+	maxAdvertisingData = 31
+)
+
+// beaconPayload builds the BLE advertising data for a portal status
+//
+func beaconPayload(status *model.Status) (data []byte) {
+	faction := byte('N')
+	if len(status.Faction) != 0 {
+		faction = status.Faction[0]
+	}
+	resonators := byte(0)
+	for _, reso := range status.Resonators {
+		if reso.Level != 0 {
+			resonators++
+		}
+	}
+
+	data = []byte{
+		// Flags, LE general discoverable and BR/EDR not supported
+		0x02, 0x01, 0x06,
+		// Manufacturer specific data
+		0x08, 0xFF, beaconCompany & 0xFF, beaconCompany >> 8,
+		beaconVersion, faction, byte(clamp(status.Level, 0, 8)), resonators, byte(clamp(status.Health, 0, 100)),
+	}
+
+	// Shortened local name using as much of the title as will fit
+	name := []byte(status.Title)
+	if room := maxAdvertisingData - len(data) - 2; len(name) > room {
+		name = name[:room]
+	}
+	if len(name) != 0 {
+		data = append(data, byte(len(name)+1), 0x08)
+		data = append(data, name...)
+	}
+	return data
+}
+
+func clamp(value float32, min float32, max float32) (clamped float32) {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// StartBeacon advertises the state of the home portal using the Bluetooth
+// adapter with the supplied device number, for example 0 for hci0
+//
+func StartBeacon(device int, broker *Broker, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+
+	adv, err := openAdvertiser(device)
+	if err != nil {
+		return err
+	}
+
+	sub := broker.Subscribe(TopicStatus, SubscribeOptions{Name: "beacon", Depth: 1, Policy: LatestWins})
+
+	go func() {
+		defer track("beacon")()
+		defer sub.Close()
+		defer adv.Close()
+
+		last := []byte{}
+		for {
+			select {
+			case status := <-sub.C:
+				msg := status.(*model.PortalMsg)
+				if msg == nil || !msg.Home {
+					continue
+				}
+				data := beaconPayload(&msg.Status)
+				if string(data) == string(last) {
+					continue
+				}
+				if err := adv.Advertise(data); err != nil {
+					sendErr(errorC, err)
+					continue
+				}
+				last = data
+			case <-quitC:
+				return
+			case <-time.After(time.Minute):
+				// Re-send the advertisement periodically in case the adapter was reset
+				if len(last) != 0 {
+					if err := adv.Advertise(last); err != nil {
+						sendErr(errorC, err)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
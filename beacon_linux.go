@@ -0,0 +1,84 @@
+// +build linux
+
+package mawt
+
+// This file contains the Linux implementation of the BLE advertiser that sends
+// HCI commands directly to the Bluetooth adapter using a raw HCI socket, this
+// requires the CAP_NET_RAW capability or root
+
+import (
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	hciCommandPkt = 0x01
+
+	// LE controller commands, OGF 0x08
+	opLESetAdvertisingParameters = 0x2006
+	opLESetAdvertisingData       = 0x2008
+	opLESetAdvertiseEnable       = 0x200A
+)
+
+type advertiser struct {
+	fd     int
+	device int
+}
+
+func openAdvertiser(device int) (adv *advertiser, err errors.Error) {
+	fd, errGo := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = unix.Bind(fd, &unix.SockaddrHCI{Dev: uint16(device), Channel: unix.HCI_CHANNEL_RAW}); errGo != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+	adv = &advertiser{fd: fd, device: device}
+
+	// Non-connectable undirected advertising every 200ms on all three channels
+	params := []byte{
+		0x40, 0x01, // Minimum interval 320 * 0.625ms
+		0x40, 0x01, // Maximum interval
+		0x03,                               // ADV_NONCONN_IND
+		0x00,                               // Public own address
+		0x00,                               // Peer address type, unused
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Peer address, unused
+		0x07, // All advertising channels
+		0x00, // No filtering
+	}
+	if err = adv.command(opLESetAdvertisingParameters, params); err != nil {
+		adv.Close()
+		return nil, err
+	}
+	return adv, nil
+}
+
+func (adv *advertiser) command(opcode uint16, params []byte) (err errors.Error) {
+	pkt := append([]byte{hciCommandPkt, byte(opcode), byte(opcode >> 8), byte(len(params))}, params...)
+	if _, errGo := unix.Write(adv.fd, pkt); errGo != nil {
+		return errors.Wrap(errGo).With("device", adv.device).With("opcode", opcode).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Advertise replaces the advertising data and ensures advertising is enabled
+//
+func (adv *advertiser) Advertise(data []byte) (err errors.Error) {
+	params := make([]byte, 1+maxAdvertisingData)
+	params[0] = byte(copy(params[1:], data))
+
+	if err = adv.command(opLESetAdvertisingData, params); err != nil {
+		return err
+	}
+	return adv.command(opLESetAdvertiseEnable, []byte{0x01})
+}
+
+// Close stops advertising and releases the adapter
+//
+func (adv *advertiser) Close() {
+	adv.command(opLESetAdvertiseEnable, []byte{0x00})
+	unix.Close(adv.fd)
+}
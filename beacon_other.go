@@ -0,0 +1,23 @@
+// +build !linux
+
+package mawt
+
+// BLE advertising is only supported on Linux
+
+import (
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+type advertiser struct{}
+
+func openAdvertiser(device int) (adv *advertiser, err errors.Error) {
+	return nil, errors.New("BLE beacons are only supported on Linux").With("stack", stack.Trace().TrimRuntime())
+}
+
+func (adv *advertiser) Advertise(data []byte) (err errors.Error) {
+	return nil
+}
+
+func (adv *advertiser) Close() {
+}
@@ -0,0 +1,230 @@
+package mawt
+
+// This module implements the beat clock used to lock show sequences to the
+// tempo of music played during events such as opening ceremonies.  The tempo
+// is set by tapping, from the 24 pulse per quarter note clock sent by MIDI
+// equipment, or directly as a BPM.  Beats are reported early by the output
+// latency so that the LEDs change when the beat is heard rather than when the
+// frame is rendered
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	midiPulsesPerBeat = 24
+
+	tapTimeout = 2 * time.Second // Taps further apart than this begin a new tempo
+	tapHistory = 8               // The number of taps averaged
+)
+
+// BeatState describes the tempo of the beat clock and where it came from
+//
+type BeatState struct {
+	BPM     float64       `json:"bpm"`    // 0 when no tempo has been set
+	Anchor  time.Time     `json:"anchor"` // The time of a beat, all other beats are a whole number of beats from it
+	Latency time.Duration `json:"latency"`
+	Source  string        `json:"source,omitempty"`
+}
+
+// BeatClock tracks a musical tempo and predicts the time of upcoming beats
+//
+type BeatClock struct {
+	state BeatState
+
+	taps []time.Time
+
+	pulses    int           // MIDI clock pulses since the last beat
+	lastPulse time.Time     // The time of the last MIDI clock pulse
+	pulseGap  time.Duration // Smoothed interval between MIDI clock pulses
+	running   bool          // Set between MIDI start and stop messages
+
+	sync.Mutex
+}
+
+var (
+	beat = NewBeatClock()
+)
+
+// GetBeat returns the beat clock shared by the pipelines of the process
+//
+func GetBeat() (clock *BeatClock) {
+	return beat
+}
+
+// NewBeatClock creates a beat clock with no tempo, until one is set beats are not aligned
+//
+func NewBeatClock() (clock *BeatClock) {
+	return &BeatClock{taps: []time.Time{}}
+}
+
+// State returns the tempo of the beat clock
+//
+func (clock *BeatClock) State() (state BeatState) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	return clock.state
+}
+
+// SetLatency sets the time between a frame being rendered and the LEDs changing,
+// beats are reported this much early to compensate
+//
+func (clock *BeatClock) SetLatency(latency time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	clock.state.Latency = latency
+}
+
+// SetBPM sets the tempo directly with a beat at the supplied time, 0 clears the tempo
+//
+func (clock *BeatClock) SetBPM(bpm float64, anchor time.Time, source string) (err errors.Error) {
+	if bpm < 0 || bpm > 400 {
+		return errors.New("the tempo must be from 0 to 400 BPM").With("bpm", bpm).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	clock.Lock()
+	defer clock.Unlock()
+
+	clock.setTempo(bpm, anchor, source)
+	return nil
+}
+
+// setTempo changes the tempo, publishing an event when it changes noticeably
+//
+func (clock *BeatClock) setTempo(bpm float64, anchor time.Time, source string) {
+	previous := clock.state.BPM
+	clock.state.BPM, clock.state.Anchor, clock.state.Source = bpm, anchor, source
+
+	if delta := bpm - previous; delta > 0.5 || delta < -0.5 {
+		bus.Publish(TopicEvents, Event{Time: anchor, Kind: "tempo", Detail: fmt.Sprintf("%.1f BPM from %s", bpm, source)})
+	}
+}
+
+// Tap records a tap of the tempo, the tempo being the average interval of the
+// recent taps and the last tap being on the beat
+//
+func (clock *BeatClock) Tap(tm time.Time, source string) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	if len(clock.taps) != 0 && tm.Sub(clock.taps[len(clock.taps)-1]) > tapTimeout {
+		clock.taps = clock.taps[:0]
+	}
+	clock.taps = append(clock.taps, tm)
+	if len(clock.taps) > tapHistory {
+		clock.taps = clock.taps[len(clock.taps)-tapHistory:]
+	}
+	if len(clock.taps) < 2 {
+		return
+	}
+
+	interval := tm.Sub(clock.taps[0]) / time.Duration(len(clock.taps)-1)
+	if interval <= 0 {
+		return
+	}
+	clock.setTempo(float64(time.Minute)/float64(interval), tm, source)
+}
+
+// Pulse records a MIDI timing clock pulse, every 24th pulse after a start
+// message being on the beat
+//
+func (clock *BeatClock) Pulse(tm time.Time, source string) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	if !clock.lastPulse.IsZero() {
+		gap := tm.Sub(clock.lastPulse)
+		// Jitter in the pulses is smoothed over roughly a beat
+		if clock.pulseGap == 0 || gap > 4*clock.pulseGap {
+			clock.pulseGap = gap
+		} else {
+			clock.pulseGap += (gap - clock.pulseGap) / midiPulsesPerBeat
+		}
+	}
+	clock.lastPulse = tm
+
+	if clock.pulses%midiPulsesPerBeat == 0 && clock.pulseGap > 0 {
+		anchor := tm
+		if !clock.running && !clock.state.Anchor.IsZero() {
+			// Without a start message the phase is unknown, so only the tempo is followed
+			anchor = clock.state.Anchor
+		}
+		clock.setTempo(float64(time.Minute)/float64(clock.pulseGap*midiPulsesPerBeat), anchor, source)
+	}
+	clock.pulses++
+}
+
+// Start records a MIDI start or continue message, the next pulse is on the beat
+//
+func (clock *BeatClock) Start() {
+	clock.Lock()
+	defer clock.Unlock()
+
+	clock.pulses = 0
+	clock.running = true
+}
+
+// Stop records a MIDI stop message, the tempo is retained
+//
+func (clock *BeatClock) Stop() {
+	clock.Lock()
+	defer clock.Unlock()
+
+	clock.running = false
+}
+
+// NextBeat returns the time at which a frame must be rendered for it to be seen on
+// the first beat at or after the supplied time.  The time is returned unchanged
+// when no tempo has been set
+//
+func (clock *BeatClock) NextBeat(after time.Time) (tm time.Time) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	if clock.state.BPM == 0 {
+		return after
+	}
+
+	period := time.Duration(float64(time.Minute) / clock.state.BPM)
+	anchor := clock.state.Anchor.Add(-clock.state.Latency)
+
+	beats := after.Sub(anchor) / period
+	tm = anchor.Add(beats * period)
+	for tm.Before(after) {
+		tm = tm.Add(period)
+	}
+	return tm
+}
+
+// animationBeat aligns steps to the beat clock, which follows the wall clock, for
+// sequences rendered on the animation clock.  The beats only line up with the
+// music while the animations run at their normal speed, at other speeds and while
+// paused steps are not aligned
+//
+type animationBeat struct{}
+
+// NextBeat returns the animation time of the first beat at or after the supplied
+// animation time
+//
+func (animationBeat) NextBeat(after time.Time) (tm time.Time) {
+	if state := GetClock().State(); state.Paused || state.Speed != 1 {
+		return after
+	}
+	wall := time.Now()
+	offset := GetClock().Now(wall).Sub(wall)
+	return GetBeat().NextBeat(after.Add(-offset)).Add(offset)
+}
+
+// ReadMIDIClock follows the timing clock of the raw MIDI device supplied, for example
+// /dev/snd/midiC1D0, ignoring all other MIDI messages
+//
+func ReadMIDIClock(device string, clock *BeatClock, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	return ReadMIDI(device, clock, nil, errorC, quitC)
+}
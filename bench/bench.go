@@ -0,0 +1,222 @@
+package bench
+
+// This package contains benchmarks for the stages of the LED pipeline, frame rendering,
+// strand packing and OPC serialization.  The stages are timed by the mawt bench
+// command so that pixel count planning for new builds can be done on the target
+// hardware without a Go toolchain, and the same stages are run as Go benchmarks by
+// go test -bench.  The command times the stages itself rather than using the testing
+// package, which does not belong in a command
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TeamNorCal/animation"
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt"
+
+	"github.com/kellydunn/go-opc"
+)
+
+const (
+	// Fadecandy strands carry up to 64 pixels
+	strandSize = 64
+
+	// measureTime is the least time spent running each stage when it is measured
+	measureTime = time.Second
+)
+
+var (
+	// PixelCounts are the default sizes of the LED builds that are benchmarked
+	PixelCounts = []int{64, 512, 4096}
+)
+
+// Result contains the measurements for one stage of the pipeline at a pixel count
+//
+type Result struct {
+	Stage      string
+	Pixels     int
+	NsPerOp    int64
+	BytesPerOp int64   // Bytes allocated for each frame, which the garbage collector must reclaim
+	FPS        float64 // Frames per second that could be sustained by this stage alone
+	Headroom   float64 // Ratio of the FPS to the target frame rate
+}
+
+// pipeline is a synthetic LED build with all pixels running a pulse effect
+//
+type pipeline struct {
+	sr       *animation.SequenceRunner
+	strands  int
+	channels []animationModel.ChannelData
+	msgs     []*opc.Message // The messages of each strand, reused from frame to frame as the gateway does
+	start    time.Time
+}
+
+func newPipeline(pixels int) (p *pipeline) {
+	strands := (pixels + strandSize - 1) / strandSize
+
+	sizes := make([]uint, strands)
+	for i := range sizes {
+		sizes[i] = strandSize
+	}
+
+	seq := animation.NewSequence()
+	for i := range sizes {
+		step := &animation.Step{
+			UniverseID: uint(i),
+			Effect:     animation.NewPulse(animation.RGBAFromRGBHex(0x000000), animation.RGBAFromRGBHex(0x00ff00), time.Second, false),
+		}
+		seq.AddInitialStep(fmt.Sprint("pulse", i), step)
+	}
+
+	p = &pipeline{
+		sr:       animation.NewSequenceRunner(sizes),
+		strands:  strands,
+		channels: make([]animationModel.ChannelData, strands),
+		msgs:     make([]*opc.Message, strands),
+		start:    time.Now(),
+	}
+	p.sr.InitSequence(seq, p.start)
+	p.render(0)
+	return p
+}
+
+// render generates the frame for the nth iteration and gathers the universes into
+// channel data ready for packing
+//
+func (p *pipeline) render(n int) {
+	p.sr.ProcessFrame(p.start.Add(time.Duration(n) * 30 * time.Millisecond))
+	for i := 0; i != p.strands; i++ {
+		p.channels[i] = animationModel.ChannelData{
+			ChannelNum: animationModel.OpcChannel(i + 1),
+			Data:       p.sr.UniverseData(uint(i)),
+		}
+	}
+}
+
+func (p *pipeline) pack(sink func([]byte)) {
+	for i, channelData := range p.channels {
+		p.msgs[i] = mawt.PackStrandInto(p.msgs[i], channelData)
+		if sink != nil {
+			sink(p.msgs[i].ByteArray())
+		}
+	}
+}
+
+// stage is one stage of the pipeline, setup creating a synthetic build and returning
+// the work done for the nth frame
+//
+type stage struct {
+	name  string
+	setup func(pixels int) (frame func(n int))
+}
+
+var (
+	discard = func(data []byte) {
+		ioutil.Discard.Write(data)
+	}
+
+	stages = []stage{
+		{
+			name: "render",
+			setup: func(pixels int) (frame func(n int)) {
+				return newPipeline(pixels).render
+			},
+		},
+		{
+			name: "pack",
+			setup: func(pixels int) (frame func(n int)) {
+				p := newPipeline(pixels)
+				return func(n int) {
+					p.pack(nil)
+				}
+			},
+		},
+		{
+			name: "serialize",
+			setup: func(pixels int) (frame func(n int)) {
+				p := newPipeline(pixels)
+				msgs := make([]*opc.Message, 0, p.strands)
+				for _, channelData := range p.channels {
+					msgs = append(msgs, mawt.PackStrand(channelData))
+				}
+				return func(n int) {
+					for _, m := range msgs {
+						discard(m.ByteArray())
+					}
+				}
+			},
+		},
+		{
+			name: "frame",
+			setup: func(pixels int) (frame func(n int)) {
+				p := newPipeline(pixels)
+				return func(n int) {
+					p.render(n)
+					p.pack(discard)
+				}
+			},
+		},
+	}
+)
+
+// measure runs a stage for at least measureTime, doubling the frames run until it
+// does, and returns the time taken and bytes allocated for each frame
+//
+func measure(frame func(n int)) (nsPerOp int64, bytesPerOp int64) {
+	before := runtime.MemStats{}
+	after := runtime.MemStats{}
+
+	for frames := 1; ; frames *= 2 {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for n := 0; n < frames; n++ {
+			frame(n)
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+
+		if elapsed >= measureTime {
+			return int64(elapsed) / int64(frames), int64(after.TotalAlloc-before.TotalAlloc) / int64(frames)
+		}
+	}
+}
+
+// Run benchmarks every stage of the pipeline at each of the pixel counts and computes the
+// frame rate headroom relative to the target frame rate
+//
+func Run(pixelCounts []int, targetFPS float64) (results []Result) {
+	results = []Result{}
+
+	for _, pixels := range pixelCounts {
+		for _, stage := range stages {
+			result := Result{
+				Stage:  stage.name,
+				Pixels: pixels,
+			}
+			result.NsPerOp, result.BytesPerOp = measure(stage.setup(pixels))
+			if result.NsPerOp > 0 {
+				result.FPS = float64(time.Second) / float64(result.NsPerOp)
+				result.Headroom = result.FPS / targetFPS
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// Print writes the results as a table
+//
+func Print(w io.Writer, results []Result, targetFPS float64) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "stage\tpixels\tns/frame\tbytes/frame\tframes/s\theadroom @ %.0f fps\t\n", targetFPS)
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.0f\t%.1fx\t\n", result.Stage, result.Pixels, result.NsPerOp, result.BytesPerOp, result.FPS, result.Headroom)
+	}
+	tw.Flush()
+}
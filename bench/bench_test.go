@@ -0,0 +1,44 @@
+package bench
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkStage runs a stage of the pipeline at each of the standard pixel counts
+//
+func benchmarkStage(b *testing.B, name string) {
+	for _, stage := range stages {
+		if stage.name != name {
+			continue
+		}
+		for _, pixels := range PixelCounts {
+			b.Run(fmt.Sprint(pixels), func(b *testing.B) {
+				frame := stage.setup(pixels)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					frame(n)
+				}
+			})
+		}
+		return
+	}
+	b.Fatalf("unknown stage %s", name)
+}
+
+func BenchmarkRender(b *testing.B) {
+	benchmarkStage(b, "render")
+}
+
+func BenchmarkPack(b *testing.B) {
+	benchmarkStage(b, "pack")
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	benchmarkStage(b, "serialize")
+}
+
+func BenchmarkFrame(b *testing.B) {
+	benchmarkStage(b, "frame")
+}
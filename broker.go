@@ -0,0 +1,358 @@
+package mawt
+
+// This module implements the in-process publish/subscribe layer that decouples
+// the producers of portal statuses, events, frames and errors from the consumers
+// of them, such as the LEDs, the sound effects, recorders and previews.  Messages
+// are published to named topics and subscribers can be added to, or removed
+// from, a topic at any time while messages are flowing.  Each subscriber has its
+// own bounded queue so that publishing never waits on a subscriber, a subscriber
+// that falls behind missing the oldest or the newest messages as it chose, and
+// subscribers outside of the gateway that stop receiving altogether being detached
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karlmutch/errors"
+)
+
+const (
+	TopicStatus    = "status"    // *model.PortalMsg, the statuses polled by the tecthulhus of a pipeline
+	TopicDisplayed = "displayed" // *model.PortalMsg, the statuses of the portal chosen by the arbitration of a pipeline
+	TopicFrames    = "frames"    // []animationModel.ChannelData, the frames sent to the fadecandy server of a pipeline
+	TopicEvents    = "events"    // Event, the events of all pipelines published to the process broker
+	TopicErrors    = "errors"    // errors.Error, the errors of all pipelines published to the process broker
+
+	// DefaultStallLimit is how long the queue of a subscriber outside of the gateway,
+	// such as the client of an event stream, can remain full before it is detached
+	DefaultStallLimit = 30 * time.Second
+
+	maxDetachedStats = 16 // The detached subscribers reported by the broker statistics
+
+	losslessWait = time.Second // The longest a publisher waits on a full Lossless queue
+)
+
+// Policy decides what becomes of a message published to a subscriber whose queue
+// is full.  Publishers only wait for Lossless subscribers, and then for no longer
+// than a second so a subscriber that has stopped receiving cannot halt the broker
+//
+type Policy int
+
+const (
+	DropNewest Policy = iota // The message being published is missed, the queued messages being kept
+	LatestWins               // The oldest queued message is missed to make room, so the latest is always received
+	Lossless                 // The publisher waits for room, the message only being missed if none appears in time
+)
+
+func (policy Policy) String() string {
+	switch policy {
+	case LatestWins:
+		return "latest-wins"
+	case Lossless:
+		return "lossless"
+	}
+	return "drop-newest"
+}
+
+// SubscribeOptions controls the queue of a subscriber
+//
+type SubscribeOptions struct {
+	Name       string        // Identifies the subscriber in the broker statistics
+	Depth      int           // The messages queued for the subscriber, at least 1
+	Policy     Policy        // What becomes of messages published while the queue is full
+	StallLimit time.Duration // A subscriber whose queue stays full for this long is detached, closing its channel, 0 never detaches it
+}
+
+// Subscription is a single subscriber to a topic, messages are received from C
+// until the subscription is closed, or the broker detaches the subscriber for
+// having stalled
+//
+type Subscription struct {
+	Topic string
+	C     <-chan interface{}
+
+	options   SubscribeOptions
+	msgC      chan interface{}
+	delivered uint64    // The count of messages queued, accessed atomically
+	dropped   uint64    // The count of messages missed, accessed atomically
+	detached  uint32    // Set once the broker detached the subscriber, accessed atomically
+	fullSince time.Time // When the queue was first found full by a publisher, guarded by the broker
+	broker    *Broker
+}
+
+// SubscriberStats describes the queue of a subscriber, for finding slow consumers
+//
+type SubscriberStats struct {
+	Topic     string    `json:"topic"`
+	Name      string    `json:"name"`
+	Policy    string    `json:"policy"`
+	Depth     int       `json:"depth"`
+	Queued    int       `json:"queued"`
+	Delivered uint64    `json:"delivered"`
+	Dropped   uint64    `json:"dropped"`
+	FullSince time.Time `json:"fullSince"` // When a publisher found the queue full, zero once a later message was queued
+	Detached  time.Time `json:"detached"`
+}
+
+// BrokerStats describes the subscribers of a broker along with those recently
+// detached for having stalled
+//
+type BrokerStats struct {
+	Subscribers   []SubscriberStats `json:"subscribers"`
+	Detached      []SubscriberStats `json:"detached,omitempty"` // The most recently detached subscribers
+	DetachedTotal uint64            `json:"detachedTotal"`
+}
+
+// Broker delivers the messages published to a topic to all of its subscribers
+//
+type Broker struct {
+	topics        map[string][]*Subscription
+	detached      []SubscriberStats
+	detachedTotal uint64
+	sync.Mutex
+}
+
+var (
+	// bus is the process wide broker used for the events and errors of all pipelines,
+	// statuses and frames are published to the broker of each pipeline
+	bus = NewBroker()
+)
+
+// NewBroker creates a broker without any subscribers
+//
+func NewBroker() (broker *Broker) {
+	return &Broker{
+		topics: map[string][]*Subscription{},
+	}
+}
+
+// Subscribe adds a subscriber to a topic with a queue of the requested depth.  Once
+// the queue is full messages are missed following the policy of the subscriber
+//
+func (broker *Broker) Subscribe(topic string, options SubscribeOptions) (sub *Subscription) {
+	if options.Depth < 1 {
+		options.Depth = 1
+	}
+	msgC := make(chan interface{}, options.Depth)
+	sub = &Subscription{
+		Topic:   topic,
+		C:       msgC,
+		options: options,
+		msgC:    msgC,
+		broker:  broker,
+	}
+
+	broker.Lock()
+	broker.topics[topic] = append(broker.topics[topic], sub)
+	broker.Unlock()
+
+	return sub
+}
+
+// Subscribers returns the number of subscribers to a topic, allowing publishers
+// to skip preparing messages nobody will receive
+//
+func (broker *Broker) Subscribers(topic string) (count int) {
+	broker.Lock()
+	defer broker.Unlock()
+
+	return len(broker.topics[topic])
+}
+
+// Publish delivers a message to all of the current subscribers of a topic without
+// waiting for any of them, subscribers that have stalled for longer than their
+// limit being detached
+//
+func (broker *Broker) Publish(topic string, msg interface{}) {
+	now := time.Now()
+	detached := []SubscriberStats{}
+
+	broker.Lock()
+	for _, sub := range broker.topics[topic] {
+		if sub.offer(msg, now) {
+			continue
+		}
+		if sub.options.StallLimit > 0 && now.Sub(sub.fullSince) >= sub.options.StallLimit {
+			detached = append(detached, broker.detach(sub, now))
+		}
+	}
+	broker.Unlock()
+
+	// Events are published once the broker is unlocked as the events topic can be on
+	// this broker
+	for _, stats := range detached {
+		bus.Publish(TopicEvents, Event{Time: now, Kind: "subscriber-detached",
+			Detail: fmt.Sprintf("%s %s, queue full since %s", stats.Topic, stats.Name, stats.FullSince.Format(time.RFC3339))})
+	}
+}
+
+// offer queues a message for the subscriber following its policy, returning false
+// when the queue was full, the broker being locked by the caller
+//
+func (sub *Subscription) offer(msg interface{}, now time.Time) (hadRoom bool) {
+	select {
+	case sub.msgC <- msg:
+		atomic.AddUint64(&sub.delivered, 1)
+		sub.fullSince = time.Time{}
+		return true
+	default:
+	}
+
+	if sub.options.Policy == Lossless {
+		// The wait holds the broker lock, delaying every publisher, which is the
+		// price of not missing messages
+		wait := time.NewTimer(losslessWait)
+		defer wait.Stop()
+		select {
+		case sub.msgC <- msg:
+			atomic.AddUint64(&sub.delivered, 1)
+			sub.fullSince = time.Time{}
+			return true
+		case <-wait.C:
+		}
+	}
+
+	if sub.fullSince.IsZero() {
+		sub.fullSince = now
+	}
+	atomic.AddUint64(&sub.dropped, 1)
+	if sub.options.Policy == LatestWins {
+		// Publishers hold the broker lock so the receive of the subscriber is the
+		// only thing that can change the queue in between
+		select {
+		case <-sub.msgC:
+		default:
+		}
+		select {
+		case sub.msgC <- msg:
+			atomic.AddUint64(&sub.delivered, 1)
+		default:
+		}
+	}
+	return false
+}
+
+// detach removes a stalled subscriber from its topic and closes its channel, the
+// broker being locked by the caller
+//
+func (broker *Broker) detach(sub *Subscription, now time.Time) (stats SubscriberStats) {
+	subs := broker.topics[sub.Topic]
+	for i, existing := range subs {
+		if existing == sub {
+			broker.topics[sub.Topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	atomic.StoreUint32(&sub.detached, 1)
+	close(sub.msgC)
+
+	stats = sub.stats()
+	stats.Detached = now
+	broker.detachedTotal++
+	broker.detached = append(broker.detached, stats)
+	if len(broker.detached) > maxDetachedStats {
+		broker.detached = broker.detached[len(broker.detached)-maxDetachedStats:]
+	}
+	return stats
+}
+
+// stats describes the queue of the subscriber, the broker being locked by the caller
+//
+func (sub *Subscription) stats() (stats SubscriberStats) {
+	return SubscriberStats{
+		Topic:     sub.Topic,
+		Name:      sub.options.Name,
+		Policy:    sub.options.Policy.String(),
+		Depth:     sub.options.Depth,
+		Queued:    len(sub.msgC),
+		Delivered: atomic.LoadUint64(&sub.delivered),
+		Dropped:   atomic.LoadUint64(&sub.dropped),
+		FullSince: sub.fullSince,
+	}
+}
+
+// Stats describes the queues of the subscribers of every topic, along with the
+// subscribers recently detached for having stalled
+//
+func (broker *Broker) Stats() (stats BrokerStats) {
+	broker.Lock()
+	defer broker.Unlock()
+
+	topics := make([]string, 0, len(broker.topics))
+	for topic := range broker.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	stats.Subscribers = []SubscriberStats{}
+	for _, topic := range topics {
+		for _, sub := range broker.topics[topic] {
+			stats.Subscribers = append(stats.Subscribers, sub.stats())
+		}
+	}
+	stats.Detached = append([]SubscriberStats{}, broker.detached...)
+	stats.DetachedTotal = broker.detachedTotal
+	return stats
+}
+
+// Close removes the subscription from its topic and closes its channel, closing
+// a subscription more than once, or after it was detached, has no effect
+//
+func (sub *Subscription) Close() {
+	broker := sub.broker
+	broker.Lock()
+	defer broker.Unlock()
+
+	subs := broker.topics[sub.Topic]
+	for i, existing := range subs {
+		if existing == sub {
+			broker.topics[sub.Topic] = append(subs[:i:i], subs[i+1:]...)
+			close(sub.msgC)
+			return
+		}
+	}
+}
+
+// Dropped returns the number of messages the subscriber missed because it was not
+// keeping up with the publishers
+//
+func (sub *Subscription) Dropped() (dropped uint64) {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Detached returns true once the broker has detached the subscriber for having
+// stalled, its channel having been closed
+//
+func (sub *Subscription) Detached() (isDetached bool) {
+	return atomic.LoadUint32(&sub.detached) != 0
+}
+
+// SubscribeEvents returns a subscription to the events being published by all of
+// the pipelines, the messages received are of the Event type
+//
+func SubscribeEvents(options SubscribeOptions) (sub *Subscription) {
+	return bus.Subscribe(TopicEvents, options)
+}
+
+// SubscribeErrors returns a subscription to the errors published using PublishError,
+// the messages received are of the errors.Error type
+//
+func SubscribeErrors(options SubscribeOptions) (sub *Subscription) {
+	return bus.Subscribe(TopicErrors, options)
+}
+
+// BusStats describes the subscribers to the events and errors of the process
+//
+func BusStats() (stats BrokerStats) {
+	return bus.Stats()
+}
+
+// PublishError makes an error reported by any part of the process available to the
+// subscribers of the errors topic
+//
+func PublishError(err errors.Error) {
+	bus.Publish(TopicErrors, err)
+}
@@ -0,0 +1,232 @@
+package mawt
+
+// This module pools the pixel buffers of the strands.  Builds of 10,000 or more
+// pixels that allocate fresh strands for each stage of every frame keep the garbage
+// collector busy, and its pauses show as stutters in the animations.  The stages of
+// the render loop instead fill buffers provided by the caller, reused from frame to
+// frame, with buffers that must grow being taken from pools kept by size class using
+// sync.Pool.  The pools hold pointers to the buffers, as a slice stored in a pool
+// would itself be allocated on every Put, and the pointers are kept for reuse once
+// their buffers are taken.  The memory held by the pools is kept within a budget,
+// buffers returned once the budget is reached being left to the garbage collector.
+// The budget is approximate as the garbage collector empties the pools without
+// notice
+
+import (
+	"image/color"
+	"sync"
+	"sync/atomic"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+)
+
+const (
+	DefaultBufferBudget = 32 << 20
+
+	// Buffers are pooled in size classes of powers of two pixels, from 64 pixels to
+	// the largest strand an OPC message can hold
+	minPooledPixels = 64
+	pixelClasses    = 10
+)
+
+// pixelPool holds pointers to the buffers of one pixel type by size class
+//
+type pixelPool struct {
+	size    int64 // The bytes in each pixel
+	classes [pixelClasses]sync.Pool
+	held    [pixelClasses]int64 // The approximate bytes held in each class, accessed atomically
+	holders sync.Pool           // The pointers of the buffers taken from the classes, emptied for reuse
+}
+
+var (
+	rgbaPool   = &pixelPool{size: 4}
+	rgba64Pool = &pixelPool{size: 8}
+
+	// bufferBudget and buffersHeld are the bytes the pools may hold and the bytes
+	// they are thought to hold, accessed atomically
+	bufferBudget = int64(DefaultBufferBudget)
+	buffersHeld  = int64(0)
+)
+
+// SetBufferBudget sets the bytes of pixel buffers the pools may hold between
+// frames, 0 disables the pooling of buffers
+//
+func SetBufferBudget(budget int64) {
+	atomic.StoreInt64(&bufferBudget, budget)
+}
+
+// pixelClass returns the size class able to hold a number of pixels, false when the
+// number is outside of the pooled sizes
+//
+func pixelClass(pixels int) (class int, isPooled bool) {
+	capacity := minPooledPixels
+	for class = 0; class != pixelClasses; class++ {
+		if pixels <= capacity {
+			return class, pixels > 0
+		}
+		capacity *= 2
+	}
+	return 0, false
+}
+
+func classPixels(class int) (pixels int) {
+	return minPooledPixels << uint(class)
+}
+
+// get returns a pointer to a pooled buffer of the class holding the pixels, or nil
+// when there is none.  The caller empties the pointer and hands it back using
+// release once it has taken the buffer
+//
+func (pool *pixelPool) get(pixels int) (buffer interface{}) {
+	class, isPooled := pixelClass(pixels)
+	if !isPooled {
+		return nil
+	}
+	if buffer = pool.classes[class].Get(); buffer == nil {
+		// The class has been emptied, most likely by the garbage collector
+		atomic.AddInt64(&buffersHeld, -atomic.SwapInt64(&pool.held[class], 0))
+		return nil
+	}
+	bytes := int64(classPixels(class)) * pool.size
+	atomic.AddInt64(&pool.held[class], -bytes)
+	atomic.AddInt64(&buffersHeld, -bytes)
+	return buffer
+}
+
+// accepts reserves the budget for a buffer of the capacity, false when the buffer is
+// not of a pooled size or the budget is used up and so it is left to the garbage
+// collector
+//
+func (pool *pixelPool) accepts(capacity int) (isPooled bool) {
+	class, isPooled := pixelClass(capacity)
+	if !isPooled || classPixels(class) != capacity {
+		return false
+	}
+	bytes := int64(capacity) * pool.size
+	if atomic.AddInt64(&buffersHeld, bytes) > atomic.LoadInt64(&bufferBudget) {
+		atomic.AddInt64(&buffersHeld, -bytes)
+		return false
+	}
+	atomic.AddInt64(&pool.held[class], bytes)
+	return true
+}
+
+// put returns the pointer to a buffer to its class, the budget having been reserved
+// using accepts
+//
+func (pool *pixelPool) put(buffer interface{}, capacity int) {
+	class, _ := pixelClass(capacity)
+	pool.classes[class].Put(buffer)
+}
+
+// release hands back an emptied pointer for reuse by put
+//
+func (pool *pixelPool) release(holder interface{}) {
+	pool.holders.Put(holder)
+}
+
+// getPixels returns a buffer of the number of pixels, their colors are not cleared
+//
+func getPixels(pixels int) (data []color.RGBA) {
+	if buffer := rgbaPool.get(pixels); buffer != nil {
+		holder := buffer.(*[]color.RGBA)
+		data = (*holder)[:pixels]
+		*holder = nil
+		rgbaPool.release(holder)
+		return data
+	}
+	if class, isPooled := pixelClass(pixels); isPooled {
+		return make([]color.RGBA, pixels, classPixels(class))
+	}
+	return make([]color.RGBA, pixels)
+}
+
+// putPixels returns a buffer for reuse, the caller must no longer refer to it
+//
+func putPixels(data []color.RGBA) {
+	if !rgbaPool.accepts(cap(data)) {
+		return
+	}
+	holder, _ := rgbaPool.holders.Get().(*[]color.RGBA)
+	if holder == nil {
+		holder = new([]color.RGBA)
+	}
+	*holder = data[:0]
+	rgbaPool.put(holder, cap(data))
+}
+
+// getPixels16 returns a buffer of the number of 16 bit pixels, their colors are not
+// cleared
+//
+func getPixels16(pixels int) (data []color.RGBA64) {
+	if buffer := rgba64Pool.get(pixels); buffer != nil {
+		holder := buffer.(*[]color.RGBA64)
+		data = (*holder)[:pixels]
+		*holder = nil
+		rgba64Pool.release(holder)
+		return data
+	}
+	if class, isPooled := pixelClass(pixels); isPooled {
+		return make([]color.RGBA64, pixels, classPixels(class))
+	}
+	return make([]color.RGBA64, pixels)
+}
+
+// putPixels16 returns a 16 bit buffer for reuse, the caller must no longer refer to it
+//
+func putPixels16(data []color.RGBA64) {
+	if !rgba64Pool.accepts(cap(data)) {
+		return
+	}
+	holder, _ := rgba64Pool.holders.Get().(*[]color.RGBA64)
+	if holder == nil {
+		holder = new([]color.RGBA64)
+	}
+	*holder = data[:0]
+	rgba64Pool.put(holder, cap(data))
+}
+
+// resizeFrame returns a frame of the number of strands, reusing the strands of the
+// frame supplied
+//
+func resizeFrame(frame []animationModel.ChannelData, strands int) (resized []animationModel.ChannelData) {
+	if cap(frame) < strands {
+		resized = make([]animationModel.ChannelData, strands)
+		copy(resized, frame)
+		return resized
+	}
+	return frame[:strands]
+}
+
+// resizeStrand returns a buffer of the number of pixels, reusing the buffer supplied
+// when it is large enough and otherwise replacing it with one from the pools
+//
+func resizeStrand(data []color.RGBA, pixels int) (resized []color.RGBA) {
+	if cap(data) >= pixels {
+		return data[:pixels]
+	}
+	if cap(data) != 0 {
+		putPixels(data)
+	}
+	return getPixels(pixels)
+}
+
+// pooledCopy returns a copy of a frame made using pooled buffers, to be handed back
+// using releaseFrame once it is no longer used
+//
+func pooledCopy(frame []animationModel.ChannelData) (copied []animationModel.ChannelData) {
+	copied = make([]animationModel.ChannelData, len(frame))
+	for i, channelData := range frame {
+		copied[i] = animationModel.ChannelData{ChannelNum: channelData.ChannelNum, Data: getPixels(len(channelData.Data))}
+		copy(copied[i].Data, channelData.Data)
+	}
+	return copied
+}
+
+// releaseFrame returns the buffers of a frame made by pooledCopy to the pools
+//
+func releaseFrame(frame []animationModel.ChannelData) {
+	for _, channelData := range frame {
+		putPixels(channelData.Data)
+	}
+}
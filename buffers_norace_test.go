@@ -0,0 +1,5 @@
+// +build !race
+
+package mawt
+
+const raceEnabled = false
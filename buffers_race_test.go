@@ -0,0 +1,7 @@
+// +build race
+
+package mawt
+
+// The race detector drops some of the items put into a sync.Pool, so the pools
+// cannot be relied upon to hand back buffers without allocating
+const raceEnabled = true
@@ -0,0 +1,77 @@
+package mawt
+
+import (
+	"fmt"
+	"image/color"
+	"testing"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+)
+
+// testFrame returns a frame of logical strands with a pattern of colors
+//
+func testFrame(strands int, pixels int) (frame []animationModel.ChannelData) {
+	frame = make([]animationModel.ChannelData, strands)
+	for i := range frame {
+		data := make([]color.RGBA, pixels)
+		for j := range data {
+			data[j] = color.RGBA{uint8(i * 40), uint8(j), uint8(255 - j), 0xFF}
+		}
+		frame[i] = animationModel.ChannelData{ChannelNum: animationModel.OpcChannel(i + 1), Data: data}
+	}
+	return frame
+}
+
+// TestFrameAllocs checks that once its buffers have been sized the layout of a frame,
+// dimmed in 16 bits and mapped onto physical strands, does not allocate
+//
+func TestFrameAllocs(t *testing.T) {
+	strands, err := NewStrandMap([]StrandMapping{
+		{Logical: 1, Segments: []Segment{{Channel: 9, Offset: 0, Length: 100}, {Channel: 10, Offset: 0}}},
+		{Logical: 2, Segments: []Segment{{Channel: 10, Offset: 300}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &FadeCandy{
+		effects:    NewEffectTimes(defaultEffectBudget),
+		narrower:   NewNarrower(),
+		brightness: 0.5,
+		strands:    strands,
+	}
+	frame := testFrame(4, 500)
+	tm := time.Now()
+
+	physical := fc.layout(frame, tm, nil)
+	channels := []animationModel.OpcChannel{}
+	for _, strand := range physical {
+		channels = append(channels, strand.ChannelNum)
+	}
+	if want := []animationModel.OpcChannel{3, 4, 9, 10}; fmt.Sprint(channels) != fmt.Sprint(want) {
+		t.Fatalf("the physical strands are %v, expected %v", channels, want)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		fc.layout(frame, tm, nil)
+	})
+	if allocs != 0 {
+		t.Fatalf("the layout of a frame made %g allocations, expected none", allocs)
+	}
+}
+
+// TestPixelPoolAllocs checks that buffers handed back to the pools are taken from
+// them again without allocating
+//
+func TestPixelPoolAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the pools drop buffers when the race detector is used")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		putPixels(getPixels(300))
+		putPixels16(getPixels16(300))
+	})
+	if allocs != 0 {
+		t.Fatalf("the pooled buffers made %g allocations, expected none", allocs)
+	}
+}
@@ -0,0 +1,189 @@
+package mawt
+
+// This module implements physical buttons wired to GPIO inputs, each bound to an
+// action such as moving on to the next effect of a show, stepping the brightness,
+// blacking out the sculpture or running the self-test, so that a builder can
+// operate the sculpture without a computer attached.  The inputs are read using
+// the Linux sysfs GPIO interface and debounced, an action being taken once each
+// time its button is pressed
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	buttonPoll     = 10 * time.Millisecond
+	buttonDebounce = 50 * time.Millisecond
+	buttonStep     = 0.1
+)
+
+// ButtonConfig binds a GPIO input to an action
+//
+type ButtonConfig struct {
+	GPIO int `yaml:"gpio"` // The sysfs GPIO number of the input
+
+	// Action is one of cycle-effect, brightness-up, brightness-down, blackout,
+	// scene or self-test.  cycle-effect moves a show on to its next playlist entry,
+	// blackout engages the emergency stop, or clears it when already engaged, and
+	// scene shows a named scene, or clears it when already showing
+	Action string `yaml:"action"`
+	Scene  string `yaml:"scene"` // The scene of the scene action
+
+	ActiveLow bool          `yaml:"activeLow"` // The input reads 0 while pressed, as when wired to ground with a pull up
+	Debounce  time.Duration `yaml:"debounce"`  // The time the input must be steady before a change is accepted, defaults to 50ms
+	Step      float64       `yaml:"step"`      // The change in brightness of each press, defaults to 0.1
+}
+
+// Buttons reads the GPIO inputs and applies their actions to the pipelines
+//
+type Buttons struct {
+	config []ButtonConfig
+	gws    []*Gateway
+
+	// SelfTest is called for the self-test action, the self-test being part of the
+	// command rather than of the pipelines
+	SelfTest func()
+}
+
+// NewButtons validates the button bindings
+//
+func NewButtons(config []ButtonConfig) (buttons *Buttons, err errors.Error) {
+	pins := map[int]bool{}
+	buttons = &Buttons{config: make([]ButtonConfig, 0, len(config))}
+	for _, button := range config {
+		if button.GPIO < 0 {
+			return nil, errors.New("button GPIO numbers cannot be negative").With("gpio", button.GPIO).With("stack", stack.Trace().TrimRuntime())
+		}
+		if pins[button.GPIO] {
+			return nil, errors.New("GPIO inputs can only be bound to one button").With("gpio", button.GPIO).With("stack", stack.Trace().TrimRuntime())
+		}
+		pins[button.GPIO] = true
+
+		switch button.Action {
+		case "cycle-effect", "brightness-up", "brightness-down", "blackout", "self-test":
+		case "scene":
+			if len(button.Scene) == 0 {
+				return nil, errors.New("scene actions need the name of a scene").With("gpio", button.GPIO).With("stack", stack.Trace().TrimRuntime())
+			}
+		default:
+			return nil, errors.New("buttons can be bound to the cycle-effect, brightness-up, brightness-down, blackout, scene and self-test actions").With("gpio", button.GPIO).With("action", button.Action).With("stack", stack.Trace().TrimRuntime())
+		}
+		if button.Debounce < 0 {
+			return nil, errors.New("the button debounce cannot be negative").With("gpio", button.GPIO).With("debounce", button.Debounce).With("stack", stack.Trace().TrimRuntime())
+		}
+		if button.Debounce == 0 {
+			button.Debounce = buttonDebounce
+		}
+		if button.Step < 0 || button.Step > 1 {
+			return nil, errors.New("the button brightness step must be from 0 to 1").With("gpio", button.GPIO).With("step", button.Step).With("stack", stack.Trace().TrimRuntime())
+		}
+		if button.Step == 0 {
+			button.Step = buttonStep
+		}
+		buttons.config = append(buttons.config, button)
+	}
+	return buttons, nil
+}
+
+// Start exports the GPIO inputs and watches them, applying the actions to the
+// pipelines supplied until quitC is closed
+//
+func (buttons *Buttons) Start(gws []*Gateway, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	buttons.gws = gws
+
+	dirs := make([]string, len(buttons.config))
+	for i, button := range buttons.config {
+		if dirs[i], err = exportGPIOInput(button.GPIO); err != nil {
+			return err.With("action", button.Action)
+		}
+	}
+
+	go func() {
+		defer track("buttons")()
+		tick := time.NewTicker(buttonPoll)
+		defer tick.Stop()
+
+		raw := make([]bool, len(buttons.config))
+		steady := make([]bool, len(buttons.config))
+		changed := make([]time.Time, len(buttons.config))
+		reported := make([]bool, len(buttons.config))
+		for {
+			select {
+			case now := <-tick.C:
+				for i, button := range buttons.config {
+					value, errGo := ioutil.ReadFile(filepath.Join(dirs[i], "value"))
+					if errGo != nil {
+						// Unlike the emergency stop an unreadable button is left alone
+						if !reported[i] {
+							sendErr(errorC, errors.Wrap(errGo).With("gpio", button.GPIO).With("stack", stack.Trace().TrimRuntime()))
+							reported[i] = true
+						}
+						continue
+					}
+					reported[i] = false
+
+					pressed := bytes.Equal(bytes.TrimSpace(value), []byte("1")) != button.ActiveLow
+					if pressed != raw[i] {
+						raw[i], changed[i] = pressed, now
+						continue
+					}
+					if pressed == steady[i] || now.Sub(changed[i]) < button.Debounce {
+						continue
+					}
+					steady[i] = pressed
+					if pressed {
+						buttons.Press(button, now)
+					}
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Press applies the action of a button pressed at the supplied time
+//
+func (buttons *Buttons) Press(button ButtonConfig, now time.Time) {
+	source := fmt.Sprintf("button gpio%d", button.GPIO)
+	bus.Publish(TopicEvents, Event{Time: now, Kind: "button", Detail: button.Action + " pressed on " + source})
+
+	switch button.Action {
+	case "cycle-effect":
+		for _, gw := range buttons.gws {
+			if gw.Show != nil {
+				gw.Show.Skip()
+			}
+		}
+	case "brightness-up", "brightness-down":
+		step := button.Step
+		if button.Action == "brightness-down" {
+			step = -step
+		}
+		for _, gw := range buttons.gws {
+			gw.SetBrightness(gw.Brightness() + step)
+		}
+	case "blackout":
+		if GetEStop().Engaged {
+			ClearEStop(source)
+			return
+		}
+		EngageEStop(source)
+	case "scene":
+		for _, gw := range buttons.gws {
+			gw.ToggleScene(button.Scene, source)
+		}
+	case "self-test":
+		if buttons.SelfTest != nil {
+			go buttons.SelfTest()
+		}
+	}
+}
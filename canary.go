@@ -0,0 +1,137 @@
+package mawt
+
+// This module implements the canary, a physical strand set aside from the
+// animations that always runs a known pattern computed from the time of each
+// frame.  The game data, cues and brightness are never applied to it, so when the
+// canary stops moving crews know at once that the renderer or the output is
+// wedged rather than the portal simply being quiet
+
+import (
+	"image/color"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultCanaryPattern = "chase"
+	defaultCanaryPixels  = 30
+	defaultCanaryPeriod  = 2 * time.Second
+)
+
+var (
+	// canaryColors are the colors of successive laps of the chase and blinks, so
+	// that a frozen frame can be told apart from the next lap
+	canaryColors = []color.RGBA{
+		{R: 0xFF, A: 0xFF},
+		{G: 0xFF, A: 0xFF},
+		{B: 0xFF, A: 0xFF},
+	}
+)
+
+// CanaryConfig defines the strand running the known pattern
+//
+type CanaryConfig struct {
+	Channel int           `yaml:"channel"` // The physical strand, or OPC channel, given over to the canary
+	Pixels  int           `yaml:"pixels"`  // The number of pixels on the strand, defaults to 30
+	Pattern string        `yaml:"pattern"` // chase, blink or rainbow, defaults to chase
+	Period  time.Duration `yaml:"period"`  // The time taken for one lap of the pattern, defaults to 2s
+}
+
+// NewCanary validates the canary
+//
+func NewCanary(config CanaryConfig) (canary *CanaryConfig, err errors.Error) {
+	if config.Channel < 1 || config.Channel > 255 {
+		return nil, errors.New("the canary channel must be from 1 to 255").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Pixels < 0 || config.Pixels > maxStrandPixels {
+		return nil, errors.New("the canary pixels must be from 1 to the length of a strand").With("pixels", config.Pixels).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Pixels == 0 {
+		config.Pixels = defaultCanaryPixels
+	}
+	switch config.Pattern {
+	case "":
+		config.Pattern = defaultCanaryPattern
+	case "chase", "blink", "rainbow":
+	default:
+		return nil, errors.New("the canary pattern must be chase, blink or rainbow").With("pattern", config.Pattern).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Period < 0 {
+		return nil, errors.New("the canary period cannot be negative").With("period", config.Period).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Period == 0 {
+		config.Period = defaultCanaryPeriod
+	}
+	return &config, nil
+}
+
+// Frame returns the canary pattern for a frame rendered at the supplied time, the
+// pattern depending on nothing but the time so that every gateway running the same
+// canary shows the same pixels
+//
+func (canary *CanaryConfig) Frame(now time.Time) (pixels []color.RGBA) {
+	pixels = make([]color.RGBA, canary.Pixels)
+	for i := range pixels {
+		pixels[i] = color.RGBA{A: 0xFF}
+	}
+
+	elapsed := now.UnixNano()
+	period := int64(canary.Period)
+	lap := int((elapsed / period) % int64(len(canaryColors)))
+	phase := float64(elapsed%period) / float64(period)
+
+	switch canary.Pattern {
+	case "chase":
+		pixels[int(phase*float64(canary.Pixels))%canary.Pixels] = canaryColors[lap]
+	case "blink":
+		if phase < 0.5 {
+			for i := range pixels {
+				pixels[i] = canaryColors[lap]
+			}
+		}
+	case "rainbow":
+		for i := range pixels {
+			pixels[i] = hueColor(phase + float64(i)/float64(canary.Pixels))
+		}
+	}
+	return pixels
+}
+
+// canaryStrand replaces the strand of the canary within a physical frame, the
+// frame is copied as its buffers belong to the animations
+//
+func canaryStrand(frame []animationModel.ChannelData, canary *CanaryConfig, now time.Time) (shown []animationModel.ChannelData) {
+	channel := animationModel.OpcChannel(canary.Channel)
+	shown = make([]animationModel.ChannelData, 0, len(frame)+1)
+	for _, channelData := range frame {
+		if channelData.ChannelNum != channel {
+			shown = append(shown, channelData)
+		}
+	}
+	return append(shown, animationModel.ChannelData{ChannelNum: channel, Data: canary.Frame(now)})
+}
+
+// hueColor returns the fully saturated color for a hue, from 0 to 1 wrapping around
+//
+func hueColor(hue float64) (rgba color.RGBA) {
+	hue -= float64(int(hue))
+	sector := hue * 6
+	rise := uint8(0xFF * (sector - float64(int(sector))))
+	fall := 0xFF - rise
+	switch int(sector) {
+	case 0:
+		return color.RGBA{R: 0xFF, G: rise, A: 0xFF}
+	case 1:
+		return color.RGBA{R: fall, G: 0xFF, A: 0xFF}
+	case 2:
+		return color.RGBA{G: 0xFF, B: rise, A: 0xFF}
+	case 3:
+		return color.RGBA{G: fall, B: 0xFF, A: 0xFF}
+	case 4:
+		return color.RGBA{R: rise, B: 0xFF, A: 0xFF}
+	}
+	return color.RGBA{R: 0xFF, B: fall, A: 0xFF}
+}
@@ -0,0 +1,392 @@
+package mawt
+
+// This module contains the detection of changes to the home portal status that
+// require the animations to be updated.  The status is checked on every
+// refresh, so the strategy used matters on small hosts such as the Raspberry Pi
+// Zero.  Checks are skipped entirely when no status has been received since the
+// last check, and otherwise the strategy decides if the content changed.  The
+// fields strategy compares the status field by field, reporting which fields
+// changed so that only the layers of the animations they drive are updated
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/cnf/structhash"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ChangeMask records the fields of a portal status that changed
+//
+type ChangeMask uint32
+
+const (
+	ChangeFaction    ChangeMask = 1 << iota // The controlling faction
+	ChangeLevel                             // The portal level
+	ChangeHealth                            // The portal health
+	ChangeResonators                        // The levels, health or owners of the resonators, or their positions
+	ChangeMods                              // The deployed mods
+	ChangeOwner                             // The owner of the portal
+	ChangeDetails                           // The title, description or cover image
+
+	ChangeAll = ChangeFaction | ChangeLevel | ChangeHealth | ChangeResonators | ChangeMods | ChangeOwner | ChangeDetails
+)
+
+var (
+	changeNames = []string{"faction", "level", "health", "resonators", "mods", "owner", "details"}
+)
+
+// String returns the names of the changed fields separated by commas
+//
+func (mask ChangeMask) String() (names string) {
+	changed := []string{}
+	for i, name := range changeNames {
+		if mask&(1<<uint(i)) != 0 {
+			changed = append(changed, name)
+		}
+	}
+	return strings.Join(changed, ",")
+}
+
+// DiffStatus returns the fields that differ between two statuses, all of them when
+// there is no previous status
+//
+func DiffStatus(previous *model.Status, status *model.Status) (mask ChangeMask) {
+	if previous == nil {
+		return ChangeAll
+	}
+	if previous.Faction != status.Faction {
+		mask |= ChangeFaction
+	}
+	if previous.Level != status.Level {
+		mask |= ChangeLevel
+	}
+	if previous.Health != status.Health {
+		mask |= ChangeHealth
+	}
+	if previous.Owner != status.Owner {
+		mask |= ChangeOwner
+	}
+	if previous.Title != status.Title || previous.Description != status.Description || previous.CoverImageURL != status.CoverImageURL {
+		mask |= ChangeDetails
+	}
+	if len(previous.Mods) != len(status.Mods) {
+		mask |= ChangeMods
+	} else {
+		for i := range status.Mods {
+			if previous.Mods[i] != status.Mods[i] {
+				mask |= ChangeMods
+				break
+			}
+		}
+	}
+	if len(previous.Resonators) != len(status.Resonators) {
+		mask |= ChangeResonators
+	} else {
+		for i := range status.Resonators {
+			if previous.Resonators[i] != status.Resonators[i] {
+				mask |= ChangeResonators
+				break
+			}
+		}
+	}
+	return mask
+}
+
+// ChangeDetector decides whether a portal status differs from the status
+// previously passed to it
+//
+type ChangeDetector interface {
+	Name() string
+	Changed(status *model.Status) (changed bool)
+}
+
+// FieldChangeDetector is a change detector that also reports which fields changed,
+// other detectors are taken to have changed every field
+//
+type FieldChangeDetector interface {
+	ChangeDetector
+	ChangedFields(status *model.Status) (mask ChangeMask)
+}
+
+// NewChangeDetector returns the named change detection strategy, fnv when the name is empty
+//
+func NewChangeDetector(name string) (detector ChangeDetector, err errors.Error) {
+	switch name {
+	case "", "fnv":
+		return &fnvDetector{hasher: fnv.New64a()}, nil
+	case "md5":
+		return &md5Detector{}, nil
+	case "generation":
+		return &generationDetector{}, nil
+	case "fields":
+		return &fieldsDetector{}, nil
+	}
+	return nil, errors.New("unknown change detection, fnv, md5, generation and fields are supported").With("changeDetection", name).With("stack", stack.Trace().TrimRuntime())
+}
+
+// md5Detector compares an MD5 digest of the reflected structure of the status, this
+// being the original and most expensive approach
+//
+type md5Detector struct {
+	last []byte
+}
+
+func (*md5Detector) Name() (name string) {
+	return "md5"
+}
+
+func (detector *md5Detector) Changed(status *model.Status) (changed bool) {
+	hash := structhash.Md5(status, 1)
+	changed = !bytes.Equal(detector.last, hash)
+	detector.last = hash
+	return changed
+}
+
+// fnvDetector compares a 64 bit FNV-1a hash of a canonical serialization of the status
+//
+type fnvDetector struct {
+	hasher hash.Hash64
+	last   uint64
+	primed bool
+}
+
+func (*fnvDetector) Name() (name string) {
+	return "fnv"
+}
+
+func (detector *fnvDetector) Changed(status *model.Status) (changed bool) {
+	h := detector.hasher
+	h.Reset()
+
+	num := make([]byte, 4)
+	writeFloat := func(value float32) {
+		binary.LittleEndian.PutUint32(num, math.Float32bits(value))
+		h.Write(num)
+	}
+	// Strings are terminated so that adjacent fields cannot run together
+	writeString := func(value string) {
+		h.Write([]byte(value))
+		h.Write([]byte{0})
+	}
+
+	writeString(status.Title)
+	writeString(status.Description)
+	writeString(status.CoverImageURL)
+	writeString(status.Owner)
+	writeString(status.Faction)
+	writeFloat(status.Level)
+	writeFloat(status.Health)
+	writeFloat(float32(len(status.Mods)))
+	for _, mod := range status.Mods {
+		writeString(mod.Owner)
+		writeFloat(mod.Slot)
+		writeString(mod.Type)
+		writeString(mod.Rarity)
+	}
+	writeFloat(float32(len(status.Resonators)))
+	for _, reso := range status.Resonators {
+		writeString(reso.Position)
+		writeFloat(reso.Level)
+		writeFloat(reso.Health)
+		writeString(reso.Owner)
+	}
+
+	sum := h.Sum64()
+	changed = !detector.primed || sum != detector.last
+	detector.last, detector.primed = sum, true
+	return changed
+}
+
+// RevisionChangeDetector is a change detector that decides using the revisions the
+// pollers give the statuses they decode, rather than examining the status
+//
+type RevisionChangeDetector interface {
+	ChangeDetector
+	ChangedRevision(portal string, revision uint64) (changed bool)
+}
+
+// generationDetector compares the revision the poller gave the status, which the
+// poller increments only when the status it decoded differs from the last one, with
+// the revision last seen, costing nothing to check.  Statuses whose source does not
+// count revisions, such as replayed or injected statuses, are always treated as changed
+//
+type generationDetector struct {
+	portal   string
+	revision uint64
+}
+
+func (*generationDetector) Name() (name string) {
+	return "generation"
+}
+
+// Changed treats the status as changed, being used only for statuses that have no revision
+//
+func (*generationDetector) Changed(status *model.Status) (changed bool) {
+	return true
+}
+
+func (detector *generationDetector) ChangedRevision(portal string, revision uint64) (changed bool) {
+	changed = revision == 0 || portal != detector.portal || revision != detector.revision
+	detector.portal, detector.revision = portal, revision
+	return changed
+}
+
+// fieldsDetector compares the status with the previous one field by field
+//
+type fieldsDetector struct {
+	last *model.Status
+}
+
+func (*fieldsDetector) Name() (name string) {
+	return "fields"
+}
+
+func (detector *fieldsDetector) Changed(status *model.Status) (changed bool) {
+	return detector.ChangedFields(status) != 0
+}
+
+// ChangedFields returns the fields that changed, the status is retained and must
+// not be modified afterwards
+//
+func (detector *fieldsDetector) ChangedFields(status *model.Status) (mask ChangeMask) {
+	mask = DiffStatus(detector.last, status)
+	detector.last = status
+	return mask
+}
+
+// ChangeStats are the change detection metrics for the home portal of a pipeline
+//
+type ChangeStats struct {
+	Strategy string  `json:"strategy"`
+	Skipped  uint64  `json:"skipped"` // Checks skipped as no status had been received
+	Checks   uint64  `json:"checks"`  // Statuses examined by the strategy
+	Changes  uint64  `json:"changes"` // Statuses found to have changed
+	MeanUs   float64 `json:"meanUs"`  // Mean time taken to copy and examine a status
+	MaxUs    float64 `json:"maxUs"`
+
+	Fields map[string]uint64 `json:"fields,omitempty"` // The changes to each field, counted by the fields strategy
+}
+
+// changeTracker applies a change detector and accumulates its metrics
+//
+type changeTracker struct {
+	detector   ChangeDetector
+	generation uint64 // The status generation last examined
+	stats      ChangeStats
+	total      time.Duration
+	sync.Mutex
+}
+
+func newChangeTracker(detector ChangeDetector) (tracker *changeTracker) {
+	return &changeTracker{
+		detector: detector,
+		stats:    ChangeStats{Strategy: detector.Name()},
+	}
+}
+
+// SetDetector switches the strategy used, the next status is treated as changed
+//
+func (tracker *changeTracker) SetDetector(detector ChangeDetector) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	tracker.detector = detector
+	tracker.generation = 0
+	tracker.stats = ChangeStats{Strategy: detector.Name()}
+	tracker.total = 0
+}
+
+// check returns a copy of the status when it needs to be sent to the animations,
+// along with the fields that changed
+//
+func (tracker *changeTracker) check(status *LastStatus) (copied *model.Status, mask ChangeMask) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	start := time.Now()
+
+	status.Lock()
+	if status.generation == tracker.generation {
+		status.Unlock()
+		tracker.stats.Skipped++
+		return nil, 0
+	}
+	tracker.generation = status.generation
+	if status.status == nil {
+		status.Unlock()
+		return nil, 0
+	}
+	copied = status.status.DeepCopy()
+	portal, revision := status.portal, status.revision
+	status.Unlock()
+
+	// Portal status not yet available
+	if copied.Faction == "" {
+		return nil, 0
+	}
+
+	fields, isFields := tracker.detector.(FieldChangeDetector)
+	revisions, isRevisions := tracker.detector.(RevisionChangeDetector)
+	switch {
+	case isFields:
+		mask = fields.ChangedFields(copied)
+	case isRevisions:
+		if revisions.ChangedRevision(portal, revision) {
+			mask = ChangeAll
+		}
+	case tracker.detector.Changed(copied):
+		mask = ChangeAll
+	}
+
+	elapsed := time.Since(start)
+	tracker.stats.Checks++
+	tracker.total += elapsed
+	tracker.stats.MeanUs = float64(tracker.total/time.Microsecond) / float64(tracker.stats.Checks)
+	if us := float64(elapsed / time.Microsecond); us > tracker.stats.MaxUs {
+		tracker.stats.MaxUs = us
+	}
+
+	if mask == 0 {
+		return nil, 0
+	}
+	if log := componentLog(LogDecoder); log.IsDebug() {
+		log.Debug("portal status changed", "strategy", tracker.stats.Strategy, "fields", mask.String(), "faction", copied.Faction, "level", copied.Level)
+	}
+	tracker.stats.Changes++
+	if isFields {
+		if tracker.stats.Fields == nil {
+			tracker.stats.Fields = map[string]uint64{}
+		}
+		for i, name := range changeNames {
+			if mask&(1<<uint(i)) != 0 {
+				tracker.stats.Fields[name]++
+			}
+		}
+	}
+	return copied, mask
+}
+
+// Stats returns the change detection metrics
+//
+func (tracker *changeTracker) Stats() (stats ChangeStats) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	stats = tracker.stats
+	if tracker.stats.Fields != nil {
+		stats.Fields = make(map[string]uint64, len(tracker.stats.Fields))
+		for name, count := range tracker.stats.Fields {
+			stats.Fields[name] = count
+		}
+	}
+	return stats
+}
@@ -0,0 +1,146 @@
+package mawt
+
+// This module implements the animation clock shared by the pipelines of the
+// process.  The animations are rendered at the time given by the clock rather
+// than the wall clock, so that they can be slowed down, sped up or paused, for
+// example for photography sessions or to examine a single frame.  The clock
+// only governs the animations, the health tracking, status indicators and the
+// canary keep to the wall clock so that a paused sculpture is not mistaken for
+// a wedged one
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/animation"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	MinClockSpeed = 0.1
+	MaxClockSpeed = 5.0
+)
+
+// ClockState describes the speed of the animation clock and whether it is paused
+//
+type ClockState struct {
+	Speed  float64   `json:"speed"`
+	Paused bool      `json:"paused"`
+	Since  time.Time `json:"since"` // The time the speed or pause last changed
+	Source string    `json:"source,omitempty"`
+}
+
+// AnimationClock converts the wall clock times of frames into the times the
+// animations are rendered at
+//
+type AnimationClock struct {
+	state ClockState
+
+	wall      time.Time // The wall clock time of the last change, zero while the clock has never changed
+	animation time.Time // The animation time at the last change
+	sync.Mutex
+}
+
+var (
+	animationClock = &AnimationClock{state: ClockState{Speed: 1}}
+)
+
+func init() {
+	// The portal animations start their effects and sequence steps at the time of
+	// the animation clock, matching the times their frames are rendered at
+	animation.Now = func() time.Time { return animationClock.Now(time.Now()) }
+}
+
+// GetClock returns the animation clock shared by the pipelines of the process
+//
+func GetClock() (clock *AnimationClock) {
+	return animationClock
+}
+
+// now returns the animation time for a wall clock time, the caller holds the lock
+//
+func (clock *AnimationClock) now(wall time.Time) (tm time.Time) {
+	if clock.wall.IsZero() {
+		return wall
+	}
+	if clock.state.Paused {
+		return clock.animation
+	}
+	return clock.animation.Add(time.Duration(float64(wall.Sub(clock.wall)) * clock.state.Speed))
+}
+
+// Now returns the time the animations are rendered at for a frame rendered at the
+// supplied wall clock time
+//
+func (clock *AnimationClock) Now(wall time.Time) (tm time.Time) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	return clock.now(wall)
+}
+
+// change applies a change to the clock, the animations continuing from the time
+// they had reached, returning the event to be published once the caller, which
+// holds the lock, has released it
+//
+func (clock *AnimationClock) change(speed float64, paused bool, source string) (event Event) {
+	detail := fmt.Sprintf("%gx by %s", speed, source)
+	switch {
+	case paused:
+		detail = "paused by " + source
+	case clock.state.Paused:
+		detail = fmt.Sprintf("resumed at %gx by %s", speed, source)
+	}
+
+	wall := time.Now()
+	clock.animation = clock.now(wall)
+	clock.wall = wall
+	clock.state = ClockState{Speed: speed, Paused: paused, Since: wall, Source: source}
+	return Event{Time: wall, Kind: "clock", Detail: detail}
+}
+
+// SetSpeed changes the speed of the animations, from 0.1 to 5 times their
+// normal speed, the source describes what changed it
+//
+func (clock *AnimationClock) SetSpeed(speed float64, source string) (err errors.Error) {
+	if speed < MinClockSpeed || speed > MaxClockSpeed {
+		return errors.New("the animation speed must be from 0.1 to 5").With("speed", speed).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	clock.Lock()
+	if speed == clock.state.Speed {
+		clock.Unlock()
+		return nil
+	}
+	event := clock.change(speed, clock.state.Paused, source)
+	clock.Unlock()
+
+	bus.Publish(TopicEvents, event)
+	return nil
+}
+
+// Pause freezes the animations, or resumes them, the source describes what
+// paused or resumed them
+//
+func (clock *AnimationClock) Pause(paused bool, source string) {
+	clock.Lock()
+	if paused == clock.state.Paused {
+		clock.Unlock()
+		return
+	}
+	event := clock.change(clock.state.Speed, paused, source)
+	clock.Unlock()
+
+	bus.Publish(TopicEvents, event)
+}
+
+// State returns the speed of the animation clock and whether it is paused
+//
+func (clock *AnimationClock) State() (state ClockState) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	return clock.state
+}
@@ -0,0 +1,91 @@
+package main
+
+// This command renders the golden scenarios and compares the results against the
+// golden frame files, or when -update is used replaces the golden frame files.  It
+// should be run after any change to the animations or sequence runner
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/TeamNorCal/mawt/golden"
+	"github.com/TeamNorCal/mawt/version"
+
+	"github.com/karlmutch/envflag" // Forked copy of https://github.com/GoBike/envflag
+)
+
+var (
+	goldenDir = flag.String("dir", "assets/golden", "the directory containing the golden frame files")
+	update    = flag.Bool("update", false, "replace the golden frame files with the frames that are rendered")
+	tolerance = flag.Uint("tolerance", 12, "the maximum difference permitted in any color component of a pixel")
+	seed      = flag.Int64("seed", 1, "the seed of the effects using random numbers, fixed so that the frames rendered are reproducible")
+	maxReport = flag.Int("max-report", 10, "the maximum number of mismatched pixels reported for each scenario")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, path.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "usage: ", os.Args[0], "[options]       golden frame checker (golden)      ", version.GitHash, "    ", version.BuildTime)
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Environment Variables:")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "options can also be extracted from environment variables by changing dashes '-' to underscores and using upper case.")
+}
+
+func init() {
+	flag.Usage = usage
+}
+
+func main() {
+	if !flag.Parsed() {
+		envflag.Parse()
+	}
+
+	mawt.SetSeeds(*seed, nil)
+
+	failed := false
+
+	for _, scenario := range golden.Scenarios() {
+		frames := golden.Render(scenario)
+
+		if *update {
+			if err := golden.Save(*goldenDir, scenario.Name, frames); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(-1)
+			}
+			fmt.Fprintf(os.Stdout, "%s updated\n", scenario.Name)
+			continue
+		}
+
+		want, err := golden.Load(*goldenDir, scenario.Name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(-1)
+		}
+
+		mismatches := golden.Compare(frames, want, uint8(*tolerance))
+		if len(mismatches) == 0 {
+			fmt.Fprintf(os.Stdout, "%s ok\n", scenario.Name)
+			continue
+		}
+
+		failed = true
+		fmt.Fprintf(os.Stdout, "%s FAILED with %d mismatched pixels\n", scenario.Name, len(mismatches))
+		for i, mismatch := range mismatches {
+			if i == *maxReport {
+				break
+			}
+			fmt.Fprintf(os.Stdout, "    %s\n", mismatch.String())
+		}
+	}
+
+	if failed {
+		os.Exit(-2)
+	}
+}
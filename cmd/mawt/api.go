@@ -0,0 +1,1031 @@
+package main
+
+// This file implements the REST API offered by the gateway for operators.  The
+// handlers are added to the default HTTP mux that is also used by the
+// pprof profiling handlers
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt"
+	"github.com/TeamNorCal/mawt/version"
+)
+
+var (
+	// pipelines contains the gateways that are running, in the order they were defined
+	pipelines = []*mawt.Gateway{}
+
+	// store holds the persisted records when the -store-dir option is used
+	store *mawt.Store
+)
+
+// initAPI adds the handlers for the REST API.  The unqualified endpoints refer to the
+// first pipeline, each pipeline also has its own endpoints under /api/v1/pipelines/{name}/
+// and its health metrics published using expvar under mawt.pipeline.{name}, or
+// mawt.{instance}.pipeline.{name} when the -instance option is used.  The endpoints
+// of each version of the API are described by the contract in contract.go
+//
+func initAPI(gws []*mawt.Gateway) {
+	pipelines = gws
+
+	http.HandleFunc("/api", serveAPIVersions)
+	http.HandleFunc("/api/v1/contract", serveContract)
+	http.HandleFunc("/api/v1/history", func(w http.ResponseWriter, r *http.Request) {
+		serveHistory(pipelines[0], w, r)
+	})
+	http.HandleFunc("/api/v1/profile", func(w http.ResponseWriter, r *http.Request) {
+		serveQuality(pipelines[0], w, r)
+	})
+	http.HandleFunc("/api/v1/effects", func(w http.ResponseWriter, r *http.Request) {
+		serveEffects(pipelines[0], w, r)
+	})
+	http.HandleFunc("/api/v1/topology", func(w http.ResponseWriter, r *http.Request) {
+		serveTopology(pipelines[0], w, r)
+	})
+	http.HandleFunc("/api/v1/universes", func(w http.ResponseWriter, r *http.Request) {
+		serveUniverses(pipelines[0], w, r)
+	})
+	http.HandleFunc("/api/v1/frame", func(w http.ResponseWriter, r *http.Request) {
+		serveFrame(pipelines[0], w, r)
+	})
+	http.HandleFunc("/api/v1/home", func(w http.ResponseWriter, r *http.Request) {
+		serveHome(pipelines[0], w, r)
+	})
+	http.HandleFunc("/api/v1/estop", serveEStop)
+	http.HandleFunc("/api/v1/clock", serveClock)
+	http.HandleFunc("/api/v1/scenes", serveScenes)
+	http.HandleFunc("/api/v1/log", serveLog)
+	http.HandleFunc("/api/v1/log/levels", serveLogLevels)
+	http.HandleFunc("/api/v1/config", serveConfig)
+	http.HandleFunc("/api/v1/config/schema", serveConfigSchema)
+	http.HandleFunc("/config", serveConfigEditor)
+	http.HandleFunc("/api/v1/annotations", serveAnnotations)
+	http.HandleFunc("/api/v1/events", serveEvents)
+	http.HandleFunc("/api/v1/beat", serveBeat)
+	http.HandleFunc("/api/v1/timecode", serveTimecode)
+	http.HandleFunc("/api/v1/store", serveStore)
+	http.HandleFunc("/api/v1/store/summary", serveStore)
+	http.HandleFunc("/api/v1/snapshot", serveSnapshot)
+	http.HandleFunc("/api/v1/faults", serveFaults)
+	http.HandleFunc("/api/v1/status", serveStatus)
+	http.HandleFunc("/api/v1/debug/profile", serveProfiling)
+	http.HandleFunc("/api/v1/pipelines", servePipelines)
+	http.HandleFunc("/api/v1/pipelines/", servePipeline)
+	http.HandleFunc("/api/v1/subscribers", serveSubscribers)
+
+	for _, gw := range gws {
+		health := gw.Health
+		expvar.Publish(instanceName("mawt")+".pipeline."+gw.Name, expvar.Func(func() interface{} {
+			return health.Snapshot()
+		}))
+		effects := gw.Effects
+		expvar.Publish(instanceName("mawt")+".effects."+gw.Name, expvar.Func(func() interface{} {
+			return effects.Report()
+		}))
+		strands := gw.StrandStats
+		expvar.Publish(instanceName("mawt")+".strands."+gw.Name, expvar.Func(func() interface{} {
+			return strands.Report()
+		}))
+		changes := gw
+		expvar.Publish(instanceName("mawt")+".changes."+gw.Name, expvar.Func(func() interface{} {
+			return changes.ChangeStats()
+		}))
+		broker := gw.Broker
+		expvar.Publish(instanceName("mawt")+".subscribers."+gw.Name, expvar.Func(func() interface{} {
+			return broker.Stats()
+		}))
+		if gw.Guard != nil {
+			guard := gw.Guard
+			expvar.Publish(instanceName("mawt")+".guard."+gw.Name, expvar.Func(func() interface{} {
+				return guard.Report()
+			}))
+		}
+		for _, binding := range gw.Outputs {
+			if validate, isOK := binding.Output.(*mawt.ValidateOutput); isOK {
+				expvar.Publish(instanceName("mawt")+".validation."+gw.Name, expvar.Func(func() interface{} {
+					return validate.Report()
+				}))
+				break
+			}
+		}
+	}
+
+	// The subscribers to the events and errors of the process are only namespaced by the instance
+	expvar.Publish(instanceName("mawt")+".subscribers", expvar.Func(func() interface{} {
+		return mawt.BusStats()
+	}))
+
+	// The temperature sensor is shared by the pipelines so its metrics are only namespaced by
+	// the instance
+	if len(gws) != 0 && gws[0].Thermal != nil {
+		thermal := gws[0].Thermal
+		expvar.Publish(instanceName("mawt")+".thermal", expvar.Func(func() interface{} {
+			return thermal.Report()
+		}))
+	}
+}
+
+func servePipelines(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(pipelines))
+	for _, gw := range pipelines {
+		names = append(names, gw.Name)
+	}
+	writeJSON(w, names)
+}
+
+// servePipeline handles the namespaced endpoints of individual pipelines
+//
+func servePipeline(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/pipelines/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, gw := range pipelines {
+		if gw.Name != parts[0] {
+			continue
+		}
+		switch parts[1] {
+		case "history":
+			serveHistory(gw, w, r)
+		case "health":
+			writeJSON(w, gw.Health.Snapshot())
+		case "profile":
+			serveQuality(gw, w, r)
+		case "home":
+			serveHome(gw, w, r)
+		case "effects":
+			serveEffects(gw, w, r)
+		case "preview":
+			servePreview(gw, w, r)
+		case "topology":
+			serveTopology(gw, w, r)
+		case "universes":
+			serveUniverses(gw, w, r)
+		case "changes":
+			writeJSON(w, gw.ChangeStats())
+		case "strands":
+			writeJSON(w, gw.StrandStats.Report())
+		case "input":
+			if gw.OPCInput == nil {
+				http.Error(w, fmt.Sprintf("pipeline %s has no OPC input", gw.Name), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, gw.OPCInput.Report())
+		case "ambient":
+			if gw.Ambient == nil {
+				http.Error(w, fmt.Sprintf("pipeline %s has no ambient light sensor", gw.Name), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, gw.Ambient.Report())
+		case "thermal":
+			if gw.Thermal == nil {
+				http.Error(w, fmt.Sprintf("pipeline %s has no temperature sensor", gw.Name), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, gw.Thermal.Report())
+		case "guard":
+			serveGuard(gw, w, r)
+		case "score":
+			if gw.Score == nil {
+				http.Error(w, fmt.Sprintf("pipeline %s has no score bar", gw.Name), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, gw.Score.Report())
+		case "frame":
+			serveFrame(gw, w, r)
+		case "display":
+			writeJSON(w, gw.Display())
+		case "validation":
+			serveValidation(gw, w, r)
+		case "pause":
+			servePause(gw, w, r)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+	http.Error(w, fmt.Sprintf("pipeline %s not found", parts[0]), http.StatusNotFound)
+}
+
+// subscribersReport holds the subscribers to the process broker and to the broker
+// of each pipeline
+//
+type subscribersReport struct {
+	Process   mawt.BrokerStats            `json:"process"`
+	Pipelines map[string]mawt.BrokerStats `json:"pipelines"`
+}
+
+// serveSubscribers reports the queues of the subscribers to the process broker and
+// to the broker of each pipeline, for finding slow consumers
+//
+func serveSubscribers(w http.ResponseWriter, r *http.Request) {
+	report := subscribersReport{
+		Process:   mawt.BusStats(),
+		Pipelines: map[string]mawt.BrokerStats{},
+	}
+	for _, gw := range pipelines {
+		report.Pipelines[gw.Name] = gw.Broker.Stats()
+	}
+	writeJSON(w, report)
+}
+
+// statusReport describes the build and options of the gateway
+//
+type statusReport struct {
+	Version    string              `json:"version"`
+	GitHash    string              `json:"gitHash"`
+	Server     string              `json:"server"`
+	Tecthulhus []string            `json:"tecthulhus"`
+	Pipelines  int                 `json:"pipelines"`
+	Timezone   mawt.TimezoneReport `json:"timezone"`
+	Seed       int64               `json:"seed"`
+	Discovered *discovered         `json:"discovered,omitempty"`
+	Crashes    *mawt.CrashState    `json:"crashes,omitempty"` // The starts counted when a -crash-state file is used
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	discoveries.Lock()
+	defer discoveries.Unlock()
+
+	found := discoveries
+	if !*discover {
+		found = nil
+	}
+
+	report := statusReport{
+		Version:    version.Version,
+		GitHash:    version.GitHash,
+		Server:     *fcserver,
+		Tecthulhus: strings.Split(*tecthulhus, ","),
+		Pipelines:  len(pipelines),
+		Timezone:   mawt.Timezone(),
+		Seed:       mawt.Seed(),
+		Discovered: found,
+	}
+	if crashGuard != nil {
+		state := crashGuard.State()
+		report.Crashes = &state
+	}
+	writeJSON(w, report)
+}
+
+// parseSince accepts either an RFC3339 timestamp, or a duration such as 5m
+// that is interpreted as being relative to the current time
+//
+func parseSince(since string, now time.Time) (tm time.Time, errGo error) {
+	if len(since) == 0 {
+		return time.Time{}, nil
+	}
+	if tm, errGo = time.Parse(time.RFC3339, since); errGo == nil {
+		return tm, nil
+	}
+	age, errGo := time.ParseDuration(since)
+	if errGo != nil {
+		return tm, fmt.Errorf("since must be an RFC3339 time or a duration, %s was supplied", since)
+	}
+	return now.Add(-age), nil
+}
+
+func serveHistory(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	since, errGo := parseSince(r.URL.Query().Get("since"), time.Now())
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, gw.History.Since(since))
+}
+
+// qualityReport holds the active quality profile of a pipeline and those available
+//
+type qualityReport struct {
+	Active   string                  `json:"active"`
+	Profiles map[string]mawt.Profile `json:"profiles"`
+}
+
+// serveQuality reports the quality profile of a pipeline, along with the profiles
+// available, on a GET and switches to the profile named by the name parameter on
+// a PUT or POST
+//
+func serveQuality(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if err := gw.SetProfile(r.URL.Query().Get("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apiLogger.Info(fmt.Sprintf("pipeline %s switched to the %s profile", gw.Name, gw.ActiveProfile()))
+	default:
+		http.Error(w, "only GET, PUT and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, qualityReport{
+		Active:   gw.ActiveProfile(),
+		Profiles: gw.AvailableProfiles(),
+	})
+}
+
+// serveHome reports the home portal of a pipeline, a PUT or POST makes the portal
+// parameter, one of the tecthulhu URLs of the pipeline, the home portal
+//
+func serveHome(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if err := gw.SetHome(r.URL.Query().Get("portal")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apiLogger.Info(fmt.Sprintf("pipeline %s home portal switched to %s by %s", gw.Name, gw.Home().Home, r.RemoteAddr))
+	default:
+		http.Error(w, "only GET, PUT and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, gw.Home())
+}
+
+// serveEffects reports the time taken to compute each of the effects in the frames of a pipeline
+//
+func serveEffects(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, gw.Effects.Report())
+}
+
+// serveTopology reports the strand mappings of a pipeline on a GET, adds or replaces
+// the mapping in the JSON body on a PUT or POST, and removes the mapping of the
+// logical strand named by the logical parameter on a DELETE
+//
+func serveTopology(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		mapping := mawt.StrandMapping{}
+		if errGo := json.NewDecoder(r.Body).Decode(&mapping); errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := gw.AddStrand(mapping); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apiLogger.Info(fmt.Sprintf("pipeline %s mapped logical strand %d onto %d segments", gw.Name, mapping.Logical, len(mapping.Segments)))
+	case http.MethodDelete:
+		logical, errGo := strconv.Atoi(r.URL.Query().Get("logical"))
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		if !gw.RemoveStrand(logical) {
+			http.Error(w, fmt.Sprintf("logical strand %d is not mapped", logical), http.StatusNotFound)
+			return
+		}
+		apiLogger.Info(fmt.Sprintf("pipeline %s removed the mapping of logical strand %d", gw.Name, logical))
+	default:
+		http.Error(w, "only GET, PUT, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, gw.Topology())
+}
+
+// serveUniverses reports the universes of a pipeline that frames are not sent to, a
+// DELETE detaches the universe or fadecandy device named by the universe or device
+// parameter and a PUT or POST attaches it again
+//
+func serveUniverses(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, gw.Universes())
+		return
+	}
+
+	universes := []int{}
+	query := r.URL.Query()
+	switch {
+	case query.Get("universe") != "":
+		universe, errGo := strconv.Atoi(query.Get("universe"))
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		universes = append(universes, universe)
+	case query.Get("device") != "":
+		device, errGo := strconv.Atoi(query.Get("device"))
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		deviceUniverses, err := mawt.DeviceUniverses(device)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		universes = deviceUniverses
+	default:
+		http.Error(w, "a universe or device parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	change, changed := gw.AttachUniverses, "attached"
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+	case http.MethodDelete:
+		change, changed = gw.DetachUniverses, "detached"
+	default:
+		http.Error(w, "only GET, PUT, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	state, err := change(universes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	apiLogger.Info(fmt.Sprintf("pipeline %s %s universes %v", gw.Name, changed, universes))
+	writeJSON(w, state)
+}
+
+// serveEStop reports the emergency stop on a GET, engages it on a POST and clears it
+// on a DELETE
+//
+func serveEStop(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		mawt.EngageEStop("api " + r.RemoteAddr)
+		apiLogger.Warn(fmt.Sprint("emergency stop engaged by ", r.RemoteAddr))
+	case http.MethodDelete:
+		mawt.ClearEStop("api " + r.RemoteAddr)
+		apiLogger.Warn(fmt.Sprint("emergency stop cleared by ", r.RemoteAddr))
+	default:
+		http.Error(w, "only GET, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, mawt.GetEStop())
+}
+
+// servePause reports whether the sends of a pipeline are paused, a POST pauses
+// them so that hardware can be swapped and a DELETE resumes them
+//
+func servePause(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	source := "api " + r.RemoteAddr
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, err := gw.Pause(source); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		apiLogger.Warn(fmt.Sprint("pipeline ", gw.Name, " paused by ", r.RemoteAddr))
+	case http.MethodDelete:
+		if err := gw.Resume(source); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		apiLogger.Warn(fmt.Sprint("pipeline ", gw.Name, " resumed by ", r.RemoteAddr))
+	default:
+		http.Error(w, "only GET, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, gw.PauseState())
+}
+
+// serveGuard reports the output guard of a pipeline, a POST confirms that frames
+// over its limit are intended and a DELETE arms it again
+//
+func serveGuard(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	if gw.Guard == nil {
+		http.Error(w, fmt.Sprintf("pipeline %s has no output guard", gw.Name), http.StatusNotFound)
+		return
+	}
+	source := "api " + r.RemoteAddr
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		gw.Guard.Confirm(source)
+		apiLogger.Warn(fmt.Sprint("pipeline ", gw.Name, " frames over the guard limit confirmed by ", r.RemoteAddr))
+	case http.MethodDelete:
+		gw.Guard.Arm(source)
+		apiLogger.Info(fmt.Sprint("pipeline ", gw.Name, " guard armed by ", r.RemoteAddr))
+	default:
+		http.Error(w, "only GET, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, gw.Guard.Report())
+}
+
+// serveClock reports the animation clock, a PUT or POST changes its speed using the
+// speed parameter and pauses or resumes it using the paused parameter
+//
+func serveClock(w http.ResponseWriter, r *http.Request) {
+	clock := mawt.GetClock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		source := "api " + r.RemoteAddr
+		if param := r.URL.Query().Get("speed"); len(param) != 0 {
+			speed, errGo := strconv.ParseFloat(param, 64)
+			if errGo != nil {
+				http.Error(w, errGo.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := clock.SetSpeed(speed, source); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if param := r.URL.Query().Get("paused"); len(param) != 0 {
+			paused, errGo := strconv.ParseBool(param)
+			if errGo != nil {
+				http.Error(w, errGo.Error(), http.StatusBadRequest)
+				return
+			}
+			clock.Pause(paused, source)
+		}
+		apiLogger.Info(fmt.Sprintf("animation clock at %gx, paused %t, set by %s", clock.State().Speed, clock.State().Paused, r.RemoteAddr))
+	default:
+		http.Error(w, "only GET, PUT and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, clock.State())
+}
+
+// scenesReport holds the scenes and the scene shown by each pipeline
+//
+type scenesReport struct {
+	Scenes []mawt.SceneConfig         `json:"scenes"`
+	Active map[string]mawt.SceneState `json:"active"` // The scene of each pipeline, by pipeline name
+}
+
+// serveScenes lists the scenes and those active on a GET, shows the scene in the name
+// parameter on a PUT or POST, for the optional timeout parameter rather than the
+// timeout of the scene, and returns to the animations on a DELETE.  The pipeline
+// parameter limits the change to one pipeline, otherwise all of them are changed
+//
+func serveScenes(w http.ResponseWriter, r *http.Request) {
+	gws := pipelines
+	if pipeline := r.URL.Query().Get("pipeline"); len(pipeline) != 0 {
+		gws = []*mawt.Gateway{}
+		for _, gw := range pipelines {
+			if gw.Name == pipeline {
+				gws = append(gws, gw)
+			}
+		}
+		if len(gws) == 0 {
+			http.Error(w, fmt.Sprintf("pipeline %s not found", pipeline), http.StatusNotFound)
+			return
+		}
+	}
+
+	source := "api " + r.RemoteAddr
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		name := r.URL.Query().Get("name")
+		timeout := time.Duration(0)
+		if param := r.URL.Query().Get("timeout"); len(param) != 0 {
+			parsed, errGo := time.ParseDuration(param)
+			if errGo != nil {
+				http.Error(w, errGo.Error(), http.StatusBadRequest)
+				return
+			}
+			timeout = parsed
+		}
+		for _, gw := range gws {
+			if _, err := gw.ActivateScene(name, timeout, source); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		apiLogger.Info(fmt.Sprintf("scene %s activated on %d pipelines by %s", name, len(gws), r.RemoteAddr))
+	case http.MethodDelete:
+		for _, gw := range gws {
+			gw.ClearScene(source)
+		}
+		apiLogger.Info(fmt.Sprintf("scenes cleared on %d pipelines by %s", len(gws), r.RemoteAddr))
+	default:
+		http.Error(w, "only GET, PUT, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := scenesReport{
+		Scenes: []mawt.SceneConfig{},
+		Active: map[string]mawt.SceneState{},
+	}
+	if len(pipelines) != 0 && pipelines[0].Scenes != nil {
+		report.Scenes = pipelines[0].Scenes.Configs()
+	}
+	for _, gw := range gws {
+		report.Active[gw.Name] = gw.Scene()
+	}
+	writeJSON(w, report)
+}
+
+// serveAnnotations adds the operator note in the text parameter, or the body, to
+// the event stream of the pipeline parameter, or all pipelines when it is absent
+//
+func serveAnnotations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	text := r.URL.Query().Get("text")
+	if len(text) == 0 {
+		body, errGo := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		text = string(body)
+	}
+
+	pipeline := r.URL.Query().Get("pipeline")
+	if len(pipeline) != 0 {
+		known := false
+		for _, gw := range pipelines {
+			known = known || gw.Name == pipeline
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("pipeline %s not found", pipeline), http.StatusNotFound)
+			return
+		}
+	}
+
+	event, err := mawt.Annotate(pipeline, text, "api "+r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	apiLogger.Info(fmt.Sprintf("annotation from %s: %s", r.RemoteAddr, event.Detail))
+	writeJSON(w, event)
+}
+
+// serveEvents streams the events of all pipelines as Server-Sent Events until the
+// client disconnects.  The optional pipeline parameter selects the events of one
+// pipeline along with those raised by the process, such as the emergency stop,
+// and the optional kind parameter a comma separated list of event kinds
+//
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, isOK := w.(http.Flusher)
+	if !isOK {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	pipeline := r.URL.Query().Get("pipeline")
+	kinds := map[string]bool{}
+	for _, kind := range strings.Split(r.URL.Query().Get("kind"), ",") {
+		if kind = strings.TrimSpace(kind); len(kind) != 0 {
+			kinds[kind] = true
+		}
+	}
+
+	// A client that stops reading is detached, ending the stream, rather than
+	// having the events queue for it indefinitely
+	sub := mawt.SubscribeEvents(mawt.SubscribeOptions{Name: "event stream " + r.RemoteAddr, Depth: 64, StallLimit: mawt.DefaultStallLimit})
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": mawt events\n\n")
+	flusher.Flush()
+
+	// Comments are sent while no events are passing to stop proxies from closing
+	// the connection, and to report events missed by a slow client
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	dropped := uint64(0)
+	for {
+		select {
+		case msg, isOpen := <-sub.C:
+			if !isOpen {
+				return
+			}
+			event := msg.(mawt.Event)
+			if len(pipeline) != 0 && len(event.Pipeline) != 0 && event.Pipeline != pipeline {
+				continue
+			}
+			if len(kinds) != 0 && !kinds[event.Kind] {
+				continue
+			}
+			data, errGo := json.Marshal(event)
+			if errGo != nil {
+				continue
+			}
+			if _, errGo = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Kind, data); errGo != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if missed := sub.Dropped(); missed != dropped {
+				fmt.Fprintf(w, ": %d events dropped\n\n", missed-dropped)
+				dropped = missed
+			}
+			if _, errGo := fmt.Fprint(w, ": keepalive\n\n"); errGo != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveStore returns the persisted records of the kind parameter, or a summary of
+// them for the summary endpoint, between the since and until parameters
+//
+func serveStore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if store == nil {
+		http.Error(w, "records are not being persisted, use the -store-dir option", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	since, errGo := parseSince(r.URL.Query().Get("since"), now)
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadRequest)
+		return
+	}
+	until, errGo := parseSince(r.URL.Query().Get("until"), now)
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summary := strings.HasSuffix(r.URL.Path, "/summary")
+	kind := r.URL.Query().Get("kind")
+	if summary {
+		kind = ""
+	}
+	records, err := store.Query(kind, since, until)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !summary {
+		writeJSON(w, records)
+		return
+	}
+	if until.IsZero() {
+		until = now
+	}
+	if since.IsZero() && len(records) != 0 {
+		since = records[0].Time
+	}
+	writeJSON(w, mawt.Summarize(records, since, until))
+}
+
+// serveBeat reports the tempo show sequences are aligned to on a GET.  A POST taps
+// the tempo, or sets it when the bpm parameter is supplied with the beat falling
+// at the time of the request
+//
+func serveBeat(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		param := r.URL.Query().Get("bpm")
+		if len(param) == 0 {
+			mawt.GetBeat().Tap(time.Now(), "api "+r.RemoteAddr)
+			break
+		}
+		bpm, errGo := strconv.ParseFloat(param, 64)
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := mawt.GetBeat().SetBPM(bpm, time.Now(), "api "+r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, mawt.GetBeat().State())
+}
+
+// serveTimecode reports the timecode chased by shows with a start timecode
+//
+func serveTimecode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, mawt.GetTimecode().State())
+}
+
+// servePreview streams the frames of a pipeline to a WebSocket client when the
+// pipeline has a websocket output
+//
+func servePreview(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	for _, binding := range gw.Outputs {
+		if preview, isOK := binding.Output.(*mawt.WebSocketOutput); isOK {
+			preview.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("pipeline %s has no websocket output", gw.Name), http.StatusNotFound)
+}
+
+// serveValidation reports the frames checked by the validate output of a pipeline
+//
+func serveValidation(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	for _, binding := range gw.Outputs {
+		if validate, isOK := binding.Output.(*mawt.ValidateOutput); isOK {
+			writeJSON(w, validate.Report())
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("pipeline %s has no validate output", gw.Name), http.StatusNotFound)
+}
+
+// invalidFrames is the number of invalid frames found by the validate outputs of all pipelines
+//
+func invalidFrames() (invalid uint64) {
+	for _, gw := range pipelines {
+		for _, binding := range gw.Outputs {
+			if validate, isOK := binding.Output.(*mawt.ValidateOutput); isOK {
+				invalid += validate.Report().Invalid
+			}
+		}
+	}
+	return invalid
+}
+
+// serveFrame shows the frame in the body, a series of OPC set pixel messages for the
+// logical strands, in place of the animations for the time in the hold parameter
+// on a PUT or POST, and returns the pipeline to the animations on a DELETE.  A GET
+// returns the frame being output
+//
+func serveFrame(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		serveScreenshot(gw, w, r)
+		return
+	case http.MethodPut, http.MethodPost:
+	case http.MethodDelete:
+		gw.ShowFrame(nil, 0)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "only GET, PUT, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hold := 5 * time.Second
+	if param := r.URL.Query().Get("hold"); len(param) != 0 {
+		duration, errGo := time.ParseDuration(param)
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		hold = duration
+	}
+
+	// One byte more than the largest frame is read so that oversize frames are
+	// rejected rather than truncated
+	data, errGo := ioutil.ReadAll(io.LimitReader(r.Body, mawt.MaxFrameBytes+1))
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > mawt.MaxFrameBytes {
+		http.Error(w, fmt.Sprintf("frames cannot be larger than %d bytes", mawt.MaxFrameBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	frame, err := mawt.UnpackFrame(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gw.ShowFrame(frame, hold)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// screenshotStrand is a physical strand of a frame, each pixel being its red, green
+// and blue components
+//
+type screenshotStrand struct {
+	Universe int        `json:"universe"`
+	Pixels   [][3]uint8 `json:"pixels"`
+}
+
+// serveScreenshot returns the next frame sent to the fadecandy server exactly as it
+// is output, either all of the physical strands or the one in the universe parameter.
+// The format parameter selects png, with a row of pixels for each strand enlarged
+// by the scale parameter, or json
+//
+func serveScreenshot(gw *mawt.Gateway, w http.ResponseWriter, r *http.Request) {
+	universe := -1
+	if param := r.URL.Query().Get("universe"); len(param) != 0 {
+		value, errGo := strconv.Atoi(param)
+		if errGo != nil || value < 0 || value > 255 {
+			http.Error(w, "universe must be an OPC channel from 0 to 255", http.StatusBadRequest)
+			return
+		}
+		universe = value
+	}
+	scale := 1
+	if param := r.URL.Query().Get("scale"); len(param) != 0 {
+		value, errGo := strconv.Atoi(param)
+		if errGo != nil || value < 1 || value > 32 {
+			http.Error(w, "scale must be from 1 to 32", http.StatusBadRequest)
+			return
+		}
+		scale = value
+	}
+
+	frame, err := gw.Frame(2 * time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	strands := make([]animationModel.ChannelData, 0, len(frame))
+	for _, channelData := range frame {
+		if universe < 0 || int(channelData.ChannelNum) == universe {
+			strands = append(strands, channelData)
+		}
+	}
+	if len(strands) == 0 {
+		http.Error(w, fmt.Sprintf("universe %d is not being output by pipeline %s", universe, gw.Name), http.StatusNotFound)
+		return
+	}
+	sort.Slice(strands, func(i, j int) bool { return strands[i].ChannelNum < strands[j].ChannelNum })
+
+	switch r.URL.Query().Get("format") {
+	case "", "png":
+		width := 0
+		for _, channelData := range strands {
+			if len(channelData.Data) > width {
+				width = len(channelData.Data)
+			}
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, width*scale, len(strands)*scale))
+		for y, channelData := range strands {
+			for x, pixel := range channelData.Data {
+				if pixel.A == 0 {
+					pixel = color.RGBA{}
+				}
+				for i := 0; i != scale*scale; i++ {
+					img.SetNRGBA(x*scale+i%scale, y*scale+i/scale, color.NRGBA{R: pixel.R, G: pixel.G, B: pixel.B, A: 0xFF})
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "image/png")
+		if errGo := png.Encode(w, img); errGo != nil {
+			apiLogger.Warn(errGo.Error())
+		}
+	case "json":
+		screenshot := make([]screenshotStrand, 0, len(strands))
+		for _, channelData := range strands {
+			pixels := make([][3]uint8, len(channelData.Data))
+			for i, pixel := range channelData.Data {
+				if pixel.A != 0 {
+					pixels[i] = [3]uint8{pixel.R, pixel.G, pixel.B}
+				}
+			}
+			screenshot = append(screenshot, screenshotStrand{Universe: int(channelData.ChannelNum), Pixels: pixels})
+		}
+		writeJSON(w, screenshot)
+	default:
+		http.Error(w, "format must be png or json", http.StatusBadRequest)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if errGo := json.NewEncoder(w).Encode(data); errGo != nil {
+		apiLogger.Warn(errGo.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+// This file implements the serving of the HTTP surfaces of the gateway, the REST
+// API, preview WebSockets, configuration editor and metrics, along with the
+// authentication of their clients when the configuration file has an auth section,
+// the handling of reverse proxies and cross origin requests when it has a web
+// section, and the sending of tokens by the sub commands that use the REST API
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// serveHTTP serves the default HTTP mux on the -listen address, authenticating the
+// requests when authentication is configured.  The web settings are applied before
+// authentication so that the client addresses of proxied requests are known and
+// preflight requests, which carry no credentials, are answered
+//
+func serveHTTP(config *mawt.AuthConfig, webConfig *mawt.WebConfig) (err errors.Error) {
+	// The deployment mode is applied closest to the mux so that it sees the paths
+	// with any base path of the web settings removed
+	mux := modeHandler(http.DefaultServeMux)
+	server := &http.Server{Addr: *listen, Handler: mux}
+	if config != nil {
+		auth, err := mawt.NewAuth(*config)
+		if err != nil {
+			return err
+		}
+		if server.TLSConfig, err = auth.TLSConfig(); err != nil {
+			return err
+		}
+		server.Handler = auth.Handler(mux)
+	} else {
+		apiLogger.Warn("the REST API is served without authentication, add an auth section to the configuration file on shared networks")
+	}
+	if webConfig != nil {
+		web, err := mawt.NewWeb(*webConfig)
+		if err != nil {
+			return err
+		}
+		server.Handler = web.Handler(server.Handler)
+	}
+
+	go func() {
+		errGo := error(nil)
+		if server.TLSConfig != nil {
+			errGo = server.ListenAndServeTLS("", "")
+		} else {
+			errGo = server.ListenAndServe()
+		}
+		if errGo != nil {
+			apiLogger.Error(fmt.Sprintf("the REST API could not be served, instances on the same host need their own -listen address %s",
+				errors.Wrap(errGo).With("listen", *listen).With("instance", *instance).With("stack", stack.Trace().TrimRuntime()).Error()))
+		}
+	}()
+	return nil
+}
+
+// authorize adds a bearer token to a request made to the REST API of a gateway,
+// requests are sent without credentials when the token is empty
+//
+func authorize(req *http.Request, token string) (authorized *http.Request) {
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
@@ -0,0 +1,38 @@
+package main
+
+// This file implements the bench sub command that measures the performance of the
+// LED pipeline on the machine being used
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/TeamNorCal/mawt/bench"
+)
+
+func runBench(args []string) (exitCode int) {
+
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	pixels := flags.String("pixels", "64,512,4096", "a comma separated list of the LED pixel counts to benchmark")
+	fps := flags.Float64("fps", 33, "the target frame rate used to calculate headroom, mawt renders every 30ms")
+
+	if errGo := flags.Parse(args); errGo != nil {
+		return -1
+	}
+
+	counts := []int{}
+	for _, count := range strings.Split(*pixels, ",") {
+		pixelCount, errGo := strconv.Atoi(strings.TrimSpace(count))
+		if errGo != nil || pixelCount < 1 {
+			fmt.Fprintf(os.Stderr, "invalid pixel count %s\n", count)
+			return -1
+		}
+		counts = append(counts, pixelCount)
+	}
+
+	bench.Print(os.Stdout, bench.Run(counts, *fps), *fps)
+	return 0
+}
@@ -0,0 +1,277 @@
+package main
+
+// This file implements the chaos sub command, which tests the resilience of a
+// running gateway before an event.  Faults are injected at random through the
+// /api/v1/faults endpoint of a gateway started with -fault-injection and once
+// each expires the health of the pipelines is checked until they recover,
+// the outcome of each round being summarized in a PASS/FAIL table
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+// serveFaults returns the faults injected on a GET, a POST injects the fault named by
+// the name parameter for the duration parameter, and a DELETE clears all faults
+//
+func serveFaults(w http.ResponseWriter, r *http.Request) {
+	if !*faultInjection {
+		http.Error(w, "mawt was started without -fault-injection", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		duration, errGo := time.ParseDuration(r.URL.Query().Get("duration"))
+		if errGo != nil {
+			http.Error(w, "the duration parameter must be a duration, for example 10s", http.StatusBadRequest)
+			return
+		}
+		delay := time.Duration(0)
+		if text := r.URL.Query().Get("delay"); len(text) != 0 {
+			if delay, errGo = time.ParseDuration(text); errGo != nil {
+				http.Error(w, "the delay parameter must be a duration, for example 5s", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := mawt.InjectFault(r.URL.Query().Get("name"), duration, delay); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Warn(fmt.Sprintf("fault %s injected for %s by %s", r.URL.Query().Get("name"), duration, r.RemoteAddr))
+	case http.MethodDelete:
+		mawt.ClearFaults()
+		logger.Warn(fmt.Sprint("faults cleared by ", r.RemoteAddr))
+	default:
+		http.Error(w, "only GET, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, mawt.Faults())
+}
+
+// chaosClient drives the REST API of the gateway under test
+//
+type chaosClient struct {
+	gateway string
+	token   string // The bearer token sent to a gateway using authentication
+	http    *http.Client
+}
+
+func (client *chaosClient) do(method string, path string, result interface{}) (errGo error) {
+	req, errGo := http.NewRequest(method, client.gateway+path, nil)
+	if errGo != nil {
+		return errGo
+	}
+	resp, errGo := client.http.Do(authorize(req, client.token))
+	if errGo != nil {
+		return errGo
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s %s %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// health returns the health of each pipeline of the gateway by name
+//
+func (client *chaosClient) health() (health map[string]*mawt.HealthSnapshot, errGo error) {
+	names := []string{}
+	if errGo = client.do(http.MethodGet, "/api/v1/pipelines", &names); errGo != nil {
+		return nil, errGo
+	}
+	health = make(map[string]*mawt.HealthSnapshot, len(names))
+	for _, name := range names {
+		snapshot := &mawt.HealthSnapshot{}
+		if errGo = client.do(http.MethodGet, "/api/v1/pipelines/"+url.PathEscape(name)+"/health", snapshot); errGo != nil {
+			return nil, errGo
+		}
+		health[name] = snapshot
+	}
+	return health, nil
+}
+
+// triggered returns the number of times the fault point of a fault has been hit
+//
+func (client *chaosClient) triggered(name string) (count uint64, errGo error) {
+	reports := []mawt.FaultReport{}
+	if errGo = client.do(http.MethodGet, "/api/v1/faults", &reports); errGo != nil {
+		return 0, errGo
+	}
+	for _, report := range reports {
+		if report.Name == name {
+			return report.Triggered, nil
+		}
+	}
+	return 0, nil
+}
+
+// recovered checks the health of the pipelines after a fault expired at a time,
+// describing what has yet to recover.  Frames must be sent again for the opc-drop
+// fault, and each portal seen before the fault must be checked successfully again
+// for the faults affecting the tecthulhus
+//
+func recovered(fault string, before map[string]*mawt.HealthSnapshot, after map[string]*mawt.HealthSnapshot, expired time.Time) (waiting []string) {
+	for name, health := range after {
+		if fault == mawt.FaultOPCDrop {
+			if !health.OPCLastSent.After(expired) {
+				waiting = append(waiting, name+" opc")
+			}
+			continue
+		}
+		for portal, lastOK := range health.Portals {
+			if previous, isPresent := before[name]; !isPresent || previous.Portals[portal].IsZero() {
+				continue
+			}
+			if !lastOK.After(expired) {
+				waiting = append(waiting, name+" "+portal)
+			}
+		}
+	}
+	return waiting
+}
+
+// chaosResult is the outcome of a single round
+//
+type chaosResult struct {
+	Round     int
+	Fault     string
+	Triggered uint64
+	Outcome   string // PASS, FAIL or SKIP when the fault point was never hit
+	Recovery  time.Duration
+	Detail    string
+}
+
+func runChaos(args []string) (exitCode int) {
+
+	flags := flag.NewFlagSet("chaos", flag.ContinueOnError)
+	gateway := flags.String("gateway", "http://127.0.0.1:6060", "the REST API of a gateway started with -fault-injection")
+	rounds := flags.Int("rounds", 6, "the number of faults injected")
+	faultList := flags.String("faults", strings.Join(mawt.FaultNames(), ","), "a comma separated list of the faults chosen from")
+	duration := flags.Duration("duration", 10*time.Second, "the time each fault is active")
+	delay := flags.Duration("delay", 5*time.Second, "the delay added to tecthulhu polls by the poll-delay fault")
+	recovery := flags.Duration("recovery", time.Minute, "the time allowed for the pipelines to recover once a fault expires")
+	seed := flags.Int64("seed", 0, "the seed used to choose the faults, 0 seeds from the time")
+	token := flags.String("token", os.Getenv("MAWT_TOKEN"), "the bearer token of a gateway using authentication, or a file://, env: or secret: reference to one, defaults to the MAWT_TOKEN environment variable")
+
+	if errGo := flags.Parse(args); errGo != nil {
+		return -1
+	}
+	bearer, err := mawt.ResolveSecret(*token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	choices := strings.Split(*faultList, ",")
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(*seed))
+
+	client := &chaosClient{gateway: strings.TrimSuffix(*gateway, "/"), token: bearer, http: &http.Client{Timeout: 10 * time.Second}}
+	if _, errGo := client.triggered(""); errGo != nil {
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+	fmt.Printf("chaos testing %s with %d rounds, seed %d\n", *gateway, *rounds, *seed)
+
+	results := []chaosResult{}
+	for round := 1; round <= *rounds; round++ {
+		result := chaosResult{Round: round, Fault: strings.TrimSpace(choices[random.Intn(len(choices))]), Outcome: "FAIL"}
+		results = append(results, result)
+		current := &results[len(results)-1]
+
+		before, errGo := client.health()
+		if errGo != nil {
+			current.Detail = errGo.Error()
+			break
+		}
+		previous, errGo := client.triggered(current.Fault)
+		if errGo == nil {
+			errGo = client.do(http.MethodPost, fmt.Sprintf("/api/v1/faults?name=%s&duration=%s&delay=%s", url.QueryEscape(current.Fault), *duration, *delay), nil)
+		}
+		if errGo != nil {
+			current.Detail = errGo.Error()
+			break
+		}
+		fmt.Printf("round %d injected %s for %s\n", round, current.Fault, *duration)
+		time.Sleep(*duration)
+		expired := time.Now()
+
+		count, errGo := client.triggered(current.Fault)
+		if errGo != nil {
+			current.Detail = errGo.Error()
+			break
+		}
+		current.Triggered = count - previous
+		if current.Triggered == 0 {
+			current.Outcome, current.Detail = "SKIP", "the fault point was not hit"
+			continue
+		}
+
+		// The gateway must keep serving its API throughout, failures to reach it count against recovery
+		deadline := expired.Add(*recovery)
+		waiting := []string{}
+		for {
+			after, errGo := client.health()
+			if errGo == nil {
+				if waiting = recovered(current.Fault, before, after, expired); len(waiting) == 0 {
+					current.Outcome, current.Recovery = "PASS", time.Since(expired)
+					break
+				}
+			} else {
+				waiting = []string{errGo.Error()}
+			}
+			if time.Now().After(deadline) {
+				current.Detail = "not recovered " + strings.Join(waiting, ", ")
+				break
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+	client.do(http.MethodDelete, "/api/v1/faults", nil)
+
+	if !printChaos(os.Stdout, results) {
+		return -1
+	}
+	return 0
+}
+
+// printChaos writes the outcome of the rounds as a table, returning false when any failed
+//
+func printChaos(w io.Writer, results []chaosResult) (passed bool) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ROUND\tFAULT\tHITS\tRESULT\tRECOVERY\tDETAIL")
+	failed := 0
+	for _, result := range results {
+		if result.Outcome == "FAIL" {
+			failed++
+		}
+		fmt.Fprintf(table, "%d\t%s\t%d\t%s\t%s\t%s\n", result.Round, result.Fault, result.Triggered, result.Outcome, result.Recovery.Round(time.Millisecond), result.Detail)
+	}
+	table.Flush()
+
+	if failed != 0 {
+		fmt.Fprintf(w, "chaos test FAILED, %d of %d rounds failed\n", failed, len(results))
+		return false
+	}
+	fmt.Fprintf(w, "chaos test PASSED, %d rounds\n", len(results))
+	return true
+}
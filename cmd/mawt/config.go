@@ -0,0 +1,190 @@
+package main
+
+// This file contains the handling of the configuration file after startup, when
+// the file changes the parts of the configuration that can be applied to
+// running pipelines are updated
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/karlmutch/errors"
+)
+
+// pipelineStrands returns the strand mapping for a pipeline, those defined within
+// the pipeline replace the top level mapping
+//
+func pipelineStrands(cfg *mawt.Config, pipeline mawt.PipelineConfig) (strands mawt.StrandMap, err errors.Error) {
+	if len(pipeline.Strands) != 0 {
+		return mawt.NewStrandMap(pipeline.Strands)
+	}
+	return mawt.NewStrandMap(cfg.Strands)
+}
+
+// pipelinePhases returns the phase offsets for a pipeline, those defined within the
+// pipeline replace the top level offsets
+//
+func pipelinePhases(cfg *mawt.Config, pipeline mawt.PipelineConfig) (phases mawt.Phases, err errors.Error) {
+	if len(pipeline.Phases) != 0 {
+		return mawt.NewPhases(pipeline.Phases)
+	}
+	return mawt.NewPhases(cfg.Phases)
+}
+
+// pipelineFirmware returns the fadecandy firmware settings for a pipeline, those defined
+// within the pipeline replace the top level settings, nil when there are none
+//
+func pipelineFirmware(cfg *mawt.Config, pipeline mawt.PipelineConfig) (firmware *mawt.FirmwareConfig, err errors.Error) {
+	if pipeline.Firmware != nil {
+		return mawt.NewFirmware(*pipeline.Firmware)
+	}
+	if cfg.Firmware != nil {
+		return mawt.NewFirmware(*cfg.Firmware)
+	}
+	return nil, nil
+}
+
+// pipelineStatus returns the status pixel for a pipeline, one defined within the
+// pipeline replacing the top level pixel, nil when there is none
+//
+func pipelineStatus(cfg *mawt.Config, pipeline mawt.PipelineConfig) (status *mawt.StatusConfig, err errors.Error) {
+	if pipeline.Status != nil {
+		return mawt.NewStatus(*pipeline.Status)
+	}
+	if cfg.Status != nil {
+		return mawt.NewStatus(*cfg.Status)
+	}
+	return nil, nil
+}
+
+// pipelineCanary returns the canary strand for a pipeline, one defined within the
+// pipeline replacing the top level canary, nil when there is none
+//
+func pipelineCanary(cfg *mawt.Config, pipeline mawt.PipelineConfig) (canary *mawt.CanaryConfig, err errors.Error) {
+	if pipeline.Canary != nil {
+		return mawt.NewCanary(*pipeline.Canary)
+	}
+	if cfg.Canary != nil {
+		return mawt.NewCanary(*cfg.Canary)
+	}
+	return nil, nil
+}
+
+// pipelineStandby returns the standby and connecting colors for a pipeline, those
+// defined within the pipeline replace the top level colors, nil when there are none
+//
+func pipelineStandby(cfg *mawt.Config, pipeline mawt.PipelineConfig) (standby *mawt.Standby, err errors.Error) {
+	if len(pipeline.Standby) != 0 {
+		return mawt.NewStandby(pipeline.Standby)
+	}
+	if len(cfg.Standby) != 0 {
+		return mawt.NewStandby(cfg.Standby)
+	}
+	return nil, nil
+}
+
+// pipelineGuard returns the output guard for a pipeline, one defined within the
+// pipeline replacing the top level guard, nil when there is none
+//
+func pipelineGuard(cfg *mawt.Config, pipeline mawt.PipelineConfig) (guard *mawt.Guard, err errors.Error) {
+	if pipeline.Guard != nil {
+		return mawt.NewGuard(*pipeline.Guard)
+	}
+	if cfg.Guard != nil {
+		return mawt.NewGuard(*cfg.Guard)
+	}
+	return nil, nil
+}
+
+// pipelineTransform returns the translation of the raw status documents for a pipeline,
+// one defined within the pipeline replacing the top level translation, nil when there
+// is none
+//
+func pipelineTransform(cfg *mawt.Config, pipeline mawt.PipelineConfig) (transform *mawt.TransformConfig) {
+	if pipeline.Transform != nil {
+		return pipeline.Transform
+	}
+	return cfg.Transform
+}
+
+// pipelineOutputs returns the output mirrors for a pipeline, those defined within
+// the pipeline replace the top level outputs
+//
+func pipelineOutputs(cfg *mawt.Config, pipeline mawt.PipelineConfig) (outputs []mawt.OutputBinding, err errors.Error) {
+	if len(pipeline.Outputs) != 0 {
+		return mawt.NewOutputs(pipeline.Outputs)
+	}
+	return mawt.NewOutputs(cfg.Outputs)
+}
+
+// applyConfig applies the strand mappings, phase offsets, firmware settings and quality
+// profiles of a changed configuration to the running pipelines
+//
+func applyConfig(cfg *mawt.Config, location string, gws []*mawt.Gateway) (errs []errors.Error) {
+	// A configuration without pipelines applies to the default pipeline
+	// created from the command line options
+	defined := map[string]mawt.PipelineConfig{}
+	for _, pipeline := range cfg.Pipelines {
+		defined[pipeline.Name] = pipeline
+	}
+	for _, gw := range gws {
+		pipeline, isPresent := defined[gw.Name]
+		if !isPresent && len(cfg.Pipelines) != 0 {
+			logger.Warn(fmt.Sprintf("pipeline %s is no longer configured and will continue until restarted", gw.Name))
+			continue
+		}
+		strands, err := pipelineStrands(cfg, pipeline)
+		if err == nil {
+			err = gw.Reconfigure(strands, cfg.Profiles, cfg.Profile)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		phases, err := pipelinePhases(cfg, pipeline)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		gw.SetPhases(phases)
+		firmware, err := pipelineFirmware(cfg, pipeline)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		gw.SetFirmware(firmware)
+	}
+	logger.Info(fmt.Sprintf("configuration %s reloaded, changes other than to strands, phases, firmware settings and profiles take effect on restart", location))
+	return errs
+}
+
+// watchConfig checks the configuration source for changes on a regular basis and
+// applies the strand mappings and quality profiles to the running pipelines
+//
+func watchConfig(src *mawt.ConfigSource, gws []*mawt.Gateway, refresh time.Duration, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	tick := time.NewTicker(refresh)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			cfg, changed, err := src.Load()
+			if err != nil {
+				logger.Warn(fmt.Sprint("configuration could not be refreshed ", err.Error()))
+				continue
+			}
+			if !changed {
+				continue
+			}
+			for _, err := range applyConfig(cfg, src.Location, gws) {
+				select {
+				case errorC <- err:
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+
+		case <-quitC:
+			return
+		}
+	}
+}
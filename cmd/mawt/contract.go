@@ -0,0 +1,316 @@
+package main
+
+// This file implements the contract sub command along with the endpoints that
+// describe the versions of the REST API.  The endpoints of version 1 of the API
+// are declared here with the structures they respond with, and the contract they
+// form is saved in assets/contracts when the version is released.  contract check
+// compares the saved contract with the current code, failing on changes that would
+// break companion tools written against it, contract update saves the contract
+// once additions have been made, and contract verify checks the responses of a
+// running gateway against the saved contract
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+// apiVersions lists the versions of the REST API served by the gateway
+//
+type apiVersions struct {
+	Versions []string `json:"versions"`
+	Current  string   `json:"current"`
+	Contract string   `json:"contract"` // The path of the contract of the current version
+}
+
+// apiContract declares the endpoints of the current version of the REST API.  Once
+// a version has been released endpoints, methods and fields may be added here but
+// not removed or changed, a new version being needed for that
+//
+func apiContract() (contract *mawt.APIContract) {
+	get := []string{http.MethodGet}
+	post := []string{http.MethodPost}
+	getPut := []string{http.MethodGet, http.MethodPut, http.MethodPost}
+	getPost := []string{http.MethodGet, http.MethodPost}
+	all := []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete}
+	engage := []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+
+	contract = mawt.NewAPIContract(mawt.APIVersion)
+	contract.Add("/api", get, mawt.ContentJSON, apiVersions{})
+	contract.Add("/api/v1/contract", get, mawt.ContentJSON, mawt.APIContract{})
+	contract.Add("/api/v1/status", get, mawt.ContentJSON, statusReport{})
+	contract.Add("/api/v1/pipelines", get, mawt.ContentJSON, []string{})
+	contract.Add("/api/v1/subscribers", get, mawt.ContentJSON, subscribersReport{})
+	contract.Add("/api/v1/estop", engage, mawt.ContentJSON, mawt.EStopState{})
+	contract.Add("/api/v1/clock", getPut, mawt.ContentJSON, mawt.ClockState{})
+	contract.Add("/api/v1/beat", getPost, mawt.ContentJSON, mawt.BeatState{})
+	contract.Add("/api/v1/timecode", get, mawt.ContentJSON, mawt.TimecodeState{})
+	contract.Add("/api/v1/scenes", all, mawt.ContentJSON, scenesReport{})
+	contract.Add("/api/v1/log", getPut, mawt.ContentJSON, &mawt.LogFileReport{})
+	contract.Add("/api/v1/log/levels", getPut, mawt.ContentJSON, map[string]string{})
+	contract.Add("/api/v1/config", get, "text/yaml", nil)
+	contract.Add("/api/v1/config", []string{http.MethodPut, http.MethodPost}, mawt.ContentJSON, configReport{})
+	contract.Add("/api/v1/config/schema", get, mawt.ContentJSON, mawt.Schema{})
+	contract.Add("/api/v1/annotations", post, mawt.ContentJSON, mawt.Event{})
+	contract.Add("/api/v1/events", get, mawt.ContentStream, mawt.Event{})
+	contract.Add("/api/v1/store", get, mawt.ContentJSON, []mawt.StoreRecord{})
+	contract.Add("/api/v1/store/summary", get, mawt.ContentJSON, &mawt.StoreSummary{})
+	contract.Add("/api/v1/snapshot", get, mawt.ContentJSON, &mawt.Snapshot{})
+	contract.Add("/api/v1/snapshot", post, mawt.ContentJSON, snapshotReport{})
+	contract.Add("/api/v1/faults", engage, mawt.ContentJSON, []mawt.FaultReport{})
+	contract.Add("/api/v1/debug/profile", post, mawt.ContentJSON, &mawt.ProfileCapture{})
+
+	// The unqualified pipeline endpoints refer to the first pipeline
+	for _, prefix := range []string{"/api/v1", "/api/v1/pipelines/{pipeline}"} {
+		contract.Add(prefix+"/history", get, mawt.ContentJSON, []mawt.HistoryEntry{})
+		contract.Add(prefix+"/profile", getPut, mawt.ContentJSON, qualityReport{})
+		contract.Add(prefix+"/home", getPut, mawt.ContentJSON, mawt.HomeState{})
+		contract.Add(prefix+"/effects", get, mawt.ContentJSON, map[string]mawt.EffectReport{})
+		contract.Add(prefix+"/topology", all, mawt.ContentJSON, []mawt.StrandMapping{})
+		contract.Add(prefix+"/universes", all, mawt.ContentJSON, mawt.UniverseState{})
+		contract.Add(prefix+"/frame", get, "image/png", nil)
+		contract.Add(prefix+"/frame?format=json", get, mawt.ContentJSON, []screenshotStrand{})
+		contract.Add(prefix+"/frame", []string{http.MethodPut, http.MethodPost, http.MethodDelete}, "", nil)
+	}
+	pipeline := "/api/v1/pipelines/{pipeline}"
+	contract.Add(pipeline+"/health", get, mawt.ContentJSON, &mawt.HealthSnapshot{})
+	contract.Add(pipeline+"/preview", get, "websocket", nil)
+	contract.Add(pipeline+"/changes", get, mawt.ContentJSON, mawt.ChangeStats{})
+	contract.Add(pipeline+"/strands", get, mawt.ContentJSON, map[int]mawt.StrandReport{})
+	contract.Add(pipeline+"/input", get, mawt.ContentJSON, mawt.OPCInputReport{})
+	contract.Add(pipeline+"/ambient", get, mawt.ContentJSON, mawt.AmbientReport{})
+	contract.Add(pipeline+"/thermal", get, mawt.ContentJSON, mawt.ThermalReport{})
+	contract.Add(pipeline+"/guard", engage, mawt.ContentJSON, mawt.GuardReport{})
+	contract.Add(pipeline+"/score", get, mawt.ContentJSON, mawt.ScoreReport{})
+	contract.Add(pipeline+"/display", get, mawt.ContentJSON, mawt.DisplayState{})
+	contract.Add(pipeline+"/validation", get, mawt.ContentJSON, mawt.ValidationReport{})
+	contract.Add(pipeline+"/pause", engage, mawt.ContentJSON, mawt.PauseState{})
+	return contract
+}
+
+// serveAPIVersions lists the versions of the REST API
+//
+func serveAPIVersions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, apiVersions{
+		Versions: []string{mawt.APIVersion},
+		Current:  mawt.APIVersion,
+		Contract: "/api/" + mawt.APIVersion + "/contract",
+	})
+}
+
+// serveContract returns the contract of the current version of the REST API, for
+// companion tools to check the endpoints they use are present
+//
+func serveContract(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, apiContract())
+}
+
+func encodeContract(contract *mawt.APIContract) (data []byte, errGo error) {
+	buffer := &bytes.Buffer{}
+	enc := json.NewEncoder(buffer)
+	enc.SetIndent("", "  ")
+	errGo = enc.Encode(contract)
+	return buffer.Bytes(), errGo
+}
+
+func runContract(args []string) (exitCode int) {
+
+	if len(args) == 0 || (args[0] != "check" && args[0] != "update" && args[0] != "verify") {
+		fmt.Fprintln(os.Stderr, "usage: contract check|update|verify [options]")
+		return -1
+	}
+
+	flags := flag.NewFlagSet("contract "+args[0], flag.ContinueOnError)
+	file := flags.String("file", "assets/contracts/"+mawt.APIVersion+".json", "the contract saved when the version of the API was released")
+	force := flags.Bool("force", false, "update the contract even though the changes would break clients")
+	gateway := flags.String("gateway", "http://127.0.0.1:6060", "the REST API of the gateway verified")
+	token := flags.String("token", os.Getenv("MAWT_TOKEN"), "the bearer token of a gateway using authentication, or a file://, env: or secret: reference to one, defaults to the MAWT_TOKEN environment variable")
+
+	if errGo := flags.Parse(args[1:]); errGo != nil {
+		return -1
+	}
+
+	var saved *mawt.APIContract
+	data, errGo := ioutil.ReadFile(*file)
+	switch {
+	case errGo == nil:
+		contract, err := mawt.LoadAPIContract(data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, *file+":", err.Error())
+			return -1
+		}
+		saved = contract
+	case !os.IsNotExist(errGo) || args[0] != "update":
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+
+	if args[0] == "verify" {
+		bearer, err := mawt.ResolveSecret(*token)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return -1
+		}
+		client := &chaosClient{gateway: strings.TrimSuffix(*gateway, "/"), token: bearer, http: &http.Client{Timeout: 10 * time.Second}}
+		return verifyContract(client, saved)
+	}
+
+	current := apiContract()
+	encoded, errGo := encodeContract(current)
+	if errGo != nil {
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+
+	breaks := []string{}
+	if saved != nil {
+		breaks = current.Breaks(saved)
+	}
+	for _, change := range breaks {
+		fmt.Fprintln(os.Stderr, change)
+	}
+
+	if args[0] == "update" {
+		if len(breaks) != 0 && !*force {
+			fmt.Fprintf(os.Stderr, "%d changes would break clients of the %s API, the contract was not updated\n", len(breaks), saved.Version)
+			return -1
+		}
+		if errGo = ioutil.WriteFile(*file, encoded, 0644); errGo != nil {
+			fmt.Fprintln(os.Stderr, errGo.Error())
+			return -1
+		}
+		fmt.Println(*file, "updated")
+		return 0
+	}
+
+	if len(breaks) != 0 {
+		fmt.Fprintf(os.Stderr, "FAIL %d changes would break clients of the %s API\n", len(breaks), saved.Version)
+		return -1
+	}
+	if !bytes.Equal(encoded, data) {
+		fmt.Fprintf(os.Stderr, "FAIL %s does not include additions to the API, use contract update\n", *file)
+		return -1
+	}
+	fmt.Println("PASS", *file)
+	return 0
+}
+
+// verifyContract fetches the GET endpoints of a contract from a running gateway,
+// checking the responses against it.  Endpoints for hardware or options the gateway
+// was not started with respond with an explanation and are skipped, while an
+// endpoint that is unknown to the gateway fails
+//
+func verifyContract(client *chaosClient, contract *mawt.APIContract) (exitCode int) {
+	names := []string{}
+	if errGo := client.do(http.MethodGet, "/api/v1/pipelines", &names); errGo != nil {
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+
+	failed := 0
+	for _, endpoint := range contract.Endpoints {
+		if !hasGet(endpoint.Methods) {
+			continue
+		}
+		paths := []string{endpoint.Path}
+		if strings.Contains(endpoint.Path, "{pipeline}") {
+			paths = paths[:0]
+			for _, name := range names {
+				paths = append(paths, strings.Replace(endpoint.Path, "{pipeline}", url.PathEscape(name), 1))
+			}
+		}
+		for _, path := range paths {
+			outcome, detail := verifyEndpoint(client, contract, endpoint, path)
+			if outcome == "FAIL" {
+				failed++
+			}
+			fmt.Printf("%s GET %s %s\n", outcome, path, detail)
+		}
+	}
+
+	if failed != 0 {
+		fmt.Fprintf(os.Stderr, "%d endpoints do not match the %s contract\n", failed, contract.Version)
+		return -1
+	}
+	return 0
+}
+
+func hasGet(methods []string) (isGet bool) {
+	for _, method := range methods {
+		if method == http.MethodGet {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyEndpoint checks the response of a GET endpoint against the contract,
+// returning PASS, SKIP or FAIL along with the reason
+//
+func verifyEndpoint(client *chaosClient, contract *mawt.APIContract, endpoint mawt.EndpointContract, path string) (outcome string, detail string) {
+	if endpoint.ContentType == mawt.ContentStream || endpoint.ContentType == "websocket" {
+		return "SKIP", "streams are not fetched"
+	}
+
+	req, errGo := http.NewRequest(http.MethodGet, client.gateway+path, nil)
+	if errGo != nil {
+		return "FAIL", errGo.Error()
+	}
+	resp, errGo := client.http.Do(authorize(req, client.token))
+	if errGo != nil {
+		return "FAIL", errGo.Error()
+	}
+	defer resp.Body.Close()
+	body, errGo := ioutil.ReadAll(io.LimitReader(resp.Body, 16*1024*1024))
+	if errGo != nil {
+		return "FAIL", errGo.Error()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden, http.StatusServiceUnavailable:
+		// The mux responds to paths without a handler with a fixed message, other
+		// messages coming from handlers for features that are not in use
+		message := strings.TrimSpace(string(body))
+		if message == "404 page not found" {
+			return "FAIL", "the endpoint is not served"
+		}
+		return "SKIP", message
+	default:
+		return "FAIL", resp.Status
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, endpoint.ContentType) {
+		return "FAIL", fmt.Sprintf("returned %q rather than %q", contentType, endpoint.ContentType)
+	}
+	if endpoint.ContentType != mawt.ContentJSON {
+		return "PASS", ""
+	}
+
+	violations, err := contract.ValidateResponse(endpoint.Path, http.MethodGet, body)
+	if err != nil {
+		return "FAIL", err.Error()
+	}
+	if len(violations) == 0 {
+		return "PASS", ""
+	}
+	messages := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		message := violation.Message
+		if len(violation.Path) != 0 {
+			message = violation.Path + ": " + message
+		}
+		messages = append(messages, message)
+	}
+	return "FAIL", strings.Join(messages, "; ")
+}
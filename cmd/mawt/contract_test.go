@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+// TestContract checks the endpoints declared for the REST API against the contract
+// saved when the version was released, in the same way as contract check, so that
+// changes breaking the clients of the API fail the tests
+//
+func TestContract(t *testing.T) {
+	fn := filepath.Join("..", "..", "assets", "contracts", mawt.APIVersion+".json")
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	saved, err := mawt.LoadAPIContract(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := apiContract()
+	for _, change := range current.Breaks(saved) {
+		t.Errorf("%s, breaking clients of the %s API", change, saved.Version)
+	}
+
+	encoded, errGo := encodeContract(current)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !bytes.Equal(encoded, data) {
+		t.Errorf("%s does not include additions to the API, use contract update", fn)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+// This file implements the discovery mode that uses mDNS to locate the fadecandy
+// server and the tecthulhus when they have not been specified by the user
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+type discovered struct {
+	FCServer   []mawt.Service `json:"fcserver,omitempty"`
+	Tecthulhus []mawt.Service `json:"tecthulhus,omitempty"`
+	Server     string         `json:"server,omitempty"`
+	Portals    []string       `json:"portals,omitempty"`
+	sync.Mutex
+}
+
+var (
+	discoveries = &discovered{}
+)
+
+// flagSet returns true when the named option was supplied on the command line or
+// using an environment variable
+//
+func flagSet(name string) (isSet bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			isSet = true
+		}
+	})
+	return isSet
+}
+
+// discoverEndpoints will replace the values of the server and tecthulhus options
+// with any services found using mDNS, if the user did not supply them
+//
+func discoverEndpoints() {
+
+	discoveries.Lock()
+	defer discoveries.Unlock()
+
+	if !flagSet("server") {
+		services, err := mawt.Discover("_opc._tcp", *discoverWait)
+		if err != nil {
+			logger.Warn(err.Error())
+		}
+		discoveries.FCServer = services
+		if len(services) != 0 {
+			*fcserver = services[0].Addr()
+			discoveries.Server = *fcserver
+			logger.Info(fmt.Sprintf("discovered fadecandy server %s at %s", services[0].Instance, *fcserver))
+		} else {
+			logger.Warn(fmt.Sprintf("no fadecandy servers discovered, using %s", *fcserver))
+		}
+	}
+
+	if !flagSet("tecthulhus") {
+		services, err := mawt.Discover("_tecthulhu._tcp", *discoverWait)
+		if err != nil {
+			logger.Warn(err.Error())
+		}
+		discoveries.Tecthulhus = services
+		portals := make([]string, 0, len(services))
+		for _, svc := range services {
+			u := url.URL{Scheme: "http", Host: svc.Addr(), Path: "/module/status/json"}
+			portals = append(portals, u.String())
+			logger.Info(fmt.Sprintf("discovered tecthulhu %s at %s", svc.Instance, u.String()))
+		}
+		if len(portals) != 0 {
+			*tecthulhus = strings.Join(portals, ",")
+			discoveries.Portals = portals
+		} else {
+			logger.Warn(fmt.Sprintf("no tecthulhus discovered, using %s", *tecthulhus))
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+// This file implements a minimal web editor for the configuration file, served at
+// /config, for installs where logging into the Raspberry Pi part way through an
+// event is impractical.  The page edits the YAML using the /api/v1/config
+// endpoint which validates changes before saving them and reloads the
+// configuration, applying the strands and profiles to the running pipelines.  The
+// page is shown in the language preferred by the browser when it is translated,
+// and otherwise in the language of the gateway
+
+import (
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+var (
+	// configSource is the location the configuration was loaded from
+	configSource *mawt.ConfigSource
+
+	configEditorTemplate = template.Must(template.New("editor").Parse(configEditorPage))
+)
+
+// editorPage holds the language of the configuration editor page
+//
+type editorPage struct {
+	Lang     string
+	Messages map[string]string
+}
+
+// T returns the message for a key in the language of the page
+//
+func (page editorPage) T(key string) (text string) {
+	return page.Messages[key]
+}
+
+// configReport is the result of saving or reloading the configuration
+//
+type configReport struct {
+	Location string   `json:"location"`
+	Valid    bool     `json:"valid"`
+	Saved    bool     `json:"saved"`
+	Reloaded bool     `json:"reloaded"` // false when the configuration was unchanged
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// reload loads the configuration source and applies any changes to the running pipelines
+//
+func (report *configReport) reload() {
+	cfg, changed, err := configSource.Load()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+	report.Valid = true
+	if !changed {
+		return
+	}
+	report.Reloaded = true
+	for _, err := range applyConfig(cfg, configSource.Location, pipelines) {
+		report.Errors = append(report.Errors, err.Error())
+	}
+}
+
+// serveConfig returns the configuration file on a GET.  A PUT validates the YAML in
+// the body, saving it and reloading the configuration unless the validate parameter
+// is true, and a POST reloads the configuration from its source
+//
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	if configSource == nil || len(configSource.Location) == 0 {
+		http.Error(w, "mawt was started without a configuration file", http.StatusNotFound)
+		return
+	}
+
+	report := &configReport{Location: configSource.Location}
+	switch r.Method {
+	case http.MethodGet:
+		data, err := configSource.Read()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+		w.Write(data)
+		return
+
+	case http.MethodPut:
+		data, errGo := ioutil.ReadAll(io.LimitReader(r.Body, 1024*1024))
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("validate") == "true" {
+			if _, err := mawt.ValidateConfig(data, configSource.Location); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			report.Valid = true
+			break
+		}
+		if err := configSource.Save(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report.Valid, report.Saved = true, true
+		apiLogger.Info("configuration saved by " + r.RemoteAddr)
+		report.reload()
+
+	case http.MethodPost:
+		report.reload()
+
+	default:
+		http.Error(w, "only GET, PUT and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// serveConfigEditor returns the page used to edit the configuration, in the language
+// given by the lang parameter, or the first language of the browser that is
+// translated, or the language of the gateway
+//
+func serveConfigEditor(w http.ResponseWriter, r *http.Request) {
+	lang, isSupported := mawt.MatchLanguage(r.URL.Query().Get("lang"))
+	if !isSupported {
+		if lang, isSupported = mawt.MatchLanguage(r.Header.Get("Accept-Language")); !isSupported {
+			lang = mawt.Language()
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	if errGo := configEditorTemplate.Execute(w, editorPage{Lang: lang, Messages: mawt.Messages(lang)}); errGo != nil {
+		apiLogger.Warn(errGo.Error())
+	}
+}
+
+const configEditorPage = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.T "editor.title"}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; background: #111; color: #ddd; }
+textarea { width: 100%; height: 70vh; font-family: monospace; font-size: 14px; background: #000; color: #ddd; tab-size: 2; }
+button { font-size: 16px; padding: 0.4em 1em; margin: 0.5em 0.5em 0.5em 0; }
+pre { white-space: pre-wrap; }
+.ok { color: #6c6; }
+.failed { color: #e66; }
+</style>
+</head>
+<body>
+<h1>{{.T "editor.title"}}</h1>
+<div id="location"></div>
+<textarea id="yaml" spellcheck="false"></textarea>
+<div>
+<button onclick="load()">{{.T "editor.revert"}}</button>
+<button onclick="save(true)">{{.T "editor.validate"}}</button>
+<button onclick="save(false)">{{.T "editor.save"}}</button>
+<button onclick="reload()">{{.T "editor.reload"}}</button>
+</div>
+<pre id="result"></pre>
+<script>
+const api = "api/v1/config";
+const messages = {{.Messages}};
+
+function show(ok, text) {
+	const result = document.getElementById("result");
+	result.className = ok ? "ok" : "failed";
+	result.textContent = text;
+}
+
+async function report(resp) {
+	if (!resp.ok) {
+		show(false, await resp.text());
+		return;
+	}
+	const report = await resp.json();
+	document.getElementById("location").textContent = report.location;
+	const lines = [];
+	if (report.saved) {
+		lines.push(messages["editor.saved"]);
+	} else if (report.valid) {
+		lines.push(messages["editor.valid"]);
+	}
+	if (report.reloaded) {
+		lines.push(messages["editor.reloaded"]);
+	}
+	(report.errors || []).forEach(function (err) { lines.push(err); });
+	show(!report.errors, lines.join("\n"));
+}
+
+async function load() {
+	const resp = await fetch(api);
+	if (!resp.ok) {
+		show(false, await resp.text());
+		return;
+	}
+	document.getElementById("yaml").value = await resp.text();
+	show(true, "");
+}
+
+async function save(validate) {
+	const body = document.getElementById("yaml").value;
+	report(await fetch(api + (validate ? "?validate=true" : ""), {method: "PUT", body: body}));
+}
+
+async function reload() {
+	report(await fetch(api, {method: "POST"}));
+}
+
+load();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,123 @@
+package main
+
+// This file implements the fleet sub command, which listens for the status broadcast
+// by the gateways started with the -fleet-broadcast option and prints a table of
+// them, giving event staff an overview of all of the gateway nodes on the LAN
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+// fleetNode is the last status received from a gateway
+//
+type fleetNode struct {
+	addr   string
+	seen   time.Time
+	status mawt.FleetStatus
+}
+
+func runFleet(args []string) (exitCode int) {
+
+	flags := flag.NewFlagSet("fleet", flag.ContinueOnError)
+	listen := flags.String("listen", fmt.Sprintf(":%d", mawt.FleetPort), "the UDP address the gateways broadcast their status to")
+	wait := flags.Duration("wait", 10*time.Second, "the time spent listening before the table of gateways is printed")
+	watch := flags.Bool("watch", false, "keep listening, printing the table again after every wait period")
+	only := flags.String("instance", "", "only list the gateways started with this -instance name, all gateways when empty")
+
+	if errGo := flags.Parse(args); errGo != nil {
+		return -1
+	}
+
+	addr, errGo := net.ResolveUDPAddr("udp4", *listen)
+	if errGo == nil {
+		var conn *net.UDPConn
+		if conn, errGo = net.ListenUDP("udp4", addr); errGo == nil {
+			defer conn.Close()
+			return listenFleet(conn, *only, *wait, *watch)
+		}
+	}
+	fmt.Fprintln(os.Stderr, errGo.Error())
+	return -1
+}
+
+// listenFleet collects the status of the gateways, printing them after each wait period.
+// When an instance name is given only the gateways started with it are collected
+//
+func listenFleet(conn *net.UDPConn, instance string, wait time.Duration, watch bool) (exitCode int) {
+	nodes := map[string]*fleetNode{}
+	buf := make([]byte, 64*1024)
+
+	for {
+		deadline := time.Now().Add(wait)
+		conn.SetReadDeadline(deadline)
+		for time.Now().Before(deadline) {
+			size, from, errGo := conn.ReadFromUDP(buf)
+			if errGo != nil {
+				if netErr, isNet := errGo.(net.Error); isNet && netErr.Timeout() {
+					break
+				}
+				fmt.Fprintln(os.Stderr, errGo.Error())
+				return -1
+			}
+			status := mawt.FleetStatus{}
+			if errGo = json.Unmarshal(buf[:size], &status); errGo != nil {
+				// Other software may use the port, anything that is not a status is ignored
+				continue
+			}
+			if len(instance) != 0 && status.Instance != instance {
+				continue
+			}
+			key := from.IP.String() + " " + status.Instance
+			nodes[key] = &fleetNode{addr: from.IP.String(), seen: time.Now(), status: status}
+		}
+
+		printFleet(os.Stdout, nodes, time.Now())
+		if !watch {
+			return 0
+		}
+		fmt.Println()
+	}
+}
+
+// printFleet writes a table with a row for each pipeline of the gateways heard from,
+// gateways that have missed three broadcasts are marked as stale
+//
+func printFleet(w io.Writer, nodes map[string]*fleetNode, now time.Time) {
+	keys := make([]string, 0, len(nodes))
+	for key := range nodes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "%d gateways heard from at %s\n", len(nodes), now.Format("15:04:05"))
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ADDRESS\tINSTANCE\tHOST\tVERSION\tPIPELINE\tPORTAL\tFACTION\tLEVEL\tHEALTH\tSTATE\tSEEN")
+	for _, key := range keys {
+		node := nodes[key]
+		state := "ok"
+		if node.status.Interval > 0 && now.Sub(node.seen) > 3*node.status.Interval {
+			state = "stale"
+		}
+		for _, pipeline := range node.status.Pipelines {
+			pipelineState := state
+			if len(pipeline.Conditions) != 0 && state == "ok" {
+				pipelineState = strings.Join(pipeline.Conditions, ",")
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.0f\t%.0f%%\t%s\t%s ago\n",
+				node.addr, node.status.Instance, node.status.Host, node.status.Version, pipeline.Name,
+				pipeline.Portal, pipeline.Faction, pipeline.Level, pipeline.Health, pipelineState, now.Sub(node.seen).Round(time.Second))
+		}
+	}
+	table.Flush()
+}
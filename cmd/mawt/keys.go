@@ -0,0 +1,171 @@
+package main
+
+// This file implements the hotkeys available when the terminal preview is
+// being used, the space bar or escape key engages the emergency stop and
+// an upper case C clears it, a lower case t taps the tempo of the music, an
+// upper case H makes the next configured portal the home portal of the first
+// pipeline, a lower case a begins an operator annotation that is finished
+// using enter, a lower case p pauses or resumes the animations, the < and >
+// keys slow them down or speed them up and a lower case s steps through the
+// named scenes and back to the animations
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/karlmutch/errors"
+)
+
+// watchKeys switches the terminal into a mode where single key presses can be
+// read, restoring it when the quitC channel is closed.  The raw mode is platform
+// specific, see keys_linux.go
+//
+func watchKeys(quitC <-chan struct{}) (err errors.Error) {
+	restore, err := rawTerminal(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-quitC
+		restore()
+	}()
+
+	go func() {
+		key := make([]byte, 1)
+
+		// While an annotation is being typed keys are added to it, escape
+		// continues to engage the emergency stop and abandons the annotation
+		annotating := false
+		text := []byte{}
+		for {
+			if _, errGo := os.Stdin.Read(key); errGo != nil {
+				return
+			}
+			if annotating && key[0] != 0x1b {
+				switch key[0] {
+				case '\r', '\n':
+					annotating = false
+					if _, err := mawt.Annotate("", string(text), "keyboard"); err != nil {
+						fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("annotation.failed", err.Error()))
+						continue
+					}
+					fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("annotation.recorded"))
+				case 0x7f, 0x08:
+					if len(text) != 0 {
+						text = text[:len(text)-1]
+					}
+				default:
+					text = append(text, key[0])
+				}
+				if annotating {
+					fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("annotation.prompt", string(text)))
+				}
+				continue
+			}
+			annotating = false
+
+			switch key[0] {
+			case ' ', 0x1b:
+				mawt.EngageEStop("keyboard")
+			case 'C':
+				mawt.ClearEStop("keyboard")
+			case 't':
+				mawt.GetBeat().Tap(time.Now(), "keyboard")
+			case 'H':
+				cycleHome()
+			case 'p':
+				clock := mawt.GetClock()
+				clock.Pause(!clock.State().Paused, "keyboard")
+			case '<', '>':
+				stepSpeed(key[0] == '>')
+			case 's':
+				cycleScene()
+			case 'a':
+				annotating = true
+				text = text[:0]
+				fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("annotation.prompt", ""))
+			}
+		}
+	}()
+	return nil
+}
+
+// stepSpeed changes the speed of the animation clock to the next of the steps
+// between 0.1 and 5 times normal speed
+//
+func stepSpeed(faster bool) {
+	steps := []float64{0.1, 0.25, 0.5, 1, 1.5, 2, 3, 5}
+	clock := mawt.GetClock()
+	speed := clock.State().Speed
+	next := speed
+	for _, step := range steps {
+		if faster && step > speed {
+			next = step
+			break
+		}
+		if !faster && step < speed {
+			next = step
+		}
+	}
+	if err := clock.SetSpeed(next, "keyboard"); err != nil {
+		fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("speed.failed", err.Error()))
+		return
+	}
+	fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("speed.changed", next))
+}
+
+// cycleHome makes the portal configured after the home portal of the first pipeline
+// its home portal, wrapping around to the first portal
+//
+func cycleHome() {
+	if len(pipelines) == 0 {
+		return
+	}
+	gw := pipelines[0]
+	state := gw.Home()
+	if len(state.Portals) < 2 {
+		fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("home.none"))
+		return
+	}
+	next := state.Portals[0]
+	for i, portal := range state.Portals {
+		if portal == state.Home {
+			next = state.Portals[(i+1)%len(state.Portals)]
+		}
+	}
+	if err := gw.SetHome(next); err != nil {
+		fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("home.failed", err.Error()))
+		return
+	}
+	fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("home.changed", next))
+}
+
+// cycleScene shows the scene defined after the one showing on the pipelines, the
+// animations returning after the last scene
+//
+func cycleScene() {
+	if len(pipelines) == 0 {
+		return
+	}
+	// The pipelines are kept in step using the scene of the first one
+	state, err := pipelines[0].CycleScene("keyboard")
+	if err != nil {
+		fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("scene.failed", err.Error()))
+		return
+	}
+	for _, gw := range pipelines[1:] {
+		if len(state.Name) == 0 {
+			gw.ClearScene("keyboard")
+			continue
+		}
+		gw.ActivateScene(state.Name, 0, "keyboard")
+	}
+	if len(state.Name) == 0 {
+		fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("scene.resumed"))
+		return
+	}
+	fmt.Print("\x1b[33;0H\x1b[K" + mawt.Text("scene.active", state.Name, state.Until.Format("15:04:05")))
+}
@@ -0,0 +1,33 @@
+// +build linux
+
+package main
+
+// This file contains the Linux implementation of the raw terminal mode used to
+// read the hotkeys, using the termios ioctls
+
+import (
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawTerminal switches the terminal into a mode where single key presses can be
+// read, returning a function that restores the previous mode
+//
+func rawTerminal(fd int) (restore func(), err errors.Error) {
+	saved, errGo := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	raw := *saved
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if errGo = unix.IoctlSetTermios(fd, unix.TCSETS, &raw); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, saved)
+	}, nil
+}
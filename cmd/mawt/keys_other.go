@@ -0,0 +1,14 @@
+// +build !linux
+
+package main
+
+// The hotkeys are only supported on Linux
+
+import (
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+func rawTerminal(fd int) (restore func(), err errors.Error) {
+	return nil, errors.New("hotkeys are only supported on Linux").With("stack", stack.Trace().TrimRuntime())
+}
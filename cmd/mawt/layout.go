@@ -0,0 +1,121 @@
+package main
+
+// This file implements the layout sub command that converts strand mappings
+// between the mawt configuration file and the layouts of xLights and LedFx
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/go-stack/stack"
+	"github.com/go-yaml/yaml"
+	"github.com/karlmutch/errors"
+)
+
+func runLayout(args []string) (exitCode int) {
+
+	if len(args) == 0 || (args[0] != "import" && args[0] != "export") {
+		fmt.Fprintln(os.Stderr, "usage: layout import|export [options]")
+		return -1
+	}
+
+	defaults := mawt.DefaultLayoutOptions()
+
+	flags := flag.NewFlagSet("layout "+args[0], flag.ContinueOnError)
+	format := flags.String("format", "xlights", "the layout format, xlights or ledfx")
+	file := flags.String("file", "", "the xLights rgbeffects file or LedFx configuration file to import")
+	config := flags.String("config", "", "the mawt configuration file holding the strand mappings to export")
+	pipeline := flags.String("pipeline", "", "the pipeline whose strand mappings are exported, the top level mappings when empty")
+	strandPixels := flags.Int("strand-pixels", defaults.StrandPixels, "the pixels in each block of the xLights channel space used for a physical strand")
+	logicalPixels := flags.Int("logical-pixels", defaults.LogicalPixels, "the length of the logical strands")
+	server := flags.String("server", "127.0.0.1", "the fadecandy server host used by exported LedFx devices")
+	port := flags.Int("port", 7890, "the fadecandy server port used by exported LedFx devices")
+
+	if errGo := flags.Parse(args[1:]); errGo != nil {
+		return -1
+	}
+	if *strandPixels < 1 || *logicalPixels < 1 {
+		fmt.Fprintln(os.Stderr, "strand-pixels and logical-pixels must be positive")
+		return -1
+	}
+	options := mawt.LayoutOptions{StrandPixels: *strandPixels, LogicalPixels: *logicalPixels}
+
+	var err errors.Error
+	if args[0] == "import" {
+		err = importLayout(*format, *file, options)
+	} else {
+		err = exportLayout(*format, *config, *pipeline, *server, *port, options)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	return 0
+}
+
+// importLayout prints the strands section of a configuration file for a layout
+//
+func importLayout(format string, file string, options mawt.LayoutOptions) (err errors.Error) {
+	f, errGo := os.Open(file)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", file).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	mappings := []mawt.StrandMapping{}
+	switch format {
+	case "xlights":
+		mappings, err = mawt.ImportXLights(f, options)
+	case "ledfx":
+		mappings, err = mawt.ImportLedFx(f)
+	default:
+		return errors.New("unknown layout format").With("format", format).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err != nil {
+		return err.With("file", file)
+	}
+
+	data, errGo := yaml.Marshal(struct {
+		Strands []mawt.StrandMapping `yaml:"strands"`
+	}{Strands: mappings})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	os.Stdout.Write(data)
+	return nil
+}
+
+// exportLayout prints the strand mappings of a configuration file as a layout
+//
+func exportLayout(format string, config string, pipeline string, server string, port int, options mawt.LayoutOptions) (err errors.Error) {
+	cfg, err := mawt.LoadConfig(config)
+	if err != nil {
+		return err
+	}
+
+	mappings := cfg.Strands
+	if len(pipeline) != 0 {
+		found := false
+		for _, candidate := range cfg.Pipelines {
+			if candidate.Name == pipeline {
+				if len(candidate.Strands) != 0 {
+					mappings = candidate.Strands
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("pipeline not found").With("pipeline", pipeline).With("file", config).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	switch format {
+	case "xlights":
+		return mawt.ExportXLights(os.Stdout, mappings, options)
+	case "ledfx":
+		return mawt.ExportLedFx(os.Stdout, mappings, server, port, options)
+	}
+	return errors.New("unknown layout format").With("format", format).With("stack", stack.Trace().TrimRuntime())
+}
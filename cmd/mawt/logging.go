@@ -0,0 +1,293 @@
+package main
+
+// This file implements the destination of the log, the terminal or a rotating
+// log file, which can be switched while mawt is running using the REST API so
+// that a headless install can be moved between files without a restart.  The log
+// is split into components, each with its own logger named mawt.<component> whose
+// level can be set on the command line, through the LOGXI environment variable, or
+// changed while mawt is running
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+	"github.com/mgutz/logxi"
+)
+
+// logSink is the writer the logger uses, either the standard output or a log file
+//
+type logSink struct {
+	file *mawt.LogFile // nil when logging to the standard output
+	sync.Mutex
+}
+
+var (
+	logOutput = &logSink{}
+
+	// logComponents holds the logger of each component of the log, along with the
+	// levels set using setLogLevels as logxi cannot report the level of a logger
+	logComponents = struct {
+		loggers map[string]logxi.Logger
+		levels  map[string]string
+		sync.Mutex
+	}{loggers: map[string]logxi.Logger{}, levels: map[string]string{}}
+
+	// apiLogger is used by the REST API and the other HTTP surfaces
+	apiLogger = logxi.New("mawt." + mawt.LogAPI)
+
+	logLevelNames = map[string]int{
+		"off":   logxi.LevelOff,
+		"error": logxi.LevelError,
+		"warn":  logxi.LevelWarn,
+		"info":  logxi.LevelInfo,
+		"debug": logxi.LevelDebug,
+		"trace": logxi.LevelTrace,
+	}
+)
+
+func (sink *logSink) Write(p []byte) (n int, errGo error) {
+	sink.Lock()
+	defer sink.Unlock()
+
+	// The length written is that of the entry before any stack traces were removed
+	if stripped := stripStacks(p); len(stripped) != len(p) {
+		if _, errGo = sink.write(stripped); errGo != nil {
+			return 0, errGo
+		}
+		return len(p), nil
+	}
+	return sink.write(p)
+}
+
+func (sink *logSink) write(p []byte) (n int, errGo error) {
+	if sink.file == nil {
+		return os.Stdout.Write(p)
+	}
+	return sink.file.Write(p)
+}
+
+// logFileConfig returns the rotation settings given on the command line for a file
+//
+func logFileConfig(path string) (config mawt.LogFileConfig) {
+	return mawt.LogFileConfig{
+		Path:     path,
+		MaxSize:  int64(*logMaxMB) * 1024 * 1024,
+		MaxAge:   *logMaxAge,
+		Keep:     *logKeep,
+		Compress: *logCompress,
+	}
+}
+
+// switchTo directs the log to a file, or to the standard output when the path is empty
+//
+func (sink *logSink) switchTo(path string) (err errors.Error) {
+	var file *mawt.LogFile
+	if len(path) != 0 {
+		if file, err = mawt.OpenLogFile(logFileConfig(path)); err != nil {
+			return err
+		}
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+
+	if sink.file != nil {
+		sink.file.Close()
+	}
+	sink.file = file
+	return nil
+}
+
+// report returns the state of the log file, nil when logging to the standard output
+//
+func (sink *logSink) report() (report *mawt.LogFileReport) {
+	sink.Lock()
+	defer sink.Unlock()
+
+	if sink.file == nil {
+		return nil
+	}
+	fileReport := sink.file.Report()
+	return &fileReport
+}
+
+// initLogging directs the log through the sink so that its destination can be
+// changed later, starting with the file given using the -log-file option.  The
+// format is chosen on startup, JSON when a file is given as the terminal colors
+// are of no use in them
+//
+func initLogging() (err errors.Error) {
+	if len(*logFile) != 0 {
+		if err = logOutput.switchTo(*logFile); err != nil {
+			return err
+		}
+	}
+
+	logComponents.Lock()
+	for _, component := range mawt.LogComponents {
+		name := "mawt." + component
+		if len(*logFile) == 0 {
+			logComponents.loggers[component] = logxi.NewLogger(logOutput, name)
+		} else {
+			logComponents.loggers[component] = logxi.NewLogger3(logOutput, name, logxi.NewJSONFormatter(name))
+		}
+		mawt.SetComponentLogger(component, logComponents.loggers[component])
+	}
+	logComponents.Unlock()
+
+	logger = componentLogger(mawt.LogGateway)
+	apiLogger = componentLogger(mawt.LogAPI)
+	return nil
+}
+
+// componentLogger returns the logger of a component of the log
+//
+func componentLogger(component string) (log logxi.Logger) {
+	logComponents.Lock()
+	defer logComponents.Unlock()
+
+	if log = logComponents.loggers[component]; log == nil {
+		return logger
+	}
+	return log
+}
+
+// levelName returns the name of the level a logger is set to, used for the loggers
+// whose level came from the LOGXI environment variable.  A logger switched off
+// cannot be told apart from one logging only errors
+//
+func levelName(log logxi.Logger) (name string) {
+	switch {
+	case log == logxi.NullLog:
+		return "off"
+	case log.IsTrace():
+		return "trace"
+	case log.IsDebug():
+		return "debug"
+	case log.IsInfo():
+		return "info"
+	case log.IsWarn():
+		return "warn"
+	}
+	return "error"
+}
+
+// logLevels returns the level of each component of the log
+//
+func logLevels() (levels map[string]string) {
+	logComponents.Lock()
+	defer logComponents.Unlock()
+
+	levels = make(map[string]string, len(logComponents.loggers))
+	for component, log := range logComponents.loggers {
+		if name, isPresent := logComponents.levels[component]; isPresent {
+			levels[component] = name
+			continue
+		}
+		levels[component] = levelName(log)
+	}
+	return levels
+}
+
+// setLogLevels changes the levels of the components of the log, given as a level
+// applied to every component, such as debug, or as a comma separated list of
+// component=level pairs, such as poller=debug,output=warn.  Nothing is changed
+// when any of the components or levels is unknown
+//
+func setLogLevels(spec string) (err errors.Error) {
+	levels := map[string]string{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		component, name := "", item
+		if i := strings.Index(item, "="); i != -1 {
+			component, name = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		name = strings.ToLower(name)
+		if _, isPresent := logLevelNames[name]; !isPresent {
+			return errors.New("unknown log level, off, error, warn, info, debug or trace are supported").With("level", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(component) == 0 || component == "all" {
+			for _, component := range mawt.LogComponents {
+				levels[component] = name
+			}
+			continue
+		}
+		if !mawt.IsLogComponent(component) {
+			return errors.New(fmt.Sprintf("unknown log component, %s are supported", strings.Join(mawt.LogComponents, ", "))).With("component", component).With("stack", stack.Trace().TrimRuntime())
+		}
+		levels[component] = name
+	}
+
+	for component, name := range levels {
+		componentLogger(component).SetLevel(logLevelNames[name])
+	}
+	logComponents.Lock()
+	for component, name := range levels {
+		logComponents.levels[component] = name
+	}
+	logComponents.Unlock()
+	return nil
+}
+
+// serveLog reports the destination of the log on a GET, switches it to the file in
+// the file parameter on a PUT, an empty file being the standard output, and rotates
+// the log file on a POST
+//
+func serveLog(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		path := r.URL.Query().Get("file")
+		if err := logOutput.switchTo(path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info("log destination changed by " + r.RemoteAddr)
+	case http.MethodPost:
+		logOutput.Lock()
+		file := logOutput.file
+		logOutput.Unlock()
+		if file == nil {
+			http.Error(w, "the log is not being written to a file", http.StatusConflict)
+			return
+		}
+		if err := file.Rotate(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "only GET, PUT and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, logOutput.report())
+}
+
+// serveLogLevels reports the level of each component of the log on a GET, and
+// changes them on a PUT using the levels parameter, for example
+// levels=poller=debug,output=warn
+//
+func serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		spec := r.URL.Query().Get("levels")
+		if err := setLogLevels(spec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apiLogger.Info(fmt.Sprintf("log levels %s set by %s", spec, r.RemoteAddr))
+	default:
+		http.Error(w, "only GET and PUT are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, logLevels())
+}
@@ -5,14 +5,15 @@ import (
 	"flag"
 	"fmt"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
 	_ "net/http/pprof"
 
@@ -30,15 +31,97 @@ import (
 var (
 	logger = logxi.New("mawt")
 
-	fcserver   = flag.String("server", "127.0.0.1:7890", "the ip and port for the fadecandy server (use /dev/null if none present)")
+	fcserver   = flag.String("server", "127.0.0.1:7890", "the ip and port, IPv6 literal, or DNS SRV name for the fadecandy server (use /dev/null if none present)")
 	terminal   = flag.Bool("term", false, "Used to define if a text user interface is being used")
 	verbose    = flag.Bool("v", false, "When enabled will print internal logging for this tool")
-	tecthulhus = flag.String("tecthulhus", "http://operation-wigwam.ingress.com:8080/v1/test-info", "A comma seperated list of IP based tecthulhus, the first being the 'home' portal")
+	instance   = flag.String("instance", "", "an optional name for this instance, allowing several to run on one host, for example one per sculpture, each with its own -listen address")
+	listen     = flag.String("listen", "0.0.0.0:6060", "the ip and port the REST API and metrics are served on")
+	tecthulhus = flag.String("tecthulhus", "http://operation-wigwam.ingress.com:8080/v1/test-info", "A comma seperated list of IP based tecthulhus, the first being the 'home' portal, or a file://, env: or secret: reference to one")
+	secretsDir = flag.String("secrets-dir", mawt.DefaultSecretsDir, "the directory secret: references in options and the configuration file are read from")
+
+	notifyWebhook = flag.String("notify-webhook", "", "an optional Discord or Slack webhook URL that will be sent notifications of critical operational errors")
+	discover      = flag.Bool("discover", false, "use mDNS to discover the fadecandy server and tecthulhus when the -server and -tecthulhus options are not set")
+	discoverWait  = flag.Duration("discover-wait", 3*time.Second, "the time spent waiting for mDNS replies when discovering services")
+
+	configFile    = flag.String("config", "", "an optional YAML configuration file, or an http(s):// or s3://bucket/key URL for one, for example to tune the tecthulhu polling policy")
+	configRefresh = flag.Duration("config-refresh", 5*time.Minute, "the interval at which the configuration is checked for changes to strands and profiles, 0 disables checking")
+
+	bleBeacon = flag.Bool("ble-beacon", false, "advertise the home portal state of the first pipeline as a Bluetooth LE beacon, requires root or CAP_NET_RAW")
+	bleDevice = flag.Int("ble-device", 0, "the Bluetooth adapter used for the beacon, for example 0 for hci0")
+
+	fleetBroadcast = flag.String("fleet-broadcast", "", "an optional UDP address, for example 255.255.255.255:7892, the instance name, version, home portal and health are broadcast to for the fleet sub command")
+	fleetInterval  = flag.Duration("fleet-interval", 5*time.Second, "the interval at which the fleet status is broadcast")
+
+	estopGPIO      = flag.Int("estop-gpio", -1, "the sysfs GPIO number of an emergency stop input that blacks out all outputs until cleared, -1 disables")
+	estopActiveLow = flag.Bool("estop-active-low", true, "the emergency stop input is active when pulled low")
+
+	midiClock    = flag.String("midi-clock", "", "an optional raw MIDI device, for example /dev/snd/midiC1D0, whose timing clock sets the tempo show sequences are aligned to")
+	beatLatency  = flag.Duration("beat-latency", 35*time.Millisecond, "the time between a frame being rendered and the LEDs changing, beats are anticipated by this much")
+	audioLatency = flag.Duration("audio-latency", mawt.DefaultAudioLatency, "the time between a sound effect being queued and it being heard, the audio cues of shows are queued early by this much less the -beat-latency")
+
+	mtcDevice     = flag.String("mtc", "", "an optional raw MIDI device, for example /dev/snd/midiC1D0, whose MIDI Time Code a show with a start timecode chases, which may be the -midi-clock device")
+	ltcFile       = flag.String("ltc", "", "an optional file or FIFO of mono 16 bit little endian audio samples, - for the standard input, whose Linear Time Code a show with a start timecode chases")
+	ltcSampleRate = flag.Int("ltc-sample-rate", 48000, "the sample rate of the -ltc audio")
+
+	storeDir       = flag.String("store-dir", "", "an optional directory in which events, errors and coarse metrics are persisted for analysis after an event")
+	storeRetention = flag.Duration("store-retention", 30*24*time.Hour, "the time for which persisted records are kept, 0 keeps them until the size limit is reached")
+	storeMaxMB     = flag.Int("store-max-mb", 64, "the size in megabytes beyond which the oldest persisted records are removed, 0 disables the limit")
+	storeInterval  = flag.Duration("store-interval", time.Minute, "the interval at which the health of the pipelines is persisted")
+
+	snapshotFile     = flag.String("snapshot", "", "an optional file the renderer state of the pipelines is saved to, and restored from on startup, so a restart resumes a show where it was")
+	snapshotInterval = flag.Duration("snapshot-interval", 5*time.Second, "the interval at which the snapshot is saved, 0 saves it only when requested using the REST API")
+	snapshotMaxAge   = flag.Duration("snapshot-max-age", 10*time.Minute, "the oldest snapshot restored on startup, older snapshots being from an earlier event rather than a crash, 0 restores a snapshot of any age")
+
+	crashState  = flag.String("crash-state", "", "an optional file in which the starts of the gateway are counted, after -crash-limit starts in a row that crashed rather than shutting down cleanly the gateway boots into safe mode")
+	crashLimit  = flag.Int("crash-limit", 3, "the crashes in a row after which the gateway boots into safe mode, drawing only the static faction color, 0 never uses safe mode")
+	crashStable = flag.Duration("crash-stable", 10*time.Minute, "the time the gateway must run before the crashes counted are cleared")
+
+	effectPlugins = flag.String("effect-plugins", "", "an optional directory of compiled Go effect plugins, files ending in .so, added to the effects shows can play")
+
+	logFile     = flag.String("log-file", "", "an optional file the log is written to in place of the standard output, rotated using the -log-max-mb and -log-max-age options")
+	logMaxMB    = flag.Int("log-max-mb", 10, "the size in megabytes beyond which the log file is rotated, 0 disables size based rotation")
+	logMaxAge   = flag.Duration("log-max-age", 24*time.Hour, "the time after which the log file is rotated, 0 disables time based rotation")
+	logKeep     = flag.Int("log-keep", 5, "the number of rotated log files kept, 0 keeps them all")
+	logCompress = flag.Bool("log-compress", true, "compress rotated log files using gzip")
+
+	logLevelsSpec = flag.String("log-levels", "", "the levels of the components of the log, poller, decoder, sequencer, output, api and gateway, for example poller=debug,output=warn, or a single level such as info for all of them")
+
+	profileDir      = flag.String("profile-dir", os.TempDir(), "the directory CPU and allocation profiles captured on SIGUSR1 or using the /api/v1/debug/profile REST API are written to")
+	profileDuration = flag.Duration("profile-duration", mawt.DefaultProfileDuration, "the time over which profiles captured on SIGUSR1 or using the REST API are taken")
+
+	shutdownCheck = flag.Duration("shutdown-check", 0, "a debugging option, the time allowed on shutdown for the subsystems to exit, after which those still running are reported along with the stacks of their goroutines and the exit code is non-zero, 0 disables the check")
+
+	faultInjection = flag.Bool("fault-injection", false, "allow faults to be injected using the /api/v1/faults REST API, used by the chaos sub command, never enable this at an event")
+
+	selfTest = flag.Bool("selftest", false, "run the startup self-test, print a PASS/FAIL table and exit, the exit code is non-zero when any check fails")
+
+	seed = flag.Int64("seed", 0, "the seed of the effects using random numbers, overriding the configuration file, 0 seeds them from the time")
+
+	termColors = flag.String("term-colors", "auto", "the way the terminal preview draws pixels, truecolor, 256 or ascii, auto detecting the terminal from the TERM, COLORTERM and NO_COLOR environment variables")
+
+	language = flag.String("language", "", "the language of the messages shown by the terminal preview, en, ja or de, a locale such as ja_JP.UTF-8 also being accepted, the web pages follow the language of the browser")
+
+	timezone = flag.String("timezone", "Local", "the IANA timezone, for example America/Los_Angeles, used for scheduling, recorded timestamps and the REST API, Local uses the zone of the host")
+
+	historyDepth = flag.Int("history-depth", 2000, "the number of portal status messages retained for the /api/v1/history REST query")
 )
 
 func usage() {
 	fmt.Fprintln(os.Stderr, path.Base(os.Args[0]))
 	fmt.Fprintln(os.Stderr, "usage: ", os.Args[0], "[options]       techthulu ← TCP → OPC (mawt)      ", version.GitHash, "    ", version.BuildTime)
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "bench [-pixels 64,512,4096] [-fps 33]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "node [-listen :7891] [-server 127.0.0.1:7890]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "layout import -format xlights|ledfx -file layout")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "layout export -format xlights|ledfx -config mawt.yaml [-pipeline name]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "repl [-strands 8] [-pixels 30] [-gateway http://127.0.0.1:6060] [-token t] [-effect-plugins dir] [-term-colors auto|truecolor|256|ascii]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "chaos [-gateway http://127.0.0.1:6060] [-token t] [-rounds 6] [-faults corrupt-json,opc-drop,poll-delay] [-duration 10s]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "replay -file recording [-server 127.0.0.1:7890] [-universe n] [-speed 1] [-loop] [-info]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "fleet [-listen :7892] [-wait 10s] [-watch] [-instance name]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "report -store-dir dir [-since 12h] [-until time] [-format markdown|json] [-top 10]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "config schema [-effect-plugins dir]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "config validate -file mawt.yaml [-effect-plugins dir]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "contract check|update [-file assets/contracts/v1.json] [-force]")
+	fmt.Fprintln(os.Stderr, "       ", os.Args[0], "contract verify [-file assets/contracts/v1.json] [-gateway http://127.0.0.1:6060] [-token t]")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "mawt is a gateway between Niantic Ingress Techthulu and OPC based USB fadecandy boards")
 	fmt.Fprintln(os.Stderr, "")
@@ -51,6 +134,7 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "options can also be extracted from environment variables by changing dashes '-' to underscores and using upper case.")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "log levels are handled by the LOGXI env variables, these are documented at https://github.com/mgutz/logxi")
+	fmt.Fprintln(os.Stderr, "each component of the log has a logger named mawt.<component>, for example LOGXI=mawt.poller=DBG, or use the -log-levels option")
 }
 
 func init() {
@@ -61,13 +145,59 @@ func init() {
 //
 func main() {
 
+	// The bench sub command measures the LED pipeline and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	// The node sub command runs a remote render node and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "node" {
+		os.Exit(runNode(os.Args[2:]))
+	}
+	// The layout sub command converts strand mappings and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "layout" {
+		os.Exit(runLayout(os.Args[2:]))
+	}
+	// The repl sub command is used to experiment with effects and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "repl" {
+		os.Exit(runREPL(os.Args[2:]))
+	}
+	// The replay sub command plays a recording of frames and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	// The fleet sub command lists the gateways broadcasting their status and does not run one
+	if len(os.Args) > 1 && os.Args[1] == "fleet" {
+		os.Exit(runFleet(os.Args[2:]))
+	}
+	// The chaos sub command tests the resilience of a running gateway and does not run one
+	if len(os.Args) > 1 && os.Args[1] == "chaos" {
+		os.Exit(runChaos(os.Args[2:]))
+	}
+	// The report sub command summarizes the persisted records and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(runReport(os.Args[2:]))
+	}
+	// The config sub command prints the configuration schema or checks a file and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:]))
+	}
+	// The contract sub command checks the REST API against its saved contract and does not run the gateway
+	if len(os.Args) > 1 && os.Args[1] == "contract" {
+		os.Exit(runContract(os.Args[2:]))
+	}
+
 	quitC := make(chan struct{})
 	defer close(quitC)
 
 	// Skip this step when the server is not running in production mode, that is when the
 	// server is being used in an automatted test
 	//
-	if err := exclusive("mawt", quitC); err != nil {
+	envflag.Parse()
+	if err := validInstance(*instance); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-1)
+	}
+	if err := exclusive(instanceName("mawt"), quitC); err != nil {
 		logger.Error(fmt.Sprintf("An instance of this process is already running %s", err.Error()))
 		os.Exit(-1)
 	}
@@ -81,12 +211,66 @@ func Main() {
 		envflag.Parse()
 	}
 
+	// The timezone is set before anything is logged or recorded so that timestamps are consistent
+	if err := mawt.SetTimezone(*timezone); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-1)
+	}
+
+	// The deployment mode is applied before the options it controls are used
+	modeWarnings, err := applyMode()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-1)
+	}
+
+	if err := initLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-1)
+	}
+
 	if *verbose {
-		logger.SetLevel(logxi.LevelDebug)
+		setLogLevels("debug")
+	}
+	if len(*logLevelsSpec) != 0 {
+		if err := setLogLevels(*logLevelsSpec); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(-1)
+		}
+	}
+	for _, warning := range modeWarnings {
+		logger.Warn(warning)
+	}
+	// The language may come from the environment so an unsupported one is not fatal
+	if len(*language) != 0 {
+		if err := mawt.SetLanguage(*language); err != nil {
+			logger.Warn(fmt.Sprint("messages are shown in English ", err.Error()))
+		}
+	}
+	if mode, err := mawt.ParseColorMode(*termColors); err != nil {
+		logger.Warn(fmt.Sprint("the terminal preview auto detects its colors ", err.Error()))
+	} else {
+		mawt.SetTerminalColors(mode)
+	}
+	logger.Debug(fmt.Sprintf("running in the %s mode", modeName()))
+
+	// The self-test exits once its table is printed, so it is not counted as a start
+	if !*selfTest {
+		startCrashGuard()
 	}
 
 	logger.Debug(fmt.Sprintf("%s built at %s, against commit id %s\n", os.Args[0], version.BuildTime, version.GitHash))
 
+	// The tecthulhus can be given as a reference so their URLs stay out of process listings
+	mawt.SetSecretsDir(*secretsDir)
+	portals, err := mawt.ResolveSecretList(*tecthulhus)
+	if err != nil {
+		logger.Error(err.Error())
+		stopCrashGuard()
+		os.Exit(-1)
+	}
+	*tecthulhus = strings.Join(portals, ",")
+
 	doneC := make(chan struct{})
 	quitC := make(chan struct{})
 
@@ -94,6 +278,7 @@ func Main() {
 		for _, err := range errs {
 			logger.Error(err.Error())
 		}
+		stopCrashGuard()
 		os.Exit(-1)
 	}
 
@@ -103,10 +288,38 @@ func Main() {
 	select {
 	case <-quitC:
 	}
+	stopCrashGuard()
 
-	// Allow the quitC to be sent before exiting, giving other modules a chance to stop
-	time.Sleep(time.Second)
+	if *shutdownCheck > 0 {
+		checkShutdown(*shutdownCheck)
+	} else {
+		// Allow the quitC to be sent before exiting, giving other modules a chance to stop
+		time.Sleep(time.Second)
+	}
 
+	// CI runs using a validate output fail when any of the frames were invalid
+	if invalid := invalidFrames(); invalid != 0 {
+		logger.Error(fmt.Sprintf("%d invalid frames were found by the validate outputs", invalid))
+		os.Exit(-1)
+	}
+}
+
+// checkShutdown waits for the subsystems to exit, reporting those still running
+// and exiting with a non-zero code when the time allowed passes
+//
+func checkShutdown(timeout time.Duration) {
+	report := mawt.WaitSubsystems(timeout)
+	if report == nil {
+		logger.Info("all subsystems exited")
+		return
+	}
+	names := make([]string, 0, len(report.Subsystems))
+	for name, count := range report.Subsystems {
+		names = append(names, fmt.Sprintf("%s (%d)", name, count))
+	}
+	sort.Strings(names)
+	logger.Error(fmt.Sprintf("subsystems still running %s after %s: %s", strings.Join(names, ", "), report.Waited.Round(time.Millisecond), strings.Join(report.Goroutines, "\n\n")))
+	os.Exit(-1)
 }
 
 func initOPC(quitC <-chan struct{}) (err errors.Error) {
@@ -123,10 +336,6 @@ func EntryPoint(quitC chan struct{}, doneC chan struct{}) (errs []errors.Error)
 
 	defer close(doneC)
 
-	go func() {
-		http.ListenAndServe("0.0.0.0:6060", nil)
-	}()
-
 	// Supplying the context allows the client to pubsub to cancel the
 	// blocking receive inside the run
 	ctx, cancel := context.WithCancel(context.Background())
@@ -139,7 +348,7 @@ func EntryPoint(quitC chan struct{}, doneC chan struct{}) (errs []errors.Error)
 	// occurs we cancel the background msg pump processing pubsub mesages from
 	// google, and this will also cause the main thread to unblock and return
 	//
-	stopC := make(chan os.Signal)
+	stopC := make(chan os.Signal, 1)
 	go func() {
 		defer cancel()
 
@@ -150,7 +359,8 @@ func EntryPoint(quitC chan struct{}, doneC chan struct{}) (errs []errors.Error)
 			select {
 			case err := <-eC:
 				if err != nil {
-					logger.Warn(err.Error())
+					componentLogger(mawt.ErrorComponent(err)).Warn(err.Error())
+					mawt.PublishError(err)
 				}
 			case msg := <-mC:
 				if len(msg) > 0 {
@@ -181,30 +391,383 @@ func startServer(ctx context.Context, msgC chan string, errorC chan errors.Error
 	// Eventually hook up error and message streams
 	go runTUI(msgC, errorC, ctx.Done())
 
-	gw := &mawt.Gateway{}
+	if *estopGPIO >= 0 {
+		if err := mawt.WatchEStopGPIO(*estopGPIO, *estopActiveLow, errorC, ctx.Done()); err != nil {
+			return append(errs, err)
+		}
+	}
+	mawt.GetBeat().SetLatency(*beatLatency)
+	mawt.SetAudioLatency(*audioLatency)
+	if len(*midiClock) != 0 {
+		// A device sending both the clock and timecode is only read once
+		var timecode *mawt.TimecodeClock
+		if *mtcDevice == *midiClock {
+			timecode = mawt.GetTimecode()
+		}
+		if err := mawt.ReadMIDI(*midiClock, mawt.GetBeat(), timecode, errorC, ctx.Done()); err != nil {
+			return append(errs, err)
+		}
+	}
+	if len(*mtcDevice) != 0 && *mtcDevice != *midiClock {
+		if err := mawt.ReadMIDI(*mtcDevice, nil, mawt.GetTimecode(), errorC, ctx.Done()); err != nil {
+			return append(errs, err)
+		}
+	}
+	if len(*ltcFile) != 0 {
+		if err := mawt.ReadLTC(*ltcFile, *ltcSampleRate, mawt.GetTimecode(), errorC, ctx.Done()); err != nil {
+			return append(errs, err)
+		}
+	}
+	if *terminal {
+		if err := watchKeys(ctx.Done()); err != nil {
+			logger.Warn(fmt.Sprint("emergency stop and tap tempo hotkeys unavailable ", err.Error()))
+		}
+	}
+
+	if *discover {
+		discoverEndpoints()
+	}
+
+	if *faultInjection {
+		logger.Warn("fault injection is enabled, the gateway can be disrupted using the /api/v1/faults REST API")
+		mawt.EnableFaults()
+	}
 
-	statusC, subscribeC := gw.Start(*fcserver, *terminal, errorC, ctx.Done())
+	watchCrashGuard(ctx.Done())
 
-	portals := strings.Split(*tecthulhus, ",")
-	for i, portal := range portals {
-		url, errGo := url.Parse(portal)
-		if errGo != nil {
-			errs = append(errs, errors.Wrap(errGo).With("url", portal).With("stack", stack.Trace().TrimRuntime()))
-			continue
+	// Effect plugins are loaded before the configuration so that shows using them are valid
+	if len(*effectPlugins) != 0 && inSafeMode() {
+		logger.Warn(fmt.Sprintf("effect plugins in %s are not loaded in safe mode", *effectPlugins))
+	} else if len(*effectPlugins) != 0 {
+		loaded, err := mawt.LoadEffectPlugins(*effectPlugins)
+		if err != nil {
+			return append(errs, err)
 		}
-		if len(url.Path) <= 1 {
-			logger.Warn("URL supplied without a path component, default one supplied")
-			url.Path = "/module/status/json"
+		logger.Info(fmt.Sprintf("loaded effects %v from %s", loaded, *effectPlugins))
+	}
+
+	configName := *configFile
+	if len(configName) == 0 {
+		configName = "defaults"
+	}
+	configSrc := mawt.NewConfigSource(*configFile)
+	configSource = configSrc
+	cfg, _, err := configSrc.Load()
+	if err != nil && inSafeMode() {
+		logger.Error(fmt.Sprint("SAFE MODE: the configuration could not be loaded, the defaults are used ", err.Error()))
+		cfg, err = mawt.DefaultConfig(), nil
+	}
+	if err != nil {
+		if *selfTest {
+			printSelfTest(os.Stdout, []selfTestResult{{Check: "config", Target: configName, Detail: err.Error()}})
 		}
-		tec := mawt.NewTecthulu(*url, i == 0, statusC, errorC)
-		go tec.Run(ctx.Done())
+		return append(errs, err)
 	}
 
-	go runMonitoring(subscribeC, ctx.Done())
+	if inSafeMode() {
+		cfg = mawt.SafeConfig(cfg)
+	}
+
+	// The HTTP surfaces are served once the configuration gives their authentication
+	if err = serveHTTP(cfg.Auth, cfg.Web); err != nil {
+		return append(errs, err)
+	}
+
+	// Effects are seeded before any are created, the seed being logged so that a show can be reproduced
+	if *seed != 0 {
+		cfg.Seed = *seed
+	}
+	mawt.SetSeeds(cfg.Seed, cfg.Seeds)
+	logger.Info(fmt.Sprintf("effects seeded using %d", mawt.Seed()))
+
+	// Without any pipelines in the configuration file a single pipeline is
+	// created using the command line options
+	pipelines := cfg.Pipelines
+	if len(pipelines) == 0 {
+		pipelines = []mawt.PipelineConfig{
+			{
+				Name:       "default",
+				Server:     *fcserver,
+				Tecthulhus: strings.Split(*tecthulhus, ","),
+				Audio:      true,
+			},
+		}
+	}
+
+	gws := make([]*mawt.Gateway, 0, len(pipelines))
+	mawt.SetPollConcurrency(cfg.Polling.Concurrency)
+	mawt.SetBufferBudget(int64(cfg.BufferBudgetMB) << 20)
+	if err = mawt.SetPollHTTP(cfg.Polling.HTTP); err != nil {
+		return append(errs, err)
+	}
+	portals := []selfTestPortal{}
+
+	// A single light and temperature sensor are shared by all of the pipelines
+	var ambient *mawt.Ambient
+	if cfg.Ambient != nil {
+		if ambient, err = mawt.NewAmbient(*cfg.Ambient); err != nil {
+			return append(errs, err)
+		}
+		ambient.Start(errorC, ctx.Done())
+	}
+	var thermal *mawt.Thermal
+	if cfg.Thermal != nil {
+		if thermal, err = mawt.NewThermal(*cfg.Thermal); err != nil {
+			return append(errs, err)
+		}
+		thermal.Start(errorC, ctx.Done())
+	}
+	scenes, err := mawt.NewScenes(cfg.Scenes)
+	if err != nil {
+		return append(errs, err)
+	}
+
+	for i, pipeline := range pipelines {
+		gw := &mawt.Gateway{
+			Name:          pipeline.Name,
+			HistoryDepth:  *historyDepth,
+			NotifyWebhook: *notifyWebhook,
+			NoAudio:       !pipeline.Audio,
+			SafeMode:      inSafeMode(),
+			Profiles:      cfg.Profiles,
+			Profile:       cfg.Profile,
+			EffectBudget:  cfg.EffectBudget,
+			SendWorkers:   cfg.SendWorkers,
+
+			ChangeDetection: cfg.ChangeDetection,
+			Arbitration:     cfg.Arbitration,
+			Ambient:         ambient,
+			Thermal:         thermal,
+			Scenes:          scenes,
+		}
+		if pipeline.Arbitration != nil {
+			gw.Arbitration = *pipeline.Arbitration
+		}
+		if pipeline.HistoryDepth != 0 {
+			gw.HistoryDepth = pipeline.HistoryDepth
+		}
+		if gw.Strands, err = pipelineStrands(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		if gw.Phases, err = pipelinePhases(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		if gw.Firmware, err = pipelineFirmware(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		if gw.Status, err = pipelineStatus(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		if gw.Canary, err = pipelineCanary(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		if gw.Standby, err = pipelineStandby(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		if gw.Guard, err = pipelineGuard(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		gw.Transform = pipelineTransform(cfg, pipeline)
+		if gw.Outputs, err = pipelineOutputs(cfg, pipeline); err != nil {
+			return append(errs, err)
+		}
+		if gw.Palette, err = mawt.GetPalette(cfg.Palette); err != nil {
+			return append(errs, err)
+		}
+		if gw.Heartbeat, err = mawt.NewHeartbeat(cfg.Heartbeat); err != nil {
+			return append(errs, err)
+		}
+		if cfg.Decay != nil {
+			if gw.Decay, err = mawt.NewDecay(*cfg.Decay); err != nil {
+				return append(errs, err)
+			}
+		}
+		if gw.Recharge, err = mawt.NewRecharge(cfg.Recharge); err != nil {
+			return append(errs, err)
+		}
+		if gw.Stingers, err = mawt.NewStingers(cfg.Stingers); err != nil {
+			return append(errs, err)
+		}
+		if cfg.Show != nil {
+			if gw.Show, err = mawt.NewShowPlayer(*cfg.Show); err != nil {
+				return append(errs, err)
+			}
+			if len(cfg.Show.Timecode) != 0 {
+				if len(*mtcDevice) == 0 && len(*ltcFile) == 0 {
+					logger.Warn(fmt.Sprintf("pipeline %s show starts at timecode %s but neither -mtc nor -ltc was given, the show stays dark", gw.Name, cfg.Show.Timecode))
+				}
+				if err = gw.Show.Chase(mawt.GetTimecode()); err != nil {
+					return append(errs, err)
+				}
+			}
+		}
+		// The top level OPC input is used by the first pipeline as each needs its own port
+		input := pipeline.OPCInput
+		if input == nil && i == 0 {
+			input = cfg.OPCInput
+		}
+		if input != nil {
+			// Instances on the same host cannot share the port of an OPC input
+			if gw.OPCInput, err = mawt.NewOPCInput(*input); err != nil {
+				return append(errs, err.With("pipeline", pipeline.Name).With("instance", *instance))
+			}
+		}
+		timeline := cfg.Timeline
+		if pipeline.Timeline != nil {
+			timeline = pipeline.Timeline
+		}
+		if timeline != nil {
+			if gw.Timeline, err = mawt.NewTimeline(*timeline); err != nil {
+				return append(errs, err)
+			}
+		}
+		score := cfg.Score
+		if pipeline.Score != nil {
+			score = pipeline.Score
+		}
+		if score != nil {
+			if gw.Score, err = mawt.NewScore(*score); err != nil {
+				return append(errs, err)
+			}
+		}
+		ticker := cfg.Ticker
+		if pipeline.Ticker != nil {
+			ticker = pipeline.Ticker
+		}
+		if ticker != nil {
+			if gw.Ticker, err = mawt.NewTicker(*ticker); err != nil {
+				return append(errs, err)
+			}
+		}
+
+		// Only the first pipeline is able to use the terminal for the LED preview
+		broker := gw.Start(pipeline.Server, *terminal && i == 0, errorC, ctx.Done())
+
+		// A headless show needs no tecthulhus, any that are configured are ignored
+		tecthulhus := pipeline.Tecthulhus
+		if gw.Show != nil {
+			logger.Info(fmt.Sprintf("pipeline %s is playing a headless show of %d entries, tecthulhus are not polled", gw.Name, len(cfg.Show.Playlist)))
+			tecthulhus = nil
+		}
+		for i, portal := range tecthulhus {
+			url, errGo := url.Parse(portal)
+			if errGo != nil {
+				errs = append(errs, errors.Wrap(errGo).With("url", portal).With("pipeline", pipeline.Name).With("stack", stack.Trace().TrimRuntime()))
+				continue
+			}
+			if len(url.Path) <= 1 {
+				logger.Warn("URL supplied without a path component, default one supplied")
+				url.Path = "/module/status/json"
+			}
+			gw.AddPortal(*url, i == 0, cfg.Polling, errorC, ctx.Done())
+			portals = append(portals, selfTestPortal{pipeline: gw.Name, url: *url, transform: gw.Transform})
+		}
+
+		if *bleBeacon && i == 0 {
+			if err := mawt.StartBeacon(*bleDevice, broker, errorC, ctx.Done()); err != nil {
+				logger.Warn(fmt.Sprint("BLE beacon could not be started ", err.Error()))
+			}
+		}
+
+		go runMonitoring(broker, ctx.Done())
+
+		gws = append(gws, gw)
+	}
+
+	if cfg.Console != nil {
+		console, err := mawt.NewConsole(*cfg.Console)
+		if err != nil {
+			return append(errs, err)
+		}
+		if err = console.Start(gws, errorC, ctx.Done()); err != nil {
+			return append(errs, err)
+		}
+	}
+	if cfg.Status != nil && len(cfg.Status.LED) != 0 {
+		status, err := mawt.NewStatus(*cfg.Status)
+		if err != nil {
+			return append(errs, err)
+		}
+		if err = mawt.WatchStatusLED(status, gws, errorC, ctx.Done()); err != nil {
+			logger.Warn(fmt.Sprint("status LED unavailable ", err.Error()))
+		}
+	}
+	if len(cfg.Buttons) != 0 {
+		buttons, err := mawt.NewButtons(cfg.Buttons)
+		if err != nil {
+			return append(errs, err)
+		}
+		buttons.SelfTest = func() {
+			buttonSelfTest(msgC, configName, pipelines, portals, gws)
+		}
+		if err = buttons.Start(gws, errorC, ctx.Done()); err != nil {
+			return append(errs, err)
+		}
+	}
+
+	if len(*storeDir) != 0 {
+		if store, err = mawt.OpenStore(*storeDir, *storeRetention, int64(*storeMaxMB)*1024*1024, mawt.Location()); err != nil {
+			return append(errs, err)
+		}
+		store.Record(gws, *storeInterval, errorC, ctx.Done())
+	}
+
+	if len(*fleetBroadcast) != 0 {
+		if err := mawt.BroadcastFleetStatus(*fleetBroadcast, *fleetInterval, *instance, version.Version, gws, errorC, ctx.Done()); err != nil {
+			logger.Warn(fmt.Sprint("fleet status could not be broadcast ", err.Error()))
+		}
+	}
+
+	if len(*snapshotFile) != 0 && inSafeMode() {
+		logger.Warn(fmt.Sprintf("the snapshot %s is neither restored nor saved in safe mode", *snapshotFile))
+	} else if len(*snapshotFile) != 0 {
+		startSnapshots(*snapshotFile, gws, *snapshotInterval, *snapshotMaxAge, errorC, ctx.Done())
+	}
+
+	initAPI(gws)
+	// Profiles are captured on SIGUSR1 only when the deployment mode allows profiling
+	if pprofEnabled {
+		watchProfileSignal(ctx.Done())
+	}
+
+	if len(*configFile) != 0 && *configRefresh > 0 {
+		go watchConfig(configSrc, gws, *configRefresh, errorC, ctx.Done())
+	}
+
+	go runEventMonitoring(ctx.Done())
+
+	if *selfTest {
+		if printSelfTest(os.Stdout, runSelfTest(configName, pipelines, portals, gws)) {
+			os.Exit(0)
+		}
+		os.Exit(-1)
+	}
+	reportSelfTest(msgC, configName, pipelines, portals, gws)
 
 	return errs
 }
 
+// validInstance checks that an instance name can be used within socket and metric names
+//
+func validInstance(name string) (err errors.Error) {
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return errors.New("instance names may only contain letters, digits, dashes and underscores").With("instance", name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// instanceName namespaces a name shared by the instances on a host, such as the
+// lock and the metrics, using the -instance name when one was given
+//
+func instanceName(name string) (namespaced string) {
+	if len(*instance) == 0 {
+		return name
+	}
+	return name + "." + *instance
+}
+
 func exclusive(name string, quitC chan struct{}) (err errors.Error) {
 
 	excl := struct {
@@ -0,0 +1,192 @@
+package main
+
+// This file implements the deployment modes of the gateway.  The development
+// conveniences, the terminal preview, debug logging, the pprof handlers, the stack
+// traces carried by errors, fault injection and the shutdown check, were each
+// enabled using their own option, which left installs at events running with
+// whichever of them had been switched on while the show was being built.  The
+// -production option turns them all off in one switch, and -dev turns them all on
+// for a workstation.  Options given explicitly take precedence over -dev, while
+// -production overrides them, logging a warning for each one it turned off
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	devShutdownCheck = 10 * time.Second
+)
+
+var (
+	production = flag.Bool("production", false, "run with the development conveniences disabled, the terminal preview, debug logging, pprof handlers, error stack traces, fault injection and the shutdown check, for installs at an event")
+	dev        = flag.Bool("dev", false, "run with the development conveniences enabled, the terminal preview, debug logging, pprof handlers, error stack traces, fault injection and the shutdown check, unless turned off using their own options")
+
+	// pprofEnabled and errorStacks are set by the deployment mode, both being on
+	// unless -production is used
+	pprofEnabled = true
+	errorStacks  = true
+
+	// stackTrace matches the stack traces added to errors, as they appear in the
+	// text of an error and quoted again by the JSON log format
+	stackTrace = regexp.MustCompile(` stack=\\?"\[[^\]]*\]\\?"`)
+)
+
+// modeOption is a development convenience controlled by the deployment mode
+//
+type modeOption struct {
+	name string
+	on   func() bool
+	set  func(on bool)
+}
+
+func modeOptions() (options []modeOption) {
+	return []modeOption{
+		{name: "term", on: func() bool { return *terminal }, set: func(on bool) { *terminal = on }},
+		{name: "v", on: func() bool { return *verbose }, set: func(on bool) { *verbose = on }},
+		{name: "fault-injection", on: func() bool { return *faultInjection }, set: func(on bool) { *faultInjection = on }},
+		{
+			name: "shutdown-check",
+			on:   func() bool { return *shutdownCheck > 0 },
+			set: func(on bool) {
+				*shutdownCheck = 0
+				if on {
+					*shutdownCheck = devShutdownCheck
+				}
+			},
+		},
+	}
+}
+
+// applyMode applies the -production or -dev option to the options controlling the
+// development conveniences, returning the warnings to be logged once logging is
+// available
+//
+func applyMode() (warnings []string, err errors.Error) {
+	if *production && *dev {
+		return nil, errors.New("the -production and -dev options cannot be used together").With("stack", stack.Trace().TrimRuntime())
+	}
+	if !*production && !*dev {
+		return nil, nil
+	}
+
+	// Options set on the command line or using the environment are visited
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for _, option := range modeOptions() {
+		switch {
+		case *production:
+			if option.on() {
+				warnings = append(warnings, fmt.Sprintf("the -%s option is turned off by -production", option.name))
+			}
+			option.set(false)
+		case !explicit[option.name]:
+			option.set(true)
+		}
+	}
+	if *production {
+		pprofEnabled = false
+		errorStacks = false
+	}
+	return warnings, nil
+}
+
+// modeName returns the name of the deployment mode for the log
+//
+func modeName() (name string) {
+	switch {
+	case *production:
+		return "production"
+	case *dev:
+		return "dev"
+	}
+	return "default"
+}
+
+// stripStacks removes the stack traces from the text of errors when they are
+// disabled by the deployment mode
+//
+func stripStacks(p []byte) (stripped []byte) {
+	if errorStacks || !bytes.Contains(p, []byte(" stack=")) {
+		return p
+	}
+	return stackTrace.ReplaceAll(p, nil)
+}
+
+// profilingPath reports whether the path is one of the pprof handlers or the
+// endpoint capturing profiles
+//
+func profilingPath(path string) (isProfiling bool) {
+	return strings.HasPrefix(path, "/debug/pprof") || path == "/api/v1/debug/profile"
+}
+
+// modeHandler wraps the HTTP surfaces so that the pprof handlers and the profile
+// capture endpoint are not found and the errors returned do not carry stack traces
+// when the deployment mode disables them
+//
+func modeHandler(handler http.Handler) (wrapped http.Handler) {
+	if pprofEnabled && errorStacks {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pprofEnabled && profilingPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeHTTP(&strippedWriter{ResponseWriter: w}, r)
+	})
+}
+
+// strippedWriter removes the stack traces from the plain text error responses
+// written using http.Error
+//
+type strippedWriter struct {
+	http.ResponseWriter
+	isError bool
+}
+
+func (w *strippedWriter) WriteHeader(status int) {
+	w.isError = status >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *strippedWriter) Write(p []byte) (n int, errGo error) {
+	if !w.isError {
+		return w.ResponseWriter.Write(p)
+	}
+	if _, errGo = w.ResponseWriter.Write(stripStacks(p)); errGo != nil {
+		return 0, errGo
+	}
+	return len(p), nil
+}
+
+// Flush passes flushes through for the streamed responses such as the event stream
+//
+func (w *strippedWriter) Flush() {
+	if flusher, isFlusher := w.ResponseWriter.(http.Flusher); isFlusher {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes the connection through for the preview WebSockets
+//
+func (w *strippedWriter) Hijack() (conn net.Conn, rw *bufio.ReadWriter, errGo error) {
+	hijacker, isHijacker := w.ResponseWriter.(http.Hijacker)
+	if !isHijacker {
+		return nil, nil, fmt.Errorf("the response cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestProductionProfiling checks that the profiling surfaces are not found when
+// the deployment mode disables them, while the rest of the API is still served
+//
+func TestProductionProfiling(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/debug/profile", serveProfiling)
+	mux.HandleFunc("/debug/pprof/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) {})
+
+	defer func(enabled bool, stacks bool) {
+		pprofEnabled, errorStacks = enabled, stacks
+	}(pprofEnabled, errorStacks)
+	pprofEnabled, errorStacks = false, false
+
+	handler := modeHandler(mux)
+
+	for _, path := range []string{"/api/v1/debug/profile", "/debug/pprof/"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s %s returned %d in production mode, expected %d", method, path, w.Code, http.StatusNotFound)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /api/v1/status returned %d in production mode, expected %d", w.Code, http.StatusOK)
+	}
+}
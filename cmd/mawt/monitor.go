@@ -3,24 +3,41 @@ package main
 import (
 	"fmt"
 
-	"github.com/TeamNorCal/mawt/model"
+	"github.com/TeamNorCal/mawt"
 )
 
 // This file implements a monitor that subscribe to and displays
 // the tecthulhu events using event subscription
 
-func runMonitoring(subscribeC chan chan *model.PortalMsg, quitC <-chan struct{}) {
+func runMonitoring(broker *mawt.Broker, quitC <-chan struct{}) {
 
-	statusC := make(chan *model.PortalMsg, 1)
-	defer close(statusC)
-	subscribeC <- statusC
+	sub := broker.Subscribe(mawt.TopicStatus, mawt.SubscribeOptions{Name: "monitor", Depth: 1, Policy: mawt.LatestWins})
+	defer sub.Close()
 
 	for {
 		select {
-		case msg := <-statusC:
+		case msg := <-sub.C:
 			logger.Debug(fmt.Sprintf("%+v", msg))
 		case <-quitC:
 			return
 		}
 	}
 }
+
+// runEventMonitoring logs the events being published by all of the pipelines
+//
+func runEventMonitoring(quitC <-chan struct{}) {
+
+	sub := mawt.SubscribeEvents(mawt.SubscribeOptions{Name: "monitor", Depth: 16})
+	defer sub.Close()
+
+	for {
+		select {
+		case msg := <-sub.C:
+			event := msg.(mawt.Event)
+			logger.Info(fmt.Sprintf("%s %s %s %s", event.Pipeline, event.Kind, event.Portal, event.Detail))
+		case <-quitC:
+			return
+		}
+	}
+}
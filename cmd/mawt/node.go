@@ -0,0 +1,151 @@
+package main
+
+// This file implements the node sub command run on remote render nodes.  The
+// node accepts the frames streamed by a node output and forwards them to its
+// local fadecandy server
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+func runNode(args []string) (exitCode int) {
+
+	flags := flag.NewFlagSet("node", flag.ContinueOnError)
+	listen := flags.String("listen", ":7891", "the address the frames from mawt are received on")
+	server := flags.String("server", "127.0.0.1:7890", "the local fadecandy server frames are forwarded to")
+
+	if errGo := flags.Parse(args); errGo != nil {
+		return -1
+	}
+
+	listener, errGo := net.Listen("tcp", *listen)
+	if errGo != nil {
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+	defer listener.Close()
+
+	// The connection to the fadecandy server outlives the streams, which come and go
+	// as mawt restarts or the wireless link drops
+	relay := &opcRelay{server: *server}
+	defer relay.close()
+
+	for {
+		conn, errGo := listener.Accept()
+		if errGo != nil {
+			fmt.Fprintln(os.Stderr, errGo.Error())
+			return -1
+		}
+		fmt.Fprintln(os.Stderr, "render node stream from", conn.RemoteAddr())
+		forwardNode(conn, relay)
+	}
+}
+
+// forwardNode relays the frames received on a connection to the fadecandy server
+// until the connection fails, only one stream is relayed at a time
+//
+func forwardNode(conn net.Conn, relay *opcRelay) {
+	defer conn.Close()
+
+	dec := &mawt.FrameDecoder{}
+
+	for {
+		msg, err := mawt.ReadFrame(conn)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		if msg == nil {
+			return
+		}
+		record, err := dec.Decode(msg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		relay.send(record.Frame)
+	}
+}
+
+const (
+	relayBackoffBase = 250 * time.Millisecond
+	relayBackoffCap  = 5 * time.Second
+)
+
+// opcRelay keeps a single connection to a fadecandy server for the frames being
+// relayed.  When the server is unavailable frames are dropped while the connection
+// is retried, backing off exponentially between attempts
+//
+type opcRelay struct {
+	server  string
+	conn    net.Conn      // nil while the server is unavailable
+	backoff time.Duration // The wait before the next connection attempt, 0 while connected
+	retryAt time.Time     // When the next connection attempt may be made
+}
+
+// connect connects to the fadecandy server unless an earlier attempt failed too
+// recently, returning true when connected
+//
+func (relay *opcRelay) connect(now time.Time) (connected bool) {
+	if relay.conn != nil {
+		return true
+	}
+	if now.Before(relay.retryAt) {
+		return false
+	}
+
+	addr, err := mawt.ResolveAddr(relay.server, "7890")
+	if err == nil {
+		conn, errGo := net.DialTimeout("tcp", addr, 2*time.Second)
+		if errGo != nil {
+			err = errors.Wrap(errGo).With("server", relay.server).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+		} else {
+			relay.conn, relay.backoff = conn, 0
+			fmt.Fprintln(os.Stderr, "connected to the fadecandy server", addr)
+			return true
+		}
+	}
+
+	if relay.backoff *= 2; relay.backoff == 0 {
+		relay.backoff = relayBackoffBase
+	}
+	if relay.backoff > relayBackoffCap {
+		relay.backoff = relayBackoffCap
+	}
+	relay.retryAt = now.Add(relay.backoff)
+	fmt.Fprintln(os.Stderr, err.With("retry", relay.backoff).Error())
+	return false
+}
+
+func (relay *opcRelay) send(frame []animationModel.ChannelData) {
+	if !relay.connect(time.Now()) {
+		return
+	}
+	for _, channelData := range frame {
+		relay.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, errGo := relay.conn.Write(mawt.PackStrand(channelData).ByteArray()); errGo != nil {
+			fmt.Fprintln(os.Stderr, errGo.Error())
+			relay.close()
+			return
+		}
+	}
+}
+
+// close drops the connection to the fadecandy server, the next frame reconnecting
+//
+func (relay *opcRelay) close() {
+	if relay.conn == nil {
+		return
+	}
+	relay.conn.Close()
+	relay.conn = nil
+}
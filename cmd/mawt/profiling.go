@@ -0,0 +1,76 @@
+package main
+
+// This file implements the triggers for capturing CPU and allocation profiles of
+// a running gateway, the SIGUSR1 signal and the /api/v1/debug/profile endpoint, the
+// profiles being written to the -profile-dir directory
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+// watchProfileSignal captures a profile of the -profile-duration each time the
+// process receives SIGUSR1, until quitC is closed
+//
+func watchProfileSignal(quitC <-chan struct{}) {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigC)
+		for {
+			select {
+			case <-sigC:
+				go func() {
+					logger.Info(fmt.Sprintf("capturing a %s profile on SIGUSR1", *profileDuration))
+					capture, err := mawt.CaptureProfile(*profileDir, *profileDuration, quitC)
+					if err != nil {
+						logger.Warn(fmt.Sprint("profile could not be captured ", err.Error()))
+						return
+					}
+					logger.Info(fmt.Sprintf("profile written to %s and %s", capture.CPU, capture.Allocs))
+				}()
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
+
+// serveProfiling captures a profile on a POST, responding once it has been written.
+// The duration parameter overrides the -profile-duration option
+//
+func serveProfiling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	duration := *profileDuration
+	if param := r.URL.Query().Get("duration"); len(param) != 0 {
+		parsed, errGo := time.ParseDuration(param)
+		if errGo != nil {
+			http.Error(w, errGo.Error(), http.StatusBadRequest)
+			return
+		}
+		duration = parsed
+	}
+	if duration <= 0 {
+		http.Error(w, "the duration must be greater than 0", http.StatusBadRequest)
+		return
+	}
+
+	capture, err := mawt.CaptureProfile(*profileDir, duration, r.Context().Done())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	logger.Info(fmt.Sprintf("profile requested by %s written to %s and %s", r.RemoteAddr, capture.CPU, capture.Allocs))
+	writeJSON(w, capture)
+}
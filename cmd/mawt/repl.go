@@ -0,0 +1,395 @@
+package main
+
+// This file implements the repl sub command, an interactive loop in which effect
+// authors load the effects of the animation package, change their parameters
+// and step through their frames.  Frames are rendered in process and drawn on
+// the terminal, and can also be shown on the sculpture by sending them to the
+// REST API of a running gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt"
+	"github.com/TeamNorCal/mawt/sequencer"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// repl holds the state of an interactive session
+//
+type repl struct {
+	strands  int
+	pixels   int
+	interval time.Duration
+
+	effect string
+	params map[string]string
+
+	runner *sequencer.Runner
+	start  time.Time // The frame time the effect was loaded at
+	now    time.Time // The frame time of the last frame rendered
+
+	gateway  string // The base URL of a running gateway frames are shown on, optional
+	token    string // The bearer token sent to a gateway using authentication
+	pipeline string
+	hold     time.Duration
+
+	out io.Writer
+}
+
+func runREPL(args []string) (exitCode int) {
+
+	flags := flag.NewFlagSet("repl", flag.ContinueOnError)
+	strands := flags.Int("strands", 8, "the number of logical strands rendered")
+	pixels := flags.Int("pixels", 30, "the number of pixels in each logical strand")
+	fps := flags.Int("fps", 30, "the frame rate used when stepping and running effects")
+	gateway := flags.String("gateway", "", "the REST API of a running gateway frames are also shown on, for example http://127.0.0.1:6060")
+	pipeline := flags.String("pipeline", "", "the gateway pipeline frames are shown on, the first pipeline when empty")
+	hold := flags.Duration("hold", 30*time.Second, "the time the gateway shows each frame before returning to the portal animations")
+	token := flags.String("token", os.Getenv("MAWT_TOKEN"), "the bearer token of a gateway using authentication, or a file://, env: or secret: reference to one, defaults to the MAWT_TOKEN environment variable")
+	plugins := flags.String("effect-plugins", "", "an optional directory of compiled Go effect plugins, files ending in .so, added to the built in effects")
+	colors := flags.String("term-colors", "auto", "the way pixels are drawn, truecolor, 256 or ascii, auto detecting the terminal from the environment")
+
+	if errGo := flags.Parse(args); errGo != nil {
+		return -1
+	}
+	mode, err := mawt.ParseColorMode(*colors)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	mawt.SetTerminalColors(mode)
+	if *strands < 1 || *strands > 255 || *pixels < 1 || *fps < 1 {
+		fmt.Fprintln(os.Stderr, "strands must be from 1 to 255, and pixels and fps must be positive")
+		return -1
+	}
+	bearer, err := mawt.ResolveSecret(*token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	if len(*plugins) != 0 {
+		if _, err := mawt.LoadEffectPlugins(*plugins); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return -1
+		}
+	}
+
+	sizes := make([]uint, *strands)
+	for i := range sizes {
+		sizes[i] = uint(*pixels)
+	}
+
+	r := &repl{
+		strands:  *strands,
+		pixels:   *pixels,
+		interval: time.Second / time.Duration(*fps),
+		params:   map[string]string{},
+		runner:   sequencer.NewRunner(sizes),
+		gateway:  strings.TrimSuffix(*gateway, "/"),
+		token:    bearer,
+		pipeline: *pipeline,
+		hold:     *hold,
+		out:      os.Stdout,
+	}
+
+	if len(r.gateway) != 0 && len(r.pipeline) == 0 {
+		if err := r.firstPipeline(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return -1
+		}
+	}
+
+	fmt.Fprintln(r.out, "type help for the commands")
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(r.out, "mawt> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(r.out)
+			return 0
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return 0
+		}
+		if err := r.command(fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(r.out, err.Error())
+		}
+	}
+}
+
+// command runs a single line entered by the author
+//
+func (r *repl) command(cmd string, args []string) (err errors.Error) {
+	switch cmd {
+	case "help":
+		fmt.Fprintln(r.out, "effects                  list the effects and their parameters")
+		fmt.Fprintln(r.out, "load effect [name=value] load an effect onto every strand, loop=true restarts it when it completes")
+		fmt.Fprintln(r.out, "set name=value ...       change parameters of the loaded effect and restart it")
+		fmt.Fprintln(r.out, "params                   show the parameters of the loaded effect")
+		fmt.Fprintln(r.out, "step [frames]            render the next frames, showing the last")
+		fmt.Fprintln(r.out, "run duration             render frames in real time for the duration")
+		fmt.Fprintln(r.out, "reset                    restart the loaded effect")
+		fmt.Fprintln(r.out, "clear                    return the gateway to the portal animations")
+		fmt.Fprintln(r.out, "quit                     leave the repl")
+		return nil
+
+	case "effects":
+		names := make([]string, 0, len(mawt.ShowEffects()))
+		for name := range mawt.ShowEffects() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(r.out, "%-6s %s\n       %s\n", name, mawt.ShowEffects()[name].Help, replParams(mawt.ShowEffects()[name].Defaults))
+		}
+		return nil
+
+	case "load":
+		if len(args) == 0 {
+			return errors.New("load needs an effect name").With("stack", stack.Trace().TrimRuntime())
+		}
+		effect, isPresent := mawt.ShowEffects()[args[0]]
+		if !isPresent {
+			return errors.New("unknown effect, use effects to list them").With("effect", args[0]).With("stack", stack.Trace().TrimRuntime())
+		}
+		params := map[string]string{"loop": "false"}
+		for k, v := range effect.Defaults {
+			params[k] = v
+		}
+		if err = r.load(args[0], params, args[1:]); err != nil {
+			return err
+		}
+		return r.render(1)
+
+	case "set":
+		if len(r.effect) == 0 {
+			return errors.New("no effect has been loaded").With("stack", stack.Trace().TrimRuntime())
+		}
+		params := map[string]string{}
+		for k, v := range r.params {
+			params[k] = v
+		}
+		if err = r.load(r.effect, params, args); err != nil {
+			return err
+		}
+		return r.render(1)
+
+	case "params":
+		if len(r.effect) == 0 {
+			return errors.New("no effect has been loaded").With("stack", stack.Trace().TrimRuntime())
+		}
+		fmt.Fprintln(r.out, r.effect, replParams(r.params))
+		return nil
+
+	case "reset":
+		if len(r.effect) == 0 {
+			return errors.New("no effect has been loaded").With("stack", stack.Trace().TrimRuntime())
+		}
+		if err = r.load(r.effect, r.params, nil); err != nil {
+			return err
+		}
+		return r.render(1)
+
+	case "step":
+		frames := 1
+		if len(args) != 0 {
+			count, errGo := strconv.Atoi(args[0])
+			if errGo != nil || count < 1 {
+				return errors.New("the number of frames must be positive").With("frames", args[0]).With("stack", stack.Trace().TrimRuntime())
+			}
+			frames = count
+		}
+		return r.render(frames)
+
+	case "run":
+		if len(args) == 0 {
+			return errors.New("run needs a duration, for example 5s").With("stack", stack.Trace().TrimRuntime())
+		}
+		duration, errGo := time.ParseDuration(args[0])
+		if errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		tick := time.NewTicker(r.interval)
+		defer tick.Stop()
+		for end := time.Now().Add(duration); time.Now().Before(end); <-tick.C {
+			if err = r.render(1); err != nil {
+				return err
+			}
+			// Frames are redrawn in place rather than scrolling the terminal
+			fmt.Fprintf(r.out, "\x1b[%dA", r.strands+1)
+		}
+		fmt.Fprintf(r.out, "\x1b[%dB", r.strands+1)
+		return nil
+
+	case "clear":
+		return r.show(nil, 0)
+	}
+	return errors.New("unknown command, use help to list them").With("command", cmd).With("stack", stack.Trace().TrimRuntime())
+}
+
+// replParams formats parameters in the form they are entered
+//
+func replParams(params map[string]string) (formatted string) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, name+"="+params[name])
+	}
+	return strings.Join(fields, " ")
+}
+
+// load applies name=value assignments to the parameters and starts the effect on
+// every strand, the frame time continuing from the last frame rendered
+//
+func (r *repl) load(name string, params map[string]string, assignments []string) (err errors.Error) {
+	for _, assignment := range assignments {
+		parts := strings.SplitN(assignment, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("parameters are set using name=value").With("value", assignment).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, isPresent := params[parts[0]]; !isPresent {
+			return errors.New("unknown parameter").With("effect", name).With("param", parts[0]).With("stack", stack.Trace().TrimRuntime())
+		}
+		params[parts[0]] = parts[1]
+	}
+	loop, errGo := strconv.ParseBool(params["loop"])
+	if errGo != nil {
+		return errors.Wrap(errGo).With("param", "loop").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	seq := sequencer.NewSequence()
+	for i := 0; i != r.strands; i++ {
+		effect, err := mawt.ShowEffects()[name].Build(params)
+		if err != nil {
+			return err.With("effect", name)
+		}
+		stepName := fmt.Sprintf("strand %d", i+1)
+		step := &sequencer.Step{UniverseID: uint(i), Effect: effect}
+		if loop {
+			step.ThenDoImmediately(stepName)
+		}
+		seq.AddInitialStep(stepName, step)
+	}
+
+	if r.now.IsZero() {
+		r.now = time.Now()
+	}
+	if err = r.runner.InitSequence(seq, r.now); err != nil {
+		return err
+	}
+	r.effect, r.params, r.start = name, params, r.now
+	return nil
+}
+
+// render advances the effect by a number of frames, drawing the last on the
+// terminal and showing it on the gateway when one is being used
+//
+func (r *repl) render(frames int) (err errors.Error) {
+	done := false
+	for i := 0; i != frames; i++ {
+		r.now = r.now.Add(r.interval)
+		done = r.runner.ProcessFrame(r.now)
+	}
+
+	frame := make([]animationModel.ChannelData, 0, r.strands)
+	for i := 0; i != r.strands; i++ {
+		frame = append(frame, animationModel.ChannelData{
+			ChannelNum: animationModel.OpcChannel(i + 1),
+			Data:       r.runner.UniverseData(uint(i)),
+		})
+	}
+
+	state := ""
+	if done && len(r.effect) != 0 {
+		state = ", completed"
+	}
+	fmt.Fprintf(r.out, "\x1b[2K%s +%v%s\n", r.effect, r.now.Sub(r.start), state)
+	mode := mawt.TerminalColors()
+	for _, channelData := range frame {
+		line := fmt.Sprintf("\x1b[2K%02d %s ", channelData.ChannelNum, mode.Arrow())
+		for _, rgba := range channelData.Data {
+			line += mode.Pixel(rgba)
+		}
+		fmt.Fprintln(r.out, line)
+	}
+
+	return r.show(frame, r.hold)
+}
+
+// firstPipeline selects the first pipeline of the gateway
+//
+func (r *repl) firstPipeline() (err errors.Error) {
+	req, errGo := http.NewRequest(http.MethodGet, r.gateway+"/api/v1/pipelines", nil)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("gateway", r.gateway).With("stack", stack.Trace().TrimRuntime())
+	}
+	resp, errGo := http.DefaultClient.Do(authorize(req, r.token))
+	if errGo != nil {
+		return errors.Wrap(errGo).With("gateway", r.gateway).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	names := []string{}
+	if errGo = json.NewDecoder(resp.Body).Decode(&names); errGo != nil {
+		return errors.Wrap(errGo).With("gateway", r.gateway).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(names) == 0 {
+		return errors.New("the gateway has no pipelines").With("gateway", r.gateway).With("stack", stack.Trace().TrimRuntime())
+	}
+	r.pipeline = names[0]
+	return nil
+}
+
+// show sends a frame to the gateway to be displayed for the hold time, an empty
+// frame returns the gateway to the portal animations
+//
+func (r *repl) show(frame []animationModel.ChannelData, hold time.Duration) (err errors.Error) {
+	if len(r.gateway) == 0 {
+		return nil
+	}
+
+	method := http.MethodPut
+	if len(frame) == 0 {
+		method = http.MethodDelete
+	}
+	body := &bytes.Buffer{}
+	for _, channelData := range frame {
+		body.Write(mawt.PackStrand(channelData).ByteArray())
+	}
+
+	url := fmt.Sprintf("%s/api/v1/pipelines/%s/frame?hold=%v", r.gateway, r.pipeline, hold)
+	req, errGo := http.NewRequest(method, url, body)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	resp, errGo := http.DefaultClient.Do(authorize(req, r.token))
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.New("the gateway did not accept the frame").With("url", url).With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
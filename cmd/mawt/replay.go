@@ -0,0 +1,109 @@
+package main
+
+// This file implements the replay sub command, which plays the frames of a
+// recording made using a record output to a fadecandy server, or prints a
+// summary of the recording, with the original timing between the frames
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+func runReplay(args []string) (exitCode int) {
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	file := flags.String("file", "", "the recording played")
+	server := flags.String("server", "127.0.0.1:7890", "the fadecandy server frames are sent to")
+	universe := flags.Int("universe", -1, "the universe played from recordings of several pipelines, -1 plays all of them")
+	speed := flags.Float64("speed", 1, "the speed of playback, 2 plays twice as fast")
+	loop := flags.Bool("loop", false, "play the recording repeatedly")
+	info := flags.Bool("info", false, "print the universes, frame count and duration of the recording rather than playing it")
+
+	if errGo := flags.Parse(args); errGo != nil {
+		return -1
+	}
+	if len(*file) == 0 || *speed <= 0 {
+		fmt.Fprintln(os.Stderr, "a -file and a positive -speed are needed")
+		return -1
+	}
+
+	relay := &opcRelay{server: *server}
+	for {
+		if errGo := replay(*file, *universe, *speed, *info, relay); errGo != nil {
+			fmt.Fprintln(os.Stderr, errGo.Error())
+			return -1
+		}
+		if !*loop || *info {
+			return 0
+		}
+	}
+}
+
+// replay plays a recording once, keeping the time between frames
+//
+func replay(fn string, universe int, speed float64, info bool, relay *opcRelay) (errGo error) {
+	in, errGo := os.Open(fn)
+	if errGo != nil {
+		return errGo
+	}
+	defer in.Close()
+	reader := bufio.NewReader(in)
+
+	dec := &mawt.FrameDecoder{}
+	counts := map[uint16]int{}
+	first, last := time.Time{}, time.Time{}
+	started := time.Now()
+
+	for {
+		msg, err := mawt.ReadFrame(reader)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			break
+		}
+		record, err := dec.Decode(msg)
+		if err != nil {
+			return err
+		}
+		if universe >= 0 && int(record.Universe) != universe {
+			continue
+		}
+		counts[record.Universe]++
+		if first.IsZero() {
+			first = record.Time
+		}
+		last = record.Time
+		if info {
+			continue
+		}
+
+		if wait := time.Duration(float64(record.Time.Sub(first))/speed) - time.Since(started); wait > 0 {
+			time.Sleep(wait)
+		}
+		relay.send(record.Frame)
+	}
+
+	if info && len(counts) == 0 {
+		fmt.Printf("%s has no frames to play\n", fn)
+		return nil
+	}
+	if info {
+		fmt.Printf("%s recorded from %s for %s\n", fn, first.Format(time.RFC3339), last.Sub(first).Round(time.Millisecond))
+		universes := make([]int, 0, len(counts))
+		for universe := range counts {
+			universes = append(universes, int(universe))
+		}
+		sort.Ints(universes)
+		for _, universe := range universes {
+			fmt.Printf("universe %d, %d frames\n", universe, counts[uint16(universe)])
+		}
+	}
+	return nil
+}
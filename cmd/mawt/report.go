@@ -0,0 +1,151 @@
+package main
+
+// This file implements the report sub command, which reads the records persisted
+// using the -store-dir option and prints an end of event summary as Markdown, to
+// be pasted into an after action review, or as JSON for further processing
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+func runReport(args []string) (exitCode int) {
+
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	dir := flags.String("store-dir", "", "the directory the gateway persisted its records to using the -store-dir option")
+	since := flags.String("since", "", "the start of the report as an RFC3339 time or a duration before now, the first record when not set")
+	until := flags.String("until", "", "the end of the report as an RFC3339 time or a duration before now, now when not set")
+	format := flags.String("format", "markdown", "the format of the report, markdown or json")
+	top := flags.Int("top", 10, "the number of the most frequent errors listed")
+
+	if errGo := flags.Parse(args); errGo != nil {
+		return -1
+	}
+	if len(*dir) == 0 || (*format != "markdown" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "a -store-dir and a -format of markdown or json are needed")
+		return -1
+	}
+	// Opening the store creates the directory, a mistyped directory should not
+	// produce an empty report
+	if info, errGo := os.Stat(*dir); errGo != nil || !info.IsDir() {
+		fmt.Fprintln(os.Stderr, *dir, "is not a store directory")
+		return -1
+	}
+
+	now := time.Now()
+	from, errGo := parseSince(*since, now)
+	if errGo != nil {
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+	to, errGo := parseSince(*until, now)
+	if errGo != nil {
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+
+	// No retention or size limits are given so the gateway remains responsible
+	// for pruning the store
+	store, err := mawt.OpenStore(*dir, 0, 0, mawt.Location())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	records, err := store.Query("", from, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	if to.IsZero() {
+		to = now
+		if len(records) != 0 {
+			to = records[len(records)-1].Time
+		}
+	}
+	if from.IsZero() && len(records) != 0 {
+		from = records[0].Time
+	}
+
+	report := mawt.NewReport(records, from, to, *top)
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if errGo = enc.Encode(report); errGo != nil {
+			fmt.Fprintln(os.Stderr, errGo.Error())
+			return -1
+		}
+		return 0
+	}
+	printReport(os.Stdout, report)
+	return 0
+}
+
+// printReport writes a report as Markdown
+//
+func printReport(w io.Writer, report *mawt.Report) {
+	fmt.Fprintf(w, "# mawt event report\n\n")
+	fmt.Fprintf(w, "%s to %s\n\n", report.From.Format(time.RFC3339), report.Until.Format(time.RFC3339))
+	fmt.Fprintf(w, "| Uptime | Frames rendered | Errors |\n")
+	fmt.Fprintf(w, "|---|---|---|\n")
+	fmt.Fprintf(w, "| %s (%.2f%%) | %d | %d |\n\n", report.Uptime, report.UptimePercent, report.Frames, report.Errors)
+
+	fmt.Fprintf(w, "## Pipelines\n\n")
+	if len(report.Pipelines) == 0 {
+		fmt.Fprintf(w, "No health samples were recorded.\n\n")
+	} else {
+		fmt.Fprintf(w, "| Pipeline | Uptime | Restarts | Frames | OPC availability | OPC drops | Tecthulhu availability | Holds |\n")
+		fmt.Fprintf(w, "|---|---|---|---|---|---|---|---|\n")
+		for _, pipeline := range report.Pipelines {
+			factions := make([]string, 0, len(pipeline.Holds))
+			for faction := range pipeline.Holds {
+				factions = append(factions, faction)
+			}
+			sort.Strings(factions)
+			holds := make([]string, 0, len(factions))
+			for _, faction := range factions {
+				holds = append(holds, faction+" "+pipeline.Holds[faction])
+			}
+			fmt.Fprintf(w, "| %s | %s | %d | %d | %.2f%% | %d | %.2f%% | %s |\n",
+				pipeline.Name, pipeline.Uptime, pipeline.Restarts, pipeline.Frames, pipeline.OPCAvailability,
+				pipeline.OPCDrops, pipeline.PortalAvailability, strings.Join(holds, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "## Top errors\n\n")
+	if len(report.TopErrors) == 0 {
+		fmt.Fprintf(w, "No errors were recorded.\n\n")
+	} else {
+		fmt.Fprintf(w, "| Count | Error | First | Last |\n")
+		fmt.Fprintf(w, "|---|---|---|---|\n")
+		for _, reportErr := range report.TopErrors {
+			fmt.Fprintf(w, "| %d | %s | %s | %s |\n", reportErr.Count, strings.Replace(reportErr.Error, "|", "\\|", -1),
+				reportErr.First.Format("15:04:05"), reportErr.Last.Format("15:04:05"))
+		}
+		fmt.Fprintln(w)
+	}
+
+	kinds := make([]string, 0, len(report.Events))
+	for kind := range report.Events {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Fprintf(w, "## Events\n\n")
+	if len(kinds) == 0 {
+		fmt.Fprintf(w, "No events were recorded.\n")
+		return
+	}
+	fmt.Fprintf(w, "| Event | Count |\n")
+	fmt.Fprintf(w, "|---|---|\n")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "| %s | %d |\n", kind, report.Events[kind])
+	}
+}
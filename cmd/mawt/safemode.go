@@ -0,0 +1,91 @@
+package main
+
+// This file implements the crash guard of the gateway, counting the starts that
+// did not end in a clean shutdown and booting into safe mode once too many have
+// been counted in a row
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+const (
+	// safeModeReminder is the interval at which the log is reminded that the
+	// gateway is running in safe mode
+	safeModeReminder = 5 * time.Minute
+)
+
+var (
+	crashGuard *mawt.CrashGuard // nil when no -crash-state file is used
+)
+
+// startCrashGuard records the start of the gateway in the -crash-state file, a
+// state file that cannot be written being logged rather than stopping the gateway
+//
+func startCrashGuard() {
+	if len(*crashState) == 0 {
+		return
+	}
+	guard, err := mawt.StartCrashGuard(*crashState, *crashLimit)
+	if err != nil {
+		logger.Warn(fmt.Sprint("crashes are not being counted ", err.Error()))
+		return
+	}
+	crashGuard = guard
+
+	state := guard.State()
+	if state.Crashes != 0 {
+		logger.Warn(fmt.Sprintf("the gateway crashed on its last %d starts", state.Crashes))
+	}
+	if state.SafeMode {
+		logger.Error(fmt.Sprintf("SAFE MODE: the gateway crashed %d times in a row, only the static faction color is drawn, no shows, scenes, overlays, mirrors or effect plugins are used and no snapshot is restored.  Fix the configuration and restart the gateway cleanly, or remove %s, to leave safe mode", state.Crashes, *crashState))
+	}
+}
+
+// inSafeMode returns true when the gateway started in safe mode
+//
+func inSafeMode() (safe bool) {
+	return crashGuard != nil && crashGuard.State().SafeMode
+}
+
+// watchCrashGuard clears the crashes once the gateway has run for the -crash-stable
+// time, and keeps reminding the log while the gateway is in safe mode
+//
+func watchCrashGuard(quitC <-chan struct{}) {
+	if crashGuard == nil {
+		return
+	}
+	go func() {
+		stable := time.After(*crashStable)
+		reminder := time.NewTicker(safeModeReminder)
+		defer reminder.Stop()
+
+		for {
+			select {
+			case <-stable:
+				if err := crashGuard.Stable(); err != nil {
+					logger.Warn(err.Error())
+				}
+			case <-reminder.C:
+				if state := crashGuard.State(); state.SafeMode {
+					logger.Error(fmt.Sprintf("SAFE MODE: running in safe mode since %s after %d crashes", state.Started.Format(time.RFC3339), state.Crashes))
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
+
+// stopCrashGuard records a clean shutdown of the gateway
+//
+func stopCrashGuard() {
+	if crashGuard == nil {
+		return
+	}
+	if err := crashGuard.Stopped(); err != nil {
+		logger.Warn(err.Error())
+	}
+}
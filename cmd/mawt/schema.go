@@ -0,0 +1,86 @@
+package main
+
+// This file implements the config sub command.  config schema prints the JSON
+// Schema of the configuration format, for YAML editors to complete and check
+// configuration files as they are written, and config validate checks a file
+// against it, printing the line and column of each problem, without running the
+// gateway
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+func runConfig(args []string) (exitCode int) {
+
+	if len(args) == 0 || (args[0] != "schema" && args[0] != "validate") {
+		fmt.Fprintln(os.Stderr, "usage: config schema|validate [options]")
+		return -1
+	}
+
+	flags := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	file := flags.String("file", "mawt.yaml", "the configuration file validated")
+	plugins := flags.String("effect-plugins", "", "an optional directory of compiled Go effect plugins, files ending in .so, whose effects are added to those a show can name")
+
+	if errGo := flags.Parse(args[1:]); errGo != nil {
+		return -1
+	}
+	if len(*plugins) != 0 {
+		if _, err := mawt.LoadEffectPlugins(*plugins); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return -1
+		}
+	}
+
+	if args[0] == "schema" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if errGo := enc.Encode(mawt.ConfigSchema()); errGo != nil {
+			fmt.Fprintln(os.Stderr, errGo.Error())
+			return -1
+		}
+		return 0
+	}
+
+	data, errGo := ioutil.ReadFile(*file)
+	if errGo != nil {
+		fmt.Fprintln(os.Stderr, errGo.Error())
+		return -1
+	}
+	violations, err := mawt.ValidateSchema(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *file+":", err.Error())
+		return -1
+	}
+	for _, violation := range violations {
+		message := violation.Message
+		if len(violation.Path) != 0 {
+			message = violation.Path + ": " + message
+		}
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", *file, violation.Line, violation.Column, message)
+	}
+	if len(violations) != 0 {
+		return -1
+	}
+	// Values the schema cannot describe, such as ranges and references between
+	// sections, are checked by loading the file
+	if _, err = mawt.ValidateConfig(data, *file); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	fmt.Println(*file, "is valid")
+	return 0
+}
+
+// serveConfigSchema returns the JSON Schema of the configuration format, including
+// the effects of the plugins loaded by the gateway, for editors to fetch
+//
+func serveConfigSchema(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, mawt.ConfigSchema())
+}
@@ -0,0 +1,182 @@
+package main
+
+// This file implements the self-test run as mawt starts.  The configuration,
+// the connection to each fadecandy server, a first status from each tecthulhu
+// and the rendering of a frame by each pipeline are checked and summarized in a
+// PASS/FAIL table, the -selftest option exiting once the table is printed so
+// that deployment scripts can use the exit code
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+const (
+	selfTestTimeout = 5 * time.Second
+)
+
+// selfTestResult is the outcome of a single check
+//
+type selfTestResult struct {
+	Check   string
+	Target  string
+	Passed  bool
+	Detail  string
+	Elapsed time.Duration
+}
+
+// selfTestPortal is a tecthulhu polled by a pipeline
+//
+type selfTestPortal struct {
+	pipeline  string
+	url       url.URL
+	transform *mawt.TransformConfig
+}
+
+// runSelfTest performs the checks of the running pipelines concurrently, the results
+// are returned in a fixed order
+//
+func runSelfTest(config string, pipelines []mawt.PipelineConfig, portals []selfTestPortal, gws []*mawt.Gateway) (results []selfTestResult) {
+	results = []selfTestResult{{
+		Check:  "config",
+		Target: config,
+		Passed: true,
+		Detail: fmt.Sprintf("%d pipelines", len(pipelines)),
+	}}
+
+	checks := []func() selfTestResult{}
+	for _, pipeline := range pipelines {
+		pipeline := pipeline
+		checks = append(checks, func() (result selfTestResult) {
+			result = selfTestResult{Check: "opc", Target: pipeline.Name + " " + pipeline.Server}
+			if pipeline.Server == "/dev/null" {
+				result.Passed, result.Detail = true, "no fadecandy server is used"
+				return result
+			}
+			addr, err := mawt.ProbeOPC(pipeline.Server, selfTestTimeout)
+			if err != nil {
+				result.Detail = err.Error()
+				return result
+			}
+			result.Passed, result.Detail = true, "connected to "+addr
+			return result
+		})
+	}
+	for _, portal := range portals {
+		portal := portal
+		checks = append(checks, func() (result selfTestResult) {
+			result = selfTestResult{Check: "tecthulhu", Target: portal.pipeline + " " + portal.url.String()}
+			ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+			defer cancel()
+			title, err := mawt.ProbeTecthulhu(ctx, portal.url, portal.transform)
+			if err != nil {
+				result.Detail = err.Error()
+				return result
+			}
+			result.Passed, result.Detail = true, fmt.Sprintf("portal %q", title)
+			return result
+		})
+	}
+	for _, gw := range gws {
+		gw := gw
+		checks = append(checks, func() (result selfTestResult) {
+			result = selfTestResult{Check: "render", Target: gw.Name}
+			frame, err := gw.Frame(selfTestTimeout)
+			if err != nil {
+				result.Detail = err.Error()
+				return result
+			}
+			pixels := 0
+			for _, channelData := range frame {
+				pixels += len(channelData.Data)
+			}
+			if pixels == 0 {
+				result.Detail = "the frame has no pixels"
+				return result
+			}
+			result.Passed, result.Detail = true, fmt.Sprintf("%d strands of %d pixels", len(frame), pixels)
+			return result
+		})
+	}
+
+	checked := make([]selfTestResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func() selfTestResult) {
+			defer wg.Done()
+			start := time.Now()
+			checked[i] = check()
+			checked[i].Elapsed = time.Since(start)
+		}(i, check)
+	}
+	wg.Wait()
+
+	return append(results, checked...)
+}
+
+// printSelfTest writes the results as a table followed by a summary, returning
+// whether every check passed
+//
+func printSelfTest(w io.Writer, results []selfTestResult) (passed bool) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "CHECK\tTARGET\tRESULT\tTIME\tDETAIL")
+	failed := 0
+	for _, result := range results {
+		outcome := "PASS"
+		if !result.Passed {
+			outcome = "FAIL"
+			failed++
+		}
+		detail := strings.Replace(result.Detail, "\n", " ", -1)
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", result.Check, result.Target, outcome, result.Elapsed.Round(time.Millisecond), detail)
+	}
+	table.Flush()
+
+	if failed != 0 {
+		fmt.Fprintf(w, "self-test FAILED, %d of %d checks failed\n", failed, len(results))
+		return false
+	}
+	fmt.Fprintf(w, "self-test PASSED, %d checks\n", len(results))
+	return true
+}
+
+// buttonSelfTest runs the self-test when asked for using a button, flashing the
+// sculpture green when every check passed and red otherwise, as there may be no
+// computer attached to show the table
+//
+func buttonSelfTest(msgC chan<- string, config string, pipelines []mawt.PipelineConfig, portals []selfTestPortal, gws []*mawt.Gateway) {
+	out := &bytes.Buffer{}
+	cue := mawt.Cue{Color: color.RGBA{G: 0xFF, A: 0xFF}, Duration: 2 * time.Second, Level: 1}
+	if !printSelfTest(out, runSelfTest(config, pipelines, portals, gws)) {
+		logger.Warn(out.String())
+		cue.Color = color.RGBA{R: 0xFF, A: 0xFF}
+	}
+	for _, gw := range gws {
+		gw.Trigger(cue)
+	}
+	msgC <- out.String()
+}
+
+// reportSelfTest runs the self-test in the background of a normal launch, printing
+// the table using the message channel and logging it when a check fails
+//
+func reportSelfTest(msgC chan<- string, config string, pipelines []mawt.PipelineConfig, portals []selfTestPortal, gws []*mawt.Gateway) {
+	go func() {
+		out := &bytes.Buffer{}
+		if !printSelfTest(out, runSelfTest(config, pipelines, portals, gws)) {
+			logger.Warn(out.String())
+		}
+		msgC <- out.String()
+	}()
+}
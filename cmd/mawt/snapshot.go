@@ -0,0 +1,95 @@
+package main
+
+// This file implements the restoring of the renderer state of the pipelines on
+// startup and the /api/v1/snapshot endpoint used to take and restore snapshots
+// on demand, for example before and after a planned restart mid ceremony
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/karlmutch/errors"
+)
+
+// startSnapshots restores the pipelines from the last snapshot and then keeps the
+// snapshot up to date.  A snapshot that cannot be read or restored is logged rather
+// than stopping the startup, the pipelines starting afresh, as is a snapshot older
+// than the maximum age
+//
+func startSnapshots(fn string, gws []*mawt.Gateway, interval time.Duration, maxAge time.Duration, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	snap, err := mawt.LoadSnapshot(fn)
+	if err != nil {
+		logger.Warn(fmt.Sprint("snapshot could not be loaded ", err.Error()))
+	}
+	if snap != nil && maxAge > 0 && time.Since(snap.Time) > maxAge {
+		logger.Info(fmt.Sprintf("the snapshot taken at %s is older than %s and was not restored", snap.Time.Format(time.RFC3339), maxAge))
+		snap = nil
+	}
+	if snap != nil {
+		logger.Info(fmt.Sprintf("restoring the snapshot taken at %s", snap.Time.Format(time.RFC3339)))
+		for _, err := range mawt.RestoreSnapshot(snap, gws) {
+			logger.Warn(fmt.Sprint("snapshot could not be fully restored ", err.Error()))
+		}
+	}
+	if interval > 0 {
+		mawt.KeepSnapshots(fn, gws, interval, errorC, quitC)
+	}
+}
+
+// snapshotReport is the result of saving or restoring a snapshot
+//
+type snapshotReport struct {
+	File     string         `json:"file"`
+	Saved    bool           `json:"saved"`
+	Restored bool           `json:"restored"`
+	Snapshot *mawt.Snapshot `json:"snapshot,omitempty"`
+	Errors   []string       `json:"errors,omitempty"`
+}
+
+// serveSnapshot returns a snapshot of the pipelines on a GET.  A POST saves a snapshot
+// to the snapshot file, or restores the pipelines from it when the restore parameter
+// is true
+//
+func serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, mawt.TakeSnapshot(pipelines))
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(*snapshotFile) == 0 {
+		http.Error(w, "mawt was started without a snapshot file", http.StatusNotFound)
+		return
+	}
+	report := &snapshotReport{File: *snapshotFile}
+	if r.URL.Query().Get("restore") == "true" {
+		snap, err := mawt.LoadSnapshot(*snapshotFile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if snap == nil {
+			http.Error(w, "no snapshot has been saved", http.StatusNotFound)
+			return
+		}
+		for _, err := range mawt.RestoreSnapshot(snap, pipelines) {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		report.Restored, report.Snapshot = true, snap
+		apiLogger.Info("snapshot restored by " + r.RemoteAddr)
+	} else {
+		report.Snapshot = mawt.TakeSnapshot(pipelines)
+		if err := mawt.SaveSnapshot(*snapshotFile, report.Snapshot); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		report.Saved = true
+	}
+	writeJSON(w, report)
+}
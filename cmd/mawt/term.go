@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/TeamNorCal/mawt"
 	"github.com/karlmutch/errors"
 )
 
@@ -52,8 +53,9 @@ func msgWatch(msgsC <-chan string, errorC <-chan errors.Error, quitC <-chan stru
 				fmt.Fprint(msgV, msg)
 			}
 		case err := <-errorC:
+			mawt.PublishError(err)
 			if msgV != nil {
-				fmt.Fprint(msgV, err.Error())
+				msgV.Write(stripStacks([]byte(err.Error())))
 			}
 		case <-quitC:
 			return
@@ -0,0 +1,161 @@
+package mawt
+
+// This module contains the 16 bit per channel color representation used by the
+// effects applied to frames after the animations, such as cues and the master
+// brightness.  Scaling 8 bit colors loses most of the levels of a dim color so
+// slow fades step visibly, working in 16 bits and then dithering the result back
+// to 8 bits as the frame is output keeps the average intensity of each pixel
+// over a few frames close to the 16 bit value.  Outputs able to use more than 8
+// bits can be given the 16 bit frames in the future
+
+import (
+	"image/color"
+	"sync"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ChannelData16 is a strand of 16 bit per channel pixels, the colors are
+// premultiplied as for the 8 bit strands
+//
+type ChannelData16 struct {
+	ChannelNum animationModel.OpcChannel
+	Data       []color.RGBA64
+}
+
+// Widen converts a frame to 16 bits per channel, fully transparent pixels become black
+//
+func Widen(frame []animationModel.ChannelData) (wide []ChannelData16) {
+	return WidenInto(nil, frame)
+}
+
+// WidenInto converts a frame to 16 bits per channel filling the strands of the wide
+// frame supplied, which are reused from frame to frame and grown when too small
+//
+func WidenInto(wide []ChannelData16, frame []animationModel.ChannelData) (widened []ChannelData16) {
+	if cap(wide) < len(frame) {
+		widened = make([]ChannelData16, len(frame))
+		copy(widened, wide)
+	} else {
+		widened = wide[:len(frame)]
+	}
+	for i, channelData := range frame {
+		data := widened[i].Data
+		if cap(data) < len(channelData.Data) {
+			if cap(data) != 0 {
+				putPixels16(data)
+			}
+			data = getPixels16(len(channelData.Data))
+		}
+		data = data[:len(channelData.Data)]
+		for j, pixel := range channelData.Data {
+			if pixel.A == 0 {
+				data[j] = color.RGBA64{}
+				continue
+			}
+			data[j] = color.RGBA64{
+				R: uint16(pixel.R) * 0x101,
+				G: uint16(pixel.G) * 0x101,
+				B: uint16(pixel.B) * 0x101,
+				A: uint16(pixel.A) * 0x101,
+			}
+		}
+		widened[i] = ChannelData16{ChannelNum: channelData.ChannelNum, Data: data}
+	}
+	return widened
+}
+
+// validNarrowing checks the method used to reduce frames to 8 bits, an empty method
+// is dithering
+//
+func validNarrowing(narrowing string) (err errors.Error) {
+	switch narrowing {
+	case "", "dither", "round", "truncate":
+		return nil
+	}
+	return errors.New("unknown narrowing, dither, round and truncate are supported").With("narrowing", narrowing).With("stack", stack.Trace().TrimRuntime())
+}
+
+// Narrower reduces 16 bit frames to 8 bits.  Dithering carries the part of each
+// value that could not be output forward to the same pixel in the next frame
+//
+type Narrower struct {
+	carry map[animationModel.OpcChannel][]uint16 // The residue of each component of each pixel, by strand
+	sync.Mutex
+}
+
+// NewNarrower creates a narrower with no residue carried from previous frames
+//
+func NewNarrower() (narrower *Narrower) {
+	return &Narrower{carry: map[animationModel.OpcChannel][]uint16{}}
+}
+
+// Narrow reduces a frame to 8 bits per channel using the dither, round or truncate
+// method
+//
+func (narrower *Narrower) Narrow(wide []ChannelData16, narrowing string) (frame []animationModel.ChannelData) {
+	return narrower.NarrowInto(nil, wide, narrowing)
+}
+
+// NarrowInto reduces a frame to 8 bits per channel filling the strands of the frame
+// supplied, which are reused from frame to frame and grown when too small
+//
+func (narrower *Narrower) NarrowInto(frame []animationModel.ChannelData, wide []ChannelData16, narrowing string) (narrowed []animationModel.ChannelData) {
+	narrower.Lock()
+	defer narrower.Unlock()
+
+	narrowed = resizeFrame(frame, len(wide))
+	for k, channelData := range wide {
+		data := resizeStrand(narrowed[k].Data, len(channelData.Data))
+
+		var carry []uint16
+		if narrowing == "" || narrowing == "dither" {
+			carry = narrower.carry[channelData.ChannelNum]
+			if len(carry) != len(data)*3 {
+				carry = make([]uint16, len(data)*3)
+				narrower.carry[channelData.ChannelNum] = carry
+			}
+		}
+
+		// reduce narrows a single component, the residue is always less than a
+		// single 8 bit level
+		reduce := func(value uint16, residue *uint16) uint8 {
+			switch {
+			case residue != nil:
+				total := uint32(value) + uint32(*residue)
+				level := total / 0x101
+				if level > 0xFF {
+					level = 0xFF
+				}
+				*residue = uint16(total - level*0x101)
+				return uint8(level)
+			case narrowing == "round":
+				return uint8((uint32(value) + 0x80) / 0x101)
+			}
+			return uint8(value / 0x101)
+		}
+
+		for i, pixel := range channelData.Data {
+			var residues [3]*uint16
+			if carry != nil {
+				residues = [3]*uint16{&carry[i*3], &carry[i*3+1], &carry[i*3+2]}
+			}
+			data[i] = color.RGBA{
+				R: reduce(pixel.R, residues[0]),
+				G: reduce(pixel.G, residues[1]),
+				B: reduce(pixel.B, residues[2]),
+				A: uint8(pixel.A >> 8),
+			}
+			// The components of a premultiplied color cannot exceed its alpha
+			for _, component := range []*uint8{&data[i].R, &data[i].G, &data[i].B} {
+				if *component > data[i].A {
+					*component = data[i].A
+				}
+			}
+		}
+		narrowed[k] = animationModel.ChannelData{ChannelNum: channelData.ChannelNum, Data: data}
+	}
+	return narrowed
+}
@@ -0,0 +1,500 @@
+package mawt
+
+// This module contains the optional YAML configuration file that can be used to
+// tune the behavior of the gateway beyond what the command line options offer
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/go-yaml/yaml"
+	"github.com/karlmutch/errors"
+)
+
+// PollPolicy controls how tecthulhus are polled and how failures to reach them
+// are retried
+//
+type PollPolicy struct {
+	Interval    time.Duration `yaml:"interval"`    // Time between regular status checks
+	MaxRetries  int           `yaml:"maxRetries"`  // Retries attempted within a single status check
+	BackoffBase time.Duration `yaml:"backoffBase"` // Delay before the first retry, doubled for each retry after that
+	BackoffCap  time.Duration `yaml:"backoffCap"`  // Maximum delay between retries
+
+	BreakerThreshold int           `yaml:"breakerThreshold"` // Consecutive failed status checks that open the circuit breaker, 0 disables the breaker
+	BreakerCooldown  time.Duration `yaml:"breakerCooldown"`  // Time the circuit stays open before a single trial status check is made
+
+	QuarantineRelease int `yaml:"quarantineRelease"` // Consecutive believable statuses needed to release a quarantined portal, 0 disables quarantine
+
+	MinInterval time.Duration `yaml:"minInterval"` // Shortest time between status checks while the portal is changing rapidly, adaptive polling is disabled when 0
+	MaxInterval time.Duration `yaml:"maxInterval"` // Longest time between status checks while the portal is quiet, defaults to the interval
+
+	Concurrency int           `yaml:"concurrency"` // Status requests in flight across every pipeline, 0 leaves them uncapped
+	Stagger     time.Duration `yaml:"stagger"`     // Delay between the first checks of successive portals, spreading the checks over the interval
+
+	HTTP PollHTTP `yaml:"http"` // Tuning of the HTTP client used for the status requests
+}
+
+// adapt returns the interval before the next status check given the current interval
+// and whether the last status showed the portal changing.  Changes halve the interval
+// and quiet checks lengthen it by a quarter, within the bounds of the policy
+//
+func (policy PollPolicy) adapt(interval time.Duration, changed bool) (next time.Duration) {
+	if policy.MinInterval <= 0 {
+		return policy.Interval
+	}
+	max := policy.MaxInterval
+	if max < policy.Interval {
+		max = policy.Interval
+	}
+
+	next = interval + interval/4
+	if changed {
+		next = interval / 2
+	}
+	if next < policy.MinInterval {
+		next = policy.MinInterval
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// PipelineConfig defines an independent pipeline, with its own tecthulhus and
+// fadecandy server, that is run alongside any others in the same process
+//
+type PipelineConfig struct {
+	Name         string   `yaml:"name"`
+	Server       string   `yaml:"server"`       // The fadecandy server, or /dev/null
+	Tecthulhus   []string `yaml:"tecthulhus"`   // The tecthulhu URLs, the first being the 'home' portal
+	HistoryDepth int      `yaml:"historyDepth"` // Optional, defaults to the -history-depth option
+	Audio        bool     `yaml:"audio"`        // Sound effects can only be enabled for one pipeline
+
+	Strands   []StrandMapping  `yaml:"strands"`   // Optional, overrides the top level strand mappings for this pipeline
+	Phases    []PhaseConfig    `yaml:"phases"`    // Optional, overrides the top level phase offsets for this pipeline
+	Firmware  *FirmwareConfig  `yaml:"firmware"`  // Optional, overrides the top level fadecandy firmware settings for this pipeline
+	Status    *StatusConfig    `yaml:"status"`    // Optional, overrides the top level status pixel for this pipeline
+	Canary    *CanaryConfig    `yaml:"canary"`    // Optional, overrides the top level canary strand for this pipeline
+	Standby   []StandbyConfig  `yaml:"standby"`   // Optional, overrides the top level standby colors for this pipeline
+	Transform *TransformConfig `yaml:"transform"` // Optional, overrides the top level status translation for this pipeline
+	Timeline  *TimelineConfig  `yaml:"timeline"`  // Optional, overrides the top level ownership timeline for this pipeline
+	Score     *ScoreConfig     `yaml:"score"`     // Optional, overrides the top level score bar for this pipeline
+	Ticker    *TickerConfig    `yaml:"ticker"`    // Optional, overrides the top level ticker for this pipeline
+	Outputs   []OutputConfig   `yaml:"outputs"`   // Optional, overrides the top level output mirrors for this pipeline
+	Guard     *GuardConfig     `yaml:"guard"`     // Optional, overrides the top level output guard for this pipeline
+
+	Arbitration *ArbitrationConfig `yaml:"arbitration"` // Optional, overrides the top level display arbitration for this pipeline
+	OPCInput    *OPCInputConfig    `yaml:"opcInput"`    // Optional listener for OPC clients composited with this pipeline
+}
+
+// Profile is a named quality mode that trades the smoothness of the LED output
+// against the CPU and power used to produce it
+//
+type Profile struct {
+	FPS           float64 `yaml:"fps" json:"fps"`                     // Frames rendered and sent to the fadecandy server each second
+	Dithering     bool    `yaml:"dithering" json:"dithering"`         // Temporal dithering performed by the fadecandy firmware
+	Interpolation bool    `yaml:"interpolation" json:"interpolation"` // Keyframe interpolation performed by the fadecandy firmware
+	Narrowing     string  `yaml:"narrowing" json:"narrowing"`         // How 16 bit colors are reduced to 8 bits, dither, round or truncate, dither when empty
+}
+
+// Interval returns the time between frames for the profile
+//
+func (profile Profile) Interval() (interval time.Duration) {
+	return time.Duration(float64(time.Second) / profile.FPS)
+}
+
+// Config is the contents of the YAML configuration file
+//
+type Config struct {
+	Polling   PollPolicy         `yaml:"polling"`
+	Profiles  map[string]Profile `yaml:"profiles"`  // Quality profiles that can be switched between at runtime
+	Profile   string             `yaml:"profile"`   // The profile used on startup
+	Strands   []StrandMapping    `yaml:"strands"`   // Mapping of logical strands onto the physical strands
+	Phases    []PhaseConfig      `yaml:"phases"`    // Delays to the sends of devices sharing a power supply, staggering their refreshes
+	Firmware  *FirmwareConfig    `yaml:"firmware"`  // Optional fadecandy status LED and color correction settings
+	Status    *StatusConfig      `yaml:"status"`    // Optional status pixel and LED showing the health of the gateway
+	Canary    *CanaryConfig      `yaml:"canary"`    // Optional strand always running a known pattern, showing the renderer and output are alive
+	Standby   []StandbyConfig    `yaml:"standby"`   // Optional colors of the strands as the pipelines start and stop, and while connecting
+	Transform *TransformConfig   `yaml:"transform"` // Optional translation of the raw tecthulhu status documents before they are decoded
+	Timeline  *TimelineConfig    `yaml:"timeline"`  // Optional strand used to display the ownership timeline
+	Score     *ScoreConfig       `yaml:"score"`     // Optional strand used to display the scores of a cell or anomaly series
+	Ticker    *TickerConfig      `yaml:"ticker"`    // Optional LED matrix panel scrolling messages about the displayed portal
+	Palette   string             `yaml:"palette"`   // The faction colors, standard, deuteranopia, protanopia or tritanopia
+	Outputs   []OutputConfig     `yaml:"outputs"`   // Additional outputs the frames are mirrored to
+	Pipelines []PipelineConfig   `yaml:"pipelines"` // When empty a single pipeline is defined using the command line options
+	Console   *ConsoleConfig     `yaml:"console"`   // Optional MIDI controller used as a lighting console for all pipelines
+	Buttons   []ButtonConfig     `yaml:"buttons"`   // Optional GPIO buttons operating all pipelines without a computer attached
+	Scenes    []SceneConfig      `yaml:"scenes"`    // Optional named scenes that can be shown in place of the animations of every pipeline
+	Auth      *AuthConfig        `yaml:"auth"`      // Optional authentication of the REST API, WebSockets, configuration editor and metrics
+	Web       *WebConfig         `yaml:"web"`       // Optional base path, trusted reverse proxies and cross origin access of the HTTP surfaces
+
+	Arbitration ArbitrationConfig `yaml:"arbitration"` // Decides which portal is displayed when a pipeline has several, the home portal by default
+	Heartbeat   HeartbeatConfig   `yaml:"heartbeat"`   // The pulse shown while the displayed portal is steady
+	Decay       *DecayConfig      `yaml:"decay"`       // Optional countdown dimming the portal as it nears going neutral
+	Recharge    RechargeConfig    `yaml:"recharge"`    // The ripple played on the strand of a resonator that is recharged
+	Stingers    []StingerConfig   `yaml:"stingers"`    // Optional flashes played as the displayed portal reports game audio cues
+	Show        *ShowConfig       `yaml:"show"`        // Optional headless show played on loop, no tecthulhus are polled when present
+	OPCInput    *OPCInputConfig   `yaml:"opcInput"`    // Optional listener for OPC clients composited with the first pipeline
+	Ambient     *AmbientConfig    `yaml:"ambient"`     // Optional light sensor scaling the brightness of every pipeline
+	Thermal     *ThermalConfig    `yaml:"thermal"`     // Optional temperature sensor derating the brightness and frame rate of every pipeline
+	Guard       *GuardConfig      `yaml:"guard"`       // Optional check clamping the pixels and acting on frames too bright for the power supplies
+
+	EffectBudget    time.Duration `yaml:"effectBudget"`    // Computation time allowed for each effect in a frame, 0 disables warnings
+	SendWorkers     int           `yaml:"sendWorkers"`     // The fadecandy devices whose strands are packed and sent at the same time, 1 sends strands in turn
+	BufferBudgetMB  int           `yaml:"bufferBudgetMB"`  // The megabytes of pixel buffers kept for reuse between frames, 0 disables pooling
+	ChangeDetection string        `yaml:"changeDetection"` // How changes to the home portal status are detected, fnv, md5, generation or fields
+
+	Seed  int64            `yaml:"seed"`  // The seed of the effects using random numbers, 0 seeds them from the time
+	Seeds map[string]int64 `yaml:"seeds"` // Seeds for individual effects, such as decay, overriding the global seed
+}
+
+// DefaultConfig returns the configuration used when no file is supplied, or for
+// any values that the file leaves out
+//
+func DefaultConfig() (cfg *Config) {
+	return &Config{
+		Polling: PollPolicy{
+			Interval:         5 * time.Second,
+			MaxRetries:       2,
+			BackoffBase:      250 * time.Millisecond,
+			BackoffCap:       2 * time.Second,
+			BreakerThreshold: 5,
+			BreakerCooldown:  30 * time.Second,
+
+			QuarantineRelease: 3,
+
+			Concurrency: 8,
+			Stagger:     100 * time.Millisecond,
+
+			HTTP: PollHTTP{
+				Timeout:         10 * time.Second,
+				DialTimeout:     5 * time.Second,
+				KeepAlive:       30 * time.Second,
+				IdleConnTimeout: 90 * time.Second,
+			},
+		},
+		Profiles: map[string]Profile{
+			"performance": {FPS: 33, Dithering: true, Interpolation: true},
+			"battery":     {FPS: 10, Dithering: false, Interpolation: true},
+		},
+		Profile:         "performance",
+		EffectBudget:    defaultEffectBudget,
+		SendWorkers:     DefaultSendWorkers,
+		BufferBudgetMB:  DefaultBufferBudget >> 20,
+		ChangeDetection: "fnv",
+	}
+}
+
+// LoadConfig reads the YAML configuration file, or a copy of it held on a web
+// server or S3, values that are not present retain their defaults
+//
+func LoadConfig(fn string) (cfg *Config, err errors.Error) {
+	cfg, _, err = NewConfigSource(fn).Load()
+	return cfg, err
+}
+
+// parseConfig decodes and validates the contents of a configuration file
+//
+func parseConfig(data []byte, fn string) (cfg *Config, err errors.Error) {
+	cfg = DefaultConfig()
+
+	if errGo := yaml.Unmarshal(data, cfg); errGo != nil {
+		return cfg, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if cfg.Polling.Interval <= 0 {
+		return cfg, errors.New("polling interval must be positive").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if cfg.Polling.MinInterval < 0 || (cfg.Polling.MinInterval > 0 && cfg.Polling.MinInterval > cfg.Polling.Interval) {
+		return cfg, errors.New("the polling minInterval cannot be negative or longer than the interval").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if cfg.Polling.MaxRetries < 0 || cfg.Polling.BreakerThreshold < 0 || cfg.Polling.QuarantineRelease < 0 {
+		return cfg, errors.New("polling retries, breaker threshold and quarantine release cannot be negative").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if cfg.Polling.Concurrency < 0 || cfg.Polling.Stagger < 0 {
+		return cfg, errors.New("polling concurrency and stagger cannot be negative").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, err = NewPollClient(cfg.Polling.HTTP); err != nil {
+		return cfg, err.With("file", fn)
+	}
+
+	if _, err = NewOutputs(cfg.Outputs); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if _, err = GetPalette(cfg.Palette); err != nil {
+		return cfg, err.With("file", fn)
+	}
+
+	if _, err = NewArbiter(cfg.Arbitration); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if _, err = NewHeartbeat(cfg.Heartbeat); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if cfg.Decay != nil {
+		if _, err = NewDecay(*cfg.Decay); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if _, err = NewRecharge(cfg.Recharge); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if _, err = NewStingers(cfg.Stingers); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if cfg.Show != nil {
+		if _, err = NewShowPlayer(*cfg.Show); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.OPCInput != nil {
+		if _, err = checkOPCInput(*cfg.OPCInput); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.Ambient != nil {
+		if _, err = NewAmbient(*cfg.Ambient); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.Thermal != nil {
+		if _, err = NewThermal(*cfg.Thermal); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.Console != nil {
+		if _, err = NewConsole(*cfg.Console); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if _, err = NewButtons(cfg.Buttons); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	scenes, err := NewScenes(cfg.Scenes)
+	if err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if cfg.Console != nil {
+		for _, mapping := range cfg.Console.Mappings {
+			if mapping.Action == "scene" {
+				if err = scenes.Check(mapping.Scene); err != nil {
+					return cfg, err.With("note", mapping.Number).With("file", fn)
+				}
+			}
+		}
+	}
+	for _, button := range cfg.Buttons {
+		if button.Action == "scene" {
+			if err = scenes.Check(button.Scene); err != nil {
+				return cfg, err.With("gpio", button.GPIO).With("file", fn)
+			}
+		}
+	}
+
+	if _, err = NewChangeDetector(cfg.ChangeDetection); err != nil {
+		return cfg, err.With("file", fn)
+	}
+
+	if cfg.EffectBudget < 0 {
+		return cfg, errors.New("the effect budget cannot be negative").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err = checkSendWorkers(cfg.SendWorkers); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if cfg.BufferBudgetMB < 0 {
+		return cfg, errors.New("the buffer budget cannot be negative").With("bufferBudgetMB", cfg.BufferBudgetMB).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for name, profile := range cfg.Profiles {
+		if profile.FPS <= 0 || profile.FPS > 400 {
+			return cfg, errors.New("profile fps must be greater than 0 and no more than 400").With("profile", name).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if err = validNarrowing(profile.Narrowing); err != nil {
+			return cfg, err.With("profile", name).With("file", fn)
+		}
+	}
+	if _, isPresent := cfg.Profiles[cfg.Profile]; !isPresent {
+		return cfg, errors.New("the startup profile is not defined").With("profile", cfg.Profile).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if _, err = NewStrandMap(cfg.Strands); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if _, err = NewPhases(cfg.Phases); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if cfg.Firmware != nil {
+		if _, err = NewFirmware(*cfg.Firmware); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.Status != nil {
+		if _, err = NewStatus(*cfg.Status); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.Canary != nil {
+		if _, err = NewCanary(*cfg.Canary); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if _, err = NewStandby(cfg.Standby); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if cfg.Transform != nil {
+		if _, err = NewTransform(*cfg.Transform); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.Guard != nil {
+		if _, err = NewGuard(*cfg.Guard); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	// References to files, environment variables and secrets are resolved before
+	// the values they hold are validated
+	if err = resolveSecrets(cfg); err != nil {
+		return cfg, err.With("file", fn)
+	}
+	if cfg.Auth != nil {
+		if _, err = NewAuth(*cfg.Auth); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+	if cfg.Web != nil {
+		if _, err = NewWeb(*cfg.Web); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+
+	if cfg.Timeline != nil {
+		if _, err = NewTimeline(*cfg.Timeline); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+
+	if cfg.Score != nil {
+		if _, err = NewScore(*cfg.Score); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+
+	if cfg.Ticker != nil {
+		if _, err = NewTicker(*cfg.Ticker); err != nil {
+			return cfg, err.With("file", fn)
+		}
+	}
+
+	names := map[string]bool{}
+	audio := 0
+	for _, pipeline := range cfg.Pipelines {
+		if len(pipeline.Name) == 0 || strings.ContainsAny(pipeline.Name, "/ ") {
+			return cfg, errors.New("pipelines must have a name without spaces or slashes").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if names[pipeline.Name] {
+			return cfg, errors.New("pipeline names must be unique").With("pipeline", pipeline.Name).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		names[pipeline.Name] = true
+		// A headless show plays without any tecthulhus
+		if len(pipeline.Server) == 0 || (len(pipeline.Tecthulhus) == 0 && cfg.Show == nil) {
+			return cfg, errors.New("pipelines must have a server and at least one tecthulhu").With("pipeline", pipeline.Name).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, err = NewStrandMap(pipeline.Strands); err != nil {
+			return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+		}
+		if _, err = NewPhases(pipeline.Phases); err != nil {
+			return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+		}
+		if pipeline.Firmware != nil {
+			if _, err = NewFirmware(*pipeline.Firmware); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if pipeline.Status != nil {
+			if _, err = NewStatus(*pipeline.Status); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+			// The LED belongs to the host rather than to a pipeline
+			if len(pipeline.Status.LED) != 0 {
+				return cfg, errors.New("the status LED can only be set at the top level").With("pipeline", pipeline.Name).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		if pipeline.Canary != nil {
+			if _, err = NewCanary(*pipeline.Canary); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if _, err = NewStandby(pipeline.Standby); err != nil {
+			return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+		}
+		if pipeline.Transform != nil {
+			if _, err = NewTransform(*pipeline.Transform); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if pipeline.Guard != nil {
+			if _, err = NewGuard(*pipeline.Guard); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if _, err = NewOutputs(pipeline.Outputs); err != nil {
+			return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+		}
+		if pipeline.Timeline != nil {
+			if _, err = NewTimeline(*pipeline.Timeline); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if pipeline.Score != nil {
+			if _, err = NewScore(*pipeline.Score); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if pipeline.Ticker != nil {
+			if _, err = NewTicker(*pipeline.Ticker); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if pipeline.Arbitration != nil {
+			if _, err = NewArbiter(*pipeline.Arbitration); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if pipeline.OPCInput != nil {
+			if _, err = checkOPCInput(*pipeline.OPCInput); err != nil {
+				return cfg, err.With("pipeline", pipeline.Name).With("file", fn)
+			}
+		}
+		if pipeline.Audio {
+			audio++
+		}
+	}
+	if audio > 1 {
+		return cfg, errors.New("audio can only be enabled for one pipeline").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return cfg, nil
+}
+
+// ValidateConfig checks the contents of a configuration file before it is saved,
+// unlike loading a file fields that are not recognized, such as misspelt names,
+// are treated as errors.  The file is checked against the configuration schema
+// first so that every mismatch is reported along with its line and column
+//
+func ValidateConfig(data []byte, fn string) (cfg *Config, err errors.Error) {
+	violations, err := ValidateSchema(data)
+	if err != nil {
+		return nil, err.With("file", fn)
+	}
+	if len(violations) != 0 {
+		texts := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			texts = append(texts, violation.Error())
+		}
+		return nil, errors.New("the configuration does not match its schema").With("file", fn).With("line", violations[0].Line).With("violations", strings.Join(texts, "; ")).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo := yaml.UnmarshalStrict(data, DefaultConfig()); errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return parseConfig(data, fn)
+}
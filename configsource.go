@@ -0,0 +1,249 @@
+package mawt
+
+// This module retrieves the configuration file from the location given on the
+// command line.  Along with local files, http(s):// URLs and s3://bucket/key
+// locations are supported so that the nodes at an anomaly can share centrally
+// managed configuration.  ETags, or the modification time of local files, are
+// used to detect when the configuration has changed.  Web servers that do not
+// send an ETag have a hash of the content used in its place
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// contentTagPrefix marks the versions of remote configuration derived from a hash
+// of the content, which are not sent to the server as they are not its ETags
+const contentTagPrefix = "sha256:"
+
+// ConfigSource is a location from which the configuration file is loaded
+//
+type ConfigSource struct {
+	Location string
+	etag     string // The version of the configuration last loaded
+	client   *http.Client
+	sync.Mutex
+}
+
+// NewConfigSource creates a source for a local file, http(s) URL or s3://bucket/key
+// location.  An empty location results in the default configuration
+//
+func NewConfigSource(location string) (src *ConfigSource) {
+	return &ConfigSource{
+		Location: location,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// IsRemote is true for sources that are retrieved from a web server or S3
+//
+func (src *ConfigSource) IsRemote() (isRemote bool) {
+	return strings.HasPrefix(src.Location, "http://") ||
+		strings.HasPrefix(src.Location, "https://") ||
+		strings.HasPrefix(src.Location, "s3://")
+}
+
+// Load retrieves and validates the configuration.  changed is false, and the
+// configuration returned is nil, when it has not been modified since the last Load
+//
+func (src *ConfigSource) Load() (cfg *Config, changed bool, err errors.Error) {
+	if len(src.Location) == 0 {
+		return DefaultConfig(), true, nil
+	}
+
+	src.Lock()
+	defer src.Unlock()
+
+	data, etag, err := src.fetch()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(etag) != 0 && etag == src.etag {
+		return nil, false, nil
+	}
+
+	if cfg, err = parseConfig(data, src.Location); err != nil {
+		return cfg, false, err
+	}
+	src.etag = etag
+	return cfg, true, nil
+}
+
+// fetch retrieves the configuration data, an empty data slice with the previous
+// etag being returned when the remote copy is unchanged
+//
+func (src *ConfigSource) fetch() (data []byte, etag string, err errors.Error) {
+	switch {
+	case strings.HasPrefix(src.Location, "s3://"):
+		return src.fetchS3()
+	case src.IsRemote():
+		req, errGo := http.NewRequest(http.MethodGet, src.Location, nil)
+		if errGo != nil {
+			return nil, "", errors.Wrap(errGo).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+		}
+		return src.fetchHTTP(req)
+	}
+
+	info, errGo := os.Stat(src.Location)
+	if errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("file", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	etag = fmt.Sprint(info.ModTime().UnixNano(), "-", info.Size())
+	if etag == src.etag {
+		return nil, etag, nil
+	}
+	if data, errGo = ioutil.ReadFile(src.Location); errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("file", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	return data, etag, nil
+}
+
+// fetchS3 retrieves an object from S3 using the credentials and region found in
+// the environment or the shared AWS configuration files
+//
+func (src *ConfigSource) fetchS3() (data []byte, etag string, err errors.Error) {
+	location, errGo := url.Parse(src.Location)
+	if errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sess, errGo := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	region := "us-east-1"
+	if sess.Config.Region != nil && len(*sess.Config.Region) != 0 {
+		region = *sess.Config.Region
+	}
+
+	objectURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", location.Host, region, strings.TrimPrefix(location.Path, "/"))
+	req, errGo := http.NewRequest(http.MethodGet, objectURL, nil)
+	if errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(src.etag) != 0 && !strings.HasPrefix(src.etag, contentTagPrefix) {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	if _, errGo = v4.NewSigner(sess.Config.Credentials).Sign(req, nil, "s3", region, time.Now()); errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	return src.fetchHTTP(req)
+}
+
+// fetchHTTP retrieves the configuration data from a web server or S3, a hash of the
+// content being returned as the etag when the server does not send one
+//
+func (src *ConfigSource) fetchHTTP(req *http.Request) (data []byte, etag string, err errors.Error) {
+	if len(src.etag) != 0 && !strings.HasPrefix(src.etag, contentTagPrefix) {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+
+	resp, errGo := src.client.Do(req)
+	if errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, src.etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", errors.New(resp.Status).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if data, errGo = ioutil.ReadAll(resp.Body); errGo != nil {
+		return nil, "", errors.Wrap(errGo).With("url", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	if etag = resp.Header.Get("ETag"); len(etag) == 0 {
+		etag = fmt.Sprintf("%s%x", contentTagPrefix, sha256.Sum256(data))
+	}
+	return data, etag, nil
+}
+
+// Read returns the configuration file as it currently exists at the source, whether
+// or not it has changed since it was last loaded
+//
+func (src *ConfigSource) Read() (data []byte, err errors.Error) {
+	if len(src.Location) == 0 {
+		return nil, errors.New("no configuration file is in use").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	src.Lock()
+	defer src.Unlock()
+
+	etag := src.etag
+	src.etag = ""
+	data, _, err = src.fetch()
+	src.etag = etag
+	return data, err
+}
+
+// Save validates the configuration and replaces the local file with it, the previous
+// file is kept with a .bak suffix.  Remote sources are managed centrally and cannot be
+// saved to.  The configuration is not loaded, a later Load will see it as changed
+//
+func (src *ConfigSource) Save(data []byte) (err errors.Error) {
+	if len(src.Location) == 0 || src.IsRemote() {
+		return errors.New("only local configuration files can be saved").With("location", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, err = ValidateConfig(data, src.Location); err != nil {
+		return err
+	}
+
+	src.Lock()
+	defer src.Unlock()
+
+	mode := os.FileMode(0644)
+	if info, errGo := os.Stat(src.Location); errGo == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// The file is written alongside the original and renamed over it so that a power
+	// loss part way through leaves either the old or the new configuration
+	tmp, errGo := ioutil.TempFile(filepath.Dir(src.Location), filepath.Base(src.Location)+".")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	_, errGo = tmp.Write(data)
+	if errGo == nil {
+		errGo = tmp.Sync()
+	}
+	if errClose := tmp.Close(); errGo == nil {
+		errGo = errClose
+	}
+	if errGo == nil {
+		errGo = os.Chmod(tmp.Name(), mode)
+	}
+	if errGo != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(errGo).With("file", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if previous, errGo := ioutil.ReadFile(src.Location); errGo == nil {
+		if errGo = ioutil.WriteFile(src.Location+".bak", previous, mode); errGo != nil {
+			os.Remove(tmp.Name())
+			return errors.Wrap(errGo).With("file", src.Location+".bak").With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if errGo = os.Rename(tmp.Name(), src.Location); errGo != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(errGo).With("file", src.Location).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
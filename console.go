@@ -0,0 +1,311 @@
+package mawt
+
+// This module implements the lighting console, a USB MIDI controller whose
+// notes and controllers are mapped onto actions such as triggering a flash of
+// color over the portal animations, setting the master brightness and
+// selecting the faction palette.  This gives a lighting operator a tactile
+// way of working the portal during ceremonies.  The controller is read as a
+// raw MIDI device, for example /dev/snd/midiC1D0, and any timing clock it
+// sends is passed to the beat clock
+
+import (
+	"fmt"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ConsoleMapping maps a MIDI note or controller onto an action
+//
+type ConsoleMapping struct {
+	Message string `yaml:"message"` // note or cc
+	Number  int    `yaml:"number"`  // The note or controller number, 0 to 127
+
+	// Action is one of cue, brightness, palette, scene, estop, clear or tap.
+	// Notes trigger cues scaled by their velocity, engage or clear the emergency
+	// stop, select a palette, show or clear a named scene or tap the tempo.
+	// Controllers set the brightness
+	Action string `yaml:"action"`
+
+	Color    string        `yaml:"color"`    // The color of a cue, as 6 hex digits
+	Duration time.Duration `yaml:"duration"` // The time a cue takes to fade out, defaults to a second
+	Palette  string        `yaml:"palette"`  // The palette selected
+	Scene    string        `yaml:"scene"`    // The scene shown, or cleared when it is already showing
+}
+
+// ConsoleConfig defines the MIDI controller used as a lighting console
+//
+type ConsoleConfig struct {
+	Device   string           `yaml:"device"`   // The raw MIDI device of the controller
+	Channel  int              `yaml:"channel"`  // The MIDI channel listened to, 1 to 16, or 0 for all channels
+	Mappings []ConsoleMapping `yaml:"mappings"` // The actions for the notes and controllers
+}
+
+// Cue is a flash of color drawn over the animations that fades out
+//
+type Cue struct {
+	Color    color.RGBA
+	Duration time.Duration
+	Level    float64 // The initial strength of the cue, from 0 to 1
+	start    time.Time
+}
+
+// Console maps the messages of a MIDI controller onto the pipelines
+//
+type Console struct {
+	config ConsoleConfig
+	cues   map[int]Cue // Cues by note number
+	gws    []*Gateway
+}
+
+// NewConsole validates the mappings of a console
+//
+func NewConsole(config ConsoleConfig) (console *Console, err errors.Error) {
+	if len(config.Device) == 0 {
+		return nil, errors.New("the console needs a MIDI device").With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Channel < 0 || config.Channel > 16 {
+		return nil, errors.New("the console channel must be from 1 to 16, or 0 for all channels").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	console = &Console{config: config, cues: map[int]Cue{}}
+	for _, mapping := range config.Mappings {
+		if mapping.Number < 0 || mapping.Number > 127 {
+			return nil, errors.New("MIDI note and controller numbers must be from 0 to 127").With("number", mapping.Number).With("stack", stack.Trace().TrimRuntime())
+		}
+		switch mapping.Message {
+		case "note":
+			switch mapping.Action {
+			case "cue":
+				rgb, errGo := strconv.ParseUint(strings.TrimPrefix(mapping.Color, "#"), 16, 32)
+				if errGo != nil || len(strings.TrimPrefix(mapping.Color, "#")) != 6 {
+					return nil, errors.New("cue colors must be 6 hex digits").With("note", mapping.Number).With("color", mapping.Color).With("stack", stack.Trace().TrimRuntime())
+				}
+				duration := mapping.Duration
+				if duration <= 0 {
+					duration = time.Second
+				}
+				console.cues[mapping.Number] = Cue{
+					Color:    color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xFF},
+					Duration: duration,
+				}
+			case "palette":
+				if _, err = GetPalette(mapping.Palette); err != nil {
+					return nil, err.With("note", mapping.Number)
+				}
+			case "scene":
+				if len(mapping.Scene) == 0 {
+					return nil, errors.New("scene actions need the name of a scene").With("note", mapping.Number).With("stack", stack.Trace().TrimRuntime())
+				}
+			case "estop", "clear", "tap":
+			default:
+				return nil, errors.New("notes can be mapped to the cue, palette, scene, estop, clear and tap actions").With("note", mapping.Number).With("action", mapping.Action).With("stack", stack.Trace().TrimRuntime())
+			}
+		case "cc":
+			if mapping.Action != "brightness" {
+				return nil, errors.New("controllers can be mapped to the brightness action").With("cc", mapping.Number).With("action", mapping.Action).With("stack", stack.Trace().TrimRuntime())
+			}
+		default:
+			return nil, errors.New("console mappings are for a note or cc message").With("message", mapping.Message).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return console, nil
+}
+
+// Start reads the MIDI device, applying the actions to the pipelines supplied
+//
+func (console *Console) Start(gws []*Gateway, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	console.gws = gws
+
+	f, errGo := os.Open(console.config.Device)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("device", console.config.Device).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	go func() {
+		<-quitC
+		f.Close()
+	}()
+
+	go func() {
+		parser := &midiParser{}
+		buf := make([]byte, 64)
+		for {
+			n, errGo := f.Read(buf)
+			if errGo != nil {
+				select {
+				case <-quitC:
+				default:
+					sendErr(errorC, errors.Wrap(errGo).With("device", console.config.Device).With("stack", stack.Trace().TrimRuntime()))
+				}
+				return
+			}
+			now := time.Now()
+			for _, b := range buf[:n] {
+				if msg := parser.next(b); msg != nil {
+					console.Handle(msg, now)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// midiParser assembles the bytes of a raw MIDI stream into messages, including
+// those that use running status
+//
+type midiParser struct {
+	status byte
+	data   []byte
+}
+
+// next adds a byte to the message being assembled, returning the message once
+// it is complete.  System exclusive messages are discarded
+//
+func (parser *midiParser) next(b byte) (msg []byte) {
+	switch {
+	case b >= 0xF8:
+		// Real time messages can appear anywhere and do not change the running status
+		return []byte{b}
+	case b >= 0xF0:
+		parser.status, parser.data = 0, nil
+		return nil
+	case b >= 0x80:
+		parser.status, parser.data = b, nil
+		return nil
+	case parser.status == 0:
+		return nil
+	}
+
+	parser.data = append(parser.data, b)
+	needed := 2
+	if kind := parser.status & 0xF0; kind == 0xC0 || kind == 0xD0 {
+		needed = 1
+	}
+	if len(parser.data) < needed {
+		return nil
+	}
+	msg = append([]byte{parser.status}, parser.data...)
+	parser.data = nil
+	return msg
+}
+
+// Handle applies the actions mapped to a MIDI message received at the supplied time
+//
+func (console *Console) Handle(msg []byte, now time.Time) {
+	source := "console " + console.config.Device
+
+	switch msg[0] {
+	case 0xF8:
+		GetBeat().Pulse(now, source)
+		return
+	case 0xFA, 0xFB:
+		GetBeat().Start()
+		return
+	case 0xFC:
+		GetBeat().Stop()
+		return
+	}
+
+	if len(msg) != 3 {
+		return
+	}
+	if console.config.Channel != 0 && int(msg[0]&0x0F)+1 != console.config.Channel {
+		return
+	}
+
+	message := ""
+	switch msg[0] & 0xF0 {
+	case 0x90:
+		// A note on with no velocity is a note off
+		if msg[2] == 0 {
+			return
+		}
+		message = "note"
+	case 0xB0:
+		message = "cc"
+	default:
+		return
+	}
+
+	for _, mapping := range console.config.Mappings {
+		if mapping.Message != message || mapping.Number != int(msg[1]) {
+			continue
+		}
+		level := float64(msg[2]) / 127
+		switch mapping.Action {
+		case "cue":
+			cue := console.cues[mapping.Number]
+			cue.Level = level
+			for _, gw := range console.gws {
+				gw.Trigger(cue)
+			}
+		case "brightness":
+			for _, gw := range console.gws {
+				gw.SetBrightness(level)
+			}
+		case "palette":
+			palette, _ := GetPalette(mapping.Palette)
+			for _, gw := range console.gws {
+				gw.SetPalette(palette)
+			}
+			bus.Publish(TopicEvents, Event{Time: now, Kind: "palette", Detail: fmt.Sprintf("%s selected by %s", mapping.Palette, source)})
+		case "scene":
+			// The scenes were checked against those defined when the configuration was loaded
+			for _, gw := range console.gws {
+				gw.ToggleScene(mapping.Scene, source)
+			}
+		case "estop":
+			EngageEStop(source)
+		case "clear":
+			ClearEStop(source)
+		case "tap":
+			GetBeat().Tap(now, source)
+		}
+	}
+}
+
+// applyCue draws a cue over a 16 bit frame, returning a copy of the frame
+//
+func applyCue(frame []ChannelData16, cue *Cue, now time.Time) (cued []ChannelData16) {
+	elapsed := now.Sub(cue.start)
+	if elapsed < 0 || elapsed >= cue.Duration {
+		return frame
+	}
+	strength := cue.Level * (1 - float64(elapsed)/float64(cue.Duration))
+	mix := func(from uint16, to uint8) uint16 {
+		return uint16(float64(from) + (float64(uint16(to)*0x101)-float64(from))*strength + 0.5)
+	}
+
+	cued = make([]ChannelData16, 0, len(frame))
+	for _, channelData := range frame {
+		data := make([]color.RGBA64, len(channelData.Data))
+		for i, pixel := range channelData.Data {
+			data[i] = color.RGBA64{R: mix(pixel.R, cue.Color.R), G: mix(pixel.G, cue.Color.G), B: mix(pixel.B, cue.Color.B), A: 0xFFFF}
+		}
+		cued = append(cued, ChannelData16{ChannelNum: channelData.ChannelNum, Data: data})
+	}
+	return cued
+}
+
+// applyBrightness scales a 16 bit frame by the master brightness in place, the frame
+// being one the render loop widened for this frame alone
+//
+func applyBrightness(frame []ChannelData16, level float64) (dimmed []ChannelData16) {
+	scale := func(value uint16) uint16 {
+		return uint16(float64(value)*level + 0.5)
+	}
+
+	for _, channelData := range frame {
+		data := channelData.Data
+		for i, pixel := range data {
+			data[i] = color.RGBA64{R: scale(pixel.R), G: scale(pixel.G), B: scale(pixel.B), A: pixel.A}
+		}
+	}
+	return frame
+}
@@ -0,0 +1,260 @@
+package mawt
+
+// This module describes the REST API of the gateway as a contract that companion
+// tools, such as dashboards and show controllers written for one event, can rely
+// upon at the next.  The API is versioned by the prefix of its paths, /api/v1, and
+// within a version endpoints, methods and response fields may be added but never
+// removed or changed.  Each endpoint is described by the JSON Schema of its
+// responses, derived from the structures the handlers encode so that it cannot
+// drift from them.  A contract saved when a version was released is compared with
+// the contract of the current code to find changes that would break existing
+// clients, and is used to check the responses of a running gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// APIVersion is the version of the REST API, and the prefix of its paths
+	APIVersion = "v1"
+
+	ContentJSON   = "application/json"
+	ContentStream = "text/event-stream"
+)
+
+// APIContract describes the endpoints of a version of the REST API
+//
+type APIContract struct {
+	Version     string             `json:"version"`
+	Endpoints   []EndpointContract `json:"endpoints"`
+	Definitions map[string]*Schema `json:"definitions"` // The structures of the responses, by name
+
+	gen *schemaGenerator
+}
+
+// EndpointContract describes the methods of an endpoint that share a response.  An
+// endpoint whose methods respond differently is described once for each response
+//
+type EndpointContract struct {
+	Path        string   `json:"path"` // {pipeline} standing for the name of a pipeline
+	Methods     []string `json:"methods"`
+	ContentType string   `json:"contentType,omitempty"` // Empty when nothing is returned
+	Response    *Schema  `json:"response,omitempty"`    // The JSON response, or the data of each event of a stream
+}
+
+// NewAPIContract returns an empty contract for a version of the REST API
+//
+func NewAPIContract(version string) (contract *APIContract) {
+	gen := newSchemaGenerator("json", nil)
+	return &APIContract{
+		Version:     version,
+		Endpoints:   []EndpointContract{},
+		Definitions: gen.definitions,
+		gen:         gen,
+	}
+}
+
+// LoadAPIContract decodes a contract saved as JSON
+//
+func LoadAPIContract(data []byte) (contract *APIContract, err errors.Error) {
+	contract = &APIContract{}
+	if errGo := json.Unmarshal(data, contract); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return contract, nil
+}
+
+// Add describes the methods of an endpoint, response being a value of the type
+// they encode, or nil when they return something other than JSON
+//
+func (contract *APIContract) Add(path string, methods []string, contentType string, response interface{}) {
+	endpoint := EndpointContract{Path: path, Methods: methods, ContentType: contentType}
+	if response != nil {
+		endpoint.Response = contract.gen.typeSchema(reflect.TypeOf(response), nil)
+	}
+	contract.Endpoints = append(contract.Endpoints, endpoint)
+}
+
+// Endpoint returns the description of a method of an endpoint, or nil when the
+// contract does not include it
+//
+func (contract *APIContract) Endpoint(path string, method string) (endpoint *EndpointContract) {
+	for i, candidate := range contract.Endpoints {
+		if candidate.Path != path {
+			continue
+		}
+		for _, name := range candidate.Methods {
+			if name == method {
+				return &contract.Endpoints[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Breaks returns the changes from a previous contract that would break clients
+// written against it, endpoints, methods and fields that were removed and fields
+// whose type changed or that may now be absent
+//
+func (contract *APIContract) Breaks(previous *APIContract) (breaks []string) {
+	for _, endpoint := range previous.Endpoints {
+		for _, method := range endpoint.Methods {
+			where := method + " " + endpoint.Path
+			current := contract.Endpoint(endpoint.Path, method)
+			if current == nil {
+				breaks = append(breaks, where+" was removed")
+				continue
+			}
+			if current.ContentType != endpoint.ContentType {
+				breaks = append(breaks, fmt.Sprintf("%s now returns %q rather than %q", where, current.ContentType, endpoint.ContentType))
+				continue
+			}
+			if endpoint.Response == nil {
+				continue
+			}
+			if current.Response == nil {
+				breaks = append(breaks, where+" no longer describes its response")
+				continue
+			}
+			comparison := &schemaComparison{
+				previous: previous.Definitions,
+				current:  contract.Definitions,
+				seen:     map[string]bool{},
+			}
+			comparison.compare(endpoint.Response, current.Response, "")
+			for _, change := range comparison.changes {
+				breaks = append(breaks, where+" "+change)
+			}
+		}
+	}
+	return breaks
+}
+
+// ValidateResponse checks a JSON response from a method of an endpoint against the
+// contract, fields added since the contract was saved being accepted
+//
+func (contract *APIContract) ValidateResponse(path string, method string, data []byte) (violations []SchemaError, err errors.Error) {
+	endpoint := contract.Endpoint(path, method)
+	if endpoint == nil || endpoint.Response == nil || endpoint.ContentType != ContentJSON {
+		return nil, errors.New("the contract does not describe a JSON response").With("path", path).With("method", method).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	var document interface{}
+	if errGo := json.Unmarshal(data, &document); errGo != nil {
+		return nil, errors.Wrap(errGo).With("path", path).With("method", method).With("stack", stack.Trace().TrimRuntime())
+	}
+	validator := &schemaValidator{
+		root:     &Schema{Definitions: contract.Definitions},
+		patterns: map[string]*regexp.Regexp{},
+		isJSON:   true,
+	}
+	validator.validate(endpoint.Response, document, "")
+	return validator.violations, nil
+}
+
+// schemaComparison compares the schema of a response in a previous contract with
+// that of the current one, collecting the changes that would break clients
+//
+type schemaComparison struct {
+	previous map[string]*Schema
+	current  map[string]*Schema
+	seen     map[string]bool // The pairs of definitions compared, for structures referring to themselves
+	changes  []string
+}
+
+func resolveSchema(schema *Schema, definitions map[string]*Schema) (resolved *Schema) {
+	if schema == nil || len(schema.Ref) == 0 {
+		return schema
+	}
+	return definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+}
+
+func describeField(path string) (description string) {
+	if len(path) == 0 {
+		return "response"
+	}
+	return "field " + path
+}
+
+func (comparison *schemaComparison) compare(previous *Schema, current *Schema, path string) {
+	if len(previous.Ref) != 0 {
+		pair := previous.Ref + " " + current.Ref
+		if comparison.seen[pair] {
+			return
+		}
+		comparison.seen[pair] = true
+	}
+	if previous = resolveSchema(previous, comparison.previous); previous == nil {
+		return
+	}
+	if current = resolveSchema(current, comparison.current); current == nil {
+		current = &Schema{}
+	}
+
+	if len(previous.Type) != 0 {
+		if len(current.Type) == 0 {
+			comparison.changes = append(comparison.changes, fmt.Sprintf("%s may now hold any value rather than %s", describeField(path), strings.Join(previous.Type, " or ")))
+			return
+		}
+		for _, name := range current.Type {
+			isKnown := false
+			for _, known := range previous.Type {
+				isKnown = isKnown || known == name
+			}
+			if !isKnown {
+				comparison.changes = append(comparison.changes, fmt.Sprintf("%s is now %s rather than %s", describeField(path), strings.Join(current.Type, " or "), strings.Join(previous.Type, " or ")))
+				return
+			}
+		}
+	}
+
+	names := make([]string, 0, len(previous.Properties))
+	for name := range previous.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := yamlPath(path, name)
+		property, isPresent := current.Properties[name]
+		if !isPresent {
+			comparison.changes = append(comparison.changes, describeField(child)+" was removed")
+			continue
+		}
+		if isRequired(previous, name) && !isRequired(current, name) {
+			comparison.changes = append(comparison.changes, describeField(child)+" may now be absent")
+		}
+		comparison.compare(previous.Properties[name], property, child)
+	}
+
+	if previous.Items != nil {
+		items := current.Items
+		if items == nil {
+			items = &Schema{}
+		}
+		comparison.compare(previous.Items, items, path+"[]")
+	}
+	if values, isSchema := previous.AdditionalProperties.(*Schema); isSchema {
+		currentValues, _ := current.AdditionalProperties.(*Schema)
+		if currentValues == nil {
+			currentValues = &Schema{}
+		}
+		comparison.compare(values, currentValues, path+"{}")
+	}
+}
+
+func isRequired(schema *Schema, name string) (required bool) {
+	for _, field := range schema.Required {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
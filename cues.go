@@ -0,0 +1,154 @@
+package mawt
+
+// This module implements the audio cues of headless shows, sound effects played as
+// the steps of the playlist entries start so that the sound and the LEDs change
+// together, for example a flash landing on a drum hit.  The step of each strand of an
+// entry starts with the entry and again each time its effect completes a cycle.
+// Sounds are heard some time after they are queued, the audio latency, while the LEDs
+// change some time after a frame is rendered, the latency of the beat clock, so each
+// cue is queued early by the difference between the two.  Steps started on the beat
+// are known a beat ahead, as is the start of the next entry, so their cues are queued
+// early, other steps are only known as they start and their cues are queued at once
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/go-yaml/yaml"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// cueLookahead is the time ahead of a frame within which cues are scheduled,
+	// longer than the period of the slowest frame rate used by shows
+	cueLookahead = 100 * time.Millisecond
+)
+
+// AudioCue plays a sound effect as a step of a playlist entry of a show starts
+//
+type AudioCue struct {
+	Entry  int    `yaml:"entry" json:"entry"`   // The playlist entry, counting from 1
+	Strand int    `yaml:"strand" json:"strand"` // The strand whose step starts the sound, the first strand of the entry by default
+	Cycle  int    `yaml:"cycle" json:"cycle"`   // The start of the step the sound is heard with, counting from 1 for the start of the entry
+	Every  bool   `yaml:"every" json:"every"`   // Set to hear the sound every time the step starts
+	Sound  string `yaml:"sound" json:"sound"`   // The sound effect, an aiff file in the -audioDir directory without its extension
+}
+
+// LoadAudioCues reads a cue file, a YAML list of cues, returning the cues of each
+// playlist entry of the show with their strand and cycle filled in
+//
+func LoadAudioCues(fn string, config ShowConfig) (cues [][]AudioCue, err errors.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	loaded := []AudioCue{}
+	if errGo = yaml.Unmarshal(data, &loaded); errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	entries := config.Playlist
+	cues = make([][]AudioCue, len(entries))
+	for i, cue := range loaded {
+		if cue.Entry < 1 || cue.Entry > len(entries) {
+			return nil, errors.New("audio cue entry out of range").With("cue", i+1).With("entry", cue.Entry).With("entries", len(entries)).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if cue.Strand == 0 {
+			cue.Strand = 1
+			if len(entries[cue.Entry-1].Strands) != 0 {
+				cue.Strand = entries[cue.Entry-1].Strands[0]
+			}
+		}
+		if !entryPlays(entries[cue.Entry-1], config.Strands, cue.Strand) {
+			return nil, errors.New("audio cues must use a strand of their entry").With("cue", i+1).With("strand", cue.Strand).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if cue.Cycle < 0 || (cue.Every && cue.Cycle > 1) {
+			return nil, errors.New("audio cues need a cycle counting from 1, or every cycle").With("cue", i+1).With("cycle", cue.Cycle).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if cue.Cycle == 0 {
+			cue.Cycle = 1
+		}
+		if len(cue.Sound) == 0 {
+			return nil, errors.New("audio cues need a sound").With("cue", i+1).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		cues[cue.Entry-1] = append(cues[cue.Entry-1], cue)
+	}
+	return cues, nil
+}
+
+// entryPlays returns true when a playlist entry plays on a strand, entries listing
+// no strands playing on all of them
+//
+func entryPlays(entry ShowEntry, strands int, strand int) (plays bool) {
+	if len(entry.Strands) == 0 {
+		return strand >= 1 && strand <= strands
+	}
+	for _, used := range entry.Strands {
+		if used == strand {
+			return true
+		}
+	}
+	return false
+}
+
+// stepCues plays the audio cues of a show player as the steps of its entries start,
+// the runner of the player calling it while the player is locked
+//
+type stepCues struct {
+	player *ShowPlayer
+}
+
+// StepStarted plays the cues of the step started, queued early by the lead of the
+// audio over the LEDs.  Steps that would start after the entry has ended are not
+// cued, nor are the first starts of the steps when their cues were queued before the
+// entry started or the entry was played from part way through
+//
+func (observer stepCues) StepStarted(stepName string, startTime time.Time, frameTime time.Time) {
+	player := observer.player
+	if !player.cueAudio || len(player.cues) == 0 || player.entry < 0 || player.entry >= len(player.config.Playlist) {
+		return
+	}
+	if !startTime.Before(player.ends()) {
+		return
+	}
+	if player.starts == nil {
+		player.starts = map[string]int{}
+	}
+	player.starts[stepName]++
+	cycle := player.starts[stepName]
+	if cycle == 1 && player.cuedFirst {
+		return
+	}
+	for _, cue := range player.cues[player.entry] {
+		if strandStep(cue.Strand) == stepName && (cue.Every || cue.Cycle == cycle) {
+			scheduleCue(cue, startTime.Sub(frameTime)-cueLead())
+		}
+	}
+}
+
+// cueLead returns the time ahead of the LEDs that sounds are queued, negative when
+// the LEDs are slower than the audio
+//
+func cueLead() (lead time.Duration) {
+	return AudioLatency() - GetBeat().State().Latency
+}
+
+// scheduleCue queues the sound of a cue after a delay, the delay being measured on
+// the animation clock
+//
+func scheduleCue(cue AudioCue, delay time.Duration) {
+	play := func() {
+		if err := PlayCue(cue.Sound); err != nil {
+			bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "cue", Detail: fmt.Sprintf("entry %d strand %d %s not played, %s", cue.Entry, cue.Strand, cue.Sound, err.Error())})
+			return
+		}
+		bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "cue", Detail: fmt.Sprintf("entry %d strand %d %s", cue.Entry, cue.Strand, cue.Sound)})
+	}
+	if delay <= 0 {
+		go play()
+		return
+	}
+	time.AfterFunc(time.Duration(float64(delay)/GetClock().State().Speed), play)
+}
@@ -0,0 +1,167 @@
+package mawt
+
+// This module implements the decay countdown.  Resonators lose a share of their
+// health every day unless they are recharged, and the portal goes neutral once
+// the last of them has decayed away.  The time remaining is predicted from the
+// resonator health reported by the tecthulhu and as it runs short the LEDs dim
+// slowly, then shimmer amber during a final warning phase, so that keeping the
+// portal charged becomes something the players can see and respond to
+
+import (
+	"image/color"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// DecayConfig defines the decay countdown
+//
+type DecayConfig struct {
+	Rate    float64       `yaml:"rate" json:"rate"`       // Percent of resonator health lost each day when no decay has been observed, defaults to 15
+	Horizon time.Duration `yaml:"horizon" json:"horizon"` // Dimming begins when the portal will go neutral within this time, defaults to 24h
+	Warning time.Duration `yaml:"warning" json:"warning"` // The amber shimmer begins when the portal will go neutral within this time, defaults to 2h
+	Floor   float64       `yaml:"floor" json:"floor"`     // The brightness as the portal goes neutral, defaults to 0.3
+}
+
+var (
+	decayAmber = color.RGBA{0xFF, 0x8C, 0x00, 0xFF}
+)
+
+// decayTrack follows the healthiest resonator of a portal since it was last recharged
+//
+type decayTrack struct {
+	health float64   // The health of the healthiest resonator when last seen
+	peak   float64   // The health of the healthiest resonator after the last recharge
+	since  time.Time // When the peak was seen
+	seen   time.Time
+}
+
+// Decay predicts when the displayed portal will go neutral
+//
+type Decay struct {
+	config    DecayConfig
+	portals   map[string]*decayTrack // Tracks by portal title
+	displayed string
+	random    *rand.Rand // Chooses the pixels that shimmer, used only by the render loop
+	sync.Mutex
+}
+
+// NewDecay validates the decay configuration and creates the countdown
+//
+func NewDecay(config DecayConfig) (decay *Decay, err errors.Error) {
+	if config.Rate < 0 || config.Rate > 100 {
+		return nil, errors.New("the decay rate must be from 0 to 100 percent a day").With("rate", config.Rate).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Horizon < 0 || config.Warning < 0 {
+		return nil, errors.New("the decay horizon and warning cannot be negative").With("horizon", config.Horizon).With("warning", config.Warning).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Floor < 0 || config.Floor > 1 {
+		return nil, errors.New("the decay floor must be from 0 to 1").With("floor", config.Floor).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Rate == 0 {
+		config.Rate = 15
+	}
+	if config.Horizon == 0 {
+		config.Horizon = 24 * time.Hour
+	}
+	if config.Warning == 0 {
+		config.Warning = 2 * time.Hour
+	}
+	if config.Floor == 0 {
+		config.Floor = 0.3
+	}
+	if config.Warning > config.Horizon {
+		return nil, errors.New("the decay warning cannot be longer than the horizon").With("horizon", config.Horizon).With("warning", config.Warning).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &Decay{config: config, portals: map[string]*decayTrack{}, random: EffectRand("decay")}, nil
+}
+
+// Update records the status of the displayed portal, a rise in the health of its
+// healthiest resonator is treated as a recharge
+//
+func (decay *Decay) Update(status *model.Status, now time.Time) {
+	health := 0.0
+	for _, resonator := range status.Resonators {
+		if resonator.Level > 0 {
+			health = math.Max(health, float64(resonator.Health))
+		}
+	}
+
+	decay.Lock()
+	defer decay.Unlock()
+
+	decay.displayed = status.Title
+	track, isPresent := decay.portals[status.Title]
+	if !isPresent || health > track.health {
+		track = &decayTrack{peak: health, since: now}
+		decay.portals[status.Title] = track
+	}
+	track.health = health
+	track.seen = now
+}
+
+// Remaining predicts the time until the displayed portal goes neutral, false is
+// returned when the portal has no resonators
+//
+func (decay *Decay) Remaining(now time.Time) (remaining time.Duration, isOK bool) {
+	decay.Lock()
+	defer decay.Unlock()
+
+	track, isPresent := decay.portals[decay.displayed]
+	if !isPresent || track.health <= 0 {
+		return 0, false
+	}
+
+	// Decay observed over at least an hour is preferred to the configured rate
+	rate := decay.config.Rate / float64(24*time.Hour)
+	if elapsed := track.seen.Sub(track.since); elapsed >= time.Hour && track.peak > track.health {
+		rate = (track.peak - track.health) / float64(elapsed)
+	}
+	remaining = time.Duration(track.health/rate) - now.Sub(track.seen)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+// State returns the brightness of the frame, and whether the warning shimmer is shown
+//
+func (decay *Decay) State(now time.Time) (level float64, warning bool) {
+	remaining, isOK := decay.Remaining(now)
+	if !isOK || remaining >= decay.config.Horizon {
+		return 1, false
+	}
+	level = decay.config.Floor + (1-decay.config.Floor)*float64(remaining)/float64(decay.config.Horizon)
+	return level, remaining < decay.config.Warning
+}
+
+// shimmer flickers a share of the pixels of a 16 bit frame towards amber, the share
+// growing as the portal nears going neutral
+//
+func (decay *Decay) shimmer(frame []ChannelData16, now time.Time) (shimmered []ChannelData16) {
+	remaining, _ := decay.Remaining(now)
+	share := 0.05 + 0.25*(1-float64(remaining)/float64(decay.config.Warning))
+
+	shimmered = make([]ChannelData16, 0, len(frame))
+	for _, channelData := range frame {
+		data := make([]color.RGBA64, len(channelData.Data))
+		for i, pixel := range channelData.Data {
+			if decay.random.Float64() >= share {
+				data[i] = pixel
+				continue
+			}
+			strength := 0.3 + 0.5*decay.random.Float64()
+			mix := func(from uint16, to uint8) uint16 {
+				return uint16(float64(from) + (float64(uint16(to)*0x101)-float64(from))*strength + 0.5)
+			}
+			data[i] = color.RGBA64{R: mix(pixel.R, decayAmber.R), G: mix(pixel.G, decayAmber.G), B: mix(pixel.B, decayAmber.B), A: 0xFFFF}
+		}
+		shimmered = append(shimmered, ChannelData16{ChannelNum: channelData.ChannelNum, Data: data})
+	}
+	return shimmered
+}
@@ -0,0 +1,146 @@
+package mawt
+
+// This module implements a filter for the previews of a pipeline that simulates
+// how the strands look through the acrylic of the sculpture.  The diffuser
+// spreads the light of each LED over its neighbours, which is simulated by
+// blurring each strand using a Gaussian kernel, and passes only part of the
+// light.  LEDs are also dimmer when seen from the side, following the cosine
+// power law fitted to the viewing angle of the LED datasheet.  The light is
+// blurred in linear intensity rather than in the gamma encoded values of the
+// frame, as light mixes in the diffuser, so that previews used to design effects
+// remotely match what is seen on site.  Only the previews are filtered, the
+// frames sent to the hardware are unchanged
+
+import (
+	"image/color"
+	"math"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultBeamAngle = 120.0 // The viewing angle of common 5050 LEDs, in degrees
+	maxDiffusionBlur = 10.0
+	displayGamma     = 2.2 // The encoding of the colors of a frame
+)
+
+// DiffusionConfig describes the diffuser and LEDs simulated by a preview output
+//
+type DiffusionConfig struct {
+	Blur         float64 `yaml:"blur"`         // The spread of the light of an LED through the diffuser, as a standard deviation in pixels
+	Transmission float64 `yaml:"transmission"` // The fraction of the light passing through the diffuser, all of it when 0
+	BeamAngle    float64 `yaml:"beamAngle"`    // The full angle, in degrees, over which an LED is at least half as bright, 120 when 0
+	ViewAngle    float64 `yaml:"viewAngle"`    // The angle, in degrees, between the preview viewer and the front of the LEDs
+}
+
+// Diffusion filters the frames of a preview to look as they do through the diffuser
+//
+type Diffusion struct {
+	kernel []float64    // The blur weights, from the center pixel outward
+	gain   float64      // The transmission and viewing angle falloff
+	linear [256]float64 // The linear intensity of each 8 bit value
+}
+
+// NewDiffusion validates the description of a diffuser
+//
+func NewDiffusion(config DiffusionConfig) (diffusion *Diffusion, err errors.Error) {
+	if config.Blur < 0 || config.Blur > maxDiffusionBlur {
+		return nil, errors.New("the diffusion blur must be from 0 to 10 pixels").With("blur", config.Blur).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Transmission < 0 || config.Transmission > 1 {
+		return nil, errors.New("the diffusion transmission must be from 0 to 1").With("transmission", config.Transmission).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.BeamAngle < 0 || config.BeamAngle >= 180 {
+		return nil, errors.New("the LED beam angle must be less than 180 degrees").With("beamAngle", config.BeamAngle).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.ViewAngle < 0 || config.ViewAngle >= 90 {
+		return nil, errors.New("the view angle must be less than 90 degrees").With("viewAngle", config.ViewAngle).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	diffusion = &Diffusion{kernel: []float64{1}, gain: 1}
+	if config.Transmission != 0 {
+		diffusion.gain = config.Transmission
+	}
+
+	// The intensity seen at an angle follows cos^m, m being chosen so that the
+	// intensity halves at the edge of the beam
+	beam := config.BeamAngle
+	if beam == 0 {
+		beam = defaultBeamAngle
+	}
+	m := math.Log(0.5) / math.Log(math.Cos(beam/2*math.Pi/180))
+	diffusion.gain *= math.Pow(math.Cos(config.ViewAngle*math.Pi/180), m)
+
+	if config.Blur != 0 {
+		radius := int(math.Ceil(3 * config.Blur))
+		diffusion.kernel = make([]float64, radius+1)
+		total := 0.0
+		for i := range diffusion.kernel {
+			diffusion.kernel[i] = math.Exp(-float64(i*i) / (2 * config.Blur * config.Blur))
+			total += diffusion.kernel[i]
+			if i != 0 {
+				total += diffusion.kernel[i]
+			}
+		}
+		for i := range diffusion.kernel {
+			diffusion.kernel[i] /= total
+		}
+	}
+
+	for i := range diffusion.linear {
+		diffusion.linear[i] = math.Pow(float64(i)/255, displayGamma)
+	}
+	return diffusion, nil
+}
+
+// Apply returns a copy of a frame as seen through the diffuser, the light of the
+// pixels at the ends of a strand spreading into the surrounding darkness
+//
+func (diffusion *Diffusion) Apply(frame []animationModel.ChannelData) (diffused []animationModel.ChannelData) {
+	diffused = make([]animationModel.ChannelData, 0, len(frame))
+	for _, channelData := range frame {
+		pixels := channelData.Data
+		linear := make([][3]float64, len(pixels))
+		for i, rgba := range pixels {
+			if rgba.A == 0 {
+				continue
+			}
+			linear[i] = [3]float64{diffusion.linear[rgba.R], diffusion.linear[rgba.G], diffusion.linear[rgba.B]}
+		}
+
+		data := make([]color.RGBA, len(pixels))
+		for i := range data {
+			sum := [3]float64{}
+			for offset, weight := range diffusion.kernel {
+				for _, j := range [2]int{i - offset, i + offset} {
+					if j < 0 || j >= len(linear) {
+						continue
+					}
+					for c := range sum {
+						sum[c] += weight * linear[j][c]
+					}
+					if offset == 0 {
+						break
+					}
+				}
+			}
+			data[i] = color.RGBA{R: encodeLinear(sum[0] * diffusion.gain), G: encodeLinear(sum[1] * diffusion.gain), B: encodeLinear(sum[2] * diffusion.gain), A: 0xFF}
+		}
+		diffused = append(diffused, animationModel.ChannelData{ChannelNum: channelData.ChannelNum, Data: data})
+	}
+	return diffused
+}
+
+// encodeLinear returns the 8 bit value of a linear intensity
+//
+func encodeLinear(intensity float64) (value uint8) {
+	if intensity <= 0 {
+		return 0
+	}
+	if intensity >= 1 {
+		return 0xFF
+	}
+	return uint8(math.Pow(intensity, 1/displayGamma)*255 + 0.5)
+}
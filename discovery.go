@@ -0,0 +1,255 @@
+package mawt
+
+// This module implements a minimal multicast DNS (mDNS/zeroconf) browser that
+// is used to locate fadecandy servers, advertised as _opc._tcp, and tecthulhus,
+// advertised as _tecthulhu._tcp, on the local network.
+//
+// Only the small subset of RFC 1035 and RFC 6762 needed to send a PTR query
+// and to decode the PTR, SRV, A and AAAA records in the replies is implemented
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+)
+
+var (
+	mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+// Service is a service instance that was discovered using mDNS
+//
+type Service struct {
+	Instance string   `json:"instance"`
+	Target   string   `json:"target"`
+	Port     int      `json:"port"`
+	Addrs    []net.IP `json:"addrs"`
+}
+
+// Addr returns a host:port pair that can be used to dial the service, preferring
+// IPv4 addresses then IPv6 addresses and finally the advertised host name
+//
+func (svc *Service) Addr() string {
+	port := strconv.Itoa(svc.Port)
+	for _, ip := range svc.Addrs {
+		if ip.To4() != nil {
+			return net.JoinHostPort(ip.String(), port)
+		}
+	}
+	if len(svc.Addrs) != 0 {
+		return net.JoinHostPort(svc.Addrs[0].String(), port)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(svc.Target, "."), port)
+}
+
+type dnsRecord struct {
+	name   string
+	rrType uint16
+	ptr    string
+	port   int
+	target string
+	ip     net.IP
+}
+
+// Discover browses the local network for instances of the service, for example
+// _opc._tcp, for the duration of the timeout.  Instances are returned sorted by name.
+//
+func Discover(service string, timeout time.Duration) (services []Service, err errors.Error) {
+
+	services = []Service{}
+
+	domain := strings.TrimSuffix(service, ".") + ".local."
+
+	conn, errGo := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if errGo != nil {
+		return services, errors.Wrap(errGo).With("service", service).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer conn.Close()
+
+	if _, errGo = conn.WriteTo(dnsQuery(domain, dnsTypePTR), mdnsAddr); errGo != nil {
+		return services, errors.Wrap(errGo).With("service", service).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	records := []dnsRecord{}
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 9000)
+
+	for time.Now().Before(deadline) {
+		conn.SetReadDeadline(deadline)
+		n, _, errGo := conn.ReadFrom(buf)
+		if errGo != nil {
+			if netErr, ok := errGo.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return services, errors.Wrap(errGo).With("service", service).With("stack", stack.Trace().TrimRuntime())
+		}
+		// Replies that cannot be decoded are simply ignored as mDNS traffic for
+		// other services can arrive on the socket
+		if found, errGo := dnsParse(buf[:n]); errGo == nil {
+			records = append(records, found...)
+		}
+	}
+
+	return collectServices(domain, records), nil
+}
+
+// collectServices joins the PTR records for the service domain with the SRV
+// and address records that describe each instance
+//
+func collectServices(domain string, records []dnsRecord) (services []Service) {
+
+	services = []Service{}
+
+	instances := map[string]*Service{}
+	for _, rec := range records {
+		if rec.rrType == dnsTypePTR && strings.EqualFold(rec.name, domain) {
+			instances[strings.ToLower(rec.ptr)] = &Service{Instance: rec.ptr, Addrs: []net.IP{}}
+		}
+	}
+	for _, rec := range records {
+		if svc, isPresent := instances[strings.ToLower(rec.name)]; isPresent && rec.rrType == dnsTypeSRV {
+			svc.Target = rec.target
+			svc.Port = rec.port
+		}
+	}
+	for _, svc := range instances {
+		if len(svc.Target) == 0 {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, rec := range records {
+			if (rec.rrType == dnsTypeA || rec.rrType == dnsTypeAAAA) && strings.EqualFold(rec.name, svc.Target) && !seen[rec.ip.String()] {
+				seen[rec.ip.String()] = true
+				svc.Addrs = append(svc.Addrs, rec.ip)
+			}
+		}
+		services = append(services, *svc)
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Instance < services[j].Instance
+	})
+	return services
+}
+
+// dnsQuery encodes a single question DNS query message
+//
+func dnsQuery(name string, qType uint16) (msg []byte) {
+	msg = make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = append(msg, byte(qType>>8), byte(qType), 0, dnsClassIN)
+	return msg
+}
+
+// dnsName decodes a possibly compressed domain name starting at offset, returning the
+// name and the offset of the first byte after the name
+//
+func dnsName(msg []byte, offset int) (name string, next int, errGo error) {
+	labels := []string{}
+	next = -1
+
+	for jumps := 0; jumps < 32; jumps++ {
+		if offset >= len(msg) {
+			return "", 0, errors.New("truncated name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				return "", 0, errors.New("truncated pointer")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("truncated label")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, errors.New("too many compression pointers")
+}
+
+// dnsParse extracts the resource records from all sections of a DNS message
+//
+func dnsParse(msg []byte) (records []dnsRecord, errGo error) {
+	if len(msg) < 12 {
+		return nil, errors.New("truncated header")
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	for i := 0; i != questions; i++ {
+		if _, offset, errGo = dnsName(msg, offset); errGo != nil {
+			return nil, errGo
+		}
+		offset += 4
+	}
+
+	records = make([]dnsRecord, 0, rrCount)
+	for i := 0; i != rrCount; i++ {
+		rec := dnsRecord{}
+		if rec.name, offset, errGo = dnsName(msg, offset); errGo != nil {
+			return nil, errGo
+		}
+		if offset+10 > len(msg) {
+			return nil, errors.New("truncated record")
+		}
+		rec.rrType = binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, errors.New("truncated record data")
+		}
+		data := msg[offset : offset+length]
+
+		switch rec.rrType {
+		case dnsTypePTR:
+			if rec.ptr, _, errGo = dnsName(msg, offset); errGo != nil {
+				return nil, errGo
+			}
+		case dnsTypeSRV:
+			if length < 7 {
+				return nil, errors.New("truncated SRV record")
+			}
+			rec.port = int(binary.BigEndian.Uint16(data[4:]))
+			if rec.target, _, errGo = dnsName(msg, offset+6); errGo != nil {
+				return nil, errGo
+			}
+		case dnsTypeA, dnsTypeAAAA:
+			rec.ip = append(net.IP(nil), data...)
+		}
+		records = append(records, rec)
+		offset += length
+	}
+	return records, nil
+}
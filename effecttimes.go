@@ -0,0 +1,140 @@
+package mawt
+
+// This module tracks the time taken to compute each of the effects that make
+// up a frame, such as the portal animations and the overlays drawn on top of
+// them, so that the effect responsible for dropped frames can be identified
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultEffectBudget = 10 * time.Millisecond
+
+	effectOverrunLimit = 10          // Consecutive frames over budget before a warning is raised
+	effectWarnInterval = time.Minute // Minimum time between warnings for the same effect
+)
+
+type effectTime struct {
+	frames      uint64
+	overruns    uint64
+	total       time.Duration
+	max         time.Duration
+	last        time.Duration
+	consecutive int       // Frames in a row that were over budget
+	warned      time.Time // When the last warning was raised
+}
+
+// EffectTimes tracks the computation time of the effects of a pipeline against
+// a per frame budget
+//
+type EffectTimes struct {
+	budget  time.Duration
+	effects map[string]*effectTime
+	sync.Mutex
+}
+
+// EffectReport summarizes the computation time of one effect, times are in milliseconds
+//
+type EffectReport struct {
+	Frames   uint64  `json:"frames"`
+	Overruns uint64  `json:"overruns"`
+	MeanMs   float64 `json:"meanMs"`
+	MaxMs    float64 `json:"maxMs"`
+	LastMs   float64 `json:"lastMs"`
+	BudgetMs float64 `json:"budgetMs"`
+}
+
+// NewEffectTimes creates a tracker that treats effects taking longer than the
+// budget to compute a frame as overrunning
+//
+func NewEffectTimes(budget time.Duration) (times *EffectTimes) {
+	return &EffectTimes{
+		budget:  budget,
+		effects: map[string]*effectTime{},
+	}
+}
+
+// SetBudget changes the time each effect is allowed for computing a frame, 0 disables warnings
+//
+func (times *EffectTimes) SetBudget(budget time.Duration) {
+	times.Lock()
+	defer times.Unlock()
+
+	times.budget = budget
+}
+
+// Record adds the time taken by an effect to compute a frame.  A warning is sent when the
+// effect has repeatedly exceeded the budget
+//
+func (times *EffectTimes) Record(effect string, elapsed time.Duration, errorC chan<- errors.Error) {
+	if times == nil {
+		return
+	}
+
+	times.Lock()
+	stats, isPresent := times.effects[effect]
+	if !isPresent {
+		stats = &effectTime{}
+		times.effects[effect] = stats
+	}
+	stats.frames++
+	stats.total += elapsed
+	stats.last = elapsed
+	if elapsed > stats.max {
+		stats.max = elapsed
+	}
+
+	budget := times.budget
+	warn := false
+	if budget > 0 && elapsed > budget {
+		stats.overruns++
+		stats.consecutive++
+		if stats.consecutive >= effectOverrunLimit && time.Since(stats.warned) > effectWarnInterval {
+			stats.warned = time.Now()
+			warn = true
+		}
+	} else {
+		stats.consecutive = 0
+	}
+	mean := stats.total / time.Duration(stats.frames)
+	times.Unlock()
+
+	if warn {
+		sendErr(errorC, errors.New(fmt.Sprintf("effect %s has exceeded its frame budget for %d frames in a row", effect, effectOverrunLimit)).
+			With("effect", effect).With("budget", budget.String()).With("last", elapsed.String()).With("mean", mean.String()).
+			With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// Report returns the computation time summaries indexed by the effect name
+//
+func (times *EffectTimes) Report() (report map[string]EffectReport) {
+	report = map[string]EffectReport{}
+	if times == nil {
+		return report
+	}
+
+	times.Lock()
+	defer times.Unlock()
+
+	ms := func(duration time.Duration) float64 {
+		return float64(duration) / float64(time.Millisecond)
+	}
+	for effect, stats := range times.effects {
+		report[effect] = EffectReport{
+			Frames:   stats.frames,
+			Overruns: stats.overruns,
+			MeanMs:   ms(stats.total / time.Duration(stats.frames)),
+			MaxMs:    ms(stats.max),
+			LastMs:   ms(stats.last),
+			BudgetMs: ms(times.budget),
+		}
+	}
+	return report
+}
@@ -0,0 +1,85 @@
+package mawt
+
+// This module collapses runs of repeated failures, such as the send to every strand
+// in every frame failing while the fadecandy server is offline, into the first
+// failure followed by periodic summaries counting the failures since the last
+// one.  Without it an outage floods the error channel, and the console and log
+// behind it, with hundreds of identical errors every second
+
+import (
+	"sync"
+	"time"
+
+	"github.com/karlmutch/errors"
+)
+
+const (
+	errorSummaryInterval = 30 * time.Second // Time between the summaries of a run of failures
+)
+
+// ErrorSummary tracks a run of failures of one kind of operation
+//
+type ErrorSummary struct {
+	interval time.Duration
+	failing  time.Time // When the run of failures began, zero while succeeding
+	reported time.Time // When the run was last reported
+	held     uint64    // Failures since the run was last reported
+	total    uint64    // Failures since the run began
+	sync.Mutex
+}
+
+// NewErrorSummary creates a summary that reports a run of failures at the interval
+//
+func NewErrorSummary(interval time.Duration) (summary *ErrorSummary) {
+	return &ErrorSummary{interval: interval}
+}
+
+// Failed records a failure, returning the error that should be reported or nil when
+// it is being held back.  The first failure of a run is returned as it is, the later
+// ones are counted and the last of them returned once per interval with the count
+//
+func (summary *ErrorSummary) Failed(err errors.Error, now time.Time) (report errors.Error) {
+	summary.Lock()
+	defer summary.Unlock()
+
+	summary.total++
+	if summary.failing.IsZero() {
+		summary.failing = now
+		summary.reported = now
+		return err
+	}
+	summary.held++
+	if now.Sub(summary.reported) < summary.interval {
+		return nil
+	}
+	report = err.With("repeated", summary.held).With("failing", now.Sub(summary.failing).Round(time.Second).String())
+	summary.reported = now
+	summary.held = 0
+	return report
+}
+
+// Failing returns when the current run of failures began, zero while succeeding
+//
+func (summary *ErrorSummary) Failing() (since time.Time) {
+	summary.Lock()
+	defer summary.Unlock()
+
+	return summary.failing
+}
+
+// Succeeded records a success, ending any run of failures.  The duration and number
+// of failures of the run that ended are returned, zero when there was no run
+//
+func (summary *ErrorSummary) Succeeded(now time.Time) (failing time.Duration, failures uint64) {
+	summary.Lock()
+	defer summary.Unlock()
+
+	if summary.failing.IsZero() {
+		return 0, 0
+	}
+	failing, failures = now.Sub(summary.failing), summary.total
+	summary.failing = time.Time{}
+	summary.held = 0
+	summary.total = 0
+	return failing, failures
+}
@@ -0,0 +1,156 @@
+package mawt
+
+// This module implements the emergency stop.  Once engaged, from a GPIO input,
+// a key press or the REST API, every pipeline in the process sends only black
+// frames until the stop is explicitly cleared.  Releasing the input that
+// engaged the stop does not clear it
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// EStopState describes whether the emergency stop is engaged, and by what
+//
+type EStopState struct {
+	Engaged bool      `json:"engaged"`
+	Since   time.Time `json:"since"`
+	Source  string    `json:"source,omitempty"`
+}
+
+type eStop struct {
+	state EStopState
+	sync.Mutex
+}
+
+var (
+	estop = &eStop{}
+)
+
+// EngageEStop blacks out all outputs until ClearEStop is called, the source
+// describes what engaged the stop
+//
+func EngageEStop(source string) {
+	estop.Lock()
+	defer estop.Unlock()
+
+	if estop.state.Engaged {
+		return
+	}
+	estop.state = EStopState{
+		Engaged: true,
+		Since:   time.Now(),
+		Source:  source,
+	}
+	bus.Publish(TopicEvents, Event{Time: estop.state.Since, Kind: "estop-engaged", Detail: source})
+}
+
+// ClearEStop releases the emergency stop, the source describes what cleared it
+//
+func ClearEStop(source string) {
+	estop.Lock()
+	defer estop.Unlock()
+
+	if !estop.state.Engaged {
+		return
+	}
+	estop.state = EStopState{}
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "estop-cleared", Detail: source})
+}
+
+// GetEStop returns the current state of the emergency stop
+//
+func GetEStop() (state EStopState) {
+	estop.Lock()
+	defer estop.Unlock()
+
+	return estop.state
+}
+
+// blackout returns a frame of the same shape as the one supplied with every pixel off
+//
+func blackout(frame []animationModel.ChannelData) (black []animationModel.ChannelData) {
+	black = make([]animationModel.ChannelData, 0, len(frame))
+	for _, channelData := range frame {
+		black = append(black, animationModel.ChannelData{
+			ChannelNum: channelData.ChannelNum,
+			Data:       make([]color.RGBA, len(channelData.Data)),
+		})
+	}
+	return black
+}
+
+// WatchEStopGPIO engages the emergency stop when a GPIO input becomes active, the
+// input is accessed using the Linux sysfs GPIO interface, for example on a Raspberry Pi
+//
+func WatchEStopGPIO(pin int, activeLow bool, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	dir, err := exportGPIOInput(pin)
+	if err != nil {
+		return err
+	}
+
+	active := []byte("1")
+	if activeLow {
+		active = []byte("0")
+	}
+
+	go func() {
+		defer track("estop gpio")()
+		tick := time.NewTicker(20 * time.Millisecond)
+		defer tick.Stop()
+
+		reported := false
+		for {
+			select {
+			case <-tick.C:
+				value, errGo := ioutil.ReadFile(filepath.Join(dir, "value"))
+				if errGo != nil {
+					// A failed read is treated as the input being active to fail safe
+					EngageEStop(fmt.Sprintf("gpio%d unreadable", pin))
+					if !reported {
+						sendErr(errorC, errors.Wrap(errGo).With("pin", pin).With("stack", stack.Trace().TrimRuntime()))
+						reported = true
+					}
+					continue
+				}
+				reported = false
+				if bytes.Equal(bytes.TrimSpace(value), active) {
+					EngageEStop(fmt.Sprintf("gpio%d", pin))
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// exportGPIOInput makes a pin available as an input using the Linux sysfs GPIO
+// interface, returning the directory holding its value file
+//
+func exportGPIOInput(pin int) (dir string, err errors.Error) {
+	base := "/sys/class/gpio"
+	dir = filepath.Join(base, fmt.Sprintf("gpio%d", pin))
+
+	if _, errGo := os.Stat(dir); os.IsNotExist(errGo) {
+		if errGo = ioutil.WriteFile(filepath.Join(base, "export"), []byte(fmt.Sprint(pin)), 0200); errGo != nil {
+			return "", errors.Wrap(errGo).With("pin", pin).With("stack", stack.Trace().TrimRuntime())
+		}
+		// udev can take a moment to make the exported pin accessible
+		time.Sleep(100 * time.Millisecond)
+	}
+	if errGo := ioutil.WriteFile(filepath.Join(dir, "direction"), []byte("in"), 0200); errGo != nil {
+		return "", errors.Wrap(errGo).With("pin", pin).With("stack", stack.Trace().TrimRuntime())
+	}
+	return dir, nil
+}
@@ -0,0 +1,124 @@
+package mawt
+
+// This module contains the derivation of higher level events from
+// consecutive portal status messages, for example a change of the
+// controlling faction or the loss of a resonator, along with the
+// annotations operators add to the event stream
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// Event is a single notable change that was observed in the portal status
+// stream, or an operational condition raised by the gateway itself
+//
+type Event struct {
+	Time     time.Time `json:"time"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	Portal   string    `json:"portal"`
+	Home     bool      `json:"home"`
+	Kind     string    `json:"kind"`
+	Detail   string    `json:"detail"`
+	Faction  string    `json:"faction,omitempty"` // The faction controlling the portal, for events that establish or change it
+	Source   string    `json:"source,omitempty"`  // Who raised the event, for operator annotations
+}
+
+const (
+	maxAnnotation = 500 // The longest operator annotation accepted, in bytes
+)
+
+// Annotate injects a free text note from an operator, such as "restarted fcserver",
+// into the event stream so that it is recorded alongside the portal events.  An
+// empty pipeline applies the note to all pipelines
+//
+func Annotate(pipeline string, text string, source string) (event Event, err errors.Error) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return event, errors.New("annotations cannot be empty").With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(text) > maxAnnotation {
+		return event, errors.New("annotation too long").With("length", len(text)).With("limit", maxAnnotation).With("stack", stack.Trace().TrimRuntime())
+	}
+	event = Event{Time: time.Now(), Pipeline: pipeline, Kind: "annotation", Detail: text, Source: source}
+	bus.Publish(TopicEvents, event)
+	return event, nil
+}
+
+// deriveEvents compares two consecutive status messages for the same portal and
+// returns the list of events that explain the differences.  When there is no previous
+// status the portal is considered to have just been discovered
+//
+func deriveEvents(last *model.Status, current *model.Status, home bool, tm time.Time) (events []Event) {
+
+	events = []Event{}
+
+	if current == nil {
+		return events
+	}
+
+	newEvent := func(kind string, detail string) {
+		events = append(events, Event{
+			Time:   tm,
+			Portal: current.Title,
+			Home:   home,
+			Kind:   kind,
+			Detail: detail,
+		})
+	}
+
+	if last == nil {
+		newEvent("discovered", fmt.Sprintf("faction %s level %.0f", current.Faction, current.Level))
+		events[len(events)-1].Faction = current.Faction
+		return events
+	}
+
+	if last.Faction != current.Faction {
+		newEvent("faction", fmt.Sprintf("%s → %s", last.Faction, current.Faction))
+		events[len(events)-1].Faction = current.Faction
+	}
+	if last.Level != current.Level {
+		newEvent("level", fmt.Sprintf("%.0f → %.0f", last.Level, current.Level))
+	}
+	if last.Owner != current.Owner {
+		newEvent("owner", fmt.Sprintf("%s → %s", last.Owner, current.Owner))
+	}
+
+	lastResos := map[string]model.Resonator{}
+	for _, reso := range last.Resonators {
+		lastResos[reso.Position] = reso
+	}
+	for _, reso := range current.Resonators {
+		prior, isPresent := lastResos[reso.Position]
+		delete(lastResos, reso.Position)
+
+		switch {
+		case !isPresent || prior.Level == 0 && reso.Level != 0:
+			newEvent("resonator-deployed", fmt.Sprintf("%s L%.0f by %s", reso.Position, reso.Level, reso.Owner))
+		case prior.Level != 0 && reso.Level == 0:
+			newEvent("resonator-destroyed", reso.Position)
+		case prior.Level != reso.Level:
+			newEvent("resonator-upgraded", fmt.Sprintf("%s L%.0f → L%.0f", reso.Position, prior.Level, reso.Level))
+		case reso.Health > prior.Health:
+			newEvent("resonator-recharged", fmt.Sprintf("%s %.0f%% → %.0f%%", reso.Position, prior.Health, reso.Health))
+		}
+	}
+	// Resonators no longer being reported at all are treated as destroyed, walk
+	// the original slice to keep the ordering stable
+	for _, reso := range last.Resonators {
+		if _, isPresent := lastResos[reso.Position]; isPresent {
+			newEvent("resonator-destroyed", reso.Position)
+		}
+	}
+
+	if len(last.Mods) != len(current.Mods) {
+		newEvent("mods", fmt.Sprintf("%d → %d", len(last.Mods), len(current.Mods)))
+	}
+
+	return events
+}
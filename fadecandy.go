@@ -6,10 +6,15 @@ package mawt
 // to one or more fadecandy device(s)
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"image/color"
+	"math"
+	"net"
 	"os"
+	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	animationModel "github.com/TeamNorCal/animation/model"
@@ -17,79 +22,207 @@ import (
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 
-	"github.com/cnf/structhash"
-
 	"github.com/kellydunn/go-opc"
 )
 
+const (
+	// MaxFrameBytes is the largest frame that UnpackFrame accepts, a set pixel message
+	// for each of the 255 universes made up of the 4 byte OPC header and the most
+	// channel bytes its 16 bit length can hold
+	MaxFrameBytes = 255 * (4 + 0xFFFF)
+)
+
 var (
-	updating sync.Mutex
+	// droppedErrors counts the errors sendErr could not deliver since the last it did
+	droppedErrors uint64
 )
 
 type LastStatus struct {
-	status *model.Status
+	status     *model.Status
+	generation uint64 // Incremented for every status received
+	portal     string // The portal the status came from
+	revision   uint64 // The revision of the status given by the poller of the portal, 0 when not counted
 	sync.Mutex
 }
 
 type FadeCandy struct {
-	oc  *opc.Client
-	nop bool // Used to set the server into a test mode with no fcserver present
+	conn    net.Conn       // The OPC connection to the fcserver, nil while offline or paused
+	sending sync.Mutex     // Serializes the messages sent on the shared OPC connection, and guards conn and devices
+	server  string         // The fadecandy server, or /dev/null
+	nop     bool           // Used to set the server into a test mode with no fcserver present
+	health  *Health        // Tracks the availability of the fcserver
+	pause   *pipelinePause // Set while the sends are paused for a hardware swap
+
+	// updating serializes the rendering and sending of the frames of the pipeline, each
+	// pipeline having its own so that one stalled on its fadecandy server does not hold
+	// up the others
+	updating sync.Mutex
+
+	profile       Profile         // The quality profile controlling the frame rate and firmware settings
+	firmware      *FirmwareConfig // Optional status LED and color correction settings of the fadecandy devices
+	configPending bool            // Set when the firmware settings have yet to be sent
+	status        *StatusConfig   // Optional status pixel showing the health of the pipeline
+	canary        *CanaryConfig   // Optional strand running a known pattern in place of the animations
+	standby       *Standby        // Optional colors shown as the pipeline starts and stops, and while connecting
+	strands       StrandMap
+	detached      map[int]bool        // The universes that frames are not sent to
+	phases        Phases              // Delays the sends to the strands of some devices within the frame period
+	sendWorkers   int                 // The devices whose strands are packed and sent at the same time
+	pool          *sendPool           // The send workers, used only by the render loop
+	devices       map[int]*deviceConn // The OPC connections of each device used by the send workers
+	timeline      *Timeline
+	score         *Score
+	ticker        *Ticker
+	palette       *Palette
+	effects       *EffectTimes  // The computation time of each effect in a frame
+	strandStats   *StrandStats  // The sends to each physical strand
+	sends         *ErrorSummary // Collapses the failed sends of an outage into periodic summaries
+	pipeline      string        // The pipeline the frames are rendered for, used to label events
+	broker        *Broker       // The pipeline broker the frames sent are published to
+	changes       *changeTracker
+	arbiter       *Arbiter                     // Decides which of the portals of the pipeline is displayed
+	held          []animationModel.ChannelData // A frame shown in place of the animations, for example by the REPL
+	heldUntil     time.Time
+	source        FrameSource   // Replaces the portal animations when set, for example by a headless show
+	safe          bool          // Draws the static color of the faction in place of the animations and any source
+	scene         *activeScene  // A named scene shown in place of the animations until it times out
+	input         *OPCInput     // Pixels received from OPC clients composited with the frames, nil when disabled
+	cue           *Cue          // The last cue triggered from the lighting console
+	brightness    float64       // The master brightness, from 0 to 1
+	aware         []strandAware // Outputs told of changes to the strand mapping
+	narrower      *Narrower     // Reduces the 16 bit frames produced by cues and the brightness to 8 bits
+	heartbeat     *Heartbeat    // Pulses the frames while the displayed portal is steady, nil when disabled
+	decay         *Decay        // Dims the frames as the displayed portal nears going neutral, nil when disabled
+	recharge      *Recharge     // Ripples the strands of recharged resonators, nil when disabled
+	stingers      *Stingers     // Flashes mapped onto the audio cues of the displayed portal, nil when there are none
+	ambient       *Ambient      // Scales the brightness to the ambient light, nil when disabled
+	thermal       *Thermal      // Derates the brightness and frame rate as the temperature rises, nil when disabled
+	guard         *Guard        // Checks the frames before they are sent, nil when disabled
+
+	// Buffers reused by the render loop from frame to frame, only the render loop
+	// uses them so they are not protected by the mutex
+	wide     []ChannelData16
+	narrowed []animationModel.ChannelData
+	physical []animationModel.ChannelData
+	scratch  StrandScratch
+	attached []animationModel.ChannelData
+	messages map[animationModel.OpcChannel]*opc.Message // The messages last packed for each channel
+	sync.Mutex
 }
 
 // This file contains the implementation of a listener for tecthulhu events that will on
 // a regular basis lift the last known state of the portal and will update the fade-candy as needed
 
-func StartFadeCandy(server string, subscribeC chan chan *model.PortalMsg, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (fc *FadeCandy) {
+func StartFadeCandy(pipeline string, server string, broker *Broker, health *Health, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (fc *FadeCandy) {
 
-	statusC := make(chan *model.PortalMsg, 1)
-	subscribeC <- statusC
+	fc = &FadeCandy{
+		server:        server,
+		nop:           server == "/dev/null",
+		health:        health,
+		profile:       DefaultConfig().Profiles["performance"],
+		configPending: true,
+		effects:       NewEffectTimes(defaultEffectBudget),
+		strandStats:   NewStrandStats(),
+		sends:         NewErrorSummary(errorSummaryInterval),
+		pipeline:      pipeline,
+		broker:        broker,
+		brightness:    1,
+		narrower:      NewNarrower(),
+	}
+	detector, _ := NewChangeDetector("")
+	fc.changes = newChangeTracker(detector)
+	fc.arbiter, _ = NewArbiter(ArbitrationConfig{})
 
 	status := &LastStatus{}
+	go fc.arbitrate(status, broker, quitC)
 
-	go func() {
-		defer close(statusC)
-		for {
-			select {
-			case msg := <-statusC:
-				if nil == msg {
-					continue
-				}
-				if msg.Home {
-					status.Lock()
-					status.status = msg.Status.DeepCopy()
-					status.Unlock()
-				}
-			case <-quitC:
-				return
-			}
-		}
-	}()
-
-	fc = &FadeCandy{
-		nop: server == "/dev/null",
+	// The terminal preview is a mirror of the frames sent to the fadecandy server
+	if debug {
+		startMirror(OutputBinding{Output: &TerminalOutput{stats: fc.strandStats}}, broker, errorC, quitC)
 	}
 
-	go fc.run(status, server, time.Duration(200*time.Millisecond), debug, errorC, quitC)
+	go fc.run(status, server, time.Duration(200*time.Millisecond), errorC, quitC)
 
 	return fc
 }
 
-func (fc *FadeCandy) run(status *LastStatus, server string, refresh time.Duration,
-	debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) {
+// arbitrate listens for portal statuses, updating the status displayed using the
+// status of the portal chosen by the arbitration policy and publishing it for the
+// sound effects and timeline
+//
+func (fc *FadeCandy) arbitrate(status *LastStatus, broker *Broker, quitC <-chan struct{}) {
+	defer track("arbitration")()
+	sub := broker.Subscribe(TopicStatus, SubscribeOptions{Name: "arbitration", Depth: 8, Policy: LatestWins})
+	defer sub.Close()
 
-	last := []byte{}
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
 
-	if !fc.nop {
-		if fc.oc == nil {
-			fc.oc = opc.NewClient()
+	for {
+		show := (*model.Status)(nil)
+		select {
+		case update := <-sub.C:
+			msg := update.(*model.PortalMsg)
+			if nil == msg {
+				continue
+			}
+			show = fc.Arbiter().Offer(msg, time.Now())
+		case <-tick.C:
+			show = fc.Arbiter().Tick(time.Now())
+		case <-quitC:
+			return
+		}
+		if show != nil {
+			if heartbeat := fc.Heartbeat(); heartbeat != nil {
+				heartbeat.Update(show, time.Now())
+			}
+			if decay := fc.Decay(); decay != nil {
+				decay.Update(show, time.Now())
+			}
+			if recharge := fc.Recharge(); recharge != nil {
+				recharge.Update(show, time.Now())
+			}
+			if stingers := fc.Stingers(); stingers != nil {
+				stingers.Play(fc, show, time.Now())
+			}
+			if ticker := fc.Ticker(); ticker != nil {
+				ticker.Update(show, time.Now())
+			}
+			portal, revision := fc.Arbiter().Revision()
+			status.Lock()
+			status.status = show
+			status.generation++
+			status.portal, status.revision = portal, revision
+			status.Unlock()
+			broker.Publish(TopicDisplayed, &model.PortalMsg{URL: portal, Revision: revision, Status: *show})
 		}
+	}
+}
 
-		if errGo := fc.oc.Connect("tcp", server); errGo != nil {
+// SetArbitration replaces the policy deciding which portal is displayed
+//
+func (fc *FadeCandy) SetArbitration(arbiter *Arbiter) {
+	fc.Lock()
+	defer fc.Unlock()
 
-			fc.oc = nil
+	fc.arbiter = arbiter
+}
+
+// Arbiter returns the arbiter deciding which portal is displayed
+//
+func (fc *FadeCandy) Arbiter() (arbiter *Arbiter) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.arbiter
+}
 
-			err := errors.Wrap(errGo).With("url", server).With("stack", stack.Trace().TrimRuntime())
+func (fc *FadeCandy) run(status *LastStatus, server string, refresh time.Duration,
+	errorC chan<- errors.Error, quitC <-chan struct{}) {
+	defer track("fadecandy")()
 
+	if !fc.nop {
+		if err := fc.connect(); err != nil {
 			select {
 			case errorC <- err:
 			case <-time.After(100 * time.Millisecond):
@@ -100,28 +233,20 @@ func (fc *FadeCandy) run(status *LastStatus, server string, refresh time.Duratio
 
 	sink := NewSink()
 
-	for {
-		// Start the LED command message pusher
-		go fc.RunLoop(sink, debug, errorC, quitC)
+	// Start the LED command message pusher, labelled so that profiles can be
+	// narrowed to the rendering of a single pipeline
+	go pprof.Do(context.Background(), pprof.Labels("pipeline", fc.pipeline), func(context.Context) {
+		fc.RunLoop(sink, status, errorC, quitC)
+	})
 
-		tick := time.NewTicker(refresh)
-		defer tick.Stop()
+	tick := time.NewTicker(refresh)
+	defer tick.Stop()
 
+	for {
 		select {
 		case <-tick.C:
-			status.Lock()
-			copied := status.status.DeepCopy()
-			status.Unlock()
-
-			// Portal status not yet available
-			if copied.Faction == "" {
-				continue
-			}
-
-			hash := structhash.Md5(copied, 1)
-			if bytes.Compare(last, hash) != 0 {
-				last = hash
-				sink.UpdateStatus(copied)
+			if copied, mask := fc.changes.check(status); copied != nil {
+				sink.UpdateFields(copied, mask)
 			}
 		case <-quitC:
 			return
@@ -129,40 +254,658 @@ func (fc *FadeCandy) run(status *LastStatus, server string, refresh time.Duratio
 	}
 }
 
-func (fc *FadeCandy) Send(m *opc.Message) (err errors.Error) {
-	if fc.nop {
+// SetChangeDetector changes the strategy used to detect changes to the home portal status
+//
+func (fc *FadeCandy) SetChangeDetector(detector ChangeDetector) {
+	fc.changes.SetDetector(detector)
+}
+
+// ChangeStats returns the metrics for the detection of changes to the home portal status
+//
+func (fc *FadeCandy) ChangeStats() (stats ChangeStats) {
+	return fc.changes.Stats()
+}
+
+// SetProfile changes the quality profile used for the LED output.  The frame rate
+// changes on the next frame and the firmware settings are sent to the fadecandy
+// server along with it
+//
+func (fc *FadeCandy) SetProfile(profile Profile) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.profile = profile
+	fc.configPending = true
+}
+
+// SetFirmware changes the status LED and color correction settings of the fadecandy
+// devices, which are sent to the fadecandy server along with the next frame
+//
+func (fc *FadeCandy) SetFirmware(firmware *FirmwareConfig) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.firmware = firmware
+	fc.configPending = true
+}
+
+// SetStatus reserves a pixel showing the health of the pipeline, nil removes it
+//
+func (fc *FadeCandy) SetStatus(status *StatusConfig) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.status = status
+}
+
+// SetCanary gives a strand over to a known pattern, nil returns it to the animations
+//
+func (fc *FadeCandy) SetCanary(canary *CanaryConfig) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.canary = canary
+}
+
+// SetStandby changes the colors the strands show as the pipeline starts and stops,
+// and while it is connecting, nil leaves the strands as they are
+//
+func (fc *FadeCandy) SetStandby(standby *Standby) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.standby = standby
+}
+
+// Profile returns the quality profile currently being used
+//
+func (fc *FadeCandy) Profile() (profile Profile) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.profile
+}
+
+// SetStrands changes the mapping of the logical strands rendered by the animations
+// onto the physical strands
+//
+func (fc *FadeCandy) SetStrands(strands StrandMap) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.strands = strands
+	for _, output := range fc.aware {
+		output.SetStrands(strands)
+	}
+}
+
+// SetPhases staggers the sends to the physical strands across the frame period, an
+// empty set sends every strand at the start of the frame period
+//
+func (fc *FadeCandy) SetPhases(phases Phases) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.phases = phases
+}
+
+// SetHeartbeat pulses the frames while the displayed portal is steady, nil removes the heartbeat
+//
+func (fc *FadeCandy) SetHeartbeat(heartbeat *Heartbeat) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.heartbeat = heartbeat
+}
+
+// Heartbeat returns the heartbeat of the pipeline, nil when it is disabled
+//
+func (fc *FadeCandy) Heartbeat() (heartbeat *Heartbeat) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.heartbeat
+}
+
+// SetDecay dims the frames as the displayed portal nears going neutral, nil removes the countdown
+//
+func (fc *FadeCandy) SetDecay(decay *Decay) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.decay = decay
+}
+
+// Decay returns the decay countdown of the pipeline, nil when it is disabled
+//
+func (fc *FadeCandy) Decay() (decay *Decay) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.decay
+}
+
+// SetTimeline draws an ownership timeline over its strand, nil removes the timeline
+//
+func (fc *FadeCandy) SetTimeline(timeline *Timeline) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.timeline = timeline
+}
+
+// SetRecharge plays a ripple on the strand of each resonator recharged, nil removes
+// the charging effect
+//
+func (fc *FadeCandy) SetRecharge(recharge *Recharge) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.recharge = recharge
+}
+
+// Recharge returns the charging effect of the pipeline, nil when it is disabled
+//
+func (fc *FadeCandy) Recharge() (recharge *Recharge) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.recharge
+}
+
+// SetStingers flashes the animations as the displayed portal reports audio cues, nil
+// removes the stingers
+//
+func (fc *FadeCandy) SetStingers(stingers *Stingers) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.stingers = stingers
+}
+
+// Stingers returns the sound-to-light stingers of the pipeline, nil when there are none
+//
+func (fc *FadeCandy) Stingers() (stingers *Stingers) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.stingers
+}
+
+// SetScore draws a score bar over its strand, nil removes the score bar
+//
+func (fc *FadeCandy) SetScore(score *Score) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.score = score
+}
+
+// SetTicker scrolls messages about the displayed portal across a matrix panel, nil removes the ticker
+//
+func (fc *FadeCandy) SetTicker(ticker *Ticker) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.ticker = ticker
+}
+
+// Ticker returns the ticker of the pipeline, nil when there is no matrix panel
+//
+func (fc *FadeCandy) Ticker() (ticker *Ticker) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.ticker
+}
+
+// AddOutputs starts mirroring the frames sent to the fadecandy server to additional outputs
+//
+func (fc *FadeCandy) AddOutputs(bindings []OutputBinding, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	for _, binding := range bindings {
+		if output, isOK := binding.Output.(strandAware); isOK {
+			fc.Lock()
+			output.SetStrands(fc.strands)
+			fc.aware = append(fc.aware, output)
+			fc.Unlock()
+		}
+		if term, isOK := binding.Output.(*TerminalOutput); isOK {
+			term.stats = fc.strandStats
+		}
+		startMirror(binding, fc.broker, errorC, quitC)
+	}
+}
+
+// SetOPCInput composites the pixels received from OPC clients with the frames, nil disables it
+//
+func (fc *FadeCandy) SetOPCInput(input *OPCInput) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.input = input
+}
+
+// SetAmbient scales the brightness of the frames to the ambient light, nil removes the scaling
+//
+func (fc *FadeCandy) SetAmbient(ambient *Ambient) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.ambient = ambient
+}
+
+// SetThermal derates the brightness and frame rate as the temperature rises, nil removes the derating
+//
+func (fc *FadeCandy) SetThermal(thermal *Thermal) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.thermal = thermal
+}
+
+// SetGuard checks the frames using the output guard before they are sent, nil removes the guard
+//
+func (fc *FadeCandy) SetGuard(guard *Guard) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.guard = guard
+}
+
+// frameInterval returns the time between frames for the quality profile, lengthened
+// while the temperature is being throttled
+//
+func (fc *FadeCandy) frameInterval() (interval time.Duration) {
+	fc.Lock()
+	profile := fc.profile
+	thermal := fc.thermal
+	fc.Unlock()
+
+	if thermal != nil {
+		profile.FPS = thermal.FPS(profile.FPS)
+	}
+	return profile.Interval()
+}
+
+// SetPalette changes the faction colors used for the output, nil uses the standard colors
+//
+func (fc *FadeCandy) SetPalette(palette *Palette) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.palette = palette
+}
+
+// ShowFrame displays a logical frame in place of the animations until the hold
+// time has passed, a zero hold returns the pipeline to the animations
+//
+func (fc *FadeCandy) ShowFrame(frame []animationModel.ChannelData, hold time.Duration) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.held = copyFrame(frame)
+	fc.heldUntil = time.Now().Add(hold)
+	if hold <= 0 {
+		fc.held = nil
+	}
+}
+
+// Trigger starts a cue drawn over the animations, replacing any cue still fading out
+//
+func (fc *FadeCandy) Trigger(cue Cue) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	cue.start = time.Now()
+	fc.cue = &cue
+}
+
+// SetBrightness scales the frames sent by a level from 0 to 1
+//
+func (fc *FadeCandy) SetBrightness(level float64) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.brightness = math.Max(0, math.Min(1, level))
+}
+
+// Brightness returns the master brightness
+//
+func (fc *FadeCandy) Brightness() (level float64) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	return fc.brightness
+}
+
+// setScene replaces the scene shown in place of the animations, nil returning to the
+// animations, returning the scene that was active
+//
+func (fc *FadeCandy) setScene(scene *activeScene) (previous *activeScene) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	previous, fc.scene = fc.scene, scene
+	return previous
+}
+
+// sceneState returns the scene active at the supplied time
+//
+func (fc *FadeCandy) sceneState(now time.Time) (state SceneState) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.scene == nil || now.After(fc.scene.state.Until) {
+		return state
+	}
+	return fc.scene.state
+}
+
+// sceneFrame returns the frame of the scene being shown in place of the animations,
+// or nil, reverting to the animations once the scene has timed out
+//
+func (fc *FadeCandy) sceneFrame(now time.Time, tm time.Time) (frame []animationModel.ChannelData) {
+	fc.Lock()
+	scene := fc.scene
+	if scene != nil && now.After(scene.state.Until) {
+		fc.scene = nil
+	}
+	fc.Unlock()
+
+	if scene == nil {
 		return nil
 	}
-	if fc.oc == nil {
-		return errors.New("fadecandy server not online").With("stack", stack.Trace().TrimRuntime())
+	if now.After(scene.state.Until) {
+		bus.Publish(TopicEvents, Event{Time: now, Pipeline: fc.pipeline, Kind: "scene", Detail: scene.state.Name + " timed out, animations resumed"})
+		return nil
+	}
+	return scene.frame(tm)
+}
+
+// heldFrame returns the frame being shown in place of the animations, or nil
+//
+func (fc *FadeCandy) heldFrame(now time.Time) (frame []animationModel.ChannelData) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.held == nil || now.After(fc.heldUntil) {
+		fc.held = nil
+		return nil
+	}
+	return copyFrame(fc.held)
+}
+
+// layout applies the overlays and strand mapping to a frame rendered by the animations
+//
+func (fc *FadeCandy) layout(frame []animationModel.ChannelData, tm time.Time, errorC chan<- errors.Error) (physical []animationModel.ChannelData) {
+	fc.Lock()
+	strands := fc.strands
+	detached := fc.detached
+	timeline := fc.timeline
+	score := fc.score
+	ticker := fc.ticker
+	palette := fc.palette
+	// A cue that has faded out is cleared so the frames are no longer widened for it
+	if fc.cue != nil && tm.Sub(fc.cue.start) >= fc.cue.Duration {
+		fc.cue = nil
+	}
+	cue := fc.cue
+	brightness := fc.brightness
+	narrowing := fc.profile.Narrowing
+	heartbeat := fc.heartbeat
+	decay := fc.decay
+	recharge := fc.recharge
+	input := fc.input
+	ambient := fc.ambient
+	thermal := fc.thermal
+	fc.Unlock()
+
+	effects := fc.effects
+
+	if input != nil {
+		start := time.Now()
+		frame = input.Composite(frame, tm)
+		effects.Record("input", time.Since(start), errorC)
+	}
+	if recharge != nil {
+		start := time.Now()
+		frame = recharge.Overlay(frame, tm)
+		effects.Record("recharge", time.Since(start), errorC)
+	}
+	if timeline != nil {
+		start := time.Now()
+		frame = timeline.Overlay(frame, tm)
+		effects.Record("timeline", time.Since(start), errorC)
+	}
+	if score != nil {
+		start := time.Now()
+		frame = score.Overlay(frame)
+		effects.Record("score", time.Since(start), errorC)
+	}
+	if ticker != nil {
+		start := time.Now()
+		frame = ticker.Overlay(frame, tm)
+		effects.Record("ticker", time.Since(start), errorC)
+	}
+	if palette != nil {
+		start := time.Now()
+		frame = palette.Apply(frame)
+		effects.Record("palette", time.Since(start), errorC)
+	}
+	if ambient != nil {
+		brightness *= ambient.Level()
+	}
+	if thermal != nil {
+		brightness *= thermal.Brightness()
+	}
+	if heartbeat != nil {
+		brightness *= heartbeat.Level(tm)
+	}
+	warning := false
+	if decay != nil {
+		var level float64
+		level, warning = decay.State(tm)
+		brightness *= level
 	}
 
+	// Cues and the brightness are applied in 16 bits so that slow fades and dim
+	// colors keep their smoothness, the frame is then narrowed back to 8 bits
+	if cue != nil || brightness < 1 || warning {
+		fc.wide = WidenInto(fc.wide, frame)
+		wide := fc.wide
+		if warning {
+			start := time.Now()
+			wide = decay.shimmer(wide, tm)
+			effects.Record("decay", time.Since(start), errorC)
+		}
+		if cue != nil {
+			start := time.Now()
+			wide = applyCue(wide, cue, tm)
+			effects.Record("cue", time.Since(start), errorC)
+		}
+		if brightness < 1 {
+			start := time.Now()
+			wide = applyBrightness(wide, brightness)
+			effects.Record("brightness", time.Since(start), errorC)
+		}
+		start := time.Now()
+		fc.narrowed = fc.narrower.NarrowInto(fc.narrowed, wide, narrowing)
+		frame = fc.narrowed
+		effects.Record("narrow", time.Since(start), errorC)
+	}
+
+	start := time.Now()
+	if len(strands) != 0 {
+		fc.physical = strands.ApplyInto(fc.physical, frame, &fc.scratch)
+		physical = fc.physical
+	} else {
+		physical = frame
+	}
+	physical = fc.attachedOnly(physical, detached)
+	effects.Record("strands", time.Since(start), errorC)
+	return physical
+}
+
+// Effects returns the tracker for the computation time of the effects
+//
+func (fc *FadeCandy) Effects() (effects *EffectTimes) {
+	return fc.effects
+}
+
+// StrandStats returns the tracker of the sends to each physical strand
+//
+func (fc *FadeCandy) StrandStats() (stats *StrandStats) {
+	return fc.strandStats
+}
+
+// sendConfig sends the firmware settings of the current profile and firmware
+// configuration if they have not already been accepted by the fadecandy server
+//
+func (fc *FadeCandy) sendConfig() (err errors.Error) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if !fc.configPending {
+		return nil
+	}
+	if err = fc.Send(firmwareConfig(fc.profile, fc.firmware)); err != nil {
+		return err
+	}
+	if correction := colorCorrectionConfig(fc.firmware); correction != nil {
+		if err = fc.Send(correction); err != nil {
+			return err
+		}
+	}
+	fc.configPending = false
+	return nil
+}
+
+func (fc *FadeCandy) Send(m *opc.Message) (err errors.Error) {
+	if faultHit(FaultOPCDrop) != nil {
+		return errors.New("fadecandy send dropped by an injected fault").With("stack", stack.Trace().TrimRuntime())
+	}
+	if fc.nop {
+		return nil
+	}
 	if m == nil {
 		return errors.New("invalid message").With("stack", stack.Trace().TrimRuntime())
 	}
 
-	if errGo := fc.oc.Send(m); errGo != nil {
+	fc.sending.Lock()
+	defer fc.sending.Unlock()
+
+	if fc.conn == nil {
+		return errors.New("fadecandy server not online").With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := fc.conn.Write(m.ByteArray()); errGo != nil {
 		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 	return nil
 }
 
-func (fc *FadeCandy) RunLoop(sink *statusSink, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+// FrameSource renders the logical strands for a frame time, the buffers returned
+// can be reused by the next frame
+//
+type FrameSource interface {
+	GetFrame(tm time.Time) []animationModel.ChannelData
+}
+
+// SetSource replaces the portal animations with another source of frames, such as
+// a headless show, nil returns to the portal animations
+//
+func (fc *FadeCandy) SetSource(source FrameSource) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.source = source
+}
 
-	defer close(errorC)
+// SetSafeMode replaces the portal animations, and any other source of frames, with
+// the static color of the faction holding the displayed portal
+//
+func (fc *FadeCandy) SetSafeMode(safe bool) {
+	fc.Lock()
+	defer fc.Unlock()
 
-	refresh := time.Duration(30 * time.Millisecond)
+	fc.safe = safe
+}
+
+func (fc *FadeCandy) RunLoop(sink *statusSink, status *LastStatus, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	defer track("render loop")()
+
+	refresh := fc.frameInterval()
 	tick := time.NewTicker(refresh)
 	defer tick.Stop()
 
 	opcError := errors.New("")
 
+	// The strands show their standby colors from the first frame rather than whatever
+	// the controller last held, until the first portal status arrives, and again
+	// once the pipeline stops
+	holding := true
+	defer fc.stopSendPool()
+	defer fc.sendStandby(errorC)
+
 	for {
 		select {
 		case <-tick.C:
-			updating.Lock()
+			// A paused pipeline sends a last black frame before its connection is
+			// closed, and then nothing until it is resumed
+			pause, isDrained := fc.draining()
+			if isDrained {
+				continue
+			}
+			if holding && pause == nil {
+				if holding = fc.awaitingStatus(status); holding && fc.sendStandby(errorC) {
+					continue
+				}
+			}
+			fc.updating.Lock()
 			// Populate the logical buffers
-			frameData := sink.GetFrame(time.Now())
+			now := time.Now()
+			fc.Lock()
+			source, safe := fc.source, fc.safe
+			fc.Unlock()
+			if source == nil {
+				source = sink
+			}
+			if safe {
+				source = staticSource{sink: sink}
+			}
+			// The animations follow the animation clock, which can be slowed, sped up
+			// or paused, while the overlays showing live information keep to the wall
+			// clock
+			tm := GetClock().Now(now)
+			frameData := getFrame(source, tm, fc.health, errorC)
+			fc.effects.Record("portal", time.Since(now), errorC)
+			// Scenes replace the animations, which keep running underneath them so
+			// that a show is not held back by the scene
+			if scene := fc.sceneFrame(now, tm); scene != nil {
+				frameData = scene
+			}
+			if held := fc.heldFrame(now); held != nil {
+				frameData = held
+			}
+			frameData = fc.layout(frameData, now, errorC)
+			fc.Lock()
+			indicator, canary, standby := fc.status, fc.canary, fc.standby
+			fc.Unlock()
+			if standby != nil {
+				stale := defaultStatusStale
+				if indicator != nil {
+					stale = indicator.Stale
+				}
+				frameData = standby.connecting(frameData, fc.health.Indicator(stale, now))
+			}
+			if canary != nil {
+				frameData = canaryStrand(frameData, canary, now)
+			}
+			if indicator != nil && indicator.Channel != 0 {
+				frameData = statusPixel(frameData, indicator, fc.health.Indicator(indicator.Stale, now))
+			}
+			if GetEStop().Engaged || pause != nil {
+				frameData = blackout(frameData)
+			}
 
 			// Copy the logical buffers into the physical buffers
 
@@ -177,17 +920,42 @@ func (fc *FadeCandy) RunLoop(sink *statusSink, debug bool, errorC chan<- errors.
 			// deviceStrands, errGo := GetStrands()
 			// if errGo != nil {
 			// 	sendErr(errorC, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
-			// 	updating.Unlock()
+			// 	fc.updating.Unlock()
 			// 	continue
 			// }
 
-			newRefresh := refresh
-			if opcError = fc.updateStrands(frameData, debug, errorC); opcError != nil {
-				newRefresh = time.Duration(250 * time.Millisecond)
+			fc.Lock()
+			phases, guard := fc.phases, fc.guard
+			fc.Unlock()
+
+			// The guard sees the frame exactly as it will be sent
+			if guard != nil {
+				frameData = guard.Check(frameData, now, errorC)
+			}
+
+			// Staggered sends span the frame period so they are made from a copy of the
+			// frame, releasing the render buffers while the sends are made
+			if len(phases) != 0 {
+				frameData = pooledCopy(frameData)
+				fc.updating.Unlock()
+			}
+
+			newRefresh := fc.frameInterval()
+			if opcError = fc.updateStrands(frameData, phases, now, refresh, errorC); opcError != nil {
+				if newRefresh < 250*time.Millisecond {
+					newRefresh = time.Duration(250 * time.Millisecond)
+				}
+			} else if opcError = fc.sendConfig(); opcError != nil {
+				sendErr(errorC, opcError)
+			}
+			if len(phases) == 0 {
+				fc.updating.Unlock()
 			} else {
-				newRefresh = time.Duration(30 * time.Millisecond)
+				releaseFrame(frameData)
+			}
+			if pause != nil {
+				fc.drained(pause)
 			}
-			updating.Unlock()
 
 			if newRefresh != refresh {
 				refresh = newRefresh
@@ -201,64 +969,154 @@ func (fc *FadeCandy) RunLoop(sink *statusSink, debug bool, errorC chan<- errors.
 	}
 }
 
-var (
-	headingOnce sync.Once
+// awaitingStatus is true until the first portal status is received, or the portal
+// animations are replaced by another source of frames such as a headless show
+//
+func (fc *FadeCandy) awaitingStatus(status *LastStatus) (awaiting bool) {
+	fc.Lock()
+	source := fc.source
+	fc.Unlock()
+	if source != nil {
+		return false
+	}
 
-	onceBody = func() {
-		fmt.Printf("\x1b[1;0H\x1b[0J     ")
-		for i := 1; i != 10; i++ {
-			fmt.Printf("         %d", i)
-		}
-		fmt.Printf("\n     ")
-		for i := 1; i != 10; i++ {
-			fmt.Print("1234567890")
+	status.Lock()
+	defer status.Unlock()
+	return status.generation == 0
+}
+
+// sendStandby sends the standby colors of the strands, unless the emergency stop
+// is engaged, returning true when a frame was sent
+//
+func (fc *FadeCandy) sendStandby(errorC chan<- errors.Error) (sent bool) {
+	fc.Lock()
+	standby := fc.standby
+	fc.Unlock()
+	if standby == nil || GetEStop().Engaged {
+		return false
+	}
+	frame := standby.Frame()
+	if len(frame) == 0 {
+		return false
+	}
+
+	fc.updating.Lock()
+	defer fc.updating.Unlock()
+	fc.updateStrands(frame, nil, time.Now(), 0, errorC)
+	return true
+}
+
+// getFrame retrieves the next frame from the animation engine, a panic inside
+// the engine results in an empty frame rather than a stopped render loop
+//
+func getFrame(source FrameSource, tm time.Time, health *Health, errorC chan<- errors.Error) (frame []animationModel.ChannelData) {
+	defer recoverPanic(health, errorC)
+	return source.GetFrame(tm)
+}
+
+// PackStrand prepares an OPC message for a single LED strand that has 3 bytes per LED.
+// Pixels that are fully transparent are sent as black.
+//
+func PackStrand(channelData animationModel.ChannelData) (m *opc.Message) {
+	return PackStrandInto(nil, channelData)
+}
+
+// PackStrandInto prepares an OPC message for a single LED strand as PackStrand does,
+// reusing a message previously packed for the same channel.  Messages hold a buffer
+// for the largest strand so reusing them saves allocating it for every strand of
+// every frame, a nil message creates a new one
+//
+func PackStrandInto(m *opc.Message, channelData animationModel.ChannelData) (packed *opc.Message) {
+	// The OPC protocol assigns a channel per LED strand, and supports a maximum of
+	// 255 strands per server.  Channel 0 is a broadcast channel.
+	if m == nil {
+		m = opc.NewMessage(uint8(channelData.ChannelNum))
+	}
+	m.SetLength(uint16(len(channelData.Data) * 3))
+	for i, rgba := range channelData.Data {
+		if rgba.A == 0 {
+			m.SetPixelColor(i, 0, 0, 0)
+			continue
 		}
-		fmt.Printf("\x1b[20;0H")
+		m.SetPixelColor(i, rgba.R, rgba.G, rgba.B)
 	}
-)
+	return m
+}
 
-func (fc *FadeCandy) updateStrands(data []animationModel.ChannelData, debug bool, errorC chan<- errors.Error) (err errors.Error) {
-	if debug {
-		headingOnce.Do(onceBody)
-		fmt.Printf("\x1b[3;0H")
-	}
-	for _, channelData := range data {
-		// The OPC protocol assigns a channel per LED strand, and supports a maximum of
-		// 255 strands per server.  Channel 0 is a broadcast channel.
-		channel := uint8(channelData.ChannelNum)
-		strip := fmt.Sprintf("\x1b[%d;0H%02d → ", channel+3, channel)
-
-		// Prepare a message for this strand that has 3 bytes per LED
-		m := opc.NewMessage(channel)
-		m.SetLength(uint16(len(channelData.Data) * 3))
-		for i, rgba := range channelData.Data {
-			r, g, b, a := rgba.RGBA()
-			if a == 0 {
-				r = 0
-				g = 0
-				b = 0
-			}
-			strip += fmt.Sprintf("\x1b[38;2;%d;%d;%dm█\x1b[0m", uint8(r), uint8(g), uint8(b))
-			m.SetPixelColor(i, uint8(r), uint8(g), uint8(b))
+// UnpackFrame parses a frame sent as a series of OPC set pixel messages, the same
+// form in which frames are sent to the fcserver and the browser preview
+//
+func UnpackFrame(data []byte) (frame []animationModel.ChannelData, err errors.Error) {
+	frame = []animationModel.ChannelData{}
+	for len(data) != 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated OPC header").With("stack", stack.Trace().TrimRuntime())
+		}
+		length := int(data[2])<<8 | int(data[3])
+		if len(data) < 4+length {
+			return nil, errors.New("truncated OPC message").With("channel", data[0]).With("length", length).With("stack", stack.Trace().TrimRuntime())
 		}
-		if err = fc.Send(m); err != nil {
-			sendErr(errorC, err)
+		if data[1] != 0 || data[0] == 0 {
+			return nil, errors.New("only set pixel messages for individual channels are supported").With("channel", data[0]).With("command", data[1]).With("stack", stack.Trace().TrimRuntime())
 		}
-		if debug {
-			fmt.Println(strip)
-			fmt.Printf("\x1b[32;0H")
+		pixels := make([]color.RGBA, length/3)
+		for i := range pixels {
+			pixel := data[4+i*3:]
+			pixels[i] = color.RGBA{R: pixel[0], G: pixel[1], B: pixel[2], A: 0xFF}
 		}
+		frame = append(frame, animationModel.ChannelData{ChannelNum: animationModel.OpcChannel(data[0]), Data: pixels})
+		data = data[4+length:]
+	}
+	return frame, nil
+}
+
+// updateStrands sends a frame to the fadecandy server, the strands of several devices
+// being packed and sent at once by the send workers, and the sends to strands with a
+// phase offset being delayed by their share of the frame period from the start of
+// the frame.  While the server is offline every strand fails in every frame, so a
+// single error for the frame is reported through the send summary rather than one
+// for each strand
+//
+func (fc *FadeCandy) updateStrands(data []animationModel.ChannelData, phases Phases, frameStart time.Time, period time.Duration, errorC chan<- errors.Error) (err errors.Error) {
+	failed, err := fc.sendDevices(data, phases, frameStart, period)
+	fc.health.opcSent(err)
+
+	now := time.Now()
+	if err != nil {
+		// The first failed frame of an outage is recorded so that drops are counted as they happen
+		if fc.sends.Failing().IsZero() {
+			bus.Publish(TopicEvents, Event{Time: now, Pipeline: fc.pipeline, Kind: "opc-dropped",
+				Detail: fmt.Sprintf("%d strands failed", failed)})
+		}
+		sendErr(errorC, fc.sends.Failed(err.With("failedStrands", failed), now))
+	} else if failing, failures := fc.sends.Succeeded(now); failures != 0 {
+		bus.Publish(TopicEvents, Event{Time: now, Pipeline: fc.pipeline, Kind: "opc-recovered",
+			Detail: fmt.Sprintf("%d frames failed over %s", failures, failing.Round(time.Second))})
+	}
+
+	// Copies are published as the animations reuse their buffers for the next frame
+	if fc.broker.Subscribers(TopicFrames) != 0 {
+		fc.broker.Publish(TopicFrames, copyFrame(data))
 	}
 	return err
 }
 
+// sendErr reports an error without blocking the caller for long.  The error channel
+// is shared by every component and is never closed.  Errors that cannot be delivered
+// promptly are dropped rather than printed, avoiding a flood of console output when
+// the receiver has fallen behind, and the number dropped is added to the next error
+//
 func sendErr(errorC chan<- errors.Error, err errors.Error) {
-	if errorC == nil {
+	if errorC == nil || err == nil {
 		return
 	}
+	if dropped := atomic.LoadUint64(&droppedErrors); dropped != 0 {
+		err = err.With("dropped", dropped)
+	}
 	select {
 	case errorC <- err:
+		atomic.StoreUint64(&droppedErrors, 0)
 	case <-time.After(20 * time.Millisecond):
-		fmt.Println(fmt.Sprintf("%+v", err.Error()))
+		atomic.AddUint64(&droppedErrors, 1)
 	}
 }
@@ -0,0 +1,148 @@
+package mawt
+
+// This module implements the fault points used to test the resilience of the
+// gateway before an event.  Faults are injected into a running instance for a
+// period, dropping the sends to the fadecandy servers, corrupting the JSON
+// returned by the tecthulhus or delaying the polls of the tecthulhus, and the
+// chaos sub command checks that the pipelines recover once they expire.
+// Faults can only be injected once enabled, which is never done by default
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	FaultOPCDrop     = "opc-drop"     // Sends to the fadecandy servers fail
+	FaultCorruptJSON = "corrupt-json" // The JSON returned by the tecthulhus is truncated before it is decoded
+	FaultPollDelay   = "poll-delay"   // The polls of the tecthulhus are delayed
+)
+
+// FaultReport describes a fault that has been injected
+//
+type FaultReport struct {
+	Name      string        `json:"name"`
+	Until     time.Time     `json:"until"`
+	Delay     time.Duration `json:"delay,omitempty"` // The delay added to polls, for the poll-delay fault
+	Triggered uint64        `json:"triggered"`       // The number of times the fault point has been hit
+}
+
+type faultPoints struct {
+	enabled bool
+	faults  map[string]*FaultReport
+	sync.Mutex
+}
+
+var (
+	faults = &faultPoints{faults: map[string]*FaultReport{}}
+)
+
+// EnableFaults allows faults to be injected into the running process
+//
+func EnableFaults() {
+	faults.Lock()
+	defer faults.Unlock()
+
+	faults.enabled = true
+}
+
+// FaultNames returns the names of the faults that can be injected
+//
+func FaultNames() (names []string) {
+	return []string{FaultCorruptJSON, FaultOPCDrop, FaultPollDelay}
+}
+
+// InjectFault activates a fault point for a duration, replacing any earlier injection
+// of the same fault.  The delay is used by the poll-delay fault
+//
+func InjectFault(name string, duration time.Duration, delay time.Duration) (err errors.Error) {
+	faults.Lock()
+	defer faults.Unlock()
+
+	if !faults.enabled {
+		return errors.New("fault injection is not enabled").With("stack", stack.Trace().TrimRuntime())
+	}
+	known := false
+	for _, fault := range FaultNames() {
+		known = known || fault == name
+	}
+	if !known {
+		return errors.New("unknown fault").With("fault", name).With("faults", FaultNames()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if duration <= 0 {
+		return errors.New("faults need a positive duration").With("fault", name).With("duration", duration.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if name == FaultPollDelay && delay <= 0 {
+		return errors.New("the poll-delay fault needs a positive delay").With("delay", delay.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// The hits are counted across injections so that callers can compare counts before and after
+	now := time.Now()
+	fault, isPresent := faults.faults[name]
+	if !isPresent {
+		fault = &FaultReport{Name: name}
+		faults.faults[name] = fault
+	}
+	fault.Until, fault.Delay = now.Add(duration), delay
+	bus.Publish(TopicEvents, Event{Time: now, Kind: "fault-injected", Detail: fmt.Sprintf("%s for %s", name, duration)})
+	return nil
+}
+
+// ClearFaults deactivates all of the fault points
+//
+func ClearFaults() {
+	faults.Lock()
+	defer faults.Unlock()
+
+	for name, fault := range faults.faults {
+		if time.Now().Before(fault.Until) {
+			fault.Until = time.Now()
+			bus.Publish(TopicEvents, Event{Time: fault.Until, Kind: "fault-cleared", Detail: name})
+		}
+	}
+}
+
+// Faults returns the faults that have been injected, including those that have expired
+//
+func Faults() (reports []FaultReport) {
+	faults.Lock()
+	defer faults.Unlock()
+
+	reports = make([]FaultReport, 0, len(faults.faults))
+	for _, fault := range faults.faults {
+		reports = append(reports, *fault)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// faultHit returns the fault when the fault point is active, counting the hit
+//
+func faultHit(name string) (fault *FaultReport) {
+	faults.Lock()
+	defer faults.Unlock()
+
+	if !faults.enabled {
+		return nil
+	}
+	fault, isPresent := faults.faults[name]
+	if !isPresent || !time.Now().Before(fault.Until) {
+		return nil
+	}
+	fault.Triggered++
+	return fault
+}
+
+// corruptBody truncates the JSON returned by a tecthulhu while the corrupt-json fault is active
+//
+func corruptBody(body []byte) (filtered []byte) {
+	if faultHit(FaultCorruptJSON) == nil {
+		return body
+	}
+	return body[:len(body)/2]
+}
@@ -0,0 +1,109 @@
+package mawt
+
+// This module implements the firmware level settings of the fadecandy devices,
+// which are sent using OPC system exclusive messages addressed to the fcserver
+// so that they can be changed from the mawt configuration rather than using a
+// separate tool on site.  The dithering and keyframe interpolation come from the
+// quality profile in use, the status LED and the color correction from the
+// firmware section of the configuration.  The fadecandy only drives WS2811 and
+// WS2812 LEDs so there is no setting for the LED type
+
+import (
+	"encoding/json"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+	"github.com/kellydunn/go-opc"
+)
+
+// FirmwareConfig defines the fadecandy settings that are not part of a quality profile
+//
+type FirmwareConfig struct {
+	StatusLED  string    `yaml:"statusLED" json:"statusLED"`   // auto, on or off, auto leaving the LED to flash with USB activity
+	Gamma      float64   `yaml:"gamma" json:"gamma"`           // The exponent of the color correction curve, 0 leaves the fcserver default of 2.5
+	Whitepoint []float64 `yaml:"whitepoint" json:"whitepoint"` // Red, green and blue multipliers from 0 to 1, empty leaves the fcserver default of full brightness
+}
+
+// colorCorrection is the JSON sent to the fcserver to set the global color correction
+//
+type colorCorrection struct {
+	Gamma      float64   `json:"gamma"`
+	Whitepoint []float64 `json:"whitepoint"`
+}
+
+// NewFirmware validates the firmware settings
+//
+func NewFirmware(config FirmwareConfig) (firmware *FirmwareConfig, err errors.Error) {
+	switch config.StatusLED {
+	case "":
+		config.StatusLED = "auto"
+	case "auto", "on", "off":
+	default:
+		return nil, errors.New("unknown status LED setting, auto, on and off are supported").With("statusLED", config.StatusLED).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Gamma < 0 || config.Gamma > 5 {
+		return nil, errors.New("the firmware gamma must be from 0 to 5").With("gamma", config.Gamma).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(config.Whitepoint) != 0 {
+		if len(config.Whitepoint) != 3 {
+			return nil, errors.New("the firmware whitepoint needs red, green and blue values").With("whitepoint", config.Whitepoint).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, level := range config.Whitepoint {
+			if level < 0 || level > 1 {
+				return nil, errors.New("the firmware whitepoint values must be from 0 to 1").With("whitepoint", config.Whitepoint).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+	}
+	return &config, nil
+}
+
+// firmwareConfig builds the fcserver system exclusive message that sets the
+// dithering and interpolation options, along with the status LED, of all
+// attached fadecandy devices
+//
+func firmwareConfig(profile Profile, firmware *FirmwareConfig) (m *opc.Message) {
+	config := byte(0)
+	if !profile.Dithering {
+		config |= 0x01
+	}
+	if !profile.Interpolation {
+		config |= 0x02
+	}
+	if firmware != nil {
+		switch firmware.StatusLED {
+		case "on":
+			config |= 0x04 | 0x08
+		case "off":
+			config |= 0x04
+		}
+	}
+
+	m = opc.NewMessage(0)
+	// System ID 0x0001 is fcserver, command 0x0002 sets the firmware configuration
+	m.SystemExclusive([]byte{0x00, 0x01, 0x00, 0x02}, []byte{config})
+	m.SetLength(5)
+	return m
+}
+
+// colorCorrectionConfig builds the fcserver system exclusive message that sets the
+// global color correction, nil being returned when the fcserver defaults are kept
+//
+func colorCorrectionConfig(firmware *FirmwareConfig) (m *opc.Message) {
+	if firmware == nil || (firmware.Gamma == 0 && len(firmware.Whitepoint) == 0) {
+		return nil
+	}
+	correction := colorCorrection{Gamma: firmware.Gamma, Whitepoint: firmware.Whitepoint}
+	if correction.Gamma == 0 {
+		correction.Gamma = 2.5
+	}
+	if len(correction.Whitepoint) == 0 {
+		correction.Whitepoint = []float64{1, 1, 1}
+	}
+	data, _ := json.Marshal(correction)
+
+	m = opc.NewMessage(0)
+	// System ID 0x0001 is fcserver, command 0x0001 sets the global color correction
+	m.SystemExclusive([]byte{0x00, 0x01, 0x00, 0x01}, data)
+	m.SetLength(uint16(4 + len(data)))
+	return m
+}
@@ -0,0 +1,140 @@
+package mawt
+
+// This module implements a small periodic UDP broadcast of the state of the
+// gateway, its instance name, version, home portal and health, so that the
+// event staff can see all of the gateways on the LAN at a glance using the
+// fleet sub command rather than visiting the REST API of each in turn
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// FleetPort is the UDP port the fleet status is broadcast to by default
+	FleetPort = 7892
+
+	// maxFleetStatus is the size of the largest broadcast, keeping within a single
+	// ethernet frame so broadcasts are not fragmented
+	maxFleetStatus = 1400
+)
+
+// FleetPipeline is the state of a single pipeline within a fleet status broadcast
+//
+type FleetPipeline struct {
+	Name       string   `json:"name"`
+	Portal     string   `json:"portal,omitempty"` // The title of the home portal, empty until it has been seen
+	Faction    string   `json:"faction,omitempty"`
+	Level      float32  `json:"level"`
+	Health     float32  `json:"health"`
+	Conditions []string `json:"conditions,omitempty"` // The critical conditions present, none when healthy
+}
+
+// FleetStatus is the state of a gateway broadcast to the fleet sub command
+//
+type FleetStatus struct {
+	Instance  string          `json:"instance,omitempty"`
+	Host      string          `json:"host"`
+	Version   string          `json:"version"`
+	Time      time.Time       `json:"time"`
+	Interval  time.Duration   `json:"interval"` // The interval between broadcasts, used to detect gateways that have gone quiet
+	Pipelines []FleetPipeline `json:"pipelines"`
+}
+
+// NewFleetStatus captures the state of the gateways for a broadcast
+//
+func NewFleetStatus(instance string, version string, interval time.Duration, gws []*Gateway) (status *FleetStatus) {
+	host, _ := os.Hostname()
+	status = &FleetStatus{
+		Instance:  instance,
+		Host:      host,
+		Version:   version,
+		Time:      time.Now(),
+		Interval:  interval,
+		Pipelines: make([]FleetPipeline, 0, len(gws)),
+	}
+	for _, gw := range gws {
+		pipeline := FleetPipeline{Name: gw.Name}
+		if portal := gw.History.Latest(true); portal != nil {
+			pipeline.Portal, pipeline.Faction, pipeline.Level, pipeline.Health = portal.Title, portal.Faction, portal.Level, portal.Health
+		}
+		for condition := range criticalConditions(gw.Health) {
+			pipeline.Conditions = append(pipeline.Conditions, condition)
+		}
+		sort.Strings(pipeline.Conditions)
+		status.Pipelines = append(status.Pipelines, pipeline)
+	}
+	return status
+}
+
+// encode returns the JSON of a fleet status, dropping the portal titles when the
+// broadcast would otherwise be too large
+//
+func (status *FleetStatus) encode() (data []byte, err errors.Error) {
+	data, errGo := json.Marshal(status)
+	if errGo == nil && len(data) > maxFleetStatus {
+		for i := range status.Pipelines {
+			status.Pipelines[i].Portal = ""
+		}
+		data, errGo = json.Marshal(status)
+	}
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(data) > maxFleetStatus {
+		return nil, errors.New("fleet status too large to broadcast").With("size", len(data)).With("pipelines", len(status.Pipelines)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return data, nil
+}
+
+// BroadcastFleetStatus sends the state of the gateways to a UDP address, normally a
+// broadcast address such as 255.255.255.255:7892, at the interval until the quit
+// channel is closed
+//
+func BroadcastFleetStatus(addr string, interval time.Duration, instance string, version string, gws []*Gateway, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	dest, errGo := net.ResolveUDPAddr("udp4", addr)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+	// Go enables broadcasts on datagram sockets by default
+	conn, errGo := net.ListenUDP("udp4", nil)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	go func() {
+		defer track("fleet broadcast")()
+		defer conn.Close()
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		failures := NewErrorSummary(errorSummaryInterval)
+		for {
+			data, err := NewFleetStatus(instance, version, interval, gws).encode()
+			if err == nil {
+				if _, errGo := conn.WriteToUDP(data, dest); errGo != nil {
+					err = errors.Wrap(errGo).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+				}
+			}
+			if err != nil {
+				sendErr(errorC, failures.Failed(err, time.Now()))
+			} else {
+				failures.Succeeded(time.Now())
+			}
+
+			select {
+			case <-tick.C:
+			case <-quitC:
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,309 @@
+package mawt
+
+// This module implements the versioned binary frame format shared by the frame
+// recordings, the replay sub command, the streams to remote render nodes and the
+// WebSocket preview, so that the tools of one release can read the frames of
+// another.  To keep network links from saturating at high pixel counts frames
+// can be delta encoded against the previous frame, with a full key frame sent
+// periodically, and the payload can be deflate compressed.
+//
+// Each frame is a record with a big endian header followed by the payload
+//
+//   bytes 0-3    magic, the characters MAWF
+//   byte  4      format version, currently 1
+//   byte  5      header length, currently 22
+//   byte  6      flags, 0x01 delta encoded and 0x02 deflate compressed
+//   byte  7      reserved, 0
+//   bytes 8-9    universe, identifying the sculpture or pipeline of the frame
+//   bytes 10-17  time the frame was rendered, in nanoseconds since the Unix epoch
+//   bytes 18-21  payload length
+//
+// The payload, after inflating it when compressed, is a uint16 count of strands
+// followed by each strand as a channel byte, a uint16 count of pixels and the RGB
+// pixels.  Delta encoded payloads contain the exclusive or of the pixels with
+// those of the previous frame, and are only written when the strands have not
+// changed shape.
+//
+// Later releases may lengthen the header, readers skip any header bytes they do
+// not understand.  Changes that older readers cannot skip, such as a new payload
+// layout or flag, increase the format version which older readers then reject
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	frameMagic     = "MAWF"
+	frameVersion   = 1
+	frameHeaderLen = 22
+
+	frameFlagDelta   = 0x01
+	frameFlagDeflate = 0x02
+	frameFlagsKnown  = frameFlagDelta | frameFlagDeflate
+
+	frameMaxPayload = 4 * 1024 * 1024
+
+	defaultKeyframes = 30
+)
+
+// FrameRecord is a decoded frame along with the universe and time it was recorded with
+//
+type FrameRecord struct {
+	Universe uint16
+	Time     time.Time
+	Frame    []animationModel.ChannelData
+}
+
+// FrameEncoder encodes frames into frame records
+//
+type FrameEncoder struct {
+	Universe uint16 // Written into every record
+
+	deflate   bool
+	keyframes int // Frames between full key frames, 1 disables delta encoding
+	sinceKey  int
+	prev      []byte // The raw payload of the previous frame
+	compress  *flate.Writer
+}
+
+// NewFrameEncoder creates an encoder using the named compression, none or deflate,
+// writing a key frame every keyframes frames, 0 uses a default of 30
+//
+func NewFrameEncoder(compression string, keyframes int) (enc *FrameEncoder, err errors.Error) {
+	if keyframes < 0 {
+		return nil, errors.New("key frame interval cannot be negative").With("keyframes", keyframes).With("stack", stack.Trace().TrimRuntime())
+	}
+	if keyframes == 0 {
+		keyframes = defaultKeyframes
+	}
+	enc = &FrameEncoder{keyframes: keyframes}
+
+	switch compression {
+	case "", "none":
+	case "deflate":
+		enc.deflate = true
+		enc.compress, _ = flate.NewWriter(ioutil.Discard, flate.BestSpeed)
+	default:
+		return nil, errors.New("unknown compression, none and deflate are supported").With("compression", compression).With("stack", stack.Trace().TrimRuntime())
+	}
+	return enc, nil
+}
+
+// Reset causes the next frame to be written as a key frame, for example after the
+// connection to a render node has been re-established
+//
+func (enc *FrameEncoder) Reset() {
+	enc.prev = nil
+}
+
+// Encode returns the record for a frame rendered at a time
+//
+func (enc *FrameEncoder) Encode(frame []animationModel.ChannelData, tm time.Time) (msg []byte, err errors.Error) {
+	raw := make([]byte, 2, 2+len(frame)*3*32)
+	binary.BigEndian.PutUint16(raw, uint16(len(frame)))
+	for _, channelData := range frame {
+		raw = append(raw, byte(channelData.ChannelNum), byte(len(channelData.Data)>>8), byte(len(channelData.Data)))
+		for _, rgba := range channelData.Data {
+			if rgba.A == 0 {
+				raw = append(raw, 0, 0, 0)
+				continue
+			}
+			raw = append(raw, rgba.R, rgba.G, rgba.B)
+		}
+	}
+
+	flags := byte(0)
+	payload := raw
+
+	// Delta frames only make sense when the layout of the strands is unchanged,
+	// the pixels that did not change become zeros that compress well
+	enc.sinceKey++
+	if enc.prev != nil && enc.sinceKey < enc.keyframes && sameShape(enc.prev, raw) {
+		flags |= frameFlagDelta
+		payload = make([]byte, len(raw))
+		copy(payload, raw)
+		xorPixels(payload, enc.prev)
+	} else {
+		enc.sinceKey = 0
+	}
+	enc.prev = raw
+
+	if enc.deflate {
+		flags |= frameFlagDeflate
+		buf := &bytes.Buffer{}
+		enc.compress.Reset(buf)
+		if _, errGo := enc.compress.Write(payload); errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		if errGo := enc.compress.Close(); errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		payload = buf.Bytes()
+	}
+	if len(payload) > frameMaxPayload {
+		return nil, errors.New("frame too large to encode").With("size", len(payload)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	msg = make([]byte, frameHeaderLen, frameHeaderLen+len(payload))
+	copy(msg, frameMagic)
+	msg[4], msg[5], msg[6] = frameVersion, frameHeaderLen, flags
+	binary.BigEndian.PutUint16(msg[8:], enc.Universe)
+	binary.BigEndian.PutUint64(msg[10:], uint64(tm.UnixNano()))
+	binary.BigEndian.PutUint32(msg[18:], uint32(len(payload)))
+	return append(msg, payload...), nil
+}
+
+// sameShape tests whether two raw payloads have the same strands of the same lengths
+//
+func sameShape(a []byte, b []byte) (same bool) {
+	if len(a) != len(b) || len(a) < 2 || a[0] != b[0] || a[1] != b[1] {
+		return false
+	}
+	for i := 2; i+3 <= len(a); {
+		if a[i] != b[i] || a[i+1] != b[i+1] || a[i+2] != b[i+2] {
+			return false
+		}
+		i += 3 + 3*(int(a[i+1])<<8|int(a[i+2]))
+	}
+	return true
+}
+
+// xorPixels applies the exclusive or of the pixels in prev to those of payload,
+// leaving the strand headers untouched.  Both must have the same shape
+//
+func xorPixels(payload []byte, prev []byte) {
+	for i := 2; i+3 <= len(payload); {
+		pixels := 3 * (int(payload[i+1])<<8 | int(payload[i+2]))
+		i += 3
+		for j := i; j < i+pixels && j < len(payload); j++ {
+			payload[j] ^= prev[j]
+		}
+		i += pixels
+	}
+}
+
+// ReadFrame reads a single frame record from a recording or stream, nil being returned
+// without an error when the reader ends cleanly between records
+//
+func ReadFrame(r io.Reader) (msg []byte, err errors.Error) {
+	header := make([]byte, 6)
+	if n, errGo := io.ReadFull(r, header); errGo != nil {
+		if errGo == io.EOF && n == 0 {
+			return nil, nil
+		}
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if string(header[:4]) != frameMagic {
+		return nil, errors.New("not a mawt frame record").With("stack", stack.Trace().TrimRuntime())
+	}
+	if header[5] < frameHeaderLen {
+		return nil, errors.New("frame record header too short").With("length", header[5]).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	msg = make([]byte, int(header[5]))
+	copy(msg, header)
+	if _, errGo := io.ReadFull(r, msg[len(header):]); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	length := binary.BigEndian.Uint32(msg[18:])
+	if length > frameMaxPayload {
+		return nil, errors.New("frame record length invalid").With("length", length).With("stack", stack.Trace().TrimRuntime())
+	}
+	msg = append(msg, make([]byte, length)...)
+	if _, errGo := io.ReadFull(r, msg[len(msg)-int(length):]); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return msg, nil
+}
+
+// FrameDecoder decodes frame records back into frames, retaining the previous
+// frame of each universe for delta encoded records
+//
+type FrameDecoder struct {
+	prev map[uint16][]byte
+}
+
+// Decode converts a frame record into a frame
+//
+func (dec *FrameDecoder) Decode(msg []byte) (record *FrameRecord, err errors.Error) {
+	if len(msg) < 6 || string(msg[:4]) != frameMagic {
+		return nil, errors.New("not a mawt frame record").With("stack", stack.Trace().TrimRuntime())
+	}
+	if msg[4] > frameVersion {
+		return nil, errors.New("frame record version is newer than this release supports").With("version", msg[4]).With("supported", frameVersion).With("stack", stack.Trace().TrimRuntime())
+	}
+	headerLen := int(msg[5])
+	if headerLen < frameHeaderLen || len(msg) < headerLen {
+		return nil, errors.New("frame record header truncated").With("stack", stack.Trace().TrimRuntime())
+	}
+	flags := msg[6]
+	if flags&^frameFlagsKnown != 0 {
+		return nil, errors.New("frame record flags not supported").With("flags", flags).With("stack", stack.Trace().TrimRuntime())
+	}
+	record = &FrameRecord{
+		Universe: binary.BigEndian.Uint16(msg[8:]),
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(msg[10:]))),
+	}
+	payload := msg[headerLen:]
+	if length := binary.BigEndian.Uint32(msg[18:]); int64(length) != int64(len(payload)) {
+		return nil, errors.New("frame record truncated").With("length", length).With("payload", len(payload)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if flags&frameFlagDeflate != 0 {
+		inflated, errGo := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(payload)), frameMaxPayload))
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		payload = inflated
+	} else {
+		// The payload becomes the base of the next delta frame so it must not share the message
+		payload = append([]byte{}, payload...)
+	}
+
+	if flags&frameFlagDelta != 0 {
+		if !sameShape(dec.prev[record.Universe], payload) {
+			return nil, errors.New("delta frame does not match the previous frame").With("stack", stack.Trace().TrimRuntime())
+		}
+		xorPixels(payload, dec.prev[record.Universe])
+	}
+
+	if len(payload) < 2 {
+		return nil, errors.New("frame record payload truncated").With("stack", stack.Trace().TrimRuntime())
+	}
+	count := int(binary.BigEndian.Uint16(payload))
+	record.Frame = make([]animationModel.ChannelData, 0, count)
+	for i, pos := 0, 2; i != count; i++ {
+		if pos+3 > len(payload) {
+			return nil, errors.New("frame record payload truncated").With("stack", stack.Trace().TrimRuntime())
+		}
+		channel := payload[pos]
+		pixels := int(payload[pos+1])<<8 | int(payload[pos+2])
+		pos += 3
+		if pos+3*pixels > len(payload) {
+			return nil, errors.New("frame record payload truncated").With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+		}
+		data := make([]color.RGBA, pixels)
+		for j := range data {
+			data[j] = color.RGBA{R: payload[pos], G: payload[pos+1], B: payload[pos+2], A: 0xff}
+			pos += 3
+		}
+		record.Frame = append(record.Frame, animationModel.ChannelData{ChannelNum: animationModel.OpcChannel(channel), Data: data})
+	}
+
+	// The payload is retained as the base for the next delta frame
+	if dec.prev == nil {
+		dec.prev = map[uint16][]byte{}
+	}
+	dec.prev[record.Universe] = payload
+	return record, nil
+}
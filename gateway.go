@@ -1,28 +1,438 @@
 package mawt
 
-// This module implements a sound effects generator that tracks the state of portal(s)
-// based on portal state messages events that are sent to it, it then
-// in turn queues up sounds effects to match.
+// This module implements the gateway pipeline that connects the portal status
+// messages from tecthulhus to the sound effects, the history and the fadecandy
+// LED output.  More than one gateway can be run in a process, each being an
+// independent pipeline with its own sources and outputs.
 
 import (
-	"github.com/TeamNorCal/mawt/model"
+	"net/url"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 )
 
 type Gateway struct {
+	Name          string // The name of the pipeline, used to namespace events, metrics and APIs
+	HistoryDepth  int    // The number of portal status messages retained in the History
+	NotifyWebhook string // Optional Discord or Slack webhook used for critical operational errors
+	NoAudio       bool   // Disables the sound effects, only one pipeline in a process can own the audio device
+	SafeMode      bool   // Draws only the static faction color, after the gateway crashed repeatedly
+
+	Profiles map[string]Profile // The quality profiles that can be selected, defaults are used when empty
+	Profile  string             // The quality profile selected when the gateway is started
+	Strands  StrandMap          // Optional mapping of the logical strands onto the physical strands
+	Phases   Phases             // Optional delays to the sends of the physical strands within the frame period
+	Firmware *FirmwareConfig    // Optional status LED and color correction settings of the fadecandy devices
+	Status   *StatusConfig      // Optional status pixel showing the health of the pipeline
+	Canary   *CanaryConfig      // Optional strand running a known pattern, showing the renderer is alive
+	Standby  *Standby           // Optional colors of the strands as the pipeline starts and stops, and while connecting
+	Timeline *Timeline          // Optional ownership timeline drawn over one of the strands
+	Score    *Score             // Optional cell or anomaly series score bar drawn over one of the strands
+	Ticker   *Ticker            // Optional messages scrolled across an LED matrix panel
+	Palette  *Palette           // Optional color blind friendly faction colors
+	Outputs  []OutputBinding    // Additional outputs the frames sent to the fadecandy server are mirrored to
+
+	EffectBudget    time.Duration // The computation time allowed for each effect in a frame, 0 disables overrun warnings
+	SendWorkers     int           // The devices whose strands are packed and sent at the same time, 0 for the default
+	ChangeDetection string        // The strategy used to detect changes to the home portal status, fnv when empty
+
+	Arbitration ArbitrationConfig // Decides which portal is displayed, the home portal by default
+	Transform   *TransformConfig  // Optional translation of the raw status documents of the portals added
+	Heartbeat   *Heartbeat        // Optional pulse shown while the displayed portal is steady
+	Decay       *Decay            // Optional dimming as the displayed portal nears going neutral
+	Recharge    *Recharge         // Optional ripple on the strands of resonators that are recharged
+	Stingers    *Stingers         // Optional flashes played as the displayed portal reports game audio cues
+	Show        *ShowPlayer       // Optional headless show played in place of the portal animations
+	Scenes      *Scenes           // Optional named scenes that can be shown in place of the animations
+	OPCInput    *OPCInput         // Optional listener compositing the frames of OPC clients with the animations
+	Ambient     *Ambient          // Optional light sensor scaling the brightness to the surroundings
+	Thermal     *Thermal          // Optional temperature sensor derating the brightness and frame rate
+	Guard       *Guard            // Optional check clamping the pixels and acting on frames too bright for the power supplies
+
+	Broker      *Broker // The portal statuses and frames of the pipeline are published here
+	History     *History
+	Health      *Health
+	Effects     *EffectTimes
+	StrandStats *StrandStats // The frames sent to each physical strand, their latency and errors
+
+	fc         *FadeCandy
+	profile    string                 // The name of the quality profile currently in use
+	tecthulhus []*tecthulhu           // The portals polled, in the order they were added
+	edits      map[int]*StrandMapping // The strand mappings changed at runtime by logical strand, nil when removed
+	detached   map[int]bool           // The universes frames are not sent to
+	sync.Mutex
 }
 
-func (*Gateway) Start(server string, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (tectC chan *model.PortalMsg, subscribeC chan chan *model.PortalMsg) {
+func (gw *Gateway) Start(server string, debug bool, errorC chan<- errors.Error, quitC <-chan struct{}) (broker *Broker) {
+
+	// Each pipeline has its own broker allowing independent pipelines to
+	// coexist within the same process
+	gw.Broker = NewBroker()
 
-	tectC, subscribeC = startFanOut(quitC)
+	gw.Health = NewHealth()
+
+	// Retain a bounded history of the portal status messages that
+	// can be queried by operators
+	//
+	gw.History = NewHistory(gw.HistoryDepth)
+	startHistory(gw.History, gw.Name, gw.Broker, quitC)
 
 	// After creating the broadcast channel we add a listener
 	// for the sounds effects so that it can process detected
 	// state changes etc
 	//
-	go StartSFX(subscribeC, errorC, quitC)
+	if !gw.NoAudio {
+		go StartSFX(gw.Health, gw.Broker, errorC, quitC)
+	}
+
+	gw.fc = StartFadeCandy(gw.Name, server, gw.Broker, gw.Health, debug, errorC, quitC)
+	gw.fc.SetStrands(gw.Strands)
+	gw.fc.SetPhases(gw.Phases)
+	if gw.Firmware != nil {
+		gw.fc.SetFirmware(gw.Firmware)
+	}
+	if gw.Status != nil {
+		gw.fc.SetStatus(gw.Status)
+	}
+	if gw.Canary != nil {
+		gw.fc.SetCanary(gw.Canary)
+	}
+	if gw.Standby != nil {
+		gw.fc.SetStandby(gw.Standby)
+	}
+	gw.fc.SetPalette(gw.Palette)
+	gw.fc.SetSafeMode(gw.SafeMode)
+	gw.fc.AddOutputs(gw.Outputs, errorC, quitC)
+
+	gw.Effects = gw.fc.Effects()
+	gw.StrandStats = gw.fc.StrandStats()
+	gw.Effects.SetBudget(gw.EffectBudget)
+	gw.fc.SetSendWorkers(gw.SendWorkers)
+
+	if detector, err := NewChangeDetector(gw.ChangeDetection); err != nil {
+		sendErr(errorC, err)
+	} else {
+		gw.fc.SetChangeDetector(detector)
+	}
+
+	if arbiter, err := NewArbiter(gw.Arbitration); err != nil {
+		sendErr(errorC, err)
+	} else {
+		arbiter.pipeline = gw.Name
+		gw.fc.SetArbitration(arbiter)
+	}
+
+	gw.fc.SetHeartbeat(gw.Heartbeat)
+	gw.fc.SetDecay(gw.Decay)
+	gw.fc.SetRecharge(gw.Recharge)
+	if gw.Stingers != nil {
+		gw.Stingers.pipeline = gw.Name
+		gw.fc.SetStingers(gw.Stingers)
+	}
+	gw.fc.SetAmbient(gw.Ambient)
+	gw.fc.SetThermal(gw.Thermal)
+	if gw.Guard != nil {
+		gw.Guard.pipeline = gw.Name
+		gw.fc.SetGuard(gw.Guard)
+	}
+	if gw.Show != nil {
+		// The audio cues of a show are only played by the pipeline owning the audio
+		if !gw.NoAudio {
+			gw.Show.EnableCues()
+		}
+		gw.fc.SetSource(gw.Show)
+	}
+	if gw.OPCInput != nil {
+		gw.fc.SetOPCInput(gw.OPCInput)
+		gw.OPCInput.Serve(errorC, quitC)
+	}
+
+	if gw.Timeline != nil {
+		startTimeline(gw.Timeline, gw.Broker, quitC)
+		gw.fc.SetTimeline(gw.Timeline)
+	}
+
+	if gw.Score != nil {
+		gw.Score.pipeline = gw.Name
+		gw.Score.Poll(errorC, quitC)
+		gw.fc.SetScore(gw.Score)
+	}
+
+	if gw.Ticker != nil {
+		gw.Ticker.decay = gw.Decay
+		gw.fc.SetTicker(gw.Ticker)
+	}
+
+	if len(gw.Profiles) == 0 {
+		gw.Profiles = DefaultConfig().Profiles
+	}
+	if len(gw.Profile) != 0 {
+		if err := gw.SetProfile(gw.Profile); err != nil {
+			sendErr(errorC, err)
+		}
+	}
+
+	if len(gw.NotifyWebhook) != 0 {
+		notifier, err := NewNotifier(gw.NotifyWebhook)
+		if err != nil {
+			sendErr(errorC, err)
+		} else {
+			notifier.Pipeline = gw.Name
+			go notifier.run(gw.Health, errorC, quitC)
+		}
+	}
+
+	return gw.Broker
+}
+
+// AddPortal starts polling a tecthulhu and feeding its status messages into the
+// gateway, the gateway must have been started first
+//
+func (gw *Gateway) AddPortal(u url.URL, home bool, policy PollPolicy, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	tec := NewTecthulu(u, home, gw.Health, gw.Broker, errorC)
+	tec.SetPolicy(policy)
+	if gw.Transform != nil {
+		transform, err := NewTransform(*gw.Transform)
+		if err != nil {
+			sendErr(errorC, err.With("url", u.String()))
+			return
+		}
+		tec.client.Transform = transform.Apply
+	}
+	tec.pipeline = gw.Name
+
+	gw.Lock()
+	gw.tecthulhus = append(gw.tecthulhus, tec)
+	gw.Unlock()
+
+	go tec.Run(quitC)
+}
+
+// HomeState reports the portals of a pipeline and which of them is the home portal
+//
+type HomeState struct {
+	Home    string   `json:"home"`
+	Portals []string `json:"portals"` // In the order they were configured
+}
+
+// Home returns the portals polled by the gateway and which of them is the home portal
+//
+func (gw *Gateway) Home() (state HomeState) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	state.Portals = make([]string, 0, len(gw.tecthulhus))
+	for _, tec := range gw.tecthulhus {
+		state.Portals = append(state.Portals, tec.url.String())
+		if tec.isHome() {
+			state.Home = tec.url.String()
+		}
+	}
+	return state
+}
+
+// SetHome switches the home portal of the gateway to another of the portals it polls,
+// for example when a crew moves the sculpture to a different anchor portal.  The
+// change lasts until mawt is restarted
+//
+func (gw *Gateway) SetHome(portal string) (err errors.Error) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	chosen := (*tecthulhu)(nil)
+	previous := ""
+	for _, tec := range gw.tecthulhus {
+		if tec.url.String() == portal {
+			chosen = tec
+		}
+		if tec.isHome() {
+			previous = tec.url.String()
+		}
+	}
+	if chosen == nil {
+		return errors.New("portal is not polled by the pipeline").With("pipeline", gw.Name).With("portal", portal).With("stack", stack.Trace().TrimRuntime())
+	}
+	if previous == portal {
+		return nil
+	}
+
+	for _, tec := range gw.tecthulhus {
+		tec.setHome(tec == chosen)
+	}
+	gw.fc.Arbiter().SetHome(portal)
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: gw.Name, Portal: portal, Home: true, Kind: "home-changed", Detail: "from " + previous})
+	return nil
+}
+
+// SetProfile switches the LED output of the gateway to one of its named quality profiles
+//
+func (gw *Gateway) SetProfile(name string) (err errors.Error) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	profile, isPresent := gw.Profiles[name]
+	if !isPresent {
+		return errors.New("unknown profile").With("profile", name).With("pipeline", gw.Name).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	gw.fc.SetProfile(profile)
+	gw.profile = name
+	return nil
+}
+
+// ActiveProfile returns the name of the quality profile in use, an empty
+// name indicates the built in defaults are being used
+//
+func (gw *Gateway) ActiveProfile() (name string) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	return gw.profile
+}
+
+// AvailableProfiles returns the quality profiles that can be selected
+//
+func (gw *Gateway) AvailableProfiles() (profiles map[string]Profile) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	profiles = make(map[string]Profile, len(gw.Profiles))
+	for name, profile := range gw.Profiles {
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+// Reconfigure applies the parts of a changed configuration that can be altered
+// while the gateway is running, these being the strand mapping and the quality
+// profiles.  Changes made to the strand mapping at runtime are applied over the
+// new mapping.  The active profile is retained unless the startup profile was changed
+// or the active profile is no longer defined
+//
+func (gw *Gateway) Reconfigure(strands StrandMap, profiles map[string]Profile, profile string) (err errors.Error) {
+	gw.Lock()
+	gw.Strands = strands
+	// Mappings changed using the topology API are kept over those of the configuration
+	gw.fc.SetStrands(gw.editedStrands())
+	gw.Profiles = profiles
+	active := gw.profile
+	if profile != gw.Profile {
+		gw.Profile = profile
+		active = profile
+	}
+	if _, isPresent := profiles[active]; !isPresent {
+		active = profile
+	}
+	gw.Unlock()
+
+	return gw.SetProfile(active)
+}
+
+// SetPhases replaces the phase offsets of the physical strands while the gateway is running
+//
+func (gw *Gateway) SetPhases(phases Phases) {
+	gw.Lock()
+	gw.Phases = phases
+	gw.Unlock()
+
+	gw.fc.SetPhases(phases)
+}
+
+// SetFirmware replaces the status LED and color correction settings of the fadecandy
+// devices while the gateway is running
+//
+func (gw *Gateway) SetFirmware(firmware *FirmwareConfig) {
+	gw.Lock()
+	gw.Firmware = firmware
+	gw.Unlock()
+
+	gw.fc.SetFirmware(firmware)
+}
+
+// ChangeStats returns the metrics for the detection of changes to the home portal status
+//
+func (gw *Gateway) ChangeStats() (stats ChangeStats) {
+	return gw.fc.ChangeStats()
+}
+
+// Trigger draws a cue from the lighting console over the animations
+//
+func (gw *Gateway) Trigger(cue Cue) {
+	gw.fc.Trigger(cue)
+}
+
+// SetBrightness sets the master brightness of the frames sent, from 0 to 1
+//
+func (gw *Gateway) SetBrightness(level float64) {
+	gw.fc.SetBrightness(level)
+}
+
+// Brightness returns the master brightness of the frames sent
+//
+func (gw *Gateway) Brightness() (level float64) {
+	return gw.fc.Brightness()
+}
+
+// SetPalette switches the faction colors while the gateway is running, nil
+// selecting the standard colors
+//
+func (gw *Gateway) SetPalette(palette *Palette) {
+	gw.Lock()
+	gw.Palette = palette
+	gw.Unlock()
+
+	gw.fc.SetPalette(palette)
+}
+
+// Pause blacks out the strands of the pipeline and closes its connection to the
+// fadecandy server so that hardware can be swapped, the source describes what
+// paused it
+//
+func (gw *Gateway) Pause(source string) (state PauseState, err errors.Error) {
+	return gw.fc.Pause(source)
+}
+
+// Resume reconnects a paused pipeline to the fadecandy server and restarts its sends
+//
+func (gw *Gateway) Resume(source string) (err errors.Error) {
+	return gw.fc.Resume(source)
+}
+
+// PauseState reports whether the sends of the pipeline are paused
+//
+func (gw *Gateway) PauseState() (state PauseState) {
+	return gw.fc.PauseState()
+}
+
+// Display reports which of the portals of the gateway is being displayed
+//
+func (gw *Gateway) Display() (state DisplayState) {
+	return gw.fc.Arbiter().State()
+}
+
+// ShowFrame displays a logical frame in place of the animations for the hold time,
+// the strand mapping and overlays are still applied.  Effect authors use this to
+// see the frames of an effect on the sculpture
+//
+func (gw *Gateway) ShowFrame(frame []animationModel.ChannelData, hold time.Duration) {
+	gw.fc.ShowFrame(frame, hold)
+}
 
-	StartFadeCandy(server, subscribeC, debug, errorC, quitC)
+// Frame waits for the next frame sent to the fadecandy server, the physical strands
+// exactly as they are output, returning an error when none is sent within the timeout
+//
+func (gw *Gateway) Frame(timeout time.Duration) (frame []animationModel.ChannelData, err errors.Error) {
+	sub := gw.Broker.Subscribe(TopicFrames, SubscribeOptions{Name: "frame", Depth: 1, Policy: LatestWins})
+	defer sub.Close()
 
-	return tectC, subscribeC
+	select {
+	case msg := <-sub.C:
+		return msg.([]animationModel.ChannelData), nil
+	case <-time.After(timeout):
+		return nil, errors.New("no frame was sent").With("pipeline", gw.Name).With("timeout", timeout.String()).With("stack", stack.Trace().TrimRuntime())
+	}
 }
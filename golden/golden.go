@@ -0,0 +1,171 @@
+package golden
+
+// This package implements a harness that drives the animation pipeline used by
+// mawt with synthetic portal statuses, at synthetic frame times, and compares the
+// universe buffers produced against golden frame files.  It allows refactoring of
+// the effects and the sequence runner to be checked for unintended visual changes.
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TeamNorCal/mawt"
+	"github.com/TeamNorCal/mawt/model"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// Update applies a portal status at an offset from the start of a scenario
+//
+type Update struct {
+	At     time.Duration
+	Status model.Status
+}
+
+// Scenario is a named series of status updates along with the frame times at
+// which the universe buffers are captured
+//
+type Scenario struct {
+	Name    string
+	Updates []Update
+	Frames  []time.Duration
+}
+
+// Frame is the captured content of all universes at a single offset from the start
+// of a scenario.  Each universe is encoded as a string of space separated RGB hex triples
+//
+type Frame struct {
+	At        time.Duration  `json:"at"`
+	Universes map[int]string `json:"universes"`
+}
+
+// Mismatch describes a single universe that did not match its golden frame
+//
+type Mismatch struct {
+	At       time.Duration
+	Universe int
+	Pixel    int
+	Got      string
+	Want     string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("at %s universe %d pixel %d got %s want %s", m.At, m.Universe, m.Pixel, m.Got, m.Want)
+}
+
+func encodePixels(pixels []color.RGBA) string {
+	hex := make([]string, 0, len(pixels))
+	for _, pixel := range pixels {
+		hex = append(hex, fmt.Sprintf("%02x%02x%02x", pixel.R, pixel.G, pixel.B))
+	}
+	return strings.Join(hex, " ")
+}
+
+func decodePixel(hex string) (pixel color.RGBA, errGo error) {
+	_, errGo = fmt.Sscanf(hex, "%02x%02x%02x", &pixel.R, &pixel.G, &pixel.B)
+	return pixel, errGo
+}
+
+// Render runs the scenario against a fresh animation pipeline and returns the
+// captured frames.  The animation library uses the wall clock when starting effects
+// so the scenario is paced in real time, rather than being fast forwarded
+//
+func Render(scenario *Scenario) (frames []Frame) {
+	sink := mawt.NewSink()
+
+	frames = make([]Frame, 0, len(scenario.Frames))
+	next := 0
+
+	start := time.Now()
+	for _, at := range scenario.Frames {
+		time.Sleep(time.Until(start.Add(at)))
+
+		for ; next < len(scenario.Updates) && scenario.Updates[next].At <= at; next++ {
+			sink.UpdateStatus(scenario.Updates[next].Status.DeepCopy())
+		}
+		frame := Frame{
+			At:        at,
+			Universes: map[int]string{},
+		}
+		for _, data := range sink.GetFrame(start.Add(at)) {
+			frame.Universes[int(data.ChannelNum)] = encodePixels(data.Data)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// Compare checks the frames that were rendered against the golden frames and reports
+// any pixel whose color components differ by more than the tolerance
+//
+func Compare(got []Frame, want []Frame, tolerance uint8) (mismatches []Mismatch) {
+	mismatches = []Mismatch{}
+
+	if len(got) != len(want) {
+		return append(mismatches, Mismatch{Universe: -1, Pixel: -1,
+			Got: fmt.Sprint(len(got), " frames"), Want: fmt.Sprint(len(want), " frames")})
+	}
+
+	within := func(a uint8, b uint8) bool {
+		if a > b {
+			return a-b <= tolerance
+		}
+		return b-a <= tolerance
+	}
+
+	for i, frame := range want {
+		for universe, wantPixels := range frame.Universes {
+			wants := strings.Fields(wantPixels)
+			gots := strings.Fields(got[i].Universes[universe])
+			if len(gots) != len(wants) {
+				mismatches = append(mismatches, Mismatch{At: frame.At, Universe: universe, Pixel: -1,
+					Got: fmt.Sprint(len(gots), " pixels"), Want: fmt.Sprint(len(wants), " pixels")})
+				continue
+			}
+			for pixel := range wants {
+				w, errGo := decodePixel(wants[pixel])
+				g, errGoGot := decodePixel(gots[pixel])
+				if errGo != nil || errGoGot != nil || !within(w.R, g.R) || !within(w.G, g.G) || !within(w.B, g.B) {
+					mismatches = append(mismatches, Mismatch{At: frame.At, Universe: universe, Pixel: pixel,
+						Got: gots[pixel], Want: wants[pixel]})
+				}
+			}
+		}
+	}
+	return mismatches
+}
+
+// Load reads the golden frames for a scenario from the directory
+//
+func Load(dir string, name string) (frames []Frame, err errors.Error) {
+	fn := filepath.Join(dir, name+".json")
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	frames = []Frame{}
+	if errGo = json.Unmarshal(data, &frames); errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return frames, nil
+}
+
+// Save writes the golden frames for a scenario into the directory
+//
+func Save(dir string, name string, frames []Frame) (err errors.Error) {
+	fn := filepath.Join(dir, name+".json")
+	data, errGo := json.MarshalIndent(frames, "", "    ")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = ioutil.WriteFile(fn, append(data, '\n'), 0644); errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
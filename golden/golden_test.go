@@ -0,0 +1,50 @@
+package golden
+
+import (
+	"testing"
+
+	"github.com/TeamNorCal/mawt"
+)
+
+const (
+	// goldenDir holds the golden frame files, relative to the directory of this package
+	goldenDir = "../assets/golden"
+
+	// tolerance is the difference permitted in any color component, matching the default of cmd/golden
+	tolerance = 12
+
+	// maxReport is the number of mismatched pixels reported for each scenario
+	maxReport = 10
+)
+
+// TestScenarios renders every golden scenario and compares the frames against the
+// golden frame files.  The scenarios are paced in real time, taking around 3 seconds
+// each, and so are skipped by go test -short
+//
+func TestScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the golden scenarios are rendered in real time")
+	}
+
+	// The seed used by cmd/golden when the golden frame files were saved
+	mawt.SetSeeds(1, nil)
+
+	for _, scenario := range Scenarios() {
+		scenario := scenario
+		t.Run(scenario.Name, func(t *testing.T) {
+			want, err := Load(goldenDir, scenario.Name)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			mismatches := Compare(Render(scenario), want, tolerance)
+			for i, mismatch := range mismatches {
+				if i == maxReport {
+					t.Errorf("%d further mismatched pixels", len(mismatches)-maxReport)
+					break
+				}
+				t.Error(mismatch.String())
+			}
+		})
+	}
+}
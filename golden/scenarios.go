@@ -0,0 +1,90 @@
+package golden
+
+// This file contains the synthetic portal statuses used to exercise the animations.
+// Transitions into the neutral faction are avoided as the neutral sequence uses
+// random delays
+
+import (
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+)
+
+var (
+	positions = []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+)
+
+// portal builds a synthetic status with resonators at the supplied levels, listed in
+// the order N, NE, E, SE, S, SW, W, NW
+//
+func portal(faction string, health float32, levels ...float32) (status model.Status) {
+	status = model.Status{
+		Title:      "Golden Portal",
+		Faction:    faction,
+		Health:     health,
+		Mods:       []model.Mod{},
+		Resonators: []model.Resonator{},
+	}
+	total := float32(0)
+	for i, level := range levels {
+		status.Resonators = append(status.Resonators, model.Resonator{
+			Position: positions[i],
+			Level:    level,
+			Health:   health,
+			Owner:    "golden",
+		})
+		total += level
+	}
+	status.Level = total / 8
+	return status
+}
+
+// frameTimes returns regularly spaced frame times up to and including the end time
+//
+func frameTimes(interval time.Duration, end time.Duration) (frames []time.Duration) {
+	frames = []time.Duration{}
+	for at := time.Duration(0); at <= end; at += interval {
+		frames = append(frames, at)
+	}
+	return frames
+}
+
+// Scenarios returns the standard set of scenarios that golden frames are kept for
+//
+func Scenarios() (scenarios []*Scenario) {
+	return []*Scenario{
+		{
+			Name: "enl-capture",
+			Updates: []Update{
+				{At: 0, Status: portal("E", 100, 8, 8, 8, 8, 8, 8, 8, 8)},
+			},
+			Frames: frameTimes(250*time.Millisecond, 3*time.Second),
+		},
+		{
+			Name: "res-build",
+			Updates: []Update{
+				{At: 0, Status: portal("R", 100, 1, 1, 1, 1)},
+				{At: 1500 * time.Millisecond, Status: portal("R", 100, 5, 5, 5, 5, 4, 4, 4, 4)},
+			},
+			Frames: frameTimes(250*time.Millisecond, 3*time.Second),
+		},
+		{
+			Name: "resonator-loss",
+			Updates: []Update{
+				{At: 0, Status: portal("E", 100, 6, 6, 6, 6, 6, 6, 6, 6)},
+				{At: time.Second, Status: portal("E", 50, 6, 6, 6, 6, 0, 0, 0, 0)},
+			},
+			Frames: frameTimes(250*time.Millisecond, 2500*time.Millisecond),
+		},
+		{
+			// The waiting pattern is shown until a usable status arrives, statuses
+			// without a faction being those that could not be parsed
+			Name: "never-received",
+			Updates: []Update{
+				{At: time.Second, Status: model.Status{}},
+				{At: 2 * time.Second, Status: portal("E", 100, 8, 8, 8, 8, 8, 8, 8, 8)},
+			},
+			Frames: frameTimes(250*time.Millisecond, 3*time.Second),
+		},
+	}
+}
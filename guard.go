@@ -0,0 +1,248 @@
+package mawt
+
+// This module implements the output guard, the last check made on a frame before it
+// is sent to the fadecandy server.  A bug in an effect, a show authored without
+// thinking about power or a bad OPC client can drive every LED to full white, which
+// draws far more current than the power supplies of most sculptures are sized for
+// and can brown out the fadecandy boards or overheat the wiring.  The guard clamps
+// the colors of every pixel to a ceiling, and measures each frame as a share of full
+// white on every LED.  Frames over the limit are an incident, logged and recorded
+// as a guard event, and are either scaled down to the limit or, when the guard
+// requires confirmation, sent dark until an operator confirms that the frames are
+// intended
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultGuardLimit = 0.8
+)
+
+// GuardConfig defines the checks made on the frames of a pipeline before they are sent
+//
+type GuardConfig struct {
+	MaxLevel float64 `yaml:"maxLevel" json:"maxLevel"` // The highest level of each color of a pixel, from 0 to 1, defaults to 1
+	Limit    float64 `yaml:"limit" json:"limit"`       // The share of full white on every LED above which a frame is abnormal, defaults to 0.8
+	Action   string  `yaml:"action" json:"action"`     // scale or confirm, frames over the limit being scaled down or sent dark until confirmed, scale when empty
+}
+
+// Guard clamps the pixels of the frames of a pipeline and acts on frames over the limit
+//
+type Guard struct {
+	config    GuardConfig
+	pipeline  string
+	ceiling   uint8
+	frame     []animationModel.ChannelData // Reused for the frames the guard changes
+	load      float64                      // The share of full white of the last frame, before it was scaled down
+	peak      float64                      // The highest share of full white of the current or last incident
+	over      bool                         // Set while the frames are over the limit
+	since     time.Time                    // When the current or last incident began
+	incidents uint64
+	clamped   uint64 // The colors of pixels clamped to the ceiling
+	confirmed string // Who confirmed that frames over the limit are intended, empty while the guard is armed
+	sync.Mutex
+}
+
+// GuardReport describes the frames checked by the guard of a pipeline
+//
+type GuardReport struct {
+	Action    string    `json:"action"`
+	MaxLevel  float64   `json:"maxLevel"`
+	Limit     float64   `json:"limit"`
+	Load      float64   `json:"load"`      // The share of full white of the last frame, before it was scaled down
+	Peak      float64   `json:"peak"`      // The highest share of full white of the current or last incident
+	Over      bool      `json:"over"`      // Set while the frames are over the limit
+	Since     time.Time `json:"since"`     // When the current or last incident began
+	Incidents uint64    `json:"incidents"` // The times the frames have gone over the limit
+	Clamped   uint64    `json:"clamped"`   // The colors of pixels clamped to the maximum level
+	Confirmed string    `json:"confirmed,omitempty"`
+}
+
+// NewGuard validates the configuration of the output guard, supplying the defaults
+//
+func NewGuard(config GuardConfig) (guard *Guard, err errors.Error) {
+	if config.MaxLevel == 0 {
+		config.MaxLevel = 1
+	}
+	if config.MaxLevel < 0 || config.MaxLevel > 1 {
+		return nil, errors.New("the guard maximum level must be from 0 to 1").With("maxLevel", config.MaxLevel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Limit == 0 {
+		config.Limit = defaultGuardLimit
+	}
+	if config.Limit < 0 || config.Limit > 1 {
+		return nil, errors.New("the guard limit must be from 0 to 1").With("limit", config.Limit).With("stack", stack.Trace().TrimRuntime())
+	}
+	switch config.Action {
+	case "":
+		config.Action = "scale"
+	case "scale", "confirm":
+	default:
+		return nil, errors.New("unknown guard action, scale and confirm are supported").With("action", config.Action).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &Guard{config: config, ceiling: uint8(math.Round(config.MaxLevel * 255))}, nil
+}
+
+// Check clamps the pixels of a frame to the maximum level and scales down, or
+// blacks out, a frame over the limit.  Frames needing no changes are returned as
+// they are, others are copied into a buffer reused for the next frame
+//
+func (guard *Guard) Check(frame []animationModel.ChannelData, now time.Time, errorC chan<- errors.Error) (checked []animationModel.ChannelData) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	ceiling := guard.ceiling
+	total, clamped, pixels := 0, 0, 0
+	for _, strand := range frame {
+		pixels += len(strand.Data)
+		for _, pixel := range strand.Data {
+			if pixel.A == 0 {
+				continue
+			}
+			for _, level := range [...]uint8{pixel.R, pixel.G, pixel.B} {
+				if level > ceiling {
+					level = ceiling
+					clamped++
+				}
+				total += int(level)
+			}
+		}
+	}
+	guard.clamped += uint64(clamped)
+
+	guard.load = 0
+	if pixels != 0 {
+		guard.load = float64(total) / float64(pixels*3*255)
+	}
+	over := guard.load > guard.config.Limit
+	guard.incident(over, now, errorC)
+
+	scale := 1.0
+	if over && len(guard.confirmed) == 0 {
+		if guard.config.Action == "confirm" {
+			scale = 0
+		} else {
+			scale = guard.config.Limit / guard.load
+		}
+	}
+	if clamped == 0 && scale == 1 {
+		return frame
+	}
+
+	if len(guard.frame) != len(frame) {
+		guard.frame = make([]animationModel.ChannelData, len(frame))
+	}
+	for i, strand := range frame {
+		data := guard.frame[i].Data
+		if cap(data) < len(strand.Data) {
+			data = make([]color.RGBA, len(strand.Data))
+		}
+		data = data[:len(strand.Data)]
+		for j, pixel := range strand.Data {
+			if pixel.A == 0 {
+				data[j] = pixel
+				continue
+			}
+			data[j] = color.RGBA{
+				R: uint8(float64(minLevel(pixel.R, ceiling))*scale + 0.5),
+				G: uint8(float64(minLevel(pixel.G, ceiling))*scale + 0.5),
+				B: uint8(float64(minLevel(pixel.B, ceiling))*scale + 0.5),
+				A: pixel.A,
+			}
+		}
+		guard.frame[i] = animationModel.ChannelData{ChannelNum: strand.ChannelNum, Data: data}
+	}
+	return guard.frame
+}
+
+func minLevel(level uint8, ceiling uint8) (clamped uint8) {
+	if level > ceiling {
+		return ceiling
+	}
+	return level
+}
+
+// incident records the frames going over, and coming back under, the limit
+//
+func (guard *Guard) incident(over bool, now time.Time, errorC chan<- errors.Error) {
+	switch {
+	case over && !guard.over:
+		guard.over, guard.since, guard.peak = true, now, guard.load
+		guard.incidents++
+
+		action := "scaled down to the limit"
+		switch {
+		case len(guard.confirmed) != 0:
+			action = "sent as confirmed by " + guard.confirmed
+		case guard.config.Action == "confirm":
+			action = "sent dark until confirmed"
+		}
+		detail := fmt.Sprintf("frame at %.0f%% of full white is over the limit of %.0f%%, %s", guard.load*100, guard.config.Limit*100, action)
+		bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: guard.pipeline, Kind: "guard", Detail: detail})
+		sendErr(errorC, errors.New("abnormal frame, "+detail).With("pipeline", guard.pipeline).With("stack", stack.Trace().TrimRuntime()))
+
+	case over:
+		guard.peak = math.Max(guard.peak, guard.load)
+
+	case guard.over:
+		guard.over = false
+		bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: guard.pipeline, Kind: "guard",
+			Detail: fmt.Sprintf("frames back under the limit after %s, peaking at %.0f%% of full white", now.Sub(guard.since).Round(time.Second), guard.peak*100)})
+	}
+}
+
+// Confirm lets frames over the limit be sent unchanged, for shows that are meant to
+// be that bright, until the guard is armed again
+//
+func (guard *Guard) Confirm(source string) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	if len(guard.confirmed) != 0 {
+		return
+	}
+	guard.confirmed = source
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: guard.pipeline, Kind: "guard", Detail: "frames over the limit confirmed by " + source})
+}
+
+// Arm withdraws a confirmation, frames over the limit being acted on again
+//
+func (guard *Guard) Arm(source string) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	if len(guard.confirmed) == 0 {
+		return
+	}
+	guard.confirmed = ""
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: guard.pipeline, Kind: "guard", Detail: "armed by " + source})
+}
+
+// Report describes the frames checked by the guard
+//
+func (guard *Guard) Report() (report GuardReport) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	return GuardReport{
+		Action:    guard.config.Action,
+		MaxLevel:  guard.config.MaxLevel,
+		Limit:     guard.config.Limit,
+		Load:      guard.load,
+		Peak:      guard.peak,
+		Over:      guard.over,
+		Since:     guard.since,
+		Incidents: guard.incidents,
+		Clamped:   guard.clamped,
+		Confirmed: guard.confirmed,
+	}
+}
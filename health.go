@@ -0,0 +1,186 @@
+package mawt
+
+// This module tracks the operational health of the gateway, that is whether
+// the fadecandy server is accepting frames, whether the tecthulhus are
+// reachable and whether any of the processing loops have been panicing
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+type Health struct {
+	opcOK      time.Time            // The last time a frame was successfully sent to the OPC server
+	opcFailing time.Time            // The time at which OPC sends started failing, zero when healthy
+	opcFrames  uint64               // The number of frames sent successfully since the gateway started
+	portals    map[string]time.Time // The time of the last successful status check for each tecthulhu, zero if never
+	panics     []time.Time          // The times at which recent panics were recovered
+	started    time.Time            // When the health started being tracked
+	sync.Mutex
+}
+
+// NewHealth creates an empty health tracker, each pipeline has its own
+//
+func NewHealth() (health *Health) {
+	return &Health{
+		portals: map[string]time.Time{},
+		panics:  []time.Time{},
+		started: time.Now(),
+	}
+}
+
+// HealthSnapshot is a point in time copy of the health information that can be
+// reported as JSON
+//
+type HealthSnapshot struct {
+	OPCLastSent  time.Time            `json:"opcLastSent"`
+	OPCOffline   string               `json:"opcOffline"`
+	Portals      map[string]time.Time `json:"portals"`
+	RecentPanics int                  `json:"recentPanics"`
+}
+
+// Snapshot returns a copy of the current health information
+//
+func (health *Health) Snapshot() (snapshot *HealthSnapshot) {
+	offline := health.OPCOffline()
+	panics := health.RecentPanics(panicWindow)
+
+	health.Lock()
+	defer health.Unlock()
+
+	snapshot = &HealthSnapshot{
+		OPCLastSent:  health.opcOK,
+		OPCOffline:   offline.Round(time.Second).String(),
+		Portals:      make(map[string]time.Time, len(health.portals)),
+		RecentPanics: panics,
+	}
+	for portal, lastOK := range health.portals {
+		snapshot.Portals[portal] = lastOK
+	}
+	return snapshot
+}
+
+func (health *Health) opcSent(err errors.Error) {
+	health.Lock()
+	defer health.Unlock()
+
+	if err == nil {
+		health.opcOK = time.Now()
+		health.opcFailing = time.Time{}
+		health.opcFrames++
+		return
+	}
+	if health.opcFailing.IsZero() {
+		health.opcFailing = time.Now()
+	}
+}
+
+func (health *Health) portalAdded(portal string) {
+	health.Lock()
+	defer health.Unlock()
+
+	if _, isPresent := health.portals[portal]; !isPresent {
+		health.portals[portal] = time.Time{}
+	}
+}
+
+func (health *Health) portalChecked(portal string, err errors.Error) {
+	health.Lock()
+	defer health.Unlock()
+
+	if err == nil {
+		health.portals[portal] = time.Now()
+		return
+	}
+	if _, isPresent := health.portals[portal]; !isPresent {
+		health.portals[portal] = time.Time{}
+	}
+}
+
+func (health *Health) panicked() {
+	health.Lock()
+	defer health.Unlock()
+
+	health.panics = append(health.panics, time.Now())
+}
+
+// OPCOffline returns the duration for which sends to the OPC server have been failing
+//
+func (health *Health) OPCOffline() (offline time.Duration) {
+	health.Lock()
+	defer health.Unlock()
+
+	if health.opcFailing.IsZero() {
+		return 0
+	}
+	return time.Since(health.opcFailing)
+}
+
+// FramesSent returns the number of frames successfully sent to the OPC server
+//
+func (health *Health) FramesSent() (frames uint64) {
+	health.Lock()
+	defer health.Unlock()
+
+	return health.opcFrames
+}
+
+// PortalsUnreachable returns true when there are tecthulhus being polled and none
+// have been successfully checked within the supplied window
+//
+func (health *Health) PortalsUnreachable(window time.Duration) (unreachable bool) {
+	health.Lock()
+	defer health.Unlock()
+
+	if len(health.portals) == 0 {
+		return false
+	}
+	for _, lastOK := range health.portals {
+		if time.Since(lastOK) < window {
+			return false
+		}
+	}
+	return true
+}
+
+// RecentPanics returns the number of panics recovered within the supplied window
+//
+func (health *Health) RecentPanics(window time.Duration) (count int) {
+	health.Lock()
+	defer health.Unlock()
+
+	// Groom out the panics that are older than the window
+	recent := health.panics[:0]
+	for _, tm := range health.panics {
+		if time.Since(tm) < window {
+			recent = append(recent, tm)
+		}
+	}
+	health.panics = recent
+	return len(recent)
+}
+
+// recoverPanic is deferred by processing loops that should survive a panic, the panic
+// is counted and then reported as an error
+//
+func recoverPanic(health *Health, errorC chan<- errors.Error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	health.panicked()
+
+	err := errors.New(fmt.Sprint("recovered from panic ", r)).With("trace", string(debug.Stack())).With("stack", stack.Trace().TrimRuntime())
+	if errorC == nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	sendErr(errorC, err)
+}
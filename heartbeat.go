@@ -0,0 +1,156 @@
+package mawt
+
+// This module implements the heartbeat, the base animation of a portal that is
+// holding steady.  Once the displayed portal has gone without changing for an
+// idle period the frames pulse with a double beat, the pulse rate following
+// the health of the portal and the depth of the pulse following the number of
+// resonators deployed, so that a glance at a quiet portal still tells the
+// players something about it
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// HeartbeatCurve maps an input, scaled to the range 0 to 1, onto an output
+//
+type HeartbeatCurve struct {
+	From  float64 `yaml:"from" json:"from"`   // The output for the lowest input
+	To    float64 `yaml:"to" json:"to"`       // The output for the highest input
+	Shape string  `yaml:"shape" json:"shape"` // linear, ease-in or ease-out, linear when empty
+}
+
+// HeartbeatConfig defines the heartbeat shown while the displayed portal is steady
+//
+type HeartbeatConfig struct {
+	Disabled  bool           `yaml:"disabled" json:"disabled"`
+	Idle      time.Duration  `yaml:"idle" json:"idle"`           // The time without changes before the heartbeat starts, defaults to 10s
+	Rate      HeartbeatCurve `yaml:"rate" json:"rate"`           // Beats per minute by portal health, defaults to 90 falling to 50 at full health
+	Amplitude HeartbeatCurve `yaml:"amplitude" json:"amplitude"` // The depth of the pulse by resonator count, defaults to 0.1 rising to 0.5 with 8 resonators
+}
+
+// Heartbeat tracks the steadiness of the displayed portal and computes the pulse
+//
+type Heartbeat struct {
+	config  HeartbeatConfig
+	status  *model.Status
+	changed time.Time // When the displayed portal last changed
+	phase   float64   // The position within the current beat, from 0 to 1
+	last    time.Time // When the phase was last advanced
+	sync.Mutex
+}
+
+// NewHeartbeat validates the heartbeat configuration, returning nil when it is disabled
+//
+func NewHeartbeat(config HeartbeatConfig) (heartbeat *Heartbeat, err errors.Error) {
+	if config.Idle < 0 {
+		return nil, errors.New("the heartbeat idle time cannot be negative").With("idle", config.Idle).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Idle == 0 {
+		config.Idle = 10 * time.Second
+	}
+	if config.Rate.From == 0 && config.Rate.To == 0 {
+		config.Rate.From, config.Rate.To = 90, 50
+	}
+	if config.Amplitude.From == 0 && config.Amplitude.To == 0 {
+		config.Amplitude.From, config.Amplitude.To = 0.1, 0.5
+	}
+
+	for name, curve := range map[string]HeartbeatCurve{"rate": config.Rate, "amplitude": config.Amplitude} {
+		switch curve.Shape {
+		case "", "linear", "ease-in", "ease-out":
+		default:
+			return nil, errors.New("unknown heartbeat curve shape, linear, ease-in and ease-out are supported").With("curve", name).With("shape", curve.Shape).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if config.Rate.From < 0 || config.Rate.From > 240 || config.Rate.To < 0 || config.Rate.To > 240 {
+		return nil, errors.New("the heartbeat rate must be from 0 to 240 beats per minute").With("from", config.Rate.From).With("to", config.Rate.To).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Amplitude.From < 0 || config.Amplitude.From > 1 || config.Amplitude.To < 0 || config.Amplitude.To > 1 {
+		return nil, errors.New("the heartbeat amplitude must be from 0 to 1").With("from", config.Amplitude.From).With("to", config.Amplitude.To).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if config.Disabled {
+		return nil, nil
+	}
+	return &Heartbeat{config: config}, nil
+}
+
+// apply maps an input from 0 to 1 through the curve
+//
+func (curve HeartbeatCurve) apply(input float64) (output float64) {
+	input = math.Max(0, math.Min(1, input))
+	switch curve.Shape {
+	case "ease-in":
+		input = input * input
+	case "ease-out":
+		input = math.Sqrt(input)
+	}
+	return curve.From + (curve.To-curve.From)*input
+}
+
+// Update records the status of the displayed portal, a status that differs from
+// the last restarts the idle period
+//
+func (heartbeat *Heartbeat) Update(status *model.Status, now time.Time) {
+	heartbeat.Lock()
+	defer heartbeat.Unlock()
+
+	if heartbeat.status == nil || len(deriveEvents(heartbeat.status, status, true, now)) != 0 {
+		heartbeat.changed = now
+	}
+	heartbeat.status = status
+}
+
+// Level returns the brightness of the frame at the supplied time, 1 when the
+// portal is not steady
+//
+func (heartbeat *Heartbeat) Level(now time.Time) (level float64) {
+	heartbeat.Lock()
+	defer heartbeat.Unlock()
+
+	elapsed := now.Sub(heartbeat.last)
+	heartbeat.last = now
+
+	if heartbeat.status == nil {
+		return 1
+	}
+	steady := now.Sub(heartbeat.changed) - heartbeat.config.Idle
+	if steady <= 0 {
+		heartbeat.phase = 0
+		return 1
+	}
+
+	resonators := 0
+	for _, resonator := range heartbeat.status.Resonators {
+		if resonator.Level > 0 {
+			resonators++
+		}
+	}
+	rate := heartbeat.config.Rate.apply(float64(heartbeat.status.Health) / maxHealth)
+	amplitude := heartbeat.config.Amplitude.apply(float64(resonators) / maxResonators)
+
+	// The phase is advanced rather than computed from the time so that changes
+	// in the rate do not make the pulse jump
+	if elapsed > 0 && elapsed < time.Second {
+		heartbeat.phase = math.Mod(heartbeat.phase+elapsed.Minutes()*rate, 1)
+	}
+
+	// The pulse fades in over the first second so the heartbeat does not start abruptly
+	if steady < time.Second {
+		amplitude *= float64(steady) / float64(time.Second)
+	}
+
+	// A strong beat followed by a weaker one, each a narrow gaussian bump
+	bump := func(center float64, width float64) float64 {
+		d := (heartbeat.phase - center) / width
+		return math.Exp(-d * d)
+	}
+	pulse := math.Min(1, bump(0.08, 0.05)+0.6*bump(0.3, 0.05))
+	return 1 - amplitude*(1-pulse)
+}
@@ -0,0 +1,142 @@
+package mawt
+
+// This module implements a bounded in-memory history of the portal status
+// messages seen by the gateway along with the events derived from them.  It
+// allows operators to look back at what happened without any external
+// logging infrastructure
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+)
+
+// HistoryEntry is a single portal status observation along with the events that
+// were derived by comparing it with the previous observation of the same portal
+//
+type HistoryEntry struct {
+	Time   time.Time    `json:"time"`
+	Home   bool         `json:"home"`
+	Status model.Status `json:"status"`
+	Events []Event      `json:"events,omitempty"`
+}
+
+// History is a ring buffer of the most recent portal status history entries
+//
+type History struct {
+	entries []HistoryEntry
+	next    int  // The slot that the next entry will be written to
+	full    bool // Set once the ring has wrapped
+	last    map[string]*model.Status
+	sync.Mutex
+}
+
+// NewHistory creates a history ring buffer that retains up to depth entries
+//
+func NewHistory(depth int) (history *History) {
+	if depth < 1 {
+		depth = 1
+	}
+	return &History{
+		entries: make([]HistoryEntry, depth),
+		last:    map[string]*model.Status{},
+	}
+}
+
+// Add records a portal status message in the history, returning the events
+// derived from it
+//
+func (history *History) Add(msg *model.PortalMsg, tm time.Time) (events []Event) {
+	if msg == nil {
+		return []Event{}
+	}
+
+	status := msg.Status.DeepCopy()
+
+	history.Lock()
+	defer history.Unlock()
+
+	events = deriveEvents(history.last[status.Title], status, msg.Home, tm)
+	history.last[status.Title] = status
+
+	history.entries[history.next] = HistoryEntry{
+		Time:   tm,
+		Home:   msg.Home,
+		Status: *status,
+		Events: events,
+	}
+	history.next = (history.next + 1) % len(history.entries)
+	if history.next == 0 {
+		history.full = true
+	}
+	return events
+}
+
+// Since returns the history entries recorded after the supplied time in the
+// order they were recorded
+//
+func (history *History) Since(since time.Time) (entries []HistoryEntry) {
+	history.Lock()
+	defer history.Unlock()
+
+	entries = []HistoryEntry{}
+
+	start := 0
+	count := history.next
+	if history.full {
+		start = history.next
+		count = len(history.entries)
+	}
+	for i := 0; i != count; i++ {
+		entry := history.entries[(start+i)%len(history.entries)]
+		if entry.Time.After(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Latest returns the most recent status of the home portal, or of any portal when
+// home is false, nil being returned when there is none
+//
+func (history *History) Latest(home bool) (status *model.Status) {
+	history.Lock()
+	defer history.Unlock()
+
+	count := history.next
+	if history.full {
+		count = len(history.entries)
+	}
+	for i := 1; i <= count; i++ {
+		entry := history.entries[(history.next-i+len(history.entries))%len(history.entries)]
+		if entry.Home || !home {
+			return entry.Status.DeepCopy()
+		}
+	}
+	return nil
+}
+
+// startHistory subscribes to the portal status messages and records them
+// into the history until the quitC channel is closed
+//
+func startHistory(history *History, pipeline string, broker *Broker, quitC <-chan struct{}) {
+
+	sub := broker.Subscribe(TopicStatus, SubscribeOptions{Name: "history", Depth: 32, Policy: LatestWins})
+
+	go func() {
+		defer track("history")()
+		defer sub.Close()
+		for {
+			select {
+			case msg := <-sub.C:
+				for _, event := range history.Add(msg.(*model.PortalMsg), time.Now()) {
+					event.Pipeline = pipeline
+					bus.Publish(TopicEvents, event)
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,199 @@
+package mawt
+
+// This module holds the translations of the messages shown to operators by the
+// terminal preview and the web pages of the gateway.  Anomaly crews are
+// international and instructions read under pressure are best read in the
+// language of the operator, so the messages are looked up by key in a catalog
+// for the language chosen on startup, with the web pages instead following the
+// language preferences of the browser.  Messages missing from a catalog fall back
+// to English.  Log entries, events and errors remain in English so that they can
+// be searched and compared across installs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	DefaultLanguage = "en"
+)
+
+var (
+	// catalogs holds the messages of each language by key, the English catalog
+	// having every key
+	catalogs = map[string]map[string]string{
+		"en": {
+			"annotation.prompt":   "annotation: %s",
+			"annotation.recorded": "annotation recorded",
+			"annotation.failed":   "annotation not recorded, %s",
+			"speed.changed":       "animations at %gx",
+			"speed.failed":        "speed not changed, %s",
+			"home.changed":        "home portal %s",
+			"home.failed":         "home portal not changed, %s",
+			"home.none":           "no other portal to make the home portal",
+			"scene.active":        "scene %s until %s",
+			"scene.resumed":       "animations resumed",
+			"scene.failed":        "scene not changed, %s",
+			"preview.frames":      "%8d frames %6.2fms",
+			"preview.errors":      "%d errors",
+			"editor.title":        "mawt configuration",
+			"editor.revert":       "Revert",
+			"editor.validate":     "Validate",
+			"editor.save":         "Save and reload",
+			"editor.reload":       "Reload",
+			"editor.saved":        "saved",
+			"editor.valid":        "valid",
+			"editor.reloaded":     "reloaded, changes other than to strands and profiles take effect on restart",
+		},
+		"ja": {
+			"annotation.prompt":   "注記: %s",
+			"annotation.recorded": "注記を記録しました",
+			"annotation.failed":   "注記を記録できませんでした、%s",
+			"speed.changed":       "アニメーション速度 %gx",
+			"speed.failed":        "速度を変更できませんでした、%s",
+			"home.changed":        "ホームポータル %s",
+			"home.failed":         "ホームポータルを変更できませんでした、%s",
+			"home.none":           "ホームポータルにできる他のポータルがありません",
+			"scene.active":        "シーン %s（%s まで）",
+			"scene.resumed":       "アニメーションを再開しました",
+			"scene.failed":        "シーンを変更できませんでした、%s",
+			"preview.frames":      "%8d フレーム %6.2fms",
+			"preview.errors":      "エラー %d 件",
+			"editor.title":        "mawt 設定",
+			"editor.revert":       "元に戻す",
+			"editor.validate":     "検証",
+			"editor.save":         "保存して再読み込み",
+			"editor.reload":       "再読み込み",
+			"editor.saved":        "保存しました",
+			"editor.valid":        "有効です",
+			"editor.reloaded":     "再読み込みしました。ストランドとプロファイル以外の変更は再起動後に反映されます",
+		},
+		"de": {
+			"annotation.prompt":   "Notiz: %s",
+			"annotation.recorded": "Notiz gespeichert",
+			"annotation.failed":   "Notiz nicht gespeichert, %s",
+			"speed.changed":       "Animationen mit %gx",
+			"speed.failed":        "Geschwindigkeit nicht geändert, %s",
+			"home.changed":        "Heimportal %s",
+			"home.failed":         "Heimportal nicht geändert, %s",
+			"home.none":           "kein anderes Portal kann Heimportal werden",
+			"scene.active":        "Szene %s bis %s",
+			"scene.resumed":       "Animationen fortgesetzt",
+			"scene.failed":        "Szene nicht geändert, %s",
+			"preview.frames":      "%8d Frames %6.2fms",
+			"preview.errors":      "%d Fehler",
+			"editor.title":        "mawt-Konfiguration",
+			"editor.revert":       "Verwerfen",
+			"editor.validate":     "Prüfen",
+			"editor.save":         "Speichern und neu laden",
+			"editor.reload":       "Neu laden",
+			"editor.saved":        "gespeichert",
+			"editor.valid":        "gültig",
+			"editor.reloaded":     "neu geladen, Änderungen außer an Strängen und Profilen werden nach einem Neustart wirksam",
+		},
+	}
+
+	// language is the language of the messages shown by the terminal preview
+	language = struct {
+		name string
+		sync.Mutex
+	}{name: DefaultLanguage}
+)
+
+// Languages returns the languages messages are translated into
+//
+func Languages() (languages []string) {
+	for name := range catalogs {
+		languages = append(languages, name)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// MatchLanguage returns the first supported language of a list of preferences,
+// such as a locale like ja_JP.UTF-8, a LANGUAGE list like de:en or the
+// Accept-Language header of a browser, false being returned when none of them are
+// supported
+//
+func MatchLanguage(preferences string) (name string, isSupported bool) {
+	for _, preference := range strings.FieldsFunc(preferences, func(r rune) bool { return r == ',' || r == ':' }) {
+		// Quality values are ignored as browsers list languages in order
+		preference = strings.TrimSpace(strings.SplitN(preference, ";", 2)[0])
+		if i := strings.IndexAny(preference, "-_.@"); i >= 0 {
+			preference = preference[:i]
+		}
+		preference = strings.ToLower(preference)
+		if _, isPresent := catalogs[preference]; isPresent {
+			return preference, true
+		}
+	}
+	return DefaultLanguage, false
+}
+
+// SetLanguage chooses the language of the messages shown by the terminal preview,
+// given as a language code or a locale
+//
+func SetLanguage(preferences string) (err errors.Error) {
+	name, isSupported := MatchLanguage(preferences)
+	if !isSupported {
+		return errors.New("unsupported language").With("language", preferences).With("languages", strings.Join(Languages(), ",")).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	language.Lock()
+	defer language.Unlock()
+
+	language.name = name
+	return nil
+}
+
+// Language returns the language of the messages shown by the terminal preview
+//
+func Language() (name string) {
+	language.Lock()
+	defer language.Unlock()
+
+	return language.name
+}
+
+// Messages returns the messages of a language by key, including those falling back
+// to English
+//
+func Messages(name string) (messages map[string]string) {
+	messages = make(map[string]string, len(catalogs[DefaultLanguage]))
+	for key, message := range catalogs[DefaultLanguage] {
+		messages[key] = message
+	}
+	for key, message := range catalogs[name] {
+		messages[key] = message
+	}
+	return messages
+}
+
+// Text returns the message for a key in the language of the terminal preview,
+// formatted using the arguments supplied
+//
+func Text(key string, args ...interface{}) (text string) {
+	return TextIn(Language(), key, args...)
+}
+
+// TextIn returns the message for a key in a language, formatted using the
+// arguments supplied.  Keys missing from the catalog of the language use the
+// English message, and unknown keys are returned as they are
+//
+func TextIn(name string, key string, args ...interface{}) (text string) {
+	format, isPresent := catalogs[name][key]
+	if !isPresent {
+		if format, isPresent = catalogs[DefaultLanguage][key]; !isPresent {
+			format = key
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,251 @@
+package mawt
+
+// This module implements the playback of PNG images and animated GIFs on LED
+// matrix panels, so that event branding and faction logos can be shown.  The
+// assets are scaled to the panel once when loaded, averaging the pixels that
+// fall within each LED, and played as an effect of the sequence runner
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	_ "image/png" // Registers the PNG decoder used by image.Decode
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	imageStill = time.Second // The length of the single frame of a still image
+)
+
+// ImageAsset is an image, or the frames of an animated GIF, scaled to a matrix panel
+//
+type ImageAsset struct {
+	frames [][]color.RGBA // Row by row from the top left of the panel
+	delays []time.Duration
+	total  time.Duration
+}
+
+var (
+	imageAssets = struct {
+		assets map[string]*ImageAsset // Keyed by the file, panel size and scaling
+		sync.Mutex
+	}{
+		assets: map[string]*ImageAsset{},
+	}
+)
+
+// LoadImage decodes a PNG or GIF file and scales its frames to a panel of the given
+// size.  fit scales the image to fit within the panel, fill scales it to cover the
+// panel cropping the excess, stretch ignores the aspect ratio and none draws the
+// image centred at its own size.  Assets are cached so they can be played repeatedly
+//
+func LoadImage(fn string, width int, height int, scale string) (asset *ImageAsset, err errors.Error) {
+	switch scale {
+	case "fit", "fill", "stretch", "none":
+	default:
+		return nil, errors.New("unknown image scaling, fit, fill, stretch and none are supported").With("scale", scale).With("stack", stack.Trace().TrimRuntime())
+	}
+	if width < 1 || height < 1 {
+		return nil, errors.New("images need a panel with at least one row and column").With("width", width).With("height", height).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	key := fmt.Sprintf("%s %dx%d %s", fn, width, height, scale)
+	imageAssets.Lock()
+	defer imageAssets.Unlock()
+	if asset, isPresent := imageAssets.assets[key]; isPresent {
+		return asset, nil
+	}
+
+	frames, delays, err := decodeImage(fn)
+	if err != nil {
+		return nil, err
+	}
+	asset = &ImageAsset{
+		frames: make([][]color.RGBA, 0, len(frames)),
+		delays: delays,
+	}
+	for i, frame := range frames {
+		asset.frames = append(asset.frames, scaleImage(frame, width, height, scale))
+		asset.total += delays[i]
+	}
+	imageAssets.assets[key] = asset
+	return asset, nil
+}
+
+// decodeImage reads the frames of an image file along with the time each is shown,
+// the frames of GIFs are composited following their disposal methods
+//
+func decodeImage(fn string) (frames []image.Image, delays []time.Duration, err errors.Error) {
+	file, errGo := os.Open(fn)
+	if errGo != nil {
+		return nil, nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer file.Close()
+
+	if !strings.EqualFold(filepath.Ext(fn), ".gif") {
+		img, _, errGo := image.Decode(file)
+		if errGo != nil {
+			return nil, nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		return []image.Image{img}, []time.Duration{imageStill}, nil
+	}
+
+	anim, errGo := gif.DecodeAll(file)
+	if errGo != nil {
+		return nil, nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	for i, paletted := range anim.Image {
+		previous := image.NewRGBA(bounds)
+		copy(previous.Pix, canvas.Pix)
+
+		draw.Draw(canvas, paletted.Bounds(), paletted, paletted.Bounds().Min, draw.Over)
+		frame := image.NewRGBA(bounds)
+		copy(frame.Pix, canvas.Pix)
+		frames = append(frames, frame)
+
+		// Browsers treat very short delays as 100ms, as do we
+		delay := time.Duration(anim.Delay[i]) * 10 * time.Millisecond
+		if delay < 20*time.Millisecond {
+			delay = 100 * time.Millisecond
+		}
+		delays = append(delays, delay)
+
+		if i < len(anim.Disposal) {
+			switch anim.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, paletted.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+	if len(frames) == 0 {
+		return nil, nil, errors.New("the GIF has no frames").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return frames, delays, nil
+}
+
+// scaleImage scales an image onto the pixels of a panel, each pixel being the average
+// of the area of the image it covers.  Transparent areas and areas of the panel the
+// image does not cover are black
+//
+func scaleImage(img image.Image, width int, height int, scale string) (pixels []color.RGBA) {
+	bounds := img.Bounds()
+	sx := float64(width) / float64(bounds.Dx())
+	sy := float64(height) / float64(bounds.Dy())
+	switch scale {
+	case "fit":
+		sx = math.Min(sx, sy)
+		sy = sx
+	case "fill":
+		sx = math.Max(sx, sy)
+		sy = sx
+	case "none":
+		sx, sy = 1, 1
+	}
+	// The position of the scaled image on the panel, centred
+	ox := (float64(width) - float64(bounds.Dx())*sx) / 2
+	oy := (float64(height) - float64(bounds.Dy())*sy) / 2
+
+	pixels = make([]color.RGBA, width*height)
+	for y := 0; y != height; y++ {
+		top := int(math.Floor((float64(y) - oy) / sy))
+		bottom := int(math.Ceil((float64(y+1) - oy) / sy))
+		for x := 0; x != width; x++ {
+			left := int(math.Floor((float64(x) - ox) / sx))
+			right := int(math.Ceil((float64(x+1) - ox) / sx))
+
+			var r, g, b, n uint32
+			for iy := top; iy < bottom; iy++ {
+				if iy < 0 || iy >= bounds.Dy() {
+					continue
+				}
+				for ix := left; ix < right; ix++ {
+					if ix < 0 || ix >= bounds.Dx() {
+						continue
+					}
+					// Premultiplied, so transparent pixels blend towards black
+					c := color.RGBAModel.Convert(img.At(bounds.Min.X+ix, bounds.Min.Y+iy)).(color.RGBA)
+					r, g, b = r+uint32(c.R), g+uint32(c.G), b+uint32(c.B)
+					n++
+				}
+			}
+			if n > 0 {
+				pixels[y*width+x] = color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 0xff}
+			}
+		}
+	}
+	return pixels
+}
+
+// ImageEffect plays an image asset on a matrix panel as an effect of the sequence runner
+//
+type ImageEffect struct {
+	asset  *ImageAsset
+	matrix *Matrix
+	loops  int // The number of times an animation plays before completing, 0 plays it forever
+	start  time.Time
+}
+
+// NewImageEffect creates an effect playing an asset scaled to the matrix panel
+//
+func NewImageEffect(asset *ImageAsset, matrix *Matrix, loops int) (effect *ImageEffect) {
+	return &ImageEffect{asset: asset, matrix: matrix, loops: loops}
+}
+
+// Start implements the Effect interface of the sequence runner
+//
+func (effect *ImageEffect) Start(startTime time.Time) {
+	effect.start = startTime
+}
+
+// Frame implements the Effect interface of the sequence runner, completing once
+// the animation has played the configured number of times.  Pixels beyond the end
+// of the universe are dropped
+//
+func (effect *ImageEffect) Frame(buf []color.RGBA, frameTime time.Time) (output []color.RGBA, endSeq bool) {
+	elapsed := frameTime.Sub(effect.start)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	frame := len(effect.asset.frames) - 1
+	if effect.loops == 0 || elapsed < time.Duration(effect.loops)*effect.asset.total {
+		within := elapsed % effect.asset.total
+		for i, delay := range effect.asset.delays {
+			if within < delay {
+				frame = i
+				break
+			}
+			within -= delay
+		}
+	} else {
+		endSeq = true
+	}
+
+	pixels := effect.asset.frames[frame]
+	width := effect.matrix.Width()
+	for i := range buf {
+		buf[i] = color.RGBA{}
+	}
+	for y := 0; y != effect.matrix.Height(); y++ {
+		for x := 0; x != width; x++ {
+			if i := effect.matrix.Index(x, y); i < len(buf) {
+				buf[i] = pixels[y*width+x]
+			}
+		}
+	}
+	return buf, endSeq
+}
@@ -0,0 +1,337 @@
+package mawt
+
+// This module contains the import and export of strand mappings from and to the
+// layouts used by xLights and LedFx, so that builders who have already mapped a
+// sculpture using those tools do not need to repeat the work.
+//
+// xLights models are matched to logical strands using the first number in the
+// model name, for example "Strand 9" or "mawt 9 part 2", with the models for a
+// logical strand becoming its segments in the order they appear.  Models must
+// use absolute start channels, the physical strands being treated as a series
+// of fixed size blocks of pixels in that channel space.
+//
+// LedFx virtuals are matched to logical strands in the same way using their
+// names, and their segments refer to devices that are each a physical strand,
+// identified by the channel in the device configuration or the first number in
+// the device name
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	layoutNumber = regexp.MustCompile(`\d+`)
+)
+
+// LayoutOptions describe the sizes needed to convert between the layouts
+//
+type LayoutOptions struct {
+	StrandPixels  int // The pixels in each block of the xLights channel space assigned to a physical strand
+	LogicalPixels int // The length of the logical strands, used for segments that have no length
+}
+
+// DefaultLayoutOptions matches the fadecandy limit of 64 pixels per strand and the
+// 30 pixel strands the animations render
+//
+func DefaultLayoutOptions() (options LayoutOptions) {
+	return LayoutOptions{StrandPixels: 64, LogicalPixels: 30}
+}
+
+// layoutLogical extracts the logical strand number from a model or virtual name
+//
+func layoutLogical(name string) (logical int, err errors.Error) {
+	number := layoutNumber.FindString(name)
+	if len(number) == 0 {
+		return 0, errors.New("name does not contain a strand number").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	logical, _ = strconv.Atoi(number)
+	return logical, nil
+}
+
+// layoutMappings groups segments in the order they were found into validated mappings
+//
+func layoutMappings(order []int, segments map[int][]Segment) (mappings []StrandMapping, err errors.Error) {
+	mappings = make([]StrandMapping, 0, len(order))
+	for _, logical := range order {
+		mappings = append(mappings, StrandMapping{Logical: logical, Segments: segments[logical]})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Logical < mappings[j].Logical })
+
+	if _, err = NewStrandMap(mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// segmentLengths returns the lengths of the segments of a mapping, resolving a
+// final segment without a length using the length of the logical strands
+//
+func segmentLengths(mapping StrandMapping, options LayoutOptions) (lengths []int) {
+	remaining := options.LogicalPixels
+	lengths = make([]int, 0, len(mapping.Segments))
+	for _, segment := range mapping.Segments {
+		length := segment.Length
+		if length == 0 {
+			length = remaining
+		}
+		if length < 0 {
+			length = 0
+		}
+		lengths = append(lengths, length)
+		remaining -= length
+	}
+	return lengths
+}
+
+type xLightsModel struct {
+	Name         string `xml:"name,attr"`
+	DisplayAs    string `xml:"DisplayAs,attr"`
+	StringType   string `xml:"StringType,attr"`
+	Parm1        int    `xml:"parm1,attr"`
+	Parm2        int    `xml:"parm2,attr"`
+	Parm3        int    `xml:"parm3,attr"`
+	StartChannel string `xml:"StartChannel,attr"`
+}
+
+type xLightsEffects struct {
+	XMLName xml.Name       `xml:"xrgb"`
+	Models  []xLightsModel `xml:"models>model"`
+}
+
+// ImportXLights reads the models from an xLights rgbeffects file
+//
+func ImportXLights(r io.Reader, options LayoutOptions) (mappings []StrandMapping, err errors.Error) {
+	effects := &xLightsEffects{}
+	if errGo := xml.NewDecoder(r).Decode(effects); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	order := []int{}
+	segments := map[int][]Segment{}
+	for _, model := range effects.Models {
+		logical, err := layoutLogical(model.Name)
+		if err != nil {
+			return nil, err
+		}
+		start, errGo := strconv.Atoi(model.StartChannel)
+		if errGo != nil || start < 1 {
+			return nil, errors.New("models must use absolute start channels").With("model", model.Name).With("startChannel", model.StartChannel).With("stack", stack.Trace().TrimRuntime())
+		}
+		pixels := model.Parm1 * model.Parm2
+		if pixels < 1 {
+			return nil, errors.New("model has no pixels").With("model", model.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		// Models are split where they cross from one physical strand onto the next
+		pixel := (start - 1) / 3
+		for pixels > 0 {
+			offset := pixel % options.StrandPixels
+			length := options.StrandPixels - offset
+			if length > pixels {
+				length = pixels
+			}
+			if _, isPresent := segments[logical]; !isPresent {
+				order = append(order, logical)
+			}
+			segments[logical] = append(segments[logical], Segment{
+				Channel: pixel/options.StrandPixels + 1,
+				Offset:  offset,
+				Length:  length,
+			})
+			pixel += length
+			pixels -= length
+		}
+	}
+	return layoutMappings(order, segments)
+}
+
+// ExportXLights writes the strand mappings as the models of an xLights rgbeffects file
+//
+func ExportXLights(w io.Writer, mappings []StrandMapping, options LayoutOptions) (err errors.Error) {
+	effects := &xLightsEffects{}
+	for _, mapping := range mappings {
+		for i, length := range segmentLengths(mapping, options) {
+			segment := mapping.Segments[i]
+			name := fmt.Sprintf("mawt %d", mapping.Logical)
+			if i != 0 {
+				name = fmt.Sprintf("mawt %d part %d", mapping.Logical, i+1)
+			}
+			effects.Models = append(effects.Models, xLightsModel{
+				Name:         name,
+				DisplayAs:    "Single Line",
+				StringType:   "RGB Nodes",
+				Parm1:        1,
+				Parm2:        length,
+				Parm3:        1,
+				StartChannel: strconv.Itoa(((segment.Channel-1)*options.StrandPixels+segment.Offset)*3 + 1),
+			})
+		}
+	}
+
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if errGo := enc.Encode(effects); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	io.WriteString(w, "\n")
+	return nil
+}
+
+type ledFxDevice struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Config struct {
+		Name       string `json:"name"`
+		PixelCount int    `json:"pixel_count"`
+		IPAddress  string `json:"ip_address,omitempty"`
+		Port       int    `json:"port,omitempty"`
+		Channel    int    `json:"channel,omitempty"`
+	} `json:"config"`
+}
+
+type ledFxVirtual struct {
+	ID     string `json:"id"`
+	Config struct {
+		Name string `json:"name"`
+	} `json:"config"`
+	Segments [][]interface{} `json:"segments"`
+}
+
+type ledFxConfig struct {
+	Devices  []ledFxDevice  `json:"devices"`
+	Virtuals []ledFxVirtual `json:"virtuals"`
+}
+
+// ImportLedFx reads the virtuals and devices from a LedFx configuration file
+//
+func ImportLedFx(r io.Reader) (mappings []StrandMapping, err errors.Error) {
+	data, errGo := ioutil.ReadAll(r)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	config := &ledFxConfig{}
+	if errGo = json.Unmarshal(data, config); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	channels := map[string]int{}
+	for _, device := range config.Devices {
+		channel := device.Config.Channel
+		if channel == 0 {
+			if channel, err = layoutLogical(device.Config.Name); err != nil {
+				return nil, err.With("device", device.ID)
+			}
+		}
+		channels[device.ID] = channel
+	}
+
+	order := []int{}
+	segments := map[int][]Segment{}
+	for _, virtual := range config.Virtuals {
+		name := virtual.Config.Name
+		if len(name) == 0 {
+			name = virtual.ID
+		}
+		logical, err := layoutLogical(name)
+		if err != nil {
+			return nil, err.With("virtual", virtual.ID)
+		}
+		if _, isPresent := segments[logical]; !isPresent {
+			order = append(order, logical)
+			segments[logical] = []Segment{}
+		}
+
+		for _, fields := range virtual.Segments {
+			if len(fields) < 3 {
+				return nil, errors.New("virtual segment is incomplete").With("virtual", virtual.ID).With("stack", stack.Trace().TrimRuntime())
+			}
+			deviceID, _ := fields[0].(string)
+			channel, isPresent := channels[deviceID]
+			if !isPresent {
+				return nil, errors.New("virtual segment uses an unknown device").With("virtual", virtual.ID).With("device", deviceID).With("stack", stack.Trace().TrimRuntime())
+			}
+			start, isStart := fields[1].(float64)
+			end, isEnd := fields[2].(float64)
+			if !isStart || !isEnd || end < start {
+				return nil, errors.New("virtual segment range is invalid").With("virtual", virtual.ID).With("stack", stack.Trace().TrimRuntime())
+			}
+			if len(fields) > 3 {
+				if reversed, _ := fields[3].(bool); reversed {
+					return nil, errors.New("reversed virtual segments are not supported").With("virtual", virtual.ID).With("stack", stack.Trace().TrimRuntime())
+				}
+			}
+			// LedFx segment ranges include the end pixel
+			segments[logical] = append(segments[logical], Segment{
+				Channel: channel,
+				Offset:  int(start),
+				Length:  int(end-start) + 1,
+			})
+		}
+	}
+	return layoutMappings(order, segments)
+}
+
+// ExportLedFx writes the strand mappings as the virtuals of a LedFx configuration, with
+// an OPC device for each physical strand sending to the supplied fadecandy server
+//
+func ExportLedFx(w io.Writer, mappings []StrandMapping, host string, port int, options LayoutOptions) (err errors.Error) {
+	config := &ledFxConfig{
+		Devices:  []ledFxDevice{},
+		Virtuals: []ledFxVirtual{},
+	}
+
+	pixels := map[int]int{}
+	for _, mapping := range mappings {
+		virtual := ledFxVirtual{ID: fmt.Sprintf("mawt-%d", mapping.Logical), Segments: [][]interface{}{}}
+		virtual.Config.Name = fmt.Sprintf("mawt %d", mapping.Logical)
+
+		for i, length := range segmentLengths(mapping, options) {
+			segment := mapping.Segments[i]
+			if length == 0 {
+				continue
+			}
+			virtual.Segments = append(virtual.Segments, []interface{}{
+				fmt.Sprintf("strand-%d", segment.Channel), segment.Offset, segment.Offset + length - 1, false,
+			})
+			if end := segment.Offset + length; end > pixels[segment.Channel] {
+				pixels[segment.Channel] = end
+			}
+		}
+		config.Virtuals = append(config.Virtuals, virtual)
+	}
+
+	channels := make([]int, 0, len(pixels))
+	for channel := range pixels {
+		channels = append(channels, channel)
+	}
+	sort.Ints(channels)
+	for _, channel := range channels {
+		device := ledFxDevice{ID: fmt.Sprintf("strand-%d", channel), Type: "openpixelcontrol"}
+		device.Config.Name = fmt.Sprintf("strand %d", channel)
+		device.Config.PixelCount = pixels[channel]
+		device.Config.IPAddress = host
+		device.Config.Port = port
+		device.Config.Channel = channel
+		config.Devices = append(config.Devices, device)
+	}
+
+	data, errGo := json.MarshalIndent(config, "", "    ")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo = w.Write(append(data, '\n')); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
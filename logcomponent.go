@@ -0,0 +1,199 @@
+package mawt
+
+// This module names the components the log is split into, so that each can be
+// made more or less verbose on its own while chasing a problem, for example the
+// polling of the tecthulhus during a flaky network without the output of every
+// frame.  Errors reported by the pipelines are assigned to a component using the
+// component value they carry, or otherwise the file at the top of their stack.
+// Debug and informational messages are written by the components directly to the
+// logger the command gives each of them
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	LogPoller    = "poller"    // Polling the tecthulhus and other portal sources
+	LogDecoder   = "decoder"   // Decoding, translating and checking portal statuses
+	LogSequencer = "sequencer" // The animations, shows, scenes and overlays
+	LogOutput    = "output"    // Sending frames to the fadecandy servers and the mirrors
+	LogAPI       = "api"       // The REST API and the other HTTP surfaces
+	LogGateway   = "gateway"   // Everything else, such as startup and shutdown
+)
+
+var (
+	// LogComponents are the components the log is split into
+	LogComponents = []string{LogPoller, LogDecoder, LogSequencer, LogOutput, LogAPI, LogGateway}
+
+	// componentFiles assigns source files to components, files within packages
+	// other than the top level one being prefixed by the package
+	componentFiles = map[string]string{
+		"tecthulhu.go":        LogPoller,
+		"pollers.go":          LogPoller,
+		"discovery.go":        LogPoller,
+		"score.go":            LogPoller,
+		"tecthulhu/client.go": LogPoller,
+
+		"transform.go":        LogDecoder,
+		"sanity.go":           LogDecoder,
+		"changes.go":          LogDecoder,
+		"arbitration.go":      LogDecoder,
+		"history.go":          LogDecoder,
+		"tecthulhu/status.go": LogDecoder,
+		"model/portal.go":     LogDecoder,
+
+		"sequencer/sequencer.go": LogSequencer,
+		"animation.go":           LogSequencer,
+		"show.go":                LogSequencer,
+		"scenes.go":              LogSequencer,
+		"cues.go":                LogSequencer,
+		"image.go":               LogSequencer,
+		"plugins.go":             LogSequencer,
+		"heartbeat.go":           LogSequencer,
+		"decay.go":               LogSequencer,
+		"recharge.go":            LogSequencer,
+		"stingers.go":            LogSequencer,
+		"timeline.go":            LogSequencer,
+		"ticker.go":              LogSequencer,
+		"beat.go":                LogSequencer,
+		"timecode.go":            LogSequencer,
+
+		"fadecandy.go":   LogOutput,
+		"output.go":      LogOutput,
+		"websocket.go":   LogOutput,
+		"opcinput.go":    LogOutput,
+		"firmware.go":    LogOutput,
+		"strands.go":     LogOutput,
+		"sendpool.go":    LogOutput,
+		"phases.go":      LogOutput,
+		"layout.go":      LogOutput,
+		"record.go":      LogOutput,
+		"node.go":        LogOutput,
+		"resolve.go":     LogOutput,
+		"strandstats.go": LogOutput,
+		"guard.go":       LogOutput,
+
+		"web.go":           LogAPI,
+		"auth.go":          LogAPI,
+		"contract.go":      LogAPI,
+		"main/api.go":      LogAPI,
+		"main/editor.go":   LogAPI,
+		"main/contract.go": LogAPI,
+		"main/snapshot.go": LogAPI,
+	}
+)
+
+// ComponentLogger receives the debug and informational messages of a component of
+// the log, the loggers of the logxi package satisfy it
+//
+type ComponentLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	IsDebug() bool
+	IsInfo() bool
+}
+
+// nopLogger discards the messages of components no logger has been given for
+//
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) IsDebug() (enabled bool)               { return false }
+func (nopLogger) IsInfo() (enabled bool)                { return false }
+
+var (
+	componentLoggers = struct {
+		loggers map[string]ComponentLogger
+		sync.Mutex
+	}{loggers: map[string]ComponentLogger{}}
+)
+
+// SetComponentLogger sets the logger the debug and informational messages of a
+// component are written to
+//
+func SetComponentLogger(component string, log ComponentLogger) {
+	componentLoggers.Lock()
+	defer componentLoggers.Unlock()
+
+	componentLoggers.loggers[component] = log
+}
+
+// componentLog returns the logger of a component, one discarding the messages when
+// none has been set
+//
+func componentLog(component string) (log ComponentLogger) {
+	componentLoggers.Lock()
+	defer componentLoggers.Unlock()
+
+	if log = componentLoggers.loggers[component]; log == nil {
+		return nopLogger{}
+	}
+	return log
+}
+
+// IsLogComponent returns true when the name is that of a component of the log
+//
+func IsLogComponent(name string) (isComponent bool) {
+	for _, component := range LogComponents {
+		if component == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorComponent returns the component of the log an error belongs to, given by
+// its component value or by the first file of its stack assigned to a component,
+// the gateway when neither is
+//
+func ErrorComponent(err errors.Error) (component string) {
+	withKeyvals, isOK := err.(interface{ Keyvals() []interface{} })
+	if !isOK {
+		return LogGateway
+	}
+	keyvals := withKeyvals.Keyvals()
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != "component" {
+			continue
+		}
+		if name, isString := keyvals[i+1].(string); isString && IsLogComponent(name) {
+			return name
+		}
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != "stack" {
+			continue
+		}
+		calls, isStack := keyvals[i+1].(stack.CallStack)
+		if !isStack {
+			continue
+		}
+		for _, call := range calls {
+			if component, isPresent := componentFiles[callFile(call)]; isPresent {
+				return component
+			}
+		}
+	}
+	return LogGateway
+}
+
+// callFile returns the file of a call, prefixed by its package when it is not in
+// the top level package
+//
+func callFile(call stack.Call) (file string) {
+	pkg := fmt.Sprintf("%+k", call)
+	file = fmt.Sprintf("%s", call)
+	if i := strings.Index(pkg, "TeamNorCal/mawt/"); i != -1 {
+		return pkg[i+len("TeamNorCal/mawt/"):] + "/" + file
+	}
+	if pkg == "main" {
+		return "main/" + file
+	}
+	return file
+}
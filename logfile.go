@@ -0,0 +1,233 @@
+package mawt
+
+// This module implements a log file that rotates itself once it grows beyond a
+// size or has been written to for longer than an age, compressing the files
+// rotated out and removing the oldest of them.  Headless installs, such as a
+// Raspberry Pi at an anomaly, keep a bounded amount of logging on disk without
+// depending on journald or logrotate having been configured
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// LogFileConfig defines a rotating log file
+//
+type LogFileConfig struct {
+	Path     string
+	MaxSize  int64         // The size in bytes beyond which the file is rotated, 0 disables size based rotation
+	MaxAge   time.Duration // The time after which the file is rotated, 0 disables time based rotation
+	Keep     int           // The number of rotated files kept, 0 keeps them all
+	Compress bool          // Rotated files are compressed using gzip
+}
+
+// LogFile is a writer appending to a file that is rotated by size and age
+//
+type LogFile struct {
+	config    LogFileConfig
+	file      *os.File
+	size      int64
+	opened    time.Time
+	rotations int
+	sync.Mutex
+}
+
+// LogFileReport describes the state of a log file
+//
+type LogFileReport struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Opened    time.Time `json:"opened"`
+	Rotations int       `json:"rotations"` // The rotations since the file was opened by this process
+}
+
+// OpenLogFile opens the log file for appending, creating it when it does not exist
+//
+func OpenLogFile(config LogFileConfig) (logFile *LogFile, err errors.Error) {
+	if len(config.Path) == 0 {
+		return nil, errors.New("log files need a path").With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.MaxSize < 0 || config.MaxAge < 0 || config.Keep < 0 {
+		return nil, errors.New("log file limits cannot be negative").With("path", config.Path).With("stack", stack.Trace().TrimRuntime())
+	}
+	logFile = &LogFile{config: config}
+	if err = logFile.open(); err != nil {
+		return nil, err
+	}
+	return logFile, nil
+}
+
+// open opens the file, the age of an existing file is taken from its modification
+// time so that restarts do not postpone rotation indefinitely
+//
+func (logFile *LogFile) open() (err errors.Error) {
+	file, errGo := os.OpenFile(logFile.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("path", logFile.config.Path).With("stack", stack.Trace().TrimRuntime())
+	}
+	info, errGo := file.Stat()
+	if errGo != nil {
+		file.Close()
+		return errors.Wrap(errGo).With("path", logFile.config.Path).With("stack", stack.Trace().TrimRuntime())
+	}
+	logFile.file = file
+	logFile.size = info.Size()
+	logFile.opened = time.Now()
+	if logFile.size != 0 {
+		logFile.opened = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends to the file, rotating it first when the write would take it beyond
+// the size limit or the age limit has been reached
+//
+func (logFile *LogFile) Write(p []byte) (n int, errGo error) {
+	logFile.Lock()
+	defer logFile.Unlock()
+
+	if logFile.file == nil {
+		return 0, os.ErrClosed
+	}
+	oversize := logFile.config.MaxSize != 0 && logFile.size != 0 && logFile.size+int64(len(p)) > logFile.config.MaxSize
+	overage := logFile.config.MaxAge != 0 && time.Since(logFile.opened) >= logFile.config.MaxAge
+	if oversize || overage {
+		if err := logFile.rotate(); err != nil {
+			// Logging continues to the existing file rather than being lost
+			if logFile.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, errGo = logFile.file.Write(p)
+	logFile.size += int64(n)
+	return n, errGo
+}
+
+// Rotate moves the current file aside and starts a new one
+//
+func (logFile *LogFile) Rotate() (err errors.Error) {
+	logFile.Lock()
+	defer logFile.Unlock()
+
+	if logFile.file == nil {
+		return errors.New("log file closed").With("path", logFile.config.Path).With("stack", stack.Trace().TrimRuntime())
+	}
+	return logFile.rotate()
+}
+
+func (logFile *LogFile) rotate() (err errors.Error) {
+	rotated := logFile.config.Path + "." + time.Now().Format("20060102-150405.000")
+	if errGo := os.Rename(logFile.config.Path, rotated); errGo != nil {
+		return errors.Wrap(errGo).With("path", logFile.config.Path).With("stack", stack.Trace().TrimRuntime())
+	}
+	logFile.file.Close()
+	logFile.file = nil
+	logFile.rotations++
+
+	// Compression and pruning are done in the background to avoid holding up the logging
+	go func(config LogFileConfig) {
+		if config.Compress {
+			compressLogFile(rotated)
+		}
+		pruneLogFiles(config)
+	}(logFile.config)
+
+	return logFile.open()
+}
+
+// compressLogFile replaces a rotated file with a gzip compressed copy, the file is
+// left in place when it cannot be compressed
+//
+func compressLogFile(path string) {
+	in, errGo := os.Open(path)
+	if errGo != nil {
+		return
+	}
+	defer in.Close()
+
+	out, errGo := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if errGo != nil {
+		return
+	}
+	zw := gzip.NewWriter(out)
+	_, errGo = io.Copy(zw, in)
+	if errClose := zw.Close(); errGo == nil {
+		errGo = errClose
+	}
+	if errClose := out.Close(); errGo == nil {
+		errGo = errClose
+	}
+	if errGo != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+	os.Remove(path)
+}
+
+// pruneLogFiles removes the oldest rotated files beyond the number kept, the
+// timestamps in their names sort in the order they were rotated
+//
+func pruneLogFiles(config LogFileConfig) {
+	if config.Keep == 0 {
+		return
+	}
+	rotated, errGo := filepath.Glob(config.Path + ".*")
+	if errGo != nil {
+		return
+	}
+	sort.Strings(rotated)
+
+	// A file being compressed appears twice, once with and once without the suffix
+	seen := map[string]bool{}
+	unique := make([]string, 0, len(rotated))
+	for _, path := range rotated {
+		base := path
+		if filepath.Ext(path) == ".gz" {
+			base = path[:len(path)-3]
+		}
+		if !seen[base] {
+			seen[base] = true
+			unique = append(unique, base)
+		}
+	}
+	for len(unique) > config.Keep {
+		os.Remove(unique[0])
+		os.Remove(unique[0] + ".gz")
+		unique = unique[1:]
+	}
+}
+
+// Report returns the state of the log file
+//
+func (logFile *LogFile) Report() (report LogFileReport) {
+	logFile.Lock()
+	defer logFile.Unlock()
+
+	return LogFileReport{
+		Path:      logFile.config.Path,
+		Size:      logFile.size,
+		Opened:    logFile.opened,
+		Rotations: logFile.rotations,
+	}
+}
+
+// Close closes the file, later writes fail
+//
+func (logFile *LogFile) Close() {
+	logFile.Lock()
+	defer logFile.Unlock()
+
+	if logFile.file != nil {
+		logFile.file.Close()
+		logFile.file = nil
+	}
+}
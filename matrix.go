@@ -0,0 +1,116 @@
+package mawt
+
+// This module contains the mapping of the pixels of a small LED matrix panel,
+// addressed by column and row, onto the single run of pixels of the strand
+// the panel is wired as.  Panels are wired row by row, or column by column,
+// starting from one of the corners, either with every line running in the
+// same direction, with alternate lines reversed as in the common serpentine
+// panels, or with the reversed lines listed for panels wired by hand
+
+import (
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// MatrixConfig describes the wiring of an LED matrix panel
+//
+type MatrixConfig struct {
+	Width      int    `yaml:"width" json:"width"`           // The number of columns
+	Height     int    `yaml:"height" json:"height"`         // The number of rows
+	Origin     string `yaml:"origin" json:"origin"`         // The corner of the first pixel, top-left, top-right, bottom-left or bottom-right, defaults to top-left
+	Serpentine bool   `yaml:"serpentine" json:"serpentine"` // Alternate lines run in the opposite direction
+	Direction  string `yaml:"direction" json:"direction"`   // The strand runs along rows or columns, defaults to rows
+
+	// Reversed lists the lines, counted from the origin, that run in the opposite
+	// direction to the first, for panels without a regular serpentine.  It cannot
+	// be combined with serpentine
+	Reversed []int `yaml:"reversed" json:"reversed,omitempty"`
+}
+
+// Matrix maps the columns and rows of a panel onto the pixels of its strand
+//
+type Matrix struct {
+	config   MatrixConfig
+	reversed map[int]bool // The lines running in the opposite direction to the first
+}
+
+// NewMatrix validates the wiring of a matrix panel
+//
+func NewMatrix(config MatrixConfig) (matrix *Matrix, err errors.Error) {
+	if config.Width < 1 || config.Height < 1 {
+		return nil, errors.New("a matrix must have at least one row and column").With("width", config.Width).With("height", config.Height).With("stack", stack.Trace().TrimRuntime())
+	}
+	switch config.Origin {
+	case "":
+		config.Origin = "top-left"
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return nil, errors.New("unknown matrix origin, top-left, top-right, bottom-left and bottom-right are supported").With("origin", config.Origin).With("stack", stack.Trace().TrimRuntime())
+	}
+	lines := config.Height
+	switch config.Direction {
+	case "":
+		config.Direction = "rows"
+	case "rows":
+	case "columns":
+		lines = config.Width
+	default:
+		return nil, errors.New("unknown matrix direction, rows and columns are supported").With("direction", config.Direction).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	matrix = &Matrix{config: config, reversed: map[int]bool{}}
+	if len(config.Reversed) != 0 && config.Serpentine {
+		return nil, errors.New("the reversed lines of a matrix cannot be combined with serpentine").With("stack", stack.Trace().TrimRuntime())
+	}
+	for _, line := range config.Reversed {
+		if line < 0 || line >= lines {
+			return nil, errors.New("a reversed line is outside of the matrix").With("line", line).With("lines", lines).With("stack", stack.Trace().TrimRuntime())
+		}
+		matrix.reversed[line] = true
+	}
+	for line := 1; config.Serpentine && line < lines; line += 2 {
+		matrix.reversed[line] = true
+	}
+	return matrix, nil
+}
+
+// Width returns the number of columns of the panel
+//
+func (matrix *Matrix) Width() (width int) {
+	return matrix.config.Width
+}
+
+// Height returns the number of rows of the panel
+//
+func (matrix *Matrix) Height() (height int) {
+	return matrix.config.Height
+}
+
+// Pixels returns the number of pixels on the strand of the panel
+//
+func (matrix *Matrix) Pixels() (pixels int) {
+	return matrix.config.Width * matrix.config.Height
+}
+
+// Index returns the position on the strand of the pixel at a column and row, counted
+// from the top left of the panel as it is viewed
+//
+func (matrix *Matrix) Index(x int, y int) (index int) {
+	width, height := matrix.config.Width, matrix.config.Height
+	switch matrix.config.Origin {
+	case "top-right":
+		x = width - 1 - x
+	case "bottom-left":
+		y = height - 1 - y
+	case "bottom-right":
+		x, y = width-1-x, height-1-y
+	}
+	line, pos, length := y, x, width
+	if matrix.config.Direction == "columns" {
+		line, pos, length = x, y, height
+	}
+	if matrix.reversed[line] {
+		pos = length - 1 - pos
+	}
+	return line*length + pos
+}
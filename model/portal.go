@@ -31,6 +31,7 @@ type Status struct {
 	Faction       string      `json:"controllingFaction"` // Will be 'E'nlightened, 'R'esistance, or 'N'eutral
 	Mods          []Mod       `json:"mods"`
 	Resonators    []Resonator `json:"resonators"`
+	AudioCues     []string    `json:"audioCues,omitempty"` // The game sounds being played at the portal, when reported
 }
 
 type PortalStatus struct {
@@ -38,8 +39,10 @@ type PortalStatus struct {
 }
 
 type PortalMsg struct {
-	Home   bool   `json:"home"`
-	Status Status `json:"externalApiPortal"`
+	Home     bool   `json:"home"`
+	URL      string `json:"url,omitempty"`      // The tecthulhu the status was retrieved from
+	Revision uint64 `json:"revision,omitempty"` // Incremented by the poller each time the status it decodes changes, 0 when the source does not count changes
+	Status   Status `json:"externalApiPortal"`
 }
 
 // DeepCopy deepcopies a to b using json marshaling
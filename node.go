@@ -0,0 +1,78 @@
+package mawt
+
+// This module implements the output used to stream frames to remote render
+// nodes, for example Wi-Fi connected controllers at the edge of a venue that
+// drive their own fadecandy server.  Frames are sent as the frame records
+// described in frames.go, delta encoded and optionally deflate compressed
+
+import (
+	"net"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultNodePort = "7891"
+)
+
+// NodeOutput streams frames to a remote render node.  Connections are retried no
+// more than every 5 seconds, and start with a key frame
+//
+type NodeOutput struct {
+	server    string
+	enc       *FrameEncoder
+	conn      net.Conn
+	lastTried time.Time
+}
+
+// NewNodeOutput creates an output for the render node at the supplied address
+// using the named compression and key frame interval, frames being tagged with
+// the universe
+//
+func NewNodeOutput(server string, compression string, keyframes int, universe uint16) (output *NodeOutput, err errors.Error) {
+	enc, err := NewFrameEncoder(compression, keyframes)
+	if err != nil {
+		return nil, err.With("server", server)
+	}
+	enc.Universe = universe
+	return &NodeOutput{server: server, enc: enc}, nil
+}
+
+func (output *NodeOutput) Name() (name string) {
+	return "node " + output.server
+}
+
+func (output *NodeOutput) Send(frame []animationModel.ChannelData) (err errors.Error) {
+	if output.conn == nil {
+		if time.Since(output.lastTried) < 5*time.Second {
+			return errors.New("render node not online").With("server", output.server).With("stack", stack.Trace().TrimRuntime())
+		}
+		output.lastTried = time.Now()
+
+		addr, err := ResolveAddr(output.server, defaultNodePort)
+		if err != nil {
+			return err
+		}
+		conn, errGo := net.DialTimeout("tcp", addr, 2*time.Second)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("server", output.server).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+		}
+		output.conn = conn
+		output.enc.Reset()
+	}
+
+	msg, err := output.enc.Encode(frame, time.Now())
+	if err != nil {
+		return err.With("server", output.server)
+	}
+	output.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, errGo := output.conn.Write(msg); errGo != nil {
+		output.conn.Close()
+		output.conn = nil
+		return errors.Wrap(errGo).With("server", output.server).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package mawt
+
+// This module implements an optional notifier that posts messages to a Discord
+// or Slack incoming webhook when critical operational conditions are detected
+// so that on-site crews are paged without having to watch the logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	opcOfflineLimit   = time.Minute
+	unreachableWindow = time.Minute
+	panicWindow       = 10 * time.Minute
+	panicLimit        = 3
+)
+
+type Notifier struct {
+	Pipeline string // Optional name of the pipeline being monitored, included in messages
+
+	webhook url.URL
+	discord bool
+	client  *http.Client
+}
+
+// NewNotifier creates a notifier for the supplied webhook, Discord webhooks are
+// recognized by their host name with all others assumed to be Slack compatible
+//
+func NewNotifier(webhook string) (notifier *Notifier, err errors.Error) {
+	hook, errGo := url.Parse(webhook)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", webhook).With("stack", stack.Trace().TrimRuntime())
+	}
+	if hook.Scheme != "https" && hook.Scheme != "http" {
+		return nil, errors.New("webhook must be an http or https URL").With("url", webhook).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &Notifier{
+		webhook: *hook,
+		discord: strings.HasSuffix(hook.Hostname(), "discord.com") || strings.HasSuffix(hook.Hostname(), "discordapp.com"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Notify posts a single message to the webhook
+//
+func (notifier *Notifier) Notify(msg string) (err errors.Error) {
+
+	host, _ := os.Hostname()
+	text := fmt.Sprintf("mawt on %s: %s", host, msg)
+	if len(notifier.Pipeline) != 0 {
+		text = fmt.Sprintf("mawt on %s pipeline %s: %s", host, notifier.Pipeline, msg)
+	}
+
+	body := map[string]string{"text": text}
+	if notifier.discord {
+		body = map[string]string{"content": text}
+	}
+
+	payload, errGo := json.Marshal(body)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	resp, errGo := notifier.client.Post(notifier.webhook.String(), "application/json", bytes.NewReader(payload))
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", notifier.webhook.Host).With("stack", stack.Trace().TrimRuntime())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook rejected notification").With("url", notifier.webhook.Host).With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// criticalConditions checks the gateway health and returns a message for each critical
+// condition that is currently present, indexed by a short name for the condition
+//
+func criticalConditions(health *Health) (conditions map[string]string) {
+	conditions = map[string]string{}
+
+	if offline := health.OPCOffline(); offline > opcOfflineLimit {
+		conditions["opc"] = fmt.Sprintf("fadecandy server has been offline for %s", offline.Round(time.Second))
+	}
+	if health.PortalsUnreachable(unreachableWindow) {
+		conditions["tecthulhus"] = fmt.Sprintf("no tecthulhus have been reachable for at least %s", unreachableWindow)
+	}
+	if panics := health.RecentPanics(panicWindow); panics >= panicLimit {
+		conditions["panics"] = fmt.Sprintf("%d panics have been recovered in the last %s", panics, panicWindow)
+	}
+	return conditions
+}
+
+// run checks for critical conditions on a regular basis and will post
+// notifications when conditions are first seen, and when they clear
+//
+func (notifier *Notifier) run(health *Health, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	defer track("notifier")()
+
+	active := map[string]string{}
+
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			conditions := criticalConditions(health)
+			for name, msg := range conditions {
+				if _, isPresent := active[name]; isPresent {
+					continue
+				}
+				if err := notifier.Notify("CRITICAL " + msg); err != nil {
+					sendErr(errorC, err)
+					continue
+				}
+				active[name] = msg
+			}
+			for name, msg := range active {
+				if _, isPresent := conditions[name]; isPresent {
+					continue
+				}
+				if err := notifier.Notify("RESOLVED " + msg); err != nil {
+					sendErr(errorC, err)
+					continue
+				}
+				delete(active, name)
+			}
+		case <-quitC:
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package mawt
+
+// This module implements the OPC input, a listener that accepts connections from
+// tools speaking the Open Pixel Control protocol, such as Processing sketches
+// written for the fcserver, and composites the pixels they send with the portal
+// animations.  The logical strands are addressed using the OPC channels, with
+// channel 0 addressing every strand, and strands that have not been sent pixels
+// for the timeout are dropped so that a stopped sketch does not freeze its
+// last frame on the sculpture
+
+import (
+	"bufio"
+	"image/color"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultOPCInputPort = "7892"
+
+	opcSetPixels = 0x00
+)
+
+// OPCInputConfig defines the listener accepting frames from OPC speaking tools
+//
+type OPCInputConfig struct {
+	Listen  string        `yaml:"listen" json:"listen"`   // The address listened on, defaults to :7892
+	Blend   string        `yaml:"blend" json:"blend"`     // over, add or replace, defaults to over
+	Timeout time.Duration `yaml:"timeout" json:"timeout"` // Strands not updated for this time are dropped, defaults to 2s
+}
+
+type inputStrand struct {
+	data     []color.RGBA
+	received time.Time
+}
+
+// OPCInput receives the frames sent by OPC clients and composites them with the
+// frames of a pipeline
+//
+type OPCInput struct {
+	config   OPCInputConfig
+	listener net.Listener
+	strands  map[animationModel.OpcChannel]*inputStrand
+	clients  int
+	messages uint64
+	sync.Mutex
+}
+
+// OPCInputReport describes the state of an OPC input
+//
+type OPCInputReport struct {
+	Listen   string `json:"listen"`
+	Clients  int    `json:"clients"`
+	Messages uint64 `json:"messages"`
+	Strands  []int  `json:"strands"` // The strands currently being composited
+}
+
+// checkOPCInput validates the configuration of an OPC input, supplying the defaults
+//
+func checkOPCInput(config OPCInputConfig) (checked OPCInputConfig, err errors.Error) {
+	switch config.Blend {
+	case "":
+		config.Blend = "over"
+	case "over", "add", "replace":
+	default:
+		return config, errors.New("unknown OPC input blend, over, add and replace are supported").With("blend", config.Blend).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Timeout < 0 {
+		return config, errors.New("the OPC input timeout cannot be negative").With("timeout", config.Timeout).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 2 * time.Second
+	}
+	if len(config.Listen) == 0 {
+		config.Listen = ":" + defaultOPCInputPort
+	}
+	return config, nil
+}
+
+// NewOPCInput validates the configuration and starts listening for OPC clients,
+// connections are accepted once Serve is called
+//
+func NewOPCInput(config OPCInputConfig) (input *OPCInput, err errors.Error) {
+	if config, err = checkOPCInput(config); err != nil {
+		return nil, err
+	}
+
+	listener, errGo := net.Listen("tcp", config.Listen)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("listen", config.Listen).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &OPCInput{
+		config:   config,
+		listener: listener,
+		strands:  map[animationModel.OpcChannel]*inputStrand{},
+	}, nil
+}
+
+// Serve accepts OPC clients until the quit channel is closed
+//
+func (input *OPCInput) Serve(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	go func() {
+		defer track("opc input")()
+		<-quitC
+		input.listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, errGo := input.listener.Accept()
+			if errGo != nil {
+				select {
+				case <-quitC:
+				default:
+					sendErr(errorC, errors.Wrap(errGo).With("listen", input.config.Listen).With("stack", stack.Trace().TrimRuntime()))
+				}
+				return
+			}
+			go input.receive(conn, quitC)
+		}
+	}()
+}
+
+// receive reads the messages of a single client until it disconnects, clients
+// leaving part way through a message is normal for sketches being stopped so
+// it is not treated as an error
+//
+func (input *OPCInput) receive(conn net.Conn, quitC <-chan struct{}) {
+	input.Lock()
+	input.clients++
+	input.Unlock()
+
+	doneC := make(chan struct{})
+	defer func() {
+		close(doneC)
+		conn.Close()
+		input.Lock()
+		input.clients--
+		input.Unlock()
+	}()
+
+	go func() {
+		select {
+		case <-quitC:
+			conn.Close()
+		case <-doneC:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		if _, errGo := io.ReadFull(reader, header); errGo != nil {
+			return
+		}
+		body := make([]byte, int(header[2])<<8|int(header[3]))
+		if _, errGo := io.ReadFull(reader, body); errGo != nil {
+			return
+		}
+
+		// Only set pixel messages are used, system exclusive messages intended for
+		// the fcserver firmware are ignored
+		if header[1] != opcSetPixels {
+			continue
+		}
+		data := make([]color.RGBA, len(body)/3)
+		for i := range data {
+			data[i] = color.RGBA{R: body[i*3], G: body[i*3+1], B: body[i*3+2], A: 0xFF}
+		}
+
+		input.Lock()
+		input.strands[animationModel.OpcChannel(header[0])] = &inputStrand{data: data, received: time.Now()}
+		input.messages++
+		input.Unlock()
+	}
+}
+
+// Composite blends the strands received from the OPC clients into a frame, strands
+// the frame does not contain are added to it
+//
+func (input *OPCInput) Composite(frame []animationModel.ChannelData, now time.Time) (composited []animationModel.ChannelData) {
+	input.Lock()
+	defer input.Unlock()
+
+	for channel, strand := range input.strands {
+		if now.Sub(strand.received) > input.config.Timeout {
+			delete(input.strands, channel)
+		}
+	}
+	if len(input.strands) == 0 {
+		return frame
+	}
+
+	composited = make([]animationModel.ChannelData, 0, len(frame)+len(input.strands))
+	present := map[animationModel.OpcChannel]bool{}
+	for _, channelData := range frame {
+		present[channelData.ChannelNum] = true
+
+		// Strands sent to a specific channel take precedence over a broadcast on channel 0
+		strand, isPresent := input.strands[channelData.ChannelNum]
+		if !isPresent {
+			if strand, isPresent = input.strands[0]; !isPresent {
+				composited = append(composited, channelData)
+				continue
+			}
+		}
+		composited = append(composited, animationModel.ChannelData{
+			ChannelNum: channelData.ChannelNum,
+			Data:       input.blend(channelData.Data, strand.data),
+		})
+	}
+	for channel, strand := range input.strands {
+		if channel != 0 && !present[channel] {
+			composited = append(composited, animationModel.ChannelData{
+				ChannelNum: channel,
+				Data:       append([]color.RGBA{}, strand.data...),
+			})
+		}
+	}
+	return composited
+}
+
+// blend combines the pixels of a strand with those received, returning a new buffer
+// as the animations reuse theirs
+//
+func (input *OPCInput) blend(pixels []color.RGBA, received []color.RGBA) (blended []color.RGBA) {
+	if input.config.Blend == "replace" {
+		return append([]color.RGBA{}, received...)
+	}
+
+	blended = make([]color.RGBA, len(pixels))
+	for i, pixel := range pixels {
+		if pixel.A == 0 {
+			pixel = color.RGBA{}
+		}
+		if i >= len(received) {
+			blended[i] = pixel
+			continue
+		}
+		over := received[i]
+		switch {
+		case input.config.Blend == "add":
+			add := func(a uint8, b uint8) uint8 {
+				if sum := int(a) + int(b); sum < 0xFF {
+					return uint8(sum)
+				}
+				return 0xFF
+			}
+			blended[i] = color.RGBA{R: add(pixel.R, over.R), G: add(pixel.G, over.G), B: add(pixel.B, over.B), A: 0xFF}
+		case over.R != 0 || over.G != 0 || over.B != 0:
+			// Black pixels sent by a client are treated as transparent
+			blended[i] = over
+		default:
+			blended[i] = pixel
+		}
+	}
+	return blended
+}
+
+// Report returns the clients connected and the strands being composited
+//
+func (input *OPCInput) Report() (report OPCInputReport) {
+	input.Lock()
+	defer input.Unlock()
+
+	report = OPCInputReport{
+		Listen:   input.listener.Addr().String(),
+		Clients:  input.clients,
+		Messages: input.messages,
+		Strands:  []int{},
+	}
+	for channel := 0; channel <= 0xFF; channel++ {
+		if _, isPresent := input.strands[animationModel.OpcChannel(channel)]; isPresent {
+			report.Strands = append(report.Strands, channel)
+		}
+	}
+	return report
+}
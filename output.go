@@ -0,0 +1,302 @@
+package mawt
+
+// This module contains the output layer.  Frames are always sent to the
+// fadecandy server of a pipeline, they can also be mirrored to any number of
+// additional outputs such as the terminal preview, a browser preview using a
+// WebSocket, a second OPC server or a remote render node, so that operators can watch exactly what
+// the hardware receives.  Each mirror runs independently and drops frames
+// rather than slowing the render loop when it cannot keep up
+
+import (
+	"fmt"
+	"image/color"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"github.com/kellydunn/go-opc"
+)
+
+// Output is a destination for the frames of a pipeline after all effects and the
+// strand mapping have been applied
+//
+type Output interface {
+	Name() string
+	Send(frame []animationModel.ChannelData) (err errors.Error)
+}
+
+// OutputConfig defines an additional output frames are mirrored to
+//
+type OutputConfig struct {
+	Type        string `yaml:"type"`        // terminal, websocket, opc, node, record or validate
+	Server      string `yaml:"server"`      // The address of the OPC server, or render node, for the opc and node types
+	File        string `yaml:"file"`        // The file frames are appended to for the record type
+	Channels    []int  `yaml:"channels"`    // The channels mirrored, all channels when empty
+	Compression string `yaml:"compression"` // none or deflate, for the node and record types
+	Keyframes   int    `yaml:"keyframes"`   // Frames between full key frames for the node and record types, 1 disables delta frames
+	Universe    uint16 `yaml:"universe"`    // Identifies the frames of the pipeline within frame records, for the websocket, node and record types
+	Pixels      int    `yaml:"pixels"`      // The length every physical strand must have for the validate type, 0 when not checked
+
+	RGBW      *RGBWConfig      `yaml:"rgbw"`      // Optional strands with a white LED, only for the opc type
+	Diffusion *DiffusionConfig `yaml:"diffusion"` // Optional simulation of the diffuser, for the terminal and websocket types
+}
+
+// OutputBinding is an output along with the channels that are mirrored to it
+//
+type OutputBinding struct {
+	Output    Output
+	Channels  []int      // All channels are mirrored when empty
+	Diffusion *Diffusion // Applied to the frames of previews, nil when not simulated
+}
+
+// NewOutputs creates the outputs for a set of output definitions
+//
+func NewOutputs(configs []OutputConfig) (bindings []OutputBinding, err errors.Error) {
+	bindings = make([]OutputBinding, 0, len(configs))
+	for _, config := range configs {
+		for _, channel := range config.Channels {
+			if channel < 1 || channel > 255 {
+				return nil, errors.New("output channels must be from 1 to 255").With("type", config.Type).With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+
+		if config.RGBW != nil && config.Type != "opc" {
+			return nil, errors.New("only opc outputs support RGBW strands, the other output types carry RGB frames").With("type", config.Type).With("stack", stack.Trace().TrimRuntime())
+		}
+		binding := OutputBinding{Channels: config.Channels}
+		if config.Diffusion != nil {
+			// The hardware and recordings must receive the frames as they were rendered
+			if config.Type != "terminal" && config.Type != "websocket" {
+				return nil, errors.New("only terminal and websocket outputs simulate a diffuser").With("type", config.Type).With("stack", stack.Trace().TrimRuntime())
+			}
+			if binding.Diffusion, err = NewDiffusion(*config.Diffusion); err != nil {
+				return nil, err.With("type", config.Type)
+			}
+		}
+
+		var output Output
+		switch config.Type {
+		case "terminal":
+			output = &TerminalOutput{}
+		case "websocket":
+			output = NewWebSocketOutput(config.Universe)
+		case "opc":
+			if len(config.Server) == 0 {
+				return nil, errors.New("opc outputs need a server").With("stack", stack.Trace().TrimRuntime())
+			}
+			opcOutput := NewOPCOutput(config.Server)
+			if config.RGBW != nil {
+				if opcOutput.rgbw, err = NewRGBW(*config.RGBW); err != nil {
+					return nil, err
+				}
+			}
+			output = opcOutput
+		case "node":
+			if len(config.Server) == 0 {
+				return nil, errors.New("node outputs need a server").With("stack", stack.Trace().TrimRuntime())
+			}
+			if output, err = NewNodeOutput(config.Server, config.Compression, config.Keyframes, config.Universe); err != nil {
+				return nil, err
+			}
+		case "record":
+			if len(config.File) == 0 {
+				return nil, errors.New("record outputs need a file").With("stack", stack.Trace().TrimRuntime())
+			}
+			if output, err = NewRecordOutput(config.File, config.Compression, config.Keyframes, config.Universe); err != nil {
+				return nil, err
+			}
+		case "validate":
+			if config.Pixels < 0 || config.Pixels > maxStrandPixels {
+				return nil, errors.New("validate outputs need a pixel count from 0 to 21845").With("pixels", config.Pixels).With("stack", stack.Trace().TrimRuntime())
+			}
+			output = NewValidateOutput(config.Pixels)
+		default:
+			return nil, errors.New("unknown output type").With("type", config.Type).With("stack", stack.Trace().TrimRuntime())
+		}
+		binding.Output = output
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+// startMirror subscribes an output to the frames published by a pipeline, delivering
+// them from its own goroutine.  Only the latest frame is kept while the output is
+// still busy with the previous frame, other than for the validate output which is
+// given a deep queue so that it checks every frame, the frames published while the
+// queue is full being missed and counted.  The frames are published by the render
+// loop while it holds its locks, so no output is allowed to make it wait
+//
+func startMirror(binding OutputBinding, broker *Broker, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	channels := map[animationModel.OpcChannel]bool{}
+	for _, channel := range binding.Channels {
+		channels[animationModel.OpcChannel(channel)] = true
+	}
+
+	options := SubscribeOptions{Name: "output " + binding.Output.Name(), Depth: 1, Policy: LatestWins}
+	validate, isValidate := binding.Output.(*ValidateOutput)
+	if isValidate {
+		options.Depth = validateDepth
+		options.Policy = DropNewest
+	}
+	sub := broker.Subscribe(TopicFrames, options)
+
+	go func() {
+		defer track("output mirror")()
+		defer sub.Close()
+
+		failures := NewErrorSummary(errorSummaryInterval)
+		for {
+			select {
+			case msg := <-sub.C:
+				frame := msg.([]animationModel.ChannelData)
+				if len(channels) != 0 {
+					filtered := make([]animationModel.ChannelData, 0, len(channels))
+					for _, channelData := range frame {
+						if channels[channelData.ChannelNum] {
+							filtered = append(filtered, channelData)
+						}
+					}
+					frame = filtered
+				}
+				if binding.Diffusion != nil {
+					frame = binding.Diffusion.Apply(frame)
+				}
+
+				// Only the first of a run of failures, and then periodic summaries, are
+				// reported to prevent an offline output from flooding the error channel
+				if err := binding.Output.Send(frame); err != nil {
+					sendErr(errorC, failures.Failed(err.With("output", binding.Output.Name()), time.Now()))
+				} else {
+					failures.Succeeded(time.Now())
+				}
+				if isValidate {
+					validate.setMissed(sub.Dropped())
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
+
+// copyFrame returns a deep copy of a frame that is safe to share between the
+// subscribers of a topic, who must not modify it
+//
+func copyFrame(frame []animationModel.ChannelData) (copied []animationModel.ChannelData) {
+	copied = make([]animationModel.ChannelData, 0, len(frame))
+	for _, channelData := range frame {
+		copied = append(copied, animationModel.ChannelData{
+			ChannelNum: channelData.ChannelNum,
+			Data:       append([]color.RGBA{}, channelData.Data...),
+		})
+	}
+	return copied
+}
+
+// TerminalOutput draws the strands as lines of color blocks, or ASCII characters, on
+// the terminal followed by the send statistics of each strand when they are available
+//
+type TerminalOutput struct {
+	stats *StrandStats
+}
+
+var (
+	headingOnce sync.Once
+
+	onceBody = func() {
+		fmt.Printf("\x1b[1;0H\x1b[0J     ")
+		for i := 1; i != 10; i++ {
+			fmt.Printf("         %d", i)
+		}
+		fmt.Printf("\n     ")
+		for i := 1; i != 10; i++ {
+			fmt.Print("1234567890")
+		}
+		fmt.Printf("\x1b[20;0H")
+	}
+)
+
+func (term *TerminalOutput) Name() (name string) {
+	return "terminal"
+}
+
+func (term *TerminalOutput) Send(frame []animationModel.ChannelData) (err errors.Error) {
+	headingOnce.Do(onceBody)
+	fmt.Printf("\x1b[3;0H")
+	for _, channelData := range frame {
+		debugStrand(channelData, term.stats)
+	}
+	return nil
+}
+
+// debugStrand renders a strand as a line of pixels drawn using the terminal color
+// mode, followed by the number of frames sent to the strand, the time the last send
+// took and any errors
+//
+func debugStrand(channelData animationModel.ChannelData, stats *StrandStats) {
+	mode := TerminalColors()
+	channel := uint8(channelData.ChannelNum)
+	strip := fmt.Sprintf("\x1b[%d;0H%02d %s ", channel+3, channel, mode.Arrow())
+	for _, rgba := range channelData.Data {
+		strip += mode.Pixel(rgba)
+	}
+	if report, isPresent := stats.Strand(channelData.ChannelNum); isPresent {
+		strip += "  " + Text("preview.frames", report.Frames, report.LastMs)
+		if report.Errors != 0 {
+			strip += " " + mode.Alert(Text("preview.errors", report.Errors))
+		}
+	}
+	fmt.Println(strip + "\x1b[K")
+	fmt.Printf("\x1b[32;0H")
+}
+
+// OPCOutput mirrors frames to an additional OPC server, such as a second fcserver,
+// the OPC visualizer or a controller driving RGBW strips.
+// Connections are retried no more than every 5 seconds
+//
+type OPCOutput struct {
+	server    string
+	oc        *opc.Client
+	lastTried time.Time
+	rgbw      *RGBW // The strands with a white LED, nil when all strands are RGB
+}
+
+// NewOPCOutput creates an output for the OPC server at the supplied address
+//
+func NewOPCOutput(server string) (output *OPCOutput) {
+	return &OPCOutput{server: server}
+}
+
+func (output *OPCOutput) Name() (name string) {
+	return "opc " + output.server
+}
+
+func (output *OPCOutput) Send(frame []animationModel.ChannelData) (err errors.Error) {
+	if output.oc == nil {
+		if time.Since(output.lastTried) < 5*time.Second {
+			return errors.New("OPC server not online").With("server", output.server).With("stack", stack.Trace().TrimRuntime())
+		}
+		output.lastTried = time.Now()
+
+		addr, err := ResolveAddr(output.server, defaultOPCPort)
+		if err != nil {
+			return err
+		}
+		oc := opc.NewClient()
+		if errGo := oc.Connect("tcp", addr); errGo != nil {
+			return errors.Wrap(errGo).With("server", output.server).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+		}
+		output.oc = oc
+	}
+
+	for _, channelData := range frame {
+		if errGo := output.oc.Send(output.rgbw.Pack(channelData)); errGo != nil {
+			output.oc = nil
+			return errors.Wrap(errGo).With("server", output.server).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package mawt
+
+// This module contains the alternative faction palettes for spectators with
+// color vision deficiencies.  The animations always render the Enlightened
+// faction in green and the Resistance in blue, a palette replaces pixels with
+// those hues by its own faction colors while retaining their brightness so
+// that fades and pulses continue to work
+
+import (
+	"image/color"
+	"math"
+	"sort"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+const (
+	paletteHueTolerance  = 30.0 // Degrees either side of the faction hue that are replaced
+	paletteMinSaturation = 0.5  // Pixels less saturated than this, such as the neutral white, are left alone
+)
+
+// Palette is a replacement pair of faction colors
+//
+type Palette struct {
+	Enlightened color.RGBA
+	Resistance  color.RGBA
+}
+
+var (
+	palettes = map[string]*Palette{
+		// Blue and amber remain distinct for the red-green color blindnesses
+		"deuteranopia": {
+			Enlightened: color.RGBA{0xFF, 0xC2, 0x0A, 0xFF},
+			Resistance:  color.RGBA{0x0C, 0x7B, 0xDC, 0xFF},
+		},
+		"protanopia": {
+			Enlightened: color.RGBA{0xF0, 0xE4, 0x42, 0xFF},
+			Resistance:  color.RGBA{0x00, 0x72, 0xB2, 0xFF},
+		},
+		// Red and teal remain distinct for the blue-yellow color blindness
+		"tritanopia": {
+			Enlightened: color.RGBA{0xDC, 0x32, 0x20, 0xFF},
+			Resistance:  color.RGBA{0x40, 0xB0, 0xA6, 0xFF},
+		},
+	}
+)
+
+// PaletteNames returns the names of the palettes that can be selected, the
+// standard palette being selected using an empty name or "standard"
+//
+func PaletteNames() (names []string) {
+	names = []string{"standard"}
+	for name := range palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// GetPalette returns the named palette, nil being returned for the standard palette
+//
+func GetPalette(name string) (palette *Palette, err errors.Error) {
+	if len(name) == 0 || name == "standard" {
+		return nil, nil
+	}
+	palette, isPresent := palettes[name]
+	if !isPresent {
+		return nil, errors.New("unknown palette").With("palette", name).With("available", PaletteNames()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return palette, nil
+}
+
+// PaletteName returns the name of a palette, nil being the standard palette
+//
+func PaletteName(palette *Palette) (name string) {
+	for name, named := range palettes {
+		if named == palette {
+			return name
+		}
+	}
+	return "standard"
+}
+
+func hueDistance(a float64, b float64) (distance float64) {
+	distance = math.Abs(a - b)
+	if distance > 180 {
+		distance = 360 - distance
+	}
+	return distance
+}
+
+// recolor replaces a pixel rendered in one of the faction colors
+//
+func (palette *Palette) recolor(pixel color.RGBA) (recolored color.RGBA) {
+	if pixel.A == 0 {
+		return pixel
+	}
+	h, s, v := colorful.MakeColor(pixel).Hsv()
+	if s < paletteMinSaturation || v == 0 {
+		return pixel
+	}
+
+	var target color.RGBA
+	switch {
+	case hueDistance(h, 120) <= paletteHueTolerance:
+		target = palette.Enlightened
+	case hueDistance(h, 240) <= paletteHueTolerance:
+		target = palette.Resistance
+	default:
+		return pixel
+	}
+	return color.RGBA{
+		R: uint8(float64(target.R)*v + 0.5),
+		G: uint8(float64(target.G)*v + 0.5),
+		B: uint8(float64(target.B)*v + 0.5),
+		A: pixel.A,
+	}
+}
+
+// Apply returns a copy of the frame with the faction colors recolored, the buffers of
+// the frame supplied belong to the animations and are left untouched
+//
+func (palette *Palette) Apply(frame []animationModel.ChannelData) (recolored []animationModel.ChannelData) {
+	if palette == nil {
+		return frame
+	}
+	recolored = make([]animationModel.ChannelData, 0, len(frame))
+	for _, channelData := range frame {
+		data := make([]color.RGBA, len(channelData.Data))
+		for i, pixel := range channelData.Data {
+			data[i] = palette.recolor(pixel)
+		}
+		recolored = append(recolored, animationModel.ChannelData{
+			ChannelNum: channelData.ChannelNum,
+			Data:       data,
+		})
+	}
+	return recolored
+}
@@ -0,0 +1,189 @@
+package mawt
+
+// This module implements pausing the sends of a pipeline so that a crew member can
+// swap a fadecandy board, or its USB cable, while the gateway keeps running.  A
+// pause is carried out by the render loop, which sends a last black frame so that
+// no strand is left lit by a half written frame, then closes the connection to the
+// fcserver and sends nothing further.  Resuming reconnects to the fcserver and
+// sends the firmware settings again for the new board, the portal animations, the
+// position of any show and every runtime setting having carried on in the meantime
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	opcDialTimeout = 5 * time.Second
+	drainTimeout   = 2 * time.Second // The time a pause waits for the render loop to send the blackout
+)
+
+// PauseState describes whether the sends of a pipeline are paused, and by what
+//
+type PauseState struct {
+	Paused  bool      `json:"paused"`
+	Drained bool      `json:"drained"` // The blackout was sent and the connection to the fcserver closed
+	Since   time.Time `json:"since"`
+	Source  string    `json:"source,omitempty"`
+}
+
+// pipelinePause is a pause of the sends of a pipeline, drainedC being closed once
+// the render loop has drained the pipeline
+//
+type pipelinePause struct {
+	state    PauseState
+	drainedC chan struct{}
+	sync.Mutex
+}
+
+// connect opens the OPC connection to the fadecandy server
+//
+func (fc *FadeCandy) connect() (err errors.Error) {
+	addr, err := ResolveAddr(fc.server, defaultOPCPort)
+	if err != nil {
+		return err
+	}
+	conn, errGo := net.DialTimeout("tcp", addr, opcDialTimeout)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", fc.server).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	fc.sending.Lock()
+	defer fc.sending.Unlock()
+
+	if fc.conn != nil {
+		fc.conn.Close()
+	}
+	fc.closeDevices()
+	fc.conn = conn
+	componentLog(LogOutput).Info("connected to the fadecandy server", "pipeline", fc.pipeline, "server", fc.server, "addr", addr)
+	return nil
+}
+
+// disconnect closes the OPC connection to the fadecandy server
+//
+func (fc *FadeCandy) disconnect() {
+	fc.sending.Lock()
+	defer fc.sending.Unlock()
+
+	fc.closeDevices()
+	if fc.conn != nil {
+		fc.conn.Close()
+		fc.conn = nil
+		componentLog(LogOutput).Debug("disconnected from the fadecandy server", "pipeline", fc.pipeline, "server", fc.server)
+	}
+}
+
+// draining returns the pause the render loop is to carry out with the frame being
+// rendered, or true when the pipeline has already been drained
+//
+func (fc *FadeCandy) draining() (pause *pipelinePause, isDrained bool) {
+	fc.Lock()
+	pause = fc.pause
+	fc.Unlock()
+	if pause == nil {
+		return nil, false
+	}
+
+	pause.Lock()
+	defer pause.Unlock()
+	if pause.state.Drained {
+		return nil, true
+	}
+	return pause, false
+}
+
+// drained is called by the render loop once the blackout of a pause has been sent,
+// closing the connection to the fcserver unless the pipeline was resumed meanwhile
+//
+func (fc *FadeCandy) drained(pause *pipelinePause) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.pause != pause {
+		return
+	}
+	fc.disconnect()
+
+	pause.Lock()
+	pause.state.Drained = true
+	state := pause.state
+	pause.Unlock()
+	close(pause.drainedC)
+
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: fc.pipeline, Kind: "pipeline-paused", Detail: state.Source})
+}
+
+// Pause blacks out the strands of the pipeline and closes its connection to the
+// fcserver, waiting for the render loop to do so.  Pausing a pipeline that is
+// already paused returns the existing pause
+//
+func (fc *FadeCandy) Pause(source string) (state PauseState, err errors.Error) {
+	fc.Lock()
+	if fc.pause == nil {
+		fc.pause = &pipelinePause{
+			state:    PauseState{Paused: true, Since: time.Now(), Source: source},
+			drainedC: make(chan struct{}),
+		}
+	}
+	pause := fc.pause
+	fc.Unlock()
+
+	select {
+	case <-pause.drainedC:
+	case <-time.After(drainTimeout):
+		return fc.PauseState(), errors.New("the pipeline did not drain in time, it remains paused").With("pipeline", fc.pipeline).With("timeout", drainTimeout).With("stack", stack.Trace().TrimRuntime())
+	}
+	return fc.PauseState(), nil
+}
+
+// Resume reconnects to the fcserver and restarts the sends of a paused pipeline,
+// the firmware settings being sent again.  The pipeline remains paused when the
+// fcserver cannot be reached so that the crew can try again
+//
+func (fc *FadeCandy) Resume(source string) (err errors.Error) {
+	fc.Lock()
+	pause := fc.pause
+	fc.Unlock()
+	if pause == nil {
+		return nil
+	}
+
+	if !fc.nop {
+		if err = fc.connect(); err != nil {
+			return err.With("pipeline", fc.pipeline)
+		}
+	}
+
+	fc.Lock()
+	fc.pause = nil
+	fc.configPending = true
+	fc.Unlock()
+
+	pause.Lock()
+	since := pause.state.Since
+	pause.Unlock()
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: fc.pipeline, Kind: "pipeline-resumed",
+		Detail: fmt.Sprintf("%s, paused for %s", source, time.Since(since).Round(time.Second))})
+	return nil
+}
+
+// PauseState returns whether the sends of the pipeline are paused
+//
+func (fc *FadeCandy) PauseState() (state PauseState) {
+	fc.Lock()
+	pause := fc.pause
+	fc.Unlock()
+	if pause == nil {
+		return state
+	}
+
+	pause.Lock()
+	defer pause.Unlock()
+	return pause.state
+}
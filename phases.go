@@ -0,0 +1,45 @@
+package mawt
+
+// This module implements the phase offsets of the fadecandy devices.  Sending
+// every strand at the start of the frame period has every device refresh its
+// LEDs at the same moment, so the current drawn from a shared power supply
+// peaks together at the frame rate.  Staggering the sends of the devices
+// across the frame period spreads the peaks out, reducing the ripple
+
+import (
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// PhaseConfig delays the sends to the strands of a device by a share of the frame period
+//
+type PhaseConfig struct {
+	Channels []int   `yaml:"channels" json:"channels"` // The OPC channels of the physical strands of the device
+	Offset   float64 `yaml:"offset" json:"offset"`     // The share of the frame period the sends are delayed by, from 0 up to 1
+}
+
+// Phases is the validated set of phase offsets indexed by physical channel, strands
+// that are not present are sent at the start of the frame period
+//
+type Phases map[int]float64
+
+// NewPhases validates the phase offsets of the devices and indexes them
+//
+func NewPhases(configs []PhaseConfig) (phases Phases, err errors.Error) {
+	phases = Phases{}
+	for _, config := range configs {
+		if config.Offset < 0 || config.Offset >= 1 {
+			return nil, errors.New("phase offsets must be from 0 up to 1 frame").With("offset", config.Offset).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, channel := range config.Channels {
+			if channel < 1 || channel > 255 {
+				return nil, errors.New("physical strands must use channels 1 to 255").With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+			}
+			if _, isPresent := phases[channel]; isPresent {
+				return nil, errors.New("physical strand given more than one phase offset").With("channel", channel).With("stack", stack.Trace().TrimRuntime())
+			}
+			phases[channel] = config.Offset
+		}
+	}
+	return phases, nil
+}
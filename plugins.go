@@ -0,0 +1,92 @@
+package mawt
+
+// This module loads effects distributed as compiled Go plugins, so that effects
+// written by the community can be added to a sculpture without forking this
+// repository.  Every plugin in the effects directory is opened at startup and
+// its effects are offered alongside the built in effects, to both headless
+// shows and the repl sub command.
+//
+// A plugin is a main package built using go build -buildmode=plugin that exports
+// a function named MawtEffects, with the signature
+//
+//     func MawtEffects() map[string]mawt.ShowEffect
+//
+// The Go toolchain only loads plugins built using the same version of Go, and
+// the same versions of every package shared with mawt, as the mawt binary
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"sort"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// effectsSymbol is the function exported by effect plugins
+	effectsSymbol = "MawtEffects"
+)
+
+// RegisterShowEffect adds an effect to those that can be played.  Effects must be
+// registered at startup, before any shows are played, and cannot replace an effect
+// already present
+//
+func RegisterShowEffect(name string, effect ShowEffect) (err errors.Error) {
+	if len(name) == 0 {
+		return errors.New("effects must have a name").With("stack", stack.Trace().TrimRuntime())
+	}
+	if effect.Build == nil {
+		return errors.New("effects must have a build function").With("effect", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, isPresent := showEffects[name]; isPresent {
+		return errors.New("an effect with this name is already present").With("effect", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	if effect.Defaults == nil {
+		effect.Defaults = map[string]string{}
+	}
+	showEffects[name] = effect
+	return nil
+}
+
+// LoadEffectPlugins opens every plugin, ending in .so, within the directory and
+// registers their effects, returning the names of the effects that were added
+//
+func LoadEffectPlugins(dir string) (loaded []string, err errors.Error) {
+	files, errGo := filepath.Glob(filepath.Join(dir, "*.so"))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		p, errGo := plugin.Open(file)
+		if errGo != nil {
+			return loaded, errors.Wrap(errGo).With("plugin", file).With("stack", stack.Trace().TrimRuntime())
+		}
+		symbol, errGo := p.Lookup(effectsSymbol)
+		if errGo != nil {
+			return loaded, errors.Wrap(errGo).With("plugin", file).With("stack", stack.Trace().TrimRuntime())
+		}
+		effects, isOK := symbol.(func() map[string]ShowEffect)
+		if !isOK {
+			return loaded, errors.New("plugin effects function has the wrong signature").With("plugin", file).With("symbol", effectsSymbol).With("type", fmt.Sprintf("%T", symbol)).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		// Effects are added in name order so that conflicts are reported consistently
+		offered := effects()
+		names := make([]string, 0, len(offered))
+		for name := range offered {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err = RegisterShowEffect(name, offered[name]); err != nil {
+				return loaded, err.With("plugin", file)
+			}
+			loaded = append(loaded, name)
+		}
+	}
+	return loaded, nil
+}
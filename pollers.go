@@ -0,0 +1,167 @@
+package mawt
+
+// This module implements the rate control and HTTP client shared by every
+// tecthulhu poller in the process.  When dozens of portals are served by a
+// single tecthulhu gateway the pollers would otherwise all start together and
+// keep checking in step, so the first check of each poller is offset by a
+// stagger, spreading the checks over the polling interval, and the status
+// requests in flight are capped by a pool of request slots.  The HTTP client
+// can be tuned for links such as cellular backhauls, where connections left
+// idle are silently dropped and requests can stall without a timeout
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	tecthulhuClient "github.com/TeamNorCal/mawt/tecthulhu"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// PollHTTP tunes the HTTP client used for tecthulhu status requests
+//
+type PollHTTP struct {
+	Timeout           time.Duration     `yaml:"timeout"`           // The time allowed for a single request including reading the status, 0 for no limit
+	DialTimeout       time.Duration     `yaml:"dialTimeout"`       // The time allowed to make a connection, 0 for no limit
+	KeepAlive         time.Duration     `yaml:"keepAlive"`         // The interval between TCP keep-alive probes, 0 for the Go default and negative to disable them
+	DisableKeepAlives bool              `yaml:"disableKeepAlives"` // Make a new connection for every request rather than reusing idle connections
+	MaxIdleConns      int               `yaml:"maxIdleConns"`      // Idle connections kept for each host, 0 for the Go default of 2
+	IdleConnTimeout   time.Duration     `yaml:"idleConnTimeout"`   // The time an idle connection is kept, 0 for no limit
+	Proxy             string            `yaml:"proxy"`             // The URL of a proxy, the HTTP_PROXY and HTTPS_PROXY environment variables are used when empty
+	Headers           map[string]string `yaml:"headers"`           // Optional headers sent with requests, for example an API key
+}
+
+type pollPool struct {
+	slots   chan struct{} // Holds a token for each request in flight, nil when requests are not capped
+	started int           // The number of pollers started, used to stagger them
+	client  *http.Client  // The client used for status requests, nil for http.DefaultClient
+	headers map[string]string
+	sync.Mutex
+}
+
+var (
+	pollers = &pollPool{}
+)
+
+// SetPollConcurrency caps the number of tecthulhu status requests in flight across
+// every pipeline, 0 removing the cap.  It is called before any portals are added
+//
+func SetPollConcurrency(concurrency int) {
+	pollers.Lock()
+	defer pollers.Unlock()
+
+	pollers.slots = nil
+	if concurrency > 0 {
+		pollers.slots = make(chan struct{}, concurrency)
+	}
+}
+
+// NewPollClient validates the HTTP tuning and creates a client using it
+//
+func NewPollClient(config PollHTTP) (client *http.Client, err errors.Error) {
+	if config.Timeout < 0 || config.DialTimeout < 0 || config.IdleConnTimeout < 0 || config.MaxIdleConns < 0 {
+		return nil, errors.New("polling HTTP timeouts and idle connections cannot be negative").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if len(config.Proxy) != 0 {
+		proxyURL, errGo := url.Parse(config.Proxy)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("proxy", config.Proxy).With("stack", stack.Trace().TrimRuntime())
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, errors.New("polling proxies must be http, https or socks5 URLs").With("proxy", config.Proxy).With("stack", stack.Trace().TrimRuntime())
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: config.KeepAlive}
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		DisableKeepAlives:   config.DisableKeepAlives,
+		MaxIdleConnsPerHost: config.MaxIdleConns,
+		IdleConnTimeout:     config.IdleConnTimeout,
+	}
+	return &http.Client{Timeout: config.Timeout, Transport: transport}, nil
+}
+
+// SetPollHTTP replaces the HTTP client used for tecthulhu status requests.  It is
+// called before any portals are added
+//
+func SetPollHTTP(config PollHTTP) (err errors.Error) {
+	client, err := NewPollClient(config)
+	if err != nil {
+		return err
+	}
+
+	pollers.Lock()
+	defer pollers.Unlock()
+
+	pollers.client, pollers.headers = client, config.Headers
+	return nil
+}
+
+// configure sets the HTTP client and headers of a tecthulhu client
+//
+func (pool *pollPool) configure(client *tecthulhuClient.Client) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	client.HTTP, client.Headers = pool.client, pool.headers
+}
+
+// acquire waits for a request slot, returning false when quitC is closed first
+//
+func (pool *pollPool) acquire(quitC <-chan struct{}) (acquired bool) {
+	pool.Lock()
+	slots := pool.slots
+	pool.Unlock()
+
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-quitC:
+		return false
+	}
+}
+
+// release returns a slot taken by acquire
+//
+func (pool *pollPool) release() {
+	pool.Lock()
+	slots := pool.slots
+	pool.Unlock()
+
+	if slots == nil {
+		return
+	}
+	select {
+	case <-slots:
+	default:
+	}
+}
+
+// offset returns the delay added before the first check of a newly started poller,
+// each poller being started a stagger after the one before, wrapping within the
+// interval so that the checks are spread evenly once dozens of pollers are running
+//
+func (pool *pollPool) offset(stagger time.Duration, interval time.Duration) (delay time.Duration) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	delay = time.Duration(pool.started) * stagger
+	pool.started++
+	if interval > 0 {
+		delay %= interval
+	}
+	return delay
+}
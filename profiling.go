@@ -0,0 +1,128 @@
+package mawt
+
+// This module implements the capture of CPU and allocation profiles on demand,
+// so that performance problems only seen under the load of a live event can be
+// diagnosed afterwards.  The render loops are labelled with the name of their
+// pipeline, allowing the profiles to be narrowed to a single pipeline using
+// the pprof -tagfocus option
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	DefaultProfileDuration = 10 * time.Second
+	maxProfileDuration     = 5 * time.Minute
+)
+
+// ProfileCapture lists the files written for a capture
+//
+type ProfileCapture struct {
+	Start     time.Time `json:"start"`
+	Duration  string    `json:"duration"`
+	CPU       string    `json:"cpu"`       // The CPU profile taken over the duration
+	AllocBase string    `json:"allocBase"` // The allocation profile at the start, for use with the pprof -diff_base option
+	Allocs    string    `json:"allocs"`    // The allocation profile at the end
+}
+
+var (
+	profiling = struct {
+		running bool
+		sync.Mutex
+	}{}
+)
+
+// CaptureProfile writes a CPU profile taken over the duration, along with the
+// allocation profiles at its start and end, to the directory using names made
+// from the time of the capture.  Only one capture can run at a time, and a CPU
+// profile taken using the /debug/pprof handlers also prevents a capture
+//
+func CaptureProfile(dir string, duration time.Duration, quitC <-chan struct{}) (capture *ProfileCapture, err errors.Error) {
+	if duration <= 0 || duration > maxProfileDuration {
+		return nil, errors.New("the profile duration must be greater than 0 and no more than 5m").With("duration", duration).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	profiling.Lock()
+	if profiling.running {
+		profiling.Unlock()
+		return nil, errors.New("a profile is already being captured").With("stack", stack.Trace().TrimRuntime())
+	}
+	profiling.running = true
+	profiling.Unlock()
+
+	defer func() {
+		profiling.Lock()
+		profiling.running = false
+		profiling.Unlock()
+	}()
+
+	if errGo := os.MkdirAll(dir, 0755); errGo != nil {
+		return nil, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	start := time.Now()
+	prefix := filepath.Join(dir, fmt.Sprintf("mawt-%s-", start.Format("20060102T150405")))
+	capture = &ProfileCapture{
+		Start:     start,
+		Duration:  duration.String(),
+		CPU:       prefix + "cpu.pprof",
+		AllocBase: prefix + "allocs-base.pprof",
+		Allocs:    prefix + "allocs.pprof",
+	}
+
+	if err = writeProfile("allocs", capture.AllocBase); err != nil {
+		return nil, err
+	}
+
+	cpu, errGo := os.Create(capture.CPU)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", capture.CPU).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer cpu.Close()
+
+	if errGo = pprof.StartCPUProfile(cpu); errGo != nil {
+		os.Remove(capture.CPU)
+		return nil, errors.Wrap(errGo).With("file", capture.CPU).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// A capture cut short by the gateway stopping is still written out
+	select {
+	case <-time.After(duration):
+	case <-quitC:
+		capture.Duration = time.Since(start).Round(time.Millisecond).String()
+	}
+	pprof.StopCPUProfile()
+
+	if errGo = cpu.Close(); errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", capture.CPU).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err = writeProfile("allocs", capture.Allocs); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+// writeProfile writes one of the named runtime profiles to a file
+//
+func writeProfile(name string, fn string) (err errors.Error) {
+	file, errGo := os.Create(fn)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = pprof.Lookup(name).WriteTo(file, 0); errGo != nil {
+		file.Close()
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = file.Close(); errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
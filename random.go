@@ -0,0 +1,74 @@
+package mawt
+
+// This module implements the seeding of the effects that use random numbers, such
+// as the shimmer of the decay countdown and the delays of the neutral portal
+// animation.  Live shows are seeded from the time, the seed chosen being
+// reported so that a recording can be reproduced, while tests and recordings
+// can fix a global seed, or a seed for an individual effect
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type seeding struct {
+	global  int64            // The seed the generators of the effects are derived from
+	effects map[string]int64 // Seeds for individual effects overriding the global seed
+	sync.Mutex
+}
+
+var (
+	seeds = &seeding{
+		global:  time.Now().UnixNano(),
+		effects: map[string]int64{},
+	}
+)
+
+// SetSeeds sets the global seed, a seed of 0 choosing one from the time, and the seeds
+// for individual effects.  Generators already handed out are not affected so this is
+// done on startup before any effects are created.  The animation package uses the
+// shared generator of the math/rand package, it is seeded using the global seed
+//
+func SetSeeds(global int64, effects map[string]int64) {
+	if global == 0 {
+		global = time.Now().UnixNano()
+	}
+
+	seeds.Lock()
+	defer seeds.Unlock()
+
+	seeds.global = global
+	seeds.effects = map[string]int64{}
+	for effect, seed := range effects {
+		seeds.effects[effect] = seed
+	}
+	rand.Seed(global)
+}
+
+// Seed returns the global seed in use
+//
+func Seed() (seed int64) {
+	seeds.Lock()
+	defer seeds.Unlock()
+
+	return seeds.global
+}
+
+// EffectRand returns a random number generator for an effect, seeded using the seed
+// for the effect when one is set or otherwise derived from the global seed and the
+// name of the effect so that effects do not share a sequence.  The generator is not
+// safe for concurrent use
+//
+func EffectRand(effect string) (random *rand.Rand) {
+	seeds.Lock()
+	defer seeds.Unlock()
+
+	if seed, isPresent := seeds.effects[effect]; isPresent {
+		return rand.New(rand.NewSource(seed))
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(effect))
+	return rand.New(rand.NewSource(seeds.global ^ int64(hash.Sum64())))
+}
@@ -0,0 +1,229 @@
+package mawt
+
+// This module implements the charging effect.  Recharging a portal is the most
+// common thing players do at it, yet the animations show nothing as the health of
+// the resonators rises.  A rise in the health of a resonator between polls is
+// treated as a recharge and plays a ripple of energy running up the strand of that
+// resonator, each wave brighter than the last, so that recharging the portal is
+// visibly rewarded by the sculpture
+
+import (
+	"image/color"
+	"math"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// RechargeConfig defines the ripple played on the strand of a resonator that was
+// recharged
+//
+type RechargeConfig struct {
+	Disabled bool          `yaml:"disabled" json:"disabled"`
+	Duration time.Duration `yaml:"duration" json:"duration"` // The length of the ripple, defaults to 3s
+	Waves    int           `yaml:"waves" json:"waves"`       // The number of waves running up the strand, defaults to 3
+	MinGain  float64       `yaml:"minGain" json:"minGain"`   // The rise in health, in percent, treated as a recharge, defaults to 1
+}
+
+var (
+	// resonatorStrands maps the positions of the resonators onto the logical strands
+	// the animations draw them on
+	resonatorStrands = map[string]animationModel.OpcChannel{
+		"N": 1, "NE": 2, "E": 3, "SE": 4, "S": 5, "SW": 6, "W": 7, "NW": 8,
+	}
+
+	rechargeWhite = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+)
+
+// rechargeRipple is a ripple playing on the strand of a resonator
+//
+type rechargeRipple struct {
+	strand   animationModel.OpcChannel
+	strength float64 // From 0.5 to 1, following the health gained
+	color    color.RGBA
+	start    time.Time
+}
+
+// Recharge detects recharges of the displayed portal and plays their ripples
+//
+type Recharge struct {
+	config  RechargeConfig
+	status  *model.Status // The last status of the displayed portal
+	ripples []rechargeRipple
+	sync.Mutex
+}
+
+// NewRecharge validates the charging effect configuration, returning nil when it is
+// disabled
+//
+func NewRecharge(config RechargeConfig) (recharge *Recharge, err errors.Error) {
+	if config.Duration < 0 {
+		return nil, errors.New("the recharge duration cannot be negative").With("duration", config.Duration).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Waves < 0 || config.Waves > 10 {
+		return nil, errors.New("the recharge waves must be from 1 to 10").With("waves", config.Waves).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.MinGain < 0 || config.MinGain > maxHealth {
+		return nil, errors.New("the recharge minimum gain must be from 0 to 100 percent").With("minGain", config.MinGain).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Duration == 0 {
+		config.Duration = 3 * time.Second
+	}
+	if config.Waves == 0 {
+		config.Waves = 3
+	}
+	if config.MinGain == 0 {
+		config.MinGain = 1
+	}
+
+	if config.Disabled {
+		return nil, nil
+	}
+	return &Recharge{config: config}, nil
+}
+
+// Update records the status of the displayed portal, starting a ripple on the strand
+// of each resonator whose health rose without it being upgraded.  A change of the
+// displayed portal starts no ripples
+//
+func (recharge *Recharge) Update(status *model.Status, now time.Time) {
+	recharge.Lock()
+	defer recharge.Unlock()
+
+	last := recharge.status
+	recharge.status = status
+	if last == nil || last.Title != status.Title || status.Faction != last.Faction {
+		return
+	}
+
+	c, isPresent := timelineColors[status.Faction]
+	if !isPresent || status.Faction == "N" {
+		c = rechargeWhite
+	}
+
+	prior := map[string]model.Resonator{}
+	for _, reso := range last.Resonators {
+		prior[reso.Position] = reso
+	}
+	for _, reso := range status.Resonators {
+		before, isPresent := prior[reso.Position]
+		strand, isMapped := resonatorStrands[reso.Position]
+		if !isPresent || !isMapped || reso.Level == 0 || before.Level != reso.Level {
+			continue
+		}
+		gain := float64(reso.Health - before.Health)
+		if gain < recharge.config.MinGain {
+			continue
+		}
+
+		// A resonator recharged again while its ripple plays restarts the ripple
+		ripple := rechargeRipple{
+			strand:   strand,
+			strength: 0.5 + 0.5*math.Min(1, gain/50),
+			color:    c,
+			start:    now,
+		}
+		replaced := false
+		for i := range recharge.ripples {
+			if recharge.ripples[i].strand == strand {
+				recharge.ripples[i] = ripple
+				replaced = true
+			}
+		}
+		if !replaced {
+			recharge.ripples = append(recharge.ripples, ripple)
+		}
+	}
+}
+
+// active returns the ripples playing at the supplied time, dropping those that
+// have finished
+//
+func (recharge *Recharge) active(tm time.Time) (ripples []rechargeRipple) {
+	recharge.Lock()
+	defer recharge.Unlock()
+
+	playing := recharge.ripples[:0]
+	for _, ripple := range recharge.ripples {
+		if tm.Sub(ripple.start) < recharge.config.Duration {
+			playing = append(playing, ripple)
+		}
+	}
+	recharge.ripples = playing
+	return append([]rechargeRipple{}, playing...)
+}
+
+// Overlay draws the ripples over the strands of the recharged resonators, the
+// strands of the frame that carry no ripple are left as they are
+//
+func (recharge *Recharge) Overlay(frame []animationModel.ChannelData, tm time.Time) (overlaid []animationModel.ChannelData) {
+	ripples := recharge.active(tm)
+	if len(ripples) == 0 {
+		return frame
+	}
+
+	overlaid = make([]animationModel.ChannelData, len(frame))
+	copy(overlaid, frame)
+	for _, ripple := range ripples {
+		for i, channelData := range overlaid {
+			if channelData.ChannelNum != ripple.strand {
+				continue
+			}
+			data := make([]color.RGBA, len(channelData.Data))
+			for j, c := range channelData.Data {
+				data[j] = blendRGBA(c, ripple.color, recharge.level(ripple, tm, j, len(data)))
+			}
+			overlaid[i] = animationModel.ChannelData{ChannelNum: channelData.ChannelNum, Data: data}
+		}
+	}
+	return overlaid
+}
+
+// level returns how far a pixel of a strand is drawn towards the color of the
+// ripple.  Each wave runs from the base of the strand to its tip in half the length
+// of the ripple, leaving a glow behind it, the waves starting in turn and each
+// brighter than the last, with the whole ripple fading over its last fifth
+//
+func (recharge *Recharge) level(ripple rechargeRipple, tm time.Time, pixel int, pixels int) (level float64) {
+	duration := float64(recharge.config.Duration)
+	age := float64(tm.Sub(ripple.start)) / duration
+	travel := 0.5
+	spacing := 0.0
+	if recharge.config.Waves > 1 {
+		spacing = (1 - travel) / float64(recharge.config.Waves)
+	}
+	position := float64(pixel) / math.Max(1, float64(pixels-1))
+
+	for wave := 0; wave < recharge.config.Waves; wave++ {
+		progress := (age - float64(wave)*spacing) / travel
+		if progress < 0 {
+			continue
+		}
+		intensity := float64(wave+1) / float64(recharge.config.Waves)
+		d := (position - progress) / 0.08
+		front := math.Exp(-d * d)
+		glow := 0.0
+		if position < progress {
+			glow = 0.25
+		}
+		level = math.Max(level, intensity*math.Max(front, glow))
+	}
+
+	if age > 0.8 {
+		level *= (1 - age) / 0.2
+	}
+	return math.Max(0, math.Min(1, level*ripple.strength))
+}
+
+// blendRGBA moves a color towards another by the supplied fraction
+//
+func blendRGBA(from color.RGBA, to color.RGBA, fraction float64) (blended color.RGBA) {
+	mix := func(a uint8, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*fraction + 0.5)
+	}
+	return color.RGBA{R: mix(from.R, to.R), G: mix(from.G, to.G), B: mix(from.B, to.B), A: from.A}
+}
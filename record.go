@@ -0,0 +1,58 @@
+package mawt
+
+// This module implements an output that records the frames of a pipeline to a
+// file as frame records, described in frames.go, so that a show or an incident
+// can be played back later using the replay sub command
+
+import (
+	"os"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// RecordOutput appends frames to a recording
+//
+type RecordOutput struct {
+	file string
+	enc  *FrameEncoder
+	out  *os.File
+}
+
+// NewRecordOutput opens a recording, appending to it when it already exists, using
+// the named compression and key frame interval with frames tagged with the universe
+//
+func NewRecordOutput(fn string, compression string, keyframes int, universe uint16) (output *RecordOutput, err errors.Error) {
+	enc, err := NewFrameEncoder(compression, keyframes)
+	if err != nil {
+		return nil, err.With("file", fn)
+	}
+	enc.Universe = universe
+
+	out, errGo := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &RecordOutput{file: fn, enc: enc, out: out}, nil
+}
+
+func (output *RecordOutput) Name() (name string) {
+	return "record " + output.file
+}
+
+// Send appends a frame to the recording, a frame that cannot be written in full
+// causes the next to be recorded as a key frame
+//
+func (output *RecordOutput) Send(frame []animationModel.ChannelData) (err errors.Error) {
+	msg, err := output.enc.Encode(frame, time.Now())
+	if err != nil {
+		return err.With("file", output.file)
+	}
+	if _, errGo := output.out.Write(msg); errGo != nil {
+		output.enc.Reset()
+		return errors.Wrap(errGo).With("file", output.file).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package mawt
+
+// This module implements the end of event report built from the persisted store,
+// giving the uptime, frames rendered, the availability of the fadecandy server and
+// the tecthulhus, and the most frequent errors, for use in after action reviews
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// errorDetail matches the start of the key value pairs appended to error messages,
+	// which differ between occurrences of the same error
+	errorDetail = regexp.MustCompile(`\s+[A-Za-z][A-Za-z0-9_]*=`)
+)
+
+// ReportPipeline is the availability of a pipeline over the period of a report,
+// availabilities are percentages of the time the pipeline was running
+//
+type ReportPipeline struct {
+	Name               string            `json:"name"`
+	Uptime             string            `json:"uptime"`
+	Frames             uint64            `json:"frames"`
+	Restarts           int               `json:"restarts"`
+	OPCAvailability    float64           `json:"opcAvailability"`
+	PortalAvailability float64           `json:"portalAvailability"`
+	OPCDrops           int               `json:"opcDrops"`
+	Holds              map[string]string `json:"holds"`
+
+	up     time.Duration
+	opcUp  time.Duration
+	portUp time.Duration
+	last   *StoreRecord
+}
+
+// ReportError is an error message along with how often it was seen
+//
+type ReportError struct {
+	Error string    `json:"error"`
+	Count int       `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// Report is the summary of the persisted records for a period such as an event
+//
+type Report struct {
+	From          time.Time        `json:"from"`
+	Until         time.Time        `json:"until"`
+	Uptime        string           `json:"uptime"`
+	UptimePercent float64          `json:"uptimePercent"`
+	Frames        uint64           `json:"frames"`
+	Pipelines     []ReportPipeline `json:"pipelines"`
+	Events        map[string]int   `json:"events"`
+	Errors        int              `json:"errors"`
+	TopErrors     []ReportError    `json:"topErrors"`
+}
+
+// NewReport analyses the records of a period, which are expected in time order,
+// listing the top most frequent errors.  Each metrics sample is taken to cover
+// the sampling interval before it, so the uptime is the time covered by samples
+//
+func NewReport(records []StoreRecord, from time.Time, until time.Time, top int) (report *Report) {
+	summary := Summarize(records, from, until)
+	report = &Report{
+		From:      from,
+		Until:     until,
+		Pipelines: []ReportPipeline{},
+		Events:    summary.Events,
+		Errors:    summary.Errors,
+		TopErrors: []ReportError{},
+	}
+
+	pipelines := map[string]*ReportPipeline{}
+	errs := map[string]*ReportError{}
+	for i, record := range records {
+		switch record.Kind {
+		case "error":
+			key := record.Error
+			if loc := errorDetail.FindStringIndex(key); loc != nil {
+				key = key[:loc[0]]
+			}
+			key = strings.TrimSpace(key)
+			if reportErr, isPresent := errs[key]; isPresent {
+				reportErr.Count++
+				reportErr.Last = record.Time
+				continue
+			}
+			errs[key] = &ReportError{Error: key, Count: 1, First: record.Time, Last: record.Time}
+		case "metrics":
+			if record.Metrics == nil {
+				continue
+			}
+			pipeline, isPresent := pipelines[record.Pipeline]
+			if !isPresent {
+				pipeline = &ReportPipeline{Name: record.Pipeline}
+				pipelines[record.Pipeline] = pipeline
+			}
+			metrics := record.Metrics
+
+			covered := time.Duration(metrics.Interval * float64(time.Second))
+			if pipeline.last != nil {
+				if gap := record.Time.Sub(pipeline.last.Time); covered == 0 || gap < covered {
+					covered = gap
+				}
+			}
+			if start := record.Time.Sub(from); covered > start {
+				covered = start
+			}
+			pipeline.up += covered
+			if metrics.OPCOffline == 0 {
+				pipeline.opcUp += covered
+			}
+			if !metrics.PortalsUnreachable {
+				pipeline.portUp += covered
+			}
+
+			// The frame count starts again from zero when the gateway restarts
+			switch {
+			case pipeline.last == nil:
+			case metrics.Frames < pipeline.last.Metrics.Frames:
+				pipeline.Restarts++
+				pipeline.Frames += metrics.Frames
+			default:
+				pipeline.Frames += metrics.Frames - pipeline.last.Metrics.Frames
+			}
+			pipeline.last = &records[i]
+		}
+	}
+
+	names := make([]string, 0, len(pipelines))
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	percent := func(part time.Duration, whole time.Duration) float64 {
+		if whole <= 0 {
+			return 0
+		}
+		return float64(int64(10000*float64(part)/float64(whole))) / 100
+	}
+
+	uptime := time.Duration(0)
+	for _, name := range names {
+		pipeline := pipelines[name]
+		pipeline.Uptime = pipeline.up.Round(time.Second).String()
+		pipeline.OPCAvailability = percent(pipeline.opcUp, pipeline.up)
+		pipeline.PortalAvailability = percent(pipeline.portUp, pipeline.up)
+		pipeline.OPCDrops = summary.OPCDrops[name]
+		if pipeline.Holds = summary.Holds[name]; pipeline.Holds == nil {
+			pipeline.Holds = map[string]string{}
+		}
+		if pipeline.up > uptime {
+			uptime = pipeline.up
+		}
+		report.Frames += pipeline.Frames
+		report.Pipelines = append(report.Pipelines, *pipeline)
+	}
+	report.Uptime = uptime.Round(time.Second).String()
+	report.UptimePercent = percent(uptime, until.Sub(from))
+
+	for _, reportErr := range errs {
+		report.TopErrors = append(report.TopErrors, *reportErr)
+	}
+	sort.Slice(report.TopErrors, func(i, j int) bool {
+		if report.TopErrors[i].Count != report.TopErrors[j].Count {
+			return report.TopErrors[i].Count > report.TopErrors[j].Count
+		}
+		return report.TopErrors[i].First.Before(report.TopErrors[j].First)
+	})
+	if top >= 0 && len(report.TopErrors) > top {
+		report.TopErrors = report.TopErrors[:top]
+	}
+	return report
+}
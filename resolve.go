@@ -0,0 +1,101 @@
+package mawt
+
+// This module contains the resolution of the addresses used for the fadecandy
+// server and the tecthulhus.  In addition to host:port pairs it supports IPv6
+// literals with or without brackets, and DNS SRV names such as _opc._tcp.example.local
+// allowing deployments with dynamic addressing to avoid hard-coded IPs
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultOPCPort = "7890"
+)
+
+// isSRVName is used to detect names of the form _service._proto.domain
+//
+func isSRVName(host string) bool {
+	parts := strings.SplitN(host, ".", 3)
+	return len(parts) == 3 && strings.HasPrefix(parts[0], "_") && strings.HasPrefix(parts[1], "_")
+}
+
+// lookupSRV resolves a DNS SRV name into a host:port pair using the highest priority target
+//
+func lookupSRV(name string) (addr string, err errors.Error) {
+	_, addrs, errGo := net.LookupSRV("", "", name)
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(addrs) == 0 {
+		return "", errors.New("no SRV records found").With("name", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	// The records are returned already sorted by priority and randomized by weight
+	return net.JoinHostPort(strings.TrimSuffix(addrs[0].Target, "."), strconv.Itoa(int(addrs[0].Port))), nil
+}
+
+// ResolveAddr converts an address supplied by the user into a host:port pair that
+// can be dialed.  The defaultPort is used when the address does not specify one.
+//
+func ResolveAddr(addr string, defaultPort string) (resolved string, err errors.Error) {
+
+	addr = strings.TrimSpace(addr)
+
+	if isSRVName(strings.TrimSuffix(addr, ".")) {
+		return lookupSRV(addr)
+	}
+
+	// A bare IPv6 literal, which might have a zone, cannot be split into a
+	// host and port so is checked for before anything else
+	if ip := net.ParseIP(strings.SplitN(addr, "%", 2)[0]); ip != nil {
+		return net.JoinHostPort(addr, defaultPort), nil
+	}
+
+	host, port, errGo := net.SplitHostPort(addr)
+	if errGo != nil {
+		// Bracketed IPv6 literals, and host names without ports are given the default port
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		port = defaultPort
+	}
+	if len(host) == 0 {
+		return "", errors.New("address has no host").With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// resolveURL replaces a DNS SRV host within a URL with the host:port pair it currently refers to,
+// other URLs are returned unchanged
+//
+func resolveURL(u url.URL) (resolved url.URL, err errors.Error) {
+	if !isSRVName(u.Hostname()) {
+		return u, nil
+	}
+	host, err := lookupSRV(u.Hostname())
+	if err != nil {
+		return u, err.With("url", u.String())
+	}
+	u.Host = host
+	return u, nil
+}
+
+// ProbeOPC checks that an OPC server, such as the fcserver, accepts connections at
+// an address supplied by the user, returning the address that was dialed
+//
+func ProbeOPC(server string, timeout time.Duration) (addr string, err errors.Error) {
+	if addr, err = ResolveAddr(server, defaultOPCPort); err != nil {
+		return "", err
+	}
+	conn, errGo := net.DialTimeout("tcp", addr, timeout)
+	if errGo != nil {
+		return addr, errors.Wrap(errGo).With("server", server).With("addr", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+	conn.Close()
+	return addr, nil
+}
@@ -0,0 +1,131 @@
+package mawt
+
+// This module implements support for RGBW strips, such as the SK6812, that
+// have a fourth white LED in every pixel.  The animations render RGB colors,
+// the white component is extracted from them as the frame is packed for the
+// strands that have been declared as RGBW, which are then sent with 4 bytes
+// for every pixel.  The fcserver only drives RGB strands, and mawt has no sACN,
+// Art-Net or WLED outputs, so RGBW strands are only carried by opc outputs to
+// controllers, or bridges to those protocols, that accept 4 byte pixels over OPC.
+// The node and record outputs carry the RGB frames as rendered, render nodes
+// driving their own fadecandy servers, and the terminal, websocket and validate
+// outputs only preview or check the frames
+
+import (
+	"image/color"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"github.com/kellydunn/go-opc"
+)
+
+const (
+	// maxRGBWPixels is the number of 4 byte pixels that fit in an OPC message
+	maxRGBWPixels = opc.MAX_MESSAGE_SIZE / 4
+)
+
+// RGBWConfig declares the physical strands of an output that have a white LED
+//
+type RGBWConfig struct {
+	Strands []int `yaml:"strands" json:"strands"` // The OPC channels of the RGBW strands, all other strands are RGB
+
+	// White selects how the white component is extracted.  min moves the common
+	// part of the red, green and blue onto the white LED, add lights the white LED
+	// with the common part while leaving the colors unchanged for extra brightness,
+	// and none leaves the white LED off.  Defaults to min
+	White string `yaml:"white" json:"white"`
+}
+
+// RGBW packs the strands of an output, RGBW strands using 4 bytes per pixel
+//
+type RGBW struct {
+	strands map[animationModel.OpcChannel]bool
+	white   string
+}
+
+// NewRGBW validates the RGBW strands of an output
+//
+func NewRGBW(config RGBWConfig) (rgbw *RGBW, err errors.Error) {
+	rgbw = &RGBW{
+		strands: map[animationModel.OpcChannel]bool{},
+		white:   config.White,
+	}
+	switch rgbw.white {
+	case "":
+		rgbw.white = "min"
+	case "min", "add", "none":
+	default:
+		return nil, errors.New("unknown white extraction, min, add and none are supported").With("white", config.White).With("stack", stack.Trace().TrimRuntime())
+	}
+	for _, strand := range config.Strands {
+		if strand < 1 || strand > 255 {
+			return nil, errors.New("RGBW strands must use channels 1 to 255").With("strand", strand).With("stack", stack.Trace().TrimRuntime())
+		}
+		rgbw.strands[animationModel.OpcChannel(strand)] = true
+	}
+	return rgbw, nil
+}
+
+// Components returns the number of bytes per pixel of a strand
+//
+func (rgbw *RGBW) Components(channel animationModel.OpcChannel) (components int) {
+	if rgbw != nil && rgbw.strands[channel] {
+		return 4
+	}
+	return 3
+}
+
+// Extract returns the RGBW components of a color
+//
+func (rgbw *RGBW) Extract(rgba color.RGBA) (r uint8, g uint8, b uint8, w uint8) {
+	if rgba.A == 0 {
+		return 0, 0, 0, 0
+	}
+	r, g, b = rgba.R, rgba.G, rgba.B
+
+	w = r
+	if g < w {
+		w = g
+	}
+	if b < w {
+		w = b
+	}
+	switch rgbw.white {
+	case "none":
+		return r, g, b, 0
+	case "add":
+		return r, g, b, w
+	}
+	return r - w, g - w, b - w, w
+}
+
+// Pack prepares the OPC message for a strand, RGB strands are packed as they are
+// for the fcserver
+//
+func (rgbw *RGBW) Pack(channelData animationModel.ChannelData) (m *opc.Message) {
+	if rgbw.Components(channelData.ChannelNum) == 3 {
+		return PackStrand(channelData)
+	}
+
+	pixels := channelData.Data
+	if len(pixels) > maxRGBWPixels {
+		pixels = pixels[:maxRGBWPixels]
+	}
+	data := make([]byte, 0, len(pixels)*4+2)
+	for _, rgba := range pixels {
+		r, g, b, w := rgbw.Extract(rgba)
+		data = append(data, r, g, b, w)
+	}
+
+	// The message only offers access to its data as RGB triples, so the bytes
+	// are copied in threes with any excess beyond the length being ignored
+	m = opc.NewMessage(uint8(channelData.ChannelNum))
+	m.SetLength(uint16(len(pixels) * 4))
+	data = append(data, 0, 0)
+	for i := 0; i*3 < len(pixels)*4; i++ {
+		m.SetPixelColor(i, data[i*3], data[i*3+1], data[i*3+2])
+	}
+	return m
+}
@@ -0,0 +1,152 @@
+package mawt
+
+// This module implements the safe mode the gateway boots into after crashing
+// repeatedly, so that a broken effect, show or plugin cannot keep the sculpture
+// dark through an event.  Each start is recorded in a small state file that is
+// marked clean when the gateway shuts down normally, a start finding the previous
+// run still marked as running counts a crash.  Once enough consecutive crashes are
+// counted the gateway drops everything optional from its configuration, loads no
+// effect plugins and draws only the static color of the faction holding the
+// displayed portal.  Safe mode lasts until the gateway is shut down cleanly, for
+// example by an operator restarting it once the cause has been fixed
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// CrashState is the record of the starts of the gateway kept across restarts
+//
+type CrashState struct {
+	Crashes  int       `json:"crashes"`  // The consecutive starts that ended without a clean shutdown
+	Running  bool      `json:"running"`  // Cleared by a clean shutdown
+	Started  time.Time `json:"started"`  // When the gateway last started
+	SafeMode bool      `json:"safeMode"` // Set when the gateway started in safe mode
+}
+
+// CrashGuard counts the crashes of the gateway using a state file
+//
+type CrashGuard struct {
+	file  string
+	state CrashState
+	sync.Mutex
+}
+
+// StartCrashGuard records a start of the gateway in the state file, counting a
+// crash when the previous run did not shut down cleanly.  Safe mode is chosen when
+// the crashes reach the limit, a limit of 0 never choosing it
+//
+func StartCrashGuard(file string, limit int) (guard *CrashGuard, err errors.Error) {
+	guard = &CrashGuard{file: file}
+
+	data, errGo := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(errGo):
+	case errGo != nil:
+		return nil, errors.Wrap(errGo).With("file", file).With("stack", stack.Trace().TrimRuntime())
+	default:
+		// A state file that cannot be decoded was most likely being written during
+		// a power loss, which is counted as a crash
+		if errGo = json.Unmarshal(data, &guard.state); errGo != nil {
+			guard.state = CrashState{Crashes: 1}
+		} else if guard.state.Running {
+			guard.state.Crashes++
+		} else {
+			guard.state.Crashes = 0
+		}
+	}
+
+	guard.state.Running = true
+	guard.state.Started = time.Now()
+	guard.state.SafeMode = limit > 0 && guard.state.Crashes >= limit
+	if err = guard.save(); err != nil {
+		return nil, err
+	}
+	if guard.state.SafeMode {
+		bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "safemode", Detail: "started in safe mode after the gateway crashed repeatedly"})
+	}
+	return guard, nil
+}
+
+func (guard *CrashGuard) save() (err errors.Error) {
+	data, errGo := json.MarshalIndent(guard.state, "", "  ")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", guard.file).With("stack", stack.Trace().TrimRuntime())
+	}
+	return writeAtomic(guard.file, data)
+}
+
+// State returns the record of the starts of the gateway
+//
+func (guard *CrashGuard) State() (state CrashState) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	return guard.state
+}
+
+// Stable clears the crashes once the gateway has run long enough to be trusted,
+// a gateway in safe mode stays in it, and counting, until it is shut down cleanly
+//
+func (guard *CrashGuard) Stable() (err errors.Error) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	if guard.state.SafeMode || guard.state.Crashes == 0 {
+		return nil
+	}
+	guard.state.Crashes = 0
+	return guard.save()
+}
+
+// Stopped records a clean shutdown, the next start being a normal one
+//
+func (guard *CrashGuard) Stopped() (err errors.Error) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	guard.state.Running = false
+	guard.state.Crashes = 0
+	return guard.save()
+}
+
+// SafeConfig returns a copy of a configuration without the shows, scenes, overlays,
+// status translations, output mirrors and inputs that could have caused the
+// crashes, keeping only what is needed to drive the strands
+//
+func SafeConfig(cfg *Config) (safe *Config) {
+	copied := *cfg
+	safe = &copied
+
+	safe.Show = nil
+	safe.Scenes = nil
+	safe.Stingers = nil
+	safe.Transform = nil
+	safe.Timeline = nil
+	safe.Score = nil
+	safe.Ticker = nil
+	safe.Decay = nil
+	safe.Outputs = nil
+	safe.OPCInput = nil
+	safe.Console = nil
+	safe.Heartbeat.Disabled = true
+	safe.Recharge.Disabled = true
+
+	safe.Pipelines = make([]PipelineConfig, len(cfg.Pipelines))
+	for i, pipeline := range cfg.Pipelines {
+		pipeline.Transform = nil
+		pipeline.Timeline = nil
+		pipeline.Score = nil
+		pipeline.Ticker = nil
+		pipeline.Outputs = nil
+		pipeline.OPCInput = nil
+		safe.Pipelines[i] = pipeline
+	}
+	return safe
+}
@@ -0,0 +1,109 @@
+package mawt
+
+// This module contains the sanity checks applied to the portal status reported
+// by tecthulhus, protecting the display from glitched firmware or malicious
+// feeds.  Values that are slightly out of range are clamped, while statuses
+// that are wildly inconsistent are reported so that the portal can be
+// quarantined until it is once again reporting believable statuses
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TeamNorCal/mawt/model"
+)
+
+var (
+	// factions maps the faction names and codes that have been seen in tecthulhu
+	// and simulator data to the canonical single letter codes
+	factions = map[string]string{
+		"e": "E", "enlightened": "E", "enl": "E", "1": "E",
+		"r": "R", "resistance": "R", "res": "R", "2": "R",
+		"n": "N", "neutral": "N", "neu": "N", "0": "N", "": "N",
+	}
+
+	resonatorPositions = map[string]bool{
+		"E": true, "NE": true, "N": true, "NW": true,
+		"W": true, "SW": true, "S": true, "SE": true,
+	}
+)
+
+const (
+	maxLevel      = 8
+	maxHealth     = 100
+	maxResonators = 8
+	maxMods       = 4
+)
+
+// clampValue limits a value to a range, values further out of range than the range
+// is wide are treated as wild
+//
+func clampValue(name string, value float32, min float32, max float32, clamped *[]string, wild *[]string) (result float32) {
+	if value >= min && value <= max {
+		return value
+	}
+	if value < min-(max-min) || value > max+(max-min) {
+		*wild = append(*wild, fmt.Sprintf("%s %v far outside %v-%v", name, value, min, max))
+	} else {
+		*clamped = append(*clamped, fmt.Sprintf("%s %v clamped to %v-%v", name, value, min, max))
+	}
+	return clamp(value, min, max)
+}
+
+// sanitizeStatus normalizes the faction and clamps the values of a portal status in place.
+// The changes made are returned in clamped, while problems that indicate the status
+// cannot be trusted are returned in inconsistent
+//
+func sanitizeStatus(status *model.Status) (clamped []string, inconsistent []string) {
+	clamped = []string{}
+	inconsistent = []string{}
+
+	faction, isPresent := factions[strings.ToLower(strings.TrimSpace(status.Faction))]
+	if !isPresent {
+		inconsistent = append(inconsistent, fmt.Sprintf("unknown faction %q", status.Faction))
+		faction = "N"
+	}
+	status.Faction = faction
+
+	minLevel := float32(1)
+	if faction == "N" {
+		minLevel = 0
+	}
+	status.Level = clampValue("level", status.Level, minLevel, maxLevel, &clamped, &inconsistent)
+	status.Health = clampValue("health", status.Health, 0, maxHealth, &clamped, &inconsistent)
+
+	if len(status.Resonators) > maxResonators {
+		inconsistent = append(inconsistent, fmt.Sprintf("%d resonators", len(status.Resonators)))
+		status.Resonators = status.Resonators[:maxResonators]
+	}
+	positions := map[string]bool{}
+	deployed := 0
+	for i := range status.Resonators {
+		reso := &status.Resonators[i]
+		if !resonatorPositions[reso.Position] {
+			inconsistent = append(inconsistent, fmt.Sprintf("unknown resonator position %q", reso.Position))
+		} else if positions[reso.Position] {
+			inconsistent = append(inconsistent, fmt.Sprintf("duplicate resonator position %s", reso.Position))
+		}
+		positions[reso.Position] = true
+
+		reso.Level = clampValue("resonator "+reso.Position+" level", reso.Level, 0, maxLevel, &clamped, &inconsistent)
+		reso.Health = clampValue("resonator "+reso.Position+" health", reso.Health, 0, maxHealth, &clamped, &inconsistent)
+		if reso.Level != 0 {
+			deployed++
+		}
+	}
+	if faction == "N" && deployed != 0 {
+		inconsistent = append(inconsistent, fmt.Sprintf("neutral portal with %d resonators deployed", deployed))
+	}
+
+	if len(status.Mods) > maxMods {
+		inconsistent = append(inconsistent, fmt.Sprintf("%d mods", len(status.Mods)))
+		status.Mods = status.Mods[:maxMods]
+	}
+	for i := range status.Mods {
+		status.Mods[i].Slot = clampValue("mod slot", status.Mods[i].Slot, 1, maxMods, &clamped, &inconsistent)
+	}
+
+	return clamped, inconsistent
+}
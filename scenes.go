@@ -0,0 +1,272 @@
+package mawt
+
+// This module implements named override scenes, such as a photo mode of plain
+// white or a slow gold shimmer for a tour, that an operator activates by name from
+// the REST API, the lighting console, a GPIO button or the terminal preview.  A
+// scene replaces the animations of a pipeline, leaving the overlays in place, and
+// reverts to them once its timeout has passed so that a scene left on by mistake
+// does not hide the portal for the rest of an event
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultSceneTimeout = 5 * time.Minute
+)
+
+// SceneConfig defines a named scene, a show effect played on every strand in place
+// of the animations
+//
+type SceneConfig struct {
+	Name       string            `yaml:"name" json:"name"`
+	Effect     string            `yaml:"effect" json:"effect"`         // One of the show effects
+	Params     map[string]string `yaml:"params" json:"params"`         // Parameters overriding the defaults of the effect
+	Brightness float64           `yaml:"brightness" json:"brightness"` // Scales the colors of the effect, from 0 to 1, defaults to 1
+	Timeout    time.Duration     `yaml:"timeout" json:"timeout"`       // The time after which the animations return, defaults to 5 minutes
+	Strands    int               `yaml:"strands" json:"strands"`       // The number of logical strands, defaults to 24
+	Pixels     int               `yaml:"pixels" json:"pixels"`         // The number of pixels in each strand, defaults to 30
+
+	Vary      map[string]ParamRange `yaml:"vary" json:"vary"`           // Optional parameters drawn between bounds each time the scene is activated
+	VaryEvery time.Duration         `yaml:"varyEvery" json:"varyEvery"` // How often the varied parameters are drawn again, 0 draws them only on activation
+}
+
+// Scenes holds the validated scenes that can be activated by name
+//
+type Scenes struct {
+	configs []SceneConfig
+}
+
+// SceneState describes the scene active on a pipeline
+//
+type SceneState struct {
+	Name   string    `json:"name"`   // Empty when the animations are being shown
+	Source string    `json:"source"` // What activated the scene
+	Until  time.Time `json:"until"`  // When the scene reverts to the animations
+}
+
+// activeScene is a scene being played on a pipeline
+//
+type activeScene struct {
+	state      SceneState
+	player     *ShowPlayer
+	brightness float64
+}
+
+// NewScenes validates the scenes
+//
+func NewScenes(configs []SceneConfig) (scenes *Scenes, err errors.Error) {
+	scenes = &Scenes{configs: make([]SceneConfig, 0, len(configs))}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if len(config.Name) == 0 {
+			return nil, errors.New("scenes need a name").With("effect", config.Effect).With("stack", stack.Trace().TrimRuntime())
+		}
+		if names[config.Name] {
+			return nil, errors.New("scene names must be unique").With("scene", config.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		names[config.Name] = true
+		if config.Brightness < 0 || config.Brightness > 1 {
+			return nil, errors.New("the scene brightness must be from 0 to 1").With("scene", config.Name).With("brightness", config.Brightness).With("stack", stack.Trace().TrimRuntime())
+		}
+		if config.Brightness == 0 {
+			config.Brightness = 1
+		}
+		if config.Timeout < 0 {
+			return nil, errors.New("the scene timeout cannot be negative").With("scene", config.Name).With("timeout", config.Timeout).With("stack", stack.Trace().TrimRuntime())
+		}
+		if config.Timeout == 0 {
+			config.Timeout = defaultSceneTimeout
+		}
+		if _, err = newScenePlayer(config, config.Timeout); err != nil {
+			return nil, err.With("scene", config.Name)
+		}
+		scenes.configs = append(scenes.configs, config)
+	}
+	return scenes, nil
+}
+
+// Configs returns the scenes in the order they were defined, with their defaults
+// filled in
+//
+func (scenes *Scenes) Configs() (configs []SceneConfig) {
+	return append([]SceneConfig{}, scenes.configs...)
+}
+
+// Names returns the names of the scenes in the order they were defined
+//
+func (scenes *Scenes) Names() (names []string) {
+	if scenes == nil {
+		return []string{}
+	}
+	names = make([]string, 0, len(scenes.configs))
+	for _, config := range scenes.configs {
+		names = append(names, config.Name)
+	}
+	return names
+}
+
+// Check returns an error when a scene is not defined
+//
+func (scenes *Scenes) Check(name string) (err errors.Error) {
+	if _, isPresent := scenes.lookup(name); !isPresent {
+		names := scenes.Names()
+		sort.Strings(names)
+		return errors.New("unknown scene").With("scene", name).With("scenes", fmt.Sprint(names)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func (scenes *Scenes) lookup(name string) (config SceneConfig, isPresent bool) {
+	if scenes == nil {
+		return config, false
+	}
+	for _, config := range scenes.configs {
+		if config.Name == name {
+			return config, true
+		}
+	}
+	return config, false
+}
+
+// newScenePlayer creates a player for the effect of a scene, as a show with a single
+// entry lasting for the time the scene is shown
+//
+func newScenePlayer(config SceneConfig, timeout time.Duration) (player *ShowPlayer, err errors.Error) {
+	player, err = NewShowPlayer(ShowConfig{
+		Strands:   config.Strands,
+		Pixels:    config.Pixels,
+		Playlist:  []ShowEntry{{Effect: config.Effect, Params: config.Params, Duration: timeout, Vary: config.Vary}},
+		VaryEvery: config.VaryEvery,
+	})
+	if err != nil {
+		return nil, err
+	}
+	player.quiet = true
+	player.random = EffectRand("scene " + config.Name)
+	return player, nil
+}
+
+// frame renders the scene at the supplied time on the animation clock, dimmed by the
+// brightness of the scene
+//
+func (scene *activeScene) frame(tm time.Time) (frame []animationModel.ChannelData) {
+	frame = scene.player.GetFrame(tm)
+	if scene.brightness >= 1 {
+		return frame
+	}
+	dimmed := make([]animationModel.ChannelData, len(frame))
+	for i, channelData := range frame {
+		data := make([]color.RGBA, len(channelData.Data))
+		for j, c := range channelData.Data {
+			data[j] = color.RGBA{
+				R: uint8(float64(c.R) * scene.brightness),
+				G: uint8(float64(c.G) * scene.brightness),
+				B: uint8(float64(c.B) * scene.brightness),
+				A: c.A,
+			}
+		}
+		dimmed[i] = animationModel.ChannelData{ChannelNum: channelData.ChannelNum, Data: data}
+	}
+	return dimmed
+}
+
+// ActivateScene shows a named scene in place of the animations until the timeout
+// has passed, a zero timeout using the timeout of the scene.  Activating a scene
+// replaces any scene already active
+//
+func (gw *Gateway) ActivateScene(name string, timeout time.Duration, source string) (state SceneState, err errors.Error) {
+	gw.Lock()
+	scenes := gw.Scenes
+	gw.Unlock()
+
+	config, isPresent := scenes.lookup(name)
+	if !isPresent {
+		return state, scenes.Check(name).With("pipeline", gw.Name)
+	}
+	if timeout < 0 {
+		return state, errors.New("the scene timeout cannot be negative").With("scene", name).With("timeout", timeout).With("stack", stack.Trace().TrimRuntime())
+	}
+	if timeout == 0 {
+		timeout = config.Timeout
+	}
+	player, err := newScenePlayer(config, timeout)
+	if err != nil {
+		return state, err.With("scene", name)
+	}
+
+	now := time.Now()
+	scene := &activeScene{
+		state:      SceneState{Name: name, Source: source, Until: now.Add(timeout)},
+		player:     player,
+		brightness: config.Brightness,
+	}
+	gw.fc.setScene(scene)
+	componentLog(LogSequencer).Info("scene activated", "pipeline", gw.Name, "scene", name, "source", source, "timeout", timeout.String())
+	bus.Publish(TopicEvents, Event{Time: now, Pipeline: gw.Name, Kind: "scene", Detail: fmt.Sprintf("%s activated by %s for %s", name, source, timeout)})
+	return scene.state, nil
+}
+
+// ClearScene returns the pipeline to the animations, returning false when no scene
+// was active
+//
+func (gw *Gateway) ClearScene(source string) (cleared bool) {
+	scene := gw.fc.setScene(nil)
+	if scene == nil {
+		return false
+	}
+	componentLog(LogSequencer).Info("scene cleared", "pipeline", gw.Name, "scene", scene.state.Name, "source", source)
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Pipeline: gw.Name, Kind: "scene", Detail: fmt.Sprintf("%s cleared by %s", scene.state.Name, source)})
+	return true
+}
+
+// Scene returns the scene active on the pipeline, with an empty name when the
+// animations are being shown
+//
+func (gw *Gateway) Scene() (state SceneState) {
+	return gw.fc.sceneState(time.Now())
+}
+
+// CycleScene activates the scene defined after the one active on the pipeline, the
+// animations returning after the last scene
+//
+func (gw *Gateway) CycleScene(source string) (state SceneState, err errors.Error) {
+	gw.Lock()
+	scenes := gw.Scenes
+	gw.Unlock()
+
+	names := scenes.Names()
+	if len(names) == 0 {
+		return state, errors.New("no scenes are defined").With("pipeline", gw.Name).With("stack", stack.Trace().TrimRuntime())
+	}
+	active := gw.Scene().Name
+	if len(active) == 0 {
+		return gw.ActivateScene(names[0], 0, source)
+	}
+	for i, name := range names {
+		if name == active && i+1 < len(names) {
+			return gw.ActivateScene(names[i+1], 0, source)
+		}
+	}
+	gw.ClearScene(source)
+	return gw.Scene(), nil
+}
+
+// ToggleScene activates a named scene using its own timeout, or returns to the
+// animations when the scene is already active, giving one touch controls such as
+// console pads and buttons
+//
+func (gw *Gateway) ToggleScene(name string, source string) (state SceneState, err errors.Error) {
+	if gw.Scene().Name == name {
+		gw.ClearScene(source)
+		return gw.Scene(), nil
+	}
+	return gw.ActivateScene(name, 0, source)
+}
@@ -0,0 +1,558 @@
+package mawt
+
+// This module generates a JSON Schema for the configuration format and uses it to
+// validate configuration files.  Show authors editing the YAML in an editor with a
+// YAML language server can point it at the schema, printed by the config schema
+// sub command or served by the gateway, to complete field names and the names of
+// effects, palettes and actions as they type.  The schema is derived from the
+// configuration structures so that it cannot drift from what the gateway loads, and
+// the gateway validates files against the same schema before saving them,
+// reporting the line and column of each problem rather than the first field the
+// YAML decoder tripped over
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/go-yaml/yaml"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	schemaDraft = "http://json-schema.org/draft-07/schema#"
+)
+
+var (
+	durationType  = reflect.TypeOf(time.Duration(0))
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+	// durationPattern matches the durations accepted by time.ParseDuration
+	durationPattern = `^[-+]?(0|(([0-9]+(\.[0-9]*)?|\.[0-9]+)(ns|us|µs|μs|ms|s|m|h))+)$`
+)
+
+// Schema is a JSON Schema, draft 7, describing a part of the configuration format
+// or a response of the REST API.  Only the keywords needed to describe them are
+// supported
+//
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 SchemaTypes        `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // false, or the schema of the values of a map
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+}
+
+// SchemaTypes holds the JSON types allowed for a value, written as a single string
+// when there is only one
+//
+type SchemaTypes []string
+
+func (types SchemaTypes) MarshalJSON() (data []byte, errGo error) {
+	if len(types) == 1 {
+		return []byte(fmt.Sprintf("%q", types[0])), nil
+	}
+	quoted := make([]string, 0, len(types))
+	for _, name := range types {
+		quoted = append(quoted, fmt.Sprintf("%q", name))
+	}
+	return []byte("[" + strings.Join(quoted, ",") + "]"), nil
+}
+
+func (types *SchemaTypes) UnmarshalJSON(data []byte) (errGo error) {
+	name := ""
+	if errGo = json.Unmarshal(data, &name); errGo == nil {
+		*types = SchemaTypes{name}
+		return nil
+	}
+	names := []string{}
+	if errGo = json.Unmarshal(data, &names); errGo != nil {
+		return errGo
+	}
+	*types = names
+	return nil
+}
+
+// UnmarshalJSON decodes a schema, additionalProperties being decoded as either a
+// boolean or the schema of the values of a map
+//
+func (schema *Schema) UnmarshalJSON(data []byte) (errGo error) {
+	type plain Schema
+	decoded := struct {
+		*plain
+		AdditionalProperties json.RawMessage `json:"additionalProperties,omitempty"`
+	}{plain: (*plain)(schema)}
+	if errGo = json.Unmarshal(data, &decoded); errGo != nil {
+		return errGo
+	}
+
+	schema.AdditionalProperties = nil
+	switch text := strings.TrimSpace(string(decoded.AdditionalProperties)); text {
+	case "":
+	case "true", "false":
+		schema.AdditionalProperties = text == "true"
+	default:
+		values := &Schema{}
+		if errGo = json.Unmarshal(decoded.AdditionalProperties, values); errGo != nil {
+			return errGo
+		}
+		schema.AdditionalProperties = values
+	}
+	return nil
+}
+
+// SchemaError is a part of a configuration file that does not match the schema
+//
+type SchemaError struct {
+	Path    string `json:"path"` // The field, for example pipelines[0].show.playlist[1].effect
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (e SchemaError) Error() string {
+	if len(e.Path) == 0 {
+		return fmt.Sprintf("line %d column %d: %s", e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("line %d column %d: %s: %s", e.Line, e.Column, e.Path, e.Message)
+}
+
+// schemaEnums returns the values allowed for the string fields that name one of a
+// fixed set of choices, by the name of the structure and field.  Fields that fall
+// back to a default when left empty also allow an explicit empty value
+//
+func schemaEnums() (enums map[string][]string) {
+	effects := make([]string, 0, len(ShowEffects()))
+	for name := range ShowEffects() {
+		effects = append(effects, name)
+	}
+	sort.Strings(effects)
+
+	optional := func(values ...string) []string {
+		return append([]string{""}, values...)
+	}
+
+	return map[string][]string{
+		"Config.palette":         optional(PaletteNames()...),
+		"Config.changeDetection": optional("fnv", "md5", "generation", "fields"),
+		"Profile.narrowing":      optional("dither", "round", "truncate"),
+		"OutputConfig.type":      {"terminal", "websocket", "opc", "node", "record", "validate"},
+		"ShowEntry.effect":       effects,
+		"SceneConfig.effect":     effects,
+		"HeartbeatCurve.shape":   optional("linear", "ease-in", "ease-out"),
+		"ButtonConfig.action":    {"cycle-effect", "brightness-up", "brightness-down", "blackout", "scene", "self-test"},
+		"ConsoleMapping.message": {"note", "cc"},
+		"ConsoleMapping.action":  {"cue", "brightness", "palette", "scene", "estop", "clear", "tap"},
+		"ConsoleMapping.palette": optional(PaletteNames()...),
+		"GuardConfig.action":     optional("scale", "confirm"),
+	}
+}
+
+// schemaGenerator builds the schema of the configuration, or of the responses of
+// the REST API, the structures used being placed in the definitions and referred
+// to by name.  The tag is the struct tag naming the fields, yaml or json
+//
+type schemaGenerator struct {
+	tag         string
+	definitions map[string]*Schema
+	types       map[string]reflect.Type
+	enums       map[string][]string
+}
+
+func newSchemaGenerator(tag string, enums map[string][]string) (gen *schemaGenerator) {
+	return &schemaGenerator{
+		tag:         tag,
+		definitions: map[string]*Schema{},
+		types:       map[string]reflect.Type{},
+		enums:       enums,
+	}
+}
+
+// ConfigSchema returns the JSON Schema of the configuration file.  The effects
+// shows can play are listed by name, including those of any effect plugins loaded
+// beforehand
+//
+func ConfigSchema() (schema *Schema) {
+	gen := newSchemaGenerator("yaml", schemaEnums())
+
+	schema = gen.structSchema(reflect.TypeOf(Config{}))
+	schema.Schema = schemaDraft
+	schema.Title = "mawt configuration"
+	schema.Definitions = gen.definitions
+	return schema
+}
+
+// structSchema returns the schema of the fields of a structure, using their YAML
+// or JSON names, fields that are not recognized being treated as mistakes.  JSON
+// fields are required unless they are omitted when empty
+//
+func (gen *schemaGenerator) structSchema(t reflect.Type) (schema *Schema) {
+	schema = &Schema{Type: SchemaTypes{"object"}, Properties: map[string]*Schema{}, AdditionalProperties: false}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get(gen.tag), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		// The JSON encoder promotes the fields of embedded structures without a name,
+		// whether or not they are exported
+		isInline := len(tag) > 1 && tag[1] == "inline"
+		if gen.tag == "json" && field.Anonymous && len(tag[0]) == 0 && field.Type.Kind() == reflect.Struct {
+			isInline = true
+		}
+		if isInline {
+			inline := gen.structSchema(field.Type)
+			for name, property := range inline.Properties {
+				schema.Properties[name] = property
+			}
+			schema.Required = append(schema.Required, inline.Required...)
+			continue
+		}
+		if len(field.PkgPath) != 0 {
+			continue
+		}
+		name := tag[0]
+		if len(name) == 0 {
+			name = field.Name
+			if gen.tag == "yaml" {
+				name = strings.ToLower(name)
+			}
+		}
+		schema.Properties[name] = gen.typeSchema(field.Type, gen.enums[t.Name()+"."+name])
+		if gen.tag == "json" && !(len(tag) > 1 && tag[1] == "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+// definitionName returns the name a structure is defined under, qualified by its
+// package when another structure has the same name, or an empty name for a
+// structure without one
+//
+func (gen *schemaGenerator) definitionName(t reflect.Type) (name string) {
+	name = t.Name()
+	if len(name) == 0 {
+		return ""
+	}
+	if known, isPresent := gen.types[name]; isPresent && known != t {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+	gen.types[name] = t
+	return name
+}
+
+// typeSchema returns the schema of a value of the supplied type
+//
+func (gen *schemaGenerator) typeSchema(t reflect.Type, enum []string) (schema *Schema) {
+	switch t {
+	case durationType:
+		if gen.tag == "json" {
+			return &Schema{Type: SchemaTypes{"integer"}, Description: "a number of nanoseconds"}
+		}
+		return &Schema{
+			Type:        SchemaTypes{"string", "integer"},
+			Description: "a duration such as 500ms or 1m30s, or a number of nanoseconds",
+			Pattern:     durationPattern,
+		}
+	case timeType:
+		return &Schema{Type: SchemaTypes{"string"}, Format: "date-time"}
+	}
+	// Values encoding themselves are not checked
+	if gen.tag == "json" && (t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType)) {
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return gen.typeSchema(t.Elem(), enum)
+	case reflect.Struct:
+		name := gen.definitionName(t)
+		if len(name) == 0 {
+			return gen.structSchema(t)
+		}
+		// Definitions are registered before being built so that structures referring
+		// to themselves do not recurse forever
+		if _, isPresent := gen.definitions[name]; !isPresent {
+			gen.definitions[name] = &Schema{}
+			*gen.definitions[name] = *gen.structSchema(t)
+		}
+		return &Schema{Ref: "#/definitions/" + name}
+	case reflect.Slice, reflect.Array:
+		// The JSON encoder writes byte slices as base64 text
+		if gen.tag == "json" && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: SchemaTypes{"string"}}
+		}
+		return &Schema{Type: SchemaTypes{"array"}, Items: gen.typeSchema(t.Elem(), enum)}
+	case reflect.Map:
+		return &Schema{Type: SchemaTypes{"object"}, AdditionalProperties: gen.typeSchema(t.Elem(), nil)}
+	case reflect.String:
+		return &Schema{Type: SchemaTypes{"string"}, Enum: enum}
+	case reflect.Bool:
+		return &Schema{Type: SchemaTypes{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: SchemaTypes{"integer"}}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		minimum := 0.0
+		schema = &Schema{Type: SchemaTypes{"integer"}, Minimum: &minimum}
+		if t.Bits() < 64 {
+			maximum := float64(uint64(1)<<uint(t.Bits()) - 1)
+			schema.Maximum = &maximum
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: SchemaTypes{"number"}}
+	}
+	// Values of any other type are not checked
+	return &Schema{}
+}
+
+// ValidateSchema checks the contents of a configuration file against the schema,
+// returning the parts that do not match it in the order they appear in the file.
+// An error is returned when the file is not valid YAML
+//
+func ValidateSchema(data []byte) (violations []SchemaError, err errors.Error) {
+	var document interface{}
+	if errGo := yaml.Unmarshal(data, &document); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	validator := &schemaValidator{root: ConfigSchema(), patterns: map[string]*regexp.Regexp{}}
+	validator.validate(validator.root, document, "")
+
+	positions := yamlPositions(data)
+	for i, violation := range validator.violations {
+		position := locate(positions, violation.Path)
+		violations = append(violations, violation)
+		violations[i].Line, violations[i].Column = position.Line, position.Column
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		if violations[i].Line != violations[j].Line {
+			return violations[i].Line < violations[j].Line
+		}
+		return violations[i].Column < violations[j].Column
+	})
+	return violations, nil
+}
+
+// schemaValidator checks a decoded YAML or JSON document against a schema.  JSON
+// documents are checked strictly, other than fields added after the schema was
+// written being accepted
+//
+type schemaValidator struct {
+	root       *Schema
+	patterns   map[string]*regexp.Regexp
+	isJSON     bool
+	violations []SchemaError
+}
+
+func (validator *schemaValidator) fail(path string, format string, args ...interface{}) {
+	validator.violations = append(validator.violations, SchemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// validate checks a value against a schema, recording the parts that do not match
+//
+func (validator *schemaValidator) validate(schema *Schema, value interface{}, path string) {
+	if len(schema.Ref) != 0 {
+		schema = validator.root.Definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+	}
+	// An empty value leaves a field with its default, whatever its type
+	if value == nil || schema == nil {
+		return
+	}
+
+	if len(schema.Type) != 0 && !matchesType(schema.Type, value, validator.isJSON) {
+		validator.fail(path, "expected %s, found %s", describeTypes(schema.Type), describeValue(value))
+		return
+	}
+
+	if values, isMapping := mapping(value); isMapping {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range schema.Required {
+			if _, isPresent := values[key]; !isPresent {
+				validator.fail(path, "missing field %q", key)
+			}
+		}
+		for _, key := range keys {
+			child := yamlPath(path, key)
+			if property, isPresent := schema.Properties[key]; isPresent {
+				validator.validate(property, values[key], child)
+				continue
+			}
+			switch additional := schema.AdditionalProperties.(type) {
+			case bool:
+				if !additional && !validator.isJSON {
+					validator.fail(child, "unknown field %q", key)
+				}
+			case *Schema:
+				validator.validate(additional, values[key], child)
+			}
+		}
+	}
+
+	switch v := value.(type) {
+
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				validator.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+
+	case string:
+		if len(schema.Pattern) != 0 {
+			pattern, isPresent := validator.patterns[schema.Pattern]
+			if !isPresent {
+				pattern = regexp.MustCompile(schema.Pattern)
+				validator.patterns[schema.Pattern] = pattern
+			}
+			if !pattern.MatchString(v) {
+				description := schema.Description
+				if len(description) == 0 {
+					description = "in the expected format"
+				}
+				validator.fail(path, "%q is not %s", v, description)
+				return
+			}
+		}
+	}
+
+	if len(schema.Enum) != 0 {
+		text := fmt.Sprint(value)
+		for _, allowed := range schema.Enum {
+			if text == allowed {
+				return
+			}
+		}
+		validator.fail(path, "%q is not one of %s", text, strings.Join(schema.Enum, ", "))
+	}
+
+	if number, isNumber := toFloat(value); isNumber {
+		if schema.Minimum != nil && number < *schema.Minimum {
+			validator.fail(path, "%v is less than %v", value, *schema.Minimum)
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			validator.fail(path, "%v is more than %v", value, *schema.Maximum)
+		}
+	}
+}
+
+// mapping returns the fields of a decoded YAML mapping or JSON object by name
+//
+func mapping(value interface{}) (values map[string]interface{}, isMapping bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		values = make(map[string]interface{}, len(v))
+		for key, item := range v {
+			values[fmt.Sprint(key)] = item
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+// matchesType checks a decoded value against the JSON types of a schema.  As when
+// the configuration is loaded, any YAML scalar is accepted as a string, while JSON
+// values must have the type given.  JSON numbers are decoded as floats so whole
+// numbers are accepted as integers
+//
+func matchesType(types SchemaTypes, value interface{}, isJSON bool) (matches bool) {
+	for _, name := range types {
+		switch v := value.(type) {
+		case map[interface{}]interface{}, map[string]interface{}:
+			matches = name == "object"
+		case []interface{}:
+			matches = name == "array"
+		case bool:
+			matches = name == "boolean" || (name == "string" && !isJSON)
+		case int, int64, uint64:
+			matches = name == "integer" || name == "number" || name == "string"
+		case float64:
+			matches = name == "number" || (name == "string" && !isJSON) || (name == "integer" && isJSON && v == float64(int64(v)))
+		default:
+			matches = name == "string"
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// describeTypes names the JSON types of a schema for an error message
+//
+func describeTypes(types SchemaTypes) (description string) {
+	names := make([]string, 0, len(types))
+	for _, name := range types {
+		switch name {
+		case "object":
+			names = append(names, "a mapping")
+		case "array":
+			names = append(names, "a list")
+		case "boolean":
+			names = append(names, "true or false")
+		case "integer":
+			names = append(names, "a whole number")
+		case "number":
+			names = append(names, "a number")
+		default:
+			names = append(names, "text")
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+// describeValue names the type of a decoded YAML value for an error message
+//
+func describeValue(value interface{}) (description string) {
+	switch value.(type) {
+	case map[interface{}]interface{}, map[string]interface{}:
+		return "a mapping"
+	case []interface{}:
+		return "a list"
+	case bool:
+		return "true or false"
+	case int, int64, uint64, float64:
+		return fmt.Sprintf("the number %v", value)
+	}
+	return fmt.Sprintf("%q", fmt.Sprint(value))
+}
+
+// toFloat returns the value of a decoded YAML number
+//
+func toFloat(value interface{}) (number float64, isNumber bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
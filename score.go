@@ -0,0 +1,259 @@
+package mawt
+
+// This module implements the score bar, a tug-of-war between the factions drawn
+// along a designated strand using the scores of a cell or anomaly series pulled
+// from a JSON API.  It lets a sculpture show the global state of the game
+// alongside the local portal that the rest of its strands display
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ScoreConfig defines the JSON API the scores are pulled from and the strand the
+// score bar is drawn on
+//
+type ScoreConfig struct {
+	URL         string            `yaml:"url" json:"url"`
+	Headers     map[string]string `yaml:"headers" json:"headers"`         // Optional headers sent with requests, for example an API key
+	Enlightened string            `yaml:"enlightened" json:"enlightened"` // The dot separated path of the Enlightened score in the JSON, defaults to enlightened
+	Resistance  string            `yaml:"resistance" json:"resistance"`   // The dot separated path of the Resistance score in the JSON, defaults to resistance
+	Interval    time.Duration     `yaml:"interval" json:"interval"`       // The time between requests, defaults to 1m
+	Channel     int               `yaml:"channel" json:"channel"`         // The logical strand the score bar is drawn on
+	Pixels      int               `yaml:"pixels" json:"pixels"`           // The number of pixels on the strand
+}
+
+// Score pulls the faction scores and renders them as a tug-of-war bar
+//
+type Score struct {
+	config      ScoreConfig
+	client      *http.Client
+	enlightened float64
+	resistance  float64
+	updated     time.Time // When the scores were last retrieved, zero before the first
+	failures    *ErrorSummary
+	lastErr     string
+	pipeline    string
+	sync.Mutex
+}
+
+// ScoreReport describes the scores being displayed
+//
+type ScoreReport struct {
+	URL         string    `json:"url"`
+	Enlightened float64   `json:"enlightened"`
+	Resistance  float64   `json:"resistance"`
+	Updated     time.Time `json:"updated"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// NewScore validates the score bar configuration, supplying the defaults
+//
+func NewScore(config ScoreConfig) (score *Score, err errors.Error) {
+	if !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") {
+		return nil, errors.New("the score URL must be an http or https URL").With("url", config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Channel < 1 || config.Channel > 255 {
+		return nil, errors.New("the score bar must use a channel from 1 to 255").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Pixels < 1 {
+		return nil, errors.New("the score bar strand must have pixels").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Interval < 0 {
+		return nil, errors.New("the score interval cannot be negative").With("interval", config.Interval).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Minute
+	}
+	if len(config.Enlightened) == 0 {
+		config.Enlightened = "enlightened"
+	}
+	if len(config.Resistance) == 0 {
+		config.Resistance = "resistance"
+	}
+	return &Score{
+		config:   config,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		failures: NewErrorSummary(errorSummaryInterval),
+	}, nil
+}
+
+// jsonPath follows a dot separated path of object keys and array indexes through a
+// decoded JSON document to a number, numbers held as strings are accepted
+//
+func jsonPath(doc interface{}, path string) (value float64, err errors.Error) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, isPresent := node[key]
+			if !isPresent {
+				return 0, errors.New("score not found").With("path", path).With("key", key).With("stack", stack.Trace().TrimRuntime())
+			}
+			doc = child
+		case []interface{}:
+			i, errGo := strconv.Atoi(key)
+			if errGo != nil || i < 0 || i >= len(node) {
+				return 0, errors.New("score not found").With("path", path).With("index", key).With("stack", stack.Trace().TrimRuntime())
+			}
+			doc = node[i]
+		default:
+			return 0, errors.New("score not found").With("path", path).With("key", key).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	switch number := doc.(type) {
+	case float64:
+		return number, nil
+	case string:
+		if value, errGo := strconv.ParseFloat(strings.Replace(number, ",", "", -1), 64); errGo == nil {
+			return value, nil
+		}
+	}
+	return 0, errors.New("the score is not a number").With("path", path).With("value", fmt.Sprint(doc)).With("stack", stack.Trace().TrimRuntime())
+}
+
+// fetch retrieves the scores from the API
+//
+func (score *Score) fetch() (enlightened float64, resistance float64, err errors.Error) {
+	req, errGo := http.NewRequest(http.MethodGet, score.config.URL, nil)
+	if errGo != nil {
+		return 0, 0, errors.Wrap(errGo).With("url", score.config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	req.Header.Set("Accept", "application/json")
+	for header, value := range score.config.Headers {
+		req.Header.Set(header, value)
+	}
+
+	resp, errGo := score.client.Do(req)
+	if errGo != nil {
+		return 0, 0, errors.Wrap(errGo).With("url", score.config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, errors.New(resp.Status).With("url", score.config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	var doc interface{}
+	if errGo = json.NewDecoder(resp.Body).Decode(&doc); errGo != nil {
+		return 0, 0, errors.Wrap(errGo).With("url", score.config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	if enlightened, err = jsonPath(doc, score.config.Enlightened); err != nil {
+		return 0, 0, err.With("url", score.config.URL)
+	}
+	if resistance, err = jsonPath(doc, score.config.Resistance); err != nil {
+		return 0, 0, err.With("url", score.config.URL)
+	}
+	return enlightened, resistance, nil
+}
+
+// Poll retrieves the scores at the configured interval until the quit channel is
+// closed, a score event being published whenever they change.  When the API cannot
+// be reached the last scores continue to be displayed
+//
+func (score *Score) Poll(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	go func() {
+		defer track("score")()
+		tick := time.NewTicker(score.config.Interval)
+		defer tick.Stop()
+
+		for {
+			now := time.Now()
+			enlightened, resistance, err := score.fetch()
+			if err != nil {
+				score.Lock()
+				score.lastErr = err.Error()
+				score.Unlock()
+				sendErr(errorC, score.failures.Failed(err, now))
+			} else {
+				score.failures.Succeeded(now)
+
+				score.Lock()
+				changed := score.updated.IsZero() || enlightened != score.enlightened || resistance != score.resistance
+				score.enlightened, score.resistance = enlightened, resistance
+				score.updated = now
+				score.lastErr = ""
+				score.Unlock()
+
+				if changed {
+					bus.Publish(TopicEvents, Event{Time: now, Pipeline: score.pipeline, Kind: "score",
+						Detail: fmt.Sprintf("E %.0f R %.0f", enlightened, resistance)})
+				}
+			}
+
+			select {
+			case <-tick.C:
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
+
+// Render draws the Enlightened share of the scores from the start of the strand and
+// the Resistance share from the end, the strand being neutral until scores arrive
+//
+func (score *Score) Render() (data []color.RGBA) {
+	score.Lock()
+	defer score.Unlock()
+
+	data = make([]color.RGBA, score.config.Pixels)
+	total := score.enlightened + score.resistance
+	if score.updated.IsZero() || total <= 0 {
+		for i := range data {
+			data[i] = timelineColors["N"]
+		}
+		return data
+	}
+
+	enlightened := int(math.Round(float64(len(data)) * score.enlightened / total))
+	for i := range data {
+		if i < enlightened {
+			data[i] = timelineColors["E"]
+		} else {
+			data[i] = timelineColors["R"]
+		}
+	}
+	return data
+}
+
+// Overlay replaces the score bar strand within a frame
+//
+func (score *Score) Overlay(frame []animationModel.ChannelData) (overlaid []animationModel.ChannelData) {
+	strand := animationModel.ChannelData{
+		ChannelNum: animationModel.OpcChannel(score.config.Channel),
+		Data:       score.Render(),
+	}
+
+	overlaid = make([]animationModel.ChannelData, 0, len(frame)+1)
+	for _, channelData := range frame {
+		if channelData.ChannelNum != strand.ChannelNum {
+			overlaid = append(overlaid, channelData)
+		}
+	}
+	return append(overlaid, strand)
+}
+
+// Report returns the scores being displayed
+//
+func (score *Score) Report() (report ScoreReport) {
+	score.Lock()
+	defer score.Unlock()
+
+	return ScoreReport{
+		URL:         score.config.URL,
+		Enlightened: score.enlightened,
+		Resistance:  score.resistance,
+		Updated:     score.updated,
+		LastError:   score.lastErr,
+	}
+}
@@ -0,0 +1,140 @@
+package mawt
+
+// This module resolves option and configuration values that are given indirectly,
+// so that tecthulhu URLs and tokens need not appear on the command line where any
+// user of a shared host can see them in the process listing.  A value may name a
+// file using file://, an environment variable using env: or a file within the
+// secrets directory, such as the /run/secrets of docker and systemd credentials,
+// using secret:.  Files given using file:// must not be readable by other users,
+// files in the secrets directory are trusted to be protected by the directory as
+// docker mounts its secrets readable by everyone within the container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	DefaultSecretsDir = "/run/secrets"
+)
+
+var (
+	secretsDir = struct {
+		dir string
+		sync.Mutex
+	}{dir: DefaultSecretsDir}
+)
+
+// SetSecretsDir changes the directory that secret: values are read from
+//
+func SetSecretsDir(dir string) {
+	secretsDir.Lock()
+	defer secretsDir.Unlock()
+
+	secretsDir.dir = dir
+}
+
+// IsSecretRef tests whether a value refers to a file, environment variable or
+// secret rather than being given directly
+//
+func IsSecretRef(value string) (isRef bool) {
+	return strings.HasPrefix(value, "file://") || strings.HasPrefix(value, "env:") || strings.HasPrefix(value, "secret:")
+}
+
+// ResolveSecret returns the value referred to by a file://, env: or secret: value,
+// without any trailing white space, other values are returned unchanged
+//
+func ResolveSecret(value string) (resolved string, err errors.Error) {
+	switch {
+	case strings.HasPrefix(value, "file://"):
+		return readSecret(strings.TrimPrefix(value, "file://"), true)
+
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		resolved, isSet := os.LookupEnv(name)
+		if !isSet {
+			return "", errors.New("the environment variable is not set").With("env", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		return strings.TrimRightFunc(resolved, isSpace), nil
+
+	case strings.HasPrefix(value, "secret:"):
+		name := strings.TrimPrefix(value, "secret:")
+		if len(name) == 0 || name != filepath.Base(name) || name == ".." {
+			return "", errors.New("secret names cannot contain paths").With("secret", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		secretsDir.Lock()
+		dir := secretsDir.dir
+		secretsDir.Unlock()
+		return readSecret(filepath.Join(dir, name), false)
+	}
+	return value, nil
+}
+
+// ResolveSecretList resolves a value holding a list, such as the tecthulhu URLs,
+// the items of which are separated by commas or white space once resolved
+//
+func ResolveSecretList(value string) (items []string, err errors.Error) {
+	resolved, err := ResolveSecret(value)
+	if err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(resolved, func(r rune) bool { return r == ',' || isSpace(r) }), nil
+}
+
+// readSecret reads a file holding a secret, refusing files other users can read
+// when private is set
+//
+func readSecret(fn string, private bool) (secret string, err errors.Error) {
+	info, errGo := os.Stat(fn)
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if private && info.Mode().Perm()&0004 != 0 {
+		return "", errors.New("secret files must not be readable by other users").With("file", fn).With("mode", info.Mode().Perm().String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return strings.TrimRightFunc(string(data), isSpace), nil
+}
+
+func isSpace(r rune) (space bool) {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// resolveSecrets replaces the tecthulhu lists of the pipelines and the tokens of the
+// users that are given as references with the values they refer to
+//
+func resolveSecrets(cfg *Config) (err errors.Error) {
+	for i, pipeline := range cfg.Pipelines {
+		tecthulhus := make([]string, 0, len(pipeline.Tecthulhus))
+		for _, portal := range pipeline.Tecthulhus {
+			if !IsSecretRef(portal) {
+				tecthulhus = append(tecthulhus, portal)
+				continue
+			}
+			items, err := ResolveSecretList(portal)
+			if err != nil {
+				return err.With("pipeline", pipeline.Name)
+			}
+			tecthulhus = append(tecthulhus, items...)
+		}
+		cfg.Pipelines[i].Tecthulhus = tecthulhus
+	}
+
+	if cfg.Auth != nil {
+		for i, user := range cfg.Auth.Users {
+			if cfg.Auth.Users[i].Token, err = ResolveSecret(user.Token); err != nil {
+				return err.With("user", user.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package mawt
+
+// This module spreads the packing and sending of the physical strands of a frame
+// across the fadecandy devices.  Packing and sending the strands one after another
+// has the frame latency grow with the number of devices, which on installs of 8 or
+// more boards leaves the last device refreshing well after the first.  The strands
+// are grouped by device and handed to a bounded pool of long lived workers, each
+// packing and sending the strands of a device.  When more than one worker is used
+// every device is given its own OPC connection to the fcserver, guarded by a mutex
+// of the device, so the sends to different devices are not serialized behind one
+// another.  The device connections are opened while the shared connection used for
+// the firmware settings is up, and closed along with it
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+	"github.com/kellydunn/go-opc"
+)
+
+const (
+	DefaultSendWorkers = 4
+	maxSendWorkers     = 64
+
+	// deviceStrands is the number of outputs of a fadecandy device.  The device of a
+	// strand is derived from its OPC channel, which assumes that the fcserver map
+	// gives each device 8 consecutive channels from channel 1 up in the order of the
+	// devices, as the maps in fc_configs do.  A map laid out in some other way leaves
+	// the strands grouped onto the wrong device connections and workers, and the
+	// devices of the universes API naming the wrong universes
+	deviceStrands = 8
+)
+
+// deviceSend holds the strands of a device sent together, strands of a device that
+// have different phase offsets being sent separately
+//
+type deviceSend struct {
+	offset  float64
+	strands []animationModel.ChannelData
+}
+
+// deviceConn is the OPC connection used to send the strands of a single device, nil
+// until first used and after a failed send
+//
+type deviceConn struct {
+	conn net.Conn
+	sync.Mutex
+}
+
+// sendPool holds the workers packing and sending the strands of the devices, which
+// run until the render loop stops
+//
+type sendPool struct {
+	workers int
+	jobC    chan func()
+}
+
+// newSendPool starts the workers of a pool
+//
+func newSendPool(workers int) (pool *sendPool) {
+	pool = &sendPool{workers: workers, jobC: make(chan func(), maxSendWorkers)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer track("send worker")()
+			for job := range pool.jobC {
+				job()
+			}
+		}()
+	}
+	return pool
+}
+
+// checkSendWorkers validates the number of workers sending the strands of a pipeline
+//
+func checkSendWorkers(workers int) (err errors.Error) {
+	if workers < 1 || workers > maxSendWorkers {
+		return errors.New("the send workers must be from 1 to 64").With("sendWorkers", workers).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// deviceSends groups the strands of a physical frame by device and phase offset, in
+// the order the groups are due to be sent, the strands of each group remaining in
+// the order of the frame
+//
+func deviceSends(frame []animationModel.ChannelData, phases Phases) (sends []deviceSend) {
+	type key struct {
+		device int
+		offset float64
+	}
+	index := map[key]int{}
+	for _, channelData := range frame {
+		k := key{device: (int(channelData.ChannelNum) - 1) / deviceStrands, offset: phases[int(channelData.ChannelNum)]}
+		i, isPresent := index[k]
+		if !isPresent {
+			i = len(sends)
+			index[k] = i
+			sends = append(sends, deviceSend{offset: k.offset})
+		}
+		sends[i].strands = append(sends[i].strands, channelData)
+	}
+	sort.SliceStable(sends, func(i, j int) bool { return sends[i].offset < sends[j].offset })
+	return sends
+}
+
+// SetSendWorkers sets the number of devices whose strands are packed and sent at
+// the same time, 1 sending the strands one after another
+//
+func (fc *FadeCandy) SetSendWorkers(workers int) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.sendWorkers = workers
+}
+
+// stopSendPool stops the workers once the render loop, the only caller of sendDevices,
+// has stopped
+//
+func (fc *FadeCandy) stopSendPool() {
+	if fc.pool != nil {
+		close(fc.pool.jobC)
+		fc.pool = nil
+	}
+}
+
+// sendDevice sends a message on the connection of a device, opening it if needed.
+// The device connections are only used while the shared connection to the fcserver
+// is up so that an offline fcserver is not dialed for every device in every frame
+//
+func (fc *FadeCandy) sendDevice(device int, m *opc.Message) (err errors.Error) {
+	if faultHit(FaultOPCDrop) != nil {
+		return errors.New("fadecandy send dropped by an injected fault").With("stack", stack.Trace().TrimRuntime())
+	}
+	if fc.nop {
+		return nil
+	}
+
+	fc.sending.Lock()
+	if fc.conn == nil {
+		fc.sending.Unlock()
+		return errors.New("fadecandy server not online").With("stack", stack.Trace().TrimRuntime())
+	}
+	if fc.devices == nil {
+		fc.devices = map[int]*deviceConn{}
+	}
+	dc, isPresent := fc.devices[device]
+	if !isPresent {
+		dc = &deviceConn{}
+		fc.devices[device] = dc
+	}
+	fc.sending.Unlock()
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	if dc.conn == nil {
+		addr, err := ResolveAddr(fc.server, defaultOPCPort)
+		if err != nil {
+			return err
+		}
+		conn, errGo := net.DialTimeout("tcp", addr, opcDialTimeout)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("url", fc.server).With("addr", addr).With("device", device).With("stack", stack.Trace().TrimRuntime())
+		}
+		dc.conn = conn
+	}
+	if _, errGo := dc.conn.Write(m.ByteArray()); errGo != nil {
+		// The connection is opened again for the next frame
+		dc.conn.Close()
+		dc.conn = nil
+		return errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// closeDevices closes the connections of the devices, the caller holding fc.sending
+//
+func (fc *FadeCandy) closeDevices() {
+	for _, dc := range fc.devices {
+		dc.Lock()
+		if dc.conn != nil {
+			dc.conn.Close()
+			dc.conn = nil
+		}
+		dc.Unlock()
+	}
+}
+
+// sendDevices packs and sends the strands of a frame using the pool of workers,
+// waiting for the phase offsets of the devices, and returns the number of strands
+// that failed along with the first error
+//
+func (fc *FadeCandy) sendDevices(data []animationModel.ChannelData, phases Phases, frameStart time.Time, period time.Duration) (failed int, err errors.Error) {
+	sends := deviceSends(data, phases)
+
+	fc.Lock()
+	workers := fc.sendWorkers
+	fc.Unlock()
+	if workers < 1 {
+		workers = DefaultSendWorkers
+	}
+
+	// Messages are packed into those of the previous frame, each being created here
+	// the first time its channel is sent so that the workers only read the map
+	if fc.messages == nil {
+		fc.messages = map[animationModel.OpcChannel]*opc.Message{}
+	}
+	for _, channelData := range data {
+		if _, isPresent := fc.messages[channelData.ChannelNum]; !isPresent {
+			fc.messages[channelData.ChannelNum] = opc.NewMessage(uint8(channelData.ChannelNum))
+		}
+	}
+
+	results := sync.Mutex{}
+	send := func(device deviceSend, shared bool) {
+		if device.offset != 0 {
+			if wait := time.Until(frameStart.Add(time.Duration(device.offset * float64(period)))); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		for _, channelData := range device.strands {
+			start := time.Now()
+			m := PackStrandInto(fc.messages[channelData.ChannelNum], channelData)
+			var strandErr errors.Error
+			if shared {
+				strandErr = fc.Send(m)
+			} else {
+				strandErr = fc.sendDevice((int(channelData.ChannelNum)-1)/deviceStrands, m)
+			}
+			if strandErr != nil {
+				strandErr = strandErr.With("strand", int(channelData.ChannelNum))
+				results.Lock()
+				if err == nil {
+					err = strandErr
+				}
+				failed++
+				results.Unlock()
+			}
+			fc.strandStats.Record(channelData.ChannelNum, time.Since(start), strandErr, start)
+		}
+	}
+
+	// A single worker, or a single device, sends the devices in turn on the shared
+	// connection
+	if workers <= 1 || len(sends) <= 1 {
+		for _, device := range sends {
+			send(device, true)
+		}
+		return failed, err
+	}
+
+	// The pool is sized from the configured workers, only being started again when
+	// the configuration changes the number of them
+	if fc.pool == nil || fc.pool.workers != workers {
+		fc.stopSendPool()
+		fc.pool = newSendPool(workers)
+	}
+
+	// Devices are handed out in the order they are due so a worker waiting on the
+	// phase offset of a device does not hold up devices due before it
+	wg := sync.WaitGroup{}
+	for _, device := range sends {
+		device := device
+		wg.Add(1)
+		fc.pool.jobC <- func() {
+			defer wg.Done()
+			send(device, false)
+		}
+	}
+	wg.Wait()
+	return failed, err
+}
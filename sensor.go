@@ -0,0 +1,110 @@
+package mawt
+
+// This module contains the reading of sensors that are accessed through a file,
+// such as those offered by the Linux sysfs and IIO interfaces, or through a
+// command printing the reading, used for the sensors that have no driver here,
+// along with the polling of the ambient light and thermal sensors
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// parseReading parses the number printed by a sensor
+//
+func parseReading(text string) (value float64, errGo error) {
+	value, errGo = strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if errGo == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		errGo = fmt.Errorf("reading %s is not a number", strings.TrimSpace(text))
+	}
+	return value, errGo
+}
+
+// readSensorFile reads a number from a file
+//
+func readSensorFile(path string) (value float64, err errors.Error) {
+	data, errGo := ioutil.ReadFile(path)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	if value, errGo = parseReading(string(data)); errGo != nil {
+		return 0, errors.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	return value, nil
+}
+
+// readSensorCommand runs a shell command that prints a number, the command is
+// killed when it does not finish within the timeout
+//
+func readSensorCommand(command string, timeout time.Duration) (value float64, err errors.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, errGo := exec.CommandContext(ctx, "/bin/sh", "-c", command).Output()
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("command", command).With("stack", stack.Trace().TrimRuntime())
+	}
+	if value, errGo = parseReading(string(out)); errGo != nil {
+		return 0, errors.Wrap(errGo).With("command", command).With("stack", stack.Trace().TrimRuntime())
+	}
+	return value, nil
+}
+
+// sensorPoll takes the readings of a sensor at an interval, for the ambient light
+// and thermal sensors
+//
+type sensorPoll struct {
+	name     string // The name the polling goroutine is tracked by
+	sensor   string // The kind of sensor, added to the errors reported
+	interval time.Duration
+	failures *ErrorSummary
+	read     func() (reading float64, err errors.Error)
+	apply    func(reading float64, now time.Time) // Records a reading that succeeded
+	failed   func(err errors.Error)               // Records the error of a reading that failed
+}
+
+// start reads the sensor at the interval, the first reading being taken at once,
+// until the quit channel is closed
+//
+func (poll *sensorPoll) start(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	go func() {
+		defer track(poll.name)()
+		tick := time.NewTicker(poll.interval)
+		defer tick.Stop()
+
+		for {
+			poll.update(errorC, time.Now())
+
+			select {
+			case <-tick.C:
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
+
+// update takes a reading.  Only the first of a run of failures, and then periodic
+// summaries, are reported so that a sensor that has gone away does not flood the
+// error channel
+//
+func (poll *sensorPoll) update(errorC chan<- errors.Error, now time.Time) {
+	reading, err := poll.read()
+	if err != nil {
+		err = err.With("sensor", poll.sensor)
+		poll.failed(err)
+		sendErr(errorC, poll.failures.Failed(err, now))
+		return
+	}
+	poll.failures.Succeeded(now)
+	poll.apply(reading, now)
+}
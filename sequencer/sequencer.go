@@ -0,0 +1,374 @@
+package sequencer
+
+// This package contains a sequence runner that plays effects across a set of
+// universes, each universe being a linear buffer of pixels, and that is not tied
+// to Ingress portals so it can be reused for other LED projects.
+//
+// A Sequence is a set of named Steps, each of which plays an Effect on one
+// universe and can then start other steps, immediately or after a delay.  A
+// Runner holds the universe buffers and is driven by calling ProcessFrame with
+// monotonically increasing frame times, after which the pixels of each universe
+// are available from UniverseData.  Only the step at the head of the queue for
+// a universe is played, other steps started on that universe wait their turn.
+//
+// The effects of the github.com/TeamNorCal/animation package satisfy the Effect
+// interface.  Unlike the runner in that package, steps are started using the
+// frame time rather than the wall clock, so sequences can be run against
+// synthetic times and give the same frames every time.  The headless shows and
+// scenes of mawt are played using this runner, the portal animations are still
+// played by the runner of the animation package.
+//
+// Operations can be aligned to the beats of music using a Beat, such as the
+// beat clock of the mawt package, in which case the step is started on the
+// first beat once any delay has passed.
+//
+// An Observer is told of each step as it is started, or as it is scheduled when it
+// waits for a delay or a beat, so that sounds can be played in step with the effects
+// and queued ahead of the steps that start on a beat.
+
+import (
+	"image/color"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// Effect generates the frames of an animation
+//
+type Effect interface {
+	// Start the effect at the supplied time, all frame times will be at this time or later
+	Start(startTime time.Time)
+
+	// Frame generates the frame for a time into buf, whose size is the number of pixels
+	// in the universe, returning the buffer and true when the effect has completed a cycle
+	Frame(buf []color.RGBA, frameTime time.Time) (output []color.RGBA, endSeq bool)
+}
+
+// Beat predicts the times of the beats of music that steps are aligned to
+//
+type Beat interface {
+	// NextBeat returns the time of the first beat at or after the supplied time
+	NextBeat(after time.Time) (tm time.Time)
+}
+
+// Observer is told of the steps started by a runner
+//
+type Observer interface {
+	// StepStarted is called with the time a step starts, as it is started or, for
+	// steps started after a delay or on a beat, as it is scheduled.  The frame time is
+	// that of the frame being processed.  The runner is locked during the call
+	StepStarted(stepName string, startTime time.Time, frameTime time.Time)
+}
+
+// Operation starts a step, optionally after a delay
+//
+type Operation struct {
+	StepName string        // The name of the step to start
+	Delay    time.Duration // Optional delay before the step is started
+	OnBeat   bool          // Start the step on the first beat after the delay
+}
+
+// Step plays an effect on a universe and then applies its Next operations
+//
+type Step struct {
+	UniverseID uint        // The universe the effect is played on
+	Effect     Effect      // The effect to play
+	Next       []Operation // Optional operations applied once the effect completes
+}
+
+// ThenDo adds an operation applied after the step completes
+//
+func (step *Step) ThenDo(stepName string, delay time.Duration) *Step {
+	step.Next = append(step.Next, Operation{StepName: stepName, Delay: delay})
+	return step
+}
+
+// ThenDoImmediately adds an operation that starts another step as soon as the step completes
+//
+func (step *Step) ThenDoImmediately(stepName string) *Step {
+	return step.ThenDo(stepName, 0)
+}
+
+// ThenDoOnBeat adds an operation that starts another step on the first beat after
+// the step completes
+//
+func (step *Step) ThenDoOnBeat(stepName string) *Step {
+	step.Next = append(step.Next, Operation{StepName: stepName, OnBeat: true})
+	return step
+}
+
+// Sequence is a set of named steps along with the operations applied when the
+// sequence is started
+//
+type Sequence struct {
+	steps   map[string]*Step
+	initial []Operation
+}
+
+// NewSequence creates an empty sequence
+//
+func NewSequence() (seq *Sequence) {
+	return &Sequence{
+		steps:   map[string]*Step{},
+		initial: []Operation{},
+	}
+}
+
+// AddStep adds a named step to the sequence, replacing any step with the same name
+//
+func (seq *Sequence) AddStep(name string, step *Step) *Sequence {
+	seq.steps[name] = step
+	return seq
+}
+
+// AddInitialOperation adds an operation applied when the sequence is started
+//
+func (seq *Sequence) AddInitialOperation(operation Operation) *Sequence {
+	seq.initial = append(seq.initial, operation)
+	return seq
+}
+
+// AddInitialStep adds a named step that is started along with the sequence
+//
+func (seq *Sequence) AddInitialStep(name string, step *Step) *Sequence {
+	seq.AddStep(name, step)
+	return seq.AddInitialOperation(Operation{StepName: name})
+}
+
+// CreateStepCycle links the named steps so that each starts the next once it
+// completes, the last starting the first
+//
+func (seq *Sequence) CreateStepCycle(names ...string) *Sequence {
+	for i, name := range names {
+		if step, isPresent := seq.steps[name]; isPresent {
+			step.ThenDoImmediately(names[(i+1)%len(names)])
+		}
+	}
+	return seq
+}
+
+// Validate checks that every operation refers to a step of the sequence, and that
+// every step has an effect and plays on one of the universes supplied
+//
+func (seq *Sequence) Validate(universes int) (err errors.Error) {
+	check := func(operation Operation) errors.Error {
+		if _, isPresent := seq.steps[operation.StepName]; !isPresent {
+			return errors.New("operation refers to an unknown step").With("step", operation.StepName).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	}
+	for _, operation := range seq.initial {
+		if err = check(operation); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(seq.steps))
+	for name := range seq.steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		step := seq.steps[name]
+		if step.Effect == nil {
+			return errors.New("step has no effect").With("step", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if int(step.UniverseID) >= universes {
+			return errors.New("step plays on an unknown universe").With("step", name).With("universe", step.UniverseID).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, operation := range step.Next {
+			if err = check(operation); err != nil {
+				return err.With("from", name)
+			}
+		}
+	}
+	return nil
+}
+
+// scheduled is a step waiting for the time at which it is started
+//
+type scheduled struct {
+	runAt   time.Time
+	step    *Step
+	aligned bool // Set when the step is started at the time of a beat rather than the frame
+}
+
+// Runner plays a sequence into a set of universe buffers
+//
+type Runner struct {
+	seq      *Sequence
+	waiting  []scheduled    // Steps waiting for their start time
+	active   [][]*Step      // The queue of started steps for each universe
+	buffers  [][]color.RGBA // The pixels of each universe
+	beat     Beat           // Optional source of the beats operations are aligned to
+	observer Observer       // Optional observer of the steps started
+	sync.Mutex
+}
+
+// NewRunner creates a runner with a universe for each of the sizes supplied, the
+// universe IDs being the indexes of the sizes
+//
+func NewRunner(universeSizes []uint) (runner *Runner) {
+	runner = &Runner{
+		seq:     NewSequence(),
+		waiting: []scheduled{},
+		active:  make([][]*Step, len(universeSizes)),
+		buffers: make([][]color.RGBA, len(universeSizes)),
+	}
+	for i, size := range universeSizes {
+		runner.buffers[i] = make([]color.RGBA, size)
+	}
+	return runner
+}
+
+// Universes returns the number of universes of the runner
+//
+func (runner *Runner) Universes() (count int) {
+	return len(runner.buffers)
+}
+
+// SetBeat sets the beats that operations with OnBeat set are aligned to, without a
+// beat such operations are treated as having only a delay
+//
+func (runner *Runner) SetBeat(beat Beat) {
+	runner.Lock()
+	defer runner.Unlock()
+
+	runner.beat = beat
+}
+
+// SetObserver sets the observer told of the steps started, nil to stop telling one
+//
+func (runner *Runner) SetObserver(observer Observer) {
+	runner.Lock()
+	defer runner.Unlock()
+
+	runner.observer = observer
+}
+
+// InitSequence stops any sequence being played and starts the supplied sequence at
+// the supplied time.  An invalid sequence is rejected, leaving the runner idle
+//
+func (runner *Runner) InitSequence(seq *Sequence, now time.Time) (err errors.Error) {
+	runner.Lock()
+	defer runner.Unlock()
+
+	runner.waiting = runner.waiting[:0]
+	for i := range runner.active {
+		runner.active[i] = nil
+	}
+	runner.seq = NewSequence()
+
+	if err = seq.Validate(len(runner.buffers)); err != nil {
+		return err
+	}
+	runner.seq = seq
+
+	for _, operation := range seq.initial {
+		runner.apply(operation, now)
+	}
+	return nil
+}
+
+// apply starts or schedules the step of an operation, operations naming steps that
+// were removed after the sequence was validated are ignored
+//
+func (runner *Runner) apply(operation Operation, now time.Time) {
+	step, isPresent := runner.seq.steps[operation.StepName]
+	if !isPresent || step.Effect == nil || int(step.UniverseID) >= len(runner.active) {
+		return
+	}
+	if operation.OnBeat && runner.beat != nil {
+		runAt := runner.beat.NextBeat(now.Add(operation.Delay))
+		if runAt.After(now) {
+			runner.waiting = append(runner.waiting, scheduled{runAt: runAt, step: step, aligned: true})
+			runner.started(operation.StepName, runAt, now)
+			return
+		}
+	} else if operation.Delay > 0 {
+		runner.waiting = append(runner.waiting, scheduled{runAt: now.Add(operation.Delay), step: step})
+		runner.started(operation.StepName, now.Add(operation.Delay), now)
+		return
+	}
+	step.Effect.Start(now)
+	runner.started(operation.StepName, now, now)
+	runner.active[step.UniverseID] = append(runner.active[step.UniverseID], step)
+}
+
+// started tells the observer, if any, of a step being started
+//
+func (runner *Runner) started(stepName string, startTime time.Time, frameTime time.Time) {
+	if runner.observer != nil {
+		runner.observer.StepStarted(stepName, startTime, frameTime)
+	}
+}
+
+// ProcessFrame generates the frame for a time, which should increase with each
+// call, returning true once nothing is playing or waiting to be played
+//
+func (runner *Runner) ProcessFrame(now time.Time) (done bool) {
+	runner.Lock()
+	defer runner.Unlock()
+
+	// Start the steps whose time has come, in the order they were scheduled
+	waiting := runner.waiting[:0]
+	due := []scheduled{}
+	for _, entry := range runner.waiting {
+		if now.Before(entry.runAt) {
+			waiting = append(waiting, entry)
+			continue
+		}
+		due = append(due, entry)
+	}
+	runner.waiting = waiting
+	for _, entry := range due {
+		// Steps aligned to a beat are started at the beat so that their phase
+		// follows the music rather than the frame the beat fell within
+		if entry.aligned {
+			entry.step.Effect.Start(entry.runAt)
+		} else {
+			entry.step.Effect.Start(now)
+		}
+		runner.active[entry.step.UniverseID] = append(runner.active[entry.step.UniverseID], entry.step)
+	}
+
+	// Universes are visited in order so that steps started by completing
+	// steps are handled the same way on every run
+	done = true
+	for id := range runner.active {
+		if len(runner.active[id]) == 0 {
+			continue
+		}
+		done = false
+
+		step := runner.active[id][0]
+		output, completed := step.Effect.Frame(runner.buffers[id], now)
+		runner.buffers[id] = output
+		if !completed {
+			continue
+		}
+		runner.active[id] = runner.active[id][1:]
+		for _, operation := range step.Next {
+			runner.apply(operation, now)
+		}
+	}
+
+	return done && len(runner.waiting) == 0
+}
+
+// UniverseData returns the pixels of a universe as of the last call to ProcessFrame,
+// or nil for an unknown universe.  The buffer is reused by the next frame
+//
+func (runner *Runner) UniverseData(universeID uint) (pixels []color.RGBA) {
+	runner.Lock()
+	defer runner.Unlock()
+
+	if int(universeID) >= len(runner.buffers) {
+		return nil
+	}
+	return runner.buffers[universeID]
+}
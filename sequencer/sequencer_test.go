@@ -0,0 +1,218 @@
+package sequencer
+
+import (
+	"image/color"
+	"testing"
+	"time"
+)
+
+// testEffect fills its universe with a color and completes after its duration
+//
+type testEffect struct {
+	color    color.RGBA
+	duration time.Duration
+	start    time.Time
+	starts   int
+}
+
+func (effect *testEffect) Start(startTime time.Time) {
+	effect.start = startTime
+	effect.starts++
+}
+
+func (effect *testEffect) Frame(buf []color.RGBA, frameTime time.Time) (output []color.RGBA, endSeq bool) {
+	for i := range buf {
+		buf[i] = effect.color
+	}
+	return buf, frameTime.Sub(effect.start) >= effect.duration
+}
+
+// testBeat has a beat on every whole second after its origin
+//
+type testBeat struct {
+	origin time.Time
+}
+
+func (beat testBeat) NextBeat(after time.Time) (tm time.Time) {
+	elapsed := after.Sub(beat.origin)
+	beats := (elapsed + time.Second - 1) / time.Second
+	return beat.origin.Add(beats * time.Second)
+}
+
+var (
+	red   = color.RGBA{0xFF, 0, 0, 0xFF}
+	green = color.RGBA{0, 0xFF, 0, 0xFF}
+	blue  = color.RGBA{0, 0, 0xFF, 0xFF}
+)
+
+func checkUniverse(t *testing.T, runner *Runner, universe uint, want color.RGBA) {
+	t.Helper()
+
+	pixels := runner.UniverseData(universe)
+	if len(pixels) == 0 {
+		t.Fatalf("universe %d has no pixels", universe)
+	}
+	for i, pixel := range pixels {
+		if pixel != want {
+			t.Fatalf("universe %d pixel %d is %v, want %v", universe, i, pixel, want)
+		}
+	}
+}
+
+func TestInitSequenceValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		seq  *Sequence
+	}{
+		{
+			name: "unknown initial step",
+			seq:  NewSequence().AddInitialOperation(Operation{StepName: "missing"}),
+		},
+		{
+			name: "unknown next step",
+			seq:  NewSequence().AddInitialStep("a", (&Step{Effect: &testEffect{}}).ThenDoImmediately("missing")),
+		},
+		{
+			name: "no effect",
+			seq:  NewSequence().AddInitialStep("a", &Step{}),
+		},
+		{
+			name: "unknown universe",
+			seq:  NewSequence().AddInitialStep("a", &Step{UniverseID: 2, Effect: &testEffect{}}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := NewRunner([]uint{4, 4})
+			if err := runner.InitSequence(test.seq, time.Now()); err == nil {
+				t.Fatal("an invalid sequence was accepted")
+			}
+			if done := runner.ProcessFrame(time.Now()); !done {
+				t.Fatal("a runner with a rejected sequence is playing")
+			}
+		})
+	}
+}
+
+func TestProcessFrameSteps(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	first := &testEffect{color: red, duration: time.Second}
+	second := &testEffect{color: green, duration: time.Second}
+	other := &testEffect{color: blue, duration: 3 * time.Second}
+
+	seq := NewSequence().
+		AddInitialStep("first", (&Step{UniverseID: 0, Effect: first}).ThenDo("second", 500*time.Millisecond)).
+		AddStep("second", &Step{UniverseID: 0, Effect: second}).
+		AddInitialStep("other", &Step{UniverseID: 1, Effect: other})
+
+	runner := NewRunner([]uint{4, 8})
+	if runner.Universes() != 2 {
+		t.Fatalf("the runner has %d universes", runner.Universes())
+	}
+	if err := runner.InitSequence(seq, start); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	runner.ProcessFrame(start)
+	checkUniverse(t, runner, 0, red)
+	checkUniverse(t, runner, 1, blue)
+
+	// The first step completes, the second waiting for its delay
+	runner.ProcessFrame(start.Add(time.Second))
+	if second.starts != 0 {
+		t.Fatal("the second step started before its delay passed")
+	}
+	runner.ProcessFrame(start.Add(1500 * time.Millisecond))
+	if second.starts != 1 || !second.start.Equal(start.Add(1500*time.Millisecond)) {
+		t.Fatalf("the second step started %d times, at %s", second.starts, second.start)
+	}
+	checkUniverse(t, runner, 0, green)
+
+	if done := runner.ProcessFrame(start.Add(2500 * time.Millisecond)); done {
+		t.Fatal("the runner finished while the other universe was playing")
+	}
+	// Steps completing are drawn in their last frame, the runner is done on the next
+	runner.ProcessFrame(start.Add(3 * time.Second))
+	checkUniverse(t, runner, 1, blue)
+	if done := runner.ProcessFrame(start.Add(3100 * time.Millisecond)); !done {
+		t.Fatal("the runner did not finish once every step completed")
+	}
+
+	if pixels := runner.UniverseData(2); pixels != nil {
+		t.Fatalf("an unknown universe returned %v", pixels)
+	}
+}
+
+func TestProcessFrameOnBeat(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	first := &testEffect{color: red, duration: 300 * time.Millisecond}
+	second := &testEffect{color: green, duration: time.Hour}
+	seq := NewSequence().
+		AddInitialStep("first", (&Step{Effect: first}).ThenDoOnBeat("second")).
+		AddStep("second", &Step{Effect: second})
+
+	runner := NewRunner([]uint{4})
+	runner.SetBeat(testBeat{origin: start})
+	if err := runner.InitSequence(seq, start); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	runner.ProcessFrame(start)
+	runner.ProcessFrame(start.Add(300 * time.Millisecond))
+	runner.ProcessFrame(start.Add(900 * time.Millisecond))
+	if second.starts != 0 {
+		t.Fatal("the step started before the beat")
+	}
+	// The frame falls after the beat, the step is started at the beat itself
+	runner.ProcessFrame(start.Add(1020 * time.Millisecond))
+	if second.starts != 1 || !second.start.Equal(start.Add(time.Second)) {
+		t.Fatalf("the step started %d times, at %s rather than on the beat", second.starts, second.start)
+	}
+	checkUniverse(t, runner, 0, green)
+}
+
+// testObserver records the steps started along with their start times
+//
+type testObserver struct {
+	steps  []string
+	starts []time.Time
+}
+
+func (observer *testObserver) StepStarted(stepName string, startTime time.Time, frameTime time.Time) {
+	observer.steps = append(observer.steps, stepName)
+	observer.starts = append(observer.starts, startTime)
+}
+
+func TestObserverStepStarted(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	first := &testEffect{color: red, duration: 300 * time.Millisecond}
+	second := &testEffect{color: green, duration: time.Hour}
+	seq := NewSequence().
+		AddInitialStep("first", (&Step{Effect: first}).ThenDoOnBeat("second")).
+		AddStep("second", &Step{Effect: second})
+
+	observer := &testObserver{}
+	runner := NewRunner([]uint{4})
+	runner.SetBeat(testBeat{origin: start})
+	runner.SetObserver(observer)
+	if err := runner.InitSequence(seq, start); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(observer.steps) != 1 || observer.steps[0] != "first" || !observer.starts[0].Equal(start) {
+		t.Fatalf("the initial step was observed as %v at %v", observer.steps, observer.starts)
+	}
+
+	// The step started on the beat is observed as it is scheduled, ahead of the beat
+	runner.ProcessFrame(start.Add(300 * time.Millisecond))
+	if len(observer.steps) != 2 || observer.steps[1] != "second" || !observer.starts[1].Equal(start.Add(time.Second)) {
+		t.Fatalf("the step started on the beat was observed as %v at %v", observer.steps, observer.starts)
+	}
+	runner.ProcessFrame(start.Add(1020 * time.Millisecond))
+	if len(observer.steps) != 2 {
+		t.Fatalf("the step was observed again as it started, %v", observer.steps)
+	}
+}
@@ -22,6 +22,9 @@ type SFXState struct {
 	ambientC chan string
 	sfxC     chan []string
 
+	health *Health             // The health of the pipeline, whose panics include those of the SFX
+	errorC chan<- errors.Error // Receives the panics recovered while processing statuses
+
 	sync.Mutex
 }
 
@@ -30,6 +33,8 @@ func (sfx *SFXState) process(msg *model.PortalMsg) (err errors.Error) {
 		return nil
 	}
 
+	defer recoverPanic(sfx.health, sfx.errorC)
+
 	sfx.Lock()
 	current := msg.Status.DeepCopy()
 	lastState := sfx.current
@@ -100,28 +105,30 @@ func (sfx *SFXState) process(msg *model.PortalMsg) (err errors.Error) {
 	return nil
 }
 
-// StartSFX will add itself to the subscriptions for portal messages
-func StartSFX(subscribeC chan chan *model.PortalMsg, errorC chan<- errors.Error, quitC <-chan struct{}) {
+// StartSFX will add itself to the subscriptions for portal messages, panics being
+// counted against the health of the pipeline
+func StartSFX(health *Health, broker *Broker, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	defer track("sfx")()
 
 	sfx := &SFXState{
 		ambientC: make(chan string, 3),
 		sfxC:     make(chan []string, 3),
+		health:   health,
+		errorC:   errorC,
 	}
 
 	if err := InitAudio(sfx.ambientC, sfx.sfxC, errorC, quitC); err != nil {
 		select {
 		case errorC <- err:
 		case <-time.After(100 * time.Millisecond):
-			fmt.Fprintf(os.Stderr, err.Error())
+			fmt.Fprintln(os.Stderr, err.Error())
 		}
 	}
 
-	// Allow a lot of messages to queue up as we will only process the last one anyway
-	updateC := make(chan *model.PortalMsg, 10)
-	defer close(updateC)
-
-	// Subscribe to portal events
-	subscribeC <- updateC
+	// Subscribe to the statuses of the portal being displayed, allowing a lot of
+	// messages to queue up as we will only process the last one anyway
+	sub := broker.Subscribe(TopicDisplayed, SubscribeOptions{Name: "sfx", Depth: 10, Policy: LatestWins})
+	defer sub.Close()
 
 	// Attempt to set the default audio effects
 	select {
@@ -135,19 +142,19 @@ func StartSFX(subscribeC chan chan *model.PortalMsg, errorC chan<- errors.Error,
 		lastMsg := &model.PortalMsg{}
 
 		select {
-		case msg := <-updateC:
-			// Only process the most recent portal status msg for the Home portal in
-			// the channel, if we are backed up
-			if msg.Home {
-				lastMsg = msg.DeepCopy()
+		case msg := <-sub.C:
+			// Only process the most recent status of the displayed portal in the
+			// channel, if we are backed up
+			if status := msg.(*model.PortalMsg); status != nil {
+				lastMsg = status.DeepCopy()
 			}
 
-			if len(updateC) == 0 && lastMsg != nil {
+			if len(sub.C) == 0 && lastMsg != nil {
 				if err := sfx.process(lastMsg); err != nil {
 					select {
 					case errorC <- err:
 					case <-time.After(20 * time.Millisecond):
-						fmt.Fprintf(os.Stderr, err.Error())
+						fmt.Fprintln(os.Stderr, err.Error())
 					}
 				}
 				lastMsg = nil
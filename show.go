@@ -0,0 +1,714 @@
+package mawt
+
+// This module implements headless shows, a playlist of the effects of the
+// animation package played on loop through the sequence runner without any
+// tecthulhu sources.  It turns mawt into a standalone LED show player for
+// events where no portal is present.  Shows authored for a ceremony can chase
+// external timecode, playing the entry due at the position of the master show
+// clock rather than running from when the gateway started.  The effects that can
+// be played are also used by the repl sub command
+
+import (
+	"fmt"
+	"image/color"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/animation"
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt/sequencer"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ShowEffect describes an effect that can be played, along with its parameters
+// and their default values
+//
+type ShowEffect struct {
+	Help     string
+	Defaults map[string]string
+	Build    func(params map[string]string) (effect sequencer.Effect, err errors.Error)
+}
+
+var (
+	showEffects = map[string]ShowEffect{
+		"solid": {
+			Help:     "a single color that never completes",
+			Defaults: map[string]string{"color": "00ff00"},
+			Build: func(params map[string]string) (effect sequencer.Effect, err errors.Error) {
+				c, err := showColor(params, "color")
+				if err != nil {
+					return nil, err
+				}
+				return animation.NewSolid(c), nil
+			},
+		},
+		"timed": {
+			Help:     "a single color that completes after the duration",
+			Defaults: map[string]string{"color": "00ff00", "duration": "1s"},
+			Build: func(params map[string]string) (effect sequencer.Effect, err errors.Error) {
+				c, err := showColor(params, "color")
+				if err != nil {
+					return nil, err
+				}
+				duration, err := showDuration(params, "duration")
+				if err != nil {
+					return nil, err
+				}
+				return animation.NewTimedSolid(c, duration), nil
+			},
+		},
+		"fade": {
+			Help:     "interpolates from one color to another over the duration",
+			Defaults: map[string]string{"from": "000000", "to": "0000ff", "duration": "2s"},
+			Build: func(params map[string]string) (effect sequencer.Effect, err errors.Error) {
+				from, err := showColor(params, "from")
+				if err != nil {
+					return nil, err
+				}
+				to, err := showColor(params, "to")
+				if err != nil {
+					return nil, err
+				}
+				duration, err := showDuration(params, "duration")
+				if err != nil {
+					return nil, err
+				}
+				return animation.NewInterpolateSolid(from, to, duration), nil
+			},
+		},
+		"pulse": {
+			Help:     "pulses between two colors, completing after one period when single is true",
+			Defaults: map[string]string{"color": "ff0000", "to": "000000", "period": "1s", "single": "false"},
+			Build: func(params map[string]string) (effect sequencer.Effect, err errors.Error) {
+				from, err := showColor(params, "color")
+				if err != nil {
+					return nil, err
+				}
+				to, err := showColor(params, "to")
+				if err != nil {
+					return nil, err
+				}
+				period, err := showDuration(params, "period")
+				if err != nil {
+					return nil, err
+				}
+				single, errGo := strconv.ParseBool(params["single"])
+				if errGo != nil {
+					return nil, errors.Wrap(errGo).With("param", "single").With("stack", stack.Trace().TrimRuntime())
+				}
+				return animation.NewPulse(from, to, period, single), nil
+			},
+		},
+		"dim": {
+			Help:     "pulses between a color and a dimmed version of it, ratio 0 dims to black",
+			Defaults: map[string]string{"color": "ff8800", "ratio": "0.2", "period": "2s"},
+			Build: func(params map[string]string) (effect sequencer.Effect, err errors.Error) {
+				c, err := showColor(params, "color")
+				if err != nil {
+					return nil, err
+				}
+				ratio, errGo := strconv.ParseFloat(params["ratio"], 64)
+				if errGo != nil || ratio < 0 || ratio > 1 {
+					return nil, errors.New("ratio must be from 0 to 1").With("param", "ratio").With("value", params["ratio"]).With("stack", stack.Trace().TrimRuntime())
+				}
+				period, err := showDuration(params, "period")
+				if err != nil {
+					return nil, err
+				}
+				return animation.NewDimmingPulse(c, ratio, period), nil
+			},
+		},
+		"image": {
+			Help:     "plays a PNG or GIF on a matrix panel, completing after the GIF has looped, loops 0 plays forever",
+			Defaults: map[string]string{"file": "", "width": "8", "height": "8", "origin": "top-left", "serpentine": "false", "direction": "rows", "reversed": "", "scale": "fit", "loops": "1"},
+			Build: func(params map[string]string) (effect sequencer.Effect, err errors.Error) {
+				if len(params["file"]) == 0 {
+					return nil, errors.New("the image file must be given").With("param", "file").With("stack", stack.Trace().TrimRuntime())
+				}
+				width, errGo := strconv.Atoi(params["width"])
+				if errGo != nil {
+					return nil, errors.Wrap(errGo).With("param", "width").With("stack", stack.Trace().TrimRuntime())
+				}
+				height, errGo := strconv.Atoi(params["height"])
+				if errGo != nil {
+					return nil, errors.Wrap(errGo).With("param", "height").With("stack", stack.Trace().TrimRuntime())
+				}
+				serpentine, errGo := strconv.ParseBool(params["serpentine"])
+				if errGo != nil {
+					return nil, errors.Wrap(errGo).With("param", "serpentine").With("stack", stack.Trace().TrimRuntime())
+				}
+				config := MatrixConfig{Width: width, Height: height, Origin: params["origin"], Serpentine: serpentine, Direction: params["direction"]}
+				for _, line := range strings.FieldsFunc(params["reversed"], func(r rune) bool { return r == ',' || r == ' ' }) {
+					reversed, errGo := strconv.Atoi(line)
+					if errGo != nil {
+						return nil, errors.Wrap(errGo).With("param", "reversed").With("stack", stack.Trace().TrimRuntime())
+					}
+					config.Reversed = append(config.Reversed, reversed)
+				}
+				loops, errGo := strconv.Atoi(params["loops"])
+				if errGo != nil || loops < 0 {
+					return nil, errors.New("loops must be 0 or more").With("param", "loops").With("value", params["loops"]).With("stack", stack.Trace().TrimRuntime())
+				}
+				matrix, err := NewMatrix(config)
+				if err != nil {
+					return nil, err
+				}
+				asset, err := LoadImage(params["file"], config.Width, config.Height, params["scale"])
+				if err != nil {
+					return nil, err
+				}
+				return NewImageEffect(asset, matrix, loops), nil
+			},
+		},
+	}
+)
+
+func showColor(params map[string]string, name string) (c color.RGBA, err errors.Error) {
+	value := strings.TrimPrefix(strings.TrimPrefix(params[name], "#"), "0x")
+	rgb, errGo := strconv.ParseUint(value, 16, 32)
+	if errGo != nil || len(value) != 6 {
+		return c, errors.New("colors must be 6 hex digits, for example ff8800").With("param", name).With("value", params[name]).With("stack", stack.Trace().TrimRuntime())
+	}
+	return animation.RGBAFromRGBHex(uint32(rgb)), nil
+}
+
+func showDuration(params map[string]string, name string) (duration time.Duration, err errors.Error) {
+	duration, errGo := time.ParseDuration(params[name])
+	if errGo != nil || duration <= 0 {
+		return 0, errors.New("durations must be positive, for example 500ms").With("param", name).With("value", params[name]).With("stack", stack.Trace().TrimRuntime())
+	}
+	return duration, nil
+}
+
+// ShowEffects returns the effects that can be played by name, the result must not be modified
+//
+func ShowEffects() (effects map[string]ShowEffect) {
+	return showEffects
+}
+
+// ShowEntry is an effect in the playlist of a show
+//
+type ShowEntry struct {
+	Effect   string            `yaml:"effect" json:"effect"`
+	Params   map[string]string `yaml:"params" json:"params"`     // Parameters overriding the defaults of the effect
+	Duration time.Duration     `yaml:"duration" json:"duration"` // The time the entry plays, effects that complete sooner are restarted
+	Strands  []int             `yaml:"strands" json:"strands"`   // The logical strands the effect plays on, all strands when empty
+
+	Vary map[string]ParamRange `yaml:"vary" json:"vary"` // Optional parameters drawn between bounds each time the entry plays, in place of their values
+}
+
+// ShowConfig defines a headless show
+//
+type ShowConfig struct {
+	Strands  int         `yaml:"strands" json:"strands"`   // The number of logical strands, defaults to 24
+	Pixels   int         `yaml:"pixels" json:"pixels"`     // The number of pixels in each strand, defaults to 30
+	Once     bool        `yaml:"once" json:"once"`         // Play the playlist once and then go dark, rather than looping
+	Cues     string      `yaml:"cues" json:"cues"`         // Optional cue file of sound effects played at times within the entries
+	Timecode string      `yaml:"timecode" json:"timecode"` // The timecode the playlist starts at when chasing timecode, hh:mm:ss:ff
+	OnBeat   bool        `yaml:"onBeat" json:"onBeat"`     // Start the entries, and restart their effects, on the beats of the beat clock
+	Playlist []ShowEntry `yaml:"playlist" json:"playlist"`
+
+	VaryEvery time.Duration `yaml:"varyEvery" json:"varyEvery"` // How often the varied parameters of the entry playing are drawn again, 0 draws them only as it starts
+}
+
+const (
+	// locateTolerance is how far a show chasing timecode can drift from the
+	// timecode before it locates to the position of the timecode
+	locateTolerance = 100 * time.Millisecond
+)
+
+var (
+	// chaseEpoch is the animation time at midnight of the timecode being chased
+	chaseEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// ShowPlayer plays the playlist of a show, in place of the portal animations
+//
+type ShowPlayer struct {
+	config ShowConfig
+	runner *sequencer.Runner
+	entry  int       // The playlist entry being played
+	start  time.Time // When the entry started
+	lit    []bool    // The strands the entry plays on, other strands retain old pixels in the runner and are sent dark
+	dark   []color.RGBA
+	frame  []animationModel.ChannelData
+
+	cues      [][]AudioCue   // The audio cues of each entry
+	cueAudio  bool           // Set when the pipeline of the player owns the audio device
+	starts    map[string]int // The number of times each step of the current entry has started
+	cuedFirst bool           // Set when the cues of the first starts of the steps of the current entry are not played as they start
+	cuedNext  bool           // Set once the cues of the first starts of the steps of the next entry have been queued
+	quiet     bool           // Set for the players of scenes, which publish their own events
+
+	chase  *TimecodeClock // The timecode the show is locked to, nil when the show runs freely
+	origin Timecode       // The timecode at which the playlist starts
+
+	random  *rand.Rand        // Draws the varied parameters of the entries
+	varied  time.Time         // When the varied parameters of the entry were last drawn
+	drawn   map[string]string // The varied parameters last drawn
+	varying []*variedEffect   // The effects of the entry playing on each of its strands, when it has varied parameters
+	sync.Mutex
+}
+
+// NewShowPlayer validates a show and creates a player for it
+//
+func NewShowPlayer(config ShowConfig) (player *ShowPlayer, err errors.Error) {
+	if config.Strands == 0 {
+		config.Strands = 24
+	}
+	if config.Pixels == 0 {
+		config.Pixels = 30
+	}
+	if config.Strands < 1 || config.Strands > 255 || config.Pixels < 1 || config.Pixels > maxStrandPixels {
+		return nil, errors.New("shows need from 1 to 255 strands and a positive number of pixels").With("strands", config.Strands).With("pixels", config.Pixels).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(config.Playlist) == 0 {
+		return nil, errors.New("the show playlist is empty").With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.VaryEvery < 0 {
+		return nil, errors.New("the show vary interval cannot be negative").With("varyEvery", config.VaryEvery).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sizes := make([]uint, config.Strands)
+	for i := range sizes {
+		sizes[i] = uint(config.Pixels)
+	}
+	player = &ShowPlayer{
+		config: config,
+		runner: sequencer.NewRunner(sizes),
+		entry:  -1,
+		lit:    make([]bool, config.Strands),
+		dark:   make([]color.RGBA, config.Pixels),
+		random: EffectRand("show"),
+	}
+	if config.OnBeat {
+		player.runner.SetBeat(animationBeat{})
+	}
+
+	// Each entry is built once to check it, the player builds fresh effects every
+	// time an entry is played
+	for i := range config.Playlist {
+		if config.Playlist[i].Duration <= 0 {
+			return nil, errors.New("show entries need a positive duration").With("entry", i+1).With("effect", config.Playlist[i].Effect).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, strand := range config.Playlist[i].Strands {
+			if strand < 1 || strand > config.Strands {
+				return nil, errors.New("show entry strand out of range").With("entry", i+1).With("strand", strand).With("strands", config.Strands).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		if _, _, err = player.sequence(i); err != nil {
+			return nil, err.With("entry", i+1)
+		}
+	}
+	if len(config.Cues) != 0 {
+		if player.cues, err = LoadAudioCues(config.Cues, config); err != nil {
+			return nil, err
+		}
+		player.runner.SetObserver(stepCues{player: player})
+	}
+	if len(config.Timecode) != 0 {
+		if player.origin, err = ParseTimecode(config.Timecode); err != nil {
+			return nil, err
+		}
+	}
+	return player, nil
+}
+
+// EnableCues plays the audio cues of the show, only the player of the pipeline
+// owning the audio device should do so
+//
+func (player *ShowPlayer) EnableCues() {
+	player.Lock()
+	defer player.Unlock()
+
+	player.cueAudio = true
+}
+
+// Chase locks the show to the timecode of a clock, the playlist starting at the
+// timecode of the show.  The show is dark until the timecode reaches its start and
+// holds its frame when the timecode stops
+//
+func (player *ShowPlayer) Chase(clock *TimecodeClock) (err errors.Error) {
+	player.Lock()
+	defer player.Unlock()
+
+	if len(player.config.Timecode) == 0 {
+		return errors.New("the show has no start timecode").With("stack", stack.Trace().TrimRuntime())
+	}
+	player.chase = clock
+	return nil
+}
+
+// nextEntry returns the playlist entry played after the current one, the length of
+// the playlist when a show played once is ending
+//
+func (player *ShowPlayer) nextEntry() (next int) {
+	next = player.entry + 1
+	if next == len(player.config.Playlist) && !player.config.Once {
+		next = 0
+	}
+	return next
+}
+
+// scheduleCues schedules the cues of the steps started with the next entry once it
+// is due within the lookahead of the frame, queued early by the lead of the audio over
+// the LEDs.  The steps are only started in the frame the entry starts within, too
+// late for their cues to be queued early
+//
+func (player *ShowPlayer) scheduleCues(tm time.Time) {
+	if !player.cueAudio || len(player.cues) == 0 || player.cuedNext || player.entry < 0 || player.entry >= len(player.config.Playlist) {
+		return
+	}
+	next := player.nextEntry()
+	if next >= len(player.config.Playlist) {
+		return
+	}
+	nextStart := player.ends()
+	if nextStart.After(tm.Add(cueLookahead + cueLead())) {
+		return
+	}
+	player.cuedNext = true
+	for _, cue := range player.cues[next] {
+		if cue.Every || cue.Cycle == 1 {
+			scheduleCue(cue, nextStart.Sub(tm)-cueLead())
+		}
+	}
+}
+
+// strandStep returns the name of the step playing the effect of an entry on a strand
+//
+func strandStep(strand int) (name string) {
+	return fmt.Sprintf("strand %d", strand)
+}
+
+// sequence builds the sequence for a playlist entry, its effect restarting on each
+// of its strands whenever it completes
+//
+func (player *ShowPlayer) sequence(entry int) (seq *sequencer.Sequence, strands []int, err errors.Error) {
+	effects, strands, err := player.effects(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	player.varying = nil
+	seq = sequencer.NewSequence()
+	for i, strand := range strands {
+		built := effects[i]
+		// Effects with varied parameters can glide into those built from a later draw
+		if len(player.config.Playlist[entry].Vary) != 0 {
+			varied := &variedEffect{effect: built}
+			player.varying = append(player.varying, varied)
+			built = varied
+		}
+		name := strandStep(strand)
+		step := &sequencer.Step{UniverseID: uint(strand - 1), Effect: built}
+		if player.config.OnBeat {
+			step.ThenDoOnBeat(name)
+		} else {
+			step.ThenDoImmediately(name)
+		}
+		seq.AddInitialStep(name, step)
+	}
+	return seq, strands, nil
+}
+
+// effects builds the effect of a playlist entry for each of its strands, drawing
+// its varied parameters
+//
+func (player *ShowPlayer) effects(entry int) (effects []sequencer.Effect, strands []int, err errors.Error) {
+	config := player.config.Playlist[entry]
+	effect, isPresent := showEffects[config.Effect]
+	if !isPresent {
+		names := make([]string, 0, len(showEffects))
+		for name := range showEffects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, nil, errors.New("unknown show effect").With("effect", config.Effect).With("effects", strings.Join(names, ", ")).With("stack", stack.Trace().TrimRuntime())
+	}
+	params := map[string]string{}
+	for k, v := range effect.Defaults {
+		params[k] = v
+	}
+	for k, v := range config.Params {
+		if _, isPresent := effect.Defaults[k]; !isPresent {
+			return nil, nil, errors.New("unknown parameter").With("effect", config.Effect).With("param", k).With("stack", stack.Trace().TrimRuntime())
+		}
+		params[k] = v
+	}
+	player.drawn = map[string]string{}
+	for k, bounds := range config.Vary {
+		if _, isPresent := effect.Defaults[k]; !isPresent {
+			return nil, nil, errors.New("unknown parameter").With("effect", config.Effect).With("param", k).With("stack", stack.Trace().TrimRuntime())
+		}
+		value, err := bounds.draw(k, effect.Defaults[k], player.random)
+		if err != nil {
+			return nil, nil, err.With("effect", config.Effect)
+		}
+		params[k], player.drawn[k] = value, value
+	}
+
+	strands = config.Strands
+	if len(strands) == 0 {
+		for strand := 1; strand <= player.config.Strands; strand++ {
+			strands = append(strands, strand)
+		}
+	}
+
+	effects = make([]sequencer.Effect, 0, len(strands))
+	for range strands {
+		built, err := effect.Build(params)
+		if err != nil {
+			return nil, nil, err.With("effect", config.Effect)
+		}
+		effects = append(effects, built)
+	}
+	return effects, strands, nil
+}
+
+// GetFrame renders the show at the supplied time, moving through the playlist as
+// the entries complete
+//
+func (player *ShowPlayer) GetFrame(tm time.Time) (frame []animationModel.ChannelData) {
+	player.Lock()
+	defer player.Unlock()
+
+	if player.chase != nil {
+		tm = player.locate()
+	}
+
+	finished := player.entry >= len(player.config.Playlist)
+	if player.chase == nil && !finished && (player.entry < 0 || !tm.Before(player.ends())) {
+		next := player.nextEntry()
+		// Cues of the next entry already scheduled are not scheduled again, unless
+		// the entry was skipped to
+		player.cuedFirst = player.cuedNext && player.entry >= 0 && !player.start.IsZero()
+		player.cuedNext, player.starts = false, map[string]int{}
+		for i := range player.lit {
+			player.lit[i] = false
+		}
+		if next < len(player.config.Playlist) {
+			// Entries were validated when the player was created
+			seq, strands, _ := player.sequence(next)
+			for _, strand := range strands {
+				player.lit[strand-1] = true
+			}
+			// Entries following one another on the beat start at the beat itself
+			// rather than the frame it fell within
+			start := tm
+			if player.config.OnBeat && player.entry >= 0 && !player.start.IsZero() {
+				start = player.ends()
+			}
+			// The entry is set first as the cues of the steps are played as they start
+			player.entry, player.start, player.varied = next, start, start
+			player.runner.InitSequence(seq, start)
+			componentLog(LogSequencer).Debug("show entry started", "entry", next+1, "effect", player.config.Playlist[next].Effect, "strands", len(strands))
+			// tm is on the animation clock, events are stamped using the wall clock
+			if !player.quiet {
+				bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "show", Detail: fmt.Sprintf("entry %d %s", next+1, player.config.Playlist[next].Effect)})
+			}
+		} else {
+			player.entry = len(player.config.Playlist)
+		}
+	}
+	if player.config.VaryEvery > 0 && player.entry >= 0 && player.entry < len(player.config.Playlist) && tm.Sub(player.varied) >= player.config.VaryEvery {
+		player.vary(tm)
+	}
+	if player.entry >= 0 {
+		player.runner.ProcessFrame(tm)
+		player.scheduleCues(tm)
+	}
+
+	if len(player.frame) != player.config.Strands {
+		player.frame = make([]animationModel.ChannelData, player.config.Strands)
+	}
+	for i := range player.frame {
+		data := player.dark
+		if player.lit[i] {
+			data = player.runner.UniverseData(uint(i))
+		}
+		player.frame[i] = animationModel.ChannelData{ChannelNum: animationModel.OpcChannel(i + 1), Data: data}
+	}
+	return player.frame
+}
+
+// ends returns the time the entry playing ends, its duration having passed or, for
+// shows played on the beat, the first beat after that
+//
+func (player *ShowPlayer) ends() (tm time.Time) {
+	tm = player.start.Add(player.config.Playlist[player.entry].Duration)
+	if player.config.OnBeat && !player.start.IsZero() {
+		tm = animationBeat{}.NextBeat(tm)
+	}
+	return tm
+}
+
+// Resume plays the playlist from part way through an entry, used to continue a show
+// from a snapshot taken before a restart
+//
+func (player *ShowPlayer) Resume(entry int, elapsed time.Duration, tm time.Time) (err errors.Error) {
+	player.Lock()
+	defer player.Unlock()
+
+	if player.chase != nil {
+		// The timecode decides where the show is
+		return nil
+	}
+	if entry < 0 || entry >= len(player.config.Playlist) {
+		return errors.New("show entry out of range").With("entry", entry+1).With("entries", len(player.config.Playlist)).With("stack", stack.Trace().TrimRuntime())
+	}
+	if elapsed < 0 || elapsed >= player.config.Playlist[entry].Duration {
+		elapsed = 0
+	}
+	// The steps started part way through the entry are not cued
+	player.cuedFirst = elapsed > 0
+	if err = player.seek(entry, elapsed, tm); err != nil {
+		return err
+	}
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "show", Detail: fmt.Sprintf("entry %d %s resumed at %s", entry+1, player.config.Playlist[entry].Effect, elapsed.Round(time.Second))})
+	return nil
+}
+
+// seek plays an entry of the playlist from part way through it, the caller deciding
+// whether the cues of the steps started with the entry are played
+//
+func (player *ShowPlayer) seek(entry int, elapsed time.Duration, tm time.Time) (err errors.Error) {
+	seq, strands, err := player.sequence(entry)
+	if err != nil {
+		return err.With("entry", entry+1)
+	}
+	for i := range player.lit {
+		player.lit[i] = false
+	}
+	for _, strand := range strands {
+		player.lit[strand-1] = true
+	}
+	player.entry, player.start, player.varied = entry, tm.Add(-elapsed), tm
+	player.cuedNext, player.starts = false, map[string]int{}
+	player.runner.InitSequence(seq, player.start)
+	return nil
+}
+
+// locate moves the show to the entry due at the position of the timecode being
+// chased, returning the time of the frame on the timeline of the timecode.  The
+// show keeps running from the entry it is playing while it stays within the
+// locate tolerance of the timecode
+//
+func (player *ShowPlayer) locate() (tm time.Time) {
+	// The frame is seen once the output latency has passed
+	position, rate, _ := player.chase.Position(time.Now().Add(GetBeat().State().Latency))
+	tm = chaseEpoch.Add(position)
+	elapsed := position - player.origin.Offset(rate)
+	if rate == 0 || elapsed < 0 {
+		// Dark until the timecode reaches the start of the show
+		player.entry, player.start = -1, time.Time{}
+		for i := range player.lit {
+			player.lit[i] = false
+		}
+		return tm
+	}
+
+	total := time.Duration(0)
+	for _, entry := range player.config.Playlist {
+		total += entry.Duration
+	}
+	if elapsed >= total {
+		if player.config.Once {
+			player.entry = len(player.config.Playlist)
+			for i := range player.lit {
+				player.lit[i] = false
+			}
+			return tm
+		}
+		elapsed %= total
+	}
+	entry := 0
+	for elapsed >= player.config.Playlist[entry].Duration {
+		elapsed -= player.config.Playlist[entry].Duration
+		entry++
+	}
+
+	start := tm.Add(-elapsed)
+	drift := player.start.Sub(start)
+	if entry == player.entry && drift < locateTolerance && drift > -locateTolerance {
+		return tm
+	}
+
+	// Moving on to the following entry, or to the first as the show starts, is not
+	// a jump in the timecode, cues of the entry already scheduled are not scheduled
+	// again
+	isNext := entry == player.nextEntry() && elapsed < locateTolerance
+	player.cuedFirst = elapsed > 0
+	if isNext {
+		player.cuedFirst = player.cuedNext
+	}
+	// Entries were validated when the player was created
+	player.seek(entry, elapsed, tm)
+	if player.quiet {
+		return tm
+	}
+	detail := fmt.Sprintf("entry %d %s", entry+1, player.config.Playlist[entry].Effect)
+	if !isNext {
+		detail += " located at timecode " + player.chase.State().Timecode
+	}
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "show", Detail: detail})
+	return tm
+}
+
+// vary draws the varied parameters of the entry playing again, its effect gliding
+// into the one built from them rather than being restarted
+//
+func (player *ShowPlayer) vary(tm time.Time) {
+	player.varied = tm
+	if len(player.config.Playlist[player.entry].Vary) == 0 {
+		return
+	}
+	// Entries were validated when the player was created
+	effects, _, _ := player.effects(player.entry)
+	glide := varyGlide
+	if player.config.VaryEvery < glide {
+		glide = player.config.VaryEvery
+	}
+	for i, varied := range player.varying {
+		varied.redraw(effects[i], tm, glide)
+	}
+	if player.quiet {
+		return
+	}
+	drawn := make([]string, 0, len(player.drawn))
+	for k, v := range player.drawn {
+		drawn = append(drawn, k+"="+v)
+	}
+	sort.Strings(drawn)
+	bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "show", Detail: fmt.Sprintf("entry %d %s varied %s", player.entry+1, player.config.Playlist[player.entry].Effect, strings.Join(drawn, " "))})
+}
+
+// Skip moves on to the next playlist entry at the following frame, a show played
+// once that has finished starts again
+//
+func (player *ShowPlayer) Skip() {
+	player.Lock()
+	defer player.Unlock()
+
+	if player.entry >= len(player.config.Playlist) {
+		player.entry = -1
+		return
+	}
+	player.start = time.Time{}
+}
+
+// State returns the playlist entry being played and when it started, the entry
+// is -1 before the show starts and past the end of the playlist once a show
+// played once has finished
+//
+func (player *ShowPlayer) State() (entry int, start time.Time) {
+	player.Lock()
+	defer player.Unlock()
+
+	return player.entry, player.start
+}
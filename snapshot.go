@@ -0,0 +1,326 @@
+package mawt
+
+// This module implements snapshots of the state of the renderers of the
+// pipelines, the position within a headless show, the scene shown in place of
+// the animations and the position within its sequence, the frame held in place
+// of the animations, the cue fading out, the speed of the animation clock and the
+// operator overrides such as the brightness, profile, palette and strand
+// mapping.  Snapshots are written to
+// disk periodically and restored on startup so that a crash or power loss in
+// the middle of a choreographed ceremony resumes where it was rather than
+// starting the show again from the beginning
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// CueSnapshot is a cue part way through fading out
+//
+type CueSnapshot struct {
+	Color    [3]uint8      `json:"color"`
+	Duration time.Duration `json:"duration"`
+	Level    float64       `json:"level"`
+	Elapsed  time.Duration `json:"elapsed"`
+}
+
+// HeldSnapshot is a frame being shown in place of the animations
+//
+type HeldSnapshot struct {
+	Frame     []animationModel.ChannelData `json:"frame"`
+	Remaining time.Duration                `json:"remaining"`
+}
+
+// ShowSnapshot is the position within the playlist of a headless show
+//
+type ShowSnapshot struct {
+	Entry   int           `json:"entry"` // Counted from 0
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// SceneSnapshot is a scene being shown in place of the animations
+//
+type SceneSnapshot struct {
+	Name      string        `json:"name"`
+	Source    string        `json:"source"`
+	Remaining time.Duration `json:"remaining"` // The time until the scene reverts to the animations
+	Elapsed   time.Duration `json:"elapsed"`   // The position within the sequence of the scene, on the animation clock
+}
+
+// PipelineSnapshot is the state of the renderer of a pipeline
+//
+type PipelineSnapshot struct {
+	Name       string          `json:"name"`
+	Profile    string          `json:"profile,omitempty"`
+	Brightness float64         `json:"brightness"`
+	Palette    string          `json:"palette"`
+	Strands    []StrandMapping `json:"strands,omitempty"`
+	Detached   []int           `json:"detached,omitempty"` // The universes frames were not sent to
+	Show       *ShowSnapshot   `json:"show,omitempty"`
+	Scene      *SceneSnapshot  `json:"scene,omitempty"`
+	Held       *HeldSnapshot   `json:"held,omitempty"`
+	Cue        *CueSnapshot    `json:"cue,omitempty"`
+}
+
+// Snapshot is the state of the renderers of all of the pipelines
+//
+type Snapshot struct {
+	Time      time.Time          `json:"time"`
+	Clock     *ClockState        `json:"clock,omitempty"` // The animation clock shared by the pipelines
+	Pipelines []PipelineSnapshot `json:"pipelines"`
+}
+
+// snapshot captures the layers drawn by the renderer of a pipeline
+//
+func (fc *FadeCandy) snapshot(snap *PipelineSnapshot, now time.Time) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	snap.Brightness = fc.brightness
+	snap.Palette = PaletteName(fc.palette)
+	if fc.scene != nil && now.Before(fc.scene.state.Until) {
+		_, start := fc.scene.player.State()
+		snap.Scene = &SceneSnapshot{
+			Name:      fc.scene.state.Name,
+			Source:    fc.scene.state.Source,
+			Remaining: fc.scene.state.Until.Sub(now),
+			Elapsed:   GetClock().Now(now).Sub(start),
+		}
+	}
+	if fc.held != nil && now.Before(fc.heldUntil) {
+		snap.Held = &HeldSnapshot{Frame: copyFrame(fc.held), Remaining: fc.heldUntil.Sub(now)}
+	}
+	if fc.cue != nil && now.Sub(fc.cue.start) < fc.cue.Duration {
+		snap.Cue = &CueSnapshot{
+			Color:    [3]uint8{fc.cue.Color.R, fc.cue.Color.G, fc.cue.Color.B},
+			Duration: fc.cue.Duration,
+			Level:    fc.cue.Level,
+			Elapsed:  now.Sub(fc.cue.start),
+		}
+	}
+}
+
+// restore replaces the layers drawn by the renderer of a pipeline with those of a snapshot
+//
+func (fc *FadeCandy) restore(snap PipelineSnapshot, now time.Time) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if snap.Held != nil {
+		fc.held = copyFrame(snap.Held.Frame)
+		fc.heldUntil = now.Add(snap.Held.Remaining)
+	}
+	if snap.Cue != nil {
+		fc.cue = &Cue{Duration: snap.Cue.Duration, Level: snap.Cue.Level, start: now.Add(-snap.Cue.Elapsed)}
+		fc.cue.Color.R, fc.cue.Color.G, fc.cue.Color.B, fc.cue.Color.A = snap.Cue.Color[0], snap.Cue.Color[1], snap.Cue.Color[2], 0xff
+	}
+}
+
+// Snapshot captures the state of the renderer of the gateway
+//
+func (gw *Gateway) Snapshot(now time.Time) (snap PipelineSnapshot) {
+	snap = PipelineSnapshot{
+		Name:    gw.Name,
+		Profile: gw.ActiveProfile(),
+		Strands: gw.Topology(),
+	}
+	if universes := gw.Universes(); len(universes.Detached) != 0 {
+		snap.Detached = universes.Detached
+	}
+	gw.fc.snapshot(&snap, now)
+	if gw.Show != nil {
+		if entry, start := gw.Show.State(); entry >= 0 && entry < len(gw.Show.config.Playlist) {
+			// Shows are played on the animation clock
+			snap.Show = &ShowSnapshot{Entry: entry, Elapsed: GetClock().Now(now).Sub(start)}
+		}
+	}
+	return snap
+}
+
+// Restore returns the renderer of the gateway to the state captured in a snapshot.
+// Parts of the snapshot that no longer apply, for example because the show or the
+// profiles have since been changed in the configuration, are skipped and reported
+//
+func (gw *Gateway) Restore(snap PipelineSnapshot, now time.Time) (errs []errors.Error) {
+	if len(snap.Profile) != 0 {
+		if err := gw.SetProfile(snap.Profile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	palette, err := GetPalette(snap.Palette)
+	if err != nil {
+		errs = append(errs, err.With("pipeline", gw.Name))
+	} else {
+		gw.SetPalette(palette)
+	}
+	if strands, err := NewStrandMap(snap.Strands); err != nil {
+		errs = append(errs, err.With("pipeline", gw.Name))
+	} else {
+		gw.restoreTopology(strands, snap.Detached)
+	}
+	gw.SetBrightness(snap.Brightness)
+	gw.fc.restore(snap, now)
+
+	if snap.Scene != nil {
+		if err := gw.resumeScene(*snap.Scene, now); err != nil {
+			errs = append(errs, err.With("pipeline", gw.Name))
+		}
+	}
+
+	if snap.Show != nil && gw.Show != nil {
+		if err := gw.Show.Resume(snap.Show.Entry, snap.Show.Elapsed, GetClock().Now(now)); err != nil {
+			errs = append(errs, err.With("pipeline", gw.Name))
+		}
+	}
+	return errs
+}
+
+// resumeScene activates the scene of a snapshot for the time it had remaining, its
+// sequence continuing from where it was.  The scene is played for its original
+// length so that the sequence does not wrap around part way through
+//
+func (gw *Gateway) resumeScene(snap SceneSnapshot, now time.Time) (err errors.Error) {
+	if _, err = gw.ActivateScene(snap.Name, snap.Elapsed+snap.Remaining, snap.Source); err != nil {
+		return err
+	}
+
+	gw.fc.Lock()
+	scene := gw.fc.scene
+	if scene != nil {
+		scene.state.Until = now.Add(snap.Remaining)
+	}
+	gw.fc.Unlock()
+	if scene == nil {
+		return nil
+	}
+
+	scene.player.Lock()
+	defer scene.player.Unlock()
+	return scene.player.seek(0, snap.Elapsed, GetClock().Now(now))
+}
+
+// TakeSnapshot captures the state of the renderers of the gateways
+//
+func TakeSnapshot(gws []*Gateway) (snap *Snapshot) {
+	now := time.Now()
+	clock := GetClock().State()
+	snap = &Snapshot{Time: now, Clock: &clock, Pipelines: make([]PipelineSnapshot, 0, len(gws))}
+	for _, gw := range gws {
+		snap.Pipelines = append(snap.Pipelines, gw.Snapshot(now))
+	}
+	return snap
+}
+
+// RestoreSnapshot returns the renderers of the gateways to the state captured in a
+// snapshot, pipelines are matched by name and those not in the snapshot are untouched
+//
+func RestoreSnapshot(snap *Snapshot, gws []*Gateway) (errs []errors.Error) {
+	// The clock is restored first as the shows and scenes resume on it
+	if snap.Clock != nil {
+		clock := GetClock()
+		if err := clock.SetSpeed(snap.Clock.Speed, "snapshot"); err != nil {
+			errs = append(errs, err)
+		}
+		clock.Pause(snap.Clock.Paused, "snapshot")
+	}
+
+	now := time.Now()
+	for _, pipeline := range snap.Pipelines {
+		for _, gw := range gws {
+			if gw.Name == pipeline.Name {
+				errs = append(errs, gw.Restore(pipeline, now)...)
+			}
+		}
+	}
+	bus.Publish(TopicEvents, Event{Time: now, Kind: "snapshot-restored", Detail: snap.Time.Format(time.RFC3339)})
+	return errs
+}
+
+// SaveSnapshot writes a snapshot to a file, replacing the previous snapshot only once
+// the new one has been written in full
+//
+func SaveSnapshot(fn string, snap *Snapshot) (err errors.Error) {
+	data, errGo := json.MarshalIndent(snap, "", "  ")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return writeAtomic(fn, data)
+}
+
+// writeAtomic replaces the contents of a file with data, written to a temporary
+// file that is renamed over it so that a crash or power loss leaves either the old
+// or the new contents
+//
+func writeAtomic(fn string, data []byte) (err errors.Error) {
+	tmp, errGo := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	_, errGo = tmp.Write(data)
+	if errGo == nil {
+		errGo = tmp.Sync()
+	}
+	if errClose := tmp.Close(); errGo == nil {
+		errGo = errClose
+	}
+	if errGo == nil {
+		errGo = os.Rename(tmp.Name(), fn)
+	}
+	if errGo != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// LoadSnapshot reads a snapshot from a file, nil being returned when there is none
+//
+func LoadSnapshot(fn string) (snap *Snapshot, err errors.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if os.IsNotExist(errGo) {
+		return nil, nil
+	}
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	snap = &Snapshot{}
+	if errGo = json.Unmarshal(data, snap); errGo != nil {
+		return nil, errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return snap, nil
+}
+
+// KeepSnapshots writes a snapshot of the gateways to a file at the interval until the
+// quit channel is closed, when a final snapshot is written
+//
+func KeepSnapshots(fn string, gws []*Gateway, interval time.Duration, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	go func() {
+		defer track("snapshots")()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		failures := NewErrorSummary(errorSummaryInterval)
+		for {
+			select {
+			case <-tick.C:
+			case <-quitC:
+				if err := SaveSnapshot(fn, TakeSnapshot(gws)); err != nil {
+					sendErr(errorC, err)
+				}
+				return
+			}
+			if err := SaveSnapshot(fn, TakeSnapshot(gws)); err != nil {
+				sendErr(errorC, failures.Failed(err, time.Now()))
+			} else {
+				failures.Succeeded(time.Now())
+			}
+		}
+	}()
+}
@@ -0,0 +1,131 @@
+package mawt
+
+// This module implements the standby and connecting colors of the physical
+// strands.  Without them the LEDs keep whatever the controller last held while
+// the gateway starts, waits for the tecthulhus or after it has stopped, which at
+// an event looks like a portal state that is not real.  The standby color is held
+// from the start of the pipeline until the first portal status arrives and sent
+// again as it stops, the connecting color replaces the animations of the strand
+// while the gateway is connecting to the fadecandy server or tecthulhus, or
+// reconnecting to them
+
+import (
+	"image/color"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultStandbyPixels = 64
+)
+
+// StandbyConfig defines the standby and connecting colors of a physical strand
+//
+type StandbyConfig struct {
+	Channel    int    `yaml:"channel"`    // The physical strand, or OPC channel
+	Pixels     int    `yaml:"pixels"`     // The number of pixels set to the standby color, defaults to 64
+	Standby    string `yaml:"standby"`    // Optional color, for example 101010, shown until the first status and as the pipeline stops
+	Connecting string `yaml:"connecting"` // Optional color shown while connecting or reconnecting
+}
+
+type standbyStrand struct {
+	channel    animationModel.OpcChannel
+	pixels     int
+	standby    *color.RGBA
+	connecting *color.RGBA
+}
+
+// Standby holds the validated standby and connecting colors of the strands
+//
+type Standby struct {
+	strands []standbyStrand
+}
+
+// NewStandby validates the standby and connecting colors
+//
+func NewStandby(configs []StandbyConfig) (standby *Standby, err errors.Error) {
+	standby = &Standby{strands: make([]standbyStrand, 0, len(configs))}
+	channels := map[int]bool{}
+	for _, config := range configs {
+		if config.Channel < 1 || config.Channel > 255 {
+			return nil, errors.New("standby channels must be from 1 to 255").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+		}
+		if channels[config.Channel] {
+			return nil, errors.New("standby colors defined more than once for a channel").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+		}
+		channels[config.Channel] = true
+		if config.Pixels < 0 || config.Pixels > maxStrandPixels {
+			return nil, errors.New("the standby pixels must be from 1 to the length of a strand").With("channel", config.Channel).With("pixels", config.Pixels).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(config.Standby) == 0 && len(config.Connecting) == 0 {
+			return nil, errors.New("standby channels need a standby or connecting color").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		strand := standbyStrand{channel: animationModel.OpcChannel(config.Channel), pixels: config.Pixels}
+		if strand.pixels == 0 {
+			strand.pixels = defaultStandbyPixels
+		}
+		colors := map[string]string{"standby": config.Standby, "connecting": config.Connecting}
+		for name, dest := range map[string]**color.RGBA{"standby": &strand.standby, "connecting": &strand.connecting} {
+			if len(colors[name]) == 0 {
+				continue
+			}
+			c, err := showColor(colors, name)
+			if err != nil {
+				return nil, err.With("channel", config.Channel)
+			}
+			*dest = &c
+		}
+		standby.strands = append(standby.strands, strand)
+	}
+	return standby, nil
+}
+
+// Frame returns the frame sent as the pipeline starts and stops, holding the
+// strands that have a standby color
+//
+func (standby *Standby) Frame() (frame []animationModel.ChannelData) {
+	frame = []animationModel.ChannelData{}
+	for _, strand := range standby.strands {
+		if strand.standby == nil {
+			continue
+		}
+		data := make([]color.RGBA, strand.pixels)
+		for i := range data {
+			data[i] = *strand.standby
+		}
+		frame = append(frame, animationModel.ChannelData{ChannelNum: strand.channel, Data: data})
+	}
+	return frame
+}
+
+// connecting replaces the strands that have a connecting color while the pipeline
+// is in one of the connecting states, the frame is copied as its buffers belong to
+// the animations
+//
+func (standby *Standby) connecting(frame []animationModel.ChannelData, state string) (shown []animationModel.ChannelData) {
+	switch state {
+	case StatusConnecting, StatusOPCDown, StatusStale:
+	default:
+		return frame
+	}
+
+	shown = make([]animationModel.ChannelData, 0, len(frame))
+	for _, channelData := range frame {
+		for _, strand := range standby.strands {
+			if strand.channel != channelData.ChannelNum || strand.connecting == nil {
+				continue
+			}
+			data := make([]color.RGBA, len(channelData.Data))
+			for i := range data {
+				data[i] = *strand.connecting
+			}
+			channelData.Data = data
+			break
+		}
+		shown = append(shown, channelData)
+	}
+	return shown
+}
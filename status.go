@@ -0,0 +1,204 @@
+package mawt
+
+// This module implements the status indicator of the gateway itself, a single
+// pixel reserved on a physical strand, or an LED such as the onboard LED of a
+// Raspberry Pi, showing the health of the pipelines so that crews can diagnose
+// problems at a glance.  The pixel is green when healthy, blue while connecting,
+// red while the fadecandy server is down and purple while the tecthulhus are
+// stale.  Single color LEDs show the same states as blink patterns
+
+import (
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	StatusOK         = "ok"
+	StatusConnecting = "connecting"
+	StatusOPCDown    = "opc-down"
+	StatusStale      = "tecthulhu-stale"
+
+	defaultStatusStale = 30 * time.Second
+)
+
+var (
+	statusColors = map[string]color.RGBA{
+		StatusOK:         {G: 0xFF, A: 0xFF},
+		StatusConnecting: {B: 0xFF, A: 0xFF},
+		StatusOPCDown:    {R: 0xFF, A: 0xFF},
+		StatusStale:      {R: 0x80, B: 0x80, A: 0xFF},
+	}
+
+	// statusSeverity orders the states, the worst state of the pipelines being
+	// the one shown by the status LED
+	statusSeverity = map[string]int{
+		StatusOK:         0,
+		StatusStale:      1,
+		StatusConnecting: 2,
+		StatusOPCDown:    3,
+	}
+
+	// statusBlinks are the on and off times of the status LED for each state, in
+	// tenths of a second, repeated
+	statusBlinks = map[string][]int{
+		StatusOK:         {10},
+		StatusConnecting: {5, 5},
+		StatusOPCDown:    {1, 1},
+		StatusStale:      {1, 2, 1, 16},
+	}
+)
+
+// StatusConfig defines the status indicators
+//
+type StatusConfig struct {
+	Channel int           `yaml:"channel"` // The physical strand, or OPC channel, of the status pixel, 0 when there is none
+	Pixel   int           `yaml:"pixel"`   // The position of the status pixel on the strand, counting from 0
+	LED     string        `yaml:"led"`     // Optional sysfs LED, such as /sys/class/leds/led0, blinking the worst state of the pipelines
+	Stale   time.Duration `yaml:"stale"`   // The time without a tecthulhu status after which they are stale, defaults to 30s
+}
+
+// NewStatus validates the status indicators
+//
+func NewStatus(config StatusConfig) (status *StatusConfig, err errors.Error) {
+	if config.Channel < 0 || config.Channel > 255 {
+		return nil, errors.New("the status pixel channel must be from 1 to 255, or 0 for no pixel").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Pixel < 0 || config.Pixel >= maxStrandPixels {
+		return nil, errors.New("the status pixel is beyond the end of the strand").With("pixel", config.Pixel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Stale < 0 {
+		return nil, errors.New("the status stale time cannot be negative").With("stale", config.Stale).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Stale == 0 {
+		config.Stale = defaultStatusStale
+	}
+	return &config, nil
+}
+
+// Indicator returns the state shown by the status indicators, the fadecandy server
+// being down taking precedence over connecting, which takes precedence over the
+// tecthulhus being stale
+//
+func (health *Health) Indicator(stale time.Duration, now time.Time) (state string) {
+	health.Lock()
+	defer health.Unlock()
+
+	if !health.opcFailing.IsZero() {
+		return StatusOPCDown
+	}
+	if health.opcOK.IsZero() {
+		return StatusConnecting
+	}
+	if len(health.portals) == 0 {
+		return StatusOK
+	}
+	latest := time.Time{}
+	for _, lastOK := range health.portals {
+		if lastOK.After(latest) {
+			latest = lastOK
+		}
+	}
+	switch {
+	case latest.IsZero() && now.Sub(health.started) < stale:
+		return StatusConnecting
+	case now.Sub(latest) >= stale:
+		return StatusStale
+	}
+	return StatusOK
+}
+
+// statusPixel sets the status pixel of a physical frame, the frame is copied
+// as its buffers belong to the animations
+//
+func statusPixel(frame []animationModel.ChannelData, status *StatusConfig, state string) (shown []animationModel.ChannelData) {
+	channel := animationModel.OpcChannel(status.Channel)
+	shown = make([]animationModel.ChannelData, 0, len(frame)+1)
+	index := -1
+	for i, channelData := range frame {
+		if channelData.ChannelNum == channel {
+			index = i
+			data := make([]color.RGBA, len(channelData.Data), len(channelData.Data)+1)
+			copy(data, channelData.Data)
+			channelData.Data = data
+		}
+		shown = append(shown, channelData)
+	}
+	// A strand given over to the status pixel is not part of the animations
+	if index < 0 {
+		shown = append(shown, animationModel.ChannelData{ChannelNum: channel})
+		index = len(shown) - 1
+	}
+	strand := &shown[index]
+	for len(strand.Data) <= status.Pixel {
+		strand.Data = append(strand.Data, color.RGBA{A: 0xFF})
+	}
+	strand.Data[status.Pixel] = statusColors[state]
+	return shown
+}
+
+// WatchStatusLED blinks a sysfs LED in the pattern of the worst state of the
+// pipelines until quitC is closed
+//
+func WatchStatusLED(status *StatusConfig, gws []*Gateway, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	// The trigger of an onboard LED, such as the SD card activity, would
+	// otherwise fight over it
+	if errGo := ioutil.WriteFile(filepath.Join(status.LED, "trigger"), []byte("none"), 0200); errGo != nil {
+		return errors.Wrap(errGo).With("led", status.LED).With("stack", stack.Trace().TrimRuntime())
+	}
+	brightness := filepath.Join(status.LED, "brightness")
+
+	go func() {
+		defer track("status led")()
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+
+		state := ""
+		step, remaining := 0, 0
+		lit, written := false, false
+		failing := false
+		for {
+			select {
+			case now := <-tick.C:
+				worst := StatusOK
+				for _, gw := range gws {
+					if gwState := gw.Health.Indicator(status.Stale, now); statusSeverity[gwState] > statusSeverity[worst] {
+						worst = gwState
+					}
+				}
+				pattern := statusBlinks[worst]
+				if worst != state {
+					state, step, remaining = worst, 0, pattern[0]
+				} else if remaining--; remaining <= 0 {
+					step = (step + 1) % len(pattern)
+					remaining = pattern[step]
+				}
+
+				on := step%2 == 0
+				if on == lit && written {
+					continue
+				}
+				value := []byte("0")
+				if on {
+					value = []byte("1")
+				}
+				if errGo := ioutil.WriteFile(brightness, value, 0200); errGo != nil {
+					if !failing {
+						sendErr(errorC, errors.Wrap(errGo).With("led", status.LED).With("stack", stack.Trace().TrimRuntime()))
+					}
+					failing = true
+					continue
+				}
+				lit, written, failing = on, true, false
+			case <-quitC:
+				return
+			}
+		}
+	}()
+	return nil
+}
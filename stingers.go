@@ -0,0 +1,153 @@
+package mawt
+
+// This module implements the sound-to-light stingers.  Some tecthulhu firmwares
+// report the identifiers of the game sounds being played at the portal, such as a
+// successful hack or a critical attack, in the audioCues field of their status.
+// Each cue can be mapped onto a short stinger, one or more flashes of color over
+// the animations, so that the physical portal answers the players in step with the
+// sound design of the app.  Firmwares using other names for the field can have
+// their documents translated using a status transform.  A stinger is played when
+// its cue appears in the status of the displayed portal, a cue reported by several
+// polls in a row being played once
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	maxStingerFlashes = 10
+)
+
+// StingerConfig maps a game audio cue onto flashes of color over the animations
+//
+type StingerConfig struct {
+	Cue      string        `yaml:"cue" json:"cue"`           // The audio cue identifier reported by the tecthulhu, for example hack-success
+	Color    string        `yaml:"color" json:"color"`       // The color of the flashes, as 6 hex digits
+	Duration time.Duration `yaml:"duration" json:"duration"` // The time each flash takes to fade out, defaults to 500ms
+	Level    float64       `yaml:"level" json:"level"`       // The strength of the flashes, from 0 to 1, defaults to 1
+	Flashes  int           `yaml:"flashes" json:"flashes"`   // The number of flashes played one after another, defaults to 1
+}
+
+// stinger is a validated stinger
+//
+type stinger struct {
+	cue     Cue
+	flashes int
+}
+
+// Stingers plays the stingers mapped onto the audio cues of the displayed portal
+//
+type Stingers struct {
+	stingers map[string]stinger // Stingers by audio cue
+	pipeline string
+	title    string          // The displayed portal
+	playing  map[string]bool // The cues reported in the last status of the displayed portal
+	sync.Mutex
+}
+
+// NewStingers validates the stingers, returning nil when there are none
+//
+func NewStingers(configs []StingerConfig) (stingers *Stingers, err errors.Error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	stingers = &Stingers{stingers: map[string]stinger{}, playing: map[string]bool{}}
+	for _, config := range configs {
+		if len(config.Cue) == 0 {
+			return nil, errors.New("stingers need an audio cue").With("color", config.Color).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, isPresent := stingers.stingers[config.Cue]; isPresent {
+			return nil, errors.New("stinger audio cues must be unique").With("cue", config.Cue).With("stack", stack.Trace().TrimRuntime())
+		}
+		rgb, errGo := strconv.ParseUint(strings.TrimPrefix(config.Color, "#"), 16, 32)
+		if errGo != nil || len(strings.TrimPrefix(config.Color, "#")) != 6 {
+			return nil, errors.New("stinger colors must be 6 hex digits").With("cue", config.Cue).With("color", config.Color).With("stack", stack.Trace().TrimRuntime())
+		}
+		if config.Duration < 0 {
+			return nil, errors.New("the stinger duration cannot be negative").With("cue", config.Cue).With("duration", config.Duration).With("stack", stack.Trace().TrimRuntime())
+		}
+		if config.Level < 0 || config.Level > 1 {
+			return nil, errors.New("the stinger level must be from 0 to 1").With("cue", config.Cue).With("level", config.Level).With("stack", stack.Trace().TrimRuntime())
+		}
+		if config.Flashes < 0 || config.Flashes > maxStingerFlashes {
+			return nil, errors.New("the stinger flashes must be from 1 to 10").With("cue", config.Cue).With("flashes", config.Flashes).With("stack", stack.Trace().TrimRuntime())
+		}
+		if config.Duration == 0 {
+			config.Duration = 500 * time.Millisecond
+		}
+		if config.Level == 0 {
+			config.Level = 1
+		}
+		if config.Flashes == 0 {
+			config.Flashes = 1
+		}
+		stingers.stingers[config.Cue] = stinger{
+			cue: Cue{
+				Color:    color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xFF},
+				Duration: config.Duration,
+				Level:    config.Level,
+			},
+			flashes: config.Flashes,
+		}
+	}
+	return stingers, nil
+}
+
+// update records the status of the displayed portal and returns the stingers of
+// the audio cues that were not reported by its previous status.  A change of the
+// displayed portal plays no stingers
+//
+func (stingers *Stingers) update(status *model.Status) (cues []string, started []stinger) {
+	stingers.Lock()
+	defer stingers.Unlock()
+
+	playing := make(map[string]bool, len(status.AudioCues))
+	for _, cue := range status.AudioCues {
+		playing[cue] = true
+	}
+	isSame := stingers.title == status.Title
+	last := stingers.playing
+	stingers.title = status.Title
+	stingers.playing = playing
+	if !isSame {
+		return nil, nil
+	}
+
+	for _, cue := range status.AudioCues {
+		if last[cue] {
+			continue
+		}
+		// Each cue is played once even when the status lists it more than once
+		last[cue] = true
+		if s, isPresent := stingers.stingers[cue]; isPresent {
+			cues = append(cues, cue)
+			started = append(started, s)
+		}
+	}
+	return cues, started
+}
+
+// Play triggers the stingers of the audio cues newly reported in the status of the
+// displayed portal, the flashes of a stinger following one another
+//
+func (stingers *Stingers) Play(fc *FadeCandy, status *model.Status, now time.Time) {
+	cues, started := stingers.update(status)
+	for i, s := range started {
+		fc.Trigger(s.cue)
+		for flash := 1; flash < s.flashes; flash++ {
+			cue := s.cue
+			time.AfterFunc(time.Duration(flash)*cue.Duration, func() { fc.Trigger(cue) })
+		}
+		bus.Publish(TopicEvents, Event{Time: now, Pipeline: stingers.pipeline, Portal: status.Title, Kind: "stinger",
+			Detail: fmt.Sprintf("%s, %d flashes", cues[i], s.flashes)})
+	}
+}
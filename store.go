@@ -0,0 +1,386 @@
+package mawt
+
+// This module implements the optional persistent store of events, errors and
+// coarse metrics used for analysis after an event, for example how long each
+// faction held the portal and how often the fadecandy server dropped out.  The
+// store is a directory of daily journals of JSON records so that it needs no
+// external infrastructure, and no database library needs to be vendored.
+// Journals older than the retention period are removed, as are the oldest
+// journals once the store exceeds its size limit.  Journals cover the days of the
+// timezone of the store and are named using the day and its offset from UTC, the
+// journals of earlier releases named using only the day covering the days of UTC
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	storePrefix  = "mawt-"
+	storeSuffix  = ".jsonl"
+	storeDay     = "2006-01-02"      // The journals of earlier releases, named using the day in UTC
+	storeZoneDay = "2006-01-02-0700" // The day along with the offset from UTC at its start
+
+	// storeDaySpan is the longest time a journal can cover, allowing for the days
+	// lengthened by the end of daylight saving
+	storeDaySpan = 25 * time.Hour
+)
+
+// StoreMetrics is a periodic sample of the health of a pipeline
+//
+type StoreMetrics struct {
+	OPCOffline         float64 `json:"opcOffline"` // Seconds the fadecandy server has been failing, 0 when healthy
+	PortalsUnreachable bool    `json:"portalsUnreachable"`
+	RecentPanics       int     `json:"recentPanics"`
+	Frames             uint64  `json:"frames"`   // Frames sent since the gateway started
+	Interval           float64 `json:"interval"` // Seconds between samples
+}
+
+// StoreRecord is a single entry in the store
+//
+type StoreRecord struct {
+	Time     time.Time     `json:"time"`
+	Kind     string        `json:"kind"` // event, error or metrics
+	Pipeline string        `json:"pipeline,omitempty"`
+	Event    *Event        `json:"event,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Metrics  *StoreMetrics `json:"metrics,omitempty"`
+}
+
+// StoreSummary is the analysis of the records for a period
+//
+type StoreSummary struct {
+	From     time.Time                    `json:"from"`
+	Until    time.Time                    `json:"until"`
+	Holds    map[string]map[string]string `json:"holds"`    // The time each faction held the home portal, by pipeline
+	OPCDrops map[string]int               `json:"opcDrops"` // The opc-dropped events, the times the fadecandy server dropped out, by pipeline
+	Events   map[string]int               `json:"events"`   // The number of events of each kind
+	Errors   int                          `json:"errors"`
+}
+
+// Store is a directory of daily journals
+//
+type Store struct {
+	dir       string
+	retention time.Duration
+	maxBytes  int64
+	loc       *time.Location // The timezone whose days the journals cover
+
+	day  string
+	file *os.File
+	sync.Mutex
+}
+
+// OpenStore opens, creating if needed, the store in a directory, the journals being
+// started at midnight in the supplied timezone.  Journals older than the retention
+// period, and the oldest journals beyond the size limit, are removed, a zero
+// retention or size disabling that limit
+//
+func OpenStore(dir string, retention time.Duration, maxBytes int64, loc *time.Location) (store *Store, err errors.Error) {
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return nil, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	store = &Store{
+		dir:       dir,
+		retention: retention,
+		maxBytes:  maxBytes,
+		loc:       loc,
+	}
+	if err = store.Prune(time.Now()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// journal returns the name of the journal covering a time
+//
+func (store *Store) journal(tm time.Time) (name string) {
+	year, month, day := tm.In(store.loc).Date()
+	return storePrefix + time.Date(year, month, day, 0, 0, 0, 0, store.loc).Format(storeZoneDay) + storeSuffix
+}
+
+// journalStart returns the time at which the day covered by a journal starts, for
+// both the journals named with an offset and the UTC journals of earlier releases
+//
+func journalStart(name string) (start time.Time, err errors.Error) {
+	day := strings.TrimSuffix(strings.TrimPrefix(name, storePrefix), storeSuffix)
+	layout := storeZoneDay
+	if len(day) == len(storeDay) {
+		layout = storeDay
+	}
+	start, errGo := time.Parse(layout, day)
+	if errGo != nil {
+		return start, errors.Wrap(errGo).With("journal", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	return start, nil
+}
+
+// journals returns the names of the journals in the store, oldest first
+//
+func (store *Store) journals() (names []string, err errors.Error) {
+	infos, errGo := ioutil.ReadDir(store.dir)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("dir", store.dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	names = []string{}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), storePrefix) && strings.HasSuffix(info.Name(), storeSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Prune applies the retention and size limits, the journal being written is retained
+//
+func (store *Store) Prune(now time.Time) (err errors.Error) {
+	store.Lock()
+	defer store.Unlock()
+
+	names, err := store.journals()
+	if err != nil {
+		return err
+	}
+
+	current := store.journal(now)
+	sizes := map[string]int64{}
+	total := int64(0)
+	for _, name := range names {
+		if info, errGo := os.Stat(filepath.Join(store.dir, name)); errGo == nil {
+			sizes[name] = info.Size()
+			total += info.Size()
+		}
+	}
+
+	for _, name := range names {
+		if name == current {
+			break
+		}
+		expired := false
+		if store.retention > 0 {
+			start, err := journalStart(name)
+			expired = err == nil && now.Sub(start.Add(storeDaySpan)) > store.retention
+		}
+		if !expired && (store.maxBytes == 0 || total <= store.maxBytes) {
+			break
+		}
+		if errGo := os.Remove(filepath.Join(store.dir, name)); errGo != nil {
+			return errors.Wrap(errGo).With("journal", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		total -= sizes[name]
+	}
+	return nil
+}
+
+// Append adds a record to the journal for the day of the record
+//
+func (store *Store) Append(record StoreRecord) (err errors.Error) {
+	data, errGo := json.Marshal(record)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	day := store.journal(record.Time)
+	if store.file == nil || day != store.day {
+		if store.file != nil {
+			store.file.Close()
+		}
+		fn := filepath.Join(store.dir, day)
+		if store.file, errGo = os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); errGo != nil {
+			store.file = nil
+			return errors.Wrap(errGo).With("journal", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		store.day = day
+	}
+	if _, errGo = store.file.Write(append(data, '\n')); errGo != nil {
+		return errors.Wrap(errGo).With("dir", store.dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Query returns the records of a kind, or of all kinds when the kind is empty,
+// between two times.  A zero until time returns all records after the since time
+//
+func (store *Store) Query(kind string, since time.Time, until time.Time) (records []StoreRecord, err errors.Error) {
+	store.Lock()
+	defer store.Unlock()
+
+	names, err := store.journals()
+	if err != nil {
+		return nil, err
+	}
+
+	records = []StoreRecord{}
+	for _, name := range names {
+		// Journals wholly outside the period are skipped without being read
+		if start, err := journalStart(name); err == nil {
+			if (!since.IsZero() && !start.Add(storeDaySpan).After(since)) || (!until.IsZero() && start.After(until)) {
+				continue
+			}
+		}
+		f, errGo := os.Open(filepath.Join(store.dir, name))
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("journal", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			record := StoreRecord{}
+			// A record torn by a power loss is skipped rather than failing the query
+			if errGo := json.Unmarshal(scanner.Bytes(), &record); errGo != nil {
+				continue
+			}
+			if record.Time.Before(since) || (!until.IsZero() && record.Time.After(until)) {
+				continue
+			}
+			if len(kind) != 0 && record.Kind != kind {
+				continue
+			}
+			records = append(records, record)
+		}
+		f.Close()
+	}
+	// The journals of earlier releases overlap those named with an offset
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// Summarize analyses the records of a period, records are expected in time order
+//
+func Summarize(records []StoreRecord, from time.Time, until time.Time) (summary *StoreSummary) {
+	summary = &StoreSummary{
+		From:     from,
+		Until:    until,
+		Holds:    map[string]map[string]string{},
+		OPCDrops: map[string]int{},
+		Events:   map[string]int{},
+	}
+
+	holding := map[string]hold{}
+	held := map[string]map[string]time.Duration{}
+	credit := func(pipeline string, h hold, end time.Time) {
+		if len(h.faction) == 0 {
+			return
+		}
+		if held[pipeline] == nil {
+			held[pipeline] = map[string]time.Duration{}
+		}
+		held[pipeline][h.faction] += end.Sub(h.start)
+	}
+
+	for _, record := range records {
+		switch record.Kind {
+		case "event":
+			if record.Event == nil {
+				continue
+			}
+			summary.Events[record.Event.Kind]++
+			if record.Event.Kind == "opc-dropped" {
+				summary.OPCDrops[record.Pipeline]++
+			}
+			if !record.Event.Home {
+				continue
+			}
+			if faction := record.Event.Faction; len(faction) != 0 {
+				credit(record.Pipeline, holding[record.Pipeline], record.Time)
+				holding[record.Pipeline] = hold{faction: faction, start: record.Time}
+			}
+		case "error":
+			summary.Errors++
+		}
+	}
+	for pipeline, h := range holding {
+		credit(pipeline, h, until)
+	}
+
+	for pipeline, factions := range held {
+		summary.Holds[pipeline] = map[string]string{}
+		for faction, duration := range factions {
+			summary.Holds[pipeline][faction] = duration.Round(time.Second).String()
+		}
+	}
+	return summary
+}
+
+// Record subscribes the store to the events and errors of the process, and samples
+// the health of the gateways at the supplied interval, until quitC is closed
+//
+func (store *Store) Record(gws []*Gateway, interval time.Duration, errorC chan<- errors.Error, quitC <-chan struct{}) {
+	events := SubscribeEvents(SubscribeOptions{Name: "store", Depth: 100})
+	errs := SubscribeErrors(SubscribeOptions{Name: "store", Depth: 100})
+
+	go func() {
+		defer track("store")()
+		defer events.Close()
+		defer errs.Close()
+
+		sample := time.NewTicker(interval)
+		defer sample.Stop()
+		prune := time.NewTicker(time.Hour)
+		defer prune.Stop()
+
+		// Only the first of a run of failures to write is reported, as the
+		// report would itself be an error to be written
+		failing := false
+		write := func(record StoreRecord) {
+			err := store.Append(record)
+			if err != nil && !failing {
+				sendErr(errorC, err)
+			}
+			failing = err != nil
+		}
+
+		for {
+			select {
+			case msg := <-events.C:
+				event := msg.(Event)
+				write(StoreRecord{Time: event.Time, Kind: "event", Pipeline: event.Pipeline, Event: &event})
+			case msg := <-errs.C:
+				if err, isOK := msg.(errors.Error); isOK && err != nil {
+					write(StoreRecord{Time: time.Now(), Kind: "error", Error: err.Error()})
+				}
+			case tm := <-sample.C:
+				for _, gw := range gws {
+					write(StoreRecord{
+						Time:     tm,
+						Kind:     "metrics",
+						Pipeline: gw.Name,
+						Metrics: &StoreMetrics{
+							OPCOffline:         gw.Health.OPCOffline().Seconds(),
+							PortalsUnreachable: gw.Health.PortalsUnreachable(3 * interval),
+							RecentPanics:       gw.Health.RecentPanics(panicWindow),
+							Frames:             gw.Health.FramesSent(),
+							Interval:           interval.Seconds(),
+						},
+					})
+				}
+			case tm := <-prune.C:
+				if err := store.Prune(tm); err != nil {
+					sendErr(errorC, err)
+				}
+			case <-quitC:
+				store.Lock()
+				if store.file != nil {
+					store.file.Close()
+					store.file = nil
+				}
+				store.Unlock()
+				return
+			}
+		}
+	}()
+}
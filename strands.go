@@ -0,0 +1,217 @@
+package mawt
+
+// This module contains the mapping of the logical strands rendered by the
+// animations onto the physical strands attached to the fadecandy devices.
+// A logical strand can be spread across several physical strands when the
+// wiring of a path is fragmented, or occupy a portion of a physical strand
+// that is shared with other logical strands
+
+import (
+	"image/color"
+	"sort"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// Segment is a run of pixels on a physical strand
+//
+type Segment struct {
+	Channel int `yaml:"channel" json:"channel"` // The OPC channel of the physical strand
+	Offset  int `yaml:"offset" json:"offset"`   // The first pixel on the physical strand that is used
+	Length  int `yaml:"length" json:"length"`   // The number of pixels used, 0 uses all remaining pixels of the logical strand
+}
+
+// StrandMapping places a logical strand onto one or more segments of physical
+// strands, the pixels of the logical strand fill the segments in order.  A logical
+// strand without any segments is not sent
+//
+type StrandMapping struct {
+	Logical  int       `yaml:"logical" json:"logical"` // The OPC channel the animations render the logical strand to
+	Segments []Segment `yaml:"segments" json:"segments"`
+}
+
+// StrandMap is the validated set of strand mappings indexed by the logical channel,
+// logical strands that are not present are sent to their own channel unchanged
+//
+type StrandMap map[int][]Segment
+
+// StrandScratch holds the working state of ApplyInto, indexed by the OPC channel of
+// the physical strands.  It is kept by the caller from frame to frame so that the
+// strands of a frame are mapped without allocating
+//
+type StrandScratch struct {
+	used    [256]bool
+	lengths [256]int
+	pixels  [256][]color.RGBA
+}
+
+// NewStrandMap validates the strand mappings and indexes them
+//
+func NewStrandMap(mappings []StrandMapping) (strands StrandMap, err errors.Error) {
+	strands = StrandMap{}
+	for _, mapping := range mappings {
+		if mapping.Logical < 1 || mapping.Logical > 255 {
+			return nil, errors.New("logical strands must use channels 1 to 255").With("logical", mapping.Logical).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, isPresent := strands[mapping.Logical]; isPresent {
+			return nil, errors.New("logical strand mapped more than once").With("logical", mapping.Logical).With("stack", stack.Trace().TrimRuntime())
+		}
+		for i, segment := range mapping.Segments {
+			if segment.Channel < 1 || segment.Channel > 255 {
+				return nil, errors.New("physical strands must use channels 1 to 255").With("logical", mapping.Logical).With("channel", segment.Channel).With("stack", stack.Trace().TrimRuntime())
+			}
+			if segment.Offset < 0 || segment.Length < 0 {
+				return nil, errors.New("segment offsets and lengths cannot be negative").With("logical", mapping.Logical).With("channel", segment.Channel).With("stack", stack.Trace().TrimRuntime())
+			}
+			if segment.Length == 0 && i != len(mapping.Segments)-1 {
+				return nil, errors.New("only the last segment of a logical strand can omit its length").With("logical", mapping.Logical).With("channel", segment.Channel).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		strands[mapping.Logical] = mapping.Segments
+	}
+	return strands, nil
+}
+
+// Apply converts a frame of logical strands into the physical strands that are sent
+// to the fadecandy server, ordered by channel.  Pixels of physical strands that are
+// not covered by any segment are left black
+//
+func (strands StrandMap) Apply(frame []animationModel.ChannelData) (physical []animationModel.ChannelData) {
+	return strands.ApplyInto(nil, frame, &StrandScratch{})
+}
+
+// ApplyInto converts a frame of logical strands into physical strands as Apply does,
+// filling the strands of the physical frame supplied, which are reused from frame to
+// frame and grown when too small, using the scratch state supplied
+//
+func (strands StrandMap) ApplyInto(physical []animationModel.ChannelData, frame []animationModel.ChannelData, scratch *StrandScratch) (applied []animationModel.ChannelData) {
+	if len(strands) == 0 {
+		return frame
+	}
+
+	// The length of each physical strand is found before any pixels are placed so
+	// that its buffer is only sized once
+	used, lengths, pixels := &scratch.used, &scratch.lengths, &scratch.pixels
+	for channel := range used {
+		used[channel] = false
+		lengths[channel] = 0
+	}
+	grow := func(channel int, need int) {
+		if !used[channel] || need > lengths[channel] {
+			used[channel] = true
+			lengths[channel] = need
+		}
+	}
+	for _, logical := range frame {
+		segments, isPresent := strands[int(logical.ChannelNum)]
+		if !isPresent {
+			grow(int(logical.ChannelNum), len(logical.Data))
+			continue
+		}
+		remaining := len(logical.Data)
+		for _, segment := range segments {
+			if remaining == 0 {
+				break
+			}
+			length := segment.Length
+			if length == 0 || length > remaining {
+				length = remaining
+			}
+			grow(segment.Channel, segment.Offset+length)
+			remaining -= length
+		}
+	}
+
+	// The physical strands are ordered by channel by visiting the channels in turn
+	count := 0
+	for channel := range used {
+		if used[channel] {
+			count++
+		}
+	}
+	applied = resizeFrame(physical, count)
+	i := 0
+	for channel := range used {
+		pixels[channel] = nil
+		if !used[channel] {
+			continue
+		}
+		data := resizeStrand(applied[i].Data, lengths[channel])
+		for j := range data {
+			data[j] = color.RGBA{}
+		}
+		applied[i] = animationModel.ChannelData{ChannelNum: animationModel.OpcChannel(channel), Data: data}
+		pixels[channel] = data
+		i++
+	}
+
+	// Logical strands without a mapping are placed first so that any segments
+	// sharing their physical strand take precedence
+	for _, logical := range frame {
+		if _, isPresent := strands[int(logical.ChannelNum)]; !isPresent {
+			copy(pixels[int(logical.ChannelNum)], logical.Data)
+		}
+	}
+	for _, logical := range frame {
+		segments, isPresent := strands[int(logical.ChannelNum)]
+		if !isPresent {
+			continue
+		}
+		data := logical.Data
+		for _, segment := range segments {
+			if len(data) == 0 {
+				break
+			}
+			length := segment.Length
+			if length == 0 || length > len(data) {
+				length = len(data)
+			}
+			copy(pixels[segment.Channel][segment.Offset:], data[:length])
+			data = data[length:]
+		}
+	}
+	return applied
+}
+
+// Mappings returns the strand mappings ordered by their logical channel
+//
+func (strands StrandMap) Mappings() (mappings []StrandMapping) {
+	logicals := make([]int, 0, len(strands))
+	for logical := range strands {
+		logicals = append(logicals, logical)
+	}
+	sort.Ints(logicals)
+
+	mappings = make([]StrandMapping, 0, len(logicals))
+	for _, logical := range logicals {
+		mappings = append(mappings, StrandMapping{Logical: logical, Segments: strands[logical]})
+	}
+	return mappings
+}
+
+// With returns a copy of the strand map with a mapping added or replaced, the
+// original map is unchanged so that it can continue to be used by the renderer
+//
+func (strands StrandMap) With(mapping StrandMapping) (updated StrandMap, err errors.Error) {
+	mappings := []StrandMapping{}
+	for _, existing := range strands.Mappings() {
+		if existing.Logical != mapping.Logical {
+			mappings = append(mappings, existing)
+		}
+	}
+	return NewStrandMap(append(mappings, mapping))
+}
+
+// Without returns a copy of the strand map with the mapping of a logical strand removed
+//
+func (strands StrandMap) Without(logical int) (updated StrandMap) {
+	updated = make(StrandMap, len(strands))
+	for existing, segments := range strands {
+		if existing != logical {
+			updated[existing] = segments
+		}
+	}
+	return updated
+}
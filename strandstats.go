@@ -0,0 +1,129 @@
+package mawt
+
+// This module tracks the frames sent to each physical strand of the fadecandy
+// server, counting the sends, how long the last one took and how many failed.
+// Aggregate errors say that something is wrong, the per strand counts point
+// the operator at the cable or board that is misbehaving
+
+import (
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/karlmutch/errors"
+)
+
+type strandStat struct {
+	frames    uint64
+	errors    uint64
+	last      time.Duration // The time taken by the last send
+	max       time.Duration
+	sent      time.Time // When the last successful send completed
+	lastError string
+	failed    time.Time // When the last send failed
+}
+
+// StrandStats tracks the sends to each of the physical strands of a pipeline
+//
+type StrandStats struct {
+	strands map[animationModel.OpcChannel]*strandStat
+	sync.Mutex
+}
+
+// StrandReport summarizes the sends to one physical strand, times are in milliseconds
+//
+type StrandReport struct {
+	Frames    uint64    `json:"frames"`
+	Errors    uint64    `json:"errors"`
+	LastMs    float64   `json:"lastMs"`
+	MaxMs     float64   `json:"maxMs"`
+	LastSent  time.Time `json:"lastSent"`
+	LastError string    `json:"lastError,omitempty"`
+	Failed    time.Time `json:"failed"`
+}
+
+// NewStrandStats creates a tracker with no strands
+//
+func NewStrandStats() (stats *StrandStats) {
+	return &StrandStats{strands: map[animationModel.OpcChannel]*strandStat{}}
+}
+
+// Record adds the result of sending a frame to a strand
+//
+func (stats *StrandStats) Record(channel animationModel.OpcChannel, elapsed time.Duration, err errors.Error, now time.Time) {
+	if stats == nil {
+		return
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+
+	stat, isPresent := stats.strands[channel]
+	if !isPresent {
+		stat = &strandStat{}
+		stats.strands[channel] = stat
+	}
+	stat.frames++
+	stat.last = elapsed
+	if elapsed > stat.max {
+		stat.max = elapsed
+	}
+	if err != nil {
+		stat.errors++
+		stat.lastError = err.Error()
+		stat.failed = now
+		return
+	}
+	stat.sent = now
+}
+
+// report summarizes the statistics of a strand
+//
+func (stat *strandStat) report() (report StrandReport) {
+	ms := func(duration time.Duration) float64 {
+		return float64(duration) / float64(time.Millisecond)
+	}
+	return StrandReport{
+		Frames:    stat.frames,
+		Errors:    stat.errors,
+		LastMs:    ms(stat.last),
+		MaxMs:     ms(stat.max),
+		LastSent:  stat.sent,
+		LastError: stat.lastError,
+		Failed:    stat.failed,
+	}
+}
+
+// Report returns the send summaries indexed by the OPC channel of the strand
+//
+func (stats *StrandStats) Report() (report map[int]StrandReport) {
+	report = map[int]StrandReport{}
+	if stats == nil {
+		return report
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+
+	for channel, stat := range stats.strands {
+		report[int(channel)] = stat.report()
+	}
+	return report
+}
+
+// Strand returns the summary for a single strand, false when nothing has been sent to it
+//
+func (stats *StrandStats) Strand(channel animationModel.OpcChannel) (report StrandReport, isPresent bool) {
+	if stats == nil {
+		return report, false
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+
+	stat, isPresent := stats.strands[channel]
+	if !isPresent {
+		return report, false
+	}
+	return stat.report(), true
+}
@@ -0,0 +1,92 @@
+package mawt
+
+// This module implements the subscription of embedding programs to the frames
+// rendered by a pipeline, so that they can be post-processed or forwarded, for
+// example to a projection mapping system, without changes to the render loop.
+// Each subscriber receives its own copies of the physical strands exactly as they
+// are sent to the fadecandy server, optionally narrowed to a single strand.  A
+// subscriber that falls behind misses frames rather than holding up the render
+// loop
+
+import (
+	"sync"
+	"sync/atomic"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+)
+
+const (
+	frameSubscriptionDepth = 4
+)
+
+// FrameSubscription delivers copies of the frames of a pipeline on C until it is
+// closed, after which C is closed
+//
+type FrameSubscription struct {
+	C <-chan []animationModel.ChannelData
+
+	universe animationModel.OpcChannel // The physical strand delivered, 0 for all of them
+	sub      *Subscription
+	dropped  uint64 // Frames missed as the subscriber was not receiving them, accessed atomically
+	doneC    chan struct{}
+	once     sync.Once
+}
+
+// SubscribeFrames returns a subscription to the frames sent to the fadecandy server,
+// containing only the physical strand, or OPC channel, of the universe, or every
+// strand when the universe is 0.  The frames received belong to the subscriber
+//
+func (gw *Gateway) SubscribeFrames(universe int) (frames *FrameSubscription) {
+	frameC := make(chan []animationModel.ChannelData, frameSubscriptionDepth)
+	frames = &FrameSubscription{
+		C:        frameC,
+		universe: animationModel.OpcChannel(universe),
+		sub:      gw.Broker.Subscribe(TopicFrames, SubscribeOptions{Name: "frame subscription", Depth: frameSubscriptionDepth, Policy: LatestWins}),
+		doneC:    make(chan struct{}),
+	}
+
+	go frames.forward(frameC)
+	return frames
+}
+
+// forward copies the frames published by the pipeline to the subscriber
+//
+func (frames *FrameSubscription) forward(frameC chan<- []animationModel.ChannelData) {
+	defer close(frameC)
+
+	for msg := range frames.sub.C {
+		published := msg.([]animationModel.ChannelData)
+		frame := make([]animationModel.ChannelData, 0, len(published))
+		for _, channelData := range published {
+			if frames.universe == 0 || channelData.ChannelNum == frames.universe {
+				frame = append(frame, channelData)
+			}
+		}
+		if len(frame) == 0 {
+			continue
+		}
+
+		select {
+		case frameC <- copyFrame(frame):
+		case <-frames.doneC:
+			return
+		default:
+			atomic.AddUint64(&frames.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of frames the subscriber missed
+//
+func (frames *FrameSubscription) Dropped() (dropped uint64) {
+	return atomic.LoadUint64(&frames.dropped) + frames.sub.Dropped()
+}
+
+// Close ends the subscription, closing it more than once has no effect
+//
+func (frames *FrameSubscription) Close() {
+	frames.once.Do(func() {
+		close(frames.doneC)
+		frames.sub.Close()
+	})
+}
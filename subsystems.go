@@ -0,0 +1,107 @@
+package mawt
+
+// This module tracks the goroutines of the long running subsystems, such as the
+// render loops, pollers and mirrors, so that a shutdown can be checked for
+// subsystems that failed to exit once they were told to stop.  Subsystems still
+// running after the time allowed are reported by name, along with the stacks of
+// every goroutine still running code from the mawt packages
+
+import (
+	"bytes"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+type subsystemTracker struct {
+	wg      sync.WaitGroup
+	running map[string]int // The number of goroutines of each subsystem that have yet to exit
+	sync.Mutex
+}
+
+var (
+	subsystems = &subsystemTracker{running: map[string]int{}}
+
+	// mawtFrame begins the stack frames of functions within the mawt packages
+	mawtFrame = []byte("\ngithub.com/TeamNorCal/mawt")
+)
+
+// track records a goroutine of a subsystem as running, the function returned is
+// deferred by the goroutine to record that it has exited
+//
+func track(name string) (done func()) {
+	subsystems.Lock()
+	subsystems.running[name]++
+	subsystems.wg.Add(1)
+	subsystems.Unlock()
+
+	return func() {
+		subsystems.Lock()
+		if subsystems.running[name]--; subsystems.running[name] <= 0 {
+			delete(subsystems.running, name)
+		}
+		subsystems.Unlock()
+		subsystems.wg.Done()
+	}
+}
+
+// LeakReport describes the subsystems that did not exit during a shutdown
+//
+type LeakReport struct {
+	Waited     time.Duration  `json:"waited"`
+	Subsystems map[string]int `json:"subsystems"` // The goroutines of each subsystem still running
+	Goroutines []string       `json:"goroutines"` // The stacks of the goroutines still running mawt code
+}
+
+// WaitSubsystems waits for the tracked subsystems to exit, for no longer than the
+// timeout, returning nil when they all exited or a report of those still running
+//
+func WaitSubsystems(timeout time.Duration) (report *LeakReport) {
+	start := time.Now()
+	doneC := make(chan struct{})
+	go func() {
+		subsystems.wg.Wait()
+		close(doneC)
+	}()
+
+	select {
+	case <-doneC:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	report = &LeakReport{Waited: time.Since(start), Subsystems: map[string]int{}, Goroutines: leakedGoroutines()}
+	subsystems.Lock()
+	for name, count := range subsystems.running {
+		report.Subsystems[name] = count
+	}
+	subsystems.Unlock()
+	return report
+}
+
+// leakedGoroutines returns the stacks of the goroutines running code from the mawt
+// packages, other than the caller and the goroutine waiting on the subsystems
+//
+func leakedGoroutines() (stacks []string) {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks = []string{}
+	// The first goroutine dumped is the caller
+	for _, goroutine := range bytes.Split(buf, []byte("\n\n"))[1:] {
+		if !bytes.Contains(goroutine, mawtFrame) || bytes.Contains(goroutine, []byte("mawt.WaitSubsystems.func")) {
+			continue
+		}
+		stacks = append(stacks, string(goroutine))
+	}
+	sort.Strings(stacks)
+	return stacks
+}
@@ -1,15 +1,16 @@
 package mawt
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/TeamNorCal/mawt/model"
+	tecthulhuClient "github.com/TeamNorCal/mawt/tecthulhu"
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 )
@@ -19,158 +20,102 @@ import (
 // like capability, however the original documentation appears
 // to indicate a serial like communications peripheral
 //
-// The following json shows example output from a tecthulhu used
-// for the 2018 season
-//
-//{
-//    "result": {
-//        "controllingFaction": "Resistance",
-//        "level": 6,
-//        "health": 99,
-//        "owner": "puntila",
-//        "title": "Crab Mosaic",
-//        "description": null,
-//        "coverImageUrl": "http://lh3.ggpht.com/rF4RNr3xmVnLep_3WmJPCcnzBtKl3z74vc2mlaHpF0K9bVieZb_61w0fygAGUCduYzB47sRXbcajUk8-5bxmVg",
-//        "attribution": "PennIsMightier",
-//        "mods": [
-//            {
-//                "type": "Portal Shield",
-//                "rarity": "Common",
-//                "owner": "dorkus",
-//                "slot": 1
-//            },
-//            {
-//                "type": "Turret",
-//                "rarity": "Rare",
-//                "owner": "slackfarmer",
-//                "slot": 3
-//            },
-//            {
-//                "type": "Portal Shield",
-//                "rarity": "Common",
-//                "owner": "dorkus",
-//                "slot": 4
-//            }
-//        ],
-//        "resonators": [
-//            {
-//                "level": 6,
-//                "health": 98,
-//                "owner": "NumberSix",
-//                "position": "E"
-//            },
-//            {
-//                "level": 7,
-//                "health": 100,
-//                "owner": "NumberSix",
-//                "position": "NE"
-//            },
-//            {
-//                "level": 8,
-//                "health": 100,
-//                "owner": "NumberSix",
-//                "position": "N"
-//            },
-//            {
-//                "level": 6,
-//                "health": 100,
-//                "owner": "NumberSix",
-//                "position": "NW"
-//            },
-//            {
-//                "level": 7,
-//                "health": 100,
-//                "owner": "dorkus",
-//                "position": "W"
-//            },
-//            {
-//                "level": 8,
-//                "health": 99,
-//                "owner": "dorkus",
-//                "position": "SW"
-//            },
-//            {
-//                "level": 5,
-//                "health": 99,
-//                "owner": "NumberSix",
-//                "position": "S"
-//            },
-//            {
-//                "level": 5,
-//                "health": 95,
-//                "owner": "NumberSix",
-//                "position": "SE"
-//            }
-//        ]
-//    },
-//    "message": null,
-//    "code": "OK",
-//    "fieldErrors": null
-//}
-//
+// The status document and the client used to retrieve it are in the tecthulhu
+// package, this module adds the retry, circuit breaker and quarantine policies
+// applied by the gateway
 
-type tResonator struct {
-	Position string `json:"position"`
-	Level    int    `json:"level"`
-	Health   int    `json:"health"`
-	Owner    string `json:"owner"`
+type PortalMon interface {
+	Run(quitC <-chan struct{})
 }
 
-type tMod struct {
-	Type   string `json:"type"`
-	Rarity string `json:"rarity"`
-	Owner  string `json:"owner"`
-	Slot   int    `json:"slot"`
-}
+type tecthulhu struct {
+	url    url.URL
+	home   bool
+	client *tecthulhuClient.Client
+	broker *Broker // The pipeline broker the portal statuses are published to
+	errorC chan<- errors.Error
 
-type tStatus struct {
-	Title      string       `json:"title"`
-	Owner      string       `json:"owner"`
-	Level      int          `json:"level"`
-	Health     int          `json:"health"`
-	Faction    string       `json:"controllingFaction"`
-	Mods       []tMod       `json:"mods"`
-	Resonators []tResonator `json:"resonators"`
+	pipeline string  // The name of the pipeline the portal feeds, used when publishing events
+	health   *Health // Tracks the reachability of the portal
+
+	policy    PollPolicy
+	failures  int       // Consecutive failed status checks
+	openUntil time.Time // When the circuit breaker is open the time at which a trial check will be made, otherwise zero
+
+	quarantined bool   // Set while statuses are being held back as untrustworthy
+	clean       int    // Consecutive believable statuses seen while quarantined
+	lastClamped string // The values clamped in the last status, used to only report changes
+
+	last     *model.Status // The last status published, used to detect activity at the portal
+	revision uint64        // Incremented each time the status decoded differs from the last one
+	interval time.Duration // The time until the next status check when polling adaptively
+
+	sync.Mutex // Guards home, which can be changed at runtime
 }
 
-type tPortalStatus struct {
-	State tStatus `json:"result"`
-	Code  string  `json:"code"`
+func NewTecthulu(url url.URL, home bool, health *Health, broker *Broker, errorC chan<- errors.Error) (tec *tecthulhu) {
+	health.portalAdded(url.String())
+
+	client := tecthulhuClient.NewClient(url)
+	// Portals addressed using DNS SRV names are resolved on every check
+	// as their addresses are expected to be dynamic
+	client.Resolve = resolveURL
+	client.Filter = corruptBody
+	pollers.configure(client)
+
+	return &tecthulhu{
+		url:    url,
+		home:   home,
+		client: client,
+		broker: broker,
+		errorC: errorC,
+		policy: DefaultConfig().Polling,
+		health: health,
+	}
 }
 
-type PortalMon interface {
-	Run(quitC <-chan struct{})
+// isHome returns true when the portal is the home portal of its pipeline
+//
+func (tec *tecthulhu) isHome() (home bool) {
+	tec.Lock()
+	defer tec.Unlock()
+
+	return tec.home
 }
 
-type tecthulhu struct {
-	url     url.URL
-	home    bool
-	statusC chan<- *model.PortalMsg
-	errorC  chan<- errors.Error
+func (tec *tecthulhu) setHome(home bool) {
+	tec.Lock()
+	defer tec.Unlock()
+
+	tec.home = home
 }
 
-func NewTecthulu(url url.URL, home bool, statusC chan<- *model.PortalMsg, errorC chan<- errors.Error) (tec *tecthulhu) {
-	return &tecthulhu{
-		url:     url,
-		home:    home,
-		statusC: statusC,
-		errorC:  errorC,
-	}
+// SetPolicy replaces the default polling, retry and circuit breaker policy
+//
+func (tec *tecthulhu) SetPolicy(policy PollPolicy) {
+	tec.policy = policy
 }
 
-func (tec *tPortalStatus) status() (state *model.PortalStatus) {
+// portalStatus converts the status reported by a tecthulhu to the canonical format
+// used by the concentrator, which we assume is a reference format for portal
+// data and meta data
+//
+func portalStatus(status *tecthulhuClient.Status) (state *model.PortalStatus) {
 	state = &model.PortalStatus{
 		Status: model.Status{
-			Title:      tec.State.Title,
-			Owner:      tec.State.Owner,
-			Level:      float32(tec.State.Level),
-			Health:     float32(tec.State.Health),
-			Faction:    tec.State.Faction,
-			Mods:       []model.Mod{},
-			Resonators: []model.Resonator{},
+			Title:         status.Title,
+			Description:   status.Description,
+			CoverImageURL: status.CoverImageURL,
+			Owner:         status.Owner,
+			Level:         float32(status.Level),
+			Health:        float32(status.Health),
+			Faction:       status.Faction,
+			Mods:          []model.Mod{},
+			Resonators:    []model.Resonator{},
+			AudioCues:     append([]string{}, status.AudioCues...),
 		},
 	}
-	for _, res := range tec.State.Resonators {
+	for _, res := range status.Resonators {
 		state.Status.Resonators = append(state.Status.Resonators,
 			model.Resonator{
 				Position: res.Position,
@@ -179,8 +124,7 @@ func (tec *tPortalStatus) status() (state *model.PortalStatus) {
 				Owner:    res.Owner,
 			})
 	}
-	state.Status.Faction = string(tec.State.Faction[0])
-	for _, mod := range tec.State.Mods {
+	for _, mod := range status.Mods {
 		newMod := model.Mod{
 			Slot:   float32(mod.Slot),
 			Type:   mod.Type,
@@ -192,55 +136,178 @@ func (tec *tPortalStatus) status() (state *model.PortalStatus) {
 	return state
 }
 
-// checkPortal can be used to extract status information from the portal
+// checkPortal can be used to extract status information from the portal, the
+// check is abandoned when the quitC channel is closed
 //
-func (tec *tecthulhu) checkPortal() (status *model.PortalStatus, err errors.Error) {
+func (tec *tecthulhu) checkPortal(quitC <-chan struct{}) (status *model.PortalStatus, err errors.Error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-quitC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if fault := faultHit(FaultPollDelay); fault != nil {
+		select {
+		case <-time.After(fault.Delay):
+		case <-quitC:
+			return nil, errors.New("status check abandoned").With("url", tec.url.String()).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
 
-	body := []byte{}
+	if !pollers.acquire(quitC) {
+		return nil, errors.New("status check abandoned").With("url", tec.url.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	tecStatus, err := tec.client.Status(ctx)
+	pollers.release()
+	if err != nil {
+		return nil, err
+	}
+	return portalStatus(tecStatus), nil
+}
 
-	switch tec.url.Scheme {
-	case "http":
-		resp, errGo := http.Get(tec.url.String())
-		if errGo != nil {
-			return nil, errors.Wrap(errGo).With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
+// ProbeTecthulhu retrieves a single status from a tecthulhu, for example to check it
+// can be reached before an event, returning the title of its portal.  The optional
+// transform translates a nonstandard status document
+//
+func ProbeTecthulhu(ctx context.Context, u url.URL, transform *TransformConfig) (title string, err errors.Error) {
+	client := tecthulhuClient.NewClient(u)
+	client.Resolve = resolveURL
+	pollers.configure(client)
+	if transform != nil {
+		translation, err := NewTransform(*transform)
+		if err != nil {
+			return "", err
 		}
+		client.Transform = translation.Apply
+	}
 
-		body, errGo = ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if errGo != nil {
-			return nil, errors.Wrap(errGo).With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
+	// Probes share the request slots of the pollers as the self-test probes every
+	// portal at once while the pollers are starting
+	if !pollers.acquire(ctx.Done()) {
+		return "", errors.Wrap(ctx.Err()).With("url", u.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	status, err := client.Status(ctx)
+	pollers.release()
+	if err != nil {
+		return "", err
+	}
+	return status.Title, nil
+}
+
+// checkWithRetries performs a status check, retrying failures using an exponential
+// backoff as directed by the polling policy
+//
+func (tec *tecthulhu) checkWithRetries(quitC <-chan struct{}) (status *model.PortalStatus, err errors.Error) {
+	backoff := tec.policy.BackoffBase
+	for attempt := 0; ; attempt++ {
+		if status, err = tec.checkPortal(quitC); err == nil || attempt >= tec.policy.MaxRetries {
+			return status, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-quitC:
+			return status, err
+		}
+		if backoff *= 2; backoff > tec.policy.BackoffCap {
+			backoff = tec.policy.BackoffCap
 		}
+	}
+}
+
+// breaker updates the circuit breaker after a status check, publishing events when
+// the circuit opens or closes
+//
+func (tec *tecthulhu) breaker(err errors.Error, now time.Time) {
+	trial := !tec.openUntil.IsZero()
 
-	case "serial":
-		errGo := fmt.Errorf("Unknown scheme %s for the tecthulhu device is not yet implemented", tec.url.Scheme)
-		return nil, errors.Wrap(errGo).With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
+	if err == nil {
+		if trial {
+			componentLog(LogPoller).Info("portal reachable again, circuit closed", "url", tec.url.String(), "failures", tec.failures)
+			bus.Publish(TopicEvents, Event{Time: now, Pipeline: tec.pipeline, Portal: tec.url.String(), Home: tec.isHome(), Kind: "circuit-close",
+				Detail: fmt.Sprintf("portal reachable after %d failed checks", tec.failures)})
+		}
+		tec.failures = 0
+		tec.openUntil = time.Time{}
+		return
+	}
 
-	default:
-		errGo := fmt.Errorf("Unknown scheme %s for the tecthulhu device URI", tec.url.Scheme)
-		return nil, errors.Wrap(errGo).With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
+	tec.failures++
+	if tec.policy.BreakerThreshold == 0 {
+		return
 	}
+	if trial || tec.failures >= tec.policy.BreakerThreshold {
+		if !trial {
+			componentLog(LogPoller).Info("portal unreachable, circuit opened", "url", tec.url.String(), "failures", tec.failures, "cooldown", tec.policy.BreakerCooldown.String())
+			bus.Publish(TopicEvents, Event{Time: now, Pipeline: tec.pipeline, Portal: tec.url.String(), Home: tec.isHome(), Kind: "circuit-open",
+				Detail: fmt.Sprintf("%d consecutive failed checks, next trial in %s", tec.failures, tec.policy.BreakerCooldown)})
+		}
+		tec.openUntil = now.Add(tec.policy.BreakerCooldown)
+	}
+}
 
-	// Parse into the tecthulhu specific format and then convert to
-	// the canonical format used by the concentrator which we assume
-	// is a reference format for portal data and meta data
-	//
-	tecStatus := &tPortalStatus{}
+// screen decides whether a sanitized status is passed on to the gateway.  Once an
+// inconsistent status is seen the portal is quarantined, with its statuses being held
+// back until the number of consecutive believable statuses set by the policy are seen
+//
+func (tec *tecthulhu) screen(clamped []string, inconsistent []string, now time.Time) (pass bool) {
+	if detail := strings.Join(clamped, ", "); detail != tec.lastClamped {
+		tec.lastClamped = detail
+		if len(detail) != 0 {
+			bus.Publish(TopicEvents, Event{Time: now, Pipeline: tec.pipeline, Portal: tec.url.String(), Home: tec.isHome(), Kind: "clamped", Detail: detail})
+		}
+	}
+
+	if tec.policy.QuarantineRelease == 0 {
+		return true
+	}
+
+	if len(inconsistent) != 0 {
+		tec.clean = 0
+		if !tec.quarantined {
+			tec.quarantined = true
+			detail := strings.Join(inconsistent, ", ")
+			bus.Publish(TopicEvents, Event{Time: now, Pipeline: tec.pipeline, Portal: tec.url.String(), Home: tec.isHome(), Kind: "quarantined", Detail: detail})
+			sendErr(tec.errorC, errors.New("portal status quarantined").With("url", tec.url.String()).With("problems", detail).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return false
+	}
 
-	errGo := json.Unmarshal(body, &tecStatus)
-	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("url", tec.url).With("body", string(body)).With("stack", stack.Trace().TrimRuntime())
+	if tec.quarantined {
+		tec.clean++
+		if tec.clean < tec.policy.QuarantineRelease {
+			return false
+		}
+		tec.quarantined = false
+		bus.Publish(TopicEvents, Event{Time: now, Pipeline: tec.pipeline, Portal: tec.url.String(), Home: tec.isHome(), Kind: "released",
+			Detail: fmt.Sprintf("%d consecutive believable statuses", tec.clean)})
 	}
-	status = tecStatus.status()
-	return status, err
+	return true
 }
 
-func (tec *tecthulhu) sendStatus() {
+// sendStatus checks the portal and publishes its status, returning true when the
+// status shows the portal changing
+//
+func (tec *tecthulhu) sendStatus(quitC <-chan struct{}) (changed bool) {
 	// Perform a regular status check with the portal
 	// and return the received results  to listeners using
 	// the channel
 	//
 	// Use  a TCP and USB Serial handler function
-	status, err := tec.checkPortal()
+	defer recoverPanic(tec.health, tec.errorC)
+
+	// While the circuit breaker is open no checks are made, until the cooldown
+	// expires and a single trial check is allowed
+	if !tec.openUntil.IsZero() && time.Now().Before(tec.openUntil) {
+		return false
+	}
+
+	status, err := tec.checkWithRetries(quitC)
+	tec.health.portalChecked(tec.url.String(), err)
+	tec.breaker(err, time.Now())
 
 	if err != nil {
 		go func(err errors.Error) {
@@ -250,26 +317,31 @@ func (tec *tecthulhu) sendStatus() {
 				fmt.Fprintf(os.Stderr, "could not send error for portal status update %s\n", err.Error())
 			}
 		}(err)
-		return
+		return false
 	}
 
-	msg := &model.PortalMsg{
-		Status: status.Status,
-		Home:   tec.home,
+	if clamped, inconsistent := sanitizeStatus(&status.Status); !tec.screen(clamped, inconsistent, time.Now()) {
+		return false
 	}
 
-	select {
-	case tec.statusC <- msg:
-	case <-time.After(750 * time.Millisecond):
-		go func() {
-			err := errors.New("portal status dropped").With("url", tec.url).With("stack", stack.Trace().TrimRuntime())
-			select {
-			case tec.errorC <- err:
-			case <-time.After(2 * time.Second):
-				fmt.Fprintf(os.Stderr, "could not send error for portal status update %s\n", err.Error())
-			}
-		}()
+	// The events derived for the history also identify the statuses that show activity
+	changed = tec.last != nil && len(deriveEvents(tec.last, &status.Status, tec.isHome(), time.Now())) != 0
+	if DiffStatus(tec.last, &status.Status) != 0 {
+		tec.revision++
 	}
+	tec.last = status.Status.DeepCopy()
+
+	if log := componentLog(LogPoller); log.IsDebug() {
+		log.Debug("portal status polled", "url", tec.url.String(), "faction", status.Status.Faction, "level", status.Status.Level,
+			"health", status.Status.Health, "revision", tec.revision, "active", changed)
+	}
+	tec.broker.Publish(TopicStatus, &model.PortalMsg{
+		Status:   status.Status,
+		Home:     tec.isHome(),
+		URL:      tec.url.String(),
+		Revision: tec.revision,
+	})
+	return changed
 }
 
 // startPortal listens to a tecthulhu device and returns
@@ -277,13 +349,18 @@ func (tec *tecthulhu) sendStatus() {
 // is associated
 //
 func (tec *tecthulhu) Run(quitC <-chan struct{}) {
+	defer track("tecthulhu poller")()
 
-	refresh := time.Duration(5 * time.Second)
-
+	tec.interval = tec.policy.Interval
+	wait := tec.interval + pollers.offset(tec.policy.Stagger, tec.policy.Interval)
 	for {
 		select {
-		case <-time.After(refresh):
-			tec.sendStatus()
+		case <-time.After(wait):
+			// When adaptive polling is enabled activity at the portal shortens the
+			// interval so a battle is followed closely, quiet periods lengthen it
+			// to reduce the load on the tecthulhu
+			tec.interval = tec.policy.adapt(tec.interval, tec.sendStatus(quitC))
+			wait = tec.interval
 		case <-quitC:
 			return
 		}
@@ -0,0 +1,145 @@
+package tecthulhu
+
+// This module contains the client used to retrieve the status of a portal from
+// its tecthulhu
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// Client retrieves the status of the portal served by a single tecthulhu
+//
+type Client struct {
+	URL url.URL
+
+	// HTTP is the client used for requests, http.DefaultClient when nil
+	HTTP *http.Client
+
+	// Headers are optionally sent with each request, for example an API key
+	// required by a gateway in front of the tecthulhus
+	Headers map[string]string
+
+	// Resolve optionally rewrites the URL before each request, for example to
+	// look up a host that is a DNS SRV name
+	Resolve func(u url.URL) (resolved url.URL, err errors.Error)
+
+	// Filter optionally alters the body of each response before it is decoded, for
+	// example to inject faults when testing
+	Filter func(body []byte) (filtered []byte)
+
+	// Transform optionally translates the body of each response into a status
+	// document before it is decoded, for example to adapt a nonstandard firmware
+	Transform func(ctx context.Context, body []byte) (transformed []byte, err errors.Error)
+}
+
+// NewClient creates a client for the tecthulhu status endpoint at the supplied URL,
+// for example http://10.0.0.5/module/status/json
+//
+func NewClient(u url.URL) (client *Client) {
+	return &Client{URL: u}
+}
+
+// Decode parses the document returned by a tecthulhu
+//
+func Decode(body []byte) (response *Response, err errors.Error) {
+	response = &Response{}
+	if errGo := json.Unmarshal(body, response); errGo != nil {
+		return nil, errors.Wrap(errGo).With("body", string(body)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return response, nil
+}
+
+// Status retrieves the current status of the portal, the request is abandoned
+// if the context is cancelled
+//
+func (client *Client) Status(ctx context.Context) (status *Status, err errors.Error) {
+	target := client.URL
+	if client.Resolve != nil {
+		if target, err = client.Resolve(client.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	switch target.Scheme {
+	case "http", "https":
+	case "serial":
+		return nil, errors.New("the serial scheme for tecthulhu devices is not yet implemented").With("url", client.URL.String()).With("stack", stack.Trace().TrimRuntime())
+	default:
+		return nil, errors.New("unknown scheme for the tecthulhu device URI").With("url", client.URL.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	req, errGo := http.NewRequest(http.MethodGet, target.String(), nil)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", client.URL.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	for header, value := range client.Headers {
+		if http.CanonicalHeaderKey(header) == "Host" {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(header, value)
+	}
+
+	httpClient := client.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, errGo := httpClient.Do(req.WithContext(ctx))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", client.URL.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("tecthulhu status request failed").With("url", client.URL.String()).With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	body, errGo := ioutil.ReadAll(resp.Body)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", client.URL.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if client.Filter != nil {
+		body = client.Filter(body)
+	}
+	if client.Transform != nil {
+		if body, err = client.Transform(ctx, body); err != nil {
+			return nil, err.With("url", client.URL.String())
+		}
+	}
+	response, err := Decode(body)
+	if err != nil {
+		return nil, err.With("url", client.URL.String())
+	}
+	return &response.Result, nil
+}
+
+// Poll retrieves the status of the portal at a regular interval, passing each
+// status, or the error that prevented it being retrieved, to the handler until
+// the context is cancelled
+//
+func (client *Client) Poll(ctx context.Context, interval time.Duration, handler func(status *Status, err errors.Error)) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			status, err := client.Status(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			handler(status, err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
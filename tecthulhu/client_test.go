@@ -0,0 +1,173 @@
+package tecthulhu
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/karlmutch/errors"
+)
+
+const testStatus = `{
+	"result": {
+		"title": "Shaft",
+		"owner": "agent",
+		"level": 7,
+		"health": 86,
+		"controllingFaction": "Enlightened",
+		"mods": [{"type": "Heat Sink", "rarity": "Rare", "owner": "agent", "slot": 1}],
+		"resonators": [{"position": "N", "level": 8, "health": 90, "owner": "agent"}],
+		"audioCues": ["e-capture"]
+	},
+	"message": "",
+	"code": "OK"
+}`
+
+// testClient returns a client for a test server replying using the handler
+//
+func testClient(t *testing.T, handler http.HandlerFunc) (client *Client, server *httptest.Server) {
+	t.Helper()
+
+	server = httptest.NewServer(handler)
+	u, errGo := url.Parse(server.URL + "/module/status/json")
+	if errGo != nil {
+		server.Close()
+		t.Fatal(errGo)
+	}
+	return NewClient(*u), server
+}
+
+func TestClientStatus(t *testing.T) {
+	client, server := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/module/status/json" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Api-Key") != "secret" {
+			http.Error(w, "missing key", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, testStatus)
+	})
+	defer server.Close()
+	client.Headers = map[string]string{"X-Api-Key": "secret"}
+
+	status, err := client.Status(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if status.Title != "Shaft" || status.Level != 7 || status.Health != 86 || status.Faction != "Enlightened" {
+		t.Fatalf("the status was decoded as %+v", *status)
+	}
+	if len(status.Mods) != 1 || status.Mods[0] != (Mod{Type: "Heat Sink", Rarity: "Rare", Owner: "agent", Slot: 1}) {
+		t.Fatalf("the mods were decoded as %+v", status.Mods)
+	}
+	if len(status.Resonators) != 1 || status.Resonators[0] != (Resonator{Position: "N", Level: 8, Health: 90, Owner: "agent"}) {
+		t.Fatalf("the resonators were decoded as %+v", status.Resonators)
+	}
+	if len(status.AudioCues) != 1 || status.AudioCues[0] != "e-capture" {
+		t.Fatalf("the audio cues were decoded as %v", status.AudioCues)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "malformed document",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"result": {"title": "Shaft"`)
+			},
+		},
+		{
+			name: "wrong types",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"result": {"level": "seven"}}`)
+			},
+		},
+		{
+			name: "not found",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := testClient(t, test.handler)
+			defer server.Close()
+
+			if status, err := client.Status(context.Background()); err == nil {
+				t.Fatalf("the status %+v was returned", *status)
+			}
+		})
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	release := make(chan struct{})
+	client, server := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.Status(ctx); err == nil {
+		t.Fatal("a cancelled request returned a status")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the cancelled request took %s to return", elapsed)
+	}
+}
+
+func TestClientPollStops(t *testing.T) {
+	client, server := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testStatus)
+	})
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	polled := make(chan *Status, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Poll(ctx, 10*time.Millisecond, func(status *Status, err errors.Error) {
+			if err != nil {
+				return
+			}
+			select {
+			case polled <- status:
+			default:
+			}
+		})
+	}()
+
+	select {
+	case status := <-polled:
+		if status.Faction != "Enlightened" {
+			t.Fatalf("the polled status was decoded as %+v", *status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no status was polled")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("polling did not stop once the context was cancelled")
+	}
+}
@@ -0,0 +1,137 @@
+package tecthulhu
+
+// This package contains a client for the tecthulhu devices found in Ingress
+// anomaly portals, along with the typed status they report, for tools that
+// need portal data without the LED machinery of mawt.
+//
+// The following json shows example output from a tecthulhu used
+// for the 2018 season
+//
+//{
+//    "result": {
+//        "controllingFaction": "Resistance",
+//        "level": 6,
+//        "health": 99,
+//        "owner": "puntila",
+//        "title": "Crab Mosaic",
+//        "description": null,
+//        "coverImageUrl": "http://lh3.ggpht.com/rF4RNr3xmVnLep_3WmJPCcnzBtKl3z74vc2mlaHpF0K9bVieZb_61w0fygAGUCduYzB47sRXbcajUk8-5bxmVg",
+//        "attribution": "PennIsMightier",
+//        "mods": [
+//            {
+//                "type": "Portal Shield",
+//                "rarity": "Common",
+//                "owner": "dorkus",
+//                "slot": 1
+//            },
+//            {
+//                "type": "Turret",
+//                "rarity": "Rare",
+//                "owner": "slackfarmer",
+//                "slot": 3
+//            },
+//            {
+//                "type": "Portal Shield",
+//                "rarity": "Common",
+//                "owner": "dorkus",
+//                "slot": 4
+//            }
+//        ],
+//        "resonators": [
+//            {
+//                "level": 6,
+//                "health": 98,
+//                "owner": "NumberSix",
+//                "position": "E"
+//            },
+//            {
+//                "level": 7,
+//                "health": 100,
+//                "owner": "NumberSix",
+//                "position": "NE"
+//            },
+//            {
+//                "level": 8,
+//                "health": 100,
+//                "owner": "NumberSix",
+//                "position": "N"
+//            },
+//            {
+//                "level": 6,
+//                "health": 100,
+//                "owner": "NumberSix",
+//                "position": "NW"
+//            },
+//            {
+//                "level": 7,
+//                "health": 100,
+//                "owner": "dorkus",
+//                "position": "W"
+//            },
+//            {
+//                "level": 8,
+//                "health": 99,
+//                "owner": "dorkus",
+//                "position": "SW"
+//            },
+//            {
+//                "level": 5,
+//                "health": 99,
+//                "owner": "NumberSix",
+//                "position": "S"
+//            },
+//            {
+//                "level": 5,
+//                "health": 95,
+//                "owner": "NumberSix",
+//                "position": "SE"
+//            }
+//        ]
+//    },
+//    "message": null,
+//    "code": "OK",
+//    "fieldErrors": null
+//}
+//
+
+// Resonator is a resonator deployed on the portal
+//
+type Resonator struct {
+	Position string `json:"position"` // E, NE, N, NW, W, SW, S or SE
+	Level    int    `json:"level"`
+	Health   int    `json:"health"` // Percentage of the full energy of the resonator
+	Owner    string `json:"owner"`
+}
+
+// Mod is a mod deployed on the portal
+//
+type Mod struct {
+	Type   string `json:"type"`
+	Rarity string `json:"rarity"`
+	Owner  string `json:"owner"`
+	Slot   int    `json:"slot"` // 1 to 4
+}
+
+// Status is the state of the portal
+//
+type Status struct {
+	Title         string      `json:"title"`
+	Description   string      `json:"description"`
+	CoverImageURL string      `json:"coverImageUrl"`
+	Attribution   string      `json:"attribution"`
+	Owner         string      `json:"owner"`
+	Level         int         `json:"level"`
+	Health        int         `json:"health"`
+	Faction       string      `json:"controllingFaction"` // Typically Enlightened, Resistance or Neutral
+	Mods          []Mod       `json:"mods"`
+	Resonators    []Resonator `json:"resonators"`
+	AudioCues     []string    `json:"audioCues"` // The game sounds being played at the portal, reported by some firmwares
+}
+
+// Response is the complete document returned by the tecthulhu status endpoint
+//
+type Response struct {
+	Result  Status `json:"result"`
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
@@ -0,0 +1,189 @@
+package mawt
+
+// This module renders the pixels of the terminal preview for the capabilities of
+// the terminal in use.  The preview draws 24 bit color blocks, which many
+// terminals show as garbage or as the wrong colors, in particular over SSH where
+// the COLORTERM variable announcing 24 bit color is not passed along.  The terminal
+// is detected from the environment, or chosen using an option, falling back to the
+// 256 color palette supported by nearly every terminal emulator, or to monochrome
+// ASCII characters whose density follows the brightness of each pixel for serial
+// consoles and terminals without color
+
+import (
+	"fmt"
+	"image/color"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// ColorMode is the way the terminal preview draws pixels
+//
+type ColorMode int
+
+const (
+	TrueColor  ColorMode = iota // 24 bit color blocks
+	Color256                    // The closest colors of the xterm 256 color palette
+	ColorASCII                  // Monochrome ASCII characters
+)
+
+var (
+	// asciiRamp holds the characters drawn for pixels from black to full brightness
+	asciiRamp = ".:-=+*#%@"
+
+	// cubeLevels are the intensities of the 6x6x6 color cube of the 256 color palette
+	cubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+	// terminalColors is the way pixels are drawn by the terminal preview
+	terminalColors = struct {
+		mode ColorMode
+		sync.Mutex
+	}{mode: DetectColorMode(os.Getenv)}
+)
+
+func (mode ColorMode) String() string {
+	switch mode {
+	case Color256:
+		return "256"
+	case ColorASCII:
+		return "ascii"
+	}
+	return "truecolor"
+}
+
+// ParseColorMode returns the color mode named truecolor, 256 or ascii, auto
+// detecting the mode from the environment
+//
+func ParseColorMode(name string) (mode ColorMode, err errors.Error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return DetectColorMode(os.Getenv), nil
+	case "truecolor", "24bit":
+		return TrueColor, nil
+	case "256":
+		return Color256, nil
+	case "ascii":
+		return ColorASCII, nil
+	}
+	return TrueColor, errors.New("unknown terminal color mode, auto, truecolor, 256 or ascii are supported").With("mode", name).With("stack", stack.Trace().TrimRuntime())
+}
+
+// DetectColorMode chooses the color mode for the terminal described by environment
+// variables, looked up using the supplied function.  NO_COLOR, or a dumb or unknown
+// terminal, selects ASCII, and 24 bit color is only used when the terminal
+// announces it using COLORTERM
+//
+func DetectColorMode(getenv func(string) string) (mode ColorMode) {
+	if len(getenv("NO_COLOR")) != 0 {
+		return ColorASCII
+	}
+	switch strings.ToLower(getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return TrueColor
+	}
+
+	term := strings.ToLower(getenv("TERM"))
+	if strings.Contains(term, "256color") {
+		return Color256
+	}
+	for _, prefix := range []string{"xterm", "screen", "tmux", "rxvt", "putty", "alacritty", "kitty"} {
+		if strings.HasPrefix(term, prefix) {
+			return Color256
+		}
+	}
+	return ColorASCII
+}
+
+// SetTerminalColors chooses the way the terminal preview draws pixels
+//
+func SetTerminalColors(mode ColorMode) {
+	terminalColors.Lock()
+	defer terminalColors.Unlock()
+
+	terminalColors.mode = mode
+}
+
+// TerminalColors returns the way the terminal preview draws pixels
+//
+func TerminalColors() (mode ColorMode) {
+	terminalColors.Lock()
+	defer terminalColors.Unlock()
+
+	return terminalColors.mode
+}
+
+// Pixel returns the text drawing one pixel, fully transparent pixels being black
+//
+func (mode ColorMode) Pixel(rgba color.RGBA) (text string) {
+	if rgba.A == 0 {
+		rgba.R, rgba.G, rgba.B = 0, 0, 0
+	}
+	switch mode {
+	case Color256:
+		return fmt.Sprintf("\x1b[38;5;%dm█\x1b[0m", palette256(rgba))
+	case ColorASCII:
+		// Rec. 601 luma, the perceived brightness of the pixel
+		luma := (299*int(rgba.R) + 587*int(rgba.G) + 114*int(rgba.B)) / 1000
+		return string(asciiRamp[luma*(len(asciiRamp)-1)/255])
+	}
+	return fmt.Sprintf("\x1b[38;2;%d;%d;%dm█\x1b[0m", rgba.R, rgba.G, rgba.B)
+}
+
+// Arrow returns the text separating the number of a strand from its pixels
+//
+func (mode ColorMode) Arrow() (text string) {
+	if mode == ColorASCII {
+		return "->"
+	}
+	return "→"
+}
+
+// Alert returns text drawn in red, or as it is in ASCII
+//
+func (mode ColorMode) Alert(text string) (alert string) {
+	if mode == ColorASCII {
+		return text
+	}
+	return "\x1b[31m" + text + "\x1b[0m"
+}
+
+// palette256 returns the entry of the xterm 256 color palette closest to a color,
+// chosen from the 6x6x6 color cube and the 24 step gray ramp
+//
+func palette256(rgba color.RGBA) (index int) {
+	cube := func(value uint8) (level int) {
+		switch {
+		case value < 48:
+			return 0
+		case value < 115:
+			return 1
+		}
+		return (int(value) - 35) / 40
+	}
+	r, g, b := cube(rgba.R), cube(rgba.G), cube(rgba.B)
+	cubeIndex := 16 + 36*r + 6*g + b
+
+	// The gray ramp runs from 8 to 238 in steps of 10
+	average := (int(rgba.R) + int(rgba.G) + int(rgba.B)) / 3
+	step := 23
+	if average < 238 {
+		step = 0
+		if average > 3 {
+			step = (average - 3) / 10
+		}
+	}
+	gray := 8 + 10*step
+
+	if colorDistance(rgba, cubeLevels[r], cubeLevels[g], cubeLevels[b]) <= colorDistance(rgba, gray, gray, gray) {
+		return cubeIndex
+	}
+	return 232 + step
+}
+
+func colorDistance(rgba color.RGBA, r int, g int, b int) (squared int) {
+	dr, dg, db := int(rgba.R)-r, int(rgba.G)-g, int(rgba.B)-b
+	return dr*dr + dg*dg + db*db
+}
@@ -0,0 +1,246 @@
+package mawt
+
+// This module implements thermal throttling.  Sealed outdoor enclosures can get
+// hot enough during summer events to damage the Raspberry Pi, the power supplies
+// and the LEDs, so once the temperature passes the warm threshold the brightness
+// and frame rate are derated, increasingly so up to the hot threshold, reducing
+// the heat produced until the enclosure cools down
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	thermalHysteresis = 2.0 // Degrees below the warm threshold at which throttling is cleared
+)
+
+// ThermalConfig defines the temperature sensor and the derating applied as it rises
+//
+type ThermalConfig struct {
+	Sensor     string        `yaml:"sensor" json:"sensor"`         // sysfs, file or command, defaults to sysfs
+	Path       string        `yaml:"path" json:"path"`             // The file read, defaults to /sys/class/thermal/thermal_zone0/temp for sysfs
+	Command    string        `yaml:"command" json:"command"`       // The shell command printing the temperature
+	Interval   time.Duration `yaml:"interval" json:"interval"`     // The time between readings, defaults to 5s
+	Warm       float64       `yaml:"warm" json:"warm"`             // The temperature in Celsius at which derating begins, defaults to 70
+	Hot        float64       `yaml:"hot" json:"hot"`               // The temperature in Celsius at which derating is greatest, defaults to 80
+	Brightness float64       `yaml:"brightness" json:"brightness"` // The brightness when hot, defaults to 0.5
+	FPS        float64       `yaml:"fps" json:"fps"`               // The frame rate cap when hot, defaults to 15
+}
+
+// Thermal reads a temperature sensor and computes the derating for the temperature
+//
+type Thermal struct {
+	config    ThermalConfig
+	reader    func() (celsius float64, err errors.Error)
+	celsius   float64
+	read      time.Time // When the last reading was taken, zero before the first
+	throttled bool
+	throttles uint64 // The number of times throttling has begun
+	failures  *ErrorSummary
+	lastErr   string
+	sync.Mutex
+}
+
+// ThermalReport describes the temperature and the derating applied
+//
+type ThermalReport struct {
+	Sensor     string    `json:"sensor"`
+	Celsius    float64   `json:"celsius"`
+	Throttled  bool      `json:"throttled"`
+	Derating   float64   `json:"derating"`   // From 0 when below the warm threshold to 1 when hot
+	Brightness float64   `json:"brightness"` // The brightness applied to the frames
+	FPS        float64   `json:"fps"`        // The frame rate derated towards when throttled, 0 when not throttled
+	Throttles  uint64    `json:"throttles"`  // The number of times throttling has begun
+	Read       time.Time `json:"read"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+// NewThermal validates the configuration of the temperature sensor, supplying the defaults
+//
+func NewThermal(config ThermalConfig) (thermal *Thermal, err errors.Error) {
+	thermal = &Thermal{failures: NewErrorSummary(errorSummaryInterval)}
+
+	if config.Interval < 0 {
+		return nil, errors.New("the thermal interval cannot be negative").With("interval", config.Interval).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Interval == 0 {
+		config.Interval = 5 * time.Second
+	}
+
+	switch config.Sensor {
+	case "", "sysfs":
+		config.Sensor = "sysfs"
+		if len(config.Path) == 0 {
+			config.Path = "/sys/class/thermal/thermal_zone0/temp"
+		}
+		thermal.reader = thermal.readFile
+	case "file":
+		if len(config.Path) == 0 {
+			return nil, errors.New("the thermal file sensor needs a path").With("stack", stack.Trace().TrimRuntime())
+		}
+		thermal.reader = thermal.readFile
+	case "command":
+		if len(config.Command) == 0 {
+			return nil, errors.New("the thermal command sensor needs a command").With("stack", stack.Trace().TrimRuntime())
+		}
+		thermal.reader = thermal.readCommand
+	default:
+		return nil, errors.New("unknown temperature sensor, sysfs, file and command are supported").With("sensor", config.Sensor).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if config.Warm == 0 {
+		config.Warm = 70
+	}
+	if config.Hot == 0 {
+		config.Hot = 80
+	}
+	if config.Hot <= config.Warm {
+		return nil, errors.New("the hot temperature must be above the warm temperature").With("warm", config.Warm).With("hot", config.Hot).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Brightness == 0 {
+		config.Brightness = 0.5
+	}
+	if config.Brightness < 0 || config.Brightness > 1 {
+		return nil, errors.New("the thermal brightness must be from 0 to 1").With("brightness", config.Brightness).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.FPS == 0 {
+		config.FPS = 15
+	}
+	if config.FPS < 0 || config.FPS > 400 {
+		return nil, errors.New("the thermal fps must be greater than 0 and no more than 400").With("fps", config.FPS).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	thermal.config = config
+	return thermal, nil
+}
+
+// celsiusReading converts a reading into degrees Celsius, sysfs reports millidegrees
+//
+func celsiusReading(reading float64) (celsius float64) {
+	if reading > 1000 {
+		return reading / 1000
+	}
+	return reading
+}
+
+func (thermal *Thermal) readFile() (celsius float64, err errors.Error) {
+	reading, err := readSensorFile(thermal.config.Path)
+	return celsiusReading(reading), err
+}
+
+func (thermal *Thermal) readCommand() (celsius float64, err errors.Error) {
+	reading, err := readSensorCommand(thermal.config.Command, thermal.config.Interval)
+	return celsiusReading(reading), err
+}
+
+// Start reads the sensor at the configured interval until the quit channel is closed
+//
+func (thermal *Thermal) Start(errorC chan<- errors.Error, quitC <-chan struct{}) {
+	poll := &sensorPoll{
+		name:     "thermal",
+		sensor:   thermal.config.Sensor,
+		interval: thermal.config.Interval,
+		failures: thermal.failures,
+		read:     thermal.reader,
+		apply:    thermal.apply,
+		failed:   thermal.failed,
+	}
+	poll.start(errorC, quitC)
+}
+
+// failed records the error of a reading, the last reading continuing to be used
+//
+func (thermal *Thermal) failed(err errors.Error) {
+	thermal.Lock()
+	defer thermal.Unlock()
+
+	thermal.lastErr = err.Error()
+}
+
+// apply records a reading, publishing an event when throttling begins or ends
+//
+func (thermal *Thermal) apply(reading float64, now time.Time) {
+	thermal.Lock()
+	thermal.celsius = reading
+	thermal.read = now
+	thermal.lastErr = ""
+	changed := false
+	switch {
+	case !thermal.throttled && reading >= thermal.config.Warm:
+		thermal.throttled, changed = true, true
+		thermal.throttles++
+	case thermal.throttled && reading < thermal.config.Warm-thermalHysteresis:
+		thermal.throttled, changed = false, true
+	}
+	throttled := thermal.throttled
+	thermal.Unlock()
+
+	if changed {
+		kind := "thermal-cleared"
+		if throttled {
+			kind = "thermal-throttled"
+		}
+		bus.Publish(TopicEvents, Event{Time: now, Kind: kind, Detail: fmt.Sprintf("%.1f°C", reading)})
+	}
+}
+
+// derating returns how far the temperature is between the warm and hot thresholds,
+// from 0 to 1, the caller holds the lock
+//
+func (thermal *Thermal) derating() (derating float64) {
+	if !thermal.throttled {
+		return 0
+	}
+	derating = (thermal.celsius - thermal.config.Warm) / (thermal.config.Hot - thermal.config.Warm)
+	return math.Max(0, math.Min(1, derating))
+}
+
+// Brightness returns the brightness the frames are derated to
+//
+func (thermal *Thermal) Brightness() (level float64) {
+	thermal.Lock()
+	defer thermal.Unlock()
+
+	return 1 - thermal.derating()*(1-thermal.config.Brightness)
+}
+
+// FPS returns the frame rate derated from that of the quality profile
+//
+func (thermal *Thermal) FPS(fps float64) (derated float64) {
+	thermal.Lock()
+	defer thermal.Unlock()
+
+	if fps <= thermal.config.FPS {
+		return fps
+	}
+	return fps - thermal.derating()*(fps-thermal.config.FPS)
+}
+
+// Report returns the temperature and the derating applied
+//
+func (thermal *Thermal) Report() (report ThermalReport) {
+	thermal.Lock()
+	defer thermal.Unlock()
+
+	derating := thermal.derating()
+	report = ThermalReport{
+		Sensor:     thermal.config.Sensor,
+		Celsius:    thermal.celsius,
+		Throttled:  thermal.throttled,
+		Derating:   derating,
+		Brightness: 1 - derating*(1-thermal.config.Brightness),
+		Throttles:  thermal.throttles,
+		Read:       thermal.read,
+		LastError:  thermal.lastErr,
+	}
+	if thermal.throttled {
+		report.FPS = thermal.config.FPS
+	}
+	return report
+}
@@ -0,0 +1,205 @@
+package mawt
+
+// This module implements the ticker, text scrolled across a small LED matrix
+// panel included in some builds.  The messages are templates filled in from
+// the status of the displayed portal, such as its name, the controlling
+// faction and the decay countdown, each scrolling in from the right edge of
+// the panel and fully off the left before the next begins
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TickerConfig defines the matrix panel the ticker is drawn on and the messages it shows
+//
+type TickerConfig struct {
+	Channel  int          `yaml:"channel" json:"channel"`   // The logical strand the panel is wired as
+	Matrix   MatrixConfig `yaml:"matrix" json:"matrix"`     // The wiring of the panel
+	Messages []string     `yaml:"messages" json:"messages"` // Message templates shown in turn, defaults to the portal name and faction
+	Speed    float64      `yaml:"speed" json:"speed"`       // Columns scrolled each second, defaults to 12
+}
+
+var (
+	tickerFactions = map[string]string{
+		"E": "Enlightened",
+		"R": "Resistance",
+		"N": "Neutral",
+	}
+
+	tickerNeutral = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// Ticker scrolls messages about the displayed portal across a matrix panel
+//
+type Ticker struct {
+	config  TickerConfig
+	matrix  *Matrix
+	decay   *Decay        // Supplies the countdown, nil when the decay countdown is disabled
+	status  *model.Status // The displayed portal, nil until the first status arrives
+	message int           // The index of the message being scrolled
+	columns []byte        // The rendered text of the message being scrolled
+	color   color.RGBA
+	started time.Time // When the message being scrolled entered the panel
+	sync.Mutex
+}
+
+// NewTicker validates the ticker configuration, supplying the defaults
+//
+func NewTicker(config TickerConfig) (ticker *Ticker, err errors.Error) {
+	if config.Channel < 1 || config.Channel > 255 {
+		return nil, errors.New("the ticker must use a channel from 1 to 255").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	matrix, err := NewMatrix(config.Matrix)
+	if err != nil {
+		return nil, err.With("channel", config.Channel)
+	}
+	if config.Speed < 0 {
+		return nil, errors.New("the ticker speed cannot be negative").With("speed", config.Speed).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Speed == 0 {
+		config.Speed = 12
+	}
+	if len(config.Messages) == 0 {
+		config.Messages = []string{"{portal}", "{faction} L{level} {health}%"}
+	}
+	return &Ticker{
+		config:  config,
+		matrix:  matrix,
+		message: -1,
+	}, nil
+}
+
+// Update records the status of the displayed portal, used by the messages that follow
+//
+func (ticker *Ticker) Update(status *model.Status, now time.Time) {
+	ticker.Lock()
+	defer ticker.Unlock()
+
+	ticker.status = status
+}
+
+// countdown formats the time until the displayed portal goes neutral
+//
+func countdown(remaining time.Duration) (text string) {
+	remaining = remaining.Round(time.Minute)
+	if remaining >= 24*time.Hour {
+		return fmt.Sprintf("%dd%dh", remaining/(24*time.Hour), remaining%(24*time.Hour)/time.Hour)
+	}
+	return fmt.Sprintf("%dh%02dm", remaining/time.Hour, remaining%time.Hour/time.Minute)
+}
+
+// expand fills in the placeholders of a message template, the caller holds the lock.
+// {portal}, {owner}, {faction}, {level}, {health}, {resonators}, {countdown} and {time}
+// are supported
+//
+func (ticker *Ticker) expand(template string, now time.Time) (text string) {
+	status := ticker.status
+	if status == nil {
+		status = &model.Status{Faction: "N"}
+	}
+
+	faction, isPresent := tickerFactions[status.Faction]
+	if !isPresent {
+		faction = status.Faction
+	}
+	resonators := 0
+	for _, resonator := range status.Resonators {
+		if resonator.Level > 0 {
+			resonators++
+		}
+	}
+	remaining := "--"
+	if ticker.decay != nil {
+		if left, isOK := ticker.decay.Remaining(now); isOK {
+			remaining = countdown(left)
+		}
+	}
+
+	return strings.NewReplacer(
+		"{portal}", status.Title,
+		"{owner}", status.Owner,
+		"{faction}", faction,
+		"{level}", fmt.Sprintf("%.0f", status.Level),
+		"{health}", fmt.Sprintf("%.0f", status.Health),
+		"{resonators}", fmt.Sprint(resonators),
+		"{countdown}", remaining,
+		"{time}", now.Format("15:04"),
+	).Replace(template)
+}
+
+// next begins scrolling the following message, the caller holds the lock.  The text
+// is fixed as the message enters the panel so that it does not shift while scrolling
+//
+func (ticker *Ticker) next(now time.Time) {
+	ticker.message = (ticker.message + 1) % len(ticker.config.Messages)
+	ticker.columns = textColumns(ticker.expand(ticker.config.Messages[ticker.message], now))
+	ticker.color = tickerNeutral
+	if ticker.status != nil {
+		if c, isPresent := timelineColors[ticker.status.Faction]; isPresent && ticker.status.Faction != "N" {
+			ticker.color = c
+		}
+	}
+	ticker.started = now
+}
+
+// Render draws the message being scrolled onto the pixels of the panel, the text
+// being centred vertically
+//
+func (ticker *Ticker) Render(now time.Time) (data []color.RGBA) {
+	ticker.Lock()
+	defer ticker.Unlock()
+
+	width, height := ticker.matrix.Width(), ticker.matrix.Height()
+	offset := 0
+	if ticker.message >= 0 {
+		offset = int(now.Sub(ticker.started).Seconds() * ticker.config.Speed)
+	}
+	if ticker.message < 0 || offset > width+len(ticker.columns) {
+		ticker.next(now)
+		offset = 0
+	}
+
+	data = make([]color.RGBA, ticker.matrix.Pixels())
+	top := (height - fontHeight) / 2
+	for x := 0; x != width; x++ {
+		column := x - width + offset
+		if column < 0 || column >= len(ticker.columns) {
+			continue
+		}
+		bits := ticker.columns[column]
+		for row := 0; row != fontHeight; row++ {
+			y := top + row
+			if y < 0 || y >= height || bits&(1<<uint(row)) == 0 {
+				continue
+			}
+			data[ticker.matrix.Index(x, y)] = ticker.color
+		}
+	}
+	return data
+}
+
+// Overlay replaces the strand of the matrix panel within a frame
+//
+func (ticker *Ticker) Overlay(frame []animationModel.ChannelData, now time.Time) (overlaid []animationModel.ChannelData) {
+	strand := animationModel.ChannelData{
+		ChannelNum: animationModel.OpcChannel(ticker.config.Channel),
+		Data:       ticker.Render(now),
+	}
+
+	overlaid = make([]animationModel.ChannelData, 0, len(frame)+1)
+	for _, channelData := range frame {
+		if channelData.ChannelNum != strand.ChannelNum {
+			overlaid = append(overlaid, channelData)
+		}
+	}
+	return append(overlaid, strand)
+}
@@ -0,0 +1,493 @@
+package mawt
+
+// This module implements chasing SMPTE timecode so that headless shows authored
+// for a ceremony start and stay locked to the master show clock, alongside the
+// audio and video systems following the same clock.  Timecode arrives as MIDI
+// Time Code from a raw MIDI device, using quarter frame and full frame messages,
+// or as Linear Time Code, the biphase audio signal, read as raw 16 bit samples from
+// a file, FIFO or the standard input, for example recorded by arecord.  The clock
+// freewheels between timecode messages and for a short dropout, holding its
+// position when the timecode stops so that a show freezes with the master clock
+// and locates to the new position when it starts again
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// timecodeFreewheel is the time the clock keeps running without timecode before
+	// it is considered stopped
+	timecodeFreewheel = time.Second
+
+	ltcFrameBits = 80
+	ltcSyncWord  = 0x3FFD // The last 16 bits of an LTC frame, in the order they are sent
+)
+
+// Timecode is a SMPTE timecode, hours, minutes, seconds and frames.  Drop frame
+// timecode skips frames 0 and 1 at the start of each minute other than every tenth
+// minute to keep 29.97 frame per second timecode in step with the wall clock
+//
+type Timecode struct {
+	Hours     int
+	Minutes   int
+	Seconds   int
+	Frames    int
+	DropFrame bool
+}
+
+// ParseTimecode parses a timecode written as hh:mm:ss:ff, or hh:mm:ss;ff for drop
+// frame timecode
+//
+func ParseTimecode(text string) (tc Timecode, err errors.Error) {
+	text = strings.TrimSpace(text)
+	tc.DropFrame = strings.ContainsAny(text, ";.")
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ':' || r == ';' || r == '.' })
+	if len(fields) != 4 {
+		return tc, errors.New("timecode must be written as hh:mm:ss:ff").With("timecode", text).With("stack", stack.Trace().TrimRuntime())
+	}
+	values := [4]int{}
+	for i, field := range fields {
+		value, errGo := strconv.Atoi(field)
+		if errGo != nil || value < 0 {
+			return tc, errors.New("timecode must be written as hh:mm:ss:ff").With("timecode", text).With("stack", stack.Trace().TrimRuntime())
+		}
+		values[i] = value
+	}
+	tc.Hours, tc.Minutes, tc.Seconds, tc.Frames = values[0], values[1], values[2], values[3]
+	if tc.Hours > 23 || tc.Minutes > 59 || tc.Seconds > 59 || tc.Frames > 29 {
+		return tc, errors.New("timecode out of range").With("timecode", text).With("stack", stack.Trace().TrimRuntime())
+	}
+	return tc, nil
+}
+
+func (tc Timecode) String() string {
+	separator := ":"
+	if tc.DropFrame {
+		separator = ";"
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%s%02d", tc.Hours, tc.Minutes, tc.Seconds, separator, tc.Frames)
+}
+
+// Offset returns the time since midnight of a timecode running at a frame rate
+//
+func (tc Timecode) Offset(rate float64) (offset time.Duration) {
+	if rate <= 0 {
+		return 0
+	}
+	nominal := int(math.Round(rate))
+	frames := ((tc.Hours*60+tc.Minutes)*60+tc.Seconds)*nominal + tc.Frames
+	if tc.DropFrame {
+		minutes := tc.Hours*60 + tc.Minutes
+		frames -= 2 * (minutes - minutes/10)
+	}
+	return time.Duration(float64(frames) / rate * float64(time.Second))
+}
+
+// addFrames returns the timecode a number of frames later, wrapping at midnight
+//
+func (tc Timecode) addFrames(frames int, rate float64) (later Timecode) {
+	nominal := int(math.Round(rate))
+	later = tc
+	later.Frames += frames
+	for later.Frames >= nominal {
+		later.Frames -= nominal
+		if later.Seconds++; later.Seconds == 60 {
+			later.Seconds = 0
+			if later.Minutes++; later.Minutes == 60 {
+				later.Minutes = 0
+				later.Hours = (later.Hours + 1) % 24
+			}
+			// Frames 0 and 1 do not exist at the start of most drop frame minutes
+			if later.DropFrame && later.Minutes%10 != 0 && later.Frames < 2 {
+				later.Frames = 2
+			}
+		}
+	}
+	return later
+}
+
+// TimecodeState describes the timecode being chased
+//
+type TimecodeState struct {
+	Source   string    `json:"source,omitempty"`
+	Timecode string    `json:"timecode"` // The last timecode received
+	Rate     float64   `json:"rate"`     // Frames per second
+	Locked   bool      `json:"locked"`   // Timecode was received within the freewheel time
+	Received time.Time `json:"received"`
+}
+
+// TimecodeClock follows the timecode received from an external source
+//
+type TimecodeClock struct {
+	timecode Timecode
+	rate     float64
+	received time.Time // When the timecode was current
+	source   string
+	locked   bool
+	sync.Mutex
+}
+
+var (
+	timecode = &TimecodeClock{}
+)
+
+// GetTimecode returns the timecode clock shared by the pipelines of the process
+//
+func GetTimecode() (clock *TimecodeClock) {
+	return timecode
+}
+
+// Set records the timecode that was current at a time
+//
+func (clock *TimecodeClock) Set(tc Timecode, rate float64, at time.Time, source string) {
+	clock.Lock()
+	wasLocked := clock.locked && at.Sub(clock.received) < timecodeFreewheel
+	clock.timecode, clock.rate, clock.received, clock.source, clock.locked = tc, rate, at, source, true
+	clock.Unlock()
+
+	if !wasLocked {
+		bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "timecode", Detail: fmt.Sprintf("locked to %s at %s, %g fps", source, tc, rate)})
+	}
+}
+
+// Position returns the time since midnight of the timecode at a time, running on
+// from the last timecode received for up to the freewheel time and then holding.
+// The rate of the timecode is also returned, 0 until timecode has been received
+//
+func (clock *TimecodeClock) Position(now time.Time) (position time.Duration, rate float64, isLocked bool) {
+	clock.Lock()
+	if clock.rate == 0 {
+		clock.Unlock()
+		return 0, 0, false
+	}
+	elapsed := now.Sub(clock.received)
+	isLocked = elapsed < timecodeFreewheel
+	if !isLocked {
+		elapsed = timecodeFreewheel
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	position, rate = clock.timecode.Offset(clock.rate)+elapsed, clock.rate
+	wasLocked := clock.locked
+	clock.locked = isLocked
+	tc, source := clock.timecode, clock.source
+	clock.Unlock()
+
+	if wasLocked && !isLocked {
+		bus.Publish(TopicEvents, Event{Time: time.Now(), Kind: "timecode", Detail: fmt.Sprintf("lost %s, holding at %s", source, tc)})
+	}
+	return position, rate, isLocked
+}
+
+// State returns the timecode being chased
+//
+func (clock *TimecodeClock) State() (state TimecodeState) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	state = TimecodeState{Source: clock.source, Rate: clock.rate, Received: clock.received}
+	if clock.rate != 0 {
+		state.Timecode = clock.timecode.String()
+		state.Locked = time.Since(clock.received) < timecodeFreewheel
+	}
+	return state
+}
+
+// mtcRates are the frame rates of the rate codes of MIDI Time Code
+//
+var mtcRates = [4]float64{24, 25, 30000.0 / 1001, 30}
+
+// mtcDecoder assembles the timecode sent by MIDI Time Code messages
+//
+type mtcDecoder struct {
+	pieces   [8]byte // The quarter frame data received, by piece
+	received byte    // A bit for each piece received since piece 0
+	sysex    []byte  // The system exclusive message being received
+	inSysex  bool
+	quarter  bool // The next data byte is a quarter frame
+}
+
+// decode handles a byte of the MIDI stream, returning the timecode once a full
+// frame message or all eight quarter frames have been received
+//
+func (decoder *mtcDecoder) decode(b byte) (tc Timecode, rate float64, isComplete bool) {
+	switch {
+	case b >= 0xF8:
+		// Real time messages can appear anywhere, including within other messages
+		return tc, 0, false
+	case b == 0xF0:
+		decoder.sysex, decoder.inSysex = decoder.sysex[:0], true
+		return tc, 0, false
+	case b == 0xF7:
+		decoder.inSysex = false
+		// F0 7F <device> 01 01 hr mn sc fr F7 is a full frame message, sent when
+		// the master locates rather than runs
+		if s := decoder.sysex; len(s) == 8 && s[0] == 0x7F && s[2] == 0x01 && s[3] == 0x01 {
+			rate = mtcRates[(s[4]>>5)&0x03]
+			tc = Timecode{Hours: int(s[4] & 0x1F), Minutes: int(s[5]), Seconds: int(s[6]), Frames: int(s[7]), DropFrame: (s[4]>>5)&0x03 == 2}
+			decoder.received = 0
+			return tc, rate, true
+		}
+		return tc, 0, false
+	case decoder.inSysex:
+		if b >= 0x80 {
+			decoder.inSysex = false
+		} else if len(decoder.sysex) < 16 {
+			decoder.sysex = append(decoder.sysex, b)
+		}
+		return tc, 0, false
+	case b == 0xF1:
+		decoder.quarter = true
+		return tc, 0, false
+	case decoder.quarter && b < 0x80:
+		decoder.quarter = false
+		piece := (b >> 4) & 0x07
+		decoder.pieces[piece] = b & 0x0F
+		if piece == 0 {
+			decoder.received = 0
+		}
+		decoder.received |= 1 << piece
+		if piece != 7 || decoder.received != 0xFF {
+			return tc, 0, false
+		}
+		p := decoder.pieces
+		rateCode := (p[7] >> 1) & 0x03
+		rate = mtcRates[rateCode]
+		tc = Timecode{
+			Frames:    int(p[0] | p[1]<<4),
+			Seconds:   int(p[2] | p[3]<<4),
+			Minutes:   int(p[4] | p[5]<<4),
+			Hours:     int(p[6] | (p[7]&0x01)<<4),
+			DropFrame: rateCode == 2,
+		}
+		// The quarter frames describe the frame that began with piece 0, two frames
+		// before the last piece arrives
+		return tc.addFrames(2, rate), rate, true
+	}
+	decoder.quarter = false
+	return tc, 0, false
+}
+
+// ReadMIDI follows the MIDI timing clock and the MIDI Time Code of a raw MIDI
+// device, for example /dev/snd/midiC1D0, ignoring all other MIDI messages.  Either
+// clock can be nil when it is not followed
+//
+func ReadMIDI(device string, clock *BeatClock, tc *TimecodeClock, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	f, errGo := os.Open(device)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	go func() {
+		<-quitC
+		f.Close()
+	}()
+
+	go func() {
+		source := "midi " + device
+		decoder := &mtcDecoder{}
+		buf := make([]byte, 64)
+		for {
+			n, errGo := f.Read(buf)
+			if errGo != nil {
+				select {
+				case <-quitC:
+				default:
+					sendErr(errorC, errors.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime()))
+				}
+				return
+			}
+			now := time.Now()
+			for _, b := range buf[:n] {
+				if clock != nil {
+					// Real time messages are single bytes that can appear anywhere in the stream
+					switch b {
+					case 0xF8:
+						clock.Pulse(now, source)
+					case 0xFA, 0xFB:
+						clock.Start()
+					case 0xFC:
+						clock.Stop()
+					}
+				}
+				if tc == nil {
+					continue
+				}
+				if decoded, rate, isComplete := decoder.decode(b); isComplete {
+					tc.Set(decoded, rate, now, "mtc "+device)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// ltcDecoder decodes Linear Time Code from audio samples.  The signal is biphase
+// mark encoded, every bit beginning with a transition and a one having a second
+// transition half way through, so the intervals between transitions are either a
+// whole bit, a zero, or two halves, a one
+//
+type ltcDecoder struct {
+	sampleRate int
+	high       bool    // The sign of the signal, with hysteresis
+	interval   int     // Samples since the last transition
+	bitLength  float64 // The smoothed length of a bit in samples
+	half       bool    // Set after the first half of a one
+	bits       [ltcFrameBits]byte
+	count      int // Bits received, up to a frame
+}
+
+func newLTCDecoder(sampleRate int) (decoder *ltcDecoder) {
+	// Start from the bit length at 25 frames per second, which adapts to the signal
+	return &ltcDecoder{sampleRate: sampleRate, bitLength: float64(sampleRate) / (25 * ltcFrameBits)}
+}
+
+// decode handles a sample, returning the timecode once a frame ends
+//
+func (decoder *ltcDecoder) decode(sample int16) (tc Timecode, rate float64, isComplete bool) {
+	decoder.interval++
+	const hysteresis = 1024
+	switch {
+	case !decoder.high && sample > hysteresis:
+		decoder.high = true
+	case decoder.high && sample < -hysteresis:
+		decoder.high = false
+	default:
+		return tc, 0, false
+	}
+
+	interval := float64(decoder.interval)
+	decoder.interval = 0
+	switch {
+	case interval < decoder.bitLength/4 || interval > decoder.bitLength*2:
+		// Noise, or a gap in the signal
+		decoder.half, decoder.count = false, 0
+		return tc, 0, false
+	case interval < decoder.bitLength*3/4:
+		if !decoder.half {
+			decoder.half = true
+			return tc, 0, false
+		}
+		decoder.half = false
+		decoder.bitLength += (interval*2 - decoder.bitLength) / 8
+		return decoder.push(1)
+	}
+	decoder.half = false
+	decoder.bitLength += (interval - decoder.bitLength) / 8
+	return decoder.push(0)
+}
+
+// push adds a bit to the frame being received, decoding the frame when the bit
+// completes the sync word
+//
+func (decoder *ltcDecoder) push(bit byte) (tc Timecode, rate float64, isComplete bool) {
+	copy(decoder.bits[:], decoder.bits[1:])
+	decoder.bits[ltcFrameBits-1] = bit
+	if decoder.count < ltcFrameBits {
+		decoder.count++
+		if decoder.count < ltcFrameBits {
+			return tc, 0, false
+		}
+	}
+
+	sync := 0
+	for _, b := range decoder.bits[64:] {
+		sync = sync<<1 | int(b)
+	}
+	if sync != ltcSyncWord {
+		return tc, 0, false
+	}
+
+	// Fields are sent least significant bit first
+	field := func(start int, length int) (value int) {
+		for i := length - 1; i >= 0; i-- {
+			value = value<<1 | int(decoder.bits[start+i])
+		}
+		return value
+	}
+	tc = Timecode{
+		Frames:    field(0, 4) + 10*field(8, 2),
+		Seconds:   field(16, 4) + 10*field(24, 3),
+		Minutes:   field(32, 4) + 10*field(40, 3),
+		Hours:     field(48, 4) + 10*field(56, 2),
+		DropFrame: decoder.bits[10] == 1,
+	}
+
+	// The frame rate is measured from the length of the bits
+	measured := float64(decoder.sampleRate) / (decoder.bitLength * ltcFrameBits)
+	rate = 30
+	for _, candidate := range []float64{24, 25, 30} {
+		if math.Abs(measured-candidate) < math.Abs(measured-rate) {
+			rate = candidate
+		}
+	}
+	if tc.DropFrame {
+		rate = 30000.0 / 1001
+	}
+	// The frame just received has ended so the next frame is current
+	return tc.addFrames(1, rate), rate, true
+}
+
+// ReadLTC follows the Linear Time Code in a stream of mono 16 bit little endian
+// samples, read from a file or FIFO, or the standard input when the file is -
+//
+func ReadLTC(file string, sampleRate int, clock *TimecodeClock, errorC chan<- errors.Error, quitC <-chan struct{}) (err errors.Error) {
+	if sampleRate < 8000 {
+		return errors.New("the LTC sample rate must be at least 8000").With("sampleRate", sampleRate).With("stack", stack.Trace().TrimRuntime())
+	}
+	var f io.ReadCloser = os.Stdin
+	if file != "-" {
+		opened, errGo := os.Open(file)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("file", file).With("stack", stack.Trace().TrimRuntime())
+		}
+		f = opened
+	}
+
+	go func() {
+		<-quitC
+		f.Close()
+	}()
+
+	go func() {
+		source := "ltc " + file
+		decoder := newLTCDecoder(sampleRate)
+		// Samples are read 5ms at a time so that the time a frame ends is accurate
+		buf := make([]byte, 2*sampleRate/200)
+		for {
+			n, errGo := io.ReadFull(f, buf)
+			if errGo != nil {
+				select {
+				case <-quitC:
+				default:
+					sendErr(errorC, errors.Wrap(errGo).With("file", file).With("stack", stack.Trace().TrimRuntime()))
+				}
+				return
+			}
+			now := time.Now()
+			samples := n / 2
+			for i := 0; i != samples; i++ {
+				tc, rate, isComplete := decoder.decode(int16(binary.LittleEndian.Uint16(buf[2*i:])))
+				if !isComplete {
+					continue
+				}
+				// The sample ending the frame was read ahead of the end of the buffer
+				at := now.Add(-time.Duration(samples-i) * time.Second / time.Duration(sampleRate))
+				clock.Set(tc, rate, at, source)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,175 @@
+package mawt
+
+// This module implements the ownership timeline, a display of the recent
+// changes in the faction controlling the portal displayed, which is the home
+// portal unless an arbitration policy chooses another, and how long each
+// faction held it.  The timeline is drawn as colored segments along a
+// designated strand replacing whatever the animations rendered there
+
+import (
+	"image/color"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/TeamNorCal/mawt/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TimelineConfig designates the strand used for the ownership timeline
+//
+type TimelineConfig struct {
+	Channel int `yaml:"channel"` // The logical strand the timeline is drawn on
+	Pixels  int `yaml:"pixels"`  // The number of pixels on the strand
+	Changes int `yaml:"changes"` // The number of faction holds shown, defaults to 8
+}
+
+var (
+	timelineColors = map[string]color.RGBA{
+		"E": {0x00, 0xff, 0x00, 0xff},
+		"R": {0x00, 0x00, 0xff, 0xff},
+		"N": {0x40, 0x40, 0x40, 0xff},
+	}
+)
+
+type hold struct {
+	faction string
+	start   time.Time
+}
+
+// Timeline tracks the faction holds of the home portal and renders them
+//
+type Timeline struct {
+	config TimelineConfig
+	holds  []hold // Oldest first, the last being the hold that is in progress
+	sync.Mutex
+}
+
+// NewTimeline validates the timeline configuration and creates an empty timeline
+//
+func NewTimeline(config TimelineConfig) (timeline *Timeline, err errors.Error) {
+	if config.Channel < 1 || config.Channel > 255 {
+		return nil, errors.New("the timeline must use a channel from 1 to 255").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Pixels < 1 {
+		return nil, errors.New("the timeline strand must have pixels").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Changes < 0 {
+		return nil, errors.New("the number of timeline changes cannot be negative").With("channel", config.Channel).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Changes == 0 {
+		config.Changes = 8
+	}
+	return &Timeline{
+		config: config,
+		holds:  []hold{},
+	}, nil
+}
+
+// Record notes a faction taking control of the portal
+//
+func (timeline *Timeline) Record(faction string, tm time.Time) {
+	timeline.Lock()
+	defer timeline.Unlock()
+
+	if len(timeline.holds) != 0 && timeline.holds[len(timeline.holds)-1].faction == faction {
+		return
+	}
+	timeline.holds = append(timeline.holds, hold{faction: faction, start: tm})
+	if len(timeline.holds) > timeline.config.Changes {
+		timeline.holds = timeline.holds[len(timeline.holds)-timeline.config.Changes:]
+	}
+}
+
+// Render draws the timeline with the oldest hold at the start of the strand and the
+// hold in progress at the end, each hold occupying a length proportional to its
+// duration but never less than a single pixel
+//
+func (timeline *Timeline) Render(now time.Time) (data []color.RGBA) {
+	timeline.Lock()
+	defer timeline.Unlock()
+
+	data = make([]color.RGBA, timeline.config.Pixels)
+	if len(timeline.holds) == 0 {
+		return data
+	}
+
+	holds := timeline.holds
+	if len(holds) > len(data) {
+		holds = holds[len(holds)-len(data):]
+	}
+
+	total := now.Sub(holds[0].start)
+	pixel := 0
+	for i, held := range holds {
+		end := now
+		if i != len(holds)-1 {
+			end = holds[i+1].start
+		}
+
+		// Reserve a pixel for each of the holds that follow
+		width := len(data) - pixel - (len(holds) - i - 1)
+		if i != len(holds)-1 && total > 0 {
+			if share := int(float64(len(data)) * float64(end.Sub(held.start)) / float64(total)); share < width {
+				width = share
+			}
+		}
+		if width < 1 {
+			width = 1
+		}
+
+		c, isPresent := timelineColors[held.faction]
+		if !isPresent {
+			c = timelineColors["N"]
+		}
+		for ; width != 0; width-- {
+			data[pixel] = c
+			pixel++
+		}
+	}
+	return data
+}
+
+// Overlay replaces the timeline strand within a frame
+//
+func (timeline *Timeline) Overlay(frame []animationModel.ChannelData, now time.Time) (overlaid []animationModel.ChannelData) {
+	strand := animationModel.ChannelData{
+		ChannelNum: animationModel.OpcChannel(timeline.config.Channel),
+		Data:       timeline.Render(now),
+	}
+
+	overlaid = make([]animationModel.ChannelData, 0, len(frame)+1)
+	for _, channelData := range frame {
+		if channelData.ChannelNum != strand.ChannelNum {
+			overlaid = append(overlaid, channelData)
+		}
+	}
+	return append(overlaid, strand)
+}
+
+// startTimeline records the faction changes of the portal displayed by a pipeline,
+// following the portal chosen by its arbitration policy
+//
+func startTimeline(timeline *Timeline, broker *Broker, quitC <-chan struct{}) {
+	sub := broker.Subscribe(TopicDisplayed, SubscribeOptions{Name: "timeline", Depth: 10})
+
+	go func() {
+		defer track("timeline")()
+		defer sub.Close()
+		faction := ""
+		for {
+			select {
+			case msg := <-sub.C:
+				displayed := msg.(*model.PortalMsg)
+				if displayed == nil || displayed.Status.Faction == faction {
+					continue
+				}
+				faction = displayed.Status.Faction
+				timeline.Record(faction, time.Now())
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package mawt
+
+// This module implements the timezone used for the timestamps mawt records and
+// reports, the event and error times, the daily journals of the store, the log
+// and the times returned by the REST API.  Installs often run with the host
+// clock set to UTC while the show is coordinated with the schedule of a venue,
+// so the zone of the venue can be chosen rather than mixing UTC and local times
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TimezoneReport describes the timezone timestamps are recorded in
+//
+type TimezoneReport struct {
+	Name   string `json:"name"`   // The IANA name, or Local for the zone of the host
+	Zone   string `json:"zone"`   // The abbreviation in effect, for example PDT
+	Offset string `json:"offset"` // The offset from UTC in effect, for example -07:00
+}
+
+var (
+	timezone = struct {
+		loc *time.Location // nil while the zone of the host is used
+		sync.Mutex
+	}{}
+)
+
+// SetTimezone makes the named IANA timezone, for example America/Los_Angeles, the
+// local time of the process.  It should be called on startup before any timestamps
+// are taken, an empty name or Local leaves the zone of the host in place
+//
+func SetTimezone(name string) (err errors.Error) {
+	if len(name) == 0 || name == "Local" {
+		return nil
+	}
+	loc, errGo := time.LoadLocation(name)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("timezone", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	timezone.Lock()
+	timezone.loc = loc
+	timezone.Unlock()
+
+	// The log and the times formatted by other packages follow the zone of the process
+	time.Local = loc
+	return nil
+}
+
+// Location returns the timezone set using SetTimezone, or the zone of the host when
+// none was set
+//
+func Location() (loc *time.Location) {
+	timezone.Lock()
+	defer timezone.Unlock()
+
+	if timezone.loc == nil {
+		return time.Local
+	}
+	return timezone.loc
+}
+
+// Timezone returns the timezone timestamps are being recorded in
+//
+func Timezone() (report TimezoneReport) {
+	now := time.Now().In(Location())
+	zone, _ := now.Zone()
+	return TimezoneReport{
+		Name:   Location().String(),
+		Zone:   zone,
+		Offset: now.Format("-07:00"),
+	}
+}
@@ -0,0 +1,234 @@
+package mawt
+
+// This module contains the changes made to the topology of a pipeline while it is
+// running, allowing a modular sculpture to have modules attached and removed without
+// a restart.  Logical strands can be mapped, remapped and unmapped, and universes,
+// the OPC channels of the physical strands, can be detached individually or a whole
+// fadecandy device at a time so that nothing is sent to a module that has been taken
+// away.  The changes are kept separately from the mapping of the configuration file
+// and applied over it, so that they survive the configuration being reloaded
+
+import (
+	"reflect"
+	"sort"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// UniverseState lists the universes of a pipeline that frames are not sent to, along
+// with the fadecandy devices all of whose universes are detached
+//
+type UniverseState struct {
+	Detached []int `json:"detached"`
+	Devices  []int `json:"devices"` // Devices numbered from 0, device 0 having universes 1 to 8
+}
+
+// DeviceUniverses returns the universes of a fadecandy device, devices being
+// numbered from 0 in the same way as the send workers number them
+//
+func DeviceUniverses(device int) (universes []int, err errors.Error) {
+	first := device*deviceStrands + 1
+	if device < 0 || first > 255 {
+		return nil, errors.New("no such fadecandy device").With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+	for universe := first; universe < first+deviceStrands && universe <= 255; universe++ {
+		universes = append(universes, universe)
+	}
+	return universes, nil
+}
+
+// editedStrands returns the strand map of the configuration with the mappings changed
+// at runtime applied over it, the caller holding the gateway lock
+//
+func (gw *Gateway) editedStrands() (strands StrandMap) {
+	if len(gw.edits) == 0 {
+		return gw.Strands
+	}
+	strands = make(StrandMap, len(gw.Strands)+len(gw.edits))
+	for logical, segments := range gw.Strands {
+		strands[logical] = segments
+	}
+	for logical, mapping := range gw.edits {
+		if mapping == nil {
+			delete(strands, logical)
+			continue
+		}
+		strands[logical] = mapping.Segments
+	}
+	return strands
+}
+
+// Topology returns the strand mappings currently used by the gateway, including
+// those changed at runtime
+//
+func (gw *Gateway) Topology() (mappings []StrandMapping) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	return gw.editedStrands().Mappings()
+}
+
+// AddStrand adds or replaces the mapping of a single logical strand while the
+// gateway is running, allowing physical strands to be added as modules of a
+// sculpture are attached.  The renderer picks up the change from the next frame
+//
+func (gw *Gateway) AddStrand(mapping StrandMapping) (err errors.Error) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	// The mapping is validated against the others in use before it is recorded
+	if _, err = gw.editedStrands().With(mapping); err != nil {
+		return err.With("pipeline", gw.Name)
+	}
+	if gw.edits == nil {
+		gw.edits = map[int]*StrandMapping{}
+	}
+	gw.edits[mapping.Logical] = &mapping
+	gw.fc.SetStrands(gw.editedStrands())
+	return nil
+}
+
+// RemoveStrand removes the mapping of a logical strand while the gateway is running,
+// the logical strand is once again sent to its own channel unchanged.  False is
+// returned when the logical strand was not mapped
+//
+func (gw *Gateway) RemoveStrand(logical int) (removed bool) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	if _, isPresent := gw.editedStrands()[logical]; !isPresent {
+		return false
+	}
+	if gw.edits == nil {
+		gw.edits = map[int]*StrandMapping{}
+	}
+	gw.edits[logical] = nil
+	gw.fc.SetStrands(gw.editedStrands())
+	return true
+}
+
+// restoreTopology replaces the runtime changes to the strand mapping with those that
+// turn the mapping of the configuration into the mappings supplied, and detaches the
+// universes supplied
+//
+func (gw *Gateway) restoreTopology(strands StrandMap, detached []int) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	gw.edits = map[int]*StrandMapping{}
+	for logical, segments := range strands {
+		if configured, isPresent := gw.Strands[logical]; !isPresent || !reflect.DeepEqual(configured, segments) {
+			gw.edits[logical] = &StrandMapping{Logical: logical, Segments: segments}
+		}
+	}
+	for logical := range gw.Strands {
+		if _, isPresent := strands[logical]; !isPresent {
+			gw.edits[logical] = nil
+		}
+	}
+	gw.fc.SetStrands(gw.editedStrands())
+
+	gw.detached = map[int]bool{}
+	for _, universe := range detached {
+		gw.detached[universe] = true
+	}
+	gw.fc.SetDetached(gw.detached)
+}
+
+// Universes returns the universes of the pipeline that frames are not being sent to
+//
+func (gw *Gateway) Universes() (state UniverseState) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	return gw.universes()
+}
+
+// universes returns the detached universes, the caller holding the gateway lock
+//
+func (gw *Gateway) universes() (state UniverseState) {
+	state = UniverseState{Detached: []int{}, Devices: []int{}}
+	for universe := range gw.detached {
+		state.Detached = append(state.Detached, universe)
+	}
+	sort.Ints(state.Detached)
+
+	for device := 0; device*deviceStrands+1 <= 255; device++ {
+		universes, _ := DeviceUniverses(device)
+		all := true
+		for _, universe := range universes {
+			all = all && gw.detached[universe]
+		}
+		if all {
+			state.Devices = append(state.Devices, device)
+		}
+	}
+	return state
+}
+
+// DetachUniverses stops frames being sent to the universes supplied, as the module
+// of the sculpture using them is removed
+//
+func (gw *Gateway) DetachUniverses(universes []int) (state UniverseState, err errors.Error) {
+	return gw.changeUniverses(universes, true)
+}
+
+// AttachUniverses resumes sending frames to universes that were detached
+//
+func (gw *Gateway) AttachUniverses(universes []int) (state UniverseState, err errors.Error) {
+	return gw.changeUniverses(universes, false)
+}
+
+func (gw *Gateway) changeUniverses(universes []int, detach bool) (state UniverseState, err errors.Error) {
+	for _, universe := range universes {
+		if universe < 1 || universe > 255 {
+			return state, errors.New("universes must use channels 1 to 255").With("pipeline", gw.Name).With("universe", universe).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	gw.Lock()
+	defer gw.Unlock()
+
+	detached := make(map[int]bool, len(gw.detached)+len(universes))
+	for universe := range gw.detached {
+		detached[universe] = true
+	}
+	for _, universe := range universes {
+		if detach {
+			detached[universe] = true
+		} else {
+			delete(detached, universe)
+		}
+	}
+	gw.detached = detached
+	gw.fc.SetDetached(detached)
+	return gw.universes(), nil
+}
+
+// SetDetached changes the universes that frames are not sent to, the map supplied is
+// not changed afterwards by the caller
+//
+func (fc *FadeCandy) SetDetached(detached map[int]bool) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.detached = detached
+}
+
+// attachedOnly removes the strands of detached universes from a physical frame, the
+// strands kept being placed in a buffer reused from frame to frame
+//
+func (fc *FadeCandy) attachedOnly(physical []animationModel.ChannelData, detached map[int]bool) (attached []animationModel.ChannelData) {
+	if len(detached) == 0 {
+		return physical
+	}
+	fc.attached = fc.attached[:0]
+	for _, strand := range physical {
+		if !detached[int(strand.ChannelNum)] {
+			fc.attached = append(fc.attached, strand)
+		}
+	}
+	return fc.attached
+}
@@ -0,0 +1,119 @@
+package mawt
+
+// This module implements the translation of the raw status documents of
+// tecthulhus before they are decoded, so that unusual tecthulhu firmwares, or
+// entirely different game feeds, can be adapted without changes to mawt.  The
+// raw document is passed to an external command on its standard input, or
+// posted to an HTTP endpoint, and the output is decoded in its place as a
+// standard tecthulhu status document
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultTransformTimeout = 5 * time.Second
+	maxTransformed          = 1024 * 1024
+)
+
+// TransformConfig defines the translation applied to raw status documents, one of
+// the command or URL is used
+//
+type TransformConfig struct {
+	Command string        `yaml:"command"` // A shell command reading the raw document on stdin and printing the translation
+	URL     string        `yaml:"url"`     // An HTTP endpoint the raw document is posted to, responding with the translation
+	Timeout time.Duration `yaml:"timeout"` // The time allowed for a translation, defaults to 5s
+}
+
+// Transform translates raw status documents
+//
+type Transform struct {
+	config TransformConfig
+	client *http.Client
+}
+
+// NewTransform validates a translation
+//
+func NewTransform(config TransformConfig) (transform *Transform, err errors.Error) {
+	if (len(config.Command) == 0) == (len(config.URL) == 0) {
+		return nil, errors.New("a status transform needs either a command or a url").With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(config.URL) != 0 {
+		u, errGo := url.Parse(config.URL)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("url", config.URL).With("stack", stack.Trace().TrimRuntime())
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errors.New("status transform urls must be http or https").With("url", config.URL).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if config.Timeout < 0 {
+		return nil, errors.New("the status transform timeout cannot be negative").With("timeout", config.Timeout).With("stack", stack.Trace().TrimRuntime())
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTransformTimeout
+	}
+	return &Transform{config: config, client: &http.Client{}}, nil
+}
+
+// Apply translates a raw status document, the translation is abandoned when the
+// context is cancelled or the timeout passes
+//
+func (transform *Transform) Apply(ctx context.Context, body []byte) (transformed []byte, err errors.Error) {
+	ctx, cancel := context.WithTimeout(ctx, transform.config.Timeout)
+	defer cancel()
+
+	if len(transform.config.Command) != 0 {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", transform.config.Command)
+		cmd.Stdin = bytes.NewReader(body)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		stdout, errGo := cmd.StdoutPipe()
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("command", transform.config.Command).With("stack", stack.Trace().TrimRuntime())
+		}
+		if errGo = cmd.Start(); errGo != nil {
+			return nil, errors.Wrap(errGo).With("command", transform.config.Command).With("stack", stack.Trace().TrimRuntime())
+		}
+		transformed, errGo = ioutil.ReadAll(io.LimitReader(stdout, maxTransformed))
+		// Output beyond the limit is discarded so that the command is not left blocked
+		// writing it, the timeout bounding how long that can take
+		io.Copy(ioutil.Discard, stdout)
+		if errWait := cmd.Wait(); errGo == nil {
+			errGo = errWait
+		}
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("command", transform.config.Command).With("stderr", stderr.String()).With("stack", stack.Trace().TrimRuntime())
+		}
+		return transformed, nil
+	}
+
+	req, errGo := http.NewRequest(http.MethodPost, transform.config.URL, bytes.NewReader(body))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", transform.config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, errGo := transform.client.Do(req.WithContext(ctx))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", transform.config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("status transform failed").With("url", transform.config.URL).With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+	}
+	if transformed, errGo = ioutil.ReadAll(io.LimitReader(resp.Body, maxTransformed)); errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", transform.config.URL).With("stack", stack.Trace().TrimRuntime())
+	}
+	return transformed, nil
+}
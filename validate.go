@@ -0,0 +1,167 @@
+package mawt
+
+// This module implements the validate output, a dry run output that sends
+// frames nowhere but checks each of them for the signs of renderer bugs, such
+// as strands whose lengths do not match the strand configuration, channels sent
+// more than once in a frame and pixel values that are out of range.  Used with
+// the /dev/null server it allows CI to exercise the renderers without hardware
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	// maxStrandPixels is the number of pixels that fit in the 16 bit length of an OPC message
+	maxStrandPixels = 0xFFFF / 3
+
+	// validateDepth is the frames queued for a validate output, deep enough that it
+	// only misses frames when it falls well behind the render loop
+	validateDepth = 64
+)
+
+// ValidationReport summarizes the frames checked by a validate output
+//
+type ValidationReport struct {
+	Frames   uint64            `json:"frames"`   // The frames checked
+	Invalid  uint64            `json:"invalid"`  // The frames with at least one problem
+	Missed   uint64            `json:"missed"`   // The frames published while the queue of the output was full, which were not checked
+	Problems map[string]uint64 `json:"problems"` // The number of each kind of problem found
+	Last     string            `json:"last,omitempty"`
+	LastTime time.Time         `json:"lastTime,omitempty"`
+}
+
+// ValidateOutput checks the frames of a pipeline without sending them anywhere
+//
+type ValidateOutput struct {
+	pixels int         // The expected length of every physical strand, 0 when not checked
+	needed map[int]int // The minimum length of each physical strand required by the strand mapping
+	report ValidationReport
+	sync.Mutex
+}
+
+// strandAware is implemented by outputs that need the strand mapping of their pipeline
+//
+type strandAware interface {
+	SetStrands(strands StrandMap)
+}
+
+// NewValidateOutput creates a validate output, a non zero pixels is the length every
+// physical strand is expected to have
+//
+func NewValidateOutput(pixels int) (output *ValidateOutput) {
+	return &ValidateOutput{
+		pixels: pixels,
+		needed: map[int]int{},
+		report: ValidationReport{Problems: map[string]uint64{}},
+	}
+}
+
+func (output *ValidateOutput) Name() (name string) {
+	return "validate"
+}
+
+// SetStrands derives the minimum length of the physical strands from the segments
+// of the strand mapping that have a length
+//
+func (output *ValidateOutput) SetStrands(strands StrandMap) {
+	needed := map[int]int{}
+	for _, segments := range strands {
+		for _, segment := range segments {
+			if end := segment.Offset + segment.Length; segment.Length != 0 && end > needed[segment.Channel] {
+				needed[segment.Channel] = end
+			}
+		}
+	}
+
+	output.Lock()
+	defer output.Unlock()
+
+	output.needed = needed
+}
+
+// Send checks a frame, returning the first problem found
+//
+func (output *ValidateOutput) Send(frame []animationModel.ChannelData) (err errors.Error) {
+	output.Lock()
+	defer output.Unlock()
+
+	problems := []string{}
+	problem := func(kind string, channel animationModel.OpcChannel, detail string) {
+		output.report.Problems[kind]++
+		problems = append(problems, fmt.Sprintf("channel %d %s", channel, detail))
+		if err == nil {
+			err = errors.New("invalid frame").With("problem", kind).With("channel", channel).With("detail", detail).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	sent := map[animationModel.OpcChannel]bool{}
+	for _, channelData := range frame {
+		channel := channelData.ChannelNum
+		if channel < 1 || channel > 255 {
+			problem("channel", channel, "is not a strand channel")
+		}
+		if sent[channel] {
+			problem("duplicate", channel, "was sent more than once")
+		}
+		sent[channel] = true
+
+		length := len(channelData.Data)
+		switch {
+		case length == 0:
+			problem("empty", channel, "has no pixels")
+		case length > maxStrandPixels:
+			problem("length", channel, fmt.Sprintf("has %d pixels, more than an OPC message can hold", length))
+		case output.pixels != 0 && length != output.pixels:
+			problem("length", channel, fmt.Sprintf("has %d pixels, expected %d", length, output.pixels))
+		case length < output.needed[int(channel)]:
+			problem("length", channel, fmt.Sprintf("has %d pixels, the strand mapping needs %d", length, output.needed[int(channel)]))
+		}
+
+		// Colors are premultiplied by their alpha, a component larger than
+		// the alpha is the result of an overflow or an unclamped value
+		for i, pixel := range channelData.Data {
+			if pixel.A != 0 && (pixel.R > pixel.A || pixel.G > pixel.A || pixel.B > pixel.A) {
+				problem("range", channel, fmt.Sprintf("pixel %d %v is out of range", i, pixel))
+				break
+			}
+		}
+	}
+
+	output.report.Frames++
+	if len(problems) != 0 {
+		output.report.Invalid++
+		output.report.Last = strings.Join(problems, ", ")
+		output.report.LastTime = time.Now()
+	}
+	return err
+}
+
+// setMissed records the frames the output missed because its queue was full
+//
+func (output *ValidateOutput) setMissed(missed uint64) {
+	output.Lock()
+	defer output.Unlock()
+
+	output.report.Missed = missed
+}
+
+// Report returns a copy of the summary of the frames checked so far
+//
+func (output *ValidateOutput) Report() (report ValidationReport) {
+	output.Lock()
+	defer output.Unlock()
+
+	report = output.report
+	report.Problems = make(map[string]uint64, len(output.report.Problems))
+	for kind, count := range output.report.Problems {
+		report.Problems[kind] = count
+	}
+	return report
+}
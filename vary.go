@@ -0,0 +1,155 @@
+package mawt
+
+// This module implements the variation of the parameters of show and scene effects.
+// A show or scene left running as the idle look of a long installation repeats the
+// same colors at the same speeds hour after hour, so any of the color, duration
+// and number parameters of an effect can instead be given bounds that a value is
+// drawn between each time the entry plays, and optionally again at an interval
+// while it plays.  Colors are drawn along the hue wheel between their bounds so
+// that a range from gold to orange drifts through the warm hues rather than
+// through grey.  Values drawn again while an entry plays do not restart its
+// effect, the effect built from them being faded in over the one it replaces
+
+import (
+	"image/color"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+	colorful "github.com/lucasb-eyer/go-colorful"
+
+	"github.com/TeamNorCal/mawt/sequencer"
+)
+
+const (
+	// varyGlide is the longest time taken to fade an effect into the one built from
+	// parameters drawn again, shorter vary intervals gliding for the whole interval
+	varyGlide = 10 * time.Second
+)
+
+// ParamRange bounds the values a parameter of an effect is drawn from, given in
+// the same form as the parameter, for example ff8800 and ffcc00 or 2s and 5s
+//
+type ParamRange struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+}
+
+// draw returns a value for a parameter between the bounds of the range, the kind
+// of the parameter, a color, duration or number, being that of its default value
+//
+func (bounds ParamRange) draw(name string, defaultValue string, random *rand.Rand) (value string, err errors.Error) {
+	from := map[string]string{name: bounds.From}
+	to := map[string]string{name: bounds.To}
+	t := random.Float64()
+
+	if _, errColor := showColor(map[string]string{name: defaultValue}, name); errColor == nil {
+		fromColor, err := showColor(from, name)
+		if err != nil {
+			return "", err
+		}
+		toColor, err := showColor(to, name)
+		if err != nil {
+			return "", err
+		}
+		drawn := colorful.MakeColor(fromColor).BlendHsv(colorful.MakeColor(toColor), t).Clamped()
+		return strings.TrimPrefix(drawn.Hex(), "#"), nil
+	}
+
+	if _, errGo := time.ParseDuration(defaultValue); errGo == nil {
+		fromDuration, err := showDuration(from, name)
+		if err != nil {
+			return "", err
+		}
+		toDuration, err := showDuration(to, name)
+		if err != nil {
+			return "", err
+		}
+		drawn := fromDuration + time.Duration(t*float64(toDuration-fromDuration))
+		return drawn.Round(time.Millisecond).String(), nil
+	}
+
+	if _, errGo := strconv.ParseFloat(defaultValue, 64); errGo == nil {
+		fromNumber, errGo := strconv.ParseFloat(bounds.From, 64)
+		if errGo != nil {
+			return "", errors.New("the bounds of a number must be numbers").With("param", name).With("value", bounds.From).With("stack", stack.Trace().TrimRuntime())
+		}
+		toNumber, errGo := strconv.ParseFloat(bounds.To, 64)
+		if errGo != nil {
+			return "", errors.New("the bounds of a number must be numbers").With("param", name).With("value", bounds.To).With("stack", stack.Trace().TrimRuntime())
+		}
+		drawn := fromNumber + t*(toNumber-fromNumber)
+		// Parameters taking whole numbers have defaults without a fraction
+		if !strings.Contains(defaultValue, ".") {
+			return strconv.Itoa(int(math.Round(drawn))), nil
+		}
+		return strconv.FormatFloat(drawn, 'f', 3, 64), nil
+	}
+
+	return "", errors.New("only color, duration and number parameters can be varied").With("param", name).With("stack", stack.Trace().TrimRuntime())
+}
+
+// variedEffect plays the effect of a show entry that has varied parameters.  When the
+// parameters are drawn again the effect built from them takes over from the effect
+// playing, starting at the same point so that it keeps the same phase, and the
+// frames are blended from the one to the other over the glide
+//
+type variedEffect struct {
+	effect   sequencer.Effect // The effect built from the parameters last drawn
+	previous sequencer.Effect // The effect being faded out, nil once the glide is over
+	start    time.Time        // When the effect was last started by the sequence
+	from     time.Time        // When the glide began
+	glide    time.Duration
+	buf      []color.RGBA // The frame of the previous effect
+}
+
+// Start starts the effect, along with any effect still being faded out, each time
+// the sequence runs it
+//
+func (varied *variedEffect) Start(startTime time.Time) {
+	varied.start = startTime
+	varied.effect.Start(startTime)
+	if varied.previous != nil {
+		varied.previous.Start(startTime)
+	}
+}
+
+// redraw replaces the effect with one built from parameters drawn again, fading from
+// the effect playing to the new effect over the glide
+//
+func (varied *variedEffect) redraw(effect sequencer.Effect, tm time.Time, glide time.Duration) {
+	effect.Start(varied.start)
+	varied.previous, varied.effect = varied.effect, effect
+	varied.from, varied.glide = tm, glide
+}
+
+// Frame renders the effect, blended with the effect it replaced during the glide.  The
+// effect completes a cycle when the effect built from the latest parameters does
+//
+func (varied *variedEffect) Frame(buf []color.RGBA, frameTime time.Time) (output []color.RGBA, endSeq bool) {
+	output, endSeq = varied.effect.Frame(buf, frameTime)
+	if varied.previous == nil {
+		return output, endSeq
+	}
+	fraction := float64(frameTime.Sub(varied.from)) / float64(varied.glide)
+	if varied.glide <= 0 || fraction >= 1 {
+		varied.previous, varied.buf = nil, nil
+		return output, endSeq
+	}
+
+	if len(varied.buf) != len(output) {
+		varied.buf = make([]color.RGBA, len(output))
+	}
+	previous, _ := varied.previous.Frame(varied.buf, frameTime)
+	varied.buf = previous
+	for i := range output {
+		if i < len(previous) {
+			output[i] = blendRGBA(previous[i], output[i], math.Max(0, fraction))
+		}
+	}
+	return output, endSeq
+}
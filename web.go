@@ -0,0 +1,196 @@
+package mawt
+
+// This module adapts the HTTP surfaces of the gateway for use behind a reverse
+// proxy such as nginx, and for embedding the preview and controls within other
+// dashboards.  A base path prefix added by the proxy is removed, the client
+// address, host and scheme forwarded by trusted proxies are used in place of
+// those of the proxy, and cross origin requests from the listed origins are
+// allowed, including their preflight requests which carry no credentials
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	defaultCORSMaxAge = 10 * time.Minute
+)
+
+var (
+	// forwardedHeaders are removed from requests that did not come from a trusted
+	// proxy so that clients cannot claim another address or scheme
+	forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+)
+
+// CORSConfig defines the origins allowed to use the HTTP surfaces from scripts
+//
+type CORSConfig struct {
+	Origins     []string      `yaml:"origins"`     // Allowed origins such as https://ops.example.org, * allows any origin
+	Credentials bool          `yaml:"credentials"` // Allow cookies and client certificates to be sent, cannot be used with the * origin
+	MaxAge      time.Duration `yaml:"maxAge"`      // The time browsers may cache a preflight response, defaults to 10m
+}
+
+// WebConfig defines how the HTTP surfaces are reached through proxies and other sites
+//
+type WebConfig struct {
+	BasePath       string      `yaml:"basePath"`       // Optional prefix, such as /mawt, removed from request paths when present
+	TrustedProxies []string    `yaml:"trustedProxies"` // Addresses or CIDR ranges of proxies whose forwarded headers are used
+	CORS           *CORSConfig `yaml:"cors"`           // Optional cross origin access
+}
+
+// Web applies the proxy and cross origin settings to requests
+//
+type Web struct {
+	config  WebConfig
+	proxies []*net.IPNet
+	origins map[string]bool
+}
+
+// NewWeb validates the proxy and cross origin settings
+//
+func NewWeb(config WebConfig) (web *Web, err errors.Error) {
+	config.BasePath = strings.TrimSuffix(config.BasePath, "/")
+	if len(config.BasePath) != 0 && !strings.HasPrefix(config.BasePath, "/") {
+		return nil, errors.New("the base path must begin with a slash").With("basePath", config.BasePath).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	web = &Web{config: config, origins: map[string]bool{}}
+	for _, proxy := range config.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.New("trusted proxies must be addresses or CIDR ranges").With("proxy", proxy).With("stack", stack.Trace().TrimRuntime())
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			web.proxies = append(web.proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, errGo := net.ParseCIDR(proxy)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("proxy", proxy).With("stack", stack.Trace().TrimRuntime())
+		}
+		web.proxies = append(web.proxies, ipNet)
+	}
+
+	if cors := config.CORS; cors != nil {
+		for _, origin := range cors.Origins {
+			if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+				return nil, errors.New("CORS origins must be http or https origins, or *").With("origin", origin).With("stack", stack.Trace().TrimRuntime())
+			}
+			web.origins[strings.TrimSuffix(origin, "/")] = true
+		}
+		if cors.Credentials && web.origins["*"] {
+			return nil, errors.New("CORS credentials cannot be allowed for every origin").With("stack", stack.Trace().TrimRuntime())
+		}
+		if cors.MaxAge < 0 {
+			return nil, errors.New("the CORS max age cannot be negative").With("maxAge", cors.MaxAge).With("stack", stack.Trace().TrimRuntime())
+		}
+		if cors.MaxAge == 0 {
+			cors.MaxAge = defaultCORSMaxAge
+		}
+	}
+	return web, nil
+}
+
+// Handler wraps a handler, which should include any authentication so that
+// preflight requests are answered before credentials are needed
+//
+func (web *Web) Handler(next http.Handler) (handler http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		web.forwarded(r)
+
+		if base := web.config.BasePath; len(base) != 0 {
+			if r.URL.Path == base {
+				r.URL.Path = "/"
+			} else if strings.HasPrefix(r.URL.Path, base+"/") {
+				r.URL.Path = strings.TrimPrefix(r.URL.Path, base)
+			}
+			r.URL.RawPath = ""
+		}
+
+		if web.config.CORS != nil {
+			if origin := r.Header.Get("Origin"); len(origin) != 0 && (web.origins["*"] || web.origins[origin]) {
+				header := w.Header()
+				header.Add("Vary", "Origin")
+				header.Set("Access-Control-Allow-Origin", origin)
+				if web.config.CORS.Credentials {
+					header.Set("Access-Control-Allow-Credentials", "true")
+				}
+				if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) != 0 {
+					header.Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE")
+					header.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+					header.Set("Access-Control-Max-Age", strconv.Itoa(int(web.config.CORS.MaxAge/time.Second)))
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwarded replaces the client address and host of requests from trusted proxies
+// with those forwarded by the proxy, and removes the forwarded headers from other
+// requests
+//
+func (web *Web) forwarded(r *http.Request) {
+	if !web.trusted(r.RemoteAddr) {
+		for _, header := range forwardedHeaders {
+			r.Header.Del(header)
+		}
+		return
+	}
+
+	// The client is the last address added by a proxy that is not itself trusted
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); len(forwardedFor) != 0 {
+		hops := strings.Split(forwardedFor, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			r.RemoteAddr = net.JoinHostPort(hop, "0")
+			if !web.trusted(r.RemoteAddr) {
+				break
+			}
+		}
+	}
+	if host := r.Header.Get("X-Forwarded-Host"); len(host) != 0 {
+		r.Host = host
+	}
+}
+
+// trusted tests whether an address is one of the trusted proxies
+//
+func (web *Web) trusted(addr string) (isTrusted bool) {
+	host, _, errGo := net.SplitHostPort(addr)
+	if errGo != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range web.proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecureRequest tests whether a request reached the gateway, or the trusted proxy
+// in front of it, using TLS
+//
+func SecureRequest(r *http.Request) (secure bool) {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
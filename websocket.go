@@ -0,0 +1,182 @@
+package mawt
+
+// This module implements an output that streams frames to browsers using a
+// WebSocket.  Only what the preview needs of RFC 6455 is implemented, the
+// server sends each frame as a single binary message containing a full frame
+// record, as described in frames.go, and anything sent by the client other
+// than a close is ignored
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	animationModel "github.com/TeamNorCal/animation/model"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+)
+
+// WebSocketOutput mirrors frames to any number of connected WebSocket clients
+//
+type WebSocketOutput struct {
+	clients map[net.Conn]bool
+	enc     *FrameEncoder // Writes every frame in full as clients may join at any time
+	sync.Mutex
+}
+
+// NewWebSocketOutput creates an output with no clients, clients are added by
+// serving HTTP upgrade requests using the output as a handler.  Frames are tagged
+// with the universe
+//
+func NewWebSocketOutput(universe uint16) (output *WebSocketOutput) {
+	enc, _ := NewFrameEncoder("none", 1)
+	enc.Universe = universe
+	return &WebSocketOutput{
+		clients: map[net.Conn]bool{},
+		enc:     enc,
+	}
+}
+
+func (output *WebSocketOutput) Name() (name string) {
+	return "websocket"
+}
+
+// ServeHTTP upgrades the request to a WebSocket that frames are then streamed to
+//
+func (output *WebSocketOutput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || len(key) == 0 {
+		http.Error(w, "a WebSocket upgrade is required", http.StatusBadRequest)
+		return
+	}
+	hijacker, isOK := w.(http.Hijacker)
+	if !isOK {
+		http.Error(w, "WebSockets are not supported by this server", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, errGo := hijacker.Hijack()
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accept := sha1.Sum([]byte(key + webSocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if errGo = rw.Flush(); errGo != nil {
+		conn.Close()
+		return
+	}
+
+	output.Lock()
+	output.clients[conn] = true
+	output.Unlock()
+
+	go output.discard(conn, rw.Reader)
+}
+
+// discard reads and ignores the messages sent by a client, removing the client
+// once it closes the connection
+//
+func (output *WebSocketOutput) discard(conn net.Conn, reader *bufio.Reader) {
+	defer output.remove(conn)
+
+	header := make([]byte, 2)
+	for {
+		if _, errGo := io.ReadFull(reader, header); errGo != nil {
+			return
+		}
+		if header[0]&0x0F == wsOpClose {
+			return
+		}
+
+		length := int64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, errGo := io.ReadFull(reader, ext); errGo != nil {
+				return
+			}
+			length = int64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, errGo := io.ReadFull(reader, ext); errGo != nil {
+				return
+			}
+			length = int64(binary.BigEndian.Uint64(ext))
+		}
+		// Client frames are always masked
+		if header[1]&0x80 != 0 {
+			length += 4
+		}
+		if _, errGo := io.CopyN(ioutil.Discard, reader, length); errGo != nil {
+			return
+		}
+	}
+}
+
+func (output *WebSocketOutput) remove(conn net.Conn) {
+	output.Lock()
+	defer output.Unlock()
+
+	if output.clients[conn] {
+		delete(output.clients, conn)
+		conn.Close()
+	}
+}
+
+// Send streams a frame to all of the connected clients, clients that cannot accept
+// the frame within a second are disconnected
+//
+func (output *WebSocketOutput) Send(frame []animationModel.ChannelData) (err errors.Error) {
+	output.Lock()
+	clients := make([]net.Conn, 0, len(output.clients))
+	for conn := range output.clients {
+		clients = append(clients, conn)
+	}
+	output.Unlock()
+
+	if len(clients) == 0 {
+		return nil
+	}
+
+	payload, err := output.enc.Encode(frame, time.Now())
+	if err != nil {
+		return err
+	}
+
+	msg := []byte{0x80 | wsOpBinary}
+	switch {
+	case len(payload) < 126:
+		msg = append(msg, byte(len(payload)))
+	case len(payload) < 65536:
+		msg = append(msg, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(len(payload)))
+		msg = append(append(msg, 127), ext...)
+	}
+	msg = append(msg, payload...)
+
+	for _, conn := range clients {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, errGo := conn.Write(msg); errGo != nil {
+			output.remove(conn)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package mawt
+
+// This module finds where the values of a YAML document appear in its text, so
+// that problems found once the document has been decoded can be reported using the
+// line and column a show author sees in their editor.  The YAML decoder does not
+// keep the positions of the values it decodes, so the document is scanned for its
+// keys and sequence items using their indentation, following the block and flow
+// styles used by configuration files.  Positions are a guide for people, a value
+// that cannot be found being reported at the closest enclosing value that was
+
+import (
+	"fmt"
+	"strings"
+)
+
+// yamlPosition is the line and column, counted from 1, that a value starts at
+//
+type yamlPosition struct {
+	Line   int
+	Column int
+}
+
+// yamlPath returns the path of a field within a mapping
+//
+func yamlPath(path string, key string) (child string) {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// locate returns the position of a path, or of the closest enclosing path that was
+// found when the path itself was not
+//
+func locate(positions map[string]yamlPosition, path string) (position yamlPosition) {
+	for len(path) != 0 {
+		if position, isPresent := positions[path]; isPresent {
+			return position
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return yamlPosition{Line: 1, Column: 1}
+}
+
+// yamlPositions returns the positions of the keys and sequence items of a YAML
+// document by their paths, for example pipelines[0].show.playlist[2].duration
+//
+func yamlPositions(data []byte) (positions map[string]yamlPosition) {
+	type frame struct {
+		indent int
+		path   string
+		isSeq  bool
+		index  int
+	}
+
+	positions = map[string]yamlPosition{}
+	stack := []*frame{}
+	pending := ""     // The path of the value whose contents are expected to follow
+	blockIndent := -1 // The indentation lines of a block scalar being skipped must exceed
+
+	lines := strings.Split(string(data), "\n")
+	for n := 0; n < len(lines); n++ {
+		line := strings.TrimRight(lines[n], "\r")
+		content := strings.TrimLeft(line, " ")
+		column := len(line) - len(content)
+
+		if blockIndent >= 0 {
+			if len(strings.TrimSpace(content)) == 0 || column > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if len(content) == 0 || content[0] == '#' || content[0] == '%' || strings.HasPrefix(content, "...") {
+			continue
+		}
+		if strings.HasPrefix(content, "---") {
+			stack, pending = stack[:0], ""
+			continue
+		}
+
+		// A line can hold a sequence item followed by the first key of the mapping
+		// it holds, each being handled in turn
+		for len(content) != 0 {
+			for len(stack) != 0 && stack[len(stack)-1].indent > column {
+				stack = stack[:len(stack)-1]
+			}
+			isItem := content == "-" || strings.HasPrefix(content, "- ")
+			if len(stack) != 0 && stack[len(stack)-1].indent == column && stack[len(stack)-1].isSeq && !isItem {
+				stack = stack[:len(stack)-1]
+			}
+
+			if isItem {
+				if len(stack) != 0 && stack[len(stack)-1].indent == column && stack[len(stack)-1].isSeq {
+					stack[len(stack)-1].index++
+				} else {
+					stack = append(stack, &frame{indent: column, path: pending, isSeq: true})
+				}
+				top := stack[len(stack)-1]
+				pending = fmt.Sprintf("%s[%d]", top.path, top.index)
+
+				rest := strings.TrimLeft(content[1:], " ")
+				column += len(content) - len(rest)
+				content = rest
+				if len(content) != 0 && content[0] != '#' {
+					positions[pending] = yamlPosition{Line: n + 1, Column: column + 1}
+				}
+				continue
+			}
+
+			key, value, offset, isKey := splitYAMLKey(content)
+			if isKey {
+				if len(stack) == 0 || stack[len(stack)-1].indent != column || stack[len(stack)-1].isSeq {
+					stack = append(stack, &frame{indent: column, path: pending})
+				}
+				pending = yamlPath(stack[len(stack)-1].path, key)
+				positions[pending] = yamlPosition{Line: n + 1, Column: column + 1}
+				column += offset
+				content = value
+			}
+
+			switch {
+			case len(content) == 0 || content[0] == '#':
+			case content[0] == '|' || content[0] == '>':
+				blockIndent = stack[len(stack)-1].indent
+			case content[0] == '{' || content[0] == '[':
+				n = flowPositions(lines, n, column, pending, positions)
+			}
+			break
+		}
+	}
+	return positions
+}
+
+// splitYAMLKey splits a line holding a key of a block mapping into the key and the
+// value that follows it, along with the offset of the value within the line
+//
+func splitYAMLKey(content string) (key string, value string, offset int, isKey bool) {
+	end := 0
+	switch content[0] {
+	case '"', '\'':
+		closing := strings.IndexByte(content[1:], content[0])
+		if closing < 0 {
+			return "", "", 0, false
+		}
+		key = content[1 : closing+1]
+		end = closing + 2
+		if end >= len(content) || content[end] != ':' {
+			return "", "", 0, false
+		}
+	case '{', '[', '#', '&', '*', '!', '|', '>', '?':
+		return "", "", 0, false
+	default:
+		for end = 0; end < len(content); end++ {
+			if content[end] == '#' && end > 0 && content[end-1] == ' ' {
+				return "", "", 0, false
+			}
+			if content[end] == ':' && (end+1 == len(content) || content[end+1] == ' ' || content[end+1] == '\t') {
+				break
+			}
+		}
+		if end == len(content) {
+			return "", "", 0, false
+		}
+		key = strings.TrimSpace(content[:end])
+	}
+	value = strings.TrimLeft(content[end+1:], " \t")
+	return key, value, len(content) - len(value), true
+}
+
+// flowPositions records the positions of the keys and items of a flow mapping or
+// sequence starting at a column of a line, returning the line it ends on
+//
+func flowPositions(lines []string, n int, column int, path string, positions map[string]yamlPosition) (last int) {
+	type frame struct {
+		path    string
+		isSeq   bool
+		index   int
+		key     string
+		inValue bool
+	}
+
+	stack := []*frame{}
+	element := func() (elementPath string) {
+		if len(stack) == 0 {
+			return path
+		}
+		top := stack[len(stack)-1]
+		if top.isSeq {
+			return fmt.Sprintf("%s[%d]", top.path, top.index)
+		}
+		if top.inValue {
+			return yamlPath(top.path, top.key)
+		}
+		return top.path
+	}
+
+	for ; n < len(lines); n, column = n+1, 0 {
+		line := lines[n]
+		for i := column; i < len(line); i++ {
+			switch c := line[i]; {
+			case c == ' ' || c == '\t' || c == '\r':
+			case c == '#' && (i == 0 || line[i-1] == ' '):
+				i = len(line)
+			case c == '{' || c == '[':
+				if len(stack) != 0 && stack[len(stack)-1].isSeq {
+					positions[element()] = yamlPosition{Line: n + 1, Column: i + 1}
+				}
+				stack = append(stack, &frame{path: element(), isSeq: c == '['})
+			case c == '}' || c == ']':
+				stack = stack[:len(stack)-1]
+				if len(stack) == 0 {
+					return n
+				}
+			case c == ',':
+				top := stack[len(stack)-1]
+				if top.isSeq {
+					top.index++
+				}
+				top.key, top.inValue = "", false
+			case c == ':':
+				stack[len(stack)-1].inValue = true
+			default:
+				// A scalar, quoted or plain, ending at the next flow indicator
+				start := i
+				if c == '"' || c == '\'' {
+					for i++; i < len(line) && line[i] != c; i++ {
+						if c == '"' && line[i] == '\\' {
+							i++
+						}
+					}
+				} else {
+					for ; i+1 < len(line) && !strings.ContainsRune(",[]{}", rune(line[i+1])); i++ {
+						if line[i+1] == ':' && (i+2 == len(line) || strings.ContainsRune(" ,]}", rune(line[i+2]))) {
+							break
+						}
+					}
+				}
+				if len(stack) == 0 {
+					continue
+				}
+				top := stack[len(stack)-1]
+				switch {
+				case top.isSeq:
+					positions[element()] = yamlPosition{Line: n + 1, Column: start + 1}
+				case !top.inValue:
+					end := i + 1
+					if end > len(line) {
+						end = len(line)
+					}
+					top.key = strings.Trim(strings.TrimSpace(line[start:end]), `"'`)
+					positions[yamlPath(top.path, top.key)] = yamlPosition{Line: n + 1, Column: start + 1}
+				}
+			}
+		}
+	}
+	return len(lines) - 1
+}